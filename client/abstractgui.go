@@ -2,6 +2,8 @@
 
 package main
 
+import "github.com/agl/pond/client/core"
+
 const uiActionsQueueLen = 256
 
 // GUI contains an abstraction layer that models GTK pretty closely.  This is
@@ -142,7 +144,7 @@ type Button struct {
 	widgetBase
 	text   string
 	markup string
-	image  Indicator
+	image  core.Indicator
 }
 
 type Spinner struct {
@@ -199,11 +201,15 @@ type RadioGroup struct {
 
 type Calendar struct {
 	widgetBase
+	// date, if not zero, is the initially selected date. Otherwise the
+	// current date is selected.
+	date CalendarDate
 }
 
 type SpinButton struct {
 	widgetBase
 	min, max, step float64
+	value          float64
 }
 
 type CheckButton struct {
@@ -214,7 +220,7 @@ type CheckButton struct {
 
 type Image struct {
 	widgetBase
-	image          Indicator
+	image          core.Indicator
 	xAlign, yAlign float32
 }
 
@@ -314,7 +320,7 @@ type SetTextView struct {
 
 type SetImage struct {
 	name  string
-	image Indicator
+	image core.Indicator
 }
 
 type SetFocus struct {
@@ -394,6 +400,8 @@ type Click struct {
 	spinButtons map[string]int
 }
 
+// CalendarDate is a date as selected in a Calendar. Note that month is zero
+// based, as in GTK.
 type CalendarDate struct {
 	year, month, day int
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/agl/pond/client/core"
+	"github.com/agl/pond/client/disk"
+)
+
+// A batchClient performs a single action, given on the command line, and
+// then exits. It's intended to be used from scripts and so never prompts:
+// the passphrase is read from a file descriptor and conditions that would
+// cause another UI to wait, like a state file that's locked by a running
+// client, are errors.
+
+// batchActions maps the names of actions to the number of arguments that
+// they take and a usage string.
+var batchActions = map[string]struct {
+	minArgs, maxArgs int
+	usage            string
+}{
+	"send":     {1, 2, "send <contact or group> [file]: send the contents of file, or stdin, to a contact or the members of a group"},
+	"inbox":    {0, 0, "inbox: list the inbox as JSON"},
+	"show":     {1, 1, "show <id>: print the inbox message with the given id"},
+	"transact": {0, 0, "transact: perform a single network transaction"},
+}
+
+type batchClient struct {
+	core.Client
+
+	// passphrase is used to decrypt the state file.
+	passphrase string
+	// action is the name of the action to perform and args contains its
+	// arguments.
+	action string
+	args   []string
+	// in is read when sending a message without a filename and out
+	// receives the output of the action.
+	in  io.Reader
+	out io.Writer
+	// err contains the result of the action.
+	err error
+	// lastError contains the last error reported via ErrorUI.
+	lastError string
+}
+
+func NewBatchClient(stateFilename string, rand io.Reader, testing bool, args []string) (*batchClient, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no action given")
+	}
+	action, ok := batchActions[args[0]]
+	if !ok {
+		return nil, errors.New("unknown action: " + args[0])
+	}
+	if n := len(args) - 1; n < action.minArgs || n > action.maxArgs {
+		return nil, errors.New("usage: " + action.usage)
+	}
+
+	c := &batchClient{
+		Client: core.Client{
+			Testing:            testing,
+			Dev:                testing,
+			StateFilename:      stateFilename,
+			LocalOnly:          args[0] != "transact",
+			Log:                core.NewLog(),
+			Rand:               rand,
+			Contacts:           make(map[uint64]*core.Contact),
+			Drafts:             make(map[uint64]*core.Draft),
+			NewMessageChan:     make(chan core.NewMessage),
+			MessageSentChan:    make(chan core.MessageSendResult, 1),
+			BackgroundChan:     make(chan interface{}, 8),
+			PandaChan:          make(chan core.PandaUpdate, 1),
+			UsedIds:            make(map[uint64]bool),
+			SigningRequestChan: make(chan core.SigningRequest),
+		},
+		action: args[0],
+		args:   args[1:],
+		in:     os.Stdin,
+		out:    os.Stdout,
+	}
+	c.UI = c
+
+	c.NewMeetingPlace = c.HTTPMeetingPlace
+	c.Log.ToStderr = false
+	return c, nil
+}
+
+// runBatch performs the action given in args and exits the process with a
+// status that reflects whether it succeeded.
+func runBatch(stateFile string, passphraseFd int, args []string, dev bool) {
+	client, err := NewBatchClient(stateFile, rand.Reader, false /* testing */, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
+	}
+	if passphraseFd >= 0 {
+		pw, err := readPassphrase(passphraseFd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read passphrase: %s\n", err)
+			os.Exit(1)
+		}
+		client.passphrase = pw
+	}
+	client.DisableV2Ratchet = true
+	client.Dev = dev
+
+	if err := client.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Start loads the state file, performs the action and waits for any changes
+// to be written to disk.
+func (c *batchClient) Start() error {
+	err := c.LoadUI()
+
+	if c.WriterChan != nil {
+		close(c.WriterChan)
+		<-c.WriterDone
+	}
+	if c.FetchNowChan != nil {
+		close(c.FetchNowChan)
+	}
+	if c.StateLock != nil {
+		c.StateLock.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+	return c.err
+}
+
+func (c *batchClient) InitUI() {
+}
+
+func (c *batchClient) LoadingUI() {
+}
+
+func (c *batchClient) TorPromptUI() error {
+	if c.LocalOnly {
+		// Other actions don't use the network.
+		return nil
+	}
+	return errors.New("cannot find Tor")
+}
+
+// SleepUI is only called while waiting for a condition that has been
+// reported via ErrorUI. Rather than wait, a batchClient fails with that
+// error.
+func (c *batchClient) SleepUI(d time.Duration) error {
+	return errors.New(c.lastError)
+}
+
+func (c *batchClient) ErrorUI(msg string, fatal bool) {
+	c.lastError = msg
+}
+
+func (c *batchClient) ShutdownAndSuspend() error {
+	return errors.New(c.lastError)
+}
+
+func (c *batchClient) CreatePassphraseUI() (string, error) {
+	return "", errors.New("state file doesn't exist")
+}
+
+func (c *batchClient) CreateErasureStorage(pw string, stateFile *disk.StateFile) error {
+	return nil
+}
+
+func (c *batchClient) CreateAccountUI(stateFile *disk.StateFile, pw string) (bool, error) {
+	return false, errors.New("state file doesn't exist")
+}
+
+func (c *batchClient) KeyPromptUI(stateFile *disk.StateFile) error {
+	if len(c.passphrase) == 0 {
+		return errors.New("state file is encrypted and no passphrase was given")
+	}
+	err := c.LoadState(stateFile, c.passphrase)
+	if err == disk.BadPasswordError {
+		return errors.New("incorrect passphrase")
+	}
+	return err
+}
+
+func (c *batchClient) ProcessFetch(msg *core.InboxMessage) {
+}
+
+func (c *batchClient) ProcessServerAnnounce(msg *core.InboxMessage) {
+}
+
+func (c *batchClient) ProcessAcknowledgement(msg *core.QueuedMessage) {
+}
+
+func (c *batchClient) ProcessRevocationOfUs(by *core.Contact) {
+}
+
+func (c *batchClient) ProcessRevocation(by *core.Contact) {
+}
+
+func (c *batchClient) ProcessPANDAUpdateUI(update core.PandaUpdate) {
+}
+
+func (c *batchClient) ProcessMessageDelivered(msg *core.QueuedMessage) {
+}
+
+func (c *batchClient) ProcessMessageUndeliverable(msg *core.QueuedMessage) {
+}
+
+func (c *batchClient) ProcessDraftSent(draft *core.Draft, id uint64, err error) {
+}
+
+func (c *batchClient) RemoveInboxMessageUI(msg *core.InboxMessage) {
+}
+
+func (c *batchClient) RemoveOutboxMessageUI(msg *core.QueuedMessage) {
+}
+
+func (c *batchClient) AddRevocationMessageUI(msg *core.QueuedMessage) {
+}
+
+func (c *batchClient) RemoveContactUI(contact *core.Contact) {
+}
+
+func (c *batchClient) LogEventUI(contact *core.Contact, event core.Event) {
+}
+
+func (c *batchClient) MainUI() {
+	switch c.action {
+	case "send":
+		c.err = c.sendAction()
+	case "inbox":
+		c.err = c.inboxAction()
+	case "show":
+		c.err = c.showAction()
+	case "transact":
+		c.err = c.transactAction()
+	}
+}
+
+func (c *batchClient) sendAction() error {
+	recipients, err := c.ResolveRecipients(c.args[0])
+	if err != nil {
+		return err
+	}
+	for _, id := range recipients {
+		if c.Contacts[id].RevokedUs {
+			return errors.New("cannot send message to contact who has revoked us")
+		}
+	}
+
+	var body []byte
+	if len(c.args) > 1 {
+		body, err = ioutil.ReadFile(c.args[1])
+	} else {
+		body, err = ioutil.ReadAll(c.in)
+	}
+	if err != nil {
+		return err
+	}
+
+	draft := &core.Draft{
+		Id:      c.RandId(),
+		Created: c.Now(),
+		Body:    string(body),
+	}
+	draft.SetRecipients(recipients)
+	id, _, err := c.SendDraft(draft)
+	if err != nil {
+		return err
+	}
+	c.Save()
+
+	fmt.Fprintf(c.out, "%d\n", id)
+	return nil
+}
+
+func (c *batchClient) inboxAction() error {
+	inbox := make([]*inboxInfo, 0, len(c.Inbox))
+	for _, msg := range c.Inbox {
+		if msg.Message != nil && len(msg.Message.Body) == 0 {
+			// Skip acks.
+			continue
+		}
+		inbox = append(inbox, inboxJSON(&c.Client, msg))
+	}
+
+	out, err := json.MarshalIndent(inbox, "", "  ")
+	if err != nil {
+		return err
+	}
+	out = append(out, '\n')
+	_, err = c.out.Write(out)
+	return err
+}
+
+func (c *batchClient) showAction() error {
+	id, err := strconv.ParseUint(c.args[0], 10, 64)
+	if err != nil {
+		return errors.New("invalid message id: " + c.args[0])
+	}
+
+	var msg *core.InboxMessage
+	for _, candidate := range c.Inbox {
+		if candidate.Id == id {
+			msg = candidate
+			break
+		}
+	}
+	if msg == nil {
+		return errors.New("no such inbox message")
+	}
+
+	sentTime, eraseTime, body := c.InboxStrings(msg)
+	fmt.Fprintf(c.out, "From: %s\n", c.ContactName(msg.From))
+	fmt.Fprintf(c.out, "Sent: %s\n", sentTime)
+	fmt.Fprintf(c.out, "Erase: %s\n", eraseTime)
+	fmt.Fprintf(c.out, "Retain: %t\n", msg.Retained)
+	if msg.Message != nil {
+		for _, attachment := range msg.Message.Files {
+			fmt.Fprintf(c.out, "Attachment: %s (%d bytes)\n", attachment.GetFilename(), len(attachment.Contents))
+		}
+		for _, detachment := range msg.Message.DetachedFiles {
+			fmt.Fprintf(c.out, "Detachment: %s (%d bytes)\n", detachment.GetFilename(), detachment.GetSize())
+		}
+	}
+	fmt.Fprintf(c.out, "\n%s\n", body)
+
+	if !msg.Read {
+		msg.MarkRead(c.Now())
+		c.Save()
+	}
+	return nil
+}
+
+// transactAction triggers a single network transaction and processes the
+// results until it has completed.
+func (c *batchClient) transactAction() error {
+	ackChan := make(chan bool)
+	c.FetchNowChan <- ackChan
+
+	processMessageSent := func(msr core.MessageSendResult) {
+		if msr.Id != 0 {
+			c.ProcessMessageSent(msr)
+		}
+	}
+
+	for {
+		select {
+		case sigReq := <-c.SigningRequestChan:
+			c.ProcessSigningRequest(sigReq)
+		case newMessage := <-c.NewMessageChan:
+			c.ProcessNewMessage(newMessage)
+		case msr := <-c.MessageSentChan:
+			processMessageSent(msr)
+		case update := <-c.PandaChan:
+			c.ProcessPANDAUpdate(update)
+		case event := <-c.BackgroundChan:
+			c.ProcessTransferEvent(event)
+		case <-c.Log.UpdateChan:
+		case <-ackChan:
+			// The result of sending a message may be waiting.
+			select {
+			case msr := <-c.MessageSentChan:
+				processMessageSent(msr)
+			default:
+			}
+			return nil
+		}
+	}
+}
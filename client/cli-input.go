@@ -34,34 +34,67 @@ const (
 var cliCommands = []cliCommand{
 	{"abort", abortCommand{}, "Abort sending the current outbox message", contextOutbox},
 	{"acknowledge", ackCommand{}, "Acknowledge the inbox message", contextInbox},
+	{"add-recipient", addRecipientCommand{}, "Add a contact, or the members of a group, to the recipients of the current draft", contextDraft},
+	{"add-to-group", addToGroupCommand{}, "Add the current contact to a group, creating it if needed", contextContact},
 	{"attach", attachCommand{}, "Attach a file to the current draft", contextDraft},
+	{"burst", burstCommand{}, "After sending, make a number of network transactions at a shorter mean interval, such as 'burst 5 20s'. A count of 0 disables bursts", 0},
+	{"cancel-transfer", cancelTransferCommand{}, "Cancel a numbered upload or download", 0},
 	{"clear", clearCommand{}, "Clear terminal", 0},
 	{"close", closeCommand{}, "Close currently opened object", contextDraft | contextInbox | contextOutbox | contextContact},
 	{"compose", composeCommand{}, "Compose a new message", contextContact},
 	{"contacts", showContactsCommand{}, "Show all known contacts", 0},
+	{"cover-traffic", coverTrafficCommand{}, "Send discardable messages to yourself, 'on' or 'off', so that the rate of sending doesn't reveal when you send messages", 0},
 	{"delete", deleteCommand{}, "Delete a message or contact", contextContact | contextDraft | contextInbox | contextOutbox},
 	{"download", downloadCommand{}, "Download a numbered detachment to disk", contextInbox},
 	{"drafts", showDraftsSummaryCommand{}, "Show drafts", 0},
 	{"edit", editCommand{}, "Edit the draft message", contextDraft},
+	{"forward", forwardCommand{}, "Forward the current message, with its attachments, to a contact or group", contextInbox},
+	{"groups", showGroupsCommand{}, "Show contact groups", 0},
+	{"expiry", expiryCommand{}, "Ask recipients to erase the current draft after a time, such as 1h or 2d, or 'none'", contextDraft},
 	{"help", helpCommand{}, "List known commands", 0},
+	{"hook", hookCommand{}, "Set the command that's run when an event occurs, or 'none' to remove it. The command is given a JSON description of the event, which includes message bodies only with --include-body", 0},
+	{"hooks", showHooksCommand{}, "Show the commands that are run when events occur", 0},
+	{"identities", showIdentitiesCommand{}, "Show the identities that are loaded", 0},
 	{"identity", showIdentityCommand{}, "Show identity", 0},
 	{"inbox", showInboxSummaryCommand{}, "Show the Inbox", 0},
+	{"interval", intervalCommand{}, "Set the mean time between network transactions, such as 1m or 30m, or 'default'", 0},
 	{"log", logCommand{}, "Show recent log entries", 0},
+	{"network", showNetworkCommand{}, "Show the proxy configuration", 0},
 	{"new-contact", newContactCommand{}, "Start a key exchange with a new contact", 0},
+	{"offline", offlineCommand{}, "Stop all network activity. Messages are queued until the next sync", 0},
+	{"online", onlineCommand{}, "Leave offline mode and resume network activity", 0},
 	{"outbox", showOutboxSummaryCommand{}, "Show the Outbox", 0},
+	{"pause", pauseCommand{}, "Stop making network transactions on a timer", 0},
+	{"proxy", proxyCommand{}, "Set the default proxy: tor, tor://host:port, socks5://[user:pass@]host:port, http://[user:pass@]host:port or direct", 0},
 	{"queue", showQueueStateCommand{}, "Show the queue", 0},
+	{"quiet-hours", quietHoursCommand{}, "Set local times between which no network transactions are made, such as 22:00-07:00, or 'none'", 0},
 	{"quit", quitCommand{}, "Exit Pond", 0},
 	{"remove", removeCommand{}, "Remove an attachment or detachment from a draft message", contextDraft},
+	{"remove-from-group", removeFromGroupCommand{}, "Remove the current contact from a group", contextContact},
+	{"remove-recipient", removeRecipientCommand{}, "Remove a contact from the recipients of the current draft", contextDraft},
 	{"rename", renameCommand{}, "Rename an existing contact", contextContact},
 	{"reply", replyCommand{}, "Reply to the current message", contextInbox},
+	{"resume", resumeCommand{}, "Resume making network transactions on a timer", 0},
 	{"retain", retainCommand{}, "Retain the current message", contextInbox},
+	{"retention", retentionCommand{}, "Set how long messages from (inbox) or to (outbox) the current contact are kept: default, forever, a number of days such as 30d, or hours after reading such as read+12h", contextContact},
+	{"retain-anyway", retainAnywayCommand{}, "Retain the current message even though the sender asked for it to be erased", contextInbox},
 	{"dont-retain", dontRetainCommand{}, "Do not retain the current message", contextInbox},
 	{"save", saveCommand{}, "Save a numbered attachment to disk", contextInbox},
 	{"save-key", saveKeyCommand{}, "Save the key to a detachment to disk", contextInbox},
+	{"search", searchCommand{}, "Search messages, attachment names and contacts for words, quoting several words like \"lunch friday\"", 0},
 	{"send", sendCommand{}, "Send the current draft", contextDraft},
+	{"send-after", sendAfterCommand{}, "Hold the current draft, once sent, until a time such as \"2006-01-02 15:04\", a delay such as +3h, or 'none'", contextDraft},
+	{"send-delay", sendDelayCommand{}, "Delay transmission of the current draft, once sent, by a random time up to a duration such as 6h or 1d, or 'none'", contextDraft},
+	{"server-carrier", serverCarrierCommand{}, "Reach a single server via a WebSocket endpoint, such as wss://example.com/pond, or 'none' to connect to it directly", 0},
+	{"server-proxy", serverProxyCommand{}, "Set the proxy for a single server, or 'default' to remove it", 0},
 	{"show", showCommand{}, "Show the current object", contextDraft | contextInbox | contextOutbox | contextContact},
 	{"status", statusCommand{}, "Show overall Pond status", 0},
+	{"sync", syncCommand{}, "While offline, make enough network transactions to send the queue and fetch new messages, and upload the attachments of drafts waiting to be sent, then return to offline", 0},
+	{"switch-identity", switchIdentityCommand{}, "Send commands to another loaded identity, given by name or number", 0},
+	{"thread", threadCommand{}, "Show the conversation that the current message is part of, or all conversations with the current contact", contextInbox | contextOutbox | contextContact},
 	{"transact-now", transactNowCommand{}, "Perform a network transaction now", 0},
+	{"transfers", showTransfersCommand{}, "Show uploads and downloads that are in progress", 0},
+	{"undeliverable-after", undeliverableAfterCommand{}, "Set how long a server must keep failing, such as 3d, before messages to it are flagged as undeliverable, or 'default'", 0},
 	{"upload", uploadCommand{}, "Upload a file to home server and include key in current draft", contextDraft},
 }
 
@@ -73,21 +106,37 @@ type composeCommand struct{}
 type deleteCommand struct{}
 type editCommand struct{}
 type logCommand struct{}
+type offlineCommand struct{}
+type onlineCommand struct{}
+type pauseCommand struct{}
 type quitCommand struct{}
 type replyCommand struct{}
+type resumeCommand struct{}
 type retainCommand struct{}
+type retainAnywayCommand struct{}
 type dontRetainCommand struct{}
 type sendCommand struct{}
 type showCommand struct{}
 type showContactsCommand struct{}
 type showDraftsSummaryCommand struct{}
+type showGroupsCommand struct{}
+type showHooksCommand struct{}
+type showIdentitiesCommand struct{}
 type showIdentityCommand struct{}
+type showNetworkCommand struct{}
 type showInboxSummaryCommand struct{}
 type showOutboxSummaryCommand struct{}
 type showQueueStateCommand struct{}
+type showTransfersCommand struct{}
 type statusCommand struct{}
+type syncCommand struct{}
+type threadCommand struct{}
 type transactNowCommand struct{}
 
+type switchIdentityCommand struct {
+	Identity string
+}
+
 type newContactCommand struct {
 	Name string
 }
@@ -96,6 +145,47 @@ type renameCommand struct {
 	NewName string
 }
 
+type expiryCommand struct {
+	Duration string
+}
+
+type searchCommand struct {
+	Query string
+}
+
+type sendAfterCommand struct {
+	When string
+}
+
+type sendDelayCommand struct {
+	Window string
+}
+
+type retentionCommand struct {
+	Which  string
+	Policy string
+}
+
+type addRecipientCommand struct {
+	Name string
+}
+
+type forwardCommand struct {
+	Name string
+}
+
+type removeRecipientCommand struct {
+	Name string
+}
+
+type addToGroupCommand struct {
+	Group string
+}
+
+type removeFromGroupCommand struct {
+	Group string
+}
+
 type attachCommand struct {
 	Filename string `cli:"filename"`
 }
@@ -123,6 +213,55 @@ type removeCommand struct {
 	Number string
 }
 
+type cancelTransferCommand struct {
+	Number string
+}
+
+type coverTrafficCommand struct {
+	State string
+}
+
+type undeliverableAfterCommand struct {
+	Duration string
+}
+
+type intervalCommand struct {
+	Interval string
+}
+
+type burstCommand struct {
+	Count    string
+	Interval string
+}
+
+type quietHoursCommand struct {
+	Hours string
+}
+
+type hookCommand struct {
+	Event       string
+	Command     string `cli:"filename"`
+	IncludeBody bool   `flag:include-body`
+}
+
+type proxyCommand struct {
+	Proxy             string
+	Isolate           bool `flag:isolate`
+	AcknowledgeDirect bool `flag:acknowledge-direct`
+}
+
+type serverCarrierCommand struct {
+	Server  string
+	Carrier string
+}
+
+type serverProxyCommand struct {
+	Server            string
+	Proxy             string
+	Isolate           bool `flag:isolate`
+	AcknowledgeDirect bool `flag:acknowledge-direct`
+}
+
 type tagCommand struct {
 	tag string
 }
@@ -11,10 +11,12 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/agl/pond/client/core"
 	"github.com/agl/pond/client/disk"
 	"github.com/agl/pond/client/system"
 	"github.com/agl/pond/panda"
@@ -32,15 +34,15 @@ const (
 )
 
 type cliClient struct {
-	client
+	core.Client
 
 	term        *terminal.Terminal
 	termWrapper *terminalWrapper
 	input       *cliInput
 	interrupt   chan bool
 	// cliIdsAssigned contains cliIds that have been used in the current
-	// session to avoid giving the same cliId to two different objects.
-	cliIdsAssigned map[cliId]bool
+	// session to avoid giving the same CliId to two different objects.
+	cliIdsAssigned map[core.CliId]bool
 
 	// deleteArmed is set to true after an attempt to delete a contact. The
 	// first attempt sets this flag, the second will actually delete a
@@ -51,10 +53,41 @@ type cliClient struct {
 	// currentObj is either a *Draft or *InboxMessage and is the object
 	// that the user is currently interacting with.
 	currentObj interface{}
+
+	// identities is non-nil when several identities share the terminal,
+	// in which case identityName is the name of this one and commands
+	// arrive on lines rather than being read from the terminal. See
+	// identities.go.
+	identities   *cliIdentities
+	identityName string
+	lines        chan cliTerminalLine
+	// ready, if not nil, is closed when the state has been unlocked and
+	// MainUI has started.
+	ready chan struct{}
 }
 
+// Printf writes to the terminal. When several identities share the terminal,
+// output from identities other than the selected one is prefixed with the
+// name of the identity.
 func (c *cliClient) Printf(format string, args ...interface{}) {
-	c.term.Write([]byte(fmt.Sprintf(format, args...)))
+	s := fmt.Sprintf(format, args...)
+	if c.identities != nil && !c.identities.isSelected(c) {
+		s = fmt.Sprintf("%s(%s)%s %s", termGray, terminalEscape(c.identityName, false), termReset, s)
+	}
+	c.term.Write([]byte(s))
+}
+
+// setPrompt sets the terminal prompt, which includes the name of the identity
+// when several identities share the terminal. Identities other than the
+// selected one don't change the prompt.
+func (c *cliClient) setPrompt(prompt string) {
+	if c.identities != nil {
+		if !c.identities.isSelected(c) {
+			return
+		}
+		prompt = fmt.Sprintf("%s%s%s %s", termGray, terminalEscape(c.identityName, false), termReset, prompt)
+	}
+	c.term.SetPrompt(prompt)
 }
 
 func (c *cliClient) clearTerminalMessage(length int) {
@@ -63,13 +96,13 @@ func (c *cliClient) clearTerminalMessage(length int) {
 	}
 }
 
-func (c *cliClient) newCliId() cliId {
+func (c *cliClient) newCliId() core.CliId {
 	var buf [2]byte
 
 	for {
-		c.randBytes(buf[:])
-		v := (cliId(buf[0])&0x7f)<<8 | cliId(buf[1])
-		if v == invalidCliId {
+		c.RandBytes(buf[:])
+		v := (core.CliId(buf[0])&0x7f)<<8 | core.CliId(buf[1])
+		if v == core.InvalidCliId {
 			continue
 		}
 		if _, ok := c.cliIdsAssigned[v]; !ok {
@@ -112,11 +145,20 @@ func updateTerminalSize(term *terminal.Terminal) {
 }
 
 func (c *cliClient) Start() {
+	restore := c.startTerminal()
+	defer restore()
+
+	c.LoadUI()
+	c.shutdown()
+}
+
+// startTerminal puts the terminal into raw mode and sets up c.term. It
+// returns a function that restores the terminal.
+func (c *cliClient) startTerminal() (restore func()) {
 	oldState, err := terminal.MakeRaw(0)
 	if err != nil {
 		panic(err.Error())
 	}
-	defer terminal.Restore(0, oldState)
 
 	signal.Notify(make(chan os.Signal), os.Interrupt)
 
@@ -136,20 +178,25 @@ func (c *cliClient) Start() {
 	}()
 	signal.Notify(resizeChan, syscall.SIGWINCH)
 
-	c.loadUI()
+	return func() {
+		terminal.Restore(0, oldState)
+	}
+}
 
-	if c.writerChan != nil {
-		c.save()
+// shutdown saves the state and stops the workers that LoadUI started.
+func (c *cliClient) shutdown() {
+	if c.WriterChan != nil {
+		c.Save()
 	}
-	if c.writerChan != nil {
-		close(c.writerChan)
-		<-c.writerDone
+	if c.WriterChan != nil {
+		close(c.WriterChan)
+		<-c.WriterDone
 	}
-	if c.fetchNowChan != nil {
-		close(c.fetchNowChan)
+	if c.FetchNowChan != nil {
+		close(c.FetchNowChan)
 	}
-	if c.stateLock != nil {
-		c.stateLock.Close()
+	if c.StateLock != nil {
+		c.StateLock.Close()
 	}
 }
 
@@ -172,7 +219,7 @@ type terminalWrapper struct {
 	// waitingToRestart is true if the goroutine is waiting on restartChan.
 	waitingToRestart bool
 	// errorOnInterrupt, if true, causes reading from the terminal to
-	// result in errInterrupted if Ctrl-C is pressed.
+	// result in ErrInterrupted if Ctrl-C is pressed.
 	errorOnInterrupt bool
 }
 
@@ -247,7 +294,7 @@ func (wrapper *terminalWrapper) run(r io.Reader, interruptChan chan bool) {
 			errorOnInterrupt := wrapper.errorOnInterrupt
 			wrapper.Unlock()
 			if errorOnInterrupt {
-				err = errInterrupted
+				err = core.ErrInterrupted
 			} else {
 				continue
 			}
@@ -305,11 +352,11 @@ const (
 	termReset = "\x1b[0m"
 )
 
-func (c *cliClient) initUI() {
+func (c *cliClient) InitUI() {
 	c.Printf("%s Pond...\n", termPrefix)
 }
 
-func (c *cliClient) loadingUI() {
+func (c *cliClient) LoadingUI() {
 }
 
 func (c *cliClient) drawChevrons(phase int) int {
@@ -331,7 +378,7 @@ func (c *cliClient) drawChevrons(phase int) int {
 	return phase
 }
 
-func (c *cliClient) torPromptUI() error {
+func (c *cliClient) TorPromptUI() error {
 	banner := "Please start a Tor SOCKS listener on port 9050 or 9150..."
 	bannerLength := 4 + len(banner)
 	c.Printf("%s %s", termPrefix, banner)
@@ -345,13 +392,13 @@ func (c *cliClient) torPromptUI() error {
 	for {
 		select {
 		case <-c.interrupt:
-			return errInterrupted
+			return core.ErrInterrupted
 		case <-animateTicker.C:
 			c.Printf("\x1b[%dD", bannerLength)
 			phase = c.drawChevrons(phase)
 			c.Printf("\x1b[%dC", bannerLength)
 		case <-probeTicker.C:
-			if c.detectTor() {
+			if c.DetectTor() {
 				return nil
 			}
 		}
@@ -360,10 +407,10 @@ func (c *cliClient) torPromptUI() error {
 	return nil
 }
 
-func (c *cliClient) sleepUI(d time.Duration) error {
+func (c *cliClient) SleepUI(d time.Duration) error {
 	select {
 	case <-c.interrupt:
-		return errInterrupted
+		return core.ErrInterrupted
 	case <-time.After(d):
 		return nil
 	}
@@ -371,7 +418,7 @@ func (c *cliClient) sleepUI(d time.Duration) error {
 	return nil
 }
 
-func (c *cliClient) errorUI(msg string, fatal bool) {
+func (c *cliClient) ErrorUI(msg string, fatal bool) {
 	prefix := termWarnPrefix
 	if fatal {
 		prefix = termErrPrefix
@@ -380,11 +427,11 @@ func (c *cliClient) errorUI(msg string, fatal bool) {
 }
 
 func (c *cliClient) ShutdownAndSuspend() error {
-	return errInterrupted
+	return core.ErrInterrupted
 }
 
-func (c *cliClient) createPassphraseUI() (string, error) {
-	c.Printf("%s %s\n", termInfoPrefix, msgCreatePassphrase)
+func (c *cliClient) CreatePassphraseUI() (string, error) {
+	c.Printf("%s %s\n", termInfoPrefix, core.MsgCreatePassphrase)
 
 	for {
 		pw1, err := c.term.ReadPassword("passphrase> ")
@@ -407,20 +454,20 @@ func (c *cliClient) createPassphraseUI() (string, error) {
 	return "", nil
 }
 
-func (c *cliClient) createAccountUI(stateFile *disk.StateFile, pw string) (bool, error) {
-	defaultServer := msgDefaultServer
-	if c.dev {
-		defaultServer = msgDefaultDevServer
+func (c *cliClient) CreateAccountUI(stateFile *disk.StateFile, pw string) (bool, error) {
+	defaultServer := core.MsgDefaultServer
+	if c.Dev {
+		defaultServer = core.MsgDefaultDevServer
 	}
 
-	c.Printf("%s %s\n", termInfoPrefix, msgCreateAccount)
+	c.Printf("%s %s\n", termInfoPrefix, core.MsgCreateAccount)
 	c.Printf("%s\n", termInfoPrefix)
 	c.Printf("%s Either leave this blank to use the default server, enter a pondserver:// address, or type one of the following server nicknames:\n", termInfoPrefix)
-	for _, server := range knownServers {
-		if len(server.nickname) == 0 {
+	for _, server := range core.KnownServers {
+		if len(server.Nickname) == 0 {
 			continue
 		}
-		c.Printf("%s   %s: %s\n", termInfoPrefix, server.nickname, server.description)
+		c.Printf("%s   %s: %s\n", termInfoPrefix, server.Nickname, server.Description)
 	}
 	c.term.SetPrompt("server> ")
 
@@ -429,22 +476,22 @@ func (c *cliClient) createAccountUI(stateFile *disk.StateFile, pw string) (bool,
 		if err != nil {
 			return false, err
 		}
-		for _, server := range knownServers {
-			if line == server.nickname {
-				line = server.uri
+		for _, server := range core.KnownServers {
+			if line == server.Nickname {
+				line = server.Uri
 				break
 			}
 		}
 		if len(line) == 0 {
 			line = defaultServer
 		}
-		c.server = line
+		c.Server = line
 
 		updateMsg := func(msg string) {
 			c.Printf("%s %s\n", termInfoPrefix, msg)
 		}
 
-		if err := c.doCreateAccount(updateMsg); err != nil {
+		if err := c.DoCreateAccount(updateMsg); err != nil {
 			c.Printf("%s %s\n", termErrPrefix, err.Error())
 			continue
 		}
@@ -455,8 +502,8 @@ func (c *cliClient) createAccountUI(stateFile *disk.StateFile, pw string) (bool,
 	return false, nil
 }
 
-func (c *cliClient) keyPromptUI(stateFile *disk.StateFile) error {
-	c.Printf("%s %s\n", termInfoPrefix, msgKeyPrompt)
+func (c *cliClient) KeyPromptUI(stateFile *disk.StateFile) error {
+	c.Printf("%s %s\n", termInfoPrefix, core.MsgKeyPrompt)
 
 	for {
 		line, err := c.term.ReadPassword("password> ")
@@ -464,56 +511,56 @@ func (c *cliClient) keyPromptUI(stateFile *disk.StateFile) error {
 			return err
 		}
 
-		if err := c.loadState(stateFile, line); err != disk.BadPasswordError {
+		if err := c.LoadState(stateFile, line); err != disk.BadPasswordError {
 			return err
 		}
 
-		c.Printf("%s %s\n", termWarnPrefix, msgIncorrectPassword)
+		c.Printf("%s %s\n", termWarnPrefix, core.MsgIncorrectPassword)
 	}
 
 	return nil
 }
 
-func (c *cliClient) processFetch(inboxMsg *InboxMessage) {
-	if inboxMsg.message != nil && len(inboxMsg.message.Body) == 0 {
+func (c *cliClient) ProcessFetch(inboxMsg *core.InboxMessage) {
+	if inboxMsg.Message != nil && len(inboxMsg.Message.Body) == 0 {
 		// Skip acks.
 		return
 	}
 
-	if inboxMsg.cliId == invalidCliId {
-		inboxMsg.cliId = c.newCliId()
+	if inboxMsg.CliId == core.InvalidCliId {
+		inboxMsg.CliId = c.newCliId()
 	}
 
-	c.Printf("\x07%s (%s) New message (%s%s%s) received from %s\n", termPrefix, time.Now().Format(shortTimeFormat), termCliIdStart, inboxMsg.cliId.String(), termReset, terminalEscape(c.ContactName(inboxMsg.from), false))
+	c.Printf("\x07%s (%s) New message (%s%s%s) received from %s\n", termPrefix, time.Now().Format(core.ShortTimeFormat), termCliIdStart, inboxMsg.CliId.String(), termReset, terminalEscape(c.ContactName(inboxMsg.From), false))
 }
 
-func (c *cliClient) processServerAnnounce(inboxMsg *InboxMessage) {
+func (c *cliClient) ProcessServerAnnounce(inboxMsg *core.InboxMessage) {
 	c.Printf("%s New message received from home server\n", termPrefix)
 }
 
-func (c *cliClient) processAcknowledgement(ackedMsg *queuedMessage) {
-	c.Printf("%s (%s) Message acknowledged by %s\n", termPrefix, time.Now().Format(shortTimeFormat), terminalEscape(c.ContactName(ackedMsg.to), false))
+func (c *cliClient) ProcessAcknowledgement(ackedMsg *core.QueuedMessage) {
+	c.Printf("%s (%s) Message acknowledged by %s\n", termPrefix, time.Now().Format(core.ShortTimeFormat), terminalEscape(c.ContactName(ackedMsg.To), false))
 }
 
-func (c *cliClient) processRevocationOfUs(by *Contact) {
-	c.Printf("%s Access to contact revoked. All outgoing messages dropped: %s\n", termPrefix, terminalEscape(c.ContactName(by.id), false))
+func (c *cliClient) ProcessRevocationOfUs(by *core.Contact) {
+	c.Printf("%s Access to contact revoked. All outgoing messages dropped: %s\n", termPrefix, terminalEscape(c.ContactName(by.Id), false))
 }
 
-func (c *cliClient) processRevocation(by *Contact) {
+func (c *cliClient) ProcessRevocation(by *core.Contact) {
 }
 
 // unsealPendingMessages is run once a key exchange with a contact has
 // completed and unseals any previously unreadable messages from that contact.
-func (c *cliClient) unsealPendingMessages(contact *Contact) {
+func (c *cliClient) unsealPendingMessages(contact *core.Contact) {
 	var needToFilter bool
 
-	for _, msg := range c.inbox {
-		if msg.message == nil && msg.from == contact.id {
-			if !c.unsealMessage(msg, contact) {
+	for _, msg := range c.Inbox {
+		if msg.Message == nil && msg.From == contact.Id {
+			if !c.UnsealMessage(msg, contact) {
 				needToFilter = true
 				continue
 			}
-			if len(msg.message.Body) == 0 {
+			if len(msg.Message.Body) == 0 {
 				needToFilter = true
 				continue
 			}
@@ -521,95 +568,137 @@ func (c *cliClient) unsealPendingMessages(contact *Contact) {
 	}
 
 	if needToFilter {
-		c.dropSealedAndAckMessagesFrom(contact)
+		c.DropSealedAndAckMessagesFrom(contact)
 	}
+	c.HoldUnsealedParts(contact)
 }
 
-func (c *cliClient) processPANDAUpdateUI(update pandaUpdate) {
-	contact := c.contacts[update.id]
+func (c *cliClient) ProcessPANDAUpdateUI(update core.PandaUpdate) {
+	contact := c.Contacts[update.Id]
 
 	switch {
-	case update.err != nil:
-		c.Printf("%s Key exchange with %s failed: %s\n", termErrPrefix, terminalEscape(contact.name, false), terminalEscape(update.err.Error(), false))
-	case update.serialised != nil:
-	case update.result != nil:
-		c.Printf("%s Key exchange with %s complete\n", termPrefix, terminalEscape(contact.name, false))
+	case update.Err != nil:
+		c.Printf("%s Key exchange with %s failed: %s\n", termErrPrefix, terminalEscape(contact.Name, false), terminalEscape(update.Err.Error(), false))
+	case update.Serialised != nil:
+	case update.Result != nil:
+		c.Printf("%s Key exchange with %s complete\n", termPrefix, terminalEscape(contact.Name, false))
 		c.unsealPendingMessages(contact)
 	}
 }
 
-func (c *cliClient) processMessageDelivered(msg *queuedMessage) {
-	if !msg.revocation && len(msg.message.Body) > 0 {
-		c.Printf("%s (%s) Message %s%s%s to %s transmitted successfully\n", termPrefix, time.Now().Format(shortTimeFormat), termCliIdStart, msg.cliId.String(), termReset, terminalEscape(c.ContactName(msg.to), false))
+func (c *cliClient) ProcessMessageDelivered(msg *core.QueuedMessage) {
+	if !msg.Revocation && len(msg.Message.Body) > 0 {
+		c.Printf("%s (%s) Message %s%s%s to %s transmitted successfully\n", termPrefix, time.Now().Format(core.ShortTimeFormat), termCliIdStart, msg.CliId.String(), termReset, terminalEscape(c.ContactName(msg.To), false))
 	}
 	c.showQueueState()
 }
 
-func (c *cliClient) removeInboxMessageUI(msg *InboxMessage) {
+func (c *cliClient) ProcessMessageUndeliverable(msg *core.QueuedMessage) {
+	c.Printf("%s Message %s%s%s to %s is undeliverable because %s keeps failing. Delivery will still be attempted.\n", termWarnPrefix, termCliIdStart, msg.CliId.String(), termReset, terminalEscape(c.ContactName(msg.To), false), terminalEscape(msg.Server, false))
 }
 
-func (c *cliClient) removeOutboxMessageUI(msg *queuedMessage) {
+func (c *cliClient) ProcessDraftSent(draft *core.Draft, id uint64, err error) {
+	if err != nil {
+		c.Printf("%s Failed to send draft after uploading its attachments: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+		return
+	}
+	if c.currentObj == draft {
+		c.setCurrentObject(nil)
+	}
+	c.Printf("%s Attachments uploaded and draft sent\n", termInfoPrefix)
+	c.printOutboxCopies(id)
 }
 
-func (c *cliClient) addRevocationMessageUI(msg *queuedMessage) {
+// printOutboxCopies assigns CLI ids to the copies of the given outbox message,
+// which was just sent, and reports them. It returns the message, or nil if
+// it's not in the outbox.
+func (c *cliClient) printOutboxCopies(id uint64) *core.QueuedMessage {
+	for _, msg := range c.Outbox {
+		if msg.Id != id {
+			continue
+		}
+		for _, m := range c.FanoutCopies(msg) {
+			if m.CliId == core.InvalidCliId {
+				m.CliId = c.newCliId()
+			}
+			c.Printf("%s Created new outbox entry %s%s%s for %s\n", termInfoPrefix, termCliIdStart, m.CliId.String(), termReset, terminalEscape(c.ContactName(m.To), false))
+		}
+		return msg
+	}
+	return nil
+}
+
+func (c *cliClient) RemoveInboxMessageUI(msg *core.InboxMessage) {
+}
+
+func (c *cliClient) RemoveOutboxMessageUI(msg *core.QueuedMessage) {
+}
+
+func (c *cliClient) AddRevocationMessageUI(msg *core.QueuedMessage) {
 	c.Printf("%s New revocation message created and pending transmission to home server.\n", termPrefix)
 }
 
-func (c *cliClient) removeContactUI(contact *Contact) {
+func (c *cliClient) RemoveContactUI(contact *core.Contact) {
 }
 
-func (c *cliClient) logEventUI(contact *Contact, event Event) {
-	c.Printf("%s While processing message from %s: %s\n", termWarnPrefix, terminalEscape(contact.name, false), terminalEscape(event.msg, false))
+func (c *cliClient) LogEventUI(contact *core.Contact, event core.Event) {
+	c.Printf("%s While processing message from %s: %s\n", termWarnPrefix, terminalEscape(contact.Name, false), terminalEscape(event.Msg, false))
 }
 
 func (c *cliClient) setCurrentObject(o interface{}) {
 	c.currentObj = o
 
 	if c.currentObj == nil {
-		c.term.SetPrompt(fmt.Sprintf("%s>%s ", termCol1, termReset))
+		c.setPrompt(fmt.Sprintf("%s>%s ", termCol1, termReset))
 		return
 	}
 
-	var id cliId
+	var id core.CliId
 	var typ string
 	switch o := c.currentObj.(type) {
-	case *Draft:
+	case *core.Draft:
 		typ = "draft"
-		id = o.cliId
-	case *InboxMessage:
+		id = o.CliId
+	case *core.InboxMessage:
 		typ = "inbox"
-		id = o.cliId
-	case *Contact:
+		id = o.CliId
+	case *core.Contact:
 		typ = "contact"
-		id = o.cliId
-	case *queuedMessage:
+		id = o.CliId
+	case *core.QueuedMessage:
 		typ = "outbox"
-		id = o.cliId
+		id = o.CliId
 	default:
 		panic("unknown currentObj type")
 	}
 
-	c.term.SetPrompt(fmt.Sprintf("%s%s%s/%s%s%s>%s ", termGray, typ, termReset, termCliIdStart, id.String(), termCol1, termReset))
+	c.setPrompt(fmt.Sprintf("%s%s%s/%s%s%s>%s ", termGray, typ, termReset, termCliIdStart, id.String(), termCol1, termReset))
 }
 
-func (c *cliClient) mainUI() {
-	c.term.SetPrompt(fmt.Sprintf("%s>%s ", termCol1, termReset))
+func (c *cliClient) MainUI() {
+	c.setPrompt(fmt.Sprintf("%s>%s ", termCol1, termReset))
 	c.showState()
 
-	termChan := make(chan cliTerminalLine)
 	c.input = &cliInput{
 		term: c.term,
 	}
 	c.termWrapper.PauseOnEnter()
 	c.termWrapper.SetErrorOnInterrupt(false)
-	go c.input.processInput(termChan)
+	termChan := c.lines
+	if termChan == nil {
+		termChan = make(chan cliTerminalLine)
+		go c.input.processInput(termChan)
+	}
+	if c.ready != nil {
+		close(c.ready)
+	}
 
 	for {
 		select {
-		case sigReq := <-c.signingRequestChan:
-			c.processSigningRequest(sigReq)
-		case line := <-termChan:
-			if line.err != nil {
+		case sigReq := <-c.SigningRequestChan:
+			c.ProcessSigningRequest(sigReq)
+		case line, ok := <-termChan:
+			if !ok || line.err != nil {
 				return
 			}
 
@@ -633,20 +722,53 @@ func (c *cliClient) mainUI() {
 				return
 			}
 			close(line.ackChan)
-		case newMessage := <-c.newMessageChan:
-			c.processNewMessage(newMessage)
-		case msr := <-c.messageSentChan:
-			if msr.id != 0 {
-				c.processMessageSent(msr)
+		case newMessage := <-c.NewMessageChan:
+			c.ProcessNewMessage(newMessage)
+		case msr := <-c.MessageSentChan:
+			if msr.Id != 0 {
+				c.ProcessMessageSent(msr)
 			}
-		case update := <-c.pandaChan:
-			c.processPANDAUpdate(update)
-		case <-c.backgroundChan:
-		case <-c.log.updateChan:
+		case update := <-c.PandaChan:
+			c.ProcessPANDAUpdate(update)
+		case event := <-c.BackgroundChan:
+			c.processBackgroundEvent(event)
+		case <-c.Log.UpdateChan:
+		case <-c.TimerChan:
+			c.ProcessTimerTick(c.Now(), c.currentMessageId())
 		}
 	}
 }
 
+// currentMessageId returns the id of the inbox or outbox message that's
+// selected, or zero if there's none.
+func (c *cliClient) currentMessageId() uint64 {
+	switch obj := c.currentObj.(type) {
+	case *core.InboxMessage:
+		return obj.Id
+	case *core.QueuedMessage:
+		return obj.Id
+	}
+	return 0
+}
+
+// processBackgroundEvent handles an event from a transfer that isn't running
+// in the foreground, such as one that was resumed when Pond started.
+func (c *cliClient) processBackgroundEvent(event interface{}) {
+	if t := c.ProcessTransferEvent(event); t != nil {
+		c.printTransferResult(t, event)
+	}
+}
+
+// printTransferResult reports the outcome of a transfer that has finished.
+func (c *cliClient) printTransferResult(t *core.Transfer, event interface{}) {
+	switch e := event.(type) {
+	case core.DetachmentComplete:
+		c.Printf("%s %s of '%s' complete\n", termInfoPrefix, t.Direction(), terminalEscape(t.Name(), false))
+	case core.DetachmentError:
+		c.Printf("%s %s of '%s' failed: %s\n", termErrPrefix, t.Direction(), terminalEscape(t.Name(), false), terminalEscape(e.Err.Error(), false))
+	}
+}
+
 // cliTable is a structure for containing tabular data for display on the
 // terminal. For example, the inbox, outbox etc summaries are handled using
 // this structure.
@@ -666,12 +788,12 @@ type cliTable struct {
 type cliRow struct {
 	// indicator contains an optional indicator star to print at the
 	// beginning of the line.
-	indicator Indicator
+	indicator core.Indicator
 	// cols contains strings for each column. Note that strings must
 	// already have been terminal escaped.
 	cols []string
 	// id contains an optional tag string to print as a final column.
-	id cliId
+	id core.CliId
 }
 
 // UpdateWidths calculates the maximum width of each column. If widths is
@@ -766,7 +888,7 @@ func (tab cliTable) WriteToWithWidths(w io.Writer, widths []int) {
 			buf.Write(spaces[:width-len(col)])
 		}
 
-		if row.id != invalidCliId {
+		if row.id != core.InvalidCliId {
 			buf.WriteString(" (")
 			buf.WriteString(termCliIdStart)
 			buf.WriteString(row.id.String())
@@ -800,6 +922,108 @@ func (c *cliClient) showState() {
 	}
 
 	c.showQueueState()
+	c.showNextTransaction()
+}
+
+// showNextTransaction prints the time of the next timed network transaction.
+func (c *cliClient) showNextTransaction() {
+	if offline, remaining := c.SyncStatus(); offline {
+		if remaining > 0 {
+			c.Printf("%s Offline, syncing with up to %d more network transactions\n", termInfoPrefix, remaining)
+		} else {
+			c.Printf("%s Offline. Network transactions are only made by sync\n", termInfoPrefix)
+		}
+		return
+	}
+
+	next, paused := c.NextTransactionTime()
+	switch {
+	case paused:
+		c.Printf("%s Network transactions are paused\n", termInfoPrefix)
+	case !next.IsZero():
+		c.Printf("%s The next network transaction will be at %s\n", termInfoPrefix, core.FormatTime(next))
+	}
+}
+
+func (c *cliClient) showNetwork() {
+	defaultProxy, overrides := c.ProxySummary()
+	table := cliTable{
+		noIndicators: true,
+		heading:      "Network",
+		rows: []cliRow{
+			cliRow{cols: []string{"Default proxy", terminalEscape(defaultProxy, false)}},
+		},
+	}
+	for _, override := range overrides {
+		table.rows = append(table.rows, cliRow{cols: []string{terminalEscape(override[0], false), terminalEscape(override[1], false)}})
+	}
+	for _, carrier := range c.CarrierSummary() {
+		table.rows = append(table.rows, cliRow{cols: []string{terminalEscape(carrier[0], false), "via " + terminalEscape(carrier[1], false)}})
+	}
+	coverTraffic := "off"
+	if c.CoverTrafficEnabled() {
+		coverTraffic = "on"
+	}
+	table.rows = append(table.rows, cliRow{cols: []string{"Cover traffic", coverTraffic}})
+	table.rows = append(table.rows, cliRow{cols: []string{"Undeliverable after", core.FormatDuration(c.UndeliverableAfter())}})
+	schedule := c.NetworkSchedule()
+	table.rows = append(table.rows, cliRow{cols: []string{"Mean interval", core.FormatDuration(schedule.MeanInterval())}})
+	burst := "none"
+	if schedule.BurstTransactions > 0 {
+		burst = fmt.Sprintf("%d transactions at a mean interval of %s", schedule.BurstTransactions, core.FormatDuration(schedule.BurstInterval))
+	}
+	table.rows = append(table.rows, cliRow{cols: []string{"Burst after sending", burst}})
+	table.rows = append(table.rows, cliRow{cols: []string{"Quiet hours", schedule.QuietHoursString()}})
+	if schedule.Paused {
+		table.rows = append(table.rows, cliRow{cols: []string{"Transactions", "paused"}})
+	}
+	if c.IsOffline() {
+		table.rows = append(table.rows, cliRow{cols: []string{"Mode", "offline"}})
+	}
+	table.WriteTo(c.term)
+
+	failures := c.UnreachableServers()
+	if len(failures) == 0 {
+		return
+	}
+	table = cliTable{
+		noIndicators: true,
+		heading:      "Unreachable servers",
+	}
+	for _, f := range failures {
+		table.rows = append(table.rows, cliRow{cols: []string{
+			terminalEscape(f.Server, false),
+			f.Category.String(),
+			fmt.Sprintf("%d failures since %s", f.Count, core.FormatTime(f.First)),
+			"retry after " + core.FormatTime(f.Retry),
+		}})
+	}
+	table.WriteTo(c.term)
+}
+
+// parseProxyCommand parses the arguments of the proxy and server-proxy
+// commands and prints an error if they are invalid.
+func (c *cliClient) parseProxyCommand(s string, isolate, acknowledgeDirect bool) (*core.ProxyConfig, bool) {
+	p, err := core.ParseProxy(s)
+	if err != nil {
+		c.Printf("%s Failed to parse proxy: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+		return nil, false
+	}
+	p.Isolate = isolate
+	p.DirectAcknowledged = acknowledgeDirect && p.Kind == disk.Proxy_DIRECT
+	if msg := core.DescribeProxyError(p); len(msg) > 0 {
+		c.Printf("%s %s\n", termErrPrefix, msg)
+		return nil, false
+	}
+	return p, true
+}
+
+// checkTorAvailable warns if the proxy configuration now needs a local Tor
+// proxy that can't be found.
+func (c *cliClient) checkTorAvailable() {
+	if c.UsesDetectedTor() && !c.DetectTor() {
+		c.Printf("%s Cannot find Tor on port 9050 or 9150. Connections will fail until it's started.\n", termWarnPrefix)
+	}
 }
 
 func (c *cliClient) showIdentity() {
@@ -807,66 +1031,74 @@ func (c *cliClient) showIdentity() {
 		noIndicators: true,
 		heading:      "Identity",
 		rows: []cliRow{
-			cliRow{cols: []string{"Server", terminalEscape(c.server, false)}},
-			cliRow{cols: []string{"Public identity", fmt.Sprintf("%x", c.identityPublic[:])}},
-			cliRow{cols: []string{"Public key", fmt.Sprintf("%x", c.pub[:])}},
-			cliRow{cols: []string{"State file", terminalEscape(c.stateFilename, false)}},
-			cliRow{cols: []string{"Group generation", fmt.Sprintf("%d", c.generation)}},
+			cliRow{cols: []string{"Server", terminalEscape(c.Server, false)}},
+			cliRow{cols: []string{"Public identity", fmt.Sprintf("%x", c.IdentityPublic[:])}},
+			cliRow{cols: []string{"Public key", fmt.Sprintf("%x", c.Pub[:])}},
+			cliRow{cols: []string{"State file", terminalEscape(c.StateFilename, false)}},
+			cliRow{cols: []string{"Group generation", fmt.Sprintf("%d", c.Generation)}},
 		},
 	}
 	table.WriteTo(c.term)
 }
 
+// inboxIndicator returns the indicator for an inbox message in a summary.
+func inboxIndicator(msg *core.InboxMessage) core.Indicator {
+	switch {
+	case msg.Message == nil:
+		return core.IndicatorNone
+	case !msg.Read:
+		return core.IndicatorBlue
+	case !msg.Acked && msg.From != 0:
+		return core.IndicatorYellow
+	}
+	return core.IndicatorNone
+}
+
 func (c *cliClient) inboxSummary() (table cliTable) {
-	if len(c.inbox) == 0 {
+	if len(c.Inbox) == 0 {
 		return
 	}
 
 	heading := "Inbox"
 	var filter uint64
 
-	if obj, isContact := c.currentObj.(*Contact); isContact {
-		heading = "Inbox messages from " + terminalEscape(obj.name, false)
-		filter = obj.id
+	if obj, isContact := c.currentObj.(*core.Contact); isContact {
+		heading = "Inbox messages from " + terminalEscape(obj.Name, false)
+		filter = obj.Id
 	}
 
 	table = cliTable{
 		heading: heading,
-		rows:    make([]cliRow, 0, len(c.inbox)),
+		rows:    make([]cliRow, 0, len(c.Inbox)),
 	}
 
-	for _, msg := range c.inbox {
-		if filter != 0 && filter != msg.from {
+	for _, msg := range c.Inbox {
+		if filter != 0 && filter != msg.From {
 			continue
 		}
 
 		var subline string
-		i := indicatorNone
+		i := inboxIndicator(msg)
 
-		if msg.message == nil {
+		if msg.Message == nil {
 			subline = "pending"
 		} else {
-			if len(msg.message.Body) == 0 {
+			if len(msg.Message.Body) == 0 {
 				continue
 			}
-			if !msg.read {
-				i = indicatorBlue
-			} else if !msg.acked && msg.from != 0 {
-				i = indicatorYellow
-			}
-			subline = time.Unix(*msg.message.Time, 0).Format(shortTimeFormat)
+			subline = time.Unix(*msg.Message.Time, 0).Format(core.ShortTimeFormat)
 		}
-		if msg.cliId == invalidCliId {
-			msg.cliId = c.newCliId()
+		if msg.CliId == core.InvalidCliId {
+			msg.CliId = c.newCliId()
 		}
 
 		table.rows = append(table.rows, cliRow{
 			i,
 			[]string{
-				terminalEscape(c.ContactName(msg.from), false),
+				terminalEscape(c.ContactName(msg.From), false),
 				subline,
 			},
-			msg.cliId,
+			msg.CliId,
 		})
 	}
 
@@ -874,58 +1106,58 @@ func (c *cliClient) inboxSummary() (table cliTable) {
 }
 
 func (c *cliClient) outboxSummary() (table cliTable) {
-	if len(c.outbox) == 0 {
+	if len(c.Outbox) == 0 {
 		return
 	}
 
 	heading := "Outbox"
 	var filter uint64
 
-	if obj, isContact := c.currentObj.(*Contact); isContact {
-		heading = "Outbox messages to " + terminalEscape(obj.name, false)
-		filter = obj.id
+	if obj, isContact := c.currentObj.(*core.Contact); isContact {
+		heading = "Outbox messages to " + terminalEscape(obj.Name, false)
+		filter = obj.Id
 	}
 
 	table = cliTable{
 		heading: heading,
-		rows:    make([]cliRow, 0, len(c.outbox)),
+		rows:    make([]cliRow, 0, len(c.Outbox)),
 	}
 
-	for _, msg := range c.outbox {
-		if filter != 0 && filter != msg.to {
+	for _, msg := range c.Outbox {
+		if filter != 0 && filter != msg.To {
 			continue
 		}
 
-		subline := msg.created.Format(shortTimeFormat)
+		subline := msg.Created.Format(core.ShortTimeFormat)
 
-		if msg.revocation {
+		if msg.Revocation {
 			table.rows = append(table.rows, cliRow{
-				msg.indicator(nil),
+				msg.Indicator(nil),
 				[]string{
 					"(Revocation)",
 					subline,
 				},
-				invalidCliId,
+				core.InvalidCliId,
 			})
 			continue
 		}
 
-		if len(msg.message.Body) == 0 {
+		if len(msg.Message.Body) == 0 {
 			continue
 		}
 
-		if msg.cliId == invalidCliId {
-			msg.cliId = c.newCliId()
+		if msg.CliId == core.InvalidCliId {
+			msg.CliId = c.newCliId()
 		}
 
-		to := c.contacts[msg.to]
+		to := c.Contacts[msg.To]
 		table.rows = append(table.rows, cliRow{
-			msg.indicator(to),
+			msg.Indicator(to),
 			[]string{
-				terminalEscape(to.name, false),
+				terminalEscape(to.Name, false),
 				subline,
 			},
-			msg.cliId,
+			msg.CliId,
 		})
 	}
 
@@ -933,45 +1165,197 @@ func (c *cliClient) outboxSummary() (table cliTable) {
 }
 
 func (c *cliClient) draftsSummary() (table cliTable) {
-	if len(c.drafts) == 0 {
+	if len(c.Drafts) == 0 {
 		return
 	}
 
 	heading := "Drafts"
 	var filter uint64
 
-	if obj, isContact := c.currentObj.(*Contact); isContact {
-		heading = "Draft messages to " + terminalEscape(obj.name, false)
-		filter = obj.id
+	if obj, isContact := c.currentObj.(*core.Contact); isContact {
+		heading = "Draft messages to " + terminalEscape(obj.Name, false)
+		filter = obj.Id
 	}
 
 	table = cliTable{
 		heading: heading,
-		rows:    make([]cliRow, 0, len(c.drafts)),
+		rows:    make([]cliRow, 0, len(c.Drafts)),
 	}
 
-	for _, msg := range c.drafts {
-		if filter != 0 && filter != msg.to {
+	for _, msg := range c.Drafts {
+		if filter != 0 && !msg.IsAddressedTo(filter) {
 			continue
 		}
 
-		if msg.cliId == invalidCliId {
-			msg.cliId = c.newCliId()
+		if msg.CliId == core.InvalidCliId {
+			msg.CliId = c.newCliId()
 		}
 
-		subline := msg.created.Format(shortTimeFormat)
+		subline := msg.Created.Format(core.ShortTimeFormat)
 		to := "(nobody)"
-		if msg.to != 0 {
-			to = c.ContactName(msg.to)
+		if msg.To != 0 {
+			to = c.RecipientNames(msg)
 		}
 
 		table.rows = append(table.rows, cliRow{
-			indicatorNone,
+			core.IndicatorNone,
 			[]string{
 				terminalEscape(to, false),
 				subline,
 			},
-			msg.cliId,
+			msg.CliId,
+		})
+	}
+
+	return
+}
+
+// threadSummary returns a table with a row for each message in a thread, in
+// the order in which they were sent and received. Replies are indented.
+func (c *cliClient) threadSummary(t core.Thread) (table cliTable) {
+	table = cliTable{
+		heading: "Conversation with " + terminalEscape(c.ContactName(t.Contact()), false),
+		rows:    make([]cliRow, 0, len(t)),
+	}
+
+	for _, entry := range t {
+		indent := strings.Repeat("  ", entry.Depth)
+
+		var row cliRow
+		if msg := entry.Inbox; msg != nil {
+			if msg.CliId == core.InvalidCliId {
+				msg.CliId = c.newCliId()
+			}
+			row = cliRow{inboxIndicator(msg), []string{indent + "From " + terminalEscape(c.ContactName(msg.From), false)}, msg.CliId}
+		} else {
+			msg := entry.Outbox
+			if msg.CliId == core.InvalidCliId {
+				msg.CliId = c.newCliId()
+			}
+			to := c.Contacts[msg.To]
+			row = cliRow{msg.Indicator(to), []string{indent + "To " + terminalEscape(to.Name, false)}, msg.CliId}
+		}
+		row.cols = append(row.cols, entry.Time().Format(core.ShortTimeFormat), terminalEscape(entry.Summary(), false))
+		table.rows = append(table.rows, row)
+	}
+
+	return
+}
+
+// searchSummary returns a table of search results. Each row has an id that
+// can be used to open the message or draft.
+func (c *cliClient) searchSummary(query string, hits []core.SearchHit) (table cliTable) {
+	table = cliTable{
+		heading: "Search results for " + terminalEscape(query, false),
+		rows:    make([]cliRow, 0, len(hits)),
+	}
+
+	terms := core.SearchTerms(query)
+	for _, hit := range hits {
+		var row cliRow
+		switch {
+		case hit.Inbox != nil:
+			msg := hit.Inbox
+			if msg.CliId == core.InvalidCliId {
+				msg.CliId = c.newCliId()
+			}
+			row = cliRow{inboxIndicator(msg), []string{"From " + terminalEscape(c.ContactName(msg.From), false)}, msg.CliId}
+		case hit.Outbox != nil:
+			msg := hit.Outbox
+			if msg.CliId == core.InvalidCliId {
+				msg.CliId = c.newCliId()
+			}
+			to := c.Contacts[msg.To]
+			row = cliRow{msg.Indicator(to), []string{"To " + terminalEscape(to.Name, false)}, msg.CliId}
+		default:
+			draft := hit.Draft
+			if draft.CliId == core.InvalidCliId {
+				draft.CliId = c.newCliId()
+			}
+			to := "(nobody)"
+			if draft.To != 0 {
+				to = c.RecipientNames(draft)
+			}
+			row = cliRow{core.IndicatorNone, []string{"Draft to " + terminalEscape(to, false)}, draft.CliId}
+		}
+		row.cols = append(row.cols, hit.Time().Format(core.ShortTimeFormat), terminalEscape(hit.Snippet(terms), false))
+		table.rows = append(table.rows, row)
+	}
+
+	return
+}
+
+func (c *cliClient) groupsSummary() (table cliTable) {
+	if len(c.ContactGroups) == 0 {
+		return
+	}
+
+	table = cliTable{
+		heading:      "Groups",
+		noIndicators: true,
+		rows:         make([]cliRow, 0, len(c.ContactGroups)),
+	}
+
+	for _, group := range c.GroupNames() {
+		var members []string
+		for _, id := range c.ContactGroups[group] {
+			members = append(members, c.Contacts[id].Name)
+		}
+		table.rows = append(table.rows, cliRow{
+			cols: []string{
+				terminalEscape(group, false),
+				terminalEscape(strings.Join(members, ", "), false),
+			},
+		})
+	}
+
+	return
+}
+
+func (c *cliClient) transfersSummary() (table cliTable) {
+	table = cliTable{
+		heading:      "Transfers",
+		noIndicators: true,
+		rows:         make([]cliRow, 0, len(c.Transfers)),
+	}
+
+	for i, t := range c.Transfers {
+		progress := "waiting"
+		if t.Total > 0 {
+			progress = fmt.Sprintf("%d / %d", t.Done, t.Total)
+		}
+		table.rows = append(table.rows, cliRow{
+			cols: []string{
+				fmt.Sprintf("%d", i+1),
+				t.Direction(),
+				terminalEscape(t.Name(), false),
+				progress,
+			},
+		})
+	}
+
+	return
+}
+
+func (c *cliClient) hooksSummary() (table cliTable) {
+	table = cliTable{
+		heading:      "Hooks",
+		noIndicators: true,
+		rows:         make([]cliRow, 0, len(c.Hooks)),
+	}
+
+	for _, name := range c.HookNames() {
+		h := c.Hooks[name]
+		body := ""
+		if h.IncludeBody {
+			body = "with body"
+		}
+		table.rows = append(table.rows, cliRow{
+			cols: []string{
+				name,
+				terminalEscape(h.Command, false),
+				body,
+			},
 		})
 	}
 
@@ -979,33 +1363,33 @@ func (c *cliClient) draftsSummary() (table cliTable) {
 }
 
 func (c *cliClient) contactsSummary() (table cliTable) {
-	if len(c.contacts) == 0 {
+	if len(c.Contacts) == 0 {
 		return
 	}
 
 	table = cliTable{
 		heading: "Contacts",
-		rows:    make([]cliRow, 0, len(c.contacts)),
+		rows:    make([]cliRow, 0, len(c.Contacts)),
 	}
 
-	contacts := c.client.contactsSorted()
+	contacts := c.Client.ContactsSorted()
 
 	for _, contact := range contacts {
-		if contact.cliId == invalidCliId {
-			contact.cliId = c.newCliId()
+		if contact.CliId == core.InvalidCliId {
+			contact.CliId = c.newCliId()
 		}
-		indicator := indicatorNone
-		if contact.revokedUs {
-			indicator = indicatorBlack
+		indicator := core.IndicatorNone
+		if contact.RevokedUs {
+			indicator = core.IndicatorBlack
 		}
 
 		table.rows = append(table.rows, cliRow{
 			indicator,
 			[]string{
-				terminalEscape(contact.name, false),
-				contact.subline(),
+				terminalEscape(contact.Name, false),
+				contact.Subline(),
 			},
-			contact.cliId,
+			contact.CliId,
 		})
 	}
 
@@ -1013,9 +1397,10 @@ func (c *cliClient) contactsSummary() (table cliTable) {
 }
 
 func (c *cliClient) showQueueState() {
-	c.queueMutex.Lock()
-	queueLength := len(c.queue)
-	c.queueMutex.Unlock()
+	c.QueueMutex.Lock()
+	queueLength := len(c.Queue)
+	scheduledLength := len(c.Scheduled)
+	c.QueueMutex.Unlock()
 
 	switch {
 	case queueLength > 1:
@@ -1025,10 +1410,16 @@ func (c *cliClient) showQueueState() {
 	default:
 		c.Printf("%s There are no messages waiting to be transmitted\n", termInfoPrefix)
 	}
+	switch {
+	case scheduledLength > 1:
+		c.Printf("%s There are %d messages scheduled for later transmission\n", termInfoPrefix, scheduledLength)
+	case scheduledLength > 0:
+		c.Printf("%s There is one message scheduled for later transmission\n", termInfoPrefix)
+	}
 }
 
-func (c *cliClient) printDraftSize(draft *Draft) {
-	usageString, oversize := draft.usageString()
+func (c *cliClient) printDraftSize(draft *core.Draft) {
+	usageString, oversize := c.UsageString(draft)
 	prefix := termPrefix
 	if oversize {
 		prefix = termErrPrefix
@@ -1066,31 +1457,35 @@ func (c *cliClient) runBackgroundProcess(id uint64, cancelThunk func()) (*pond.M
 
 	for {
 		select {
-		case event := <-c.backgroundChan:
+		case event := <-c.BackgroundChan:
+			if t := c.ProcessTransferEvent(event); t != nil && t.Id != id {
+				c.printTransferResult(t, event)
+				continue
+			}
 			switch e := event.(type) {
-			case DetachmentError:
-				if e.id != id {
+			case core.DetachmentError:
+				if e.Id != id {
 					continue
 				}
 				c.clearTerminalMessage(lastProgressStringLength)
 				lastProgressStringLength = 0
-				c.Printf("%s Error: %s\n", termErrPrefix, terminalEscape(e.err.Error(), false))
+				c.Printf("%s Error: %s\n", termErrPrefix, terminalEscape(e.Err.Error(), false))
 				return nil, false
-			case DetachmentProgress:
-				if e.id != id {
+			case core.DetachmentProgress:
+				if e.Id != id {
 					continue
 				}
-				s := fmt.Sprintf("%s: %d / %d", terminalEscape(e.status, false), e.done, e.total)
+				s := fmt.Sprintf("%s: %d / %d", terminalEscape(e.Status, false), e.Done, e.Total)
 				c.clearTerminalMessage(lastProgressStringLength)
 				lastProgressStringLength = len(s)
 				c.term.Write([]byte(s))
-			case DetachmentComplete:
-				if e.id != id {
+			case core.DetachmentComplete:
+				if e.Id != id {
 					continue
 				}
 				c.clearTerminalMessage(lastProgressStringLength)
 				c.Printf("%s Complete\n", termPrefix)
-				return e.detachment, true
+				return e.Detachment, true
 			}
 		case <-c.interrupt:
 			cancelThunk()
@@ -1107,15 +1502,15 @@ func (c *cliClient) processCommand(cmd interface{}) (shouldQuit bool) {
 	// control.
 	switch cmd.(type) {
 	case composeCommand:
-		if contact, ok := c.currentObj.(*Contact); ok {
+		if contact, ok := c.currentObj.(*core.Contact); ok {
 			c.compose(contact, nil, nil)
 		} else {
 			c.Printf("%s Select contact first\n", termWarnPrefix)
 		}
 
 	case editCommand:
-		if draft, ok := c.currentObj.(*Draft); ok {
-			if draft.to == 0 {
+		if draft, ok := c.currentObj.(*core.Draft); ok {
+			if draft.To == 0 {
 				c.Printf("%s Draft was created in the GUI and doesn't have a destination specified. Please use the GUI to manipulate this draft.\n", termErrPrefix)
 				return
 			}
@@ -1125,16 +1520,43 @@ func (c *cliClient) processCommand(cmd interface{}) (shouldQuit bool) {
 		}
 
 	case replyCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
+		msg, ok := c.currentObj.(*core.InboxMessage)
 		if !ok {
 			c.Printf("%s Select inbox message first\n", termWarnPrefix)
 			return
 		}
-		if msg.from == 0 {
+		if msg.From == 0 {
 			c.Printf("%s Cannot reply to server announcement\n", termWarnPrefix)
 			return
 		}
-		c.compose(c.contacts[msg.from], nil, msg)
+		c.compose(c.Contacts[msg.From], nil, msg)
+
+	case forwardCommand:
+		msg, ok := c.currentObj.(*core.InboxMessage)
+		if !ok {
+			c.Printf("%s Select inbox message first\n", termWarnPrefix)
+			return
+		}
+		if msg.Message == nil {
+			c.Printf("%s Cannot forward a message from a pending contact\n", termWarnPrefix)
+			return
+		}
+		ids, err := c.ResolveRecipients(cmd.(forwardCommand).Name)
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		draft := c.ForwardDraft(msg)
+		for _, id := range ids {
+			draft.AddRecipient(id)
+		}
+		draft.CliId = c.newCliId()
+		c.Printf("%s Created new draft: %s%s%s\n", termInfoPrefix, termCliIdStart, draft.CliId.String(), termReset)
+		if c.HasUploads(draft.Id) {
+			c.Printf("%s Detachments are being copied to your home server and will be added to the draft\n", termInfoPrefix)
+		}
+		c.setCurrentObject(draft)
+		c.compose(nil, draft, nil)
 
 	default:
 		goto Handle
@@ -1157,13 +1579,13 @@ Handle:
 		}
 
 		switch c.currentObj.(type) {
-		case *Contact:
+		case *core.Contact:
 			c.input.showHelp(contextContact, false)
-		case *Draft:
+		case *core.Draft:
 			c.input.showHelp(contextDraft, false)
-		case *InboxMessage:
+		case *core.InboxMessage:
 			c.input.showHelp(contextInbox, false)
-		case *queuedMessage:
+		case *core.QueuedMessage:
 			c.input.showHelp(contextOutbox, false)
 		default:
 			c.input.showHelp(0, false)
@@ -1174,31 +1596,31 @@ Handle:
 			c.showState()
 			return
 		}
-		cliId, ok := cliIdFromString(cmd.tag)
+		cliId, ok := core.CliIdFromString(cmd.tag)
 		if !ok {
 			c.Printf("%s Bad tag\n", termWarnPrefix)
 			return
 		}
-		for _, msg := range c.inbox {
-			if msg.cliId == cliId {
+		for _, msg := range c.Inbox {
+			if msg.CliId == cliId {
 				c.setCurrentObject(msg)
 				return
 			}
 		}
-		for _, msg := range c.outbox {
-			if msg.cliId == cliId {
+		for _, msg := range c.Outbox {
+			if msg.CliId == cliId {
 				c.setCurrentObject(msg)
 				return
 			}
 		}
-		for _, msg := range c.drafts {
-			if msg.cliId == cliId {
+		for _, msg := range c.Drafts {
+			if msg.CliId == cliId {
 				c.setCurrentObject(msg)
 				return
 			}
 		}
-		for _, contact := range c.contacts {
-			if contact.cliId == cliId {
+		for _, contact := range c.Contacts {
+			if contact.CliId == cliId {
 				c.setCurrentObject(contact)
 				return
 			}
@@ -1207,7 +1629,7 @@ Handle:
 
 	case logCommand:
 		n := 15
-		if l := len(c.log.entries); l < n {
+		if l := len(c.Log.Entries); l < n {
 			n = l
 		}
 		table := cliTable{
@@ -1215,11 +1637,11 @@ Handle:
 			noIndicators: true,
 		}
 
-		for _, entry := range c.log.entries[len(c.log.entries)-n:] {
+		for _, entry := range c.Log.Entries[len(c.Log.Entries)-n:] {
 			table.rows = append(table.rows, cliRow{
 				cols: []string{
-					entry.Format(logTimeFormat),
-					terminalEscape(entry.s, false),
+					entry.Format(core.LogTimeFormat),
+					terminalEscape(entry.S, false),
 				},
 			})
 		}
@@ -1227,11 +1649,197 @@ Handle:
 		table.WriteTo(c.term)
 
 	case transactNowCommand:
+		if c.IsOffline() {
+			c.Printf("%s The client is offline. Use sync to make network transactions\n", termErrPrefix)
+			return
+		}
 		c.Printf("%s Triggering immediate network transaction.\n", termPrefix)
 		select {
-		case c.fetchNowChan <- nil:
+		case c.FetchNowChan <- nil:
+		default:
+		}
+
+	case showNetworkCommand:
+		c.showNetwork()
+
+	case proxyCommand:
+		p, ok := c.parseProxyCommand(cmd.Proxy, cmd.Isolate, cmd.AcknowledgeDirect)
+		if !ok {
+			return
+		}
+		c.SetDefaultProxy(p)
+		c.Save()
+		c.Printf("%s Default proxy set to %s\n", termPrefix, terminalEscape(p.String(), false))
+		c.checkTorAvailable()
+
+	case intervalCommand:
+		interval, err := core.ParseInterval(cmd.Interval)
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		schedule := c.NetworkSchedule()
+		schedule.Interval = interval
+		c.SetNetworkSchedule(schedule)
+		c.Save()
+		c.Printf("%s Mean interval between network transactions set to %s\n", termPrefix, core.FormatDuration(schedule.MeanInterval()))
+
+	case burstCommand:
+		count, err := strconv.Atoi(cmd.Count)
+		if err != nil || count < 0 || count > core.MaxBurstTransactions {
+			c.Printf("%s The number of transactions must be between 0 and %d\n", termErrPrefix, core.MaxBurstTransactions)
+			return
+		}
+		schedule := c.NetworkSchedule()
+		schedule.BurstTransactions = count
+		schedule.BurstInterval = 0
+		if count > 0 {
+			if schedule.BurstInterval, err = core.ParseInterval(cmd.Interval); err != nil || schedule.BurstInterval == 0 {
+				c.Printf("%s The burst interval must be a duration of at least %s\n", termErrPrefix, core.MinTransactionInterval)
+				return
+			}
+		}
+		c.SetNetworkSchedule(schedule)
+		c.Save()
+		if count == 0 {
+			c.Printf("%s Bursts disabled\n", termPrefix)
+			return
+		}
+		c.Printf("%s After sending, %d network transactions will be made at a mean interval of %s\n", termPrefix, count, core.FormatDuration(schedule.BurstInterval))
+
+	case quietHoursCommand:
+		quietHours, start, end, err := core.ParseQuietHours(cmd.Hours)
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		schedule := c.NetworkSchedule()
+		schedule.QuietHours, schedule.QuietStart, schedule.QuietEnd = quietHours, start, end
+		c.SetNetworkSchedule(schedule)
+		c.Save()
+		c.Printf("%s Quiet hours set to %s\n", termPrefix, schedule.QuietHoursString())
+
+	case pauseCommand, resumeCommand:
+		schedule := c.NetworkSchedule()
+		_, schedule.Paused = cmd.(pauseCommand)
+		c.SetNetworkSchedule(schedule)
+		c.Save()
+		if schedule.Paused {
+			c.Printf("%s Network transactions paused. Use transact-now to make one anyway\n", termPrefix)
+		} else {
+			c.Printf("%s Network transactions resumed\n", termPrefix)
+		}
+
+	case showIdentitiesCommand:
+		if c.identities == nil {
+			c.showIdentity()
+			return
+		}
+		c.identities.show(c.term)
+
+	case switchIdentityCommand:
+		// The selection has already been changed by the time that the
+		// identity receives this command.
+		if c.identities == nil {
+			c.Printf("%s Only one identity is loaded. Use --state-files to load several\n", termErrPrefix)
+			return
+		}
+		c.Printf("%s Using identity %s (%s)\n", termPrefix, terminalEscape(c.identityName, false), terminalEscape(c.Server, false))
+		c.setCurrentObject(c.currentObj)
+
+	case offlineCommand, onlineCommand:
+		_, offline := cmd.(offlineCommand)
+		if offline == c.IsOffline() {
+			if offline {
+				c.Printf("%s Already offline\n", termErrPrefix)
+			} else {
+				c.Printf("%s Already online\n", termErrPrefix)
+			}
+			return
+		}
+		c.SetOffline(offline)
+		c.Save()
+		if offline {
+			c.Printf("%s Offline. No network connections will be made. Use sync to send and fetch messages\n", termPrefix)
+		} else {
+			c.Printf("%s Online. Network transactions will be made as normal\n", termPrefix)
+			c.checkTorAvailable()
+		}
+
+	case syncCommand:
+		n, err := c.StartSync()
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		c.checkTorAvailable()
+		c.Printf("%s Syncing with up to %d network transactions\n", termPrefix, n)
+
+	case undeliverableAfterCommand:
+		var d time.Duration
+		if cmd.Duration != "default" {
+			var err error
+			if d, err = core.ParseDays(cmd.Duration); err != nil {
+				c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+				return
+			}
+			if d <= 0 {
+				c.Printf("%s The period must be positive\n", termErrPrefix)
+				return
+			}
+		}
+		c.SetUndeliverableAfter(d)
+		c.Save()
+		c.Printf("%s Messages will be flagged as undeliverable after their server has been failing for %s\n", termPrefix, core.FormatDuration(c.UndeliverableAfter()))
+
+	case coverTrafficCommand:
+		var on bool
+		switch cmd.State {
+		case "on":
+			on = true
+		case "off":
 		default:
+			c.Printf("%s Cover traffic can be 'on' or 'off'\n", termErrPrefix)
+			return
 		}
+		c.SetCoverTraffic(on)
+		c.Save()
+		c.Printf("%s Cover traffic turned %s\n", termPrefix, cmd.State)
+
+	case serverCarrierCommand:
+		if cmd.Carrier == "none" {
+			c.SetServerCarrier(cmd.Server, nil)
+			c.Save()
+			c.Printf("%s %s will be connected to directly\n", termPrefix, terminalEscape(cmd.Server, false))
+			return
+		}
+		carrier, err := core.ParseCarrier(cmd.Carrier)
+		if err == nil {
+			_, err = core.CarrierAddress(carrier, c.AllowClearnet(cmd.Server))
+		}
+		if err != nil {
+			c.Printf("%s Failed to parse carrier: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		c.SetServerCarrier(cmd.Server, carrier)
+		c.Save()
+		c.Printf("%s %s will be reached via %s\n", termPrefix, terminalEscape(cmd.Server, false), terminalEscape(carrier.String(), false))
+
+	case serverProxyCommand:
+		if cmd.Proxy == "default" {
+			c.SetServerProxy(cmd.Server, nil)
+			c.Save()
+			c.Printf("%s %s will use the default proxy\n", termPrefix, terminalEscape(cmd.Server, false))
+			return
+		}
+		p, ok := c.parseProxyCommand(cmd.Proxy, cmd.Isolate, cmd.AcknowledgeDirect)
+		if !ok {
+			return
+		}
+		c.SetServerProxy(cmd.Server, p)
+		c.Save()
+		c.Printf("%s Proxy for %s set to %s\n", termPrefix, terminalEscape(cmd.Server, false), terminalEscape(p.String(), false))
+		c.checkTorAvailable()
 
 	case closeCommand:
 		c.setCurrentObject(nil)
@@ -1249,25 +1857,25 @@ Handle:
 		}
 		if !c.deleteArmed {
 			switch obj := c.currentObj.(type) {
-			case *Contact:
-				c.Printf("%s You attempted to delete a contact (%s). Doing so removes all messages to and from that contact and revokes their ability to send you messages. To confirm, enter the delete command again.\n", termWarnPrefix, terminalEscape(obj.name, false))
-			case *Draft:
+			case *core.Contact:
+				c.Printf("%s You attempted to delete a contact (%s). Doing so removes all messages to and from that contact and revokes their ability to send you messages. To confirm, enter the delete command again.\n", termWarnPrefix, terminalEscape(obj.Name, false))
+			case *core.Draft:
 				toName := "<unknown>"
-				if obj.to != 0 {
-					toName = c.ContactName(obj.to)
+				if obj.To != 0 {
+					toName = c.ContactName(obj.To)
 				}
 				c.Printf("%s You attempted to delete a draft message (to %s). To confirm, enter the delete command again.\n", termWarnPrefix, terminalEscape(toName, false))
-			case *queuedMessage:
-				c.queueMutex.Lock()
-				if c.indexOfQueuedMessage(obj) != -1 {
-					c.queueMutex.Unlock()
+			case *core.QueuedMessage:
+				c.QueueMutex.Lock()
+				if c.IsQueued(obj) {
+					c.QueueMutex.Unlock()
 					c.Printf("%s Please abort the unsent message before deleting it.\n", termErrPrefix)
 					return
 				}
-				c.queueMutex.Unlock()
-				c.Printf("%s You attempted to delete a message (to %s). To confirm, enter the delete command again.\n", termWarnPrefix, terminalEscape(c.ContactName(obj.to), false))
-			case *InboxMessage:
-				c.Printf("%s You attempted to delete a message (from %s). To confirm, enter the delete command again.\n", termWarnPrefix, terminalEscape(c.ContactName(obj.from), false))
+				c.QueueMutex.Unlock()
+				c.Printf("%s You attempted to delete a message (to %s). To confirm, enter the delete command again.\n", termWarnPrefix, terminalEscape(c.ContactName(obj.To), false))
+			case *core.InboxMessage:
+				c.Printf("%s You attempted to delete a message (from %s). To confirm, enter the delete command again.\n", termWarnPrefix, terminalEscape(c.ContactName(obj.From), false))
 			default:
 				c.Printf("%s Cannot delete current object\n", termWarnPrefix)
 				return
@@ -1278,104 +1886,90 @@ Handle:
 		c.deleteArmed = false
 
 		switch obj := c.currentObj.(type) {
-		case *Contact:
-			c.deleteContact(obj)
-		case *Draft:
-			delete(c.drafts, obj.id)
-		case *queuedMessage:
-			c.deleteOutboxMsg(obj.id)
-		case *InboxMessage:
-			c.deleteInboxMsg(obj.id)
+		case *core.Contact:
+			c.DeleteContact(obj)
+		case *core.Draft:
+			c.DeleteDraft(obj.Id)
+		case *core.QueuedMessage:
+			c.DeleteOutboxMsg(obj.Id)
+		case *core.InboxMessage:
+			c.DeleteInboxMsg(obj.Id)
 		default:
 			c.Printf("%s Cannot delete current object\n", termWarnPrefix)
 			return
 		}
 		c.setCurrentObject(nil)
-		c.save()
+		c.Save()
 
 	case sendCommand:
-		draft, ok := c.currentObj.(*Draft)
+		draft, ok := c.currentObj.(*core.Draft)
 		if !ok {
 			c.Printf("%s Select draft first\n", termWarnPrefix)
 			return
 		}
-		if draft.to == 0 {
+		if draft.To == 0 {
 			c.Printf("%s Draft was created in the GUI and doesn't have a destination specified. Please use the GUI to manipulate this draft.\n", termErrPrefix)
 			return
 		}
-		id, _, err := c.sendDraft(draft)
+		id, _, err := c.SendDraft(draft)
+		if err == core.ErrDraftUploading {
+			c.Printf("%s Message is too large to send directly. Uploading attachments to home server; the message will be sent once they have been uploaded. Use the transfers command to see progress.\n", termPrefix)
+			if c.IsOffline() {
+				c.Printf("%s The client is offline so the upload will start with the next sync.\n", termPrefix)
+			}
+			return
+		}
 		if err != nil {
 			c.Printf("%s Error sending: %s\n", termErrPrefix, err)
 			return
 		}
-		if draft.inReplyTo != 0 {
-			for _, msg := range c.inbox {
-				if msg.message != nil && msg.message.GetId() == draft.inReplyTo {
-					msg.acked = true
-					break
-				}
-			}
-		}
-		delete(c.drafts, draft.id)
+		c.DraftSent(draft)
 		c.setCurrentObject(nil)
-		for _, msg := range c.outbox {
-			if msg.id == id {
-				if msg.cliId == invalidCliId {
-					msg.cliId = c.newCliId()
-				}
-				c.Printf("%s Created new outbox entry %s%s%s\n", termInfoPrefix, termCliIdStart, msg.cliId.String(), termReset)
-				c.setCurrentObject(msg)
-				c.showQueueState()
-				break
-			}
+		if msg := c.printOutboxCopies(id); msg != nil {
+			c.setCurrentObject(msg)
+			c.showQueueState()
 		}
-		c.save()
+		c.Save()
 
 	case abortCommand:
-		msg, ok := c.currentObj.(*queuedMessage)
+		msg, ok := c.currentObj.(*core.QueuedMessage)
 		if !ok {
 			c.Printf("%s Select outbox message first\n", termErrPrefix)
 			return
 		}
 
-		c.queueMutex.Lock()
-		index := c.indexOfQueuedMessage(msg)
-		if index == -1 || msg.sending {
-			c.queueMutex.Unlock()
+		if !c.AbortMessage(msg) {
 			c.Printf("%s Too Late to Abort!\n", termErrPrefix)
 			return
 		}
 
-		c.removeQueuedMessage(index)
-		c.queueMutex.Unlock()
-
-		c.deleteOutboxMsg(msg.id)
-		draft := c.outboxToDraft(msg)
-		c.drafts[draft.id] = draft
-		if draft.cliId == invalidCliId {
-			draft.cliId = c.newCliId()
+		c.DeleteOutboxMsg(msg.Id)
+		draft := c.OutboxToDraft(msg)
+		c.Drafts[draft.Id] = draft
+		if draft.CliId == core.InvalidCliId {
+			draft.CliId = c.newCliId()
 		}
 
-		c.Printf("%s Aborted sending %s%s%s and moved to Drafts as %s%s%s\n", termInfoPrefix, termCliIdStart, msg.cliId.String(), termReset, termCliIdStart, draft.cliId.String(), termReset)
-		c.save()
+		c.Printf("%s Aborted sending %s%s%s and moved to Drafts as %s%s%s\n", termInfoPrefix, termCliIdStart, msg.CliId.String(), termReset, termCliIdStart, draft.CliId.String(), termReset)
+		c.Save()
 		c.setCurrentObject(draft)
 
 	case ackCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
+		msg, ok := c.currentObj.(*core.InboxMessage)
 		if !ok {
 			c.Printf("%s Select inbox message first\n", termWarnPrefix)
 			return
 		}
-		if msg.acked {
+		if msg.Acked {
 			c.Printf("%s Message has already been acknowledged\n", termWarnPrefix)
 			return
 		}
-		if msg.from == 0 {
+		if msg.From == 0 {
 			c.Printf("%s Cannot ack server announcement\n", termWarnPrefix)
 			return
 		}
-		msg.acked = true
-		c.sendAck(msg)
+		msg.Acked = true
+		c.SendAck(msg)
 		c.showQueueState()
 
 	case showCommand:
@@ -1384,13 +1978,13 @@ Handle:
 			return
 		}
 		switch o := c.currentObj.(type) {
-		case *queuedMessage:
+		case *core.QueuedMessage:
 			c.showOutbox(o)
-		case *InboxMessage:
+		case *core.InboxMessage:
 			c.showInbox(o)
-		case *Draft:
+		case *core.Draft:
 			c.showDraft(o)
-		case *Contact:
+		case *core.Contact:
 			c.showContact(o)
 		default:
 			c.Printf("%s Cannot show the current object\n", termWarnPrefix)
@@ -1414,16 +2008,59 @@ Handle:
 	case showQueueStateCommand:
 		c.showQueueState()
 
+	case showTransfersCommand:
+		if len(c.Transfers) == 0 {
+			c.Printf("%s There are no uploads or downloads in progress\n", termInfoPrefix)
+			return
+		}
+		c.transfersSummary().WriteTo(c.term)
+
+	case cancelTransferCommand:
+		i, ok := c.prepareSubobjectCommand(cmd.Number, len(c.Transfers), "transfer")
+		if !ok {
+			return
+		}
+		t := c.Transfers[i]
+		c.CancelTransfer(t)
+		c.Printf("%s Cancelled %s of '%s'\n", termPrefix, strings.ToLower(t.Direction()), terminalEscape(t.Name(), false))
+
+	case showHooksCommand:
+		if len(c.Hooks) == 0 {
+			c.Printf("%s No hooks have been set\n", termInfoPrefix)
+		} else {
+			c.hooksSummary().WriteTo(c.term)
+		}
+		c.Printf("%s Events:\n", termInfoPrefix)
+		for _, e := range core.HookEvents {
+			c.Printf("%s %s: when %s\n", termHeaderPrefix, e.Name, e.Description)
+		}
+
+	case hookCommand:
+		command := cmd.Command
+		if command == "none" {
+			command = ""
+		}
+		if err := c.SetHook(cmd.Event, command, cmd.IncludeBody); err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		c.Save()
+		if len(command) == 0 {
+			c.Printf("%s Removed the hook for %s\n", termPrefix, terminalEscape(cmd.Event, false))
+			return
+		}
+		c.Printf("%s %s will be run for %s\n", termPrefix, terminalEscape(command, false), terminalEscape(cmd.Event, false))
+
 	case statusCommand:
 		c.showState()
 
 	case attachCommand:
-		draft, ok := c.currentObj.(*Draft)
+		draft, ok := c.currentObj.(*core.Draft)
 		if !ok {
 			c.Printf("%s Select draft first\n", termWarnPrefix)
 			return
 		}
-		contents, size, err := openAttachment(cmd.Filename)
+		contents, size, err := core.OpenAttachment(cmd.Filename)
 		if err != nil {
 			c.Printf("%s Failed to open file: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
 			return
@@ -1438,64 +2075,64 @@ Handle:
 			Filename: proto.String(base),
 			Contents: contents,
 		}
-		draft.attachments = append(draft.attachments, a)
+		draft.Attachments = append(draft.Attachments, a)
 		c.Printf("%s Attached '%s' (%d bytes)\n", termPrefix, terminalEscape(base, false), len(contents))
 		c.printDraftSize(draft)
 
 	case uploadCommand:
-		draft, ok := c.currentObj.(*Draft)
+		draft, ok := c.currentObj.(*core.Draft)
 		if !ok {
 			c.Printf("%s Select draft first\n", termWarnPrefix)
 			return
 		}
 
 		base := filepath.Base(cmd.Filename)
-		id := c.randId()
+		id := c.RandId()
 		c.Printf("%s Padding, encrypting and uploading '%s' to home server (Ctrl-C to abort):\n", termPrefix, terminalEscape(base, false))
-		cancelThunk := c.startUpload(id, cmd.Filename)
+		cancelThunk := c.StartUpload(id, draft.Id, cmd.Filename)
 
-		if detachment, ok := c.runBackgroundProcess(id, cancelThunk); ok {
-			draft.detachments = append(draft.detachments, detachment)
-		}
+		// The detachment is added to the draft once the upload is
+		// complete.
+		c.runBackgroundProcess(id, cancelThunk)
 
 	case downloadCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
+		msg, ok := c.currentObj.(*core.InboxMessage)
 		if !ok {
 			c.Printf("%s Select inbox message\n", termWarnPrefix)
 			return
 		}
-		i, ok := c.prepareSubobjectCommand(cmd.Number, len(msg.message.DetachedFiles), "detachment")
+		i, ok := c.prepareSubobjectCommand(cmd.Number, len(msg.Message.DetachedFiles), "detachment")
 		if !ok {
 			return
 		}
-		id := c.randId()
+		id := c.RandId()
 
-		if msg.message.DetachedFiles[i].Url == nil {
+		if msg.Message.DetachedFiles[i].Url == nil {
 			c.Printf("%s That detachment is just a key; you need to obtain the encrypted payload out-of-band. Use the save-key command and the decrypt utility the decrypt the payload.\n", termErrPrefix)
 			return
 		}
 
 		c.Printf("%s Downloading and decrypting detachment (Ctrl-C to abort):\n", termPrefix)
-		cancelThunk := c.startDownload(id, cmd.Filename, msg.message.DetachedFiles[i])
+		cancelThunk := c.StartDownload(id, cmd.Filename, msg.Message.DetachedFiles[i])
 
 		c.runBackgroundProcess(id, cancelThunk)
 
 	case saveKeyCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
+		msg, ok := c.currentObj.(*core.InboxMessage)
 		if !ok {
 			c.Printf("%s Select inbox message\n", termWarnPrefix)
 			return
 		}
-		i, ok := c.prepareSubobjectCommand(cmd.Number, len(msg.message.DetachedFiles), "detachment")
+		i, ok := c.prepareSubobjectCommand(cmd.Number, len(msg.Message.DetachedFiles), "detachment")
 		if !ok {
 			return
 		}
 
-		if msg.message.DetachedFiles[i].Url != nil {
+		if msg.Message.DetachedFiles[i].Url != nil {
 			c.Printf("%s (Note that this detachment can be downloaded with the 'download' command)\n", termInfoPrefix)
 		}
 
-		bytes, err := proto.Marshal(msg.message.DetachedFiles[i])
+		bytes, err := proto.Marshal(msg.Message.DetachedFiles[i])
 		if err != nil {
 			panic(err)
 		}
@@ -1507,43 +2144,43 @@ Handle:
 		}
 
 	case saveCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
+		msg, ok := c.currentObj.(*core.InboxMessage)
 		if !ok {
 			c.Printf("%s Select inbox message\n", termWarnPrefix)
 			return
 		}
-		i, ok := c.prepareSubobjectCommand(cmd.Number, len(msg.message.Files), "attachment")
+		i, ok := c.prepareSubobjectCommand(cmd.Number, len(msg.Message.Files), "attachment")
 		if !ok {
 			return
 		}
 
-		if err := ioutil.WriteFile(cmd.Filename, msg.message.Files[i].GetContents(), 0600); err != nil {
+		if err := ioutil.WriteFile(cmd.Filename, msg.Message.Files[i].GetContents(), 0600); err != nil {
 			c.Printf("%s Failed to write file: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
 		} else {
 			c.Printf("%s Wrote file\n", termPrefix)
 		}
 
 	case removeCommand:
-		draft, ok := c.currentObj.(*Draft)
+		draft, ok := c.currentObj.(*core.Draft)
 		if !ok {
 			c.Printf("%s Select draft first\n", termWarnPrefix)
 			return
 		}
-		i, ok := c.prepareSubobjectCommand(cmd.Number, len(draft.attachments)+len(draft.detachments), "attachment")
+		i, ok := c.prepareSubobjectCommand(cmd.Number, len(draft.Attachments)+len(draft.Detachments), "attachment")
 		if !ok {
 			return
 		}
 
-		if i < len(draft.attachments) {
-			draft.attachments = append(draft.attachments[:i], draft.attachments[i+1:]...)
+		if i < len(draft.Attachments) {
+			draft.Attachments = append(draft.Attachments[:i], draft.Attachments[i+1:]...)
 			return
 		}
-		i -= len(draft.attachments)
-		draft.detachments = append(draft.detachments[:i], draft.detachments[i+1:]...)
+		i -= len(draft.Attachments)
+		draft.Detachments = append(draft.Detachments[:i], draft.Detachments[i+1:]...)
 
 	case newContactCommand:
-		for _, contact := range c.contacts {
-			if contact.name == cmd.Name {
+		for _, contact := range c.Contacts {
+			if contact.Name == cmd.Name {
 				c.Printf("%s A contact with that name already exists.\n", termErrPrefix)
 				return
 			}
@@ -1565,71 +2202,230 @@ Handle:
 		}
 
 		if len(sharedSecret) == 0 {
-			sharedSecret = panda.NewSecretString(c.rand)
+			sharedSecret = panda.NewSecretString(c.Rand)
 			c.Printf("%s Shared secret: %s\n", termPrefix, sharedSecret)
 		}
 
-		contact := &Contact{
-			name:      cmd.Name,
-			isPending: true,
-			id:        c.randId(),
-			cliId:     c.newCliId(),
+		contact := c.StartPANDA(cmd.Name, sharedSecret)
+		contact.CliId = c.newCliId()
+		c.Printf("%s Key exchange running in background.\n", termPrefix)
+
+	case renameCommand:
+		if contact, ok := c.currentObj.(*core.Contact); ok {
+			c.renameContact(contact, cmd.NewName)
+		} else {
+			c.Printf("%s Select contact first\n", termWarnPrefix)
+		}
+
+	case addToGroupCommand:
+		contact, ok := c.currentObj.(*core.Contact)
+		if !ok {
+			c.Printf("%s Select contact first\n", termWarnPrefix)
+			return
+		}
+		if err := c.AddToGroup(cmd.Group, contact); err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		c.Save()
+
+	case removeFromGroupCommand:
+		contact, ok := c.currentObj.(*core.Contact)
+		if !ok {
+			c.Printf("%s Select contact first\n", termWarnPrefix)
+			return
+		}
+		if err := c.RemoveFromGroup(cmd.Group, contact); err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
 		}
+		c.Save()
 
-		c.newKeyExchange(contact)
+	case showGroupsCommand:
+		c.groupsSummary().WriteTo(c.term)
 
-		stack := &panda.CardStack{
-			NumDecks: 1,
+	case threadCommand:
+		var threads []core.Thread
+		switch o := c.currentObj.(type) {
+		case *core.InboxMessage:
+			if t := c.ThreadContaining(o, nil); t != nil {
+				threads = append(threads, t)
+			}
+		case *core.QueuedMessage:
+			if t := c.ThreadContaining(nil, o); t != nil {
+				threads = append(threads, t)
+			}
+		case *core.Contact:
+			threads = c.Threads(o.Id)
+		default:
+			c.Printf("%s Select message or contact first\n", termWarnPrefix)
+			return
 		}
-		secret := panda.SharedSecret{
-			Secret: sharedSecret,
-			Cards:  *stack,
+		if len(threads) == 0 {
+			c.Printf("%s No conversation to show\n", termWarnPrefix)
+			return
+		}
+		for _, t := range threads {
+			c.threadSummary(t).WriteTo(c.term)
 		}
 
-		mp := c.newMeetingPlace()
+	case searchCommand:
+		hits := c.Search(cmd.Query)
+		if len(hits) == 0 {
+			c.Printf("%s No messages found\n", termInfoPrefix)
+			return
+		}
+		c.searchSummary(cmd.Query, hits).WriteTo(c.term)
 
-		c.contacts[contact.id] = contact
-		kx, err := panda.NewKeyExchange(c.rand, mp, &secret, contact.kxsBytes)
+	case addRecipientCommand:
+		draft, ok := c.currentObj.(*core.Draft)
+		if !ok {
+			c.Printf("%s Select draft first\n", termWarnPrefix)
+			return
+		}
+		ids, err := c.ResolveRecipients(cmd.Name)
 		if err != nil {
-			panic(err)
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
 		}
-		kx.Testing = c.testing
-		contact.pandaKeyExchange = kx.Marshal()
-		contact.kxsBytes = nil
-
-		c.save()
-		c.pandaWaitGroup.Add(1)
-		contact.pandaShutdownChan = make(chan struct{})
-		go c.runPANDA(contact.pandaKeyExchange, contact.id, contact.name, contact.pandaShutdownChan)
-		c.Printf("%s Key exchange running in background.\n", termPrefix)
+		for _, id := range ids {
+			draft.AddRecipient(id)
+		}
+		c.Printf("%s Draft will be sent to %s\n", termInfoPrefix, terminalEscape(c.RecipientNames(draft), false))
+		c.Save()
 
-	case renameCommand:
-		if contact, ok := c.currentObj.(*Contact); ok {
-			c.renameContact(contact, cmd.NewName)
-		} else {
-			c.Printf("%s Select contact first\n", termWarnPrefix)
+	case removeRecipientCommand:
+		draft, ok := c.currentObj.(*core.Draft)
+		if !ok {
+			c.Printf("%s Select draft first\n", termWarnPrefix)
+			return
+		}
+		var contact *core.Contact
+		for _, id := range draft.Recipients() {
+			if c.Contacts[id].Name == cmd.Name {
+				contact = c.Contacts[id]
+				break
+			}
 		}
+		if contact == nil {
+			c.Printf("%s Draft isn't addressed to that contact\n", termErrPrefix)
+			return
+		}
+		if len(draft.AlsoTo) == 0 {
+			c.Printf("%s Cannot remove the only recipient of a draft\n", termErrPrefix)
+			return
+		}
+		draft.RemoveRecipient(contact.Id)
+		c.Printf("%s Draft will be sent to %s\n", termInfoPrefix, terminalEscape(c.RecipientNames(draft), false))
+		c.Save()
 
 	case retainCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
+		msg, ok := c.currentObj.(*core.InboxMessage)
 		if !ok {
 			c.Printf("%s Select inbox message first\n", termWarnPrefix)
 			return
 		}
-		msg.retained = true
-		c.save()
+		if c.SenderExpiry(msg) != 0 && !msg.Retained {
+			c.Printf("%s %s\n", termWarnPrefix, terminalEscape(msg.ExpiryWarning(), false))
+			c.Printf("%s Use 'retain-anyway' to retain it.\n", termWarnPrefix)
+			return
+		}
+		msg.Retained = true
+		c.Save()
+
+	case retainAnywayCommand:
+		msg, ok := c.currentObj.(*core.InboxMessage)
+		if !ok {
+			c.Printf("%s Select inbox message first\n", termWarnPrefix)
+			return
+		}
+		msg.Retained = true
+		c.Save()
+
+	case expiryCommand:
+		draft, ok := c.currentObj.(*core.Draft)
+		if !ok {
+			c.Printf("%s Select draft first\n", termWarnPrefix)
+			return
+		}
+		expiry, err := core.ParseExpiry(cmd.Duration)
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		draft.Expiry = expiry
+		c.Save()
+		if expiry == 0 {
+			c.Printf("%s Recipients will keep the message for the usual time\n", termInfoPrefix)
+		} else {
+			c.Printf("%s Recipients will be asked to erase the message %s after receiving it\n", termInfoPrefix, core.FormatDuration(expiry))
+		}
+
+	case sendAfterCommand:
+		draft, ok := c.currentObj.(*core.Draft)
+		if !ok {
+			c.Printf("%s Select draft first\n", termWarnPrefix)
+			return
+		}
+		sendAfter, err := core.ParseSendAfter(cmd.When, c.Now())
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		draft.SendAfter = sendAfter
+		c.Save()
+		c.Printf("%s Once sent, the message will be transmitted %s\n", termInfoPrefix, draft.ScheduleString())
+
+	case sendDelayCommand:
+		draft, ok := c.currentObj.(*core.Draft)
+		if !ok {
+			c.Printf("%s Select draft first\n", termWarnPrefix)
+			return
+		}
+		sendDelay, err := core.ParseSendDelay(cmd.Window)
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		draft.SendDelay = sendDelay
+		c.Save()
+		c.Printf("%s Once sent, the message will be transmitted %s\n", termInfoPrefix, draft.ScheduleString())
+
+	case retentionCommand:
+		contact, ok := c.currentObj.(*core.Contact)
+		if !ok {
+			c.Printf("%s Select contact first\n", termWarnPrefix)
+			return
+		}
+		policy, err := core.ParseRetention(cmd.Policy)
+		if err != nil {
+			c.Printf("%s %s\n", termErrPrefix, terminalEscape(err.Error(), false))
+			return
+		}
+		switch cmd.Which {
+		case "inbox":
+			contact.InboxRetention = policy
+			c.Printf("%s Messages from %s will be kept: %s\n", termInfoPrefix, terminalEscape(contact.Name, false), policy.Describe(false))
+		case "outbox":
+			contact.OutboxRetention = policy
+			c.Printf("%s Messages to %s will be kept: %s\n", termInfoPrefix, terminalEscape(contact.Name, false), policy.Describe(true))
+		default:
+			c.Printf("%s Unknown mailbox %s: use inbox or outbox\n", termErrPrefix, terminalEscape(cmd.Which, false))
+			return
+		}
+		c.Save()
 
 	case dontRetainCommand:
-		msg, ok := c.currentObj.(*InboxMessage)
+		msg, ok := c.currentObj.(*core.InboxMessage)
 		if !ok {
 			c.Printf("%s Select inbox message first\n", termWarnPrefix)
 			return
 		}
-		msg.retained = false
-		msg.exposureTime = c.Now()
+		msg.Retained = false
+		msg.ExposureTime = c.Now()
 		// TODO: the CLI needs to expire messages when open as the GUI
 		// does. See guiClient.processTimer.
-		c.save()
+		c.Save()
 
 	default:
 		panic(fmt.Sprintf("Unhandled command: %#v", cmd))
@@ -1638,26 +2434,26 @@ Handle:
 	return
 }
 
-func (c *cliClient) compose(to *Contact, draft *Draft, inReplyTo *InboxMessage) {
+func (c *cliClient) compose(to *core.Contact, draft *core.Draft, inReplyTo *core.InboxMessage) {
 	if draft == nil {
-		draft = &Draft{
-			id:      c.randId(),
-			created: time.Now(),
-			to:      to.id,
-			cliId:   c.newCliId(),
-		}
-		if inReplyTo != nil && inReplyTo.message != nil {
-			draft.inReplyTo = inReplyTo.message.GetId()
-			draft.body = indentForReply(inReplyTo.message.GetBody())
-		}
-		c.Printf("%s Created new draft: %s%s%s\n", termInfoPrefix, termCliIdStart, draft.cliId.String(), termReset)
-		c.drafts[draft.id] = draft
+		draft = &core.Draft{
+			Id:      c.RandId(),
+			Created: time.Now(),
+			To:      to.Id,
+			CliId:   c.newCliId(),
+		}
+		if inReplyTo != nil && inReplyTo.Message != nil {
+			draft.InReplyTo = inReplyTo.Message.GetId()
+			draft.Body = core.IndentForReply(inReplyTo.Message.GetBody())
+		}
+		c.Printf("%s Created new draft: %s%s%s\n", termInfoPrefix, termCliIdStart, draft.CliId.String(), termReset)
+		c.Drafts[draft.Id] = draft
 		c.setCurrentObject(draft)
 	}
 	if to == nil {
-		to = c.contacts[draft.to]
+		to = c.Contacts[draft.To]
 	}
-	if to.isPending {
+	if to.IsPending {
 		c.Printf("%s Cannot send message to pending contact\n", termErrPrefix)
 		return
 	}
@@ -1678,11 +2474,11 @@ func (c *cliClient) compose(to *Contact, draft *Draft, inReplyTo *InboxMessage)
 		os.Remove(tempFileName)
 	}()
 
-	fmt.Fprintf(tempFile, "# Pond message. Lines prior to the first blank line are ignored.\nTo: %s\n\n", to.name)
-	if len(draft.body) == 0 {
+	fmt.Fprintf(tempFile, "# Pond message. Lines prior to the first blank line are ignored.\nTo: %s\n\n", c.RecipientNames(draft))
+	if len(draft.Body) == 0 {
 		tempFile.WriteString("\n")
 	} else {
-		tempFile.WriteString(draft.body)
+		tempFile.WriteString(draft.Body)
 	}
 
 	// The editor is forced to vim because I'm not sure about leaks from
@@ -1712,39 +2508,42 @@ func (c *cliClient) compose(to *Contact, draft *Draft, inReplyTo *InboxMessage)
 	if i := bytes.Index(contents, []byte("\n\n")); i >= 0 {
 		contents = contents[i+2:]
 	}
-	draft.body = string(contents)
+	draft.Body = string(contents)
 	c.printDraftSize(draft)
 
-	c.save()
+	c.Save()
 }
 
-func (c *cliClient) showInbox(msg *InboxMessage) {
-	sentTimeText, eraseTimeText, msgText := msg.Strings()
-	msg.read = true
+func (c *cliClient) showInbox(msg *core.InboxMessage) {
+	sentTimeText, eraseTimeText, msgText := c.InboxStrings(msg)
+	msg.MarkRead(c.Now())
 
 	table := cliTable{
 		noIndicators:      true,
 		noTrailingNewline: true,
 		rows: []cliRow{
-			cliRow{cols: []string{"From", terminalEscape(c.ContactName(msg.from), false)}},
+			cliRow{cols: []string{"From", terminalEscape(c.ContactName(msg.From), false)}},
 			cliRow{cols: []string{"Sent", sentTimeText}},
 			cliRow{cols: []string{"Erase", eraseTimeText}},
-			cliRow{cols: []string{"Retain", fmt.Sprintf("%t", msg.retained)}},
+			cliRow{cols: []string{"Retain", fmt.Sprintf("%t", msg.Retained)}},
 		},
 	}
+	if countdown := c.ExpiryCountdown(msg, c.Now()); len(countdown) > 0 {
+		table.rows = append(table.rows, cliRow{cols: []string{"Expires", countdown}})
+	}
 	table.WriteTo(c.term)
 
-	if msg.message != nil {
-		if len(msg.message.Files) > 0 {
+	if msg.Message != nil {
+		if len(msg.Message.Files) > 0 {
 			c.Printf("%s Attachments (use 'save <#> <filename>' to save):\n", termHeaderPrefix)
 		}
-		for i, attachment := range msg.message.Files {
+		for i, attachment := range msg.Message.Files {
 			c.Printf("%s     %d: %s (%d bytes):\n", termHeaderPrefix, i+1, terminalEscape(attachment.GetFilename(), false), len(attachment.Contents))
 		}
-		if len(msg.message.DetachedFiles) > 0 {
+		if len(msg.Message.DetachedFiles) > 0 {
 			c.Printf("%s Detachments (use '[download|save-key] <#> <filename>' to save):\n", termHeaderPrefix)
 		}
-		for i, detachment := range msg.message.DetachedFiles {
+		for i, detachment := range msg.Message.DetachedFiles {
 			disposition := ""
 			if detachment.Url != nil {
 				disposition = ", downloadable"
@@ -1757,123 +2556,133 @@ func (c *cliClient) showInbox(msg *InboxMessage) {
 	c.Printf("\n")
 }
 
-func (c *cliClient) showOutbox(msg *queuedMessage) {
-	contact := c.contacts[msg.to]
-	var sentTime string
-	if contact.revokedUs {
-		sentTime = "(never - contact has revoked us)"
-	} else {
-		sentTime = formatTime(msg.sent)
-	}
-	eraseTime := formatTime(msg.created.Add(messageLifetime))
+func (c *cliClient) showOutbox(msg *core.QueuedMessage) {
+	contact := c.Contacts[msg.To]
+	sentTime := c.SentTimeString(msg)
+	eraseTime := c.OutboxEraseTimeString(msg)
 
 	table := cliTable{
 		noIndicators: true,
 		rows: []cliRow{
-			cliRow{cols: []string{"To", terminalEscape(contact.name, false)}},
-			cliRow{cols: []string{"Created", formatTime(time.Unix(*msg.message.Time, 0))}},
+			cliRow{cols: []string{"To", terminalEscape(contact.Name, false)}},
+			cliRow{cols: []string{"Created", core.FormatTime(time.Unix(*msg.Message.Time, 0))}},
 			cliRow{cols: []string{"Sent", sentTime}},
-			cliRow{cols: []string{"Acknowledged", formatTime(msg.acked)}},
+			cliRow{cols: []string{"Acknowledged", core.FormatTime(msg.Acked)}},
 			cliRow{cols: []string{"Erase", eraseTime}},
 		},
 	}
 	table.WriteTo(c.term)
 
-	if len(msg.message.Files) > 0 {
+	if msg.FanoutId != 0 {
+		c.Printf("%s Recipients:\n", termHeaderPrefix)
+		for _, m := range c.FanoutCopies(msg) {
+			c.Printf("%s     %s: %s\n", termHeaderPrefix, terminalEscape(c.ContactName(m.To), false), c.DeliveryStatus(m))
+		}
+	}
+
+	if len(msg.Message.Files) > 0 {
 		c.Printf("%s Attachments:\n", termHeaderPrefix)
 	}
-	for _, attachment := range msg.message.Files {
+	for _, attachment := range msg.Message.Files {
 		c.Printf("%s     %s (%d bytes):\n", termHeaderPrefix, terminalEscape(attachment.GetFilename(), false), len(attachment.Contents))
 	}
-	if len(msg.message.DetachedFiles) > 0 {
+	if len(msg.Message.DetachedFiles) > 0 {
 		c.Printf("%s Detachments:\n", termHeaderPrefix)
 	}
-	for _, detachment := range msg.message.DetachedFiles {
+	for _, detachment := range msg.Message.DetachedFiles {
 		c.Printf("%s     %s (%d bytes):\n", termHeaderPrefix, terminalEscape(detachment.GetFilename(), false), detachment.GetSize())
 	}
-	if len(msg.message.Files) > 0 || len(msg.message.DetachedFiles) > 0 {
+	if len(msg.Message.Files) > 0 || len(msg.Message.DetachedFiles) > 0 {
 		c.Printf("\n")
 	}
 
-	c.term.Write([]byte(terminalEscape(string(msg.message.Body), true /* line breaks ok */)))
+	c.term.Write([]byte(terminalEscape(string(msg.Message.Body), true /* line breaks ok */)))
 	c.Printf("\n")
 }
 
-func (c *cliClient) showDraft(msg *Draft) {
+func (c *cliClient) showDraft(msg *core.Draft) {
 	to := "(not specified)"
-	if msg.to != 0 {
-		to = c.ContactName(msg.to)
+	if msg.To != 0 {
+		to = c.RecipientNames(msg)
 	}
 	c.Printf("%s To: %s\n", termHeaderPrefix, terminalEscape(to, false))
-	c.Printf("%s Created: %s\n", termHeaderPrefix, formatTime(msg.created))
-	if len(msg.attachments) > 0 {
+	c.Printf("%s Created: %s\n", termHeaderPrefix, core.FormatTime(msg.Created))
+	if msg.Expiry != 0 {
+		c.Printf("%s Expiry: %s\n", termHeaderPrefix, core.FormatDuration(msg.Expiry))
+	}
+	if !msg.SendAfter.IsZero() || msg.SendDelay != 0 {
+		c.Printf("%s Transmit: %s\n", termHeaderPrefix, msg.ScheduleString())
+	}
+	if len(msg.Attachments) > 0 {
 		c.Printf("%s Attachments (use 'remove <#>' to remove):\n", termHeaderPrefix)
 	}
-	for i, attachment := range msg.attachments {
+	for i, attachment := range msg.Attachments {
 		c.Printf("%s     %d: %s (%d bytes):\n", termHeaderPrefix, i+1, terminalEscape(attachment.GetFilename(), false), len(attachment.Contents))
 	}
-	if len(msg.detachments) > 0 {
+	if len(msg.Detachments) > 0 {
 		c.Printf("%s Detachments (use 'remove <#>' to remove):\n", termHeaderPrefix)
 	}
-	for i, detachment := range msg.detachments {
-		c.Printf("%s     %d: %s (%d bytes):\n", termHeaderPrefix, 1+len(msg.attachments)+i, terminalEscape(detachment.GetFilename(), false), detachment.GetSize())
+	for i, detachment := range msg.Detachments {
+		c.Printf("%s     %d: %s (%d bytes):\n", termHeaderPrefix, 1+len(msg.Attachments)+i, terminalEscape(detachment.GetFilename(), false), detachment.GetSize())
 	}
 	c.Printf("\n")
-	c.term.Write([]byte(terminalEscape(string(msg.body), true /* line breaks ok */)))
+	c.term.Write([]byte(terminalEscape(string(msg.Body), true /* line breaks ok */)))
 	c.Printf("\n")
 }
 
-func (c *cliClient) renameContact(contact *Contact, newName string) {
-	if contact.name == newName {
+func (c *cliClient) renameContact(contact *core.Contact, newName string) {
+	if contact.Name == newName {
 		return
 	}
 
-	for _, contact := range c.contacts {
-		if contact.name == newName {
+	for _, contact := range c.Contacts {
+		if contact.Name == newName {
 			c.Printf("%s Another contact already has that name.\n", termErrPrefix)
 			return
 		}
 	}
 
-	contact.name = newName
-	c.save()
+	contact.Name = newName
+	c.Save()
 }
 
-func (c *cliClient) showContact(contact *Contact) {
-	if len(contact.pandaResult) > 0 {
-		c.Printf("%s PANDA error: %s\n", termErrPrefix, terminalEscape(contact.pandaResult, false))
+func (c *cliClient) showContact(contact *core.Contact) {
+	if len(contact.PandaResult) > 0 {
+		c.Printf("%s PANDA error: %s\n", termErrPrefix, terminalEscape(contact.PandaResult, false))
 	}
-	if contact.revoked {
+	if contact.Revoked {
 		c.Printf("%s This contact has been revoked\n", termWarnPrefix)
 	}
-	if contact.revokedUs {
+	if contact.RevokedUs {
 		c.Printf("%s This contact has revoked access\n", termWarnPrefix)
 	}
-	if contact.isPending {
+	if contact.IsPending {
 		c.Printf("%s This contact is pending\n", termWarnPrefix)
 	}
 
 	table := cliTable{
 		noIndicators: true,
 		rows: []cliRow{
-			cliRow{cols: []string{"Name", terminalEscape(contact.name, false)}},
-			cliRow{cols: []string{"Server", terminalEscape(contact.theirServer, false)}},
-			cliRow{cols: []string{"Generation", fmt.Sprintf("%d", contact.generation)}},
-			cliRow{cols: []string{"Public key", fmt.Sprintf("%x", contact.theirPub[:])}},
-			cliRow{cols: []string{"Identity key", fmt.Sprintf("%x", contact.theirIdentityPublic[:])}},
-			cliRow{cols: []string{"Client version", fmt.Sprintf("%d", contact.supportedVersion)}},
+			cliRow{cols: []string{"Name", terminalEscape(contact.Name, false)}},
+			cliRow{cols: []string{"Server", terminalEscape(contact.TheirServer, false)}},
+			cliRow{cols: []string{"Generation", fmt.Sprintf("%d", contact.Generation)}},
+			cliRow{cols: []string{"Public key", fmt.Sprintf("%x", contact.TheirPub[:])}},
+			cliRow{cols: []string{"Identity key", fmt.Sprintf("%x", contact.TheirIdentityPublic[:])}},
+			cliRow{cols: []string{"Client version", fmt.Sprintf("%d", contact.SupportedVersion)}},
+			cliRow{cols: []string{"Inbox retention", contact.InboxRetention.Describe(false)}},
+			cliRow{cols: []string{"Outbox retention", contact.OutboxRetention.Describe(true)}},
 		},
 	}
 	table.WriteTo(c.term)
 
-	if len(contact.events) > 0 {
+	if len(contact.Events) > 0 {
 		table = cliTable{
 			noIndicators: true,
 			heading:      "Events for this contact",
 		}
-		for _, event := range contact.events {
+		for _, event := range contact.Events {
 			table.rows = append(table.rows,
-				cliRow{cols: []string{event.t.Format(logTimeFormat), terminalEscape(event.msg, false)}},
+				cliRow{cols: []string{event.T.Format(core.LogTimeFormat), terminalEscape(event.Msg, false)}},
 			)
 		}
 
@@ -1883,32 +2692,31 @@ func (c *cliClient) showContact(contact *Contact) {
 
 func NewCLIClient(stateFilename string, rand io.Reader, testing, autoFetch bool) *cliClient {
 	c := &cliClient{
-		client: client{
-			testing:            testing,
-			dev:                testing,
-			autoFetch:          autoFetch,
-			stateFilename:      stateFilename,
-			log:                NewLog(),
-			rand:               rand,
-			contacts:           make(map[uint64]*Contact),
-			drafts:             make(map[uint64]*Draft),
-			newMessageChan:     make(chan NewMessage),
-			messageSentChan:    make(chan messageSendResult, 1),
-			backgroundChan:     make(chan interface{}, 8),
-			pandaChan:          make(chan pandaUpdate, 1),
-			usedIds:            make(map[uint64]bool),
-			signingRequestChan: make(chan signingRequest),
+		Client: core.Client{
+			Testing:            testing,
+			Dev:                testing,
+			AutoFetch:          autoFetch,
+			StateFilename:      stateFilename,
+			Log:                core.NewLog(),
+			Rand:               rand,
+			Contacts:           make(map[uint64]*core.Contact),
+			Drafts:             make(map[uint64]*core.Draft),
+			NewMessageChan:     make(chan core.NewMessage),
+			MessageSentChan:    make(chan core.MessageSendResult, 1),
+			BackgroundChan:     make(chan interface{}, 8),
+			PandaChan:          make(chan core.PandaUpdate, 1),
+			UsedIds:            make(map[uint64]bool),
+			SigningRequestChan: make(chan core.SigningRequest),
 		},
-		cliIdsAssigned: make(map[cliId]bool),
+		cliIdsAssigned: make(map[core.CliId]bool),
 	}
-	c.ui = c
+	c.UI = c
 
-	c.newMeetingPlace = func() panda.MeetingPlace {
-		return &panda.HTTPMeetingPlace{
-			TorAddress: c.torAddress,
-			URL:        "https://panda-key-exchange.appspot.com/exchange",
-		}
+	if !testing {
+		c.TimerChan = time.Tick(core.TimerInterval)
 	}
-	c.log.toStderr = false
+
+	c.NewMeetingPlace = c.HTTPMeetingPlace
+	c.Log.ToStderr = false
 	return c
 }
@@ -4,13 +4,21 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,8 +26,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/agl/pond/client/core"
+	"github.com/agl/pond/client/disk"
 	panda "github.com/agl/pond/panda"
 	pond "github.com/agl/pond/protos"
+	"github.com/agl/pond/transport"
 	"github.com/golang/protobuf/proto"
 )
 
@@ -300,9 +311,9 @@ func NewTestClient(t *testing.T, name string, options *TestClientOptions) (*Test
 		}
 	}
 	tc.guiClient = NewGUIClient(stateFilePath, tc.gui, rand.Reader, true, false)
-	tc.guiClient.log.name = name
-	tc.guiClient.log.toStderr = clientLogToStderr
-	tc.guiClient.timerChan = tc.testTimerChan
+	tc.guiClient.Log.Name = name
+	tc.guiClient.Log.ToStderr = clientLogToStderr
+	tc.guiClient.TimerChan = tc.testTimerChan
 	tc.guiClient.Start()
 	return tc, nil
 }
@@ -344,15 +355,15 @@ func (tc *TestClient) Reload() {
 
 func (tc *TestClient) ReloadWithMeetingPlace(mp panda.MeetingPlace) {
 	tc.Shutdown()
-	oldNowFunc := tc.nowFunc
+	oldNowFunc := tc.NowFunc
 	tc.gui = NewTestGUI(tc.gui.t)
 	tc.guiClient = NewGUIClient(filepath.Join(tc.stateDir, "state"), tc.gui, rand.Reader, true /* testing */, false /* autoFetch */)
-	tc.guiClient.log.name = tc.name
-	tc.guiClient.log.toStderr = clientLogToStderr
-	tc.guiClient.timerChan = tc.testTimerChan
-	tc.nowFunc = oldNowFunc
+	tc.guiClient.Log.Name = tc.name
+	tc.guiClient.Log.ToStderr = clientLogToStderr
+	tc.guiClient.TimerChan = tc.testTimerChan
+	tc.NowFunc = oldNowFunc
 	if mp != nil {
-		tc.guiClient.newMeetingPlace = func() panda.MeetingPlace {
+		tc.guiClient.NewMeetingPlace = func() panda.MeetingPlace {
 			return mp
 		}
 	}
@@ -554,11 +565,11 @@ func testKeyExchange(t *testing.T, versionA, versionB int) {
 
 	switch versionA {
 	case simulateOldRatchet:
-		client1.simulateOldClient = true
+		client1.SimulateOldClient = true
 	case simulateNewRatchet:
-		client1.disableV2Ratchet = true
+		client1.DisableV2Ratchet = true
 	case simulateNewRatchetV2:
-		client1.disableV2Ratchet = false
+		client1.DisableV2Ratchet = false
 	}
 
 	client2, err := NewTestClient(t, "client2", nil)
@@ -569,11 +580,11 @@ func testKeyExchange(t *testing.T, versionA, versionB int) {
 
 	switch versionB {
 	case simulateOldRatchet:
-		client2.simulateOldClient = true
+		client2.SimulateOldClient = true
 	case simulateNewRatchet:
-		client2.disableV2Ratchet = true
+		client2.DisableV2Ratchet = true
 	case simulateNewRatchetV2:
-		client1.disableV2Ratchet = false
+		client1.DisableV2Ratchet = false
 	}
 
 	proceedToKeyExchange(t, client1, server, "client2")
@@ -628,9 +639,9 @@ func testKeyExchange(t *testing.T, versionA, versionB int) {
 	client2.AdvanceTo(uiStateShowContact)
 }
 
-func contactByName(client *TestClient, name string) (id uint64, contact *Contact) {
-	for id, contact = range client.contacts {
-		if contact.name == name {
+func contactByName(client *TestClient, name string) (id uint64, contact *core.Contact) {
+	for id, contact = range client.Contacts {
+		if contact.Name == name {
 			return
 		}
 	}
@@ -638,8 +649,8 @@ func contactByName(client *TestClient, name string) (id uint64, contact *Contact
 }
 
 func clickOnContact(client *TestClient, name string) {
-	for id, contact := range client.contacts {
-		if contact.name == name {
+	for id, contact := range client.Contacts {
+		if contact.Name == name {
 			for _, entry := range client.contactsUI.entries {
 				if entry.id == id {
 					client.gui.events <- Click{name: entry.boxName}
@@ -686,7 +697,7 @@ func composeMessage(client *TestClient, to string, message string) {
 
 func transmitMessage(client *TestClient, readActions bool) {
 	ackChan := make(chan bool)
-	client.fetchNowChan <- ackChan
+	client.FetchNowChan <- ackChan
 
 WaitForAck:
 	for {
@@ -709,10 +720,10 @@ WaitForAck:
 	}
 }
 
-func fetchMessage(client *TestClient) (from string, msg *InboxMessage) {
+func fetchMessage(client *TestClient) (from string, msg *core.InboxMessage) {
 	ackChan := make(chan bool)
-	initialInboxLen := len(client.inbox)
-	client.fetchNowChan <- ackChan
+	initialInboxLen := len(client.Inbox)
+	client.FetchNowChan <- ackChan
 
 WaitForAck:
 	for {
@@ -724,12 +735,12 @@ WaitForAck:
 		}
 	}
 
-	if len(client.inbox) <= initialInboxLen {
+	if len(client.Inbox) <= initialInboxLen {
 		return "", nil
 	}
-	msg = client.inbox[len(client.inbox)-1]
-	if msg.from != 0 {
-		from = client.contacts[msg.from].name
+	msg = client.Inbox[len(client.Inbox)-1]
+	if msg.From != 0 {
+		from = client.Contacts[msg.From].Name
 	}
 	return
 }
@@ -758,7 +769,7 @@ func testMessageExchange(t *testing.T, crossVersion bool) {
 		t.Fatal(err)
 	}
 	defer client1.Close()
-	client1.simulateOldClient = crossVersion
+	client1.SimulateOldClient = crossVersion
 
 	client2, err := NewTestClient(t, "client2", nil)
 	if err != nil {
@@ -770,9 +781,9 @@ func testMessageExchange(t *testing.T, crossVersion bool) {
 
 	var initialCurrentDH [32]byte
 	if crossVersion {
-		for _, contact := range client1.contacts {
-			if contact.name == "client2" {
-				copy(initialCurrentDH[:], contact.currentDHPrivate[:])
+		for _, contact := range client1.Contacts {
+			if contact.Name == "client2" {
+				copy(initialCurrentDH[:], contact.CurrentDHPrivate[:])
 			}
 		}
 	}
@@ -784,7 +795,7 @@ func testMessageExchange(t *testing.T, crossVersion bool) {
 		if from != "client1" {
 			t.Fatalf("message from %s, expected client1", from)
 		}
-		if string(msg.message.Body) != testMsg {
+		if string(msg.Message.Body) != testMsg {
 			t.Fatalf("Incorrect message contents: %#v", msg)
 		}
 
@@ -793,16 +804,16 @@ func testMessageExchange(t *testing.T, crossVersion bool) {
 		if from != "client2" {
 			t.Fatalf("message from %s, expected client2", from)
 		}
-		if string(msg.message.Body) != testMsg {
+		if string(msg.Message.Body) != testMsg {
 			t.Fatalf("Incorrect message contents: %#v", msg)
 		}
 	}
 
 	if crossVersion {
 		// Ensure that the DH secrets are advancing.
-		for _, contact := range client1.contacts {
-			if contact.name == "client2" {
-				if bytes.Equal(initialCurrentDH[:], contact.currentDHPrivate[:]) {
+		for _, contact := range client1.Contacts {
+			if contact.Name == "client2" {
+				if bytes.Equal(initialCurrentDH[:], contact.CurrentDHPrivate[:]) {
 					t.Fatalf("DH secrets aren't advancing!")
 				}
 			}
@@ -841,10 +852,10 @@ func TestACKs(t *testing.T) {
 	if from != "client1" {
 		t.Fatalf("message from %s, expected client1", from)
 	}
-	if string(msg.message.Body) != testMsg {
+	if string(msg.Message.Body) != testMsg {
 		t.Fatalf("Incorrect message contents: %#v", msg)
 	}
-	if !client1.outbox[0].acked.IsZero() {
+	if !client1.Outbox[0].Acked.IsZero() {
 		t.Fatalf("client1 incorrectly believes that its message has been acked")
 	}
 	client2.gui.events <- Click{
@@ -857,7 +868,7 @@ func TestACKs(t *testing.T) {
 	client2.AdvanceTo(uiStateInbox)
 
 	ackChan := make(chan bool)
-	client2.fetchNowChan <- ackChan
+	client2.FetchNowChan <- ackChan
 WaitForAck:
 	for {
 		select {
@@ -870,7 +881,7 @@ WaitForAck:
 
 	fetchMessage(client1)
 
-	if client1.outbox[0].acked.IsZero() {
+	if client1.Outbox[0].Acked.IsZero() {
 		t.Fatalf("client1 doesn't believe that its message has been acked")
 	}
 
@@ -887,7 +898,7 @@ WaitForAck:
 		t.Fatalf("client1 still has %d outbox UI entries after delete", l)
 	}
 
-	if l := len(client1.outbox); l > 0 {
+	if l := len(client1.Outbox); l > 0 {
 		t.Fatalf("client1 still has %d outbox entries after delete", l)
 	}
 }
@@ -935,7 +946,7 @@ func TestHalfPairedMessageExchange(t *testing.T) {
 	if from != "client1" {
 		t.Fatalf("message from %s, expected client1", from)
 	}
-	if len(msg.sealed) == 0 {
+	if len(msg.Sealed) == 0 {
 		t.Fatalf("no sealed message from client2")
 	}
 	if len(client2.inboxUI.entries) == 0 {
@@ -992,11 +1003,11 @@ func TestDraft(t *testing.T) {
 	client.gui.events <- Click{name: "compose"}
 	client.AdvanceTo(uiStateCompose)
 
-	if l := len(client.drafts); l != 1 {
+	if l := len(client.Drafts); l != 1 {
 		t.Fatalf("Bad number of drafts: %d", l)
 	}
 	var draftID uint64
-	for id := range client.drafts {
+	for id := range client.Drafts {
 		draftID = id
 		break
 	}
@@ -1010,7 +1021,7 @@ func TestDraft(t *testing.T) {
 	client.Reload()
 	client.AdvanceTo(uiStateMain)
 
-	if l := len(client.drafts); l != 1 {
+	if l := len(client.Drafts); l != 1 {
 		t.Fatalf("Bad number of drafts after reload: %d", l)
 	}
 
@@ -1123,14 +1134,14 @@ func TestDraftDiscard(t *testing.T) {
 	client.gui.events <- Click{name: "compose"}
 	client.AdvanceTo(uiStateCompose)
 
-	if l := len(client.drafts); l != 1 {
+	if l := len(client.Drafts); l != 1 {
 		t.Fatalf("Bad number of drafts: %d", l)
 	}
 
 	client.gui.events <- Click{name: "discard"}
 	client.AdvanceTo(uiStateMain)
 
-	if l := len(client.drafts); l != 0 {
+	if l := len(client.Drafts); l != 0 {
 		t.Fatalf("Bad number of drafts after discard: %d", l)
 	}
 }
@@ -1195,15 +1206,15 @@ func testDetached(t *testing.T, upload bool) {
 		client1.gui.WaitForSignal()
 	}
 
-	var draft *Draft
-	for _, d := range client1.drafts {
+	var draft *core.Draft
+	for _, d := range client1.Drafts {
 		draft = d
 		break
 	}
 
 	client1.AdvanceTo(uiStateDetachmentComplete)
 
-	if len(draft.detachments) == 0 {
+	if len(draft.Detachments) == 0 {
 		t.Errorf("detachments still empty")
 	}
 
@@ -1215,7 +1226,7 @@ func testDetached(t *testing.T, upload bool) {
 
 	client1.AdvanceTo(uiStateOutbox)
 	ackChan := make(chan bool)
-	client1.fetchNowChan <- ackChan
+	client1.FetchNowChan <- ackChan
 
 WaitForAck:
 	for {
@@ -1228,12 +1239,12 @@ WaitForAck:
 	}
 
 	_, msg := fetchMessage(client2)
-	if len(msg.message.DetachedFiles) != 1 {
+	if len(msg.Message.DetachedFiles) != 1 {
 		t.Fatalf("message received with no detachments")
 	}
 
 	for _, e := range client2.inboxUI.entries {
-		if e.id == msg.id {
+		if e.id == msg.Id {
 			client2.gui.events <- Click{name: e.boxName}
 			break
 		}
@@ -1274,7 +1285,7 @@ func TestUploadDownload(t *testing.T) {
 	testDetached(t, true)
 }
 
-func TestLogOverflow(t *testing.T) {
+func TestAutomaticDetachment(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1290,65 +1301,124 @@ func TestLogOverflow(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer client1.Close()
-	proceedToMainUI(t, client1, server)
-
-	client1.gui.events <- Click{name: client1.clientUI.entries[1].boxName}
-	client1.AdvanceTo(uiStateLog)
-
-	for i := 0; i < 2*(logLimit+logSlack); i++ {
-		client1.log.Printf("%d", i)
-	}
-}
 
-func TestServerAnnounce(t *testing.T) {
-	server, err := NewTestServer(t)
+	client2, err := NewTestClient(t, "client2", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer server.Close()
+	defer client2.Close()
 
-	client, err := NewTestClient(t, "client", nil)
-	if err != nil {
-		t.Fatal(err)
+	proceedToPaired(t, client1, client2, server)
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+
+	// Each file can be attached directly, but not both of them.
+	small := make([]byte, pond.MaxSerializedMessage/3)
+	large := make([]byte, pond.MaxSerializedMessage*2/3)
+	io.ReadFull(rand.Reader, small)
+	io.ReadFull(rand.Reader, large)
+	for name, contents := range map[string][]byte{"small": small, "large": large} {
+		path := filepath.Join(client1.stateDir, name)
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		client1.gui.events <- Click{name: "attach"}
+		client1.gui.WaitForFileOpen()
+		client1.gui.events <- OpenResult{path: path, ok: true}
+		client1.gui.WaitForSignal()
 	}
-	defer client.Close()
 
-	proceedToMainUI(t, client, server)
+	var draft *core.Draft
+	for _, d := range client1.Drafts {
+		draft = d
+		break
+	}
+	if len(draft.Attachments) != 2 {
+		t.Fatalf("Expected two attachments but found %d", len(draft.Attachments))
+	}
+	if _, over := client1.UsageString(draft); over {
+		t.Fatalf("Draft with attachments that can be uploaded is considered too large")
+	}
 
-	const testMessage = "Hello world"
-	announce := &pond.Message{
-		Id:           proto.Uint64(0),
-		Time:         proto.Int64(time.Now().Unix()),
-		Body:         []byte(testMessage),
-		MyNextDh:     []byte{},
-		BodyEncoding: pond.Message_RAW.Enum(),
+	client1.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "foo"},
 	}
-	announceBytes, err := proto.Marshal(announce)
-	if err != nil {
-		t.Fatalf("Failed to marshal announce message: %s", err)
+
+	// The large file is uploaded in the background and the draft is sent
+	// once it has been.
+	client1.AdvanceTo(uiStateTransfers)
+	if !draft.SendWhenUploaded {
+		t.Fatalf("Draft isn't waiting for its upload")
 	}
-	if err := ioutil.WriteFile(fmt.Sprintf("%s/accounts/%x/announce-00000000", server.stateDir, client.identityPublic[:]), announceBytes, 0666); err != nil {
-		t.Fatalf("Failed to write announce message: %s", err)
+	if l := len(client1.Transfers); l != 1 {
+		t.Fatalf("Expected one upload but found %d transfers", l)
+	}
+	if t0 := client1.Transfers[0]; !t0.Attachment || t0.Detachment == nil || t0.Name() != "large" {
+		t.Fatalf("Bad upload transfer: %#v", t0)
+	}
+	for len(client1.Transfers) > 0 {
+		client1.AdvanceTo(uiStateTransfers)
+	}
+	if _, ok := client1.Drafts[draft.Id]; ok {
+		t.Fatalf("Draft wasn't removed after it was sent")
+	}
+	if l := len(client1.Outbox); l != 1 {
+		t.Fatalf("Expected one message in the outbox but found %d", l)
 	}
 
-	fetchMessage(client)
+	if l := len(draft.Attachments); l != 1 || draft.Attachments[0].GetFilename() != "small" {
+		t.Fatalf("Expected only the small file to remain attached, but found %d attachments", l)
+	}
+	if l := len(draft.Detachments); l != 1 || draft.Detachments[0].GetFilename() != "large" {
+		t.Fatalf("Expected only the large file to have been uploaded, but found %d detachments", l)
+	}
 
-	if len(client.inbox) != 1 {
-		t.Fatalf("Inbox doesn't have a message")
+	ackChan := make(chan bool)
+	client1.FetchNowChan <- ackChan
+
+WaitForAck:
+	for {
+		select {
+		case ack := <-client1.gui.signal:
+			ack <- true
+		case <-ackChan:
+			break WaitForAck
+		}
 	}
-	client.gui.events <- Click{
-		name: client.inboxUI.entries[0].boxName,
+
+	_, msg := fetchMessage(client2)
+	if len(msg.Message.Files) != 1 || !bytes.Equal(msg.Message.Files[0].Contents, small) {
+		t.Fatalf("Small file wasn't received as an attachment")
 	}
-	client.AdvanceTo(uiStateInbox)
-	if s := client.gui.text["body"]; s != testMessage {
-		t.Fatalf("resolved message is incorrect: %s", s)
+	if len(msg.Message.DetachedFiles) != 1 {
+		t.Fatalf("Large file wasn't received as a detachment")
 	}
 
-	client.Reload()
-	client.AdvanceTo(uiStateMain)
+	for _, e := range client2.inboxUI.entries {
+		if e.id == msg.Id {
+			client2.gui.events <- Click{name: e.boxName}
+			break
+		}
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{name: "detachment-download-0"}
+	fo := client2.gui.WaitForFileOpen()
+	outputPath := filepath.Join(client2.stateDir, "output")
+	client2.gui.events <- OpenResult{ok: true, path: outputPath, arg: fo.arg}
+	client2.AdvanceTo(uiStateDetachmentComplete)
+
+	result, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, large) {
+		t.Fatalf("Downloaded detachment doesn't match the large file")
+	}
 }
 
-func TestRevoke(t *testing.T) {
+func TestMultipartMessage(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1371,125 +1441,101 @@ func TestRevoke(t *testing.T) {
 	}
 	defer client2.Close()
 
-	client3, err := NewTestClient(t, "client3", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer client3.Close()
+	proceedToPaired(t, client1, client2, server)
 
-	client4, err := NewTestClient(t, "client4", nil)
-	if err != nil {
-		t.Fatal(err)
+	// client1 learns that client2 supports messages in parts from a message.
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+	id2, _ := contactByName(client1, "client2")
+	if v := client1.Contacts[id2].SupportedVersion; v < core.MultipartVersion {
+		t.Fatalf("client2 advertised version %d", v)
 	}
-	defer client4.Close()
-
-	proceedToPaired(t, client1, client2, server)
-	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
-	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
 
-	initialGeneration := client1.generation
+	// The body is random, so that it doesn't compress, and includes
+	// multi-byte runes that mustn't be split between parts.
+	random := make([]byte, 2*pond.MaxSerializedMessage)
+	rand.Reader.Read(random)
+	body := strings.Replace(fmt.Sprintf("%x", random), "0", "é", -1)
 
-	// Have client4 send a message before the revocation.
-	const beforeRevocationMsg = "from before revocation"
-	sendMessage(client4, "client1", beforeRevocationMsg)
+	usage, over := client1.UsageString(&core.Draft{To: id2, Body: body})
+	if over || !strings.Contains(usage, "parts") {
+		t.Fatalf("bad usage for a long draft: %s", usage)
+	}
 
-	var client1FromClient2 *Contact
-	for _, candidate := range client2.contacts {
-		if candidate.name == "client1" {
-			client1FromClient2 = candidate
-			break
-		}
+	sendMessage(client1, "client2", body)
+	if l := len(client1.Outbox); l != 1 {
+		t.Fatalf("client1 has %d outbox entries, expected 1", l)
 	}
-	if client1FromClient2.generation != initialGeneration {
-		t.Errorf("Initial generations don't match")
+	out := client1.Outbox[0]
+	numParts := len(out.Parts)
+	if numParts < 2 {
+		t.Fatalf("message was split into %d parts", numParts)
 	}
-
-	var client1FromClient3 *Contact
-	for _, candidate := range client3.contacts {
-		if candidate.name == "client1" {
-			client1FromClient3 = candidate
-			break
-		}
+	for i := 1; i < numParts; i++ {
+		transmitMessage(client1, false)
 	}
 
-	client1.gui.events <- Click{name: client1.contactsUI.entries[0].boxName}
-	client1.AdvanceTo(uiStateShowContact)
-	client1.gui.events <- Click{name: "delete"}
-	client1.gui.WaitForSignal() // button changes to "Confirm"
-	client1.gui.events <- Click{name: "delete"}
-	client1.AdvanceTo(uiStateRevocationComplete)
-
-	if client1.generation != initialGeneration+1 {
-		t.Errorf("Generation did not advance")
+	for i := 0; i < numParts-1; i++ {
+		transmitMessage(client2, true)
 	}
-
-	if len(client1.outboxUI.entries) != 1 {
-		t.Errorf("No revocation entry found after click")
+	if l := len(client2.Inbox); l != 0 {
+		t.Fatalf("message was presented before all its parts had arrived")
 	}
-	client1.Reload()
-	client1.AdvanceTo(uiStateMain)
-
-	if len(client1.outboxUI.entries) != 1 {
-		t.Errorf("No revocation entry found after reload")
+	if l := len(client2.HeldParts); l != numParts-1 {
+		t.Fatalf("client2 is holding %d parts, expected %d", l, numParts-1)
 	}
 
-	transmitMessage(client1, true)
-
-	composeMessage(client2, "client1", "test1")
-	// Select the contact before sending because we have previously crashed
-	// in this case. See https://github.com/agl/pond/issues/96.
-	client2.gui.events <- Click{name: client2.contactsUI.entries[0].boxName}
-	client2.AdvanceTo(uiStateShowContact)
-	transmitMessage(client2, false)
-	client2.AdvanceTo(uiStateRevocationProcessed)
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if l := len(client2.HeldParts); l != numParts-1 {
+		t.Fatalf("after reload, client2 is holding %d parts, expected %d", l, numParts-1)
+	}
 
-	if gen := client1FromClient2.generation; gen != client1.generation {
-		t.Errorf("Generation number didn't update: found %d, want %d", gen, client1.generation)
+	// The reassembled message is received at the time of the client's
+	// clock.
+	receivedTime := time.Now().Add(time.Hour).Truncate(time.Second)
+	client2.NowFunc = func() time.Time {
+		return receivedTime
 	}
-	if !client1FromClient2.revokedUs {
-		t.Errorf("Client1 isn't marked as revoked")
+	from, msg := fetchMessage(client2)
+	client2.NowFunc = nil
+	if from != "client1" || msg == nil {
+		t.Fatalf("message wasn't reassembled")
 	}
-
-	sendMessage(client3, "client1", "test2")
-	client3.AdvanceTo(uiStateRevocationProcessed)
-
-	if gen := client1FromClient3.generation; gen != client1.generation {
-		t.Errorf("Generation number didn't update for non-revoked: found %d, want %d", gen, client1.generation)
+	if !msg.ReceivedTime.Equal(receivedTime) {
+		t.Fatalf("reassembled message was received at %s, expected %s", msg.ReceivedTime, receivedTime)
 	}
-	if client1FromClient3.revokedUs {
-		t.Errorf("Client3 believes that it was revoked")
+	if string(msg.Message.Body) != body {
+		t.Fatalf("reassembled message doesn't match")
+	}
+	if l := len(msg.PartIds); l != numParts-1 {
+		t.Fatalf("reassembled message has %d part ids, expected %d", l, numParts-1)
+	}
+	if l := len(client2.HeldParts); l != 0 {
+		t.Fatalf("client2 is still holding %d parts", l)
 	}
 
-	// Have client3 resend.
-	transmitMessage(client3, false)
-
-	// Have client1 fetch the resigned message from client3, and the
-	// message from client4 using previousTags.
-	var seenClient3, seenClient4 bool
-	for i := 0; i < 2; i++ {
-		from, msg := fetchMessage(client1)
-		switch from {
-		case "client3":
-			if seenClient3 {
-				t.Fatalf("client3 message observed twice")
-			}
-			if string(msg.message.Body) != "test2" {
-				t.Fatalf("Incorrect message contents from client3: %#v", msg)
-			}
-			seenClient3 = true
-		case "client4":
-			if seenClient4 {
-				t.Fatalf("client4 message observed twice")
-			}
-			if string(msg.message.Body) != beforeRevocationMsg {
-				t.Fatalf("Incorrect message contents client4: %#v", msg)
-			}
-			seenClient4 = true
+	for _, e := range client2.inboxUI.entries {
+		if e.id == msg.Id {
+			client2.gui.events <- Click{name: e.boxName}
+			break
 		}
 	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{name: "ack"}
+	client2.AdvanceTo(uiStateInbox)
+	transmitMessage(client2, false)
+
+	fetchMessage(client1)
+	if out.Sent.IsZero() {
+		t.Fatalf("message wasn't marked as sent after all its parts were sent")
+	}
+	if out.Acked.IsZero() {
+		t.Fatalf("client1 doesn't believe that its message has been acked")
+	}
 }
 
-func TestMultiRevoke(t *testing.T) {
+func TestHeldPartsDropped(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1512,79 +1558,55 @@ func TestMultiRevoke(t *testing.T) {
 	}
 	defer client2.Close()
 
-	client3, err := NewTestClient(t, "client3", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer client3.Close()
-
-	client4, err := NewTestClient(t, "client4", nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer client4.Close()
-
 	proceedToPaired(t, client1, client2, server)
-	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
-	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
 
-	revokeContact := func(client *TestClient, name string) {
-		found := false
-		for _, ent := range client.contactsUI.entries {
-			if client.contacts[ent.id].name == name {
-				client.gui.events <- Click{name: ent.boxName}
-				found = true
-				break
-			}
+	// holdParts has client2 receive all but the last part of a long
+	// message from client1.
+	holdParts := func() {
+		random := make([]byte, 2*pond.MaxSerializedMessage)
+		rand.Reader.Read(random)
+		sendMessage(client1, "client2", fmt.Sprintf("%x", random))
+		out := client1.Outbox[len(client1.Outbox)-1]
+		numParts := len(out.Parts)
+		for i := 1; i < numParts; i++ {
+			transmitMessage(client1, false)
 		}
-		if !found {
-			t.Fatalf("Couldn't find contact %s", name)
+		for i := 0; i < numParts-1; i++ {
+			transmitMessage(client2, true)
+		}
+		if l := len(client2.HeldParts); l != numParts-1 {
+			t.Fatalf("client2 is holding %d parts, expected %d", l, numParts-1)
 		}
-		client.AdvanceTo(uiStateShowContact)
-		client.gui.events <- Click{name: "delete"}
-		client.gui.WaitForSignal() // button changes to "Confirm"
-		client.gui.events <- Click{name: "delete"}
-		client.AdvanceTo(uiStateRevocationComplete)
-
-		transmitMessage(client, true)
 	}
 
-	// Revoke client3 and 4 from client1.
-	revokeContact(client1, "client3")
-	revokeContact(client1, "client4")
-
-	// Send a message from client2 to client1. It should hit two
-	// revocations, which should be returned in a single error from the
-	// server.
-	sendMessage(client2, "client1", "test")
-	client2.AdvanceTo(uiStateRevocationProcessed)
-	client2.AdvanceTo(uiStateRevocationProcessed)
-
-	if g := client2.contacts[client2.contactsUI.entries[0].id].generation; g != client1.generation {
-		t.Errorf("Generations don't match: %d vs %d", g, client1.generation)
+	// Parts of a message that never arrives in full are dropped by the
+	// timer once they're as old as a message would be.
+	holdParts()
+	baseTime := time.Now()
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + 10*time.Second)
 	}
-}
-
-func startPANDAKeyExchange(t *testing.T, client *TestClient, server *TestServer, otherName, sharedSecret string) {
-	proceedToMainUI(t, client, server)
-
-	client.gui.events <- Click{name: "newcontact"}
-	client.AdvanceTo(uiStateNewContact)
-
-	client.gui.events <- Click{
-		name:    "name",
-		entries: map[string]string{"name": otherName},
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+	if l := len(client2.HeldParts); l != 0 {
+		t.Fatalf("client2 is still holding %d parts after they expired", l)
 	}
-	client.gui.events <- Click{name: "shared"}
-	client.AdvanceTo(uiStateNewContact2)
+	client2.NowFunc = nil
 
-	client.gui.events <- Click{
-		name:    "begin",
-		entries: map[string]string{"shared": sharedSecret},
+	// Deleting a contact drops the parts held from them.
+	holdParts()
+	clickOnContact(client2, "client1")
+	client2.gui.events <- Click{name: "delete"}
+	client2.gui.events <- Click{name: "delete"}
+	client2.AdvanceTo(uiStateRevocationComplete)
+	if l := len(client2.HeldParts); l != 0 {
+		t.Fatalf("client2 is still holding %d parts after deleting the contact", l)
 	}
 }
 
-func TestPANDA(t *testing.T) {
+func TestResumeTransfers(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1595,65 +1617,336 @@ func TestPANDA(t *testing.T) {
 	}
 	defer server.Close()
 
-	client1, err := NewTestClient(t, "client1", nil)
+	client, err := NewTestClient(t, "client", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client1.Close()
+	defer client.Close()
+	proceedToMainUI(t, client, server)
 
-	client2, err := NewTestClient(t, "client2", nil)
-	if err != nil {
+	client.gui.events <- Click{name: "compose"}
+	client.AdvanceTo(uiStateCompose)
+	var draft *core.Draft
+	for _, d := range client.Drafts {
+		draft = d
+	}
+
+	plaintextPath := filepath.Join(client.stateDir, "file")
+	plaintext := make([]byte, 200*1024)
+	io.ReadFull(rand.Reader, plaintext)
+	if err := ioutil.WriteFile(plaintextPath, plaintext, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// waitForTransfers shows the list of transfers until they have all
+	// finished.
+	waitForTransfers := func() {
+		client.gui.events <- Click{name: client.clientUI.entries[3].boxName}
+		for {
+			client.AdvanceTo(uiStateTransfers)
+			if len(client.Transfers) == 0 {
+				break
+			}
+		}
+	}
+
+	// An upload that was interrupted before the file was encrypted is
+	// started again when the client is reloaded.
+	tmp, err := ioutil.TempFile("", "pond-upload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	client.Transfers = append(client.Transfers, &core.Transfer{
+		Id:      client.RandId(),
+		Upload:  true,
+		TmpPath: tmp.Name(),
+		Path:    plaintextPath,
+		Draft:   draft.Id,
+		Size:    int64(len(plaintext)),
+	})
+	client.Save()
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	if l := len(client.Transfers); l > 1 {
+		t.Fatalf("%d transfers loaded, expected one", l)
+	}
+	waitForTransfers()
+
+	draft = client.Drafts[draft.Id]
+	if l := len(draft.Detachments); l != 1 {
+		t.Fatalf("draft has %d detachments after the upload resumed", l)
+	}
+	detachment := draft.Detachments[0]
+	if detachment.GetFilename() != "file" || detachment.Url == nil {
+		t.Fatalf("bad detachment after upload: %s", detachment)
+	}
+	if _, err := os.Stat(tmp.Name()); err == nil {
+		t.Errorf("temp file wasn't removed after the upload")
+	}
+
+	// Likewise for an interrupted download.
+	outputPath := filepath.Join(client.stateDir, "output")
+	tmp, err = ioutil.TempFile("", "pond-download-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	client.Transfers = append(client.Transfers, &core.Transfer{
+		Id:         client.RandId(),
+		TmpPath:    tmp.Name(),
+		Path:       outputPath,
+		Detachment: detachment,
+	})
+	client.Save()
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+	waitForTransfers()
+
+	result, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, plaintext) {
+		t.Fatalf("resumed download doesn't match the uploaded file")
+	}
+
+	// Cancelling a transfer that hasn't been started, for example because
+	// the client is offline, removes its temp file.
+	tmp, err = ioutil.TempFile("", "pond-upload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	waiting := &core.Transfer{
+		Id:      client.RandId(),
+		Upload:  true,
+		TmpPath: tmp.Name(),
+		Path:    plaintextPath,
+		Draft:   draft.Id,
+	}
+	client.Transfers = append(client.Transfers, waiting)
+	client.CancelTransfer(waiting)
+	if _, err := os.Stat(tmp.Name()); err == nil {
+		t.Errorf("temp file wasn't removed after cancelling a waiting transfer")
+	}
+}
+
+func TestForward(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
 		t.Fatal(err)
 	}
 	defer client2.Close()
 
-	mp := panda.NewSimpleMeetingPlace()
-	newMeetingPlace := func() panda.MeetingPlace {
-		return mp
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	client1.newMeetingPlace = newMeetingPlace
-	client2.newMeetingPlace = newMeetingPlace
+	defer client3.Close()
 
-	startPANDAKeyExchange(t, client1, server, "client2", "shared secret")
+	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client2, client3, "client2", "client3", server)
 
-	client1.ReloadWithMeetingPlace(mp)
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
 
-	startPANDAKeyExchange(t, client2, server, "client1", "shared secret")
+	small := []byte("small file")
+	smallPath := filepath.Join(client1.stateDir, "small")
+	if err := ioutil.WriteFile(smallPath, small, 0644); err != nil {
+		t.Fatal(err)
+	}
+	large := make([]byte, 200*1024)
+	io.ReadFull(rand.Reader, large)
+	largePath := filepath.Join(client1.stateDir, "large")
+	if err := ioutil.WriteFile(largePath, large, 0644); err != nil {
+		t.Fatal(err)
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		client1.AdvanceTo(uiStatePANDAComplete)
-		wg.Done()
-	}()
-	go func() {
-		client2.AdvanceTo(uiStatePANDAComplete)
-		wg.Done()
-	}()
-	wg.Wait()
+	client1.gui.events <- Click{name: "attach"}
+	client1.gui.WaitForFileOpen()
+	client1.gui.events <- OpenResult{path: smallPath, ok: true}
+	client1.gui.WaitForSignal()
 
-	var client2FromClient1 *Contact
-	for _, contact := range client1.contacts {
-		client2FromClient1 = contact
-		break
+	client1.gui.events <- Click{name: "attach"}
+	client1.gui.WaitForFileOpen()
+	client1.gui.events <- OpenResult{path: largePath, ok: true}
+	client1.gui.WaitForSignal()
+	for name := range client1.gui.text {
+		const labelPrefix = "attachment-label-"
+		if strings.HasPrefix(name, labelPrefix) && strings.HasPrefix(client1.gui.text[name], "large") {
+			client1.gui.events <- Click{name: "attachment-upload-" + name[len(labelPrefix):]}
+			break
+		}
 	}
+	client1.AdvanceTo(uiStateDetachmentComplete)
 
-	var client1FromClient2 *Contact
-	for _, contact := range client2.contacts {
-		client1FromClient2 = contact
-		break
+	client1.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "have a look at these"},
+	}
+	client1.AdvanceTo(uiStateOutbox)
+	transmitMessage(client1, false)
+
+	_, received := fetchMessage(client2)
+	if received == nil || len(received.Message.Files) != 1 || len(received.Message.DetachedFiles) != 1 {
+		t.Fatalf("client2 didn't receive the attachment and detachment")
+	}
+
+	for _, e := range client2.inboxUI.entries {
+		if e.id == received.Id {
+			client2.gui.events <- Click{name: e.boxName}
+			break
+		}
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	// The detachment is forwarded shortly before client1's server will
+	// delete it, so it's copied to client2's server.
+	sent := time.Unix(received.Message.GetTime(), 0)
+	client2.NowFunc = func() time.Time {
+		return sent.Add(core.DetachmentLifetime - time.Hour)
 	}
+	client2.gui.events <- Click{name: "forward"}
+	client2.AdvanceTo(uiStateDetachmentComplete)
+	client2.NowFunc = nil
+
+	var draft *core.Draft
+	for _, d := range client2.Drafts {
+		draft = d
+	}
+	if !strings.Contains(draft.Body, "Forwarded message from client1") || !strings.Contains(draft.Body, "> have a look at these") {
+		t.Fatalf("forwarded draft has bad body: %q", draft.Body)
+	}
+	if len(draft.Attachments) != 1 || len(draft.Detachments) != 1 {
+		t.Fatalf("forwarded draft has %d attachments and %d detachments", len(draft.Attachments), len(draft.Detachments))
+	}
+	original := received.Message.DetachedFiles[0]
+	copied := draft.Detachments[0]
+	if !strings.Contains(copied.GetUrl(), fmt.Sprintf("%x", client2.IdentityPublic[:])) {
+		t.Fatalf("forwarded detachment wasn't copied to client2's account: %s", copied.GetUrl())
+	}
+	if !bytes.Equal(copied.Key, original.Key) || copied.GetSize() != original.GetSize() {
+		t.Fatalf("copied detachment doesn't match the original")
+	}
+
+	// client1's server deletes the original before client3 downloads the
+	// forwarded detachment.
+	u, err := url.Parse(original.GetUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pathParts := strings.Split(u.Path, "/")
+	if err := os.Remove(filepath.Join(server.stateDir, "accounts", pathParts[1], "files", pathParts[2])); err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempFile("", "pond-client-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := client2.CopyDetachment(1, tmp.Name(), original, nil); err == nil {
+		t.Fatalf("a deleted detachment was copied")
+	}
+
+	client2.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client3"},
+		textViews: map[string]string{"body": draft.Body},
+	}
+	client2.AdvanceTo(uiStateOutbox)
+	transmitMessage(client2, false)
+
+	from, msg := fetchMessage(client3)
+	if from != "client2" || msg == nil {
+		t.Fatalf("client3 didn't receive the forwarded message")
+	}
+	if len(msg.Message.Files) != 1 || !bytes.Equal(msg.Message.Files[0].Contents, small) {
+		t.Fatalf("forwarded attachment wasn't received")
+	}
+	if len(msg.Message.DetachedFiles) != 1 {
+		t.Fatalf("forwarded detachment wasn't received")
+	}
+
+	// The detachment is downloaded from the copy on client2's account.
+	for _, e := range client3.inboxUI.entries {
+		if e.id == msg.Id {
+			client3.gui.events <- Click{name: e.boxName}
+			break
+		}
+	}
+	client3.AdvanceTo(uiStateInbox)
+	client3.gui.events <- Click{name: "detachment-download-0"}
+	fo := client3.gui.WaitForFileOpen()
+	outputPath := filepath.Join(client3.stateDir, "output")
+	client3.gui.events <- OpenResult{ok: true, path: outputPath, arg: fo.arg}
+	client3.AdvanceTo(uiStateDetachmentComplete)
 
-	if g := client2FromClient1.generation; g != client2.generation {
-		t.Errorf("Generation mismatch %d vs %d", g, client1.generation)
+	result, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, large) {
+		t.Fatalf("forwarded detachment doesn't match")
 	}
 
-	if g := client1FromClient2.generation; g != client1.generation {
-		t.Errorf("Generation mismatch %d vs %d", g, client1.generation)
+	// Detachments that have probably been deleted from the server aren't
+	// forwarded.
+	client2.NowFunc = func() time.Time {
+		return time.Now().Add(core.DetachmentLifetime + time.Hour)
+	}
+	expired := client2.ForwardDraft(received)
+	if len(expired.Detachments) != 0 || !strings.Contains(expired.Body, "large expired") {
+		t.Fatalf("expired detachment was forwarded: %q", expired.Body)
 	}
 }
 
-func TestReadingOldStateFiles(t *testing.T) {
+// readHookPayloads waits for a hook command to have written n payloads to
+// path and returns them.
+func readHookPayloads(t *testing.T, path string, n int) []core.HookPayload {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		contents, _ := ioutil.ReadFile(path)
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		if len(contents) > 0 && len(lines) >= n {
+			var payloads []core.HookPayload
+			for _, line := range lines {
+				var payload core.HookPayload
+				if err := json.Unmarshal([]byte(line), &payload); err != nil {
+					t.Fatalf("failed to parse hook payload %q: %s", line, err)
+				}
+				payloads = append(payloads, payload)
+			}
+			return payloads
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d hook payloads in %s", n, path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHooks(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1664,22 +1957,2567 @@ func TestReadingOldStateFiles(t *testing.T) {
 	}
 	defer server.Close()
 
-	client1, err := NewTestClient(t, "client1", &TestClientOptions{
-		initialStateFile: "testdata/state-old",
-	})
+	client1, err := NewTestClient(t, "client1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer client1.Close()
 
-	client1.AdvanceTo(uiStateMain)
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	dir, err := ioutil.TempDir("", "pond-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeHook := func(name string) (script, output string) {
+		script = filepath.Join(dir, name+".sh")
+		output = filepath.Join(dir, name+".out")
+		if err := ioutil.WriteFile(script, []byte("#!/bin/sh\ncat >> "+output+"\n"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	script1, output1 := writeHook("client1")
+	script2, output2 := writeHook("client2")
+
+	if err := client1.SetHook("no-such-event", script1, false); err == nil {
+		t.Fatalf("hook for unknown event was accepted")
+	}
+	for _, event := range []string{core.HookDelivered, core.HookAcked} {
+		if err := client1.SetHook(event, script1, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client2.SetHook(core.HookReceived, script2, true); err != nil {
+		t.Fatal(err)
+	}
+
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	// Process the result of the transmission.
+	fetchMessage(client1)
+
+	delivered := readHookPayloads(t, output1, 1)[0]
+	if delivered.Event != core.HookDelivered || delivered.Contact != "client2" || delivered.Id != client1.Outbox[0].Id {
+		t.Fatalf("bad delivered payload: %#v", delivered)
+	}
+	if len(delivered.Body) > 0 {
+		t.Fatalf("delivered payload included the body without opting in")
+	}
+
+	fetchMessage(client2)
+	received := readHookPayloads(t, output2, 1)[0]
+	if received.Event != core.HookReceived || received.Contact != "client1" || received.ContactId != client2.Inbox[0].From {
+		t.Fatalf("bad received payload: %#v", received)
+	}
+	if received.Body != testMsg {
+		t.Fatalf("received payload has body %q, but wanted %q", received.Body, testMsg)
+	}
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+	transmitMessage(client2, false)
+	fetchMessage(client1)
+
+	acked := readHookPayloads(t, output1, 2)[1]
+	if acked.Event != core.HookAcked || acked.Contact != "client2" || len(acked.Acked) == 0 {
+		t.Fatalf("bad acked payload: %#v", acked)
+	}
+
+	// Hooks are kept in the state file.
 	client1.Reload()
 	client1.AdvanceTo(uiStateMain)
+	if h, ok := client1.Hooks[core.HookAcked]; !ok || h.Command != script1 || h.IncludeBody {
+		t.Fatalf("acked hook wasn't restored after reload: %#v", h)
+	}
+	if _, ok := client1.Hooks[core.HookReceived]; ok {
+		t.Fatalf("unexpected received hook after reload")
+	}
 }
 
-func testReplyACKs(t *testing.T, reloadDraft bool, abortSend bool) {
-	// Test that a message is acked by sending a reply. If reloadDraft is
-	// true then the message is reloaded as draft before sending.
+func TestLogOverflow(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+	proceedToMainUI(t, client1, server)
+
+	client1.gui.events <- Click{name: client1.clientUI.entries[1].boxName}
+	client1.AdvanceTo(uiStateLog)
+
+	for i := 0; i < 2*(core.LogLimit+core.LogSlack); i++ {
+		client1.Log.Printf("%d", i)
+	}
+}
+
+func TestServerAnnounce(t *testing.T) {
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	const testMessage = "Hello world"
+	announce := &pond.Message{
+		Id:           proto.Uint64(0),
+		Time:         proto.Int64(time.Now().Unix()),
+		Body:         []byte(testMessage),
+		MyNextDh:     []byte{},
+		BodyEncoding: pond.Message_RAW.Enum(),
+	}
+	announceBytes, err := proto.Marshal(announce)
+	if err != nil {
+		t.Fatalf("Failed to marshal announce message: %s", err)
+	}
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/accounts/%x/announce-00000000", server.stateDir, client.IdentityPublic[:]), announceBytes, 0666); err != nil {
+		t.Fatalf("Failed to write announce message: %s", err)
+	}
+
+	fetchMessage(client)
+
+	if len(client.Inbox) != 1 {
+		t.Fatalf("Inbox doesn't have a message")
+	}
+	client.gui.events <- Click{
+		name: client.inboxUI.entries[0].boxName,
+	}
+	client.AdvanceTo(uiStateInbox)
+	if s := client.gui.text["body"]; s != testMessage {
+		t.Fatalf("resolved message is incorrect: %s", s)
+	}
+
+	client.Reload()
+	client.AdvanceTo(uiStateMain)
+}
+
+func TestRevoke(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	client4, err := NewTestClient(t, "client4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client4.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
+	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
+
+	initialGeneration := client1.Generation
+
+	// Have client4 send a message before the revocation.
+	const beforeRevocationMsg = "from before revocation"
+	sendMessage(client4, "client1", beforeRevocationMsg)
+
+	var client1FromClient2 *core.Contact
+	for _, candidate := range client2.Contacts {
+		if candidate.Name == "client1" {
+			client1FromClient2 = candidate
+			break
+		}
+	}
+	if client1FromClient2.Generation != initialGeneration {
+		t.Errorf("Initial generations don't match")
+	}
+
+	var client1FromClient3 *core.Contact
+	for _, candidate := range client3.Contacts {
+		if candidate.Name == "client1" {
+			client1FromClient3 = candidate
+			break
+		}
+	}
+
+	client1.gui.events <- Click{name: client1.contactsUI.entries[0].boxName}
+	client1.AdvanceTo(uiStateShowContact)
+	client1.gui.events <- Click{name: "delete"}
+	client1.gui.WaitForSignal() // button changes to "Confirm"
+	client1.gui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateRevocationComplete)
+
+	if client1.Generation != initialGeneration+1 {
+		t.Errorf("Generation did not advance")
+	}
+
+	if len(client1.outboxUI.entries) != 1 {
+		t.Errorf("No revocation entry found after click")
+	}
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+
+	if len(client1.outboxUI.entries) != 1 {
+		t.Errorf("No revocation entry found after reload")
+	}
+
+	transmitMessage(client1, true)
+
+	composeMessage(client2, "client1", "test1")
+	// Select the contact before sending because we have previously crashed
+	// in this case. See https://github.com/agl/pond/issues/96.
+	client2.gui.events <- Click{name: client2.contactsUI.entries[0].boxName}
+	client2.AdvanceTo(uiStateShowContact)
+	transmitMessage(client2, false)
+	client2.AdvanceTo(uiStateRevocationProcessed)
+
+	if gen := client1FromClient2.Generation; gen != client1.Generation {
+		t.Errorf("Generation number didn't update: found %d, want %d", gen, client1.Generation)
+	}
+	if !client1FromClient2.RevokedUs {
+		t.Errorf("Client1 isn't marked as revoked")
+	}
+
+	sendMessage(client3, "client1", "test2")
+	client3.AdvanceTo(uiStateRevocationProcessed)
+
+	if gen := client1FromClient3.Generation; gen != client1.Generation {
+		t.Errorf("Generation number didn't update for non-revoked: found %d, want %d", gen, client1.Generation)
+	}
+	if client1FromClient3.RevokedUs {
+		t.Errorf("Client3 believes that it was revoked")
+	}
+
+	// Have client3 resend.
+	transmitMessage(client3, false)
+
+	// Have client1 fetch the resigned message from client3, and the
+	// message from client4 using previousTags.
+	var seenClient3, seenClient4 bool
+	for i := 0; i < 2; i++ {
+		from, msg := fetchMessage(client1)
+		switch from {
+		case "client3":
+			if seenClient3 {
+				t.Fatalf("client3 message observed twice")
+			}
+			if string(msg.Message.Body) != "test2" {
+				t.Fatalf("Incorrect message contents from client3: %#v", msg)
+			}
+			seenClient3 = true
+		case "client4":
+			if seenClient4 {
+				t.Fatalf("client4 message observed twice")
+			}
+			if string(msg.Message.Body) != beforeRevocationMsg {
+				t.Fatalf("Incorrect message contents client4: %#v", msg)
+			}
+			seenClient4 = true
+		}
+	}
+}
+
+func TestMultiRevoke(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
+	client4, err := NewTestClient(t, "client4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client4.Close()
+
+	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
+	proceedToPairedWithNames(t, client1, client4, "client1", "client4", server)
+
+	revokeContact := func(client *TestClient, name string) {
+		found := false
+		for _, ent := range client.contactsUI.entries {
+			if client.Contacts[ent.id].Name == name {
+				client.gui.events <- Click{name: ent.boxName}
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("Couldn't find contact %s", name)
+		}
+		client.AdvanceTo(uiStateShowContact)
+		client.gui.events <- Click{name: "delete"}
+		client.gui.WaitForSignal() // button changes to "Confirm"
+		client.gui.events <- Click{name: "delete"}
+		client.AdvanceTo(uiStateRevocationComplete)
+
+		transmitMessage(client, true)
+	}
+
+	// Revoke client3 and 4 from client1.
+	revokeContact(client1, "client3")
+	revokeContact(client1, "client4")
+
+	// Send a message from client2 to client1. It should hit two
+	// revocations, which should be returned in a single error from the
+	// server.
+	sendMessage(client2, "client1", "test")
+	client2.AdvanceTo(uiStateRevocationProcessed)
+	client2.AdvanceTo(uiStateRevocationProcessed)
+
+	if g := client2.Contacts[client2.contactsUI.entries[0].id].Generation; g != client1.Generation {
+		t.Errorf("Generations don't match: %d vs %d", g, client1.Generation)
+	}
+}
+
+func startPANDAKeyExchange(t *testing.T, client *TestClient, server *TestServer, otherName, sharedSecret string) {
+	proceedToMainUI(t, client, server)
+
+	client.gui.events <- Click{name: "newcontact"}
+	client.AdvanceTo(uiStateNewContact)
+
+	client.gui.events <- Click{
+		name:    "name",
+		entries: map[string]string{"name": otherName},
+	}
+	client.gui.events <- Click{name: "shared"}
+	client.AdvanceTo(uiStateNewContact2)
+
+	client.gui.events <- Click{
+		name:    "begin",
+		entries: map[string]string{"shared": sharedSecret},
+	}
+}
+
+func TestPANDA(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	mp := panda.NewSimpleMeetingPlace()
+	newMeetingPlace := func() panda.MeetingPlace {
+		return mp
+	}
+	client1.NewMeetingPlace = newMeetingPlace
+	client2.NewMeetingPlace = newMeetingPlace
+
+	startPANDAKeyExchange(t, client1, server, "client2", "shared secret")
+
+	client1.ReloadWithMeetingPlace(mp)
+
+	startPANDAKeyExchange(t, client2, server, "client1", "shared secret")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		client1.AdvanceTo(uiStatePANDAComplete)
+		wg.Done()
+	}()
+	go func() {
+		client2.AdvanceTo(uiStatePANDAComplete)
+		wg.Done()
+	}()
+	wg.Wait()
+
+	var client2FromClient1 *core.Contact
+	for _, contact := range client1.Contacts {
+		client2FromClient1 = contact
+		break
+	}
+
+	var client1FromClient2 *core.Contact
+	for _, contact := range client2.Contacts {
+		client1FromClient2 = contact
+		break
+	}
+
+	if g := client2FromClient1.Generation; g != client2.Generation {
+		t.Errorf("Generation mismatch %d vs %d", g, client1.Generation)
+	}
+
+	if g := client1FromClient2.Generation; g != client1.Generation {
+		t.Errorf("Generation mismatch %d vs %d", g, client1.Generation)
+	}
+}
+
+func TestReadingOldStateFiles(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", &TestClientOptions{
+		initialStateFile: "testdata/state-old",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client1.AdvanceTo(uiStateMain)
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+}
+
+func testReplyACKs(t *testing.T, reloadDraft bool, abortSend bool) {
+	// Test that a message is acked by sending a reply. If reloadDraft is
+	// true then the message is reloaded as draft before sending.
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	from, _ := fetchMessage(client2)
+	if from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+	if !client1.Outbox[0].Acked.IsZero() {
+		t.Fatalf("client1 incorrectly believes that its message has been acked")
+	}
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "reply",
+	}
+	client2.AdvanceTo(uiStateCompose)
+
+	if reloadDraft {
+		client2.gui.events <- Click{
+			name: client2.draftsUI.entries[0].boxName,
+		}
+		client2.AdvanceTo(uiStateCompose)
+	}
+
+	client2.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client1"},
+		textViews: map[string]string{"body": "reply message"},
+	}
+	client2.AdvanceTo(uiStateOutbox)
+
+	if abortSend {
+		client2.gui.events <- Click{name: "abort"}
+		client2.AdvanceTo(uiStateCompose)
+
+		client2.gui.events <- Click{
+			name:      "send",
+			combos:    map[string]string{"to": "client1"},
+			textViews: map[string]string{"body": "reply message"},
+		}
+		client2.AdvanceTo(uiStateOutbox)
+	}
+
+	ackChan := make(chan bool)
+	client2.FetchNowChan <- ackChan
+
+WaitForAck:
+	for {
+		select {
+		case ack := <-client2.gui.signal:
+			ack <- true
+		case <-ackChan:
+			break WaitForAck
+		}
+	}
+
+	from, _ = fetchMessage(client1)
+	if from != "client2" {
+		t.Fatalf("ack received from wrong contact: %s", from)
+	}
+
+	if client1.Outbox[0].Acked.IsZero() {
+		t.Fatalf("client1 doesn't believe that its message has been acked")
+	}
+	if !client2.Inbox[0].Acked {
+		t.Fatalf("client2 doesn't believe that it has acked the message")
+	}
+}
+
+func TestReplyACKs(t *testing.T) {
+	testReplyACKs(t, false, false)
+}
+
+func TestReplyACKsWithDraft(t *testing.T) {
+	testReplyACKs(t, true, false)
+}
+
+func TestReplyACKsWithDraftAndAbort(t *testing.T) {
+	testReplyACKs(t, true, true)
+}
+
+func TestCliId(t *testing.T) {
+	id := core.CliId(0x7ab8)
+	s := id.String()
+	t.Log(s)
+	if result, ok := core.CliIdFromString(s); !ok || result != id {
+		t.Fatalf("CliId parse failed: got %d, want %d", result, id)
+	}
+}
+
+func TestSendToPendingContact(t *testing.T) {
+	// Test that it's not possible to send a message to a pending contact.
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	client.gui.events <- Click{name: "newcontact"}
+	client.AdvanceTo(uiStateNewContact)
+
+	client.gui.events <- Click{
+		name:    "name",
+		entries: map[string]string{"name": "pendingContact"},
+	}
+	client.gui.events <- Click{name: "manual"}
+	client.AdvanceTo(uiStateNewContact2)
+
+	client.gui.events <- Click{name: "compose"}
+	client.AdvanceTo(uiStateCompose)
+
+	if contacts, ok := client.gui.combos["to"]; !ok || len(contacts) > 0 {
+		t.Error("can send message to pending contact")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	// Test that deleting contacts works.
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	from, _ := fetchMessage(client2)
+	if from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+
+	// Start an incomplete, manual exchange.
+	proceedToKeyExchange(t, client1, server, "client3")
+
+	// Start a PANDA exchange.
+	mp := panda.NewSimpleMeetingPlace()
+	newMeetingPlace := func() panda.MeetingPlace {
+		return mp
+	}
+	client1.NewMeetingPlace = newMeetingPlace
+	startPANDAKeyExchange(t, client1, server, "client4", "secret")
+	client1.AdvanceTo(uiStateShowContact)
+
+	clickOnContact(client1, "client2")
+	client1.gui.events <- Click{name: "delete"}
+	client1.gui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateRevocationComplete)
+
+	if len(client1.Inbox) > 0 {
+		t.Errorf("still entries in inbox")
+	}
+
+	for _, msg := range client1.Outbox {
+		if !msg.Revocation {
+			t.Errorf("still entries in outbox")
+			break
+		}
+	}
+
+	clickOnContact(client1, "client3")
+	client1.gui.events <- Click{name: "abort"}
+	client1.AdvanceTo(uiStateRevocationComplete)
+
+	clickOnContact(client1, "client4")
+	client1.gui.events <- Click{name: "delete"}
+	client1.gui.events <- Click{name: "delete"}
+	client1.AdvanceTo(uiStateRevocationComplete)
+
+	if len(client1.Contacts) > 0 {
+		t.Errorf("still contacts")
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+}
+
+func TestExpireMessage(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	from, _ := fetchMessage(client2)
+	if from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("Bad initial number of inbox messages: %d", n)
+	}
+
+	baseTime := time.Now()
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("Bad number of messages after first timer: %d", n)
+	}
+
+	if n := len(client2.inboxUI.entries); n != 1 {
+		t.Fatalf("Bad number of messages in listUI after first timer: %d", n)
+	}
+
+	if client2.inboxUI.entries[0].background != colorGray {
+		t.Fatalf("Bad message background after first timer")
+	}
+
+	// Advance the clock so that the message should be indicated as near
+	// deletion.
+
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessagePreIndicationLifetime + 10*time.Second)
+	}
+
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.inboxUI.entries); n != 1 {
+		t.Fatalf("Bad number of messages in listUI: %d", n)
+	}
+
+	if client2.inboxUI.entries[0].background != colorDeleteSoon {
+		t.Fatalf("Bad message background after second timer")
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+
+	if n := len(client2.inboxUI.entries); n != 1 {
+		t.Fatalf("Bad number of messages in listUI after reload: %d", n)
+	}
+
+	if client2.inboxUI.entries[0].background != colorDeleteSoon {
+		t.Fatalf("Bad message background after second reload")
+	}
+
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + 10*time.Second)
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+
+	if n := len(client2.inboxUI.entries); n != 1 {
+		t.Fatalf("Bad number of messages in listUI after second reload: %d", n)
+	}
+
+	if client2.inboxUI.entries[0].background != colorImminently {
+		t.Fatalf("Bad message background after second reload")
+	}
+
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.inboxUI.entries); n != 1 {
+		t.Fatalf("Bad number of messages in listUI after grace period timer: %d", n)
+	}
+
+	if client2.inboxUI.entries[0].background != colorImminently {
+		t.Fatalf("Bad message background after grace period timer")
+	}
+
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + 10*time.Second + core.MessageGraceTime)
+	}
+
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.inboxUI.entries); n != 1 {
+		t.Fatalf("Bad number of messages in listUI after expiry: %d", n)
+	}
+
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("Bad number of messages in inbox after expiry: %d", n)
+	}
+}
+
+func TestRetainMessage(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	from, _ := fetchMessage(client2)
+	if from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("Bad initial number of inbox messages: %d", n)
+	}
+
+	if n := len(client2.inboxUI.entries); n != 1 {
+		t.Fatalf("Bad initial number of messages in listUI: %d", n)
+	}
+
+	msg := client2.Inbox[0]
+	if msg.Retained {
+		t.Fatalf("Retained flag is initially set")
+	}
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name:   "retain",
+		checks: map[string]bool{"retain": true},
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	if !msg.Retained {
+		t.Fatalf("Retained flag not set")
+	}
+
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+
+	msg = client2.Inbox[0]
+	if !msg.Retained {
+		t.Fatalf("Retained flag lost")
+	}
+
+	baseTime := time.Now()
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + 10*time.Second)
+	}
+
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("Message was deleted while retain flag set")
+	}
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name:   "retain",
+		checks: map[string]bool{"retain": false},
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	if msg.Retained {
+		t.Fatalf("Retain flag not cleared")
+	}
+
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("Message was deleted while in grace period")
+	}
+
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + core.MessageGraceTime + 20*time.Second)
+	}
+
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("Message deleted while selected")
+	}
+
+	client2.gui.events <- Click{
+		name: "compose",
+	}
+	client2.AdvanceTo(uiStateCompose)
+
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client2.Inbox); n != 0 {
+		t.Fatalf("Message not deleted")
+	}
+}
+
+func TestOutboxDeletion(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+
+	client1.gui.events <- Click{
+		name: "compose",
+	}
+	client1.AdvanceTo(uiStateCompose)
+
+	if n := len(client1.Outbox); n != 1 {
+		t.Fatalf("Bad initial number of outbox messages: %d", n)
+	}
+
+	baseTime := time.Now()
+	client1.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + 10*time.Second)
+	}
+
+	client1.testTimerChan <- baseTime
+	client1.AdvanceTo(uiStateTimerComplete)
+
+	if n := len(client1.Outbox); n != 0 {
+		t.Fatalf("Outbox message not deleted")
+	}
+}
+
+func TestStateFileLocking(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	stateFile, err := os.Open(filepath.Join(client1.stateDir, "state"))
+	if err != nil {
+		t.Fatalf("Failed to open state file")
+	}
+	defer stateFile.Close()
+	if syscall.Flock(int(stateFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
+		t.Fatalf("Was able to lock state file")
+	}
+}
+
+func TestMergedACKs(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	// Send two messages to client2.
+	sendMessage(client1, "client2", "foo1")
+	fetchMessage(client2)
+	sendMessage(client1, "client2", "foo2")
+	fetchMessage(client2)
+
+	// Ack the two messages in client2. The second ack should merge with
+	// the first.
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[1].boxName,
+	}
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+
+	// Send only one message from client2.
+	transmitMessage(client2, false)
+
+	// Both messages should be ACKed in client1 on receipt.
+	fetchMessage(client1)
+
+	for _, msg := range client1.Outbox {
+		if msg.Acked.IsZero() {
+			t.Errorf("Unacked message in client1's outbox.")
+		}
+	}
+}
+
+func TestEntombing(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	// Send a message so that we can be sure that the state file was
+	// correctly recovered.
+	sendMessage(client1, "client2", "foo1")
+	fetchMessage(client2)
+
+	// Emtomb client1.
+	client1.gui.events <- Click{
+		name: client1.clientUI.entries[0].boxName,
+	}
+	client1.AdvanceTo(uiStateShowIdentity)
+
+	client1.gui.events <- OpenResult{ok: true, path: filepath.Join(client1.stateDir, "statefile.tomb")}
+	client1.gui.events <- Click{name: "entomb"}
+	client1.AdvanceTo(uiStateEntomb)
+	client1.AdvanceTo(uiStateEntombComplete)
+
+	keyHex := client1.gui.info
+	client1.Reload()
+	client1.AdvanceTo(uiStateLoading)
+	client1.AdvanceTo(uiStateCreatePassphrase)
+	client1.gui.events <- Click{
+		name:    "next",
+		entries: map[string]string{"pw": ""},
+	}
+
+	if client1.hasErasure() {
+		client1.AdvanceTo(uiStateErasureStorage)
+		client1.gui.events <- Click{
+			name: "continue",
+		}
+	}
+
+	client1.AdvanceTo(uiStateCreateAccount)
+	client1.gui.events <- OpenResult{ok: true, path: filepath.Join(client1.stateDir, "statefile.tomb")}
+	client1.gui.events <- Click{
+		name:    "import",
+		entries: map[string]string{"tombkey": keyHex},
+	}
+	client1.AdvanceTo(uiStateMain)
+
+	if len(client1.Outbox) != 1 {
+		t.Fatalf("No messages in outbox")
+	}
+}
+
+func TestContactNameChange(t *testing.T) {
+	// Exercise the code to change a contact's name.
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	// Setup a normal pair of clients.
+	proceedToPaired(t, client1, client2, server)
+
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	from, _ := fetchMessage(client2)
+	if from != "client1" {
+		t.Fatalf("message from %s, expected client1", from)
+	}
+
+	clickOnContact(client1, "client2")
+	const newName = "client2x"
+	client1.gui.events <- Update{name: "contactname", text: newName}
+	client1.gui.events <- Click{
+		name:    "changebutton",
+		entries: map[string]string{"contactname": newName},
+	}
+	client1.AdvanceTo(uiStateContactNameChanged)
+
+	if contact, _ := client1.ContactByName(newName); contact == nil {
+		t.Errorf("name not updated in client")
+	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+
+	if contact, _ := client1.ContactByName(newName); contact == nil {
+		t.Errorf("name not updated in client after reload")
+	}
+}
+
+// connectProxy is a minimal HTTP proxy that supports only the CONNECT method.
+type connectProxy struct {
+	listener net.Listener
+	// requests receives the Proxy-Authorization header of each request.
+	requests chan string
+}
+
+func newConnectProxy() (*connectProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &connectProxy{
+		listener: listener,
+		requests: make(chan string, 16),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *connectProxy) run() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *connectProxy) handle(conn net.Conn) {
+	defer conn.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != "CONNECT" {
+		return
+	}
+	p.requests <- req.Header.Get("Proxy-Authorization")
+
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer target.Close()
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func (p *connectProxy) Close() {
+	p.listener.Close()
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	proxy, err := newConnectProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	p, err := core.ParseProxy("http://user:pass@" + proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetServerProxy(server.URL(), p)
+	fetchMessage(client)
+
+	select {
+	case auth := <-proxy.requests:
+		if expected := "Basic dXNlcjpwYXNz"; auth != expected {
+			t.Errorf("proxy received credentials %q, expected %q", auth, expected)
+		}
+	default:
+		t.Fatal("transaction didn't use the configured proxy")
+	}
+
+	client.SetServerProxy(server.URL(), nil)
+	fetchMessage(client)
+
+	select {
+	case <-proxy.requests:
+		t.Error("transaction used the proxy after the override was removed")
+	default:
+	}
+}
+
+func TestWebSocketCarrier(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The frontend terminates TLS and WebSocket framing and relays the
+	// transport to the server's TCP port, as a reverse proxy would.
+	upgrades := make(chan bool, 16)
+	frontend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pond" {
+			http.NotFound(w, r)
+			return
+		}
+		ws, err := transport.UpgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		upgrades <- true
+
+		backend, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.port))
+		if err != nil {
+			return
+		}
+		defer backend.Close()
+		go io.Copy(backend, ws)
+		io.Copy(ws, backend)
+	}))
+	defer frontend.Close()
+
+	client, err := NewTestClient(t, "client", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	proceedToMainUI(t, client, server)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(frontend.Certificate())
+	client.CarrierTLSConfig = &tls.Config{RootCAs: roots, ServerName: "example.com"}
+
+	carrier, err := core.ParseCarrier("wss://" + frontend.Listener.Addr().String() + "/pond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetServerCarrier(server.URL(), carrier)
+	fetchMessage(client)
+
+	select {
+	case <-upgrades:
+	default:
+		t.Fatal("transaction didn't use the WebSocket carrier")
+	}
+	for _, failure := range []string{"Failed to connect to ", "Failed to send to ", "Failed to read from "} {
+		if n, _ := logContains(client, failure+server.URL()); n > 0 {
+			t.Fatalf("transaction via the carrier failed: %q was logged", failure)
+		}
+	}
+
+	client.SetServerCarrier(server.URL(), nil)
+	fetchMessage(client)
+
+	select {
+	case <-upgrades:
+		t.Error("transaction used the carrier after it was removed")
+	default:
+	}
+
+	// The carrier is a local setting and so doesn't allow a server URL
+	// to avoid being a hidden service. Nor may the carrier itself be on
+	// the clearnet if it's reached via Tor.
+	if _, _, err := core.ParseServer("pondserver://"+server.identity+"@example.com?websocket=/pond", false); err == nil {
+		t.Error("server URL with a websocket parameter avoided the .onion requirement")
+	}
+	onionServer := "pondserver://" + server.identity + "@examplesite.onion"
+	client.SetServerProxy(onionServer, &core.ProxyConfig{Kind: disk.Proxy_TOR})
+	client.SetServerCarrier(onionServer, carrier)
+	if _, _, err := client.ParseServer(onionServer); err == nil {
+		t.Error("clearnet carrier was accepted for a server reached via Tor")
+	}
+	onionCarrier, err := core.ParseCarrier("ws://examplefront.onion/pond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetServerCarrier(onionServer, onionCarrier)
+	if _, host, err := client.ParseServer(onionServer); err != nil || host != "examplefront.onion:80" {
+		t.Errorf("onion carrier resulted in host %q, error %v", host, err)
+	}
+
+	for _, bad := range []string{"http://example.com/pond", "wss:///pond", "ws://user@example.com/"} {
+		if _, err := core.ParseCarrier(bad); err == nil {
+			t.Errorf("parseCarrier accepted %q", bad)
+		}
+	}
+}
+
+func TestNetworkConfigSerialization(t *testing.T) {
+	var network core.NetworkConfig
+	network.DefaultProxy = &core.ProxyConfig{Kind: disk.Proxy_SOCKS5, Address: "127.0.0.1:1080", Isolate: true}
+	network.ServerProxies = map[string]*core.ProxyConfig{
+		"pondserver://ABCD@example.com": &core.ProxyConfig{Kind: disk.Proxy_DIRECT, DirectAcknowledged: true},
+		"https://example.com/exchange":  &core.ProxyConfig{Kind: disk.Proxy_HTTP_CONNECT, Address: "proxy:8080", Username: "user", Password: "pass"},
+	}
+	carrier, err := core.ParseCarrier("wss://example.com:8443/pond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.ServerCarriers = map[string]*url.URL{
+		"pondserver://ABCD@example.com": carrier,
+	}
+	network.CoverTraffic = true
+	network.UndeliverableAfter = 3 * 24 * time.Hour
+	network.Schedule = core.NetworkSchedule{
+		Interval:          time.Hour,
+		BurstTransactions: 5,
+		BurstInterval:     20 * time.Second,
+		QuietHours:        true,
+		QuietStart:        22 * 60,
+		QuietEnd:          7 * 60,
+		Paused:            true,
+	}
+	network.Offline = true
+
+	serialized, err := proto.Marshal(network.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := new(disk.NetworkConfig)
+	if err := proto.Unmarshal(serialized, m); err != nil {
+		t.Fatal(err)
+	}
+
+	var network2 core.NetworkConfig
+	network2.Unmarshal(m)
+	if !reflect.DeepEqual(network, network2) {
+		t.Errorf("network configuration changed after serialization: got %#v, want %#v", network2, network)
+	}
+
+	// Schedules that the CLI wouldn't accept are replaced by the defaults
+	// when they're read from the state file.
+	bad := &disk.NetworkConfig{
+		TransactionInterval: proto.Int64(0),
+		BurstTransactions:   proto.Int32(core.MaxBurstTransactions + 1),
+		BurstInterval:       proto.Int64(-1),
+		QuietStart:          proto.Int32(22 * 60),
+		QuietEnd:            proto.Int32(25 * 60),
+	}
+	var schedule core.NetworkSchedule
+	schedule.Unmarshal(bad)
+	if !reflect.DeepEqual(schedule, core.NetworkSchedule{}) {
+		t.Errorf("invalid schedule was read as %#v", schedule)
+	}
+	bad.TransactionInterval = proto.Int64(1)
+	bad.BurstInterval = proto.Int64(int64(core.MinTransactionInterval / time.Second))
+	schedule.Unmarshal(bad)
+	if schedule.Interval != 0 || schedule.BurstTransactions != core.MaxBurstTransactions {
+		t.Errorf("out of range schedule was read as %#v", schedule)
+	}
+
+	for _, bad := range []string{"ftp://example.com:21", "socks5://example.com", "tor://user@127.0.0.1:9050"} {
+		if _, err := core.ParseProxy(bad); err == nil {
+			t.Errorf("parseProxy accepted %q", bad)
+		}
+	}
+	if p, _ := core.ParseProxy("direct"); core.DescribeProxyError(p) == "" {
+		t.Error("direct proxy was accepted without acknowledgement")
+	}
+}
+
+// logContains returns the number of log entries containing substr and the
+// number of those that are errors.
+func logContains(client *TestClient, substr string) (n, errors int) {
+	client.Log.Lock()
+	defer client.Log.Unlock()
+
+	for _, entry := range client.Log.Entries {
+		if strings.Contains(entry.S, substr) {
+			n++
+			if entry.IsError {
+				errors++
+			}
+		}
+	}
+	return
+}
+
+func TestDeliveriesResumed(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	numTickets := func() int {
+		client1.TicketsLock.Lock()
+		defer client1.TicketsLock.Unlock()
+		return len(client1.Tickets[client1.Server])
+	}
+
+	// Tickets are blinded, so ones that were issued to fetches can be
+	// used by anonymous deliveries, but only once the server has
+	// presented the key that they were issued with on an anonymous
+	// connection.
+	fetchMessage(client1)
+	if n := numTickets(); n < 2 {
+		t.Fatalf("fetch left %d tickets", n)
+	}
+	conn, err := client1.DialServer(client1.Server, core.PurposeDelivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn.Resumed() {
+		t.Errorf("delivery connection was resumed before the ticket key was pinned")
+	}
+	sendMessage(client1, "client2", "test message")
+	for i := 0; i < 2; i++ {
+		conn, err := client1.DialServer(client1.Server, core.PurposeDelivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !conn.Resumed() {
+			t.Errorf("delivery connection #%d wasn't resumed", i)
+		}
+		if !conn.WantsTickets() {
+			t.Errorf("delivery connection doesn't ask for tickets")
+		}
+		conn.Close()
+	}
+
+	// Full deliveries have no room to ask for tickets, but each fetch
+	// receives more tickets than it uses, until the pool is full.
+	for i := 0; numTickets() < core.MaxTickets; i++ {
+		if i == core.MaxTickets {
+			t.Fatalf("client has %d tickets after %d fetches, but wanted %d", numTickets(), i, core.MaxTickets)
+		}
+		fetchMessage(client1)
+	}
+
+	conn, err = client1.DialServer(client1.Server, core.PurposeFetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !conn.Resumed() {
+		t.Errorf("fetch connection wasn't resumed")
+	}
+	if conn.WantsTickets() {
+		t.Errorf("connection asked for a ticket when the client had enough")
+	}
+}
+
+func TestCoverTraffic(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	client1.SetCoverTraffic(true)
+	inboxLen := len(client1.Inbox)
+
+	// transactions has client1 make n transactions and returns whether
+	// each was a delivery or a fetch.
+	transactions := func(n int) []string {
+		client1.Log.Clear()
+		for i := 0; i < n; i++ {
+			transmitMessage(client1, false)
+		}
+
+		client1.Log.Lock()
+		defer client1.Log.Unlock()
+		var kinds []string
+		for _, entry := range client1.Log.Entries {
+			switch {
+			case strings.HasPrefix(entry.S, "Starting cover transmission"), strings.HasPrefix(entry.S, "Starting message transmission"):
+				kinds = append(kinds, "delivery")
+			case strings.HasPrefix(entry.S, "Starting fetch from"):
+				kinds = append(kinds, "fetch")
+			}
+		}
+		return kinds
+	}
+
+	// With an empty queue, transactions alternate between a cover delivery
+	// and a fetch, which should retrieve any cover message.
+	const numTransactions = 6
+	withoutMail := transactions(numTransactions)
+	if n, _ := logContains(client1, "Starting cover transmission"); n != numTransactions/2 {
+		t.Fatalf("%d cover messages were sent, expected %d", n, numTransactions/2)
+	}
+	if _, errors := logContains(client1, ""); errors > 0 {
+		t.Fatalf("errors were logged while sending cover traffic")
+	}
+	if len(client1.Inbox) != inboxLen {
+		t.Fatalf("cover message was added to the inbox")
+	}
+	if len(client1.Outbox) != 0 {
+		t.Fatalf("cover message was added to the outbox")
+	}
+	// Cover messages are only delivered to the home server and are all
+	// signed with the same member key.
+	if n, _ := logContains(client1, "Sending cover delivery to "+client1.Server); n != numTransactions/2 {
+		t.Fatalf("%d cover messages were sent to the home server, expected %d", n, numTransactions/2)
+	}
+	coverMember := client1.CoverMember
+	if coverMember == nil {
+		t.Fatalf("no member key was kept for cover messages")
+	}
+
+	// Queued messages take the place of cover deliveries without changing
+	// the sequence of transactions.
+	const testMsg = "test message"
+	composeMessage(client1, "client2", testMsg)
+	composeMessage(client1, "client2", testMsg)
+	withMail := transactions(numTransactions)
+	if fmt.Sprint(withMail) != fmt.Sprint(withoutMail) {
+		t.Fatalf("transactions with queued messages were %v, but without were %v", withMail, withoutMail)
+	}
+	for i, kind := range withMail {
+		if (i > 0 && kind == withMail[i-1]) || len(withMail) != numTransactions {
+			t.Fatalf("transactions don't alternate: %v", withMail)
+		}
+	}
+	if n, _ := logContains(client1, "Starting cover transmission"); n != 1 {
+		t.Fatalf("%d cover messages were sent with two messages queued, expected 1", n)
+	}
+	for i := 0; i < 2; i++ {
+		from, msg := fetchMessage(client2)
+		if from != "client1" || string(msg.Message.Body) != testMsg {
+			t.Fatalf("message wasn't received with cover traffic enabled")
+		}
+	}
+
+	if client1.CoverMember != coverMember {
+		t.Fatalf("a new member key was created for cover messages")
+	}
+}
+
+func TestServerBackoff(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	// Point client2 at a port that nothing is listening on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	deadServer := fmt.Sprintf("pondserver://%s@127.0.0.1:%d", server.identity, deadPort)
+	contact, _ := client1.ContactByName("client2")
+	contact.TheirServer = deadServer
+
+	composeMessage(client1, "client2", "test message")
+	msg := client1.Outbox[len(client1.Outbox)-1]
+	transmitMessage(client1, true)
+	// Process the result of the transmission.
+	transmitMessage(client1, true)
+
+	failures := client1.UnreachableServers()
+	if len(failures) != 1 || failures[0].Server != deadServer || failures[0].Category != core.FailureDial || failures[0].Count != 1 {
+		t.Fatalf("bad failures after one delivery attempt: %#v", failures)
+	}
+	if msg.Undeliverable {
+		t.Fatalf("message was flagged as undeliverable too soon")
+	}
+
+	// The server is skipped until its backoff has passed.
+	transmitMessage(client1, true)
+	if failures := client1.UnreachableServers(); failures[0].Count != 1 {
+		t.Fatalf("server was retried during its backoff: %d failures", failures[0].Count)
+	}
+
+	// Pretend that the server has been failing for a day.
+	client1.SetUndeliverableAfter(time.Hour)
+	client1.QueueMutex.Lock()
+	client1.ServerFailures[deadServer].First = time.Now().Add(-24 * time.Hour)
+	client1.ServerFailures[deadServer].Retry = time.Time{}
+	msg.Created = msg.Created.Add(-24 * time.Hour)
+	client1.QueueMutex.Unlock()
+	transmitMessage(client1, true)
+	transmitMessage(client1, true)
+
+	failures = client1.UnreachableServers()
+	if failures[0].Count != 2 {
+		t.Fatalf("server wasn't retried after its backoff: %d failures", failures[0].Count)
+	}
+	if !msg.Undeliverable {
+		t.Fatalf("message wasn't flagged as undeliverable")
+	}
+
+	client1.gui.events <- Click{name: client1.clientUI.entries[4].boxName}
+	client1.AdvanceTo(uiStateServers)
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	msg = client1.Outbox[len(client1.Outbox)-1]
+	if !msg.Undeliverable {
+		t.Fatalf("undeliverable flag was lost after reload")
+	}
+	if client1.UndeliverableAfter() != time.Hour {
+		t.Fatalf("undeliverable period was lost after reload")
+	}
+	reloaded := client1.UnreachableServers()
+	if len(reloaded) != 1 || reloaded[0].Server != deadServer || reloaded[0].Count != 2 || !reloaded[0].First.Equal(failures[0].First.Truncate(time.Second)) || !reloaded[0].Retry.Equal(failures[0].Retry.Truncate(time.Second)) {
+		t.Fatalf("server failures were lost after reload: %#v", reloaded)
+	}
+
+	// Once the server works again, the message is delivered and the
+	// failures are forgotten. The failures, which survived the reload,
+	// are moved along with the message.
+	client1.QueueMutex.Lock()
+	msg.Server = server.URL()
+	client1.ServerFailures[msg.Server] = client1.ServerFailures[deadServer]
+	client1.ServerFailures[msg.Server].Retry = time.Time{}
+	delete(client1.ServerFailures, deadServer)
+	client1.QueueMutex.Unlock()
+	transmitMessage(client1, true)
+	transmitMessage(client1, true)
+	if msg.Sent.IsZero() {
+		t.Fatalf("message wasn't delivered once its server had recovered")
+	}
+	if failures := client1.UnreachableServers(); len(failures) != 0 {
+		t.Fatalf("failures remain after successful delivery: %#v", failures)
+	}
+}
+
+func TestOfflineSync(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	if _, err := client1.StartSync(); err == nil {
+		t.Fatalf("sync was started while online")
+	}
+	client1.SetOffline(true)
+
+	// Messages are queued, but not sent, while offline.
+	const testMsg = "test message"
+	sendMessage(client1, "client2", testMsg)
+	if n, _ := logContains(client1, "Ignoring fetchNow signal while offline"); n == 0 {
+		t.Fatalf("transaction wasn't refused while offline")
+	}
+	if msg := client1.Outbox[len(client1.Outbox)-1]; !msg.Sent.IsZero() {
+		t.Fatalf("message was sent while offline")
+	}
+
+	n, err := client1.StartSync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("sync with one queued message will make %d transactions, but wanted 4", n)
+	}
+
+	// Process the results of the sync until it's complete.
+	timeout := time.After(30 * time.Second)
+WaitForSync:
+	for {
+		select {
+		case ack := <-client1.gui.signal:
+			ack <- true
+		case <-time.After(50 * time.Millisecond):
+			if n, _ := logContains(client1, "Sync complete"); n > 0 {
+				break WaitForSync
+			}
+		case <-timeout:
+			t.Fatalf("sync didn't complete")
+		}
+	}
+	if n, _ := logContains(client1, "Starting sync transaction"); n != 4 {
+		t.Errorf("sync made %d transactions, but wanted 4", n)
+	}
+	if offline, remaining := client1.SyncStatus(); !offline || remaining != 0 {
+		t.Errorf("after sync, offline is %v with %d transactions remaining", offline, remaining)
+	}
+	if msg := client1.Outbox[len(client1.Outbox)-1]; msg.Sent.IsZero() {
+		t.Fatalf("message wasn't sent by sync")
+	}
+
+	from, msg := fetchMessage(client2)
+	if from != "client1" || string(msg.Message.Body) != testMsg {
+		t.Fatalf("message sent by sync wasn't received")
+	}
+
+	// A draft whose attachment must be uploaded waits for the next sync,
+	// which uploads the attachment and then delivers the draft.
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	// Each file can be attached directly, but not both of them.
+	for _, name := range []string{"large1", "large2"} {
+		contents := make([]byte, pond.MaxSerializedMessage*2/3)
+		io.ReadFull(rand.Reader, contents)
+		path := filepath.Join(client1.stateDir, name)
+		if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		client1.gui.events <- Click{name: "attach"}
+		client1.gui.WaitForFileOpen()
+		client1.gui.events <- OpenResult{path: path, ok: true}
+		client1.gui.WaitForSignal()
+	}
+	client1.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client2"},
+		textViews: map[string]string{"body": "large"},
+	}
+	client1.AdvanceTo(uiStateTransfers)
+
+	if l := len(client1.Transfers); l != 1 {
+		t.Fatalf("Expected one upload but found %d transfers", l)
+	}
+	if client1.Transfers[0].KillChan != nil {
+		t.Fatalf("upload was started while offline")
+	}
+	draftID := client1.Transfers[0].Draft
+	if draft, ok := client1.Drafts[draftID]; !ok || !draft.SendWhenUploaded {
+		t.Fatalf("draft isn't waiting for its upload")
+	}
+	outboxLen := len(client1.Outbox)
+
+	if _, err := client1.StartSync(); err != nil {
+		t.Fatal(err)
+	}
+	timeout = time.After(30 * time.Second)
+WaitForUploadSync:
+	for {
+		select {
+		case ack := <-client1.gui.signal:
+			// The main goroutine is blocked until the signal is
+			// acknowledged.
+			sent := len(client1.Outbox) > outboxLen && !client1.Outbox[outboxLen].Sent.IsZero()
+			ack <- true
+			if sent {
+				break WaitForUploadSync
+			}
+		case <-timeout:
+			t.Fatalf("draft wasn't uploaded and sent by sync")
+		}
+	}
+	if _, ok := client1.Drafts[draftID]; ok {
+		t.Fatalf("draft wasn't removed after it was sent")
+	}
+	if offline, _ := client1.SyncStatus(); !offline {
+		t.Fatalf("client isn't offline after the sync")
+	}
+
+	_, msg = fetchMessage(client2)
+	if string(msg.Message.Body) != "large" || len(msg.Message.Files) != 1 || len(msg.Message.DetachedFiles) != 1 {
+		t.Fatalf("draft sent by sync wasn't received with its detachment")
+	}
+}
+
+func TestCLIIdentities(t *testing.T) {
+	stateFiles := []string{"/home/user/.pond", "/tmp/work", "/mnt/work", "/"}
+	ids := NewCLIIdentities(stateFiles, rand.Reader, true /* testing */, false /* autoFetch */)
+
+	wantNames := []string{"pond", "work", "work-2", "identity"}
+	for i, c := range ids.clients {
+		if c.identityName != wantNames[i] {
+			t.Errorf("identity %d is named %q, but wanted %q", i, c.identityName, wantNames[i])
+		}
+		if c.StateFilename != stateFiles[i] {
+			t.Errorf("identity %d has state file %q, but wanted %q", i, c.StateFilename, stateFiles[i])
+		}
+		if c.identities != ids {
+			t.Errorf("identity %d doesn't refer to the set of identities", i)
+		}
+	}
+
+	if c := ids.find("work-2"); c != ids.clients[2] {
+		t.Errorf("identity wasn't found by name")
+	}
+	if c := ids.find("4"); c != ids.clients[3] {
+		t.Errorf("identity wasn't found by number")
+	}
+	for _, bad := range []string{"0", "5", "home"} {
+		if c := ids.find(bad); c != nil {
+			t.Errorf("find(%q) returned %q", bad, c.identityName)
+		}
+	}
+
+	ids.selectIdentity(ids.clients[1])
+	if ids.isSelected(ids.clients[0]) || !ids.isSelected(ids.clients[1]) {
+		t.Errorf("wrong identity is selected")
+	}
+
+	// Each identity isolates its connections independently so that
+	// identities never share Tor circuits.
+	auth1 := ids.clients[0].IsolationAuth("pondserver://example.com", core.PurposeFetch)
+	auth2 := ids.clients[1].IsolationAuth("pondserver://example.com", core.PurposeFetch)
+	if *auth1 == *auth2 {
+		t.Errorf("two identities share SOCKS credentials")
+	}
+}
+
+// socksConn records a connection made through a fakeSOCKSProxy.
+type socksConn struct {
+	user, password string
+	target         string
+}
+
+// fakeSOCKSProxy is a minimal SOCKS5 proxy that records the credentials of
+// each connection.
+type fakeSOCKSProxy struct {
+	listener net.Listener
+	conns    chan socksConn
+}
+
+func newFakeSOCKSProxy() (*fakeSOCKSProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &fakeSOCKSProxy{
+		listener: listener,
+		conns:    make(chan socksConn, 16),
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *fakeSOCKSProxy) run() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+func readSOCKSString(r io.Reader) (string, error) {
+	var l [1]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", err
+	}
+	s := make([]byte, l[0])
+	_, err := io.ReadFull(r, s)
+	return string(s), err
+}
+
+func (p *fakeSOCKSProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Method negotiation. Only username/password authentication is
+	// accepted.
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil || bytes.IndexByte(methods, 2) == -1 {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	var record socksConn
+	var version [1]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil || version[0] != 1 {
+		return
+	}
+	var err error
+	if record.user, err = readSOCKSString(r); err != nil {
+		return
+	}
+	if record.password, err = readSOCKSString(r); err != nil {
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	var request [4]byte
+	if _, err := io.ReadFull(r, request[:]); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		var ip [4]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return
+		}
+		host = net.IP(ip[:]).String()
+	case 3:
+		if host, err = readSOCKSString(r); err != nil {
+			return
+		}
+	default:
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return
+	}
+	record.target = net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+
+	target, err := net.Dial("tcp", record.target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	p.conns <- record
+
+	go io.Copy(target, r)
+	io.Copy(conn, target)
+}
+
+func (p *fakeSOCKSProxy) Close() {
+	p.listener.Close()
+}
+
+func (p *fakeSOCKSProxy) next(t *testing.T) socksConn {
+	select {
+	case record := <-p.conns:
+		return record
+	default:
+		t.Fatal("no connection was made through the SOCKS proxy")
+	}
+	panic("unreachable")
+}
+
+func TestStreamIsolation(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	socks, err := newFakeSOCKSProxy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socks.Close()
+
+	client1, err := NewTestClient(t, "client1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Close()
+
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Close()
+
+	proceedToPaired(t, client1, client2, server)
+
+	p, err := core.ParseProxy("socks5://" + socks.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Isolate = true
+	client1.SetDefaultProxy(p)
+
+	fetchMessage(client1)
+	fetch1 := socks.next(t)
+	fetchMessage(client1)
+	fetch2 := socks.next(t)
+	if fetch1.user != fetch2.user || fetch1.password != fetch2.password {
+		t.Errorf("fetches used different credentials: %q and %q", fetch1.user, fetch2.user)
+	}
+
+	// Sending a message may trigger a fetch as well as the delivery.
+	// Each delivery should have its own credentials so that deliveries
+	// don't share a circuit.
+	var deliveryUsers []string
+	for i := 0; i < 2; i++ {
+		sendMessage(client1, "client2", "test message")
+		transmitMessage(client1, false)
+		deliveries := 0
+		for len(socks.conns) > 0 {
+			conn := socks.next(t)
+			if conn.target != fetch1.target {
+				t.Fatalf("connection was to %s but fetches were to %s", conn.target, fetch1.target)
+			}
+			if conn.user != fetch1.user {
+				deliveries++
+				deliveryUsers = append(deliveryUsers, conn.user)
+			}
+		}
+		if deliveries != 1 {
+			t.Errorf("found %d connections with credentials different from the fetches, expected one delivery", deliveries)
+		}
+	}
+	if len(deliveryUsers) == 2 && deliveryUsers[0] == deliveryUsers[1] {
+		t.Errorf("deliveries used the same credentials")
+	}
+
+	// Age the credentials so that they are rotated.
+	client1.NetworkLock.Lock()
+	for _, token := range client1.IsolationTokens {
+		token.Created = token.Created.Add(-core.IsolationRotation)
+	}
+	client1.NetworkLock.Unlock()
+
+	fetchMessage(client1)
+	if fetch3 := socks.next(t); fetch3.user == fetch1.user {
+		t.Errorf("fetch credentials weren't rotated")
+	}
+}
+
+// TestDaemonConn is a JSON-RPC connection to a daemonClient's control socket.
+type TestDaemonConn struct {
+	t       *testing.T
+	conn    net.Conn
+	decoder *json.Decoder
+	nextId  int
+	// events contains notifications that have been received but not yet
+	// consumed by WaitForEvent.
+	events []map[string]interface{}
+}
+
+type testRPCMessage struct {
+	Id     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+func DialTestDaemon(t *testing.T, path string) *TestDaemonConn {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", path); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to connect to daemon: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	return &TestDaemonConn{
+		t:       t,
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+	}
+}
+
+func (dc *TestDaemonConn) read() *testRPCMessage {
+	msg := new(testRPCMessage)
+	if err := dc.decoder.Decode(msg); err != nil {
+		dc.t.Fatalf("failed to read from daemon: %s", err)
+	}
+	if msg.Method == "v1.event" {
+		var event map[string]interface{}
+		if err := json.Unmarshal(msg.Params, &event); err != nil {
+			dc.t.Fatalf("failed to parse event: %s", err)
+		}
+		dc.events = append(dc.events, event)
+	}
+	return msg
+}
+
+// Call performs a request and unmarshals the result into result, if not nil.
+func (dc *TestDaemonConn) Call(method string, params, result interface{}) *rpcError {
+	dc.nextId++
+	id := dc.nextId
+	req := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	}
+	if err := json.NewEncoder(dc.conn).Encode(req); err != nil {
+		dc.t.Fatalf("failed to write to daemon: %s", err)
+	}
+
+	for {
+		msg := dc.read()
+		if msg.Id == nil || *msg.Id != id {
+			continue
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Result, result); err != nil {
+				dc.t.Fatalf("failed to parse result of %s: %s", method, err)
+			}
+		}
+		return nil
+	}
+}
+
+func (dc *TestDaemonConn) MustCall(method string, params, result interface{}) {
+	if err := dc.Call(method, params, result); err != nil {
+		dc.t.Fatalf("%s failed: %s", method, err.Message)
+	}
+}
+
+// WaitForEvent returns the next event of the given type, discarding any
+// other events before it.
+func (dc *TestDaemonConn) WaitForEvent(eventType string) map[string]interface{} {
+	for {
+		for len(dc.events) > 0 {
+			event := dc.events[0]
+			dc.events = dc.events[1:]
+			if event["type"] == eventType {
+				return event
+			}
+		}
+		dc.read()
+	}
+}
+
+type TestDaemonClient struct {
+	*daemonClient
+	stateDir      string
+	done          chan struct{}
+	testTimerChan chan time.Time
+}
+
+func NewTestDaemon(t *testing.T, server *TestServer, mp panda.MeetingPlace) *TestDaemonClient {
+	stateDir, err := ioutil.TempDir("", "pond-daemon-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &TestDaemonClient{
+		daemonClient:  NewDaemonClient(filepath.Join(stateDir, "state"), filepath.Join(stateDir, "control"), rand.Reader, true /* testing */, false /* autoFetch */),
+		stateDir:      stateDir,
+		done:          make(chan struct{}),
+		testTimerChan: make(chan time.Time, 1),
+	}
+	d.TimerChan = d.testTimerChan
+	d.accountServer = server.URL()
+	d.Log.ToStderr = clientLogToStderr
+	d.NewMeetingPlace = func() panda.MeetingPlace {
+		return mp
+	}
+	go func() {
+		d.Start()
+		close(d.done)
+	}()
+	return d
+}
+
+func (d *TestDaemonClient) Close() {
+	d.signals <- os.Interrupt
+	<-d.done
+	os.RemoveAll(d.stateDir)
+}
+
+func TestDaemon(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	mp := panda.NewSimpleMeetingPlace()
+	daemon1 := NewTestDaemon(t, server, mp)
+	defer daemon1.Close()
+	daemon2 := NewTestDaemon(t, server, mp)
+	defer daemon2.Close()
+
+	conn1 := DialTestDaemon(t, daemon1.socketPath)
+	conn2 := DialTestDaemon(t, daemon2.socketPath)
+
+	fi, err := os.Stat(daemon1.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("control socket has permissions %o", perm)
+	}
+
+	var version struct {
+		Versions []int `json:"versions"`
+	}
+	conn1.MustCall("version", nil, &version)
+	if len(version.Versions) == 0 || version.Versions[0] != 1 {
+		t.Errorf("unexpected versions: %v", version.Versions)
+	}
+	if err := conn1.Call("v2.listContacts", nil, nil); err == nil || err.Code != rpcMethodNotFound {
+		t.Errorf("unknown method didn't result in the expected error: %#v", err)
+	}
+
+	conn1.MustCall("v1.subscribe", nil, nil)
+	conn2.MustCall("v1.subscribe", nil, nil)
+
+	const sharedSecret = "shared secret"
+	conn1.MustCall("v1.newContact", map[string]string{"name": "daemon2", "sharedSecret": sharedSecret}, nil)
+	conn2.MustCall("v1.newContact", map[string]string{"name": "daemon1", "sharedSecret": sharedSecret}, nil)
+	conn1.WaitForEvent("keyExchangeComplete")
+	conn2.WaitForEvent("keyExchangeComplete")
+
+	var contacts []contactInfo
+	conn1.MustCall("v1.listContacts", nil, &contacts)
+	if len(contacts) != 1 || contacts[0].Name != "daemon2" || contacts[0].Pending {
+		t.Fatalf("unexpected contacts: %#v", contacts)
+	}
+
+	const body = "hello from daemon1"
+	var draft draftInfo
+	conn1.MustCall("v1.compose", map[string]string{"to": strconv.FormatUint(contacts[0].Id, 10), "body": body}, &draft)
+	var sent outboxInfo
+	conn1.MustCall("v1.send", map[string]string{"draft": strconv.FormatUint(draft.Id, 10)}, &sent)
+	if sent.Body != body {
+		t.Errorf("outbox message has body %q, expected %q", sent.Body, body)
+	}
+
+	var drafts []draftInfo
+	conn1.MustCall("v1.listDrafts", nil, &drafts)
+	if len(drafts) != 0 {
+		t.Errorf("draft wasn't removed after sending")
+	}
+
+	conn1.MustCall("v1.transactNow", nil, nil)
+	conn1.WaitForEvent("messageDelivered")
+
+	conn2.MustCall("v1.transactNow", nil, nil)
+	event := conn2.WaitForEvent("fetch")
+	if msg := event["message"].(map[string]interface{}); msg["body"] != body || msg["fromName"] != "daemon1" {
+		t.Errorf("unexpected message in fetch event: %#v", msg)
+	}
+
+	var inbox []inboxInfo
+	conn2.MustCall("v1.listInbox", nil, &inbox)
+	if len(inbox) != 1 || inbox[0].Body != body {
+		t.Fatalf("unexpected inbox: %#v", inbox)
+	}
+	conn2.MustCall("v1.acknowledge", map[string]string{"id": strconv.FormatUint(inbox[0].Id, 10)}, nil)
+	if err := conn2.Call("v1.acknowledge", map[string]string{"id": strconv.FormatUint(inbox[0].Id, 10)}, nil); err == nil {
+		t.Errorf("acknowledging a message twice didn't fail")
+	}
+
+	// Acks don't generate events on the sending side so daemon1 polls
+	// until the ack has been delivered.
+	conn2.MustCall("v1.transactNow", nil, nil)
+	for i := 0; ; i++ {
+		if i == 50 {
+			t.Fatalf("acknowledgement wasn't received")
+		}
+		time.Sleep(100 * time.Millisecond)
+		conn1.MustCall("v1.transactNow", nil, nil)
+		var outbox []outboxInfo
+		conn1.MustCall("v1.listOutbox", nil, &outbox)
+		if len(outbox) == 1 && outbox[0].Acked != 0 {
+			break
+		}
+	}
+	conn1.WaitForEvent("acknowledgement")
+
+	// Hooks can be set over the control socket and the daemon's timer
+	// runs the erase-soon hook, and then erases the message.
+	dir, err := ioutil.TempDir("", "pond-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "hook.sh")
+	output := filepath.Join(dir, "hook.out")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\ncat >> "+output+"\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn2.Call("v1.setHook", map[string]string{"event": "no-such-event", "command": script}, nil); err == nil {
+		t.Errorf("hook for unknown event was accepted")
+	}
+	conn2.MustCall("v1.setHook", map[string]string{"event": core.HookEraseSoon, "command": script}, nil)
+	var hooks []hookInfo
+	conn2.MustCall("v1.listHooks", nil, &hooks)
+	if len(hooks) != 1 || hooks[0].Event != core.HookEraseSoon || hooks[0].Command != script {
+		t.Fatalf("unexpected hooks: %#v", hooks)
+	}
+
+	baseTime := time.Now()
+	daemon2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessagePreIndicationLifetime + 10*time.Second)
+	}
+	daemon2.testTimerChan <- baseTime
+	eraseSoon := readHookPayloads(t, output, 1)[0]
+	if eraseSoon.Event != core.HookEraseSoon || eraseSoon.Id != inbox[0].Id {
+		t.Fatalf("bad erase-soon payload: %#v", eraseSoon)
+	}
+
+	daemon2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + core.MessageGraceTime + 10*time.Second)
+	}
+	daemon2.testTimerChan <- baseTime
+	if id := conn2.WaitForEvent("inboxRemoved")["id"]; id != strconv.FormatUint(inbox[0].Id, 10) {
+		t.Errorf("unexpected message erased: %v", id)
+	}
+}
+
+func runTestBatch(t *testing.T, stateFile, stdin string, args ...string) (string, error) {
+	c, err := NewBatchClient(stateFile, rand.Reader, true /* testing */, args)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	c.Log.ToStderr = clientLogToStderr
+	c.in = strings.NewReader(stdin)
+	c.out = &out
+	err = c.Start()
+	return out.String(), err
+}
+
+func TestBatch(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1694,7 +4532,6 @@ func testReplyACKs(t *testing.T, reloadDraft bool, abortSend bool) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client1.Close()
 
 	client2, err := NewTestClient(t, "client2", nil)
 	if err != nil {
@@ -1703,100 +4540,76 @@ func testReplyACKs(t *testing.T, reloadDraft bool, abortSend bool) {
 	defer client2.Close()
 
 	proceedToPaired(t, client1, client2, server)
+	stateFile := filepath.Join(client1.stateDir, "state")
 
-	const testMsg = "test message"
-	sendMessage(client1, "client2", testMsg)
-	from, _ := fetchMessage(client2)
-	if from != "client1" {
-		t.Fatalf("message from %s, expected client1", from)
+	if _, err := runTestBatch(t, stateFile, "", "inbox"); err == nil {
+		t.Fatalf("batch action succeeded while the state file was locked")
 	}
-	if !client1.outbox[0].acked.IsZero() {
-		t.Fatalf("client1 incorrectly believes that its message has been acked")
+	if _, err := runTestBatch(t, stateFile, "", "send"); err == nil {
+		t.Fatalf("send without a contact was accepted")
 	}
-	client2.gui.events <- Click{
-		name: client2.inboxUI.entries[0].boxName,
+
+	client1.Shutdown()
+	defer os.RemoveAll(client1.stateDir)
+
+	if _, err := runTestBatch(t, stateFile, "hello", "send", "client3"); err == nil {
+		t.Fatalf("send to unknown contact succeeded")
 	}
-	client2.AdvanceTo(uiStateInbox)
-	client2.gui.events <- Click{
-		name: "reply",
+	const message = "hello from a script"
+	out, err := runTestBatch(t, stateFile, message, "send", "client2")
+	if err != nil {
+		t.Fatalf("send failed: %s", err)
 	}
-	client2.AdvanceTo(uiStateCompose)
-
-	if reloadDraft {
-		client2.gui.events <- Click{
-			name: client2.draftsUI.entries[0].boxName,
-		}
-		client2.AdvanceTo(uiStateCompose)
+	if _, err := strconv.ParseUint(strings.TrimSpace(out), 10, 64); err != nil {
+		t.Errorf("send didn't output a message id: %q", out)
 	}
-
-	client2.gui.events <- Click{
-		name:      "send",
-		combos:    map[string]string{"to": "client1"},
-		textViews: map[string]string{"body": "reply message"},
+	if _, err := runTestBatch(t, stateFile, "", "transact"); err != nil {
+		t.Fatalf("transact failed: %s", err)
 	}
-	client2.AdvanceTo(uiStateOutbox)
-
-	if abortSend {
-		client2.gui.events <- Click{name: "abort"}
-		client2.AdvanceTo(uiStateCompose)
 
-		client2.gui.events <- Click{
-			name:      "send",
-			combos:    map[string]string{"to": "client1"},
-			textViews: map[string]string{"body": "reply message"},
-		}
-		client2.AdvanceTo(uiStateOutbox)
+	from, msg := fetchMessage(client2)
+	if from != "client1" || msg == nil || string(msg.Message.Body) != message {
+		t.Fatalf("message from batch client wasn't received")
 	}
 
-	ackChan := make(chan bool)
-	client2.fetchNowChan <- ackChan
-
-WaitForAck:
-	for {
-		select {
-		case ack := <-client2.gui.signal:
-			ack <- true
-		case <-ackChan:
-			break WaitForAck
-		}
+	const reply = "hello from a GUI"
+	sendMessage(client2, "client1", reply)
+	if _, err := runTestBatch(t, stateFile, "", "transact"); err != nil {
+		t.Fatalf("transact failed: %s", err)
 	}
 
-	from, _ = fetchMessage(client1)
-	if from != "client2" {
-		t.Fatalf("ack received from wrong contact: %s", from)
+	var inbox []inboxInfo
+	out, err = runTestBatch(t, stateFile, "", "inbox")
+	if err != nil {
+		t.Fatalf("inbox failed: %s", err)
 	}
-
-	if client1.outbox[0].acked.IsZero() {
-		t.Fatalf("client1 doesn't believe that its message has been acked")
+	if err := json.Unmarshal([]byte(out), &inbox); err != nil {
+		t.Fatalf("failed to parse inbox: %s", err)
 	}
-	if !client2.inbox[0].acked {
-		t.Fatalf("client2 doesn't believe that it has acked the message")
+	if len(inbox) != 1 || inbox[0].Body != reply || inbox[0].FromName != "client2" || inbox[0].Read {
+		t.Fatalf("unexpected inbox: %#v", inbox)
 	}
-}
-
-func TestReplyACKs(t *testing.T) {
-	testReplyACKs(t, false, false)
-}
-
-func TestReplyACKsWithDraft(t *testing.T) {
-	testReplyACKs(t, true, false)
-}
 
-func TestReplyACKsWithDraftAndAbort(t *testing.T) {
-	testReplyACKs(t, true, true)
-}
+	id := strconv.FormatUint(inbox[0].Id, 10)
+	if out, err = runTestBatch(t, stateFile, "", "show", id); err != nil {
+		t.Fatalf("show failed: %s", err)
+	}
+	if !strings.HasPrefix(out, "From: client2\n") || !strings.HasSuffix(out, "\n\n"+reply+"\n") {
+		t.Errorf("unexpected output from show: %q", out)
+	}
 
-func TestCliId(t *testing.T) {
-	id := cliId(0x7ab8)
-	s := id.String()
-	t.Log(s)
-	if result, ok := cliIdFromString(s); !ok || result != id {
-		t.Fatalf("CliId parse failed: got %d, want %d", result, id)
+	if out, err = runTestBatch(t, stateFile, "", "inbox"); err != nil {
+		t.Fatalf("inbox failed: %s", err)
+	}
+	if err := json.Unmarshal([]byte(out), &inbox); err != nil {
+		t.Fatalf("failed to parse inbox: %s", err)
+	}
+	if !inbox[0].Read {
+		t.Errorf("message wasn't marked as read after being shown")
 	}
 }
 
-func TestSendToPendingContact(t *testing.T) {
-	// Test that it's not possible to send a message to a pending contact.
+func TestBatchLocalOnly(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1807,34 +4620,63 @@ func TestSendToPendingContact(t *testing.T) {
 	}
 	defer server.Close()
 
-	client, err := NewTestClient(t, "client", nil)
+	client1, err := NewTestClient(t, "client1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer client.Close()
-
-	proceedToMainUI(t, client, server)
-
-	client.gui.events <- Click{name: "newcontact"}
-	client.AdvanceTo(uiStateNewContact)
 
-	client.gui.events <- Click{
-		name:    "name",
-		entries: map[string]string{"name": "pendingContact"},
+	client2, err := NewTestClient(t, "client2", nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	client.gui.events <- Click{name: "manual"}
-	client.AdvanceTo(uiStateNewContact2)
+	defer client2.Close()
 
-	client.gui.events <- Click{name: "compose"}
-	client.AdvanceTo(uiStateCompose)
+	proceedToPaired(t, client1, client2, server)
 
-	if contacts, ok := client.gui.combos["to"]; !ok || len(contacts) > 0 {
-		t.Error("can send message to pending contact")
+	// Leave a key exchange and a transfer pending in the state file.
+	contact, _ := client1.ContactByName("client2")
+	contact.PandaKeyExchange = []byte{1}
+	client1.Transfers = append(client1.Transfers, &core.Transfer{
+		Id:      1,
+		TmpPath: filepath.Join(client1.stateDir, "download.tmp"),
+		Path:    filepath.Join(client1.stateDir, "download"),
+		Detachment: &pond.Message_Detachment{
+			Filename: proto.String("download"),
+			Size:     proto.Uint64(1),
+			Url:      proto.String(server.URL()),
+		},
+	})
+	client1.Save()
+	client1.Shutdown()
+	defer os.RemoveAll(client1.stateDir)
+
+	// Actions that don't transact must not touch the network, so nothing
+	// that was pending is resumed.
+	for _, args := range [][]string{{"inbox"}, {"show", "1"}, {"send", "client2"}} {
+		c, err := NewBatchClient(filepath.Join(client1.stateDir, "state"), rand.Reader, true /* testing */, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Log.ToStderr = clientLogToStderr
+		c.in = strings.NewReader("hello")
+		c.out = new(bytes.Buffer)
+		c.Start()
+
+		if len(c.Transfers) != 1 {
+			t.Fatalf("%s: pending transfer wasn't loaded", args[0])
+		}
+		if c.Transfers[0].KillChan != nil {
+			t.Errorf("%s: transfer was resumed", args[0])
+		}
+		for _, contact := range c.Contacts {
+			if contact.PandaShutdownChan != nil {
+				t.Errorf("%s: key exchange with %s was resumed", args[0], contact.Name)
+			}
+		}
 	}
 }
 
-func TestDelete(t *testing.T) {
-	// Test that deleting contacts works.
+func TestContactGroups(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1857,62 +4699,89 @@ func TestDelete(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
+	client3, err := NewTestClient(t, "client3", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client3.Close()
+
 	proceedToPaired(t, client1, client2, server)
+	proceedToPairedWithNames(t, client1, client3, "client1", "client3", server)
 
-	const testMsg = "test message"
-	sendMessage(client1, "client2", testMsg)
-	from, _ := fetchMessage(client2)
-	if from != "client1" {
-		t.Fatalf("message from %s, expected client1", from)
+	for _, name := range []string{"client2", "client3"} {
+		_, contact := contactByName(client1, name)
+		if err := client1.AddToGroup("friends", contact); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, contact := contactByName(client1, "client2"); client1.AddToGroup("friends", contact) == nil {
+		t.Errorf("adding a contact to a group twice succeeded")
 	}
 
-	// Start an incomplete, manual exchange.
-	proceedToKeyExchange(t, client1, server, "client3")
+	const message = "hello friends"
+	composeMessage(client1, core.GroupLabelPrefix+"friends", message)
 
-	// Start a PANDA exchange.
-	mp := panda.NewSimpleMeetingPlace()
-	newMeetingPlace := func() panda.MeetingPlace {
-		return mp
+	if len(client1.Outbox) != 2 {
+		t.Fatalf("expected two outbox messages but found %d", len(client1.Outbox))
+	}
+	first, second := client1.Outbox[0], client1.Outbox[1]
+	if first.FanoutId == 0 || first.FanoutId != second.FanoutId {
+		t.Errorf("copies don't share a fanout id: %x and %x", first.FanoutId, second.FanoutId)
+	}
+	if first.To == second.To || first.Id == second.Id {
+		t.Errorf("copies have the same recipient or id")
+	}
+	if copies := client1.FanoutCopies(first); len(copies) != 2 {
+		t.Errorf("fanoutCopies returned %d messages", len(copies))
 	}
-	client1.newMeetingPlace = newMeetingPlace
-	startPANDAKeyExchange(t, client1, server, "client4", "secret")
-	client1.AdvanceTo(uiStateShowContact)
 
-	clickOnContact(client1, "client2")
-	client1.gui.events <- Click{name: "delete"}
-	client1.gui.events <- Click{name: "delete"}
-	client1.AdvanceTo(uiStateRevocationComplete)
+	transmitMessage(client1, false)
+	transmitMessage(client1, false)
 
-	if len(client1.inbox) > 0 {
-		t.Errorf("still entries in inbox")
+	for _, client := range []*TestClient{client2, client3} {
+		from, msg := fetchMessage(client)
+		if from != "client1" || msg == nil || string(msg.Message.Body) != message {
+			t.Errorf("%s didn't receive the message", client.name)
+		}
 	}
-
-	for _, msg := range client1.outbox {
-		if !msg.revocation {
-			t.Errorf("still entries in outbox")
-			break
+	for _, msg := range client1.Outbox {
+		if msg.Sent.IsZero() {
+			t.Errorf("copy to %s wasn't sent", client1.ContactName(msg.To))
 		}
 	}
 
-	clickOnContact(client1, "client3")
-	client1.gui.events <- Click{name: "abort"}
-	client1.AdvanceTo(uiStateRevocationComplete)
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
 
-	clickOnContact(client1, "client4")
-	client1.gui.events <- Click{name: "delete"}
-	client1.gui.events <- Click{name: "delete"}
-	client1.AdvanceTo(uiStateRevocationComplete)
+	if members := client1.GroupRecipients("friends"); len(members) != 2 {
+		t.Errorf("group has %d members after reload", len(members))
+	}
+	if len(client1.Outbox) != 2 || client1.Outbox[0].FanoutId != first.FanoutId || client1.Outbox[1].FanoutId != first.FanoutId {
+		t.Errorf("fanout ids weren't preserved by reload")
+	}
 
-	if len(client1.contacts) > 0 {
-		t.Errorf("still contacts")
+	draft := &core.Draft{Id: client1.RandId()}
+	id2, _ := contactByName(client1, "client2")
+	id3, _ := contactByName(client1, "client3")
+	draft.SetRecipients([]uint64{id2, id3, id2})
+	if r := draft.Recipients(); len(r) != 2 || r[0] != id2 || r[1] != id3 {
+		t.Errorf("unexpected recipients: %v", r)
+	}
+	draft.RemoveRecipient(id2)
+	if r := draft.Recipients(); len(r) != 1 || draft.To != id3 {
+		t.Errorf("unexpected recipients after removal: %v", r)
 	}
 
-	client1.Reload()
-	client1.AdvanceTo(uiStateMain)
+	// A copy to a contact that has been deleted can still be described.
+	deleted := *first
+	deleted.To = client1.RandId()
+	deleted.Sent = time.Time{}
+	if status := client1.DeliveryStatus(&deleted); status != "queued" {
+		t.Errorf("unexpected status for a copy to a deleted contact: %s", status)
+	}
 }
 
-func TestExpireMessage(t *testing.T) {
+func TestThreads(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -1935,108 +4804,75 @@ func TestExpireMessage(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	const testMsg = "test message"
-	sendMessage(client1, "client2", testMsg)
-	from, _ := fetchMessage(client2)
-	if from != "client1" {
-		t.Fatalf("message from %s, expected client1", from)
-	}
-
-	if n := len(client2.inbox); n != 1 {
-		t.Fatalf("Bad initial number of inbox messages: %d", n)
-	}
-
-	baseTime := time.Now()
-	client2.testTimerChan <- baseTime
-	client2.AdvanceTo(uiStateTimerComplete)
-
-	if n := len(client2.inbox); n != 1 {
-		t.Fatalf("Bad number of messages after first timer: %d", n)
-	}
-
-	if n := len(client2.inboxUI.entries); n != 1 {
-		t.Fatalf("Bad number of messages in listUI after first timer: %d", n)
-	}
-
-	if client2.inboxUI.entries[0].background != colorGray {
-		t.Fatalf("Bad message background after first timer")
-	}
-
-	// Advance the clock so that the message should be indicated as near
-	// deletion.
-
-	client2.nowFunc = func() time.Time {
-		return baseTime.Add(messagePreIndicationLifetime + 10*time.Second)
-	}
-
-	client2.testTimerChan <- baseTime
-	client2.AdvanceTo(uiStateTimerComplete)
-
-	if n := len(client2.inboxUI.entries); n != 1 {
-		t.Fatalf("Bad number of messages in listUI: %d", n)
-	}
-
-	if client2.inboxUI.entries[0].background != colorDeleteSoon {
-		t.Fatalf("Bad message background after second timer")
-	}
-
-	client2.Reload()
-	client2.AdvanceTo(uiStateMain)
-
-	if n := len(client2.inboxUI.entries); n != 1 {
-		t.Fatalf("Bad number of messages in listUI after reload: %d", n)
-	}
-
-	if client2.inboxUI.entries[0].background != colorDeleteSoon {
-		t.Fatalf("Bad message background after second reload")
-	}
-
-	client2.nowFunc = func() time.Time {
-		return baseTime.Add(messageLifetime + 10*time.Second)
-	}
-
-	client2.Reload()
-	client2.AdvanceTo(uiStateMain)
-
-	if n := len(client2.inboxUI.entries); n != 1 {
-		t.Fatalf("Bad number of messages in listUI after second reload: %d", n)
-	}
+	sendMessage(client1, "client2", "first message")
+	fetchMessage(client2)
 
-	if client2.inboxUI.entries[0].background != colorImminently {
-		t.Fatalf("Bad message background after second reload")
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
 	}
-
-	client2.testTimerChan <- baseTime
-	client2.AdvanceTo(uiStateTimerComplete)
-
-	if n := len(client2.inboxUI.entries); n != 1 {
-		t.Fatalf("Bad number of messages in listUI after grace period timer: %d", n)
+	client2.AdvanceTo(uiStateInbox)
+	client2.gui.events <- Click{
+		name: "reply",
 	}
-
-	if client2.inboxUI.entries[0].background != colorImminently {
-		t.Fatalf("Bad message background after grace period timer")
+	client2.AdvanceTo(uiStateCompose)
+	client2.gui.events <- Click{
+		name:      "send",
+		combos:    map[string]string{"to": "client1"},
+		textViews: map[string]string{"body": "reply message"},
 	}
+	client2.AdvanceTo(uiStateOutbox)
+	transmitMessage(client2, false)
 
-	client2.nowFunc = func() time.Time {
-		return baseTime.Add(messageLifetime + 10*time.Second + messageGraceTime)
+	if from, _ := fetchMessage(client1); from != "client2" {
+		t.Fatalf("reply from %s, expected client2", from)
 	}
+	sendMessage(client1, "client2", "unrelated message")
 
-	client2.testTimerChan <- baseTime
-	client2.AdvanceTo(uiStateTimerComplete)
+	id2, _ := contactByName(client1, "client2")
+	checkThreads := func() {
+		threads := client1.Threads(id2)
+		if len(threads) != 2 {
+			t.Fatalf("found %d threads, expected 2", len(threads))
+		}
+		first := threads[0]
+		if len(first) != 2 {
+			t.Fatalf("first thread has %d messages, expected 2", len(first))
+		}
+		if first[0].Outbox == nil || string(first[0].Message().Body) != "first message" || first[0].Depth != 0 {
+			t.Errorf("first thread starts with the wrong message")
+		}
+		if first[1].Inbox == nil || string(first[1].Message().Body) != "reply message" || first[1].Depth != 1 || first[1].Parent != first[0] {
+			t.Errorf("reply isn't linked to the first message")
+		}
+		if second := threads[1]; len(second) != 1 || string(second[0].Message().Body) != "unrelated message" {
+			t.Errorf("unrelated message isn't in its own thread")
+		}
+	}
+	checkThreads()
 
-	if n := len(client2.inboxUI.entries); n != 1 {
-		t.Fatalf("Bad number of messages in listUI after expiry: %d", n)
+	client1.gui.events <- Click{
+		name: client1.inboxUI.entries[0].boxName,
 	}
+	client1.AdvanceTo(uiStateInbox)
+	client1.gui.events <- Click{name: "thread"}
+	client1.AdvanceTo(uiStateThread)
 
-	if n := len(client2.inbox); n != 1 {
-		t.Fatalf("Bad number of messages in inbox after expiry: %d", n)
+	transcript := client1.gui.text["thread"]
+	if i, j := strings.Index(transcript, "first message"), strings.Index(transcript, "reply message"); i < 0 || j < i {
+		t.Errorf("bad conversation transcript: %q", transcript)
+	}
+	if strings.Contains(transcript, "unrelated message") {
+		t.Errorf("conversation transcript includes a message from another thread")
 	}
+
+	client1.Reload()
+	client1.AdvanceTo(uiStateMain)
+	checkThreads()
 }
 
-func TestRetainMessage(t *testing.T) {
+func TestSenderExpiry(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2059,109 +4895,97 @@ func TestRetainMessage(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	const testMsg = "test message"
-	sendMessage(client1, "client2", testMsg)
-	from, _ := fetchMessage(client2)
-	if from != "client1" {
-		t.Fatalf("message from %s, expected client1", from)
-	}
-
-	if n := len(client2.inbox); n != 1 {
-		t.Fatalf("Bad initial number of inbox messages: %d", n)
+	composeWithExpiry := func(body, expiry string) {
+		client1.gui.events <- Click{name: "compose"}
+		client1.AdvanceTo(uiStateCompose)
+		client1.gui.events <- Click{
+			name:      "send",
+			combos:    map[string]string{"to": "client2", "expiry": expiry},
+			textViews: map[string]string{"body": body},
+		}
+		client1.AdvanceTo(uiStateOutbox)
+		transmitMessage(client1, false)
 	}
 
-	if n := len(client2.inboxUI.entries); n != 1 {
-		t.Fatalf("Bad initial number of messages in listUI: %d", n)
+	composeWithExpiry("retained message", "1 hour")
+	if expiry := client1.Outbox[0].Message.GetExpiry(); expiry != 3600 {
+		t.Fatalf("outbox message has expiry %d, expected 3600", expiry)
 	}
-
-	msg := client2.inbox[0]
-	if msg.retained {
-		t.Fatalf("Retained flag is initially set")
+	_, msg := fetchMessage(client2)
+	if msg == nil || client2.SenderExpiry(msg) != time.Hour {
+		t.Fatalf("received message doesn't have the expected expiry")
 	}
 
 	client2.gui.events <- Click{
 		name: client2.inboxUI.entries[0].boxName,
 	}
 	client2.AdvanceTo(uiStateInbox)
-	client2.gui.events <- Click{
-		name:   "retain",
-		checks: map[string]bool{"retain": true},
+	if text := client2.gui.text["expires"]; !strings.HasPrefix(text, "erased in ") {
+		t.Errorf("bad expiry countdown: %q", text)
 	}
-	client2.AdvanceTo(uiStateInbox)
 
-	if !msg.retained {
-		t.Fatalf("Retained flag not set")
+	client2.gui.events <- Click{name: "retain-override"}
+	client2.AdvanceTo(uiStateInbox)
+	if msg.Retained {
+		t.Fatalf("message was retained without a warning")
+	}
+	if text := client2.gui.text["expires"]; text != msg.ExpiryWarning() {
+		t.Errorf("override warning wasn't shown, got %q", text)
+	}
+	client2.gui.events <- Click{name: "retain-override"}
+	client2.AdvanceTo(uiStateInbox)
+	if !msg.Retained {
+		t.Fatalf("message wasn't retained after confirming the override")
 	}
 
-	client2.Reload()
-	client2.AdvanceTo(uiStateMain)
-
-	msg = client2.inbox[0]
-	if !msg.retained {
-		t.Fatalf("Retained flag lost")
+	composeWithExpiry("disappearing message", "10 minutes")
+	if _, msg := fetchMessage(client2); msg == nil || client2.SenderExpiry(msg) != 10*time.Minute {
+		t.Fatalf("second message doesn't have the expected expiry")
 	}
 
 	baseTime := time.Now()
-	client2.nowFunc = func() time.Time {
-		return baseTime.Add(messageLifetime + 10*time.Second)
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(10*time.Minute + 10*time.Second)
 	}
-
 	client2.testTimerChan <- baseTime
 	client2.AdvanceTo(uiStateTimerComplete)
 
-	if n := len(client2.inbox); n != 1 {
-		t.Fatalf("Message was deleted while retain flag set")
-	}
-
-	client2.gui.events <- Click{
-		name: client2.inboxUI.entries[0].boxName,
-	}
-	client2.AdvanceTo(uiStateInbox)
-	client2.gui.events <- Click{
-		name:   "retain",
-		checks: map[string]bool{"retain": false},
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("found %d inbox messages after expiry, expected 1", n)
 	}
-	client2.AdvanceTo(uiStateInbox)
-
-	if msg.retained {
-		t.Fatalf("Retain flag not cleared")
+	if client2.Inbox[0] != msg {
+		t.Errorf("the wrong message was erased")
 	}
 
-	client2.testTimerChan <- baseTime
-	client2.AdvanceTo(uiStateTimerComplete)
-
-	if n := len(client2.inbox); n != 1 {
-		t.Fatalf("Message was deleted while in grace period")
+	// Whether an expiry is meaningful depends on how long client2 keeps
+	// messages from client1.
+	if err := core.ValidateExpiry(10 * 24 * time.Hour); err != nil {
+		t.Errorf("an expiry longer than the default lifetime was rejected: %s", err)
 	}
-
-	client2.nowFunc = func() time.Time {
-		return baseTime.Add(messageLifetime + messageGraceTime + 20*time.Second)
+	id1, _ := contactByName(client2, "client1")
+	withExpiry := func(expiry time.Duration) *core.InboxMessage {
+		return &core.InboxMessage{
+			From:         id1,
+			ReceivedTime: client2.Now(),
+			Message:      &pond.Message{Expiry: proto.Int64(int64(expiry / time.Second))},
+		}
 	}
-
-	client2.testTimerChan <- baseTime
-	client2.AdvanceTo(uiStateTimerComplete)
-
-	if n := len(client2.inbox); n != 1 {
-		t.Fatalf("Message deleted while selected")
+	client2.Contacts[id1].InboxRetention = core.RetentionPolicy{Mode: disk.Retention_DAYS, Days: 1}
+	if expiry := client2.SenderExpiry(withExpiry(3 * 24 * time.Hour)); expiry != 0 {
+		t.Errorf("an expiry longer than the contact's retention was honoured: %s", expiry)
 	}
-
-	client2.gui.events <- Click{
-		name: "compose",
+	if expiry := client2.SenderExpiry(withExpiry(time.Hour)); expiry != time.Hour {
+		t.Errorf("an expiry shorter than the contact's retention was ignored: %s", expiry)
 	}
-	client2.AdvanceTo(uiStateCompose)
-
-	client2.testTimerChan <- baseTime
-	client2.AdvanceTo(uiStateTimerComplete)
-
-	if n := len(client2.inbox); n != 0 {
-		t.Fatalf("Message not deleted")
+	client2.Contacts[id1].InboxRetention = core.RetentionPolicy{Mode: disk.Retention_FOREVER}
+	if expiry := client2.SenderExpiry(withExpiry(10 * 24 * time.Hour)); expiry != 10*24*time.Hour {
+		t.Errorf("an expiry was ignored for a contact whose messages are kept forever: %s", expiry)
 	}
 }
 
-func TestOutboxDeletion(t *testing.T) {
+func TestRetentionPolicy(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2184,71 +5008,95 @@ func TestOutboxDeletion(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	const testMsg = "test message"
-	sendMessage(client1, "client2", testMsg)
+	selectContact(t, client2, "client1")
+	client2.gui.events <- Click{
+		name:   "inbox-retention",
+		combos: map[string]string{"inbox-retention": "1 hour after reading"},
+	}
+	client2.AdvanceTo(uiStateShowContact)
+	contact2, _ := contactByName(client2, "client1")
+	if policy := client2.Contacts[contact2].InboxRetention; policy.Mode != disk.Retention_AFTER_READ || policy.Hours != 1 {
+		t.Fatalf("inbox retention wasn't set: %#v", policy)
+	}
 
+	selectContact(t, client1, "client2")
 	client1.gui.events <- Click{
-		name: "compose",
+		name:   "outbox-retention",
+		combos: map[string]string{"outbox-retention": "1 hour after acknowledgement"},
 	}
-	client1.AdvanceTo(uiStateCompose)
+	client1.AdvanceTo(uiStateShowContact)
 
-	if n := len(client1.outbox); n != 1 {
-		t.Fatalf("Bad initial number of outbox messages: %d", n)
-	}
+	sendMessage(client1, "client2", "ephemeral message")
+	fetchMessage(client2)
 
+	// An unread message is kept for longer than the default lifetime.
 	baseTime := time.Now()
-	client1.nowFunc = func() time.Time {
-		return baseTime.Add(messageLifetime + 10*time.Second)
+	client2.NowFunc = func() time.Time {
+		return baseTime.Add(core.MessageLifetime + time.Hour)
 	}
-
-	client1.testTimerChan <- baseTime
-	client1.AdvanceTo(uiStateTimerComplete)
-
-	if n := len(client1.outbox); n != 0 {
-		t.Fatalf("Outbox message not deleted")
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+	if n := len(client2.Inbox); n != 1 {
+		t.Fatalf("found %d inbox messages before reading, expected 1", n)
 	}
-}
+	client2.NowFunc = nil
 
-func TestStateFileLocking(t *testing.T) {
-	if parallel {
-		t.Parallel()
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if policy := client2.Contacts[contact2].InboxRetention; policy.Mode != disk.Retention_AFTER_READ || policy.Hours != 1 {
+		t.Fatalf("inbox retention wasn't persisted: %#v", policy)
 	}
 
-	server, err := NewTestServer(t)
-	if err != nil {
-		t.Fatal(err)
+	client2.gui.events <- Click{
+		name: client2.inboxUI.entries[0].boxName,
 	}
-	defer server.Close()
-
-	client1, err := NewTestClient(t, "client1", nil)
-	if err != nil {
-		t.Fatal(err)
+	client2.AdvanceTo(uiStateInbox)
+	if client2.Inbox[0].ReadTime.IsZero() {
+		t.Fatalf("read time wasn't recorded")
 	}
-	defer client1.Close()
-
-	client2, err := NewTestClient(t, "client2", nil)
-	if err != nil {
-		t.Fatal(err)
+	client2.gui.events <- Click{
+		name: "ack",
+	}
+	client2.AdvanceTo(uiStateInbox)
+	transmitMessage(client2, false)
+	fetchMessage(client1)
+	if client1.Outbox[0].Acked.IsZero() {
+		t.Fatalf("client1 doesn't believe that its message has been acked")
 	}
-	defer client2.Close()
 
-	// Setup a normal pair of clients.
-	proceedToPaired(t, client1, client2, server)
+	// The message has to be deselected before it can be erased.
+	client2.gui.events <- Click{name: "compose"}
+	client2.AdvanceTo(uiStateCompose)
 
-	stateFile, err := os.Open(filepath.Join(client1.stateDir, "state"))
-	if err != nil {
-		t.Fatalf("Failed to open state file")
+	// Both copies are erased an hour after the message was read and acked.
+	baseTime = time.Now()
+	later := func() time.Time {
+		return baseTime.Add(time.Hour + time.Minute)
 	}
-	defer stateFile.Close()
-	if syscall.Flock(int(stateFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == nil {
-		t.Fatalf("Was able to lock state file")
+	client2.NowFunc = later
+	client2.testTimerChan <- baseTime
+	client2.AdvanceTo(uiStateTimerComplete)
+	for _, msg := range client2.Inbox {
+		if msg.From == contact2 {
+			t.Fatalf("inbox message wasn't erased an hour after reading")
+		}
+	}
+
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	client1.NowFunc = later
+	client1.testTimerChan <- baseTime
+	client1.AdvanceTo(uiStateTimerComplete)
+	for _, msg := range client1.Outbox {
+		if !msg.Revocation {
+			t.Fatalf("outbox message wasn't erased an hour after acknowledgement")
+		}
 	}
 }
 
-func TestMergedACKs(t *testing.T) {
+func TestSearch(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2271,49 +5119,86 @@ func TestMergedACKs(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	// Send two messages to client2.
-	sendMessage(client1, "client2", "foo1")
+	sendMessage(client1, "client2", "Lunch on Friday?")
 	fetchMessage(client2)
-	sendMessage(client1, "client2", "foo2")
+	sendMessage(client1, "client2", "The budget is attached.\nPlease check the budget figures before the meeting.")
 	fetchMessage(client2)
 
-	// Ack the two messages in client2. The second ack should merge with
-	// the first.
-	client2.gui.events <- Click{
-		name: client2.inboxUI.entries[0].boxName,
+	if hits := client2.Search("budget"); len(hits) != 1 || hits[0].Inbox == nil {
+		t.Fatalf("bad results for a single word: %#v", hits)
 	}
-	client2.AdvanceTo(uiStateInbox)
-	client2.gui.events <- Click{
-		name: "ack",
+	if hits := client2.Search("FRI lunch"); len(hits) != 1 || !strings.HasPrefix(string(hits[0].Inbox.Message.Body), "Lunch") {
+		t.Fatalf("bad results for a prefix: %#v", hits)
+	}
+	if hits := client2.Search("lunch budget"); len(hits) != 0 {
+		t.Fatalf("found %d results for words in different messages", len(hits))
+	}
+	if hits := client2.Search("client1 meeting"); len(hits) != 1 {
+		t.Fatalf("found %d results for a contact name and word, expected 1", len(hits))
+	}
+	// Both messages are from client1 so they score equally and the most
+	// recent is first.
+	if hits := client2.Search("client1"); len(hits) != 2 || !strings.HasPrefix(hits[0].Body(), "The budget") {
+		t.Fatalf("bad results for a contact name: %#v", hits)
+	}
+	if hits := client1.Search("budget"); len(hits) != 1 || hits[0].Outbox == nil {
+		t.Fatalf("sent message not found: %#v", hits)
 	}
-	client2.AdvanceTo(uiStateInbox)
 
+	client2.gui.events <- Click{name: client2.clientUI.entries[2].boxName}
+	client2.AdvanceTo(uiStateSearch)
 	client2.gui.events <- Click{
-		name: client2.inboxUI.entries[1].boxName,
+		name:    "search",
+		entries: map[string]string{"search-query": "figures"},
 	}
-	client2.AdvanceTo(uiStateInbox)
-	client2.gui.events <- Click{
-		name: "ack",
+	client2.AdvanceTo(uiStateSearch)
+	if snippet := client2.gui.text["search-snippet-0"]; !strings.Contains(snippet, "budget figures") || strings.Contains(snippet, "\n") {
+		t.Fatalf("bad snippet: %q", snippet)
 	}
+	client2.gui.events <- Click{name: "search-result-0"}
 	client2.AdvanceTo(uiStateInbox)
 
-	// Send only one message from client2.
-	transmitMessage(client2, false)
+	// Drafts are searchable and changes to them are noticed.
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
+	var draft *core.Draft
+	for _, d := range client1.Drafts {
+		draft = d
+	}
+	draft.Body = "unfinished thoughts"
+	if hits := client1.Search("thoughts"); len(hits) != 1 || hits[0].Draft != draft {
+		t.Fatalf("draft not found: %#v", hits)
+	}
+	draft.Body = "finished"
+	if hits := client1.Search("thoughts"); len(hits) != 0 {
+		t.Fatalf("stale draft found")
+	}
 
-	// Both messages should be ACKed in client1 on receipt.
-	fetchMessage(client1)
+	client2.Reload()
+	client2.AdvanceTo(uiStateMain)
+	if n := len(client2.SearchIndex.Docs); n != 2 {
+		t.Fatalf("index has %d documents after reload, expected 2", n)
+	}
 
-	for _, msg := range client1.outbox {
-		if msg.acked.IsZero() {
-			t.Errorf("Unacked message in client1's outbox.")
+	// Deleting a message removes it from the index straight away, rather
+	// than at the next search.
+	for _, msg := range client2.Inbox {
+		if msg.Message != nil && strings.Contains(string(msg.Message.Body), "budget") {
+			client2.DeleteInboxMsg(msg.Id)
+			break
 		}
 	}
+	if n := len(client2.SearchIndex.Docs); n != 1 {
+		t.Fatalf("index has %d documents after a deletion, expected 1", n)
+	}
+	if _, ok := client2.SearchIndex.Postings[core.SearchTerms("budget")[0]]; ok {
+		t.Fatalf("words from a deleted message are still indexed")
+	}
 }
 
-func TestEntombing(t *testing.T) {
+func TestScheduledSend(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2336,56 +5221,73 @@ func TestEntombing(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	// Send a message so that we can be sure that the state file was
-	// correctly recovered.
-	sendMessage(client1, "client2", "foo1")
-	fetchMessage(client2)
-
-	// Emtomb client1.
+	sendAfter := time.Now().Add(24 * time.Hour).Local()
+	client1.gui.events <- Click{name: "compose"}
+	client1.AdvanceTo(uiStateCompose)
 	client1.gui.events <- Click{
-		name: client1.clientUI.entries[0].boxName,
+		name:        "send",
+		combos:      map[string]string{"to": "client2"},
+		textViews:   map[string]string{"body": "good morning"},
+		checks:      map[string]bool{"schedule": true},
+		calendars:   map[string]CalendarDate{"send-date": {sendAfter.Year(), int(sendAfter.Month()) - 1, sendAfter.Day()}},
+		spinButtons: map[string]int{"send-hour": sendAfter.Hour(), "send-minute": sendAfter.Minute()},
 	}
-	client1.AdvanceTo(uiStateShowIdentity)
-
-	client1.gui.events <- OpenResult{ok: true, path: filepath.Join(client1.stateDir, "statefile.tomb")}
-	client1.gui.events <- Click{name: "entomb"}
-	client1.AdvanceTo(uiStateEntomb)
-	client1.AdvanceTo(uiStateEntombComplete)
+	client1.AdvanceTo(uiStateOutbox)
 
-	keyHex := client1.gui.info
-	client1.Reload()
-	client1.AdvanceTo(uiStateLoading)
-	client1.AdvanceTo(uiStateCreatePassphrase)
-	client1.gui.events <- Click{
-		name:    "next",
-		entries: map[string]string{"pw": ""},
+	expected := sendAfter.Truncate(time.Minute)
+	if notBefore := client1.Outbox[0].NotBefore; !notBefore.Equal(expected) {
+		t.Fatalf("message scheduled for %s, expected %s", notBefore, expected)
 	}
 
-	if client1.hasErasure() {
-		client1.AdvanceTo(uiStateErasureStorage)
-		client1.gui.events <- Click{
-			name: "continue",
-		}
+	scheduledLengths := func() (queued, scheduled int) {
+		client1.QueueMutex.Lock()
+		defer client1.QueueMutex.Unlock()
+		return len(client1.Queue), len(client1.Scheduled)
+	}
+	if queued, scheduled := scheduledLengths(); queued != 0 || scheduled != 1 {
+		t.Fatalf("%d messages queued and %d scheduled, expected 0 and 1", queued, scheduled)
 	}
 
-	client1.AdvanceTo(uiStateCreateAccount)
-	client1.gui.events <- OpenResult{ok: true, path: filepath.Join(client1.stateDir, "statefile.tomb")}
-	client1.gui.events <- Click{
-		name:    "import",
-		entries: map[string]string{"tombkey": keyHex},
+	transmitMessage(client1, false)
+	if !client1.Outbox[0].Sent.IsZero() {
+		t.Fatalf("scheduled message was transmitted early")
 	}
+
+	client1.Reload()
 	client1.AdvanceTo(uiStateMain)
+	if queued, scheduled := scheduledLengths(); queued != 0 || scheduled != 1 {
+		t.Fatalf("after reload, %d messages queued and %d scheduled, expected 0 and 1", queued, scheduled)
+	}
+	if notBefore := client1.Outbox[0].NotBefore; !notBefore.Equal(expected) {
+		t.Fatalf("after reload, message scheduled for %s, expected %s", notBefore, expected)
+	}
 
-	if len(client1.outbox) != 1 {
-		t.Fatalf("No messages in outbox")
+	// Simulate the passing of time.
+	client1.QueueMutex.Lock()
+	client1.Scheduled[0].NotBefore = time.Now().Add(-time.Minute)
+	client1.QueueMutex.Unlock()
+
+	transmitMessage(client1, false)
+	if _, msg := fetchMessage(client2); msg == nil || string(msg.Message.Body) != "good morning" {
+		t.Fatalf("scheduled message wasn't received")
+	}
+	if client1.Outbox[0].Sent.IsZero() {
+		t.Fatalf("scheduled message wasn't marked as sent")
+	}
+
+	// A random delay falls within the window.
+	now := client1.Now()
+	draft := &core.Draft{SendDelay: time.Hour}
+	for i := 0; i < 10; i++ {
+		if notBefore := client1.NotBefore(draft); notBefore.Before(now.Add(-time.Second)) || notBefore.After(now.Add(time.Hour)) {
+			t.Fatalf("random send time %s is outside the window", notBefore)
+		}
 	}
 }
 
-func TestContactNameChange(t *testing.T) {
-	// Exercise the code to change a contact's name.
+func TestGZIPBodies(t *testing.T) {
 	if parallel {
 		t.Parallel()
 	}
@@ -2408,33 +5310,53 @@ func TestContactNameChange(t *testing.T) {
 	}
 	defer client2.Close()
 
-	// Setup a normal pair of clients.
 	proceedToPaired(t, client1, client2, server)
 
-	const testMsg = "test message"
-	sendMessage(client1, "client2", testMsg)
-	from, _ := fetchMessage(client2)
-	if from != "client1" {
-		t.Fatalf("message from %s, expected client1", from)
+	// client1 learns that client2 supports compression from a message.
+	sendMessage(client2, "client1", "hello")
+	fetchMessage(client1)
+	id2, _ := contactByName(client1, "client2")
+	if v := client1.Contacts[id2].SupportedVersion; v < core.GzipVersion {
+		t.Fatalf("client2 advertised version %d", v)
 	}
 
-	clickOnContact(client1, "client2")
-	const newName = "client2x"
-	client1.gui.events <- Update{name: "contactname", text: newName}
-	client1.gui.events <- Click{
-		name:    "changebutton",
-		entries: map[string]string{"contactname": newName},
+	body := strings.Repeat("All work and no play makes Jack a dull boy.\n", 1000)
+	draft := &core.Draft{To: id2, Body: body}
+	usage, over := client1.UsageString(draft)
+	if over || !strings.HasSuffix(usage, "(compressed)") {
+		t.Fatalf("bad usage for a compressible draft: %s", usage)
 	}
-	client1.AdvanceTo(uiStateContactNameChanged)
-
-	if contact, _ := client1.contactByName(newName); contact == nil {
-		t.Errorf("name not updated in client")
+	client1.Contacts[id2].SupportedVersion = 1
+	if usage, over := client1.UsageString(draft); !over || strings.HasSuffix(usage, "(compressed)") {
+		t.Fatalf("bad usage for a contact that doesn't support compression: %s", usage)
 	}
+	client1.Contacts[id2].SupportedVersion = core.ProtoVersion
 
-	client1.Reload()
-	client1.AdvanceTo(uiStateMain)
+	sendMessage(client1, "client2", body)
+	if encoding := client1.Outbox[len(client1.Outbox)-1].Message.GetBodyEncoding(); encoding != pond.Message_RAW {
+		t.Errorf("outbox message has encoding %s", encoding)
+	}
+	_, msg := fetchMessage(client2)
+	if msg == nil || string(msg.Message.Body) != body {
+		t.Fatalf("compressed message wasn't received intact")
+	}
+	if encoding := msg.Message.GetBodyEncoding(); encoding != pond.Message_RAW {
+		t.Errorf("inbox message has encoding %s", encoding)
+	}
 
-	if contact, _ := client1.contactByName(newName); contact == nil {
-		t.Errorf("name not updated in client after reload")
+	// Bodies that decompress to more than the limit are rejected.
+	bomb := &pond.Message{
+		Body:         core.GzipBody(make([]byte, core.MaxDecompressedBody+1)),
+		BodyEncoding: pond.Message_GZIP.Enum(),
+	}
+	if err := core.DecompressBody(bomb); err == nil {
+		t.Errorf("oversized body was decompressed")
+	}
+	limit := &pond.Message{
+		Body:         core.GzipBody(make([]byte, core.MaxDecompressedBody)),
+		BodyEncoding: pond.Message_GZIP.Enum(),
+	}
+	if err := core.DecompressBody(limit); err != nil || len(limit.Body) != core.MaxDecompressedBody {
+		t.Errorf("failed to decompress body at the limit: %s", err)
 	}
 }
@@ -0,0 +1,416 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var backgroundCanceledError = errors.New("background task canceled")
+
+func (c *Client) StartEncryption(id uint64, outPath, inPath string) (cancel func()) {
+	killChan := make(chan bool, 1)
+	go func() {
+		var detachment *pond.Message_Detachment
+		var out *os.File
+		var err error
+		if out, err = os.OpenFile(outPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+			err = errors.New("failed to open output: " + err.Error())
+		} else {
+			defer out.Close()
+			detachment, err = saveEncrypted(c.Rand, c.BackgroundChan, out, id, inPath, killChan)
+		}
+		if detachment != nil {
+			c.BackgroundChan <- DetachmentComplete{id, detachment}
+		} else {
+			os.Remove(outPath)
+			c.BackgroundChan <- DetachmentError{id, err}
+		}
+	}()
+	return func() {
+		killChan <- true
+	}
+}
+
+func (c *Client) StartDecryption(id uint64, outPath, inPath string, detachment *pond.Message_Detachment) (cancel func()) {
+	killChan := make(chan bool, 1)
+	go func() {
+		var in *os.File
+		var err error
+		if in, err = os.Open(inPath); err != nil {
+			err = errors.New("failed to open input: " + err.Error())
+		} else {
+			defer in.Close()
+			err = saveDecrypted(c.BackgroundChan, outPath, id, in, detachment, killChan)
+		}
+		if err != nil {
+			c.BackgroundChan <- DetachmentError{id, err}
+		} else {
+			c.BackgroundChan <- DetachmentComplete{id, nil}
+		}
+	}()
+	return func() {
+		killChan <- true
+	}
+}
+
+func (c *Client) buildDetachmentURL(id uint64) string {
+	u, err := url.Parse(c.Server)
+	if err != nil {
+		panic("own server failed to parse as URL")
+	}
+
+	u.Path = fmt.Sprintf("/%x/%x", c.IdentityPublic[:], id)
+	return u.String()
+}
+
+// StartUpload encrypts and uploads the file at inPath to the home server. The
+// resulting detachment is added to the given draft once the upload is
+// complete.
+func (c *Client) StartUpload(id, draft uint64, inPath string) (cancel func()) {
+	t := &Transfer{
+		Id:     id,
+		Upload: true,
+		Path:   inPath,
+		Draft:  draft,
+	}
+	if fileInfo, err := os.Stat(inPath); err == nil {
+		t.Size = fileInfo.Size()
+	}
+	return c.startTransfer(t, "pond-upload-")
+}
+
+// StartDownload downloads detachment and decrypts it to outPath.
+func (c *Client) StartDownload(id uint64, outPath string, detachment *pond.Message_Detachment) (cancel func()) {
+	t := &Transfer{
+		Id:         id,
+		Path:       outPath,
+		Detachment: detachment,
+	}
+	return c.startTransfer(t, "pond-download-")
+}
+
+// runUpload performs an upload transfer. If the file hasn't been encrypted
+// yet then it's encrypted into TmpPath, or if the upload copies source then
+// source is downloaded into TmpPath, and the resulting detachment is sent on
+// BackgroundChan so that it can be recorded. Nothing is uploaded until it
+// has been, so that a resumed upload never continues with a different key.
+// Otherwise TmpPath already contains the encrypted file and the upload is
+// resumed.
+func (c *Client) runUpload(id uint64, tmpPath, inPath string, detachment, source *pond.Message_Detachment, killChan chan bool) (*pond.Message_Detachment, error) {
+	if detachment == nil {
+		var err error
+		if source != nil {
+			detachment, err = c.CopyDetachment(id, tmpPath, source, killChan)
+		} else {
+			detachment, err = c.encryptDetachment(id, tmpPath, inPath, killChan)
+		}
+		if err != nil {
+			return nil, err
+		}
+		detachment.Url = proto.String(c.buildDetachmentURL(id))
+		saved := make(chan struct{})
+		c.BackgroundChan <- DetachmentEncrypted{id, detachment, saved}
+		select {
+		case <-saved:
+		case <-killChan:
+			return nil, backgroundCanceledError
+		}
+	}
+
+	tmp, err := os.Open(tmpPath)
+	if err != nil {
+		return nil, errors.New("failed to open temp file: " + err.Error())
+	}
+	defer tmp.Close()
+
+	if err := c.uploadDetachment(c.BackgroundChan, tmp, id, killChan); err != nil {
+		return nil, err
+	}
+	c.Log.Printf("Finished upload of %s", *detachment.Url)
+	return detachment, nil
+}
+
+// encryptDetachment encrypts the file at inPath into TmpPath and returns the
+// resulting detachment, without a URL.
+func (c *Client) encryptDetachment(id uint64, tmpPath, inPath string, killChan chan bool) (*pond.Message_Detachment, error) {
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.New("failed to open temp file: " + err.Error())
+	}
+	defer out.Close()
+
+	return saveEncrypted(c.Rand, c.BackgroundChan, out, id, inPath, killChan)
+}
+
+// CopyDetachment downloads the encrypted contents of source into TmpPath and
+// returns a copy of source, without a URL, that describes them. Any data
+// already in TmpPath is assumed to be the beginning of the contents.
+func (c *Client) CopyDetachment(id uint64, tmpPath string, source *pond.Message_Detachment, killChan chan bool) (*pond.Message_Detachment, error) {
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.New("failed to open temp file: " + err.Error())
+	}
+	defer tmp.Close()
+
+	if err := c.downloadDetachment(c.BackgroundChan, tmp, id, source.GetUrl(), killChan); err != nil {
+		return nil, err
+	}
+	detachment := proto.Clone(source).(*pond.Message_Detachment)
+	detachment.Url = nil
+	return detachment, nil
+}
+
+// runDownload performs a download transfer. Any data already in TmpPath is
+// assumed to be the beginning of the detachment and the download is resumed
+// from the end of it.
+func (c *Client) runDownload(id uint64, tmpPath, outPath string, detachment *pond.Message_Detachment, killChan chan bool) error {
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.New("failed to open temp file: " + err.Error())
+	}
+	defer tmp.Close()
+
+	if err := c.downloadDetachment(c.BackgroundChan, tmp, id, *detachment.Url, killChan); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, 0 /* from start */); err != nil {
+		return err
+	}
+	return saveDecrypted(c.BackgroundChan, outPath, id, tmp, detachment, killChan)
+}
+
+type DetachmentProgress struct {
+	Id          uint64
+	Done, Total uint64
+	Status      string
+}
+
+type DetachmentError struct {
+	Id  uint64
+	Err error
+}
+
+type DetachmentComplete struct {
+	Id         uint64
+	Detachment *pond.Message_Detachment
+}
+
+// DetachmentEncrypted is sent when a file that's being uploaded has been
+// encrypted, but before the upload starts. The upload waits until saved is
+// closed, which happens once the detachment has been recorded in the state
+// file.
+type DetachmentEncrypted struct {
+	id         uint64
+	detachment *pond.Message_Detachment
+	saved      chan struct{}
+}
+
+const defaultDetachmentBlockSize = 16384 - secretbox.Overhead
+
+func saveEncrypted(rand io.Reader, c chan interface{}, out io.Writer, id uint64, inPath string, killChan chan bool) (*pond.Message_Detachment, error) {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return nil, errors.New("failed to open input: " + err.Error())
+	}
+	defer in.Close()
+
+	var size int64
+	if fileInfo, err := in.Stat(); err == nil {
+		size = fileInfo.Size()
+	}
+
+	detachment, err := saveEncryptedFrom(rand, c, out, id, in, size, killChan)
+	if err != nil {
+		return nil, err
+	}
+	detachment.Filename = proto.String(filepath.Base(inPath))
+	return detachment, nil
+}
+
+// saveEncryptedFrom is like saveEncrypted but reads the plaintext from in,
+// which is expected to contain size bytes. The filename of the resulting
+// detachment is left unset.
+func saveEncryptedFrom(rand io.Reader, c chan interface{}, out io.Writer, id uint64, in io.Reader, size int64, killChan chan bool) (*pond.Message_Detachment, error) {
+	var key [32]byte
+	var nonce [24]byte
+
+	if _, err := io.ReadFull(rand, key[:]); err != nil {
+		panic(err)
+	}
+
+	blockSize := defaultDetachmentBlockSize
+	buf := make([]byte, blockSize)
+
+	var fileSize, bytesOut uint64
+	var eof bool
+	var boxBuf []byte
+	var lastUpdate time.Time
+
+	for {
+		if !eof {
+			n, err := io.ReadFull(in, buf)
+			switch err {
+			case nil:
+				break
+			case io.ErrUnexpectedEOF, io.EOF:
+				eof = true
+			default:
+				return nil, errors.New("failed to read from source file: " + err.Error())
+			}
+			fileSize += uint64(n)
+		}
+		boxBuf = secretbox.Seal(boxBuf[:0], buf, &nonce, &key)
+
+		if _, err := out.Write(boxBuf); err != nil {
+			return nil, errors.New("failed to write to destination: " + err.Error())
+		}
+		bytesOut += uint64(len(boxBuf))
+
+		// Stop when we've read all of the file and have hit a power of
+		// two.
+		if eof && (bytesOut&(bytesOut-1)) == 0 {
+			break
+		}
+
+		incNonce(&nonce)
+
+		now := time.Now()
+		if size > 0 && (lastUpdate.IsZero() || now.Sub(lastUpdate) > 500*time.Millisecond) {
+			lastUpdate = now
+			select {
+			case c <- DetachmentProgress{
+				Id:     id,
+				Done:   fileSize,
+				Total:  uint64(size),
+				Status: "encrypting",
+			}:
+				break
+			default:
+			}
+		}
+
+		select {
+		case <-killChan:
+			return nil, backgroundCanceledError
+		default:
+			break
+		}
+	}
+
+	return &pond.Message_Detachment{
+		Size:       proto.Uint64(fileSize),
+		PaddedSize: proto.Uint64(bytesOut),
+		ChunkSize:  proto.Uint32(uint32(blockSize)),
+		Key:        key[:],
+	}, nil
+}
+
+func saveDecrypted(c chan interface{}, outPath string, id uint64, in *os.File, detachment *pond.Message_Detachment, killChan chan bool) error {
+	out, err := os.OpenFile(outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.New("failed to open output: " + err.Error())
+	}
+	defer out.Close()
+
+	var key [32]byte
+	var nonce [24]byte
+
+	blockSize := *detachment.ChunkSize + secretbox.Overhead
+	if blockSize > 1<<20 {
+		return errors.New("chunk size too large")
+	}
+
+	copy(key[:], detachment.Key)
+
+	var bytesIn, bytesOut uint64
+	buf := make([]byte, blockSize)
+	var decrypted []byte
+	var lastUpdate time.Time
+
+BlockLoop:
+	for {
+		n, err := io.ReadFull(in, buf)
+		switch err {
+		case nil:
+			break
+		case io.ErrUnexpectedEOF, io.EOF:
+			break BlockLoop
+		default:
+			return errors.New("failed to read from source: " + err.Error())
+		}
+
+		bytesIn += uint64(n)
+		var ok bool
+		decrypted, ok = secretbox.Open(decrypted[:0], buf, &nonce, &key)
+		if !ok {
+			os.Remove(outPath)
+			return errors.New("input corrupt")
+		}
+
+		if bytesOut != *detachment.Size {
+			if n := bytesOut + uint64(len(decrypted)); n > *detachment.Size {
+				decrypted = decrypted[:*detachment.Size-bytesOut]
+			}
+			bytesOut += uint64(len(decrypted))
+
+			if _, err := out.Write(decrypted); err != nil {
+				return errors.New("failed to write to destination: " + err.Error())
+			}
+		}
+
+		if bytesIn > *detachment.PaddedSize {
+			// This means that we downloaded more bytes than we
+			// expected.
+			break
+		}
+
+		incNonce(&nonce)
+
+		now := time.Now()
+		if lastUpdate.IsZero() || now.Sub(lastUpdate) > 500*time.Millisecond {
+			lastUpdate = now
+			select {
+			case c <- DetachmentProgress{
+				Id:     id,
+				Done:   bytesIn,
+				Total:  *detachment.PaddedSize,
+				Status: "decrypting",
+			}:
+				break
+			default:
+			}
+		}
+
+		select {
+		case <-killChan:
+			os.Remove(outPath)
+			return backgroundCanceledError
+		default:
+			break
+		}
+	}
+
+	if bytesIn != *detachment.PaddedSize {
+		return errors.New("input truncated")
+	}
+
+	return nil
+}
+
+func incNonce(nonce *[24]byte) {
+	s := 1
+	for i, b := range nonce[:] {
+		s += int(b)
+		nonce[i] = byte(s)
+		s >>= 8
+	}
+}
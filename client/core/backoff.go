@@ -0,0 +1,257 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/agl/pond/client/disk"
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+)
+
+// When a delivery to a server fails, the network goroutine records the
+// failure and doesn't try that server again until an exponentially increasing
+// delay has passed. Messages to other servers are sent in the meantime. Once a
+// server has been failing for longer than a configurable period, messages to
+// it are flagged as undeliverable, although they continue to be retried.
+
+const (
+	// serverBackoffBase is the delay after the first failure to deliver to
+	// a server. It doubles with each further failure.
+	serverBackoffBase = time.Minute
+	// serverBackoffMax is the maximum delay between attempts to deliver to
+	// a server.
+	serverBackoffMax = 12 * time.Hour
+	// defaultUndeliverableAfter is the default time after which messages to
+	// a failing server are flagged as undeliverable.
+	defaultUndeliverableAfter = 7 * 24 * time.Hour
+)
+
+// failureCategory classifies a failed transaction with a server.
+type failureCategory int
+
+const (
+	// FailureDial means that the server couldn't be connected to.
+	FailureDial failureCategory = iota
+	// failureHandshake means that the connection failed after it was
+	// made: during the handshake or while exchanging the request.
+	failureHandshake
+	// failureReply means that the server replied with an error status.
+	failureReply
+)
+
+func (f failureCategory) String() string {
+	switch f {
+	case FailureDial:
+		return "connection failed"
+	case failureHandshake:
+		return "handshake failed"
+	case failureReply:
+		return "server error"
+	}
+	return "unknown"
+}
+
+// handshakeError wraps an error that occured after a connection to a server
+// was made.
+type handshakeError struct {
+	error
+}
+
+// replyError is the error for a reply with a status other than OK.
+type replyError struct {
+	status pond.Reply_Status
+}
+
+func (e replyError) Error() string {
+	if msg, ok := pond.Reply_Status_name[int32(e.status)]; ok {
+		return "error from server: " + msg
+	}
+	return "error from server: unknown"
+}
+
+// errNotSigned is returned when a message couldn't be signed for delivery,
+// which isn't the fault of the server.
+var errNotSigned = errors.New("failed to sign message")
+
+// failureCategoryOf returns the category of an error from a transaction.
+func failureCategoryOf(err error) failureCategory {
+	switch err.(type) {
+	case *handshakeError:
+		return failureHandshake
+	case replyError:
+		return failureReply
+	}
+	return FailureDial
+}
+
+// serverFailure records the consecutive failures to deliver to a server.
+type serverFailure struct {
+	Server string
+	// Category and err describe the most recent failure.
+	Category failureCategory
+	Err      string
+	Count    int
+	// first and last are the times of the first and most recent failures.
+	First, last time.Time
+	// Retry is the time before which the server won't be tried again.
+	Retry time.Time
+}
+
+// serverBackoff returns the time to wait before trying a server again after
+// count consecutive failures.
+func serverBackoff(count int) time.Duration {
+	d := serverBackoffBase
+	for i := 1; i < count && d < serverBackoffMax; i++ {
+		d *= 2
+	}
+	if d > serverBackoffMax {
+		d = serverBackoffMax
+	}
+	return d
+}
+
+// recordServerFailure notes a failure to deliver to server and returns a copy
+// of the server's failure state. It's called from the network goroutine.
+func (c *Client) recordServerFailure(server string, err error, now time.Time) *serverFailure {
+	c.QueueMutex.Lock()
+	defer c.QueueMutex.Unlock()
+
+	if c.ServerFailures == nil {
+		c.ServerFailures = make(map[string]*serverFailure)
+	}
+	f, ok := c.ServerFailures[server]
+	if !ok {
+		f = &serverFailure{Server: server, First: now}
+		c.ServerFailures[server] = f
+	}
+	f.Category = failureCategoryOf(err)
+	f.Err = err.Error()
+	f.Count++
+	f.last = now
+	f.Retry = now.Add(serverBackoff(f.Count))
+	c.Log.Printf("Delivery to %s failed (%s). Will retry after %s", server, f.Category, f.Retry.Format(LogTimeFormat))
+
+	failure := *f
+	return &failure
+}
+
+// recordServerSuccess clears any failures of server. It's called from the
+// network goroutine.
+func (c *Client) recordServerSuccess(server string) {
+	c.QueueMutex.Lock()
+	defer c.QueueMutex.Unlock()
+
+	delete(c.ServerFailures, server)
+}
+
+// nextSendableLocked returns the first message in the queue whose server isn't
+// being backed off from, or nil if there's none. c.QueueMutex must be held.
+func (c *Client) nextSendableLocked(now time.Time) *QueuedMessage {
+	for _, msg := range c.Queue {
+		if f, ok := c.ServerFailures[msg.Server]; ok && now.Before(f.Retry) {
+			continue
+		}
+		return msg
+	}
+	return nil
+}
+
+// UnreachableServers returns copies of the failure states of the servers that
+// deliveries are currently failing to, sorted by server.
+func (c *Client) UnreachableServers() []serverFailure {
+	c.QueueMutex.Lock()
+	defer c.QueueMutex.Unlock()
+
+	var servers []string
+	for server := range c.ServerFailures {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	failures := make([]serverFailure, 0, len(servers))
+	for _, server := range servers {
+		failures = append(failures, *c.ServerFailures[server])
+	}
+	return failures
+}
+
+// marshalServerFailures returns the failure states of the servers that
+// deliveries are currently failing to, for saving in the state file.
+func (c *Client) marshalServerFailures() []*disk.NetworkConfig_ServerFailure {
+	var failures []*disk.NetworkConfig_ServerFailure
+	for _, f := range c.UnreachableServers() {
+		failures = append(failures, &disk.NetworkConfig_ServerFailure{
+			Server: proto.String(f.Server),
+			First:  proto.Int64(f.First.Unix()),
+			Count:  proto.Int32(int32(f.Count)),
+			Retry:  proto.Int64(f.Retry.Unix()),
+		})
+	}
+	return failures
+}
+
+// unmarshalServerFailures restores the failure states of servers from the
+// state file. The details of the most recent failure aren't saved so last is
+// taken to be first until the server fails again.
+func (c *Client) unmarshalServerFailures(failures []*disk.NetworkConfig_ServerFailure) {
+	c.QueueMutex.Lock()
+	defer c.QueueMutex.Unlock()
+
+	c.ServerFailures = nil
+	for _, m := range failures {
+		if c.ServerFailures == nil {
+			c.ServerFailures = make(map[string]*serverFailure)
+		}
+		first := time.Unix(m.GetFirst(), 0)
+		c.ServerFailures[m.GetServer()] = &serverFailure{
+			Server: m.GetServer(),
+			Count:  int(m.GetCount()),
+			First:  first,
+			last:   first,
+			Retry:  time.Unix(m.GetRetry(), 0),
+		}
+	}
+}
+
+// UndeliverableAfter returns the time for which a server must have been
+// failing before messages to it are flagged as undeliverable.
+func (c *Client) UndeliverableAfter() time.Duration {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	if c.network.UndeliverableAfter == 0 {
+		return defaultUndeliverableAfter
+	}
+	return c.network.UndeliverableAfter
+}
+
+// SetUndeliverableAfter sets the period after which messages to a failing
+// server are flagged as undeliverable. Zero restores the default.
+func (c *Client) SetUndeliverableAfter(d time.Duration) {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	c.network.UndeliverableAfter = d
+}
+
+// processDeliveryFailure is called on the main goroutine when msg couldn't be
+// delivered. If its server has been failing for long enough, and the message
+// has been waiting for as long, the message is flagged as undeliverable.
+func (c *Client) processDeliveryFailure(msg *QueuedMessage, failure *serverFailure) {
+	// The server's failure state is saved so that backing off from it
+	// survives a restart.
+	defer c.Save()
+
+	if msg.Undeliverable {
+		return
+	}
+	period := c.UndeliverableAfter()
+	if failure.last.Sub(failure.First) < period || failure.last.Sub(msg.Created) < period {
+		return
+	}
+	msg.Undeliverable = true
+	c.Log.Errorf("Message to %s is undeliverable: %s has been failing since %s (%s)", c.ContactName(msg.To), failure.Server, failure.First.Format(LogTimeFormat), failure.Err)
+	c.UI.ProcessMessageUndeliverable(msg)
+}
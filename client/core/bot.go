@@ -0,0 +1,592 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/panda"
+)
+
+// A Bot runs a Pond identity for another program, such as an auto-responder,
+// without a user interface. Like the daemon, it runs the usual network and
+// PANDA goroutines but it's driven by method calls, which may be made from
+// any goroutine once Start has returned, and it reports what happens as values
+// on the channel returned by Events.
+type Bot struct {
+	client Client
+
+	// Passphrase is used to decrypt the state file, or to encrypt a new
+	// one.
+	Passphrase string
+	// Server is the server on which an account is created if the state
+	// file doesn't exist. If empty, Start fails in that case.
+	Server string
+
+	// events is returned by Events. It's closed once the bot has stopped.
+	events chan interface{}
+	// pending contains events that are waiting to be sent on events. It's
+	// only accessed from the main goroutine.
+	pending []interface{}
+	// calls receives functions that are run on the main goroutine.
+	calls chan func()
+	// stop is closed by Close.
+	stop chan struct{}
+	// started is closed once the main goroutine has either loaded the
+	// state file, or failed to.
+	started chan struct{}
+	// running is true once the state file has been loaded.
+	running bool
+	// done is closed when the main goroutine has shut down.
+	done chan struct{}
+	// err is the reason that the bot failed to start, if any.
+	err error
+}
+
+// BotContact describes a contact of a Bot.
+type BotContact struct {
+	ID   uint64
+	Name string
+	// Pending is true until the key exchange with the contact has
+	// completed. Messages can't be sent to pending contacts.
+	Pending bool
+	// RevokedUs is true if the contact has revoked our access to their
+	// server.
+	RevokedUs bool
+}
+
+// MessageReceived is an event that's sent when a message from a contact has
+// been received and decrypted.
+type MessageReceived struct {
+	// ID is the id of the message in the inbox.
+	ID       uint64
+	From     uint64
+	FromName string
+	Body     string
+	// Sent is the time claimed by the sender.
+	Sent time.Time
+}
+
+// MessageDelivered is an event that's sent when an outbox message has been
+// delivered to its recipient's server.
+type MessageDelivered struct {
+	ID uint64
+	To uint64
+}
+
+// MessageAcknowledged is an event that's sent when the recipient of an outbox
+// message has acknowledged it.
+type MessageAcknowledged struct {
+	ID uint64
+	To uint64
+}
+
+// MessageUndeliverable is an event that's sent when an outbox message has
+// been flagged as undeliverable because its server keeps failing.
+type MessageUndeliverable struct {
+	ID uint64
+	To uint64
+}
+
+// KeyExchangeComplete is an event that's sent when a key exchange started by
+// NewContact has completed.
+type KeyExchangeComplete struct {
+	Contact BotContact
+}
+
+// KeyExchangeFailed is an event that's sent when a key exchange started by
+// NewContact has failed.
+type KeyExchangeFailed struct {
+	Contact BotContact
+	Err     error
+}
+
+// ContactRevokedUs is an event that's sent when a contact has revoked our
+// access to their server.
+type ContactRevokedUs struct {
+	Contact BotContact
+}
+
+var errBotStopped = errors.New("bot: stopped")
+
+// NewBot returns a Bot for the identity in the given state file. Its
+// Passphrase and Server may be set before calling Start.
+func NewBot(stateFilename string, rand io.Reader) *Bot {
+	b := newBot(stateFilename, rand, false /* testing */, true /* autoFetch */)
+	b.client.DisableV2Ratchet = true
+	return b
+}
+
+func newBot(stateFilename string, rand io.Reader, testing, autoFetch bool) *Bot {
+	b := &Bot{
+		client: Client{
+			Testing:            testing,
+			Dev:                testing,
+			AutoFetch:          autoFetch,
+			StateFilename:      stateFilename,
+			Log:                NewLog(),
+			Rand:               rand,
+			Contacts:           make(map[uint64]*Contact),
+			Drafts:             make(map[uint64]*Draft),
+			NewMessageChan:     make(chan NewMessage),
+			MessageSentChan:    make(chan MessageSendResult, 1),
+			BackgroundChan:     make(chan interface{}, 8),
+			PandaChan:          make(chan PandaUpdate, 1),
+			UsedIds:            make(map[uint64]bool),
+			SigningRequestChan: make(chan SigningRequest),
+		},
+		events:  make(chan interface{}),
+		calls:   make(chan func()),
+		stop:    make(chan struct{}),
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	b.client.UI = botUI{b}
+
+	if !testing {
+		b.client.TimerChan = time.Tick(TimerInterval)
+	}
+
+	b.client.NewMeetingPlace = b.client.HTTPMeetingPlace
+	return b
+}
+
+// Start loads the state file, or creates an account if it doesn't exist, and
+// starts the bot. It returns once the bot is running, or has failed to start.
+func (b *Bot) Start() error {
+	go b.run()
+	<-b.started
+	return b.err
+}
+
+// Close stops the bot and waits for its state to be saved. The channel
+// returned by Events is closed once the bot has stopped.
+func (b *Bot) Close() {
+	select {
+	case <-b.stop:
+	default:
+		close(b.stop)
+	}
+	<-b.done
+}
+
+// Events returns a channel on which events, such as MessageReceived, are
+// sent. Events are queued until they're read, so the channel should be read
+// promptly.
+func (b *Bot) Events() <-chan interface{} {
+	return b.events
+}
+
+func (b *Bot) run() {
+	defer close(b.done)
+	defer close(b.events)
+
+	err := b.client.LoadUI()
+	if !b.running {
+		if b.err = err; b.err == nil {
+			b.err = errBotStopped
+		}
+		close(b.started)
+	}
+
+	if b.client.WriterChan != nil {
+		b.client.Save()
+	}
+	if b.client.WriterChan != nil {
+		close(b.client.WriterChan)
+		<-b.client.WriterDone
+	}
+	if b.client.FetchNowChan != nil {
+		close(b.client.FetchNowChan)
+	}
+	if b.client.StateLock != nil {
+		b.client.StateLock.Close()
+	}
+}
+
+// call runs f on the main goroutine and waits for it to return.
+func (b *Bot) call(f func() error) error {
+	result := make(chan error, 1)
+	select {
+	case b.calls <- func() { result <- f() }:
+	case <-b.done:
+		return errBotStopped
+	}
+	return <-result
+}
+
+// event queues an event to be sent on the events channel.
+func (b *Bot) event(e interface{}) {
+	b.pending = append(b.pending, e)
+}
+
+func botContact(contact *Contact) BotContact {
+	return BotContact{
+		ID:        contact.Id,
+		Name:      contact.Name,
+		Pending:   contact.IsPending,
+		RevokedUs: contact.RevokedUs,
+	}
+}
+
+// Contacts returns the bot's contacts.
+func (b *Bot) Contacts() (contacts []BotContact, err error) {
+	err = b.call(func() error {
+		for _, contact := range b.client.Contacts {
+			contacts = append(contacts, botContact(contact))
+		}
+		return nil
+	})
+	return
+}
+
+// NewContact adds a contact with the given name and starts a PANDA key
+// exchange with it. If sharedSecret is empty then a random one is generated.
+// It returns the contact, which is pending until a KeyExchangeComplete event,
+// and the shared secret, which must be given to the other party.
+func (b *Bot) NewContact(name, sharedSecret string) (contact BotContact, secret string, err error) {
+	err = b.call(func() error {
+		if len(name) == 0 {
+			return errors.New("bot: contact name is empty")
+		}
+		for _, contact := range b.client.Contacts {
+			if contact.Name == name {
+				return errors.New("bot: a contact with that name already exists")
+			}
+		}
+		if secret = sharedSecret; len(secret) == 0 {
+			secret = panda.NewSecretString(b.client.Rand)
+		} else if !panda.IsAcceptableSecretString(secret) {
+			return errors.New("bot: shared secret checksum is incorrect")
+		}
+		contact = botContact(b.client.StartPANDA(name, secret))
+		return nil
+	})
+	return
+}
+
+// send sends a message to the contact with the given id, in reply to the
+// message with id InReplyTo if non-zero, and returns the id of the message
+// in the outbox. It runs on the main goroutine.
+func (b *Bot) send(to uint64, body string, inReplyTo uint64) (uint64, error) {
+	contact, ok := b.client.Contacts[to]
+	if !ok {
+		return 0, errors.New("bot: no such contact")
+	}
+	if contact.IsPending {
+		return 0, errors.New("bot: cannot send message to pending contact")
+	}
+
+	draft := &Draft{
+		Id:        b.client.RandId(),
+		Created:   b.client.Now(),
+		Body:      body,
+		InReplyTo: inReplyTo,
+	}
+	draft.AddRecipient(to)
+	id, _, err := b.client.SendDraft(draft)
+	if err != nil {
+		return 0, err
+	}
+	b.client.DraftSent(draft)
+	b.client.Save()
+	return id, nil
+}
+
+// Send queues a message to the contact with the given id and returns the id
+// of the message in the outbox.
+func (b *Bot) Send(to uint64, body string) (id uint64, err error) {
+	err = b.call(func() (err error) {
+		id, err = b.send(to, body, 0)
+		return
+	})
+	return
+}
+
+// inboxMessage returns the decrypted inbox message from a contact that has
+// the given id. It runs on the main goroutine.
+func (b *Bot) inboxMessage(id uint64) (*InboxMessage, error) {
+	for _, msg := range b.client.Inbox {
+		if msg.Id != id {
+			continue
+		}
+		if msg.From == 0 {
+			return nil, errors.New("bot: message is a server announcement")
+		}
+		if msg.Message == nil {
+			return nil, errors.New("bot: message hasn't been decrypted")
+		}
+		return msg, nil
+	}
+	return nil, errors.New("bot: no such inbox message")
+}
+
+// Reply queues a reply to the inbox message with the given id, which
+// acknowledges it, and returns the id of the reply in the outbox.
+func (b *Bot) Reply(inboxID uint64, body string) (id uint64, err error) {
+	err = b.call(func() error {
+		msg, err := b.inboxMessage(inboxID)
+		if err != nil {
+			return err
+		}
+		id, err = b.send(msg.From, body, msg.Message.GetId())
+		return err
+	})
+	return
+}
+
+// Acknowledge sends an acknowledgement of the inbox message with the given
+// id.
+func (b *Bot) Acknowledge(inboxID uint64) error {
+	return b.call(func() error {
+		msg, err := b.inboxMessage(inboxID)
+		if err != nil {
+			return err
+		}
+		if msg.Acked {
+			return errors.New("bot: message has already been acknowledged")
+		}
+		msg.Acked = true
+		b.client.SendAck(msg)
+		b.client.Save()
+		return nil
+	})
+}
+
+// TransactNow starts a network transaction, which sends the next queued
+// message or fetches from the home server, without waiting for the timer.
+func (b *Bot) TransactNow() error {
+	return b.call(func() error {
+		if b.client.IsOffline() {
+			return ErrOffline
+		}
+		select {
+		case b.client.FetchNowChan <- nil:
+		default:
+		}
+		return nil
+	})
+}
+
+// botUI implements UI for a Bot. It's separate from Bot so that the callbacks
+// from the client aren't part of the Bot's API.
+type botUI struct {
+	*Bot
+}
+
+func (b botUI) InitUI() {
+}
+
+func (b botUI) LoadingUI() {
+}
+
+func (b botUI) TorPromptUI() error {
+	b.client.Log.Errorf("Cannot find Tor. Looking for a SOCKS proxy on port 9050 or 9150...")
+	for {
+		if err := b.SleepUI(1 * time.Second); err != nil {
+			return err
+		}
+		if b.client.DetectTor() {
+			return nil
+		}
+	}
+}
+
+func (b botUI) SleepUI(d time.Duration) error {
+	select {
+	case <-b.stop:
+		return errBotStopped
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (b botUI) ErrorUI(msg string, fatal bool) {
+	b.client.Log.Errorf("%s", msg)
+	if fatal {
+		b.err = errors.New("bot: " + msg)
+	}
+}
+
+func (b botUI) ShutdownAndSuspend() error {
+	if b.err != nil {
+		return b.err
+	}
+	return errBotStopped
+}
+
+func (b botUI) CreatePassphraseUI() (string, error) {
+	if len(b.Server) == 0 {
+		return "", errors.New("bot: state file doesn't exist and no server was given to create an account")
+	}
+	return b.Passphrase, nil
+}
+
+func (b botUI) CreateErasureStorage(pw string, stateFile *disk.StateFile) error {
+	// A bot can't ask whether to use a TPM so the state file is only
+	// protected by the passphrase.
+	return stateFile.Create(pw)
+}
+
+func (b botUI) CreateAccountUI(stateFile *disk.StateFile, pw string) (bool, error) {
+	b.client.Server = b.Server
+	updateMsg := func(msg string) {
+		b.client.Log.Printf("%s", msg)
+	}
+	return false, b.client.DoCreateAccount(updateMsg)
+}
+
+func (b botUI) KeyPromptUI(stateFile *disk.StateFile) error {
+	err := b.client.LoadState(stateFile, b.Passphrase)
+	if err == disk.BadPasswordError {
+		return errors.New("bot: incorrect passphrase")
+	}
+	return err
+}
+
+// received queues a MessageReceived event for msg unless it's an
+// acknowledgement.
+func (b *Bot) received(msg *InboxMessage) {
+	if len(msg.Message.Body) == 0 {
+		return
+	}
+	_, _, body := b.client.InboxStrings(msg)
+	b.event(MessageReceived{
+		ID:       msg.Id,
+		From:     msg.From,
+		FromName: b.client.ContactName(msg.From),
+		Body:     body,
+		Sent:     time.Unix(msg.Message.GetTime(), 0),
+	})
+}
+
+func (b botUI) ProcessFetch(msg *InboxMessage) {
+	// Messages that can't be decrypted yet are reported once the key
+	// exchange with their sender completes.
+	if msg.Message != nil {
+		b.received(msg)
+	}
+}
+
+func (b botUI) ProcessServerAnnounce(msg *InboxMessage) {
+}
+
+func (b botUI) ProcessAcknowledgement(msg *QueuedMessage) {
+	b.event(MessageAcknowledged{ID: msg.Id, To: msg.To})
+}
+
+func (b botUI) ProcessRevocationOfUs(by *Contact) {
+	b.event(ContactRevokedUs{botContact(by)})
+}
+
+func (b botUI) ProcessRevocation(by *Contact) {
+}
+
+// unsealPendingMessages is run once a key exchange with a contact has
+// completed and unseals any previously unreadable messages from that contact.
+func (b *Bot) unsealPendingMessages(contact *Contact) {
+	var needToFilter bool
+
+	for _, msg := range b.client.Inbox {
+		if msg.Message == nil && msg.From == contact.Id {
+			if !b.client.UnsealMessage(msg, contact) {
+				needToFilter = true
+				continue
+			}
+			if len(msg.Message.Body) == 0 {
+				needToFilter = true
+				continue
+			}
+			b.received(msg)
+		}
+	}
+
+	if needToFilter {
+		b.client.DropSealedAndAckMessagesFrom(contact)
+	}
+	b.client.HoldUnsealedParts(contact)
+}
+
+func (b botUI) ProcessPANDAUpdateUI(update PandaUpdate) {
+	contact := b.client.Contacts[update.Id]
+
+	switch {
+	case update.Err != nil:
+		b.event(KeyExchangeFailed{botContact(contact), update.Err})
+	case update.Result != nil:
+		b.unsealPendingMessages(contact)
+		b.event(KeyExchangeComplete{botContact(contact)})
+	}
+}
+
+func (b botUI) ProcessMessageDelivered(msg *QueuedMessage) {
+	if msg.Revocation || len(msg.Message.Body) == 0 {
+		return
+	}
+	b.event(MessageDelivered{ID: msg.Id, To: msg.To})
+}
+
+func (b botUI) ProcessMessageUndeliverable(msg *QueuedMessage) {
+	b.event(MessageUndeliverable{ID: msg.Id, To: msg.To})
+}
+
+func (b botUI) ProcessDraftSent(draft *Draft, id uint64, err error) {
+	// A bot's drafts have no attachments, so they're never waiting for
+	// uploads.
+}
+
+func (b botUI) RemoveInboxMessageUI(msg *InboxMessage) {
+}
+
+func (b botUI) RemoveOutboxMessageUI(msg *QueuedMessage) {
+}
+
+func (b botUI) AddRevocationMessageUI(msg *QueuedMessage) {
+}
+
+func (b botUI) RemoveContactUI(contact *Contact) {
+}
+
+func (b botUI) LogEventUI(contact *Contact, event Event) {
+}
+
+func (b botUI) MainUI() {
+	b.running = true
+	close(b.started)
+
+	for {
+		// The first pending event, if any, is offered on the events
+		// channel while other work continues.
+		var events chan interface{}
+		var next interface{}
+		if len(b.pending) > 0 {
+			events = b.events
+			next = b.pending[0]
+		}
+
+		select {
+		case events <- next:
+			b.pending = b.pending[1:]
+		case sigReq := <-b.client.SigningRequestChan:
+			b.client.ProcessSigningRequest(sigReq)
+		case f := <-b.calls:
+			f()
+		case newMessage := <-b.client.NewMessageChan:
+			b.client.ProcessNewMessage(newMessage)
+		case msr := <-b.client.MessageSentChan:
+			if msr.Id != 0 {
+				b.client.ProcessMessageSent(msr)
+			}
+		case update := <-b.client.PandaChan:
+			b.client.ProcessPANDAUpdate(update)
+		case event := <-b.client.BackgroundChan:
+			b.client.ProcessTransferEvent(event)
+		case <-b.client.Log.UpdateChan:
+		case <-b.client.TimerChan:
+			b.client.ProcessTimerTick(b.client.Now(), 0)
+		case <-b.stop:
+			return
+		}
+	}
+}
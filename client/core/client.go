@@ -0,0 +1,1946 @@
+// Package core contains the Pond client's state, contacts, messages, key
+// exchanges and network goroutine. The GUI, CLI and daemon interfaces of the
+// client command in the parent directory drive it by implementing UI. Other
+// programs can run a Pond identity with a Bot, which needs neither cgo nor any
+// build tags.
+package core
+
+// The Pond client consists of a number of goroutines:
+//
+// The initial goroutine handles GTK and sits in the GTK event loop most of the
+// time. It reads requests to change the UI from UI.Actions() and writes UI
+// events to UI.Events(). Since its sitting in a GTK mainloop, after writing to
+// UI.Actions(), UI.Signal() must be called which wakes up the UI goroutine and
+// triggers the processing of any pending requests.
+//
+// The "main" goroutine is started immediately and exclusively drives the UI.
+// The reason that the "main" goroutine isn't the initial goroutine is that, on
+// OS X, the system really likes the native UI calls to be made from the
+// initial thread.
+//
+// The main goroutine drives the startup process, loads state from disk etc.
+// During startup it interacts with the UI channels directly but once startup
+// has completed it sits in nextEvent(). The UI goroutine is callback based
+// because GTK is callback based, but the main goroutine has a synchronous
+// model. The nextEvent() call reads from a number of differnet channels,
+// including UI.Events() and either processes the event directly, returns the
+// event to the calling function, or returns and indicates that it's a global
+// event. Global events are basically clicks on the left-hand-side of the UI
+// which stop the current UI flow and start a different one.
+//
+// There are two utility goroutines with which the main goroutine communicates:
+//
+// The state writing goroutine is passed the serialised state for writing to
+// the disk every time c.save() is called. It avoids having disk or TPM latency
+// hang the main goroutine.
+//
+// The network goroutine handles sending and receiving messages. It shares a
+// locked queue with the main goroutine in the form of client.queue. Once
+// something has been added to the queue, the network goroutine owns it. This
+// is complex when it comes to handling revocations because that involves
+// resigning messages that have already been queued and thus part of the
+// handling has to happen on the network goroutine.
+//
+// Lastly there are two types of O(n) goroutines: detachment and PANDA
+// goroutines.
+//
+// Detachment goroutines handle the encryption/decryption and upload/download
+// of detactments. They feed their results back into nextEvent().
+//
+// PANDA goroutines handle shared-secret key exchanges. They spend most of
+// their time sleeping, waiting to poll the MeetingPlace. In tests, the mock
+// MeetingPlace can be gracefully shutdown but, in normal operation, these
+// goroutines are just killed. Their state is preserved because it's serialised
+// whenever they write a log message.
+//
+//
+// There are two flags that affect operation: dev and testing. Development mode
+// is triggered by an environment variable: POND=dev. It causes a number of
+// changes, including: servers are not contacted over Tor, fetches happen once
+// every 5 seconds and the default server is on localhost.
+//
+// In addition to dev mode, there's testing mode. (Testing mode implies dev.)
+// Testing mode is used by the unittests and generally changes things so that
+// the tests can fully synchonise and avoid non-determinism.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/agl/ed25519/extra25519"
+	"github.com/agl/pond/bbssig"
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/client/ratchet"
+	"github.com/agl/pond/panda"
+	pond "github.com/agl/pond/protos"
+	"github.com/agl/pond/transport"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	// MessageLifetime is the default amount of time for which we'll keep a
+	// message. (Counting from the time that it was received.)
+	MessageLifetime = 7 * 24 * time.Hour
+	// MessagePreIndicationLifetime is the amount of time that a message
+	// remains before the background color changes to indicate that it will
+	// be deleted soon.
+	MessagePreIndicationLifetime = 6 * 24 * time.Hour
+	// MessageGraceTime is the amount of time that we'll leave a message
+	// before deletion after it has been marked as not-retained, or after
+	// startup.
+	MessageGraceTime = 5 * time.Minute
+	// TimerInterval is the period of TimerChan.
+	TimerInterval = 60 * time.Second
+	// The current protocol version implemented by this code. Version two
+	// adds GZIP encoded message bodies and version three adds messages
+	// that are split into several parts.
+	ProtoVersion = 3
+)
+
+const (
+	ShortTimeFormat = "Jan _2 15:04"
+	LogTimeFormat   = "Jan _2 15:04:05"
+	KeyExchangePEM  = "POND KEY EXCHANGE"
+)
+
+// Client is the main structure containing most of the client's state.
+type Client struct {
+	// Testing is true in unittests and disables some assertions that are
+	// needed in the real world, but which make testing difficult.
+	Testing bool
+	// Dev is true if POND=dev is in the environment. Unittests also set this.
+	Dev bool
+	// AutoFetch controls whether the network goroutine performs periodic
+	// transactions or waits for outside prompting.
+	AutoFetch bool
+	// LocalOnly is true for one-shot commands that don't make network
+	// transactions. Pending PANDA key exchanges and detachment transfers
+	// aren't resumed when the state is loaded.
+	LocalOnly bool
+	// NewMeetingPlace is a function that returns a PANDA MeetingPlace. In
+	// tests this can be overridden to return a testing meeting place.
+	NewMeetingPlace func() panda.MeetingPlace
+
+	UI UI
+	// StateFilename is the filename of the file on disk in which we
+	// load/save our state.
+	StateFilename string
+	// StateLock protects the state against concurrent access by another
+	// program.
+	StateLock *disk.Lock
+	// NetworkLock protects network, burstRemaining, nextTransaction,
+	// syncRemaining, syncUploads, torAddress and IsolationTokens, which
+	// are used by the network goroutine.
+	NetworkLock sync.Mutex
+	// network contains the proxy configuration.
+	network NetworkConfig
+	// burstRemaining is the number of transactions that remain in the
+	// current burst. See policy.go.
+	burstRemaining int
+	// nextTransaction is the time of the next timed network transaction,
+	// or zero if none is pending.
+	nextTransaction time.Time
+	// syncRemaining is the number of transactions that remain in the
+	// current sync while offline. See offline.go.
+	syncRemaining int
+	// syncUploads is the number of uploads that were started by a sync
+	// while offline and haven't yet finished. See offline.go.
+	syncUploads int
+	// torAddress contains a string like "127.0.0.1:9050", which specifies
+	// the address of the local Tor SOCKS proxy.
+	torAddress string
+	// IsolationTokens contains the SOCKS credentials used to isolate
+	// connections to each server, for each purpose, from one another.
+	IsolationTokens map[isolationKey]*isolationToken
+
+	// Server is the URL of the user's home server.
+	Server string
+	// identity is a curve25519 private value that's used to authenticate
+	// the client to its home server.
+	identity, IdentityPublic [32]byte
+	// groupPriv is the group private key for the user's delivery group.
+	groupPriv *bbssig.PrivateKey
+	// prevGroupPrivs contains previous group private keys that have been
+	// revoked. This allows us to process messages that were inflight at
+	// the time of the revocation.
+	prevGroupPrivs []previousGroupPrivateKey
+	// Generation is the generation number of the group private key and is
+	// incremented when a member of the group is revoked.
+	Generation uint32
+	// priv is an Ed25519 private key.
+	priv [64]byte
+	// Pub is the public key corresponding to |priv|.
+	Pub  [32]byte
+	Rand io.Reader
+	// LastErasureStorageTime is the time at which we last rotated the
+	// erasure storage value.
+	LastErasureStorageTime time.Time
+	// WriterChan is a channel that the disk goroutine reads from to
+	// receive updated, serialised states.
+	WriterChan chan disk.NewState
+	// WriterDone is a channel that is closed by the disk goroutine when it
+	// has finished all pending updates.
+	WriterDone chan struct{}
+	// FetchNowChan is the channel that the network goroutine reads from
+	// that triggers an immediate network transaction. Mostly intended for
+	// testing.
+	FetchNowChan chan chan bool
+	// networkPolicyChan is poked when the network schedule changes so
+	// that the network goroutine recalculates the time of the next
+	// transaction.
+	networkPolicyChan chan bool
+
+	Log *Log
+
+	// Outbox contains all outgoing messages.
+	Outbox   []*QueuedMessage
+	Drafts   map[uint64]*Draft
+	Contacts map[uint64]*Contact
+	Inbox    []*InboxMessage
+	// HeldParts contains the parts of messages that are held until all the
+	// parts of each message have arrived.
+	HeldParts []*InboxMessage
+	// ContactGroups maps the names of contact groups to the ids of their
+	// members.
+	ContactGroups map[string][]uint64
+	// Transfers contains the uploads and downloads of detachments that
+	// are in progress.
+	Transfers []*Transfer
+	// SearchIndex indexes the inbox, outbox and drafts for searching. It's
+	// only ever held in memory.
+	SearchIndex *searchIndex
+
+	// Queue is a queue of messages for transmission that's shared with the
+	// network goroutine and protected by QueueMutex.
+	Queue      []*QueuedMessage
+	QueueMutex sync.Mutex
+	// Scheduled contains messages that will be moved into the queue by the
+	// network goroutine once their NotBefore time has passed. It's also
+	// protected by QueueMutex.
+	Scheduled []*QueuedMessage
+	// ServerFailures maps the servers that deliveries have failed to, and
+	// not since succeeded to, to the details of the failures. It's
+	// protected by QueueMutex. See backoff.go.
+	ServerFailures map[string]*serverFailure
+	// NewMessageChan receives messages that have been read from the home
+	// server by the network goroutine.
+	NewMessageChan chan NewMessage
+	// MessageSentChan receives the ids of messages that have been sent by
+	// the network goroutine.
+	MessageSentChan chan MessageSendResult
+	// BackgroundChan is used for signals from background processes - e.g.
+	// detachment uploads.
+	BackgroundChan chan interface{}
+	// PandaChan receives messages from goroutines in runPANDA about
+	// changes to PANDA key exchange state.
+	PandaChan chan PandaUpdate
+	// PandaWaitGroup is incremented for each running PANDA goroutine.
+	PandaWaitGroup sync.WaitGroup
+	// SigningRequestChan receives requests to sign messages for delivery,
+	// just before they are sent to the destination server.
+	SigningRequestChan chan SigningRequest
+
+	// UsedIds records ID numbers that have been assigned in the current
+	// state file.
+	UsedIds map[uint64]bool
+
+	// TimerChan fires every TimerInterval so that messages can be erased.
+	TimerChan <-chan time.Time
+	// NowFunc is a function that, if not nil, will be used by the GUI to
+	// get the current time. This is used in testing.
+	NowFunc func() time.Time
+
+	// SimulateOldClient causes the client to act like a pre-ratchet client
+	// for testing purposes.
+	SimulateOldClient bool
+
+	// DisableV2Ratchet causes the client to advertise and process V1
+	// axolotl ratchet support.
+	DisableV2Ratchet bool
+
+	// CarrierTLSConfig, if not nil, is used to verify the certificates of
+	// wss:// carriers. This is used in testing.
+	CarrierTLSConfig *tls.Config
+
+	// receiveHookCommand is command to run upon receiving a message if
+	// no hook has been configured for that event. It's taken from the
+	// POND_HOOK_RECEIVE environment variable.
+	receiveHookCommand string
+	// Hooks maps the names of events to the commands that are run when
+	// they occur.
+	Hooks map[string]*hook
+
+	// CoverMember is the group member key that cover messages are signed
+	// with, and coverGeneration is the group generation that it belongs
+	// to. It's only held in memory, and only used on the main goroutine,
+	// and is replaced when the generation changes.
+	CoverMember     *bbssig.MemberKey
+	coverGeneration uint32
+
+	// TicketsLock protects tickets and ticketKeyPins.
+	TicketsLock sync.Mutex
+	// Tickets contains session resumption tickets, oldest first, keyed by
+	// server URL. They are only held in memory and each is used at most
+	// once.
+	Tickets map[string][]*transport.Ticket
+	// ticketKeyPins contains the ticket keys that each server, keyed by
+	// URL, has presented on anonymous connections.
+	ticketKeyPins map[string]*transport.TicketKeyPins
+}
+
+// UI abstracts behaviour that is specific to a given interface (GUI or CLI).
+// Generic code can call these functions to perform interface-specific
+// behaviour.
+type UI interface {
+	InitUI()
+	// LoadingUI shows a basic "loading" prompt while the state file is read.
+	LoadingUI()
+	// TorPromptUI prompts the user to start Tor.
+	TorPromptUI() error
+	// SleepUI waits the given amount of time or never returns if the user
+	// closes the UI.
+	SleepUI(d time.Duration) error
+	// ErrorUI shows an error and returns.
+	ErrorUI(msg string, fatal bool)
+	// ShutdownAndSuspend quits the program - possibly waiting for the user
+	// to close the window in the case of a GUI so any error message can be
+	// read first.
+	ShutdownAndSuspend() error
+	CreatePassphraseUI() (string, error)
+	CreateErasureStorage(pw string, stateFile *disk.StateFile) error
+	// CreateAccountUI allows the user to either create a new account or to
+	// import from a entombed statefile. It returns whether an import
+	// occured and an error.
+	CreateAccountUI(stateFile *disk.StateFile, pw string) (bool, error)
+	KeyPromptUI(stateFile *disk.StateFile) error
+	ProcessFetch(msg *InboxMessage)
+	ProcessServerAnnounce(announce *InboxMessage)
+	ProcessAcknowledgement(ackedMsg *QueuedMessage)
+	// ProcessRevocationOfUs is called when a revocation is received that
+	// revokes our group key for a contact.
+	ProcessRevocationOfUs(by *Contact)
+	// ProcessRevocation is called when we have finished processing a
+	// revocation. This includes revocations of others and of this
+	// ourselves. In the latter case, this is called after
+	// ProcessRevocationOfUs.
+	ProcessRevocation(by *Contact)
+	// ProcessMessageSent is called when an outbox message has been
+	// delivered to the destination server.
+	ProcessMessageDelivered(msg *QueuedMessage)
+	// ProcessMessageUndeliverable is called when an outbox message is
+	// flagged as undeliverable because its server keeps failing.
+	ProcessMessageUndeliverable(msg *QueuedMessage)
+	// ProcessPANDAUpdateUI is called on each PANDA update to update the
+	// UI and unseal pending messages.
+	ProcessPANDAUpdateUI(update PandaUpdate)
+	// ProcessDraftSent is called when a draft that was waiting for its
+	// uploads to finish has been sent, in which case id is the id of the
+	// first copy in the outbox, or when it couldn't be sent.
+	ProcessDraftSent(draft *Draft, id uint64, err error)
+	// RemoveInboxMessageUI removes a message from the inbox UI.
+	RemoveInboxMessageUI(msg *InboxMessage)
+	// RemoveOutboxMessageUI removes a message from the outbox UI.
+	RemoveOutboxMessageUI(msg *QueuedMessage)
+	// AddRevocationMessageUI notifies the UI that a new revocation message
+	// has been created.
+	AddRevocationMessageUI(msg *QueuedMessage)
+	// RemoveContactUI removes a contact from the UI.
+	RemoveContactUI(contact *Contact)
+	// LogEventUI is called when an exceptional event has been logged for
+	// the given contact.
+	LogEventUI(contact *Contact, event Event)
+	// MainUI starts the main interface.
+	MainUI()
+}
+
+type MessageSendResult struct {
+	// If the id is zero then a message wasn't actually sent - this is just
+	// the transact goroutine poking the UI because the queue has been
+	// updated.
+	Id uint64
+	// revocation optionally contains a revocation update that resulted
+	// from attempting to send a message.
+	revocation *pond.SignedRevocation
+	// extraRevocations optionally contains revocations further to
+	// |revocation|. This is only non-empty if |revocation| is non-nil.
+	extraRevocations []*pond.SignedRevocation
+	// failure, if not nil, describes why the message couldn't be
+	// delivered this time.
+	failure *serverFailure
+}
+
+// SigningRequest is a structure that is sent from the network thread to the
+// main thread to request that a message be signed with a group signature for
+// delivery.
+type SigningRequest struct {
+	msg        *QueuedMessage
+	resultChan chan *pond.Request
+}
+
+// PendingDecryption represents a detachment decryption/download operation
+// that's in progress. These are not saved to disk.
+type PendingDecryption struct {
+	// Index is used by the UI code and indexes the list of detachments in
+	// a message.
+	Index int
+	// Cancel is a thunk that causes the task to be canceled at some point
+	// in the future.
+	Cancel func()
+}
+
+// CliId represents a short, unique ID that is assigned by the command-line
+// interface so that users can select an object by typing a short sequence of
+// letters and digits. The value is 15 bits long and represented as a string in
+// z-base-32.
+type CliId uint
+
+const InvalidCliId CliId = 0
+
+// See http://philzimmermann.com/docs/human-oriented-base-32-encoding.txt
+const zBase32Chars = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+func (id CliId) String() string {
+	var chars [3]byte
+
+	for i := range chars {
+		chars[i] = zBase32Chars[id&31]
+		id >>= 5
+	}
+
+	return string(chars[:])
+}
+
+func CliIdFromString(s string) (id CliId, ok bool) {
+	if len(s) != 3 {
+		return
+	}
+
+	var shift uint
+
+NextChar:
+	for _, r := range s {
+		for i, r2 := range zBase32Chars {
+			if r == r2 {
+				id |= CliId(i) << shift
+				shift += 5
+				continue NextChar
+			}
+		}
+
+		return
+	}
+
+	ok = true
+	return
+}
+
+// InboxMessage represents a message in the client's inbox. (Acks also appear
+// as InboxMessages, but their message.Body is empty.)
+type InboxMessage struct {
+	Id           uint64
+	Read         bool
+	ReceivedTime time.Time
+	From         uint64
+	// Sealed contained the encrypted message if the contact who sent this
+	// message is still pending.
+	Sealed []byte
+	Acked  bool
+	// Message may be nil if the contact who sent this is pending. In this
+	// case, sealed with contain the encrypted message.
+	Message *pond.Message
+	// CliId is a number, assigned by the command-line interface, to
+	// identity this message for the duration of the session. It's not
+	// saved to disk.
+	CliId CliId
+	// Retained is true if the user has chosen to retain this message -
+	// i.e. to opt it out of the usual, time-based, auto-deletion.
+	Retained bool
+	// ReadTime is the time at which the message was first read. It's used
+	// by retention policies that erase messages some time after reading.
+	ReadTime time.Time
+	// ExposureTime contains the time when the message was last "exposed".
+	// This is used to allow a small period of time for the user to mark a
+	// message as retained (MessageGraceTime). For example, if a message is
+	// loaded at startup and has expired then it's a candidate for
+	// deletion, but the ExposureTime will be the startup time, which
+	// ensures that we leave it a few minutes before deletion. Setting
+	// retained to false also resets the ExposureTime.
+	ExposureTime time.Time
+	// eraseSoonHookRun is true if the hook for messages that will be
+	// erased soon has been run for this message. It's not saved to disk.
+	eraseSoonHookRun bool
+	// PartIds contains the ids of the further parts of a message that was
+	// reassembled from several parts. They're acknowledged along with
+	// the message.
+	PartIds []uint64
+
+	Decryptions map[uint64]*PendingDecryption
+}
+
+func (c *Client) InboxStrings(msg *InboxMessage) (sentTime, eraseTime, body string) {
+	isPending := msg.Message == nil
+	if isPending {
+		body = "(cannot display message as key exchange is still pending)"
+		sentTime = "(unknown)"
+	} else {
+		sentTime = time.Unix(*msg.Message.Time, 0).Format(time.RFC1123)
+		body = "(cannot display message as encoding is not supported)"
+		if msg.Message.BodyEncoding != nil {
+			switch *msg.Message.BodyEncoding {
+			case pond.Message_RAW:
+				body = string(msg.Message.Body)
+			}
+		}
+	}
+	eraseTime = c.inboxEraseTimeString(msg)
+	return
+}
+
+// NewMessage is sent from the network goroutine to the client goroutine and
+// contains messages fetched from the home server.
+type NewMessage struct {
+	fetched  *pond.Fetched
+	announce *pond.ServerAnnounce
+	ack      chan bool
+}
+
+// Contact represents a contact to which we can send messages.
+type Contact struct {
+	// Id is only locally valid.
+	Id uint64
+	// Name is the friendly name that the user chose for this contact. It
+	// is unique for all contacts.
+	Name string
+	// IsPending is true if we haven't received a key exchange message from
+	// this contact.
+	IsPending bool
+	// KxsBytes is the serialised key exchange message that we generated
+	// for this contact. (Only valid if |IsPending| is true.)
+	KxsBytes []byte
+	// groupKey is the group member key that we gave to this contact.
+	// myGroupKey is the one that they gave to us.
+	groupKey, myGroupKey *bbssig.MemberKey
+	// previousTags contains bbssig tags that were previously used by this
+	// contact. The tag of a contact changes when a recovation is
+	// processed, but old messages may still be queued.
+	previousTags []previousTag
+	// Generation is the current group generation number that we know for
+	// this contact.
+	Generation uint32
+	// TheirServer is the URL of the contact's home server.
+	TheirServer string
+	// TheirPub is their Ed25519 public key.
+	TheirPub [32]byte
+	// TheirIdentityPublic is the public identity that their home server
+	// knows them by.
+	TheirIdentityPublic [32]byte
+	// SupportedVersion contains the greatest protocol version number that
+	// we have observed from this contact.
+	SupportedVersion int32
+	// Revoked is true if this contact has been revoked.
+	Revoked bool
+	// RevokedUs is true if this contact has revoked us.
+	RevokedUs bool
+	// PandaKeyExchange contains the serialised PANDA state if a key
+	// exchange is ongoing.
+	PandaKeyExchange []byte
+	// PandaShutdownChan is a channel that can be closed to trigger the
+	// shutdown of an individual PANDA exchange.
+	PandaShutdownChan chan struct{}
+	// pandaDone is written to and closed by the most recently started
+	// PANDA goroutine for this contact when it exits. If the goroutine was
+	// shut down, it first writes the exchange's final state so that a
+	// goroutine started in its place can continue from it.
+	pandaDone chan []byte
+	// PandaResult contains an error message in the event that a PANDA key
+	// exchange failed.
+	PandaResult string
+	// Events contains a log of important events relating to this contact.
+	Events []Event
+	// InboxRetention and OutboxRetention control how long messages from,
+	// and to, this contact are kept.
+	InboxRetention, OutboxRetention RetentionPolicy
+
+	// Members for the old ratchet.
+	lastDHPrivate        [32]byte
+	CurrentDHPrivate     [32]byte
+	TheirLastDHPublic    [32]byte
+	TheirCurrentDHPublic [32]byte
+
+	// New ratchet support.
+	ratchet *ratchet.Ratchet
+
+	CliId CliId
+}
+
+// Event represents a log entry. This does not apply to the global log, which
+// is quite chatty, but rather to significant events related to a given
+// contact. These events are surfaced in the UI and recorded in the statefile.
+type Event struct {
+	T   time.Time
+	Msg string
+}
+
+// contactList is a sortable slice of Contacts.
+type contactList []*Contact
+
+func (cl contactList) Len() int {
+	return len(cl)
+}
+
+func (cl contactList) Less(i, j int) bool {
+	return cl[i].Name < cl[j].Name
+}
+
+func (cl contactList) Swap(i, j int) {
+	cl[i], cl[j] = cl[j], cl[i]
+}
+
+func (c *Client) ContactsSorted() []*Contact {
+	contacts := contactList(make([]*Contact, 0, len(c.Contacts)))
+	for _, contact := range c.Contacts {
+		contacts = append(contacts, contact)
+	}
+	sort.Sort(contacts)
+	return contacts
+}
+
+// previousTagLifetime contains the amount of time that we'll store a previous
+// tag (or previous group private key) for.
+const previousTagLifetime = 14 * 24 * time.Hour
+
+// previousTag represents a group signature tag that was previously assigned to
+// a contact. In the event of a revocation, all the tags change but we need to
+// know the previous tags for a certain amount of time because messages may
+// have been created before the contact saw the revocation update.
+type previousTag struct {
+	tag []byte
+	// expired contains the time at which this tag was expired - i.e. the
+	// timestamp when the revocation occured.
+	expired time.Time
+}
+
+// previousGroupPrivateKey represents a group private key that has been
+// revoked. These are retained for the same reason as previous tags.
+type previousGroupPrivateKey struct {
+	priv *bbssig.PrivateKey
+	// expired contains the time at which this tag was expired - i.e. the
+	// timestamp when the revocation occured.
+	expired time.Time
+}
+
+// PendingDetachment represents a detachment conversion/upload operation that's
+// in progress. These are not saved to disk.
+type PendingDetachment struct {
+	Size   int64
+	Path   string
+	Cancel func()
+}
+
+type Draft struct {
+	Id      uint64
+	Created time.Time
+	To      uint64
+	// AlsoTo contains any further recipients of the draft. Each recipient
+	// is sent a separate copy of the message.
+	AlsoTo      []uint64
+	Body        string
+	InReplyTo   uint64
+	Attachments []*pond.Message_Attachment
+	Detachments []*pond.Message_Detachment
+	// Expiry, if non-zero, is the lifetime that recipients are asked to
+	// limit the message to.
+	Expiry time.Duration
+	// SendAfter, if not zero, is the time before which the message won't
+	// be transmitted once sent.
+	SendAfter time.Time
+	// SendDelay, if non-zero, causes transmission to be delayed by a
+	// random amount of time, up to SendDelay, after SendAfter or the time
+	// at which the message was sent.
+	SendDelay time.Duration
+	// SendWhenUploaded is true if the draft is to be sent once its uploads
+	// have finished.
+	SendWhenUploaded bool
+	// CliId is a number, assigned by the command-line interface, to
+	// identity this message for the duration of the session. It's not
+	// saved to disk.
+	CliId CliId
+
+	// PendingDetachments is only used by the GTK UI.
+	PendingDetachments map[uint64]*PendingDetachment
+}
+
+// prettyNumber formats n in base 10 and puts commas between groups of
+// thousands.
+func prettyNumber(n uint64) string {
+	s := strconv.FormatUint(n, 10)
+	ret := make([]rune, 0, len(s)*2)
+
+	phase := len(s) % 3
+	for i, r := range s {
+		if phase == 0 && i > 0 {
+			ret = append(ret, ',')
+		}
+		ret = append(ret, r)
+		phase--
+		if phase < 0 {
+			phase += 3
+		}
+	}
+
+	return string(ret)
+}
+
+// candidateMessage returns a message that's at least as large, when
+// serialised, as any copy of draft that will be transmitted.
+func (c *Client) candidateMessage(draft *Draft) *pond.Message {
+	var replyToId *uint64
+	var alsoAck []uint64
+	if draft.InReplyTo != 0 {
+		replyToId = proto.Uint64(1)
+		alsoAck = c.replyAcks(draft)
+	}
+	var dhPub [32]byte
+
+	msg := &pond.Message{
+		Id:               proto.Uint64(0),
+		Time:             proto.Int64(1 << 62),
+		Body:             []byte(draft.Body),
+		BodyEncoding:     pond.Message_RAW.Enum(),
+		InReplyTo:        replyToId,
+		AlsoAck:          alsoAck,
+		MyNextDh:         dhPub[:],
+		Files:            draft.Attachments,
+		DetachedFiles:    draft.Detachments,
+		SupportedVersion: proto.Int32(ProtoVersion),
+	}
+	if draft.Expiry != 0 {
+		msg.Expiry = proto.Int64(int64(draft.Expiry / time.Second))
+	}
+	return msg
+}
+
+// draftSize returns the size of a draft as it would be transmitted, and
+// whether its body would be compressed, which happens if all the recipients
+// support that.
+func (c *Client) draftSize(draft *Draft) (int, bool) {
+	msg := c.candidateMessage(draft)
+
+	compressed := false
+	if recipients := draft.Recipients(); len(recipients) > 0 {
+		compressed = true
+		for _, id := range recipients {
+			if to, ok := c.Contacts[id]; !ok || to.SupportedVersion < GzipVersion {
+				compressed = false
+			}
+		}
+	}
+	if compressed {
+		msg = compressMessage(msg)
+		compressed = msg.GetBodyEncoding() == pond.Message_GZIP
+	}
+
+	serialized, err := proto.Marshal(msg)
+	if err != nil {
+		panic("error while serialising candidate Message: " + err.Error())
+	}
+	return len(serialized), compressed
+}
+
+// UsageString describes the size of a draft, as it would be transmitted,
+// relative to the maximum and returns true if it's too large to send. A draft
+// with a long body isn't too large if it can be split into parts, and one
+// that's only too large because of its attachments isn't too large because
+// they'll be uploaded when it's sent.
+func (c *Client) UsageString(draft *Draft) (string, bool) {
+	size, compressed := c.draftSize(draft)
+
+	s := fmt.Sprintf("%s of %s bytes", prettyNumber(uint64(size)), prettyNumber(pond.MaxSerializedMessage))
+	if compressed {
+		s += " (compressed)"
+	}
+	if size <= pond.MaxSerializedMessage {
+		return s, false
+	}
+	if bodies, err := c.splitBody(draft); err == nil {
+		return s + fmt.Sprintf(", sent in %d parts", len(bodies)), false
+	}
+	if len(draft.Attachments) > 0 && c.fitsWithAttachmentsDetached(draft) {
+		return s + ", attachments will be uploaded", false
+	}
+	return s, true
+}
+
+type QueuedMessage struct {
+	request    *pond.Request
+	Id         uint64
+	To         uint64
+	Server     string
+	Created    time.Time
+	Sent       time.Time
+	Acked      time.Time
+	Revocation bool
+	Message    *pond.Message
+	// FanoutId is non-zero for copies of a message that was sent to
+	// several contacts and is the same for all of the copies.
+	FanoutId uint64
+	// NotBefore, if not zero, is the time before which the message is held
+	// in the scheduled list rather than the queue.
+	NotBefore time.Time
+	// Parts, if not empty, contains the parts that a long message was
+	// split into. In that case the message itself is never transmitted
+	// and its sent and acked times are those of the last part.
+	Parts []*QueuedMessage
+	// cover is true if this is a cover delivery to our own account. Such
+	// messages are never in the queue or outbox.
+	cover bool
+	// Undeliverable is true if the message's server has been failing for
+	// longer than the configured period. Delivery is still attempted.
+	Undeliverable bool
+
+	// sending is true if the transact goroutine is currently sending this
+	// message. This is protected by the QueueMutex.
+	sending bool
+
+	// CliId is a number, assigned by the command-line interface, to
+	// identity this message for the duration of the session. It's not
+	// saved to disk.
+	CliId CliId
+}
+
+func (qm *QueuedMessage) Indicator(contact *Contact) Indicator {
+	switch {
+	case !qm.Acked.IsZero():
+		return IndicatorGreen
+	case !qm.Sent.IsZero():
+		if qm.Revocation {
+			// Revocations are never acked so they are green as
+			// soon as they are sent.
+			return IndicatorGreen
+		}
+		return IndicatorYellow
+	case contact != nil && contact.RevokedUs:
+		return IndicatorBlack
+	case qm.Undeliverable:
+		return IndicatorBlack
+	}
+	return IndicatorRed
+}
+
+// OutboxToDraft converts an outbox message back to a Draft. This is used when
+// the user aborts the sending of a message.
+func (c *Client) OutboxToDraft(msg *QueuedMessage) *Draft {
+	draft := &Draft{
+		Id:          msg.Id,
+		Created:     msg.Created,
+		To:          msg.To,
+		Body:        string(msg.Message.Body),
+		Attachments: msg.Message.Files,
+		Detachments: msg.Message.DetachedFiles,
+		Expiry:      time.Duration(msg.Message.GetExpiry()) * time.Second,
+	}
+	// The time that was picked for the message is kept so that the user
+	// can adjust it.
+	if msg.NotBefore.After(c.Now()) {
+		draft.SendAfter = msg.NotBefore
+	}
+
+	if irt := msg.Message.GetInReplyTo(); irt != 0 {
+		// The InReplyTo value of a draft references *our* id for the
+		// inbox message. But the InReplyTo field of a pond.Message
+		// references's the contact's id for the message. So we need to
+		// enumerate the messages in the inbox from that contact and
+		// find the one with the matching id.
+		for _, inboxMsg := range c.Inbox {
+			if inboxMsg.From == msg.To && inboxMsg.Message != nil && inboxMsg.Message.GetId() == irt {
+				draft.InReplyTo = inboxMsg.Id
+				break
+			}
+		}
+	}
+
+	return draft
+}
+
+func (c *Client) ContactName(id uint64) string {
+	if id == 0 {
+		return "Home Server"
+	}
+	return c.Contacts[id].Name
+}
+
+// defaultTorAddress is the address of the Tor SOCKS proxy that is assumed if
+// none can be found.
+const defaultTorAddress = "127.0.0.1:9050"
+
+// DetectTor sets c.torAddress, either from the POND_TOR_ADDRESS environment
+// variable if it is set or by attempting to connect to port 9050 and 9150 on
+// the local host and assuming that Tor is running on the first port that it
+// finds to be open.
+func (c *Client) DetectTor() bool {
+	addr, ok := c.findTor()
+
+	c.NetworkLock.Lock()
+	c.torAddress = addr
+	c.NetworkLock.Unlock()
+
+	return ok
+}
+
+func (c *Client) findTor() (string, bool) {
+	if addr := os.Getenv("POND_TOR_ADDRESS"); len(addr) != 0 {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			c.Log.Printf("Ignoring POND_TOR_ADDRESS because of parse error: %s", err)
+		} else {
+			c.Log.Printf("Using POND_TOR_ADDRESS=%s", addr)
+			return addr, true
+		}
+	}
+
+	ports := []int{9050, 9150}
+	for _, port := range ports {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		return addr, true
+	}
+
+	return defaultTorAddress, false
+}
+
+// pandaMeetingPlaceURL is the URL of the default PANDA meeting place.
+const pandaMeetingPlaceURL = "https://panda-key-exchange.appspot.com/exchange"
+
+var KnownServers = []struct {
+	Nickname    string
+	Description string
+	Uri         string
+}{
+	{"wau", "Wau Holland Foundation", "pondserver://25WHHEVD3565FGIOXJZWV7LGQFR4BTO3HF3FWHEW7PCYPFMFPVOQ@vx652n4utsodj5c6.onion"},
+	{"hoi", "Hoi Polloi (https://hoi-polloi.org)", "pondserver://4V6Q5M2AFLBW6UIYL2B5LMKDHEBA6HRHR6UIUU3VDQFNI3BHZAEQ@oum7argqrnlzpcro.onion"},
+}
+
+func (c *Client) enqueue(m *QueuedMessage) {
+	c.QueueMutex.Lock()
+	defer c.QueueMutex.Unlock()
+
+	c.Queue = append(c.Queue, m)
+}
+
+func MaybeTruncate(s string) string {
+	if runes := []rune(s); len(runes) > 30 {
+		runes = runes[:30]
+		runes = append(runes, 0x2026 /* ellipsis */)
+		return string(runes)
+	}
+	return s
+}
+
+func FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return "(not yet)"
+	}
+	return t.Format(time.RFC1123)
+}
+
+var ErrInterrupted = errors.New("cli: interrupt signal")
+
+func (c *Client) LoadUI() error {
+	c.UI.InitUI()
+
+	c.receiveHookCommand = os.Getenv("POND_HOOK_RECEIVE")
+
+	c.UI.LoadingUI()
+
+	stateFile := &disk.StateFile{
+		Path: c.StateFilename,
+		Rand: c.Rand,
+		Log: func(format string, args ...interface{}) {
+			c.Log.Printf(format, args...)
+		},
+	}
+
+	var newAccount, imported bool
+	var err error
+	if c.StateLock, err = stateFile.Lock(false /* don't create */); err == nil && c.StateLock == nil {
+		c.UI.ErrorUI("State file locked by another process. Waiting for lock.", false)
+		c.Log.Errorf("Waiting for locked state file")
+
+		for {
+			if c.StateLock, err = stateFile.Lock(false /* don't create */); c.StateLock != nil {
+				break
+			}
+			if err := c.UI.SleepUI(1 * time.Second); err != nil {
+				return err
+			}
+		}
+	} else if err == nil {
+	} else if os.IsNotExist(err) {
+		newAccount = true
+	} else {
+		c.UI.ErrorUI(err.Error(), true)
+		if err := c.UI.ShutdownAndSuspend(); err != nil {
+			return err
+		}
+	}
+
+	if newAccount {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		copy(c.priv[:], priv[:])
+		copy(c.Pub[:], pub[:])
+
+		if c.DisableV2Ratchet {
+			c.RandBytes(c.identity[:])
+		} else {
+			extra25519.PrivateKeyToCurve25519(&c.identity, priv)
+		}
+		curve25519.ScalarBaseMult(&c.IdentityPublic, &c.identity)
+
+		c.groupPriv, err = bbssig.GenerateGroup(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		pw, err := c.UI.CreatePassphraseUI()
+		if err != nil {
+			return err
+		}
+		c.UI.CreateErasureStorage(pw, stateFile)
+		c.loadProxyFromEnvironment()
+		if err := c.waitForTor(); err != nil {
+			return err
+		}
+		imported, err = c.UI.CreateAccountUI(stateFile, pw)
+		if err != nil {
+			return err
+		}
+	} else {
+		// First try with zero key.
+		err := c.LoadState(stateFile, "")
+		for err == disk.BadPasswordError {
+			// That didn't work, try prompting for a key.
+			err = c.UI.KeyPromptUI(stateFile)
+		}
+		if err == ErrInterrupted {
+			return err
+		}
+		if err != nil {
+			// Fatal error loading state. Abort.
+			c.UI.ErrorUI(err.Error(), true)
+			if err := c.UI.ShutdownAndSuspend(); err != nil {
+				return err
+			}
+		}
+		c.loadOfflineFromEnvironment()
+		if err := c.waitForTor(); err != nil {
+			return err
+		}
+	}
+
+	if newAccount && !imported {
+		c.StateLock, err = stateFile.Lock(true /* create */)
+		if err != nil {
+			err = errors.New("Failed to create state file: " + err.Error())
+		} else if c.StateLock == nil {
+			err = errors.New("Failed to obtain lock on created state file")
+		}
+		if err != nil {
+			c.UI.ErrorUI(err.Error(), true)
+			if err := c.UI.ShutdownAndSuspend(); err != nil {
+				return err
+			}
+		}
+		c.LastErasureStorageTime = time.Now()
+	}
+
+	c.WriterChan = make(chan disk.NewState)
+	c.WriterDone = make(chan struct{})
+	c.FetchNowChan = make(chan chan bool, 1)
+	c.networkPolicyChan = make(chan bool, 1)
+
+	// Start disk and network workers.
+	go stateFile.StartWriter(c.WriterChan, c.WriterDone)
+	go c.transact()
+	if newAccount {
+		c.Save()
+	}
+
+	if !c.LocalOnly {
+		c.resumeTransfers()
+
+		// Start any pending key exchanges.
+		for _, contact := range c.Contacts {
+			if len(contact.PandaKeyExchange) == 0 {
+				continue
+			}
+			c.ResumePANDA(contact)
+		}
+	}
+
+	c.UI.MainUI()
+
+	return nil
+}
+
+func (contact *Contact) Subline() string {
+	switch {
+	case contact.RevokedUs:
+		return "has revoked"
+	case contact.IsPending:
+		return "pending"
+	case len(contact.PandaResult) > 0:
+		return "failed"
+	case !contact.IsPending && contact.ratchet == nil:
+		return "old ratchet"
+	}
+	return ""
+}
+
+func (contact *Contact) Indicator() Indicator {
+	switch {
+	case contact.RevokedUs:
+		return IndicatorBlack
+	case contact.IsPending:
+		return IndicatorYellow
+	}
+	return IndicatorNone
+}
+
+func (contact *Contact) ProcessKeyExchange(kxsBytes []byte, allowClearnet func(server string) bool, simulateOldClient, disableV2Ratchet bool) error {
+	var kxs pond.SignedKeyExchange
+	if err := proto.Unmarshal(kxsBytes, &kxs); err != nil {
+		return err
+	}
+
+	var sig [64]byte
+	if len(kxs.Signature) != len(sig) {
+		return errors.New("invalid signature length")
+	}
+	copy(sig[:], kxs.Signature)
+
+	var kx pond.KeyExchange
+	if err := proto.Unmarshal(kxs.Signed, &kx); err != nil {
+		return err
+	}
+
+	if len(kx.PublicKey) != len(contact.TheirPub) {
+		return errors.New("invalid public key")
+	}
+	copy(contact.TheirPub[:], kx.PublicKey)
+
+	if !ed25519.Verify(&contact.TheirPub, kxs.Signed, &sig) {
+		return errors.New("invalid signature")
+	}
+
+	contact.TheirServer = *kx.Server
+	if _, _, err := ParseServer(contact.TheirServer, allowClearnet(contact.TheirServer)); err != nil {
+		return err
+	}
+
+	group, ok := new(bbssig.Group).Unmarshal(kx.Group)
+	if !ok {
+		return errors.New("invalid group")
+	}
+	if contact.myGroupKey, ok = new(bbssig.MemberKey).Unmarshal(group, kx.GroupKey); !ok {
+		return errors.New("invalid group key")
+	}
+
+	if len(kx.IdentityPublic) != len(contact.TheirIdentityPublic) {
+		return errors.New("invalid public identity")
+	}
+	copy(contact.TheirIdentityPublic[:], kx.IdentityPublic)
+
+	if simulateOldClient {
+		kx.Dh1 = nil
+	}
+
+	if len(kx.Dh1) == 0 {
+		// They are using an old-style ratchet. We have to extract the
+		// private value from the Ratchet in order to use it with the
+		// old code.
+		contact.lastDHPrivate = contact.ratchet.GetKXPrivateForTransition()
+		if len(kx.Dh) != len(contact.TheirCurrentDHPublic) {
+			return errors.New("invalid public DH value")
+		}
+		copy(contact.TheirCurrentDHPublic[:], kx.Dh)
+		contact.ratchet = nil
+	} else {
+		// If the identity and ed25519 public keys are the same (modulo
+		// isomorphism) then the contact is using the v2 ratchet.
+		var ed25519Public, curve25519Public [32]byte
+		copy(ed25519Public[:], kx.PublicKey)
+		extra25519.PublicKeyToCurve25519(&curve25519Public, &ed25519Public)
+		v2 := !disableV2Ratchet && bytes.Equal(curve25519Public[:], kx.IdentityPublic[:])
+		if err := contact.ratchet.CompleteKeyExchange(&kx, v2); err != nil {
+			return err
+		}
+	}
+
+	contact.Generation = *kx.Generation
+
+	return nil
+}
+
+// logEvent records an exceptional event relating to the given contact.
+func (c *Client) logEvent(contact *Contact, msg string) {
+	event := Event{
+		T:   time.Now(),
+		Msg: msg,
+	}
+	contact.Events = append(contact.Events, event)
+	c.Log.Errorf("While processing message from %s: %s", contact.Name, msg)
+	c.UI.LogEventUI(contact, event)
+}
+
+func (c *Client) RandBytes(buf []byte) {
+	if _, err := io.ReadFull(c.Rand, buf); err != nil {
+		panic(err)
+	}
+}
+
+func (c *Client) RandId() uint64 {
+	var idBytes [8]byte
+	for {
+		c.RandBytes(idBytes[:])
+		n := binary.LittleEndian.Uint64(idBytes[:])
+		if n == 0 {
+			continue
+		}
+		if c.UsedIds[n] {
+			continue
+		}
+		c.UsedIds[n] = true
+		return n
+	}
+	panic("unreachable")
+}
+
+// Now is a wrapper around time.Now() that allows unittests to override the
+// current time.
+func (c *Client) Now() time.Time {
+	if c.NowFunc == nil {
+		return time.Now()
+	}
+	return c.NowFunc()
+}
+
+// registerId records that an ID number has been used, typically because we are
+// loading a state file.
+func (c *Client) registerId(id uint64) {
+	if c.UsedIds[id] {
+		panic("duplicate ID registered")
+	}
+	c.UsedIds[id] = true
+}
+
+func (c *Client) newRatchet(contact *Contact) *ratchet.Ratchet {
+	r := ratchet.New(c.Rand)
+	r.MyIdentityPrivate = &c.identity
+	r.MySigningPublic = &c.Pub
+	r.TheirIdentityPublic = &contact.TheirIdentityPublic
+	r.TheirSigningPublic = &contact.TheirPub
+	return r
+}
+
+func (c *Client) NewKeyExchange(contact *Contact) {
+	var err error
+	if contact.groupKey, err = c.groupPriv.NewMember(c.Rand); err != nil {
+		panic(err)
+	}
+	contact.ratchet = c.newRatchet(contact)
+
+	kx := &pond.KeyExchange{
+		PublicKey:      c.Pub[:],
+		IdentityPublic: c.IdentityPublic[:],
+		Server:         proto.String(c.Server),
+		Group:          contact.groupKey.Group.Marshal(),
+		GroupKey:       contact.groupKey.Marshal(),
+		Generation:     proto.Uint32(c.Generation),
+	}
+	contact.ratchet.FillKeyExchange(kx)
+	if c.SimulateOldClient {
+		kx.Dh1 = nil
+	}
+
+	kxBytes, err := proto.Marshal(kx)
+	if err != nil {
+		panic(err)
+	}
+
+	sig := ed25519.Sign(&c.priv, kxBytes)
+
+	kxs := &pond.SignedKeyExchange{
+		Signed:    kxBytes,
+		Signature: sig[:],
+	}
+
+	if contact.KxsBytes, err = proto.Marshal(kxs); err != nil {
+		panic(err)
+	}
+}
+
+func (c *Client) ContactByName(name string) (*Contact, bool) {
+	for _, contact := range c.Contacts {
+		if contact.Name == name {
+			return contact, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c *Client) DeleteInboxMsg(id uint64) {
+	newInbox := make([]*InboxMessage, 0, len(c.Inbox))
+	for _, inboxMsg := range c.Inbox {
+		if inboxMsg.Id == id {
+			c.unindex(inboxMsg)
+			continue
+		}
+		newInbox = append(newInbox, inboxMsg)
+	}
+	c.Inbox = newInbox
+}
+
+// DropSealedAndAckMessagesFrom removes all sealed or pure-ack messages from
+// the given contact, from the inbox.
+func (c *Client) DropSealedAndAckMessagesFrom(contact *Contact) {
+	newInbox := make([]*InboxMessage, 0, len(c.Inbox))
+	for _, inboxMsg := range c.Inbox {
+		if inboxMsg.From == contact.Id &&
+			(len(inboxMsg.Sealed) > 0 ||
+				(inboxMsg.Message != nil && len(inboxMsg.Message.Body) == 0)) {
+			continue
+		}
+		newInbox = append(newInbox, inboxMsg)
+	}
+	c.Inbox = newInbox
+}
+
+func (c *Client) DeleteOutboxMsg(id uint64) {
+	newOutbox := make([]*QueuedMessage, 0, len(c.Outbox))
+	for _, outboxMsg := range c.Outbox {
+		if outboxMsg.Id == id {
+			c.unindex(outboxMsg)
+			continue
+		}
+		newOutbox = append(newOutbox, outboxMsg)
+	}
+	c.Outbox = newOutbox
+}
+
+// DeleteDraft removes the draft with the given id.
+func (c *Client) DeleteDraft(id uint64) {
+	if draft, ok := c.Drafts[id]; ok {
+		c.unindex(draft)
+		delete(c.Drafts, id)
+	}
+}
+
+// ProcessTimerTick is run by every UI each time TimerChan fires. It erases
+// expired messages, other than the one with id keep that's being viewed,
+// drops expired parts of messages and runs the hooks for messages that will
+// be erased soon.
+func (c *Client) ProcessTimerTick(now time.Time, keep uint64) {
+	var expiredInbox []*InboxMessage
+	for _, msg := range c.Inbox {
+		if msg.Id != keep && c.InboxExpired(msg, now) && now.Sub(msg.ExposureTime) > MessageGraceTime {
+			expiredInbox = append(expiredInbox, msg)
+		}
+	}
+	for _, msg := range expiredInbox {
+		c.UI.RemoveInboxMessageUI(msg)
+		c.DeleteInboxMsg(msg.Id)
+	}
+
+	var expiredOutbox []*QueuedMessage
+	for _, msg := range c.Outbox {
+		if msg.Id != keep && c.outboxExpired(msg, now) {
+			expiredOutbox = append(expiredOutbox, msg)
+		}
+	}
+	for _, msg := range expiredOutbox {
+		c.UI.RemoveOutboxMessageUI(msg)
+		c.DeleteOutboxMsg(msg.Id)
+	}
+
+	if c.expireHeldParts(now) || len(expiredInbox) > 0 || len(expiredOutbox) > 0 {
+		c.Save()
+	}
+	c.runEraseSoonHooks(now)
+}
+
+// DraftSent marks the message that draft replied to, if any, as acknowledged
+// and removes the draft now that it has been sent. It returns the
+// acknowledged message, or nil.
+func (c *Client) DraftSent(draft *Draft) (acked *InboxMessage) {
+	if draft.InReplyTo != 0 {
+		for _, msg := range c.Inbox {
+			if msg.Message != nil && msg.Message.GetId() == draft.InReplyTo {
+				msg.Acked = true
+				acked = msg
+				break
+			}
+		}
+	}
+	c.DeleteDraft(draft.Id)
+	return
+}
+
+func (c *Client) indexOfQueuedMessage(msg *QueuedMessage) (index int) {
+	// c.QueueMutex must be held before calling this function.
+
+	for i, queuedMsg := range c.Queue {
+		if queuedMsg == msg {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (c *Client) removeQueuedMessage(index int) {
+	// c.QueueMutex must be held before calling this function.
+
+	var newQueue []*QueuedMessage
+	for i, queuedMsg := range c.Queue {
+		if i != index {
+			newQueue = append(newQueue, queuedMsg)
+		}
+	}
+	c.Queue = newQueue
+}
+
+// IsQueued returns true if msg, or any of its parts, is waiting in the queue
+// or the scheduled list.
+func (c *Client) IsQueued(msg *QueuedMessage) bool {
+	// c.QueueMutex must be held before calling this function.
+
+	for _, m := range msg.transmissions() {
+		if c.indexOfQueuedMessage(m) != -1 || c.isScheduled(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransmissionStarted returns true if msg, or any of its parts, is being, or
+// has been, transmitted.
+func (msg *QueuedMessage) TransmissionStarted() bool {
+	// c.QueueMutex must be held before calling this function.
+
+	for _, m := range msg.transmissions() {
+		if m.sending || !m.Sent.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// AbortMessage removes msg, and all of its parts, from the queue or the
+// scheduled list. It returns false, and leaves everything in place, if it's
+// too late because transmission has started.
+func (c *Client) AbortMessage(msg *QueuedMessage) bool {
+	c.QueueMutex.Lock()
+	defer c.QueueMutex.Unlock()
+
+	transmissions := msg.transmissions()
+	for _, m := range transmissions {
+		if m.sending || (c.indexOfQueuedMessage(m) == -1 && !c.isScheduled(m)) {
+			return false
+		}
+	}
+	for _, m := range transmissions {
+		if index := c.indexOfQueuedMessage(m); index != -1 {
+			c.removeQueuedMessage(index)
+		} else {
+			c.unscheduleMessage(m)
+		}
+	}
+	return true
+}
+
+// If sending a message fails for any reason then we want to move the
+// message to the end of the queue so that we never clog the queue with
+// an unsendable message. However, we also don't want to reorder messages
+// so all messages to the same contact are moved to the end of the queue.
+func (c *Client) moveContactsMessagesToEndOfQueue(id uint64) {
+	// c.QueueMutex must be held before calling this function.
+
+	if len(c.Queue) < 2 {
+		// There are no other orders for queues of length zero or one.
+		return
+	}
+
+	newQueue := make([]*QueuedMessage, 0, len(c.Queue))
+	movedMessages := make([]*QueuedMessage, 0, 2)
+
+	for _, queuedMsg := range c.Queue {
+		if queuedMsg.To == id {
+			movedMessages = append(movedMessages, queuedMsg)
+		} else {
+			newQueue = append(newQueue, queuedMsg)
+		}
+	}
+	newQueue = append(newQueue, movedMessages...)
+	c.Queue = newQueue
+}
+
+func (c *Client) DeleteContact(contact *Contact) {
+	var newInbox []*InboxMessage
+	for _, msg := range c.Inbox {
+		if msg.From == contact.Id {
+			c.UI.RemoveInboxMessageUI(msg)
+			c.unindex(msg)
+			continue
+		}
+		newInbox = append(newInbox, msg)
+	}
+	c.Inbox = newInbox
+
+	var stillHeld []*InboxMessage
+	for _, held := range c.HeldParts {
+		if held.From != contact.Id {
+			stillHeld = append(stillHeld, held)
+		}
+	}
+	c.HeldParts = stillHeld
+
+	for _, draft := range c.Drafts {
+		draft.RemoveRecipient(contact.Id)
+	}
+	c.removeFromAllGroups(contact)
+
+	c.QueueMutex.Lock()
+	var newQueue []*QueuedMessage
+	for _, msg := range c.Queue {
+		if msg.To == contact.Id && !msg.Revocation {
+			continue
+		}
+		newQueue = append(newQueue, msg)
+	}
+	c.Queue = newQueue
+	var newScheduled []*QueuedMessage
+	for _, msg := range c.Scheduled {
+		if msg.To == contact.Id {
+			continue
+		}
+		newScheduled = append(newScheduled, msg)
+	}
+	c.Scheduled = newScheduled
+	c.QueueMutex.Unlock()
+
+	var newOutbox []*QueuedMessage
+	for _, msg := range c.Outbox {
+		if msg.To == contact.Id && !msg.Revocation {
+			c.UI.RemoveOutboxMessageUI(msg)
+			c.unindex(msg)
+			continue
+		}
+		newOutbox = append(newOutbox, msg)
+	}
+	c.Outbox = newOutbox
+
+	revocationMessage := c.revoke(contact)
+	c.UI.AddRevocationMessageUI(revocationMessage)
+
+	if contact.PandaShutdownChan != nil {
+		close(contact.PandaShutdownChan)
+	}
+
+	c.UI.RemoveContactUI(contact)
+	delete(c.Contacts, contact.Id)
+}
+
+// IndentForReply returns a copy of in where the beginning of each line is
+// prefixed with "> ", as is typical for replies.
+func IndentForReply(i []byte) string {
+	in := bufio.NewReader(bytes.NewBuffer(i))
+	var out bytes.Buffer
+
+	newLine := true
+	for {
+		line, isPrefix, err := in.ReadLine()
+		if err != nil {
+			break
+		}
+
+		if newLine {
+			if len(line) > 0 {
+				out.WriteString("> ")
+			} else {
+				out.WriteString(">")
+			}
+		}
+		out.Write(line)
+		newLine = !isPrefix
+		if !isPrefix {
+			out.WriteString("\n")
+		}
+	}
+
+	return string(out.Bytes())
+}
+
+// DetachmentLifetime is the time for which a home server keeps an uploaded
+// detachment. It matches fileLifetime in the server.
+const DetachmentLifetime = 14 * 24 * time.Hour
+
+// ForwardDraft creates a new draft, without any recipients, that forwards msg
+// and adds it to the drafts. The body of msg is quoted and its attachments
+// are copied. The server that holds a detachment deletes it fileLifetime
+// after it was uploaded, which may be long before the forwarded message is
+// received, so uploaded detachments are copied to the home server in the
+// background and added to the draft once that's complete. Detachments that
+// have probably been deleted already are omitted and listed in the body
+// instead.
+func (c *Client) ForwardDraft(msg *InboxMessage) *Draft {
+	draft := &Draft{
+		Id:      c.RandId(),
+		Created: c.Now(),
+	}
+	c.Drafts[draft.Id] = draft
+
+	sent := time.Unix(msg.Message.GetTime(), 0)
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "\n\nForwarded message from %s, sent %s:\n\n", c.ContactName(msg.From), sent.Format(time.RFC1123))
+	body.WriteString(IndentForReply(msg.Message.GetBody()))
+
+	draft.Attachments = append(draft.Attachments, msg.Message.Files...)
+
+	var expired []string
+	var copies []*pond.Message_Detachment
+	for _, detachment := range msg.Message.DetachedFiles {
+		switch {
+		case detachment.Url == nil:
+			draft.Detachments = append(draft.Detachments, detachment)
+		case c.Now().Sub(sent) > DetachmentLifetime:
+			expired = append(expired, detachment.GetFilename())
+		default:
+			copies = append(copies, detachment)
+		}
+	}
+	if len(expired) > 0 {
+		fmt.Fprintf(&body, "\n(%s expired and couldn't be forwarded.)\n", strings.Join(expired, ", "))
+	}
+	draft.Body = body.String()
+
+	for _, detachment := range copies {
+		c.startTransfer(&Transfer{
+			Id:     c.RandId(),
+			Upload: true,
+			Path:   detachment.GetFilename(),
+			Draft:  draft.Id,
+			source: detachment,
+			Size:   int64(detachment.GetSize()),
+		}, "pond-upload-")
+	}
+	return draft
+}
+
+// RunPANDA runs in its own goroutine and runs a PANDA key exchange. If
+// previous is not nil then it first waits for the previous goroutine for the
+// same contact to exit, so that the two never run at once, and continues from
+// the state that it hands over. The state is written to done if the exchange
+// is shut down.
+func (c *Client) runPANDA(serialisedKeyExchange []byte, id uint64, name string, shutdown chan struct{}, previous <-chan []byte, done chan<- []byte) {
+	var result []byte
+	defer c.PandaWaitGroup.Done()
+	defer close(done)
+
+	if previous != nil {
+		serialised, ok := <-previous
+		if !ok {
+			// The previous goroutine finished the exchange before
+			// it saw the shutdown and has reported the outcome.
+			return
+		}
+		serialisedKeyExchange = serialised
+	}
+
+	c.Log.Printf("Starting PANDA key exchange with %s", name)
+
+	kx, err := panda.UnmarshalKeyExchange(c.Rand, c.NewMeetingPlace(), serialisedKeyExchange)
+	kx.Testing = c.Testing
+	kx.Log = func(format string, args ...interface{}) {
+		serialised := kx.Marshal()
+		c.PandaChan <- PandaUpdate{
+			Id:         id,
+			Serialised: serialised,
+		}
+		c.Log.Printf("Key exchange with %s: %s", name, fmt.Sprintf(format, args...))
+	}
+	kx.ShutdownChan = shutdown
+
+	if err == nil {
+		result, err = kx.Run()
+	}
+
+	if err == panda.ShutdownErr {
+		done <- kx.Marshal()
+		return
+	}
+
+	c.PandaChan <- PandaUpdate{
+		Id:     id,
+		Err:    err,
+		Result: result,
+	}
+}
+
+// StartPANDA creates a pending contact with the given name and starts a PANDA
+// key exchange with it, using a single deck of cards and the given shared
+// secret. It runs on the main client goroutine.
+func (c *Client) StartPANDA(name, sharedSecret string) *Contact {
+	contact := &Contact{
+		Name:      name,
+		IsPending: true,
+		Id:        c.RandId(),
+	}
+
+	c.NewKeyExchange(contact)
+
+	stack := &panda.CardStack{
+		NumDecks: 1,
+	}
+	secret := panda.SharedSecret{
+		Secret: sharedSecret,
+		Cards:  *stack,
+	}
+
+	mp := c.NewMeetingPlace()
+
+	c.Contacts[contact.Id] = contact
+	kx, err := panda.NewKeyExchange(c.Rand, mp, &secret, contact.KxsBytes)
+	if err != nil {
+		panic(err)
+	}
+	kx.Testing = c.Testing
+	contact.PandaKeyExchange = kx.Marshal()
+	contact.KxsBytes = nil
+
+	c.Save()
+	c.ResumePANDA(contact)
+
+	return contact
+}
+
+// ResumePANDA starts running the pending PANDA key exchange of contact in the
+// background. While offline, nothing is started and the exchange is resumed
+// when the client goes online.
+func (c *Client) ResumePANDA(contact *Contact) {
+	if c.IsOffline() {
+		c.Log.Printf("Key exchange with %s will start when the client is online", contact.Name)
+		return
+	}
+	c.PandaWaitGroup.Add(1)
+	previous := contact.pandaDone
+	contact.PandaShutdownChan = make(chan struct{})
+	contact.pandaDone = make(chan []byte, 1)
+	go c.runPANDA(contact.PandaKeyExchange, contact.Id, contact.Name, contact.PandaShutdownChan, previous, contact.pandaDone)
+}
+
+// ProcessPANDAUpdate runs on the main client goroutine and handles messages
+// from a runPANDA goroutine.
+func (c *Client) ProcessPANDAUpdate(update PandaUpdate) {
+	contact, ok := c.Contacts[update.Id]
+	if !ok {
+		return
+	}
+
+	switch {
+	case update.Err != nil:
+		contact.PandaResult = update.Err.Error()
+		contact.PandaKeyExchange = nil
+		contact.PandaShutdownChan = nil
+		contact.pandaDone = nil
+		c.Log.Printf("Key exchange with %s failed: %s", contact.Name, update.Err)
+	case update.Serialised != nil:
+		if bytes.Equal(contact.PandaKeyExchange, update.Serialised) {
+			return
+		}
+		contact.PandaKeyExchange = update.Serialised
+	case update.Result != nil:
+		contact.PandaKeyExchange = nil
+		contact.PandaShutdownChan = nil
+		contact.pandaDone = nil
+
+		if err := contact.ProcessKeyExchange(update.Result, c.AllowClearnet, c.SimulateOldClient, c.DisableV2Ratchet); err != nil {
+			contact.PandaResult = err.Error()
+			update.Err = err
+			c.Log.Printf("Key exchange with %s failed: %s", contact.Name, err)
+		} else {
+			c.Log.Printf("Key exchange with %s complete", contact.Name)
+			contact.IsPending = false
+		}
+	}
+
+	c.UI.ProcessPANDAUpdateUI(update)
+	c.Save()
+
+	if update.Err != nil || update.Result != nil {
+		payload := &HookPayload{
+			Contact:   contact.Name,
+			ContactId: contact.Id,
+		}
+		if update.Err != nil {
+			payload.Error = update.Err.Error()
+		}
+		c.runHook(hookPANDA, payload)
+	}
+}
+
+type PandaUpdate struct {
+	Id         uint64
+	Err        error
+	Result     []byte
+	Serialised []byte
+}
+
+func OpenAttachment(path string) (contents []byte, size int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if fi.Size() < pond.MaxSerializedMessage-500 {
+		contents, err = ioutil.ReadAll(file)
+		size = -1
+	} else {
+		size = fi.Size()
+	}
+	return
+}
+
+// Entomb encrypts and *destroys* the statefile. The encrypted statefile is
+// written to tombFile (with tombPath). The function log will be called during
+// the process to give status updates. It returns the random key of the
+// encrypted statefile and whether the process was successful. If unsuccessful,
+// the original statefile will not be destroyed.
+func (c *Client) Entomb(tombPath string, tombFile *os.File, log func(string, ...interface{})) (keyHex *[32]byte, ok bool) {
+	log("Emtombing statefile to %s\n", tombPath)
+	log("Stopping network processing...\n")
+	if c.FetchNowChan != nil {
+		close(c.FetchNowChan)
+	}
+	log("Stopping active key exchanges...\n")
+	for _, contact := range c.Contacts {
+		if contact.PandaShutdownChan != nil {
+			close(contact.PandaShutdownChan)
+		}
+	}
+	log("Serialising state...\n")
+	stateBytes := c.marshal()
+
+	var key [32]byte
+	c.RandBytes(key[:])
+	var nonce [24]byte
+	log("Encrypting...\n")
+	encrypted := secretbox.Seal(nil, stateBytes, &nonce, &key)
+
+	log("Writing...\n")
+	if _, err := tombFile.Write(encrypted); err != nil {
+		log("Error writing: %s\n", err)
+		return nil, false
+	}
+	log("Syncing...\n")
+	if err := tombFile.Sync(); err != nil {
+		log("Error syncing: %s\n", err)
+		return nil, false
+	}
+	if err := tombFile.Close(); err != nil {
+		log("Error closing: %s\n", err)
+		return nil, false
+	}
+
+	readBack, err := ioutil.ReadFile(tombPath)
+	if err != nil {
+		log("Error rereading: %s\n", err)
+		return nil, false
+	}
+	if !bytes.Equal(readBack, encrypted) {
+		log("Contents of tomb file incorrect\n")
+		return nil, false
+	}
+
+	log("The ephemeral key is: %x\n", key)
+	log("You must write the ephemeral key down now! Store it somewhat erasable!\n")
+
+	log("Erasing statefile... ")
+	c.WriterChan <- disk.NewState{stateBytes, false, true /* destruct */}
+	<-c.WriterDone
+	log("done\n")
+
+	return &key, true
+}
+
+// ImportTombFile decrypts a file with the given path, using a hex-encoded key
+// and loads the client state from the result.
+func (c *Client) ImportTombFile(stateFile *disk.StateFile, keyHex, path string) error {
+	keyBytes, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return err
+	}
+
+	var key [32]byte
+	var nonce [24]byte
+	if len(keyBytes) != len(key) {
+		return fmt.Errorf("Incorrect key length: %d (want %d)", len(keyBytes), len(key))
+	}
+	copy(key[:], keyBytes)
+
+	tombBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	plaintext, ok := secretbox.Open(nil, tombBytes, &nonce, &key)
+	if !ok {
+		return errors.New("Incorrect key")
+	}
+
+	c.StateLock, err = stateFile.Lock(true /* create */)
+	if c.StateLock == nil && err == nil {
+		return errors.New("Output statefile is locked.")
+	}
+	if err != nil {
+		return err
+	}
+
+	writerChan := make(chan disk.NewState)
+	writerDone := make(chan struct{})
+	go stateFile.StartWriter(writerChan, writerDone)
+
+	writerChan <- disk.NewState{State: plaintext}
+	close(writerChan)
+	<-writerDone
+
+	return nil
+}
@@ -0,0 +1,458 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	panda "github.com/agl/pond/panda"
+)
+
+// clientLogToStderr controls whether the TestClients will log to stderr during
+// the test. This produces too much noise to be enabled all the time, but it
+// can be helpful when debugging.
+const clientLogToStderr = false
+
+const parallel = true
+
+type TestServer struct {
+	cmd      *exec.Cmd
+	port     int
+	identity string
+	stateDir string
+}
+
+func NewTestServer(t *testing.T) (*TestServer, error) {
+	var err error
+	server := new(TestServer)
+	if server.stateDir, err = ioutil.TempDir("", "pond-client-test"); err != nil {
+		return nil, err
+	}
+
+	// To ensure that the server dies when the test exits, we install a
+	// socketpair into the child process and set a command line flag to
+	// tell the server to exit if it sees EOF on that socket. Since we hold
+	// the other end in this process, the kernel will close it for us if we
+	// die.
+	pipeFds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(pipeFds[0])
+	syscall.CloseOnExec(pipeFds[1])
+
+	serverLifeline := os.NewFile(uintptr(pipeFds[0]), "server lifeline fd")
+	defer serverLifeline.Close()
+
+	server.cmd = exec.Command("../../server/server",
+		"--init",
+		"--base-directory", server.stateDir,
+		"--port", "0",
+		"--lifeline-fd", "3",
+	)
+	server.cmd.ExtraFiles = []*os.File{serverLifeline}
+	rawStderr, err := server.cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := server.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	stderr := bufio.NewReader(rawStderr)
+
+	for {
+		line, isPrefix, err := stderr.ReadLine()
+		if err != nil {
+			return nil, errors.New("error while reading status line: " + err.Error())
+		}
+		if isPrefix {
+			continue
+		}
+		if i := bytes.Index(line, []byte("Started. Listening on port ")); i != -1 {
+			line = line[i:]
+			words := strings.Split(string(line), " ")
+			if len(words) < 8 {
+				return nil, errors.New("status line from server has unexpected form: " + string(line))
+			}
+			portStr := words[4]
+			server.identity = words[7]
+
+			if server.port, err = strconv.Atoi(portStr); err != nil {
+				return nil, errors.New("failed to parse port number: " + err.Error())
+			}
+			break
+		}
+	}
+
+	go func() {
+		for {
+			line, _, err := stderr.ReadLine()
+			if err != nil {
+				return
+			}
+			t.Logf("%s\n", string(line))
+		}
+	}()
+
+	return server, nil
+}
+
+func (server *TestServer) URL() string {
+	return fmt.Sprintf("pondserver://%s@127.0.0.1:%d", server.identity, server.port)
+}
+
+func (server *TestServer) Close() {
+	server.cmd.Process.Kill()
+	server.cmd.Wait()
+	os.RemoveAll(server.stateDir)
+}
+
+// slowShutdownMeetingPlace wraps a MeetingPlace, takes a while to return once
+// an exchange has been shut down and records whether exchanges overlapped.
+// Each call to Exchange is signaled on entered.
+type slowShutdownMeetingPlace struct {
+	panda.MeetingPlace
+	entered chan struct{}
+
+	sync.Mutex
+	running    int
+	overlapped bool
+}
+
+func (mp *slowShutdownMeetingPlace) Exchange(log func(string, ...interface{}), id, message []byte, shutdown chan struct{}) ([]byte, error) {
+	mp.Lock()
+	if mp.running++; mp.running > 1 {
+		mp.overlapped = true
+	}
+	mp.Unlock()
+
+	select {
+	case mp.entered <- struct{}{}:
+	default:
+	}
+
+	reply, err := mp.MeetingPlace.Exchange(log, id, message, shutdown)
+	if err == panda.ShutdownErr {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	mp.Lock()
+	mp.running--
+	mp.Unlock()
+	return reply, err
+}
+
+func TestPANDAOfflineToggle(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pond-panda-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mp := panda.NewSimpleMeetingPlace()
+	slowMP := &slowShutdownMeetingPlace{
+		MeetingPlace: mp,
+		entered:      make(chan struct{}, 1),
+	}
+	bot1 := newTestBot(filepath.Join(dir, "bot1"), server, slowMP)
+	if err := bot1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bot1.Close()
+	bot2 := newTestBot(filepath.Join(dir, "bot2"), server, mp)
+	if err := bot2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bot2.Close()
+
+	_, secret, err := bot1.NewContact("bot2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Going offline and online twice in a row, before the stopped
+	// exchanges have finished, mustn't leave two exchanges running.
+	for i := 0; i < 2; i++ {
+		<-slowMP.entered
+		for _, offline := range []bool{true, false} {
+			offline := offline
+			bot1.call(func() error {
+				bot1.client.SetOffline(offline)
+				return nil
+			})
+		}
+	}
+
+	if _, _, err := bot2.NewContact("bot1", secret); err != nil {
+		t.Fatal(err)
+	}
+	waitForBotEvents(t, bot1, KeyExchangeComplete{})
+	waitForBotEvents(t, bot2, KeyExchangeComplete{})
+
+	slowMP.Lock()
+	defer slowMP.Unlock()
+	if slowMP.overlapped {
+		t.Errorf("key exchanges for the same contact ran at the same time")
+	}
+}
+
+func TestNetworkSchedule(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2014, 6, 10, hour, minute, 0, 0, time.Local)
+	}
+
+	quietHours, start, end, err := ParseQuietHours("22:00-07:30")
+	if err != nil || !quietHours || start != 22*60 || end != 7*60+30 {
+		t.Fatalf("bad parse of quiet hours: %v %d %d %s", quietHours, start, end, err)
+	}
+	for _, bad := range []string{"22:00", "25:00-07:00", "22:00-07:60", "07:00-07:00"} {
+		if _, _, _, err := ParseQuietHours(bad); err == nil {
+			t.Errorf("parseQuietHours accepted %q", bad)
+		}
+	}
+
+	overnight := NetworkSchedule{QuietHours: true, QuietStart: start, QuietEnd: end}
+	daytime := NetworkSchedule{QuietHours: true, QuietStart: 9 * 60, QuietEnd: 17 * 60}
+	tests := []struct {
+		schedule *NetworkSchedule
+		t        time.Time
+		quiet    bool
+		end      time.Time
+	}{
+		{&overnight, at(23, 0), true, at(7, 30).AddDate(0, 0, 1)},
+		{&overnight, at(3, 0), true, at(7, 30)},
+		{&overnight, at(7, 30), false, time.Time{}},
+		{&overnight, at(12, 0), false, time.Time{}},
+		{&daytime, at(12, 0), true, at(17, 0)},
+		{&daytime, at(8, 59), false, time.Time{}},
+		{&daytime, at(17, 0), false, time.Time{}},
+	}
+	for i, test := range tests {
+		end, quiet := test.schedule.quietUntil(test.t)
+		if quiet != test.quiet || !end.Equal(test.end) {
+			t.Errorf("#%d: quietUntil returned %s, %v but wanted %s, %v", i, end, quiet, test.end, test.quiet)
+		}
+	}
+
+	c := &Client{}
+	r := mrand.New(mrand.NewSource(1))
+
+	// Transactions never fall in quiet hours.
+	c.network.Schedule = daytime
+	for i := 0; i < 100; i++ {
+		now := at(8, 55)
+		delay, ok := c.nextTransactionDelay(r, now)
+		if !ok {
+			t.Fatalf("no transaction was scheduled")
+		}
+		if _, quiet := daytime.quietUntil(now.Add(delay)); quiet {
+			t.Fatalf("transaction scheduled in quiet hours at %s", now.Add(delay))
+		}
+	}
+	if c.mayTransactNow(at(12, 0)) || !c.mayTransactNow(at(18, 0)) {
+		t.Errorf("mayTransactNow doesn't respect quiet hours")
+	}
+
+	// After sending, a burst of transactions use the shorter interval.
+	c.network.Schedule = NetworkSchedule{
+		Interval:          time.Hour,
+		BurstTransactions: 2,
+		BurstInterval:     time.Second,
+	}
+	c.startBurst()
+	for i := 0; i < 2; i++ {
+		if delay, _ := c.nextTransactionDelay(r, time.Now()); delay > time.Minute {
+			t.Errorf("transaction %d of burst was delayed by %s", i, delay)
+		}
+		c.transactionStarted()
+	}
+	if c.burstRemaining != 0 {
+		t.Errorf("burst didn't end")
+	}
+
+	c.network.Schedule.Paused = true
+	if _, ok := c.nextTransactionDelay(r, time.Now()); ok {
+		t.Errorf("transaction was scheduled while paused")
+	}
+	if next, paused := c.NextTransactionTime(); !next.IsZero() || !paused {
+		t.Errorf("nextTransactionTime returned %s, %v while paused", next, paused)
+	}
+}
+
+func newTestBot(stateFile string, server *TestServer, mp panda.MeetingPlace) *Bot {
+	b := newBot(stateFile, rand.Reader, true /* testing */, false /* autoFetch */)
+	b.client.Log.ToStderr = clientLogToStderr
+	if server != nil {
+		b.Server = server.URL()
+	}
+	b.client.NewMeetingPlace = func() panda.MeetingPlace {
+		return mp
+	}
+	return b
+}
+
+// waitForBotEvents reads events from b until it has seen one of the type of
+// each example, and returns them in the same order as the examples. Other
+// events are discarded.
+func waitForBotEvents(t *testing.T, b *Bot, examples ...interface{}) []interface{} {
+	results := make([]interface{}, len(examples))
+	remaining := len(examples)
+	timeout := time.After(30 * time.Second)
+
+	for remaining > 0 {
+		select {
+		case event, ok := <-b.Events():
+			if !ok {
+				t.Fatalf("bot stopped while waiting for events")
+			}
+			for i, example := range examples {
+				if results[i] == nil && reflect.TypeOf(event) == reflect.TypeOf(example) {
+					results[i] = event
+					remaining--
+					break
+				}
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for events: %#v", results)
+		}
+	}
+	return results
+}
+
+func TestBot(t *testing.T) {
+	if parallel {
+		t.Parallel()
+	}
+
+	server, err := NewTestServer(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pond-bot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mp := panda.NewSimpleMeetingPlace()
+	if err := newTestBot(filepath.Join(dir, "none"), nil, mp).Start(); err == nil {
+		t.Errorf("bot without a state file or server started")
+	}
+
+	bot1 := newTestBot(filepath.Join(dir, "bot1"), server, mp)
+	if err := bot1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bot1.Close()
+	bot2 := newTestBot(filepath.Join(dir, "bot2"), server, mp)
+	if err := bot2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer bot2.Close()
+
+	contact2, secret, err := bot1.NewContact("bot2", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contact2.Pending {
+		t.Errorf("new contact isn't pending")
+	}
+	if _, _, err := bot2.NewContact("bot1", secret+"x"); err == nil {
+		t.Errorf("shared secret with a bad checksum was accepted")
+	}
+	contact1, _, err := bot2.NewContact("bot1", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForBotEvents(t, bot1, KeyExchangeComplete{})
+	waitForBotEvents(t, bot2, KeyExchangeComplete{})
+
+	contacts, err := bot1.Contacts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contacts) != 1 || contacts[0].ID != contact2.ID || contacts[0].Name != "bot2" || contacts[0].Pending {
+		t.Fatalf("unexpected contacts: %#v", contacts)
+	}
+
+	const body = "hello from bot1"
+	sentID, err := bot1.Send(contact2.ID, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bot1.TransactNow(); err != nil {
+		t.Fatal(err)
+	}
+	if delivered := waitForBotEvents(t, bot1, MessageDelivered{})[0].(MessageDelivered); delivered.ID != sentID || delivered.To != contact2.ID {
+		t.Errorf("unexpected delivery event: %#v", delivered)
+	}
+
+	// bot2 acts as an auto-responder, which acknowledges the message.
+	bot2.TransactNow()
+	received := waitForBotEvents(t, bot2, MessageReceived{})[0].(MessageReceived)
+	if received.Body != body || received.From != contact1.ID || received.FromName != "bot1" {
+		t.Errorf("unexpected received message: %#v", received)
+	}
+	const reply = "automatic reply"
+	if _, err := bot2.Reply(received.ID, reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot2.Acknowledge(received.ID); err == nil {
+		t.Errorf("message that was replied to could be acknowledged again")
+	}
+	bot2.TransactNow()
+	waitForBotEvents(t, bot2, MessageDelivered{})
+
+	bot1.TransactNow()
+	events := waitForBotEvents(t, bot1, MessageReceived{}, MessageAcknowledged{})
+	if received := events[0].(MessageReceived); received.Body != reply || received.From != contact2.ID {
+		t.Errorf("unexpected reply: %#v", received)
+	}
+	if acked := events[1].(MessageAcknowledged); acked.ID != sentID {
+		t.Errorf("unexpected acknowledgement: %#v", acked)
+	}
+
+	// Once closed, calls fail and the state can be loaded again.
+	bot1.Close()
+	if _, ok := <-bot1.Events(); ok {
+		t.Errorf("events channel wasn't closed")
+	}
+	if err := bot1.TransactNow(); err == nil {
+		t.Errorf("call succeeded after the bot was closed")
+	}
+	reloaded := newTestBot(filepath.Join(dir, "bot1"), nil, mp)
+	if err := reloaded.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if contacts, err := reloaded.Contacts(); err != nil || len(contacts) != 1 || contacts[0].Name != "bot2" {
+		t.Errorf("unexpected contacts after reloading: %#v, %v", contacts, err)
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+)
+
+// GzipVersion is the first protocol version in which GZIP encoded message
+// bodies are understood. Bodies are only compressed for contacts that have
+// advertised at least this version.
+const GzipVersion = 2
+
+// MaxDecompressedBody is the largest message body that will be produced by
+// decompression. Larger bodies are never compressed when sending and, when
+// received, are rejected rather than allowing a small message to expand
+// without limit.
+const MaxDecompressedBody = 16 * pond.MaxSerializedMessage
+
+// GzipBody returns body compressed with GZIP.
+func GzipBody(body []byte) []byte {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+// compressMessage returns message, or a copy of it with a GZIP encoded body
+// if that's smaller.
+func compressMessage(message *pond.Message) *pond.Message {
+	body := message.Body
+	if message.GetBodyEncoding() != pond.Message_RAW || len(body) == 0 || len(body) > MaxDecompressedBody {
+		return message
+	}
+	compressed := GzipBody(body)
+	if len(compressed) >= len(body) {
+		return message
+	}
+
+	compressedMessage := *message
+	compressedMessage.Body = compressed
+	compressedMessage.BodyEncoding = pond.Message_GZIP.Enum()
+	return &compressedMessage
+}
+
+// DecompressBody replaces a GZIP encoded body with the RAW body that it
+// encodes. Other encodings are left untouched.
+func DecompressBody(message *pond.Message) error {
+	if message.GetBodyEncoding() != pond.Message_GZIP {
+		return nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(message.Body))
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressedBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > MaxDecompressedBody {
+		return errors.New("decompressed body is too large")
+	}
+
+	message.Body = body
+	message.BodyEncoding = pond.Message_RAW.Enum()
+	return nil
+}
+
+// wireMessage returns the form of message that is transmitted to a contact,
+// which has a compressed body if they support it.
+func wireMessage(to *Contact, message *pond.Message) *pond.Message {
+	if to == nil || to.SupportedVersion < GzipVersion {
+		return message
+	}
+	return compressMessage(message)
+}
+
+// serializeMessage returns message, as it'll be transmitted to a contact, in
+// serialised form.
+func serializeMessage(to *Contact, message *pond.Message) ([]byte, error) {
+	return proto.Marshal(wireMessage(to, message))
+}
@@ -0,0 +1,108 @@
+package core
+
+import (
+	"crypto/sha256"
+
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Cover traffic is an optional mode in which the network goroutine strictly
+// alternates between deliveries and fetches. When it's time to deliver but
+// there's nothing in the queue that can be sent, it delivers a cover message
+// instead. Thus the rate at which deliveries leave the client, and the
+// sequence of transactions, is the same whether or not the user is sending
+// anything.
+//
+// A cover message is encrypted with a key that only we know, signed with a
+// member key of our own group and delivered to our own account on our home
+// server, exactly as a contact would deliver a message to us. Our home server
+// accepts it as it would any other delivery and, when it's fetched, we
+// recognise it and silently drop it. Cover messages are never sent to other
+// servers because they'd learn our account, which they otherwise never see,
+// and would reject the delivery.
+
+// coverKeyLabel is hashed with our identity private key to derive the key
+// that cover messages are encrypted with.
+var coverKeyLabel = []byte("cover traffic key\x00")
+
+// coverMessageLen is the length of a sealed cover message. It's the same as a
+// message encrypted with a ratchet: a nonce and sealed, 64-byte header
+// followed by the sealed, padded message.
+const coverMessageLen = 24 + 64 + secretbox.Overhead + pond.MaxSerializedMessage + 4 + secretbox.Overhead
+
+// SetCoverTraffic enables or disables cover traffic.
+func (c *Client) SetCoverTraffic(on bool) {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	c.network.CoverTraffic = on
+}
+
+// CoverTrafficEnabled returns true if cover traffic should be sent. It's
+// called from the network goroutine.
+func (c *Client) CoverTrafficEnabled() bool {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	return c.network.CoverTraffic
+}
+
+func (c *Client) coverKey() *[32]byte {
+	var key [32]byte
+	h := sha256.New()
+	h.Write(coverKeyLabel)
+	h.Write(c.identity[:])
+	h.Sum(key[:0])
+	return &key
+}
+
+// coverRequest returns a delivery of a cover message to our own account. It's
+// run on the main goroutine because it uses the group private key.
+func (c *Client) coverRequest() (*pond.Request, error) {
+	var nonce [24]byte
+	c.RandBytes(nonce[:])
+	plaintext := make([]byte, coverMessageLen-len(nonce)-secretbox.Overhead)
+	c.RandBytes(plaintext)
+	sealed := secretbox.Seal(nonce[:], plaintext, &nonce, c.coverKey())
+
+	// Group signatures made with the same member key can't be linked, so
+	// one key is enough for every cover message of a generation.
+	if c.CoverMember == nil || c.coverGeneration != c.Generation {
+		member, err := c.groupPriv.NewMember(c.Rand)
+		if err != nil {
+			return nil, err
+		}
+		c.CoverMember, c.coverGeneration = member, c.Generation
+	}
+	member := c.CoverMember
+	sha := sha256.New()
+	sha.Write(sealed)
+	digest := sha.Sum(nil)
+	sha.Reset()
+	groupSig, err := member.Sign(c.Rand, digest, sha)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pond.Request{
+		Deliver: &pond.Delivery{
+			To:             c.IdentityPublic[:],
+			GroupSignature: groupSig,
+			Generation:     proto.Uint32(c.Generation),
+			Message:        sealed,
+		},
+	}, nil
+}
+
+// isCoverMessage returns true if sealed is a cover message that we sent.
+func (c *Client) isCoverMessage(sealed []byte) bool {
+	if len(sealed) < 24+secretbox.Overhead {
+		return false
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	_, ok := secretbox.Open(nil, sealed[24:], &nonce, c.coverKey())
+	return ok
+}
@@ -0,0 +1,154 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+)
+
+// placeholderDetachment returns a detachment that's at least as large, when
+// serialised, as the one that will replace attachment once it has been
+// uploaded.
+func (c *Client) placeholderDetachment(attachment *pond.Message_Attachment) *pond.Message_Detachment {
+	var key [32]byte
+	return &pond.Message_Detachment{
+		Filename:   attachment.Filename,
+		Size:       proto.Uint64(math.MaxUint64),
+		PaddedSize: proto.Uint64(math.MaxUint64),
+		ChunkSize:  proto.Uint32(math.MaxUint32),
+		Key:        key[:],
+		Url:        proto.String(c.buildDetachmentURL(math.MaxUint64)),
+	}
+}
+
+// fitsWithAttachmentsDetached returns true if draft could be sent once all
+// its attachments have been uploaded and replaced with detachments.
+func (c *Client) fitsWithAttachmentsDetached(draft *Draft) bool {
+	detached := *draft
+	detached.Attachments = nil
+	detached.Detachments = append([]*pond.Message_Detachment(nil), draft.Detachments...)
+	for _, attachment := range draft.Attachments {
+		detached.Detachments = append(detached.Detachments, c.placeholderDetachment(attachment))
+	}
+
+	return c.fits(&detached)
+}
+
+// ErrDraftUploading is returned by SendDraft when the draft will be sent once
+// its uploads have finished.
+var ErrDraftUploading = errors.New("the draft will be sent once its attachments have been uploaded")
+
+// detachLargeAttachments starts uploading the largest attachments of draft to
+// the home server, to be replaced with detachments, until the draft can be
+// sent. It returns true if the draft has to wait for uploads to finish, in
+// which case it's marked to be sent once they have.
+func (c *Client) detachLargeAttachments(draft *Draft) (uploading bool, err error) {
+	if c.HasUploads(draft.Id) {
+		draft.SendWhenUploaded = true
+		c.Save()
+		return true, nil
+	}
+	if c.fits(draft) {
+		return false, nil
+	}
+	if len(draft.Attachments) == 0 || !c.fitsWithAttachmentsDetached(draft) {
+		return false, errors.New("message too large")
+	}
+
+	// The attachments to upload are chosen by replacing them with
+	// placeholders in a copy of the draft.
+	detached := *draft
+	detached.Attachments = append([]*pond.Message_Attachment(nil), draft.Attachments...)
+	detached.Detachments = append([]*pond.Message_Detachment(nil), draft.Detachments...)
+	var uploads []*Transfer
+	for !c.fits(&detached) {
+		largest := 0
+		for i, attachment := range detached.Attachments {
+			if len(attachment.Contents) > len(detached.Attachments[largest].Contents) {
+				largest = i
+			}
+		}
+		attachment := detached.Attachments[largest]
+		detached.Attachments = append(detached.Attachments[:largest:largest], detached.Attachments[largest+1:]...)
+		detached.Detachments = append(detached.Detachments, c.placeholderDetachment(attachment))
+
+		t, err := c.encryptAttachment(draft.Id, attachment)
+		if err != nil {
+			for _, t := range uploads {
+				os.Remove(t.TmpPath)
+			}
+			return false, errors.New("failed to upload " + attachment.GetFilename() + ": " + err.Error())
+		}
+		uploads = append(uploads, t)
+	}
+
+	draft.SendWhenUploaded = true
+	for _, t := range uploads {
+		c.addTransfer(t)
+	}
+	return true, nil
+}
+
+// encryptAttachment encrypts the contents of an attachment to a temporary
+// file and returns a transfer that will upload it and replace the attachment
+// in the given draft. The plaintext is never written to disk and, because the
+// key is known before the transfer is recorded, a resumed upload always
+// continues with the same ciphertext.
+func (c *Client) encryptAttachment(draft uint64, attachment *pond.Message_Attachment) (*Transfer, error) {
+	tmp, err := ioutil.TempFile("" /* default tmp dir */, "pond-upload-")
+	if err != nil {
+		return nil, errors.New("failed to create temp file: " + err.Error())
+	}
+	defer tmp.Close()
+
+	id := c.RandId()
+	in := bytes.NewReader(attachment.Contents)
+	detachment, err := saveEncryptedFrom(c.Rand, nil, tmp, id, in, int64(len(attachment.Contents)), nil)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	detachment.Filename = attachment.Filename
+	detachment.Url = proto.String(c.buildDetachmentURL(id))
+
+	return &Transfer{
+		Id:         id,
+		Upload:     true,
+		TmpPath:    tmp.Name(),
+		Path:       attachment.GetFilename(),
+		Detachment: detachment,
+		Draft:      draft,
+		Attachment: true,
+		Size:       int64(len(attachment.Contents)),
+	}, nil
+}
+
+// removeAttachment removes the attachment that detachment was uploaded from.
+func (draft *Draft) removeAttachment(detachment *pond.Message_Detachment) {
+	for i, attachment := range draft.Attachments {
+		if attachment.GetFilename() == detachment.GetFilename() && uint64(len(attachment.Contents)) == detachment.GetSize() {
+			draft.Attachments = append(draft.Attachments[:i:i], draft.Attachments[i+1:]...)
+			return
+		}
+	}
+}
+
+// sendUploadedDraft sends a draft that was waiting for its uploads to finish
+// and tells the UI the result.
+func (c *Client) sendUploadedDraft(draft *Draft) {
+	draft.SendWhenUploaded = false
+	id, _, err := c.SendDraft(draft)
+	if err == ErrDraftUploading {
+		return
+	}
+	if err == nil {
+		c.DraftSent(draft)
+	}
+	c.Save()
+	c.UI.ProcessDraftSent(draft, id, err)
+}
@@ -0,0 +1,540 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	"github.com/agl/pond/bbssig"
+	"github.com/agl/pond/client/disk"
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/curve25519"
+)
+
+// erasureRotationTime is the amount of time that we'll use a single erasure
+// storage value before rotating.
+const erasureRotationTime = 24 * time.Hour
+
+func (c *Client) LoadState(stateFile *disk.StateFile, pw string) error {
+	parsedState, err := stateFile.Read(pw)
+	if err != nil {
+		return err
+	}
+	return c.unmarshal(parsedState)
+}
+
+func (c *Client) Save() {
+	c.Log.Printf("Saving state")
+	now := c.Now()
+	rotateErasureStorage := now.Before(c.LastErasureStorageTime) || now.Sub(c.LastErasureStorageTime) > erasureRotationTime
+	if rotateErasureStorage {
+		c.Log.Printf("Rotating erasure storage key")
+		c.LastErasureStorageTime = now
+	}
+	serialized := c.marshal()
+	c.WriterChan <- disk.NewState{serialized, rotateErasureStorage, false /* don't destruct */}
+}
+
+func (c *Client) unmarshal(state *disk.State) error {
+	c.Server = *state.Server
+
+	if len(state.Identity) != len(c.identity) {
+		return errors.New("client: identity is wrong length in State")
+	}
+	copy(c.identity[:], state.Identity)
+	curve25519.ScalarBaseMult(&c.IdentityPublic, &c.identity)
+
+	group, ok := new(bbssig.Group).Unmarshal(state.Group)
+	if !ok {
+		return errors.New("client: failed to unmarshal group")
+	}
+	c.groupPriv, ok = new(bbssig.PrivateKey).Unmarshal(group, state.GroupPrivate)
+	if !ok {
+		return errors.New("client: failed to unmarshal group private key")
+	}
+
+	if len(state.Private) != len(c.priv) {
+		return errors.New("client: failed to unmarshal private key")
+	}
+	copy(c.priv[:], state.Private)
+	if len(state.Public) != len(c.Pub) {
+		return errors.New("client: failed to unmarshal public key")
+	}
+	copy(c.Pub[:], state.Public)
+	c.Generation = *state.Generation
+
+	if state.LastErasureStorageTime != nil {
+		c.LastErasureStorageTime = time.Unix(*state.LastErasureStorageTime, 0)
+	}
+
+	c.network.Unmarshal(state.Network)
+	c.unmarshalServerFailures(state.Network.GetServerFailures())
+
+	for _, prevGroupPriv := range state.PreviousGroupPrivateKeys {
+		group, ok := new(bbssig.Group).Unmarshal(prevGroupPriv.Group)
+		if !ok {
+			return errors.New("client: failed to unmarshal previous group")
+		}
+		priv, ok := new(bbssig.PrivateKey).Unmarshal(group, prevGroupPriv.GroupPrivate)
+		if !ok {
+			return errors.New("client: failed to unmarshal previous group private key")
+		}
+		c.prevGroupPrivs = append(c.prevGroupPrivs, previousGroupPrivateKey{
+			priv:    priv,
+			expired: time.Unix(*prevGroupPriv.Expired, 0),
+		})
+	}
+
+	for _, cont := range state.Contacts {
+		contact := &Contact{
+			Id:               *cont.Id,
+			Name:             *cont.Name,
+			KxsBytes:         cont.KeyExchangeBytes,
+			PandaKeyExchange: cont.PandaKeyExchange,
+			PandaResult:      cont.GetPandaError(),
+			RevokedUs:        cont.GetRevokedUs(),
+			InboxRetention:   unmarshalRetention(cont.InboxRetention),
+			OutboxRetention:  unmarshalRetention(cont.OutboxRetention),
+		}
+		c.registerId(contact.Id)
+		c.Contacts[contact.Id] = contact
+		if contact.groupKey, ok = new(bbssig.MemberKey).Unmarshal(c.groupPriv.Group, cont.GroupKey); !ok {
+			return errors.New("client: failed to unmarshal group member key")
+		}
+		copy(contact.lastDHPrivate[:], cont.LastPrivate)
+		copy(contact.CurrentDHPrivate[:], cont.CurrentPrivate)
+
+		if cont.Ratchet != nil {
+			contact.ratchet = c.newRatchet(contact)
+			if err := contact.ratchet.Unmarshal(cont.Ratchet); err != nil {
+				return err
+			}
+		}
+
+		if cont.IsPending != nil && *cont.IsPending {
+			contact.IsPending = true
+			continue
+		}
+
+		theirGroup, ok := new(bbssig.Group).Unmarshal(cont.TheirGroup)
+		if !ok {
+			return errors.New("client: failed to unmarshal their group")
+		}
+		if contact.myGroupKey, ok = new(bbssig.MemberKey).Unmarshal(theirGroup, cont.MyGroupKey); !ok {
+			return errors.New("client: failed to unmarshal my group key")
+		}
+
+		if cont.TheirServer == nil {
+			return errors.New("client: contact missing server")
+		}
+		contact.TheirServer = *cont.TheirServer
+
+		if len(cont.TheirPub) != len(contact.TheirPub) {
+			return errors.New("client: contact missing public key")
+		}
+		copy(contact.TheirPub[:], cont.TheirPub)
+
+		if len(cont.TheirIdentityPublic) != len(contact.TheirIdentityPublic) {
+			return errors.New("client: contact missing identity public key")
+		}
+		copy(contact.TheirIdentityPublic[:], cont.TheirIdentityPublic)
+
+		copy(contact.TheirLastDHPublic[:], cont.TheirLastPublic)
+		copy(contact.TheirCurrentDHPublic[:], cont.TheirCurrentPublic)
+
+		for _, prevTag := range cont.PreviousTags {
+			contact.previousTags = append(contact.previousTags, previousTag{
+				tag:     prevTag.Tag,
+				expired: time.Unix(*prevTag.Expired, 0),
+			})
+		}
+
+		// For now we'll have to do this conditionally until everyone
+		// has updated local state.
+		if cont.Generation != nil {
+			contact.Generation = *cont.Generation
+		}
+		if cont.SupportedVersion != nil {
+			contact.SupportedVersion = *cont.SupportedVersion
+		}
+
+		contact.Events = make([]Event, 0, len(cont.Events))
+		for _, evt := range cont.Events {
+			event := Event{
+				T:   time.Unix(*evt.Time, 0),
+				Msg: *evt.Message,
+			}
+			contact.Events = append(contact.Events, event)
+		}
+	}
+
+	now := c.Now()
+	for _, m := range state.Inbox {
+		msg := &InboxMessage{
+			Id:           *m.Id,
+			From:         *m.From,
+			ReceivedTime: time.Unix(*m.ReceivedTime, 0),
+			Acked:        *m.Acked,
+			Read:         *m.Read,
+			Sealed:       m.Sealed,
+			Retained:     m.GetRetained(),
+			ExposureTime: now,
+		}
+		if m.ReadTime != nil {
+			msg.ReadTime = time.Unix(*m.ReadTime, 0)
+		} else if msg.Read {
+			// Messages that were read before read times were
+			// recorded are treated as having just been read.
+			msg.ReadTime = now
+		}
+		msg.PartIds = m.PartIds
+		c.registerId(msg.Id)
+		if len(m.Message) > 0 {
+			msg.Message = new(pond.Message)
+			if err := proto.Unmarshal(m.Message, msg.Message); err != nil {
+				return errors.New("client: corrupt message in inbox: " + err.Error())
+			}
+		}
+
+		if m.GetHeld() {
+			c.HeldParts = append(c.HeldParts, msg)
+			continue
+		}
+		c.Inbox = append(c.Inbox, msg)
+	}
+
+	for _, m := range state.Outbox {
+		msg := &QueuedMessage{
+			Id:      *m.Id,
+			To:      *m.To,
+			Server:  *m.Server,
+			Created: time.Unix(*m.Created, 0),
+		}
+		if m.GetPartOf() != msg.Id {
+			// The first part of a message has the same id as
+			// the whole.
+			c.registerId(msg.Id)
+		}
+		if len(m.Message) > 0 {
+			msg.Message = new(pond.Message)
+			if err := proto.Unmarshal(m.Message, msg.Message); err != nil {
+				return errors.New("client: corrupt message in outbox: " + err.Error())
+			}
+		}
+		if m.Sent != nil {
+			msg.Sent = time.Unix(*m.Sent, 0)
+		}
+		if m.Acked != nil {
+			msg.Acked = time.Unix(*m.Acked, 0)
+		}
+		if len(m.Request) != 0 {
+			msg.request = new(pond.Request)
+			if err := proto.Unmarshal(m.Request, msg.request); err != nil {
+				return errors.New("client: corrupt request in outbox: " + err.Error())
+			}
+		}
+		msg.Revocation = m.GetRevocation()
+		msg.FanoutId = m.GetFanoutId()
+		if m.NotBefore != nil {
+			msg.NotBefore = time.Unix(*m.NotBefore, 0)
+		}
+		msg.Undeliverable = m.GetUndeliverable()
+		if msg.Revocation && len(msg.Server) == 0 {
+			// There was a bug in some versions where revoking a
+			// pending contact would result in a revocation message
+			// with an empty server.
+			msg.Server = c.Server
+		}
+
+		if m.PartOf != nil {
+			// Parts are saved after the message that they're
+			// part of.
+			if len(c.Outbox) == 0 || c.Outbox[len(c.Outbox)-1].Id != *m.PartOf {
+				return errors.New("client: part of unknown message in outbox")
+			}
+			whole := c.Outbox[len(c.Outbox)-1]
+			whole.Parts = append(whole.Parts, msg)
+			continue
+		}
+		c.Outbox = append(c.Outbox, msg)
+	}
+
+	for _, msg := range c.Outbox {
+		for _, m := range msg.transmissions() {
+			if m.Sent.IsZero() && (m.To == 0 || !c.Contacts[m.To].RevokedUs) {
+				// This message hasn't been sent yet.
+				if m.NotBefore.After(now) {
+					c.schedule(m)
+				} else {
+					c.enqueue(m)
+				}
+			}
+		}
+	}
+
+	for _, m := range state.Drafts {
+		draft := &Draft{
+			Id:          *m.Id,
+			Body:        *m.Body,
+			Attachments: m.Attachments,
+			Detachments: m.Detachments,
+			Created:     time.Unix(*m.Created, 0),
+		}
+		c.registerId(draft.Id)
+		if m.To != nil {
+			draft.To = *m.To
+		}
+		if m.InReplyTo != nil {
+			draft.InReplyTo = *m.InReplyTo
+		}
+		for _, id := range m.AlsoTo {
+			if _, ok := c.Contacts[id]; ok {
+				draft.AddRecipient(id)
+			}
+		}
+		draft.Expiry = time.Duration(m.GetExpiry()) * time.Second
+		if m.SendAfter != nil {
+			draft.SendAfter = time.Unix(*m.SendAfter, 0)
+		}
+		draft.SendDelay = time.Duration(m.GetSendDelay()) * time.Second
+		draft.SendWhenUploaded = m.GetSendWhenUploaded()
+
+		c.Drafts[draft.Id] = draft
+	}
+
+	c.unmarshalContactGroups(state.ContactGroups)
+	c.unmarshalTransfers(state.Transfers)
+	c.unmarshalHooks(state.Hooks)
+
+	c.SearchIndex = newSearchIndex()
+	c.refreshSearchIndex()
+
+	return nil
+}
+
+func (c *Client) marshal() []byte {
+	var err error
+	var contacts []*disk.Contact
+
+	for _, contact := range c.Contacts {
+		cont := &disk.Contact{
+			Id:               proto.Uint64(contact.Id),
+			Name:             proto.String(contact.Name),
+			GroupKey:         contact.groupKey.Marshal(),
+			IsPending:        proto.Bool(contact.IsPending),
+			KeyExchangeBytes: contact.KxsBytes,
+			LastPrivate:      contact.lastDHPrivate[:],
+			CurrentPrivate:   contact.CurrentDHPrivate[:],
+			SupportedVersion: proto.Int32(contact.SupportedVersion),
+			PandaKeyExchange: contact.PandaKeyExchange,
+			PandaError:       proto.String(contact.PandaResult),
+			RevokedUs:        proto.Bool(contact.RevokedUs),
+			InboxRetention:   contact.InboxRetention.marshal(),
+			OutboxRetention:  contact.OutboxRetention.marshal(),
+		}
+		if !contact.IsPending {
+			cont.MyGroupKey = contact.myGroupKey.Marshal()
+			cont.TheirGroup = contact.myGroupKey.Group.Marshal()
+			cont.TheirServer = proto.String(contact.TheirServer)
+			cont.TheirPub = contact.TheirPub[:]
+			cont.Generation = proto.Uint32(contact.Generation)
+
+			cont.TheirIdentityPublic = contact.TheirIdentityPublic[:]
+			cont.TheirLastPublic = contact.TheirLastDHPublic[:]
+			cont.TheirCurrentPublic = contact.TheirCurrentDHPublic[:]
+		}
+		if contact.ratchet != nil {
+			cont.Ratchet = contact.ratchet.Marshal(time.Now(), MessageLifetime)
+		}
+		for _, prevTag := range contact.previousTags {
+			if time.Since(prevTag.expired) > previousTagLifetime {
+				continue
+			}
+			cont.PreviousTags = append(cont.PreviousTags, &disk.Contact_PreviousTag{
+				Tag:     prevTag.tag,
+				Expired: proto.Int64(prevTag.expired.Unix()),
+			})
+		}
+		cont.Events = make([]*disk.Contact_Event, 0, len(contact.Events))
+		for _, event := range contact.Events {
+			if time.Since(event.T) > MessageLifetime {
+				continue
+			}
+			cont.Events = append(cont.Events, &disk.Contact_Event{
+				Time:    proto.Int64(event.T.Unix()),
+				Message: proto.String(event.Msg),
+			})
+		}
+		contacts = append(contacts, cont)
+	}
+
+	var inbox []*disk.Inbox
+	for _, msg := range c.Inbox {
+		if c.InboxExpired(msg, time.Now()) {
+			continue
+		}
+		inbox = append(inbox, marshalInbox(msg))
+	}
+	for _, msg := range c.HeldParts {
+		// The parts of a message that never arrives in full are
+		// eventually dropped.
+		if time.Since(msg.ReceivedTime) > MessageLifetime {
+			continue
+		}
+		m := marshalInbox(msg)
+		m.Held = proto.Bool(true)
+		inbox = append(inbox, m)
+	}
+
+	var outbox []*disk.Outbox
+	for _, msg := range c.Outbox {
+		if c.outboxExpired(msg, time.Now()) {
+			continue
+		}
+		outbox = append(outbox, marshalOutbox(msg))
+		for _, part := range msg.Parts {
+			m := marshalOutbox(part)
+			m.PartOf = proto.Uint64(msg.Id)
+			outbox = append(outbox, m)
+		}
+	}
+
+	var drafts []*disk.Draft
+	for _, draft := range c.Drafts {
+		m := &disk.Draft{
+			Id:          proto.Uint64(draft.Id),
+			Body:        proto.String(draft.Body),
+			Attachments: draft.Attachments,
+			Detachments: draft.Detachments,
+			Created:     proto.Int64(draft.Created.Unix()),
+		}
+		if draft.To != 0 {
+			m.To = proto.Uint64(draft.To)
+		}
+		m.AlsoTo = draft.AlsoTo
+		if draft.InReplyTo != 0 {
+			m.InReplyTo = proto.Uint64(draft.InReplyTo)
+		}
+		if draft.Expiry != 0 {
+			m.Expiry = proto.Int64(int64(draft.Expiry / time.Second))
+		}
+		if !draft.SendAfter.IsZero() {
+			m.SendAfter = proto.Int64(draft.SendAfter.Unix())
+		}
+		if draft.SendDelay != 0 {
+			m.SendDelay = proto.Int64(int64(draft.SendDelay / time.Second))
+		}
+		if draft.SendWhenUploaded {
+			m.SendWhenUploaded = proto.Bool(true)
+		}
+
+		drafts = append(drafts, m)
+	}
+
+	network := c.network.Marshal()
+	if failures := c.marshalServerFailures(); len(failures) > 0 {
+		if network == nil {
+			network = new(disk.NetworkConfig)
+		}
+		network.ServerFailures = failures
+	}
+
+	state := &disk.State{
+		Private:                c.priv[:],
+		Public:                 c.Pub[:],
+		Identity:               c.identity[:],
+		Server:                 proto.String(c.Server),
+		Group:                  c.groupPriv.Group.Marshal(),
+		GroupPrivate:           c.groupPriv.Marshal(),
+		Generation:             proto.Uint32(c.Generation),
+		Contacts:               contacts,
+		Inbox:                  inbox,
+		Outbox:                 outbox,
+		Drafts:                 drafts,
+		LastErasureStorageTime: proto.Int64(c.LastErasureStorageTime.Unix()),
+		Network:                network,
+		ContactGroups:          c.marshalContactGroups(),
+		Transfers:              c.marshalTransfers(),
+		Hooks:                  c.marshalHooks(),
+	}
+	for _, prevGroupPriv := range c.prevGroupPrivs {
+		if time.Since(prevGroupPriv.expired) > previousTagLifetime {
+			continue
+		}
+
+		state.PreviousGroupPrivateKeys = append(state.PreviousGroupPrivateKeys, &disk.State_PreviousGroup{
+			Group:        prevGroupPriv.priv.Group.Marshal(),
+			GroupPrivate: prevGroupPriv.priv.Marshal(),
+			Expired:      proto.Int64(prevGroupPriv.expired.Unix()),
+		})
+	}
+	s, err := proto.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// marshalInbox returns the form of an inbox message that's saved in the state
+// file.
+func marshalInbox(msg *InboxMessage) *disk.Inbox {
+	var err error
+	m := &disk.Inbox{
+		Id:           proto.Uint64(msg.Id),
+		From:         proto.Uint64(msg.From),
+		ReceivedTime: proto.Int64(msg.ReceivedTime.Unix()),
+		Acked:        proto.Bool(msg.Acked),
+		Read:         proto.Bool(msg.Read),
+		Sealed:       msg.Sealed,
+		Retained:     proto.Bool(msg.Retained),
+		PartIds:      msg.PartIds,
+	}
+	if !msg.ReadTime.IsZero() {
+		m.ReadTime = proto.Int64(msg.ReadTime.Unix())
+	}
+	if msg.Message != nil {
+		if m.Message, err = proto.Marshal(msg.Message); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// marshalOutbox returns the form of an outbox message that's saved in the
+// state file.
+func marshalOutbox(msg *QueuedMessage) *disk.Outbox {
+	var err error
+	m := &disk.Outbox{
+		Id:         proto.Uint64(msg.Id),
+		To:         proto.Uint64(msg.To),
+		Server:     proto.String(msg.Server),
+		Created:    proto.Int64(msg.Created.Unix()),
+		Revocation: proto.Bool(msg.Revocation),
+	}
+	if msg.FanoutId != 0 {
+		m.FanoutId = proto.Uint64(msg.FanoutId)
+	}
+	if !msg.NotBefore.IsZero() {
+		m.NotBefore = proto.Int64(msg.NotBefore.Unix())
+	}
+	if msg.Undeliverable {
+		m.Undeliverable = proto.Bool(true)
+	}
+	if msg.Message != nil {
+		if m.Message, err = proto.Marshal(msg.Message); err != nil {
+			panic(err)
+		}
+	}
+	if !msg.Sent.IsZero() {
+		m.Sent = proto.Int64(msg.Sent.Unix())
+	}
+	if !msg.Acked.IsZero() {
+		m.Acked = proto.Int64(msg.Acked.Unix())
+	}
+	if msg.request != nil {
+		if m.Request, err = proto.Marshal(msg.request); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
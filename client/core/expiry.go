@@ -0,0 +1,161 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// minExpiry is the shortest expiry that can be set on a draft. Since the GUI
+// only checks for expired messages every minute, anything shorter would be
+// misleading.
+const minExpiry = time.Minute
+
+// maxExpiry is the longest expiry that can be set on a draft. The sender
+// doesn't know how long a recipient keeps messages from them, which may be
+// up to maxRetentionDays, or forever, so longer expiries can still be
+// meaningful.
+const maxExpiry = maxRetentionDays * 24 * time.Hour
+
+// expiryChoices are offered in the GUI when composing a message. A zero
+// duration means that the recipient's default applies.
+var expiryChoices = []struct {
+	label  string
+	expiry time.Duration
+}{
+	{"Default", 0},
+	{"10 minutes", 10 * time.Minute},
+	{"1 hour", time.Hour},
+	{"1 day", 24 * time.Hour},
+	{"3 days", 3 * 24 * time.Hour},
+}
+
+// ValidateExpiry returns an error if d is not a valid expiry for a draft.
+func ValidateExpiry(d time.Duration) error {
+	switch {
+	case d == 0:
+		return nil
+	case d < minExpiry:
+		return errors.New("expiry must be at least " + FormatDuration(minExpiry))
+	case d > maxExpiry:
+		return errors.New("expiry must be at most " + FormatDuration(maxExpiry))
+	}
+	return nil
+}
+
+// ParseExpiry parses an expiry given on the command line. It accepts "none",
+// a number of days such as "2d", or anything that time.ParseDuration accepts.
+func ParseExpiry(s string) (time.Duration, error) {
+	if s == "none" {
+		return 0, nil
+	}
+
+	d, err := ParseDays(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.New("expiry must be positive")
+	}
+	return d, ValidateExpiry(d)
+}
+
+// FormatDuration returns a short, human readable description of d, to the
+// minute.
+func FormatDuration(d time.Duration) string {
+	if d < time.Minute {
+		return "less than a minute"
+	}
+
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+
+	var parts []string
+	if days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if hours > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", hours))
+	}
+	if minutes > 0 {
+		parts = append(parts, fmt.Sprintf("%dm", minutes))
+	}
+	return strings.Join(parts, " ")
+}
+
+// requestedExpiry returns the lifetime that the sender requested for the
+// message, or zero if they didn't request one.
+func (msg *InboxMessage) requestedExpiry() time.Duration {
+	if msg.Message == nil {
+		return 0
+	}
+	seconds := msg.Message.GetExpiry()
+	if seconds <= 0 || seconds > int64(maxExpiry/time.Second) {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// SenderExpiry returns the lifetime that the sender requested for the message,
+// or zero if they didn't request one or if the retention policy for the
+// sender would erase the message no later anyway.
+func (c *Client) SenderExpiry(msg *InboxMessage) time.Duration {
+	expiry := msg.requestedExpiry()
+	if expiry == 0 {
+		return 0
+	}
+	if eraseTime, ok := c.inboxPolicyEraseTime(msg); ok && !msg.ReceivedTime.Add(expiry).Before(eraseTime) {
+		return 0
+	}
+	return expiry
+}
+
+// ExpiryCountdown describes the time remaining until a message with a sender
+// specified expiry is erased. It returns the empty string for other messages.
+func (c *Client) ExpiryCountdown(msg *InboxMessage, now time.Time) string {
+	if c.SenderExpiry(msg) == 0 {
+		return ""
+	}
+	if msg.Retained {
+		return "retained despite the sender's request to erase it"
+	}
+	eraseTime, _ := c.InboxEraseTime(msg)
+	return "erased in " + FormatDuration(eraseTime.Sub(now)) + " at the sender's request"
+}
+
+// ExpiryWarning is shown when the user tries to retain a message that has a
+// sender specified expiry.
+func (msg *InboxMessage) ExpiryWarning() string {
+	return fmt.Sprintf("The sender asked for this message to be erased after %s. Retaining it keeps it until you choose otherwise, against the sender's wishes.", FormatDuration(msg.requestedExpiry()))
+}
+
+// ExpiryLabels returns the labels for the expiry choices that are offered
+// for a draft, including the draft's current expiry, and the label of the
+// current expiry.
+func ExpiryLabels(current time.Duration) (labels []string, selected string) {
+	for _, choice := range expiryChoices {
+		labels = append(labels, choice.label)
+		if choice.expiry == current {
+			selected = choice.label
+		}
+	}
+	if len(selected) == 0 {
+		selected = FormatDuration(current)
+		labels = append(labels, selected)
+	}
+	return
+}
+
+// ExpiryForLabel returns the expiry for a label returned by ExpiryLabels.
+func ExpiryForLabel(label string, current time.Duration) time.Duration {
+	for _, choice := range expiryChoices {
+		if choice.label == label {
+			return choice.expiry
+		}
+	}
+	return current
+}
@@ -0,0 +1,240 @@
+package core
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/agl/pond/client/disk"
+	"github.com/golang/protobuf/proto"
+)
+
+// GroupLabelPrefix is prepended to group names when they are offered as
+// recipients alongside contacts in the GUI.
+const GroupLabelPrefix = "Group: "
+
+// Recipients returns the ids of all the contacts that the draft is addressed
+// to.
+func (draft *Draft) Recipients() []uint64 {
+	if draft.To == 0 {
+		return nil
+	}
+	return append([]uint64{draft.To}, draft.AlsoTo...)
+}
+
+// IsAddressedTo returns true if the given contact is a recipient of the
+// draft.
+func (draft *Draft) IsAddressedTo(id uint64) bool {
+	for _, recipient := range draft.Recipients() {
+		if recipient == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRecipients replaces the recipients of the draft.
+func (draft *Draft) SetRecipients(ids []uint64) {
+	draft.To = 0
+	draft.AlsoTo = nil
+	for _, id := range ids {
+		draft.AddRecipient(id)
+	}
+}
+
+// AddRecipient adds a contact to the recipients of the draft, if it's not
+// already included.
+func (draft *Draft) AddRecipient(id uint64) {
+	if draft.To == 0 {
+		draft.To = id
+		return
+	}
+	if draft.To == id {
+		return
+	}
+	for _, existing := range draft.AlsoTo {
+		if existing == id {
+			return
+		}
+	}
+	draft.AlsoTo = append(draft.AlsoTo, id)
+}
+
+// RemoveRecipient removes a contact from the recipients of the draft.
+func (draft *Draft) RemoveRecipient(id uint64) {
+	ids := draft.Recipients()
+	for i, existing := range ids {
+		if existing == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	draft.SetRecipients(ids)
+}
+
+// RecipientNames returns a description of the recipients of draft.
+func (c *Client) RecipientNames(draft *Draft) string {
+	var names []string
+	for _, id := range draft.Recipients() {
+		if contact, ok := c.Contacts[id]; ok {
+			names = append(names, contact.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "Unknown"
+	}
+	return strings.Join(names, ", ")
+}
+
+// GroupNames returns the names of all contact groups in order.
+func (c *Client) GroupNames() []string {
+	names := make([]string, 0, len(c.ContactGroups))
+	for name := range c.ContactGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GroupRecipients returns the ids of the members of a group that messages
+// can be sent to.
+func (c *Client) GroupRecipients(group string) []uint64 {
+	var ids []uint64
+	for _, id := range c.ContactGroups[group] {
+		if contact, ok := c.Contacts[id]; ok && !contact.IsPending && !contact.RevokedUs {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// AddToGroup adds a contact to a group, creating the group if needed.
+func (c *Client) AddToGroup(group string, contact *Contact) error {
+	if len(group) == 0 {
+		return errors.New("group name is empty")
+	}
+	if c.ContactGroups == nil {
+		c.ContactGroups = make(map[string][]uint64)
+	}
+	for _, id := range c.ContactGroups[group] {
+		if id == contact.Id {
+			return errors.New(contact.Name + " is already a member of " + group)
+		}
+	}
+	c.ContactGroups[group] = append(c.ContactGroups[group], contact.Id)
+	return nil
+}
+
+// RemoveFromGroup removes a contact from a group. Groups are deleted once
+// they are empty.
+func (c *Client) RemoveFromGroup(group string, contact *Contact) error {
+	members, ok := c.ContactGroups[group]
+	if !ok {
+		return errors.New("no such group: " + group)
+	}
+	for i, id := range members {
+		if id == contact.Id {
+			members = append(members[:i], members[i+1:]...)
+			if len(members) == 0 {
+				delete(c.ContactGroups, group)
+			} else {
+				c.ContactGroups[group] = members
+			}
+			return nil
+		}
+	}
+	return errors.New(contact.Name + " is not a member of " + group)
+}
+
+// removeFromAllGroups is called when a contact is deleted.
+func (c *Client) removeFromAllGroups(contact *Contact) {
+	for group, members := range c.ContactGroups {
+		for _, id := range members {
+			if id == contact.Id {
+				c.RemoveFromGroup(group, contact)
+				break
+			}
+		}
+	}
+}
+
+// ResolveRecipients returns the ids of the contacts named by name, which is
+// either the name of a contact or of a group. Contact names take precedence.
+func (c *Client) ResolveRecipients(name string) ([]uint64, error) {
+	for _, contact := range c.Contacts {
+		if contact.Name != name {
+			continue
+		}
+		if contact.IsPending {
+			return nil, errors.New("cannot send message to pending contact")
+		}
+		return []uint64{contact.Id}, nil
+	}
+	if _, ok := c.ContactGroups[name]; ok {
+		ids := c.GroupRecipients(name)
+		if len(ids) == 0 {
+			return nil, errors.New("group " + name + " doesn't contain any contacts that can receive messages")
+		}
+		return ids, nil
+	}
+	return nil, errors.New("no such contact or group: " + name)
+}
+
+// FanoutCopies returns all the copies of a message that was sent to several
+// contacts. For other messages it returns just msg.
+func (c *Client) FanoutCopies(msg *QueuedMessage) []*QueuedMessage {
+	if msg.FanoutId == 0 {
+		return []*QueuedMessage{msg}
+	}
+	var copies []*QueuedMessage
+	for _, candidate := range c.Outbox {
+		if candidate.FanoutId == msg.FanoutId {
+			copies = append(copies, candidate)
+		}
+	}
+	return copies
+}
+
+// DeliveryStatus describes the progress of an outbox message.
+func (c *Client) DeliveryStatus(msg *QueuedMessage) string {
+	// The contact may have been deleted while the message is still listed.
+	contact, ok := c.Contacts[msg.To]
+
+	switch {
+	case !msg.Acked.IsZero():
+		return "acknowledged " + FormatTime(msg.Acked)
+	case !msg.Sent.IsZero():
+		return "sent " + FormatTime(msg.Sent)
+	case ok && contact.RevokedUs:
+		return "never - contact has revoked us"
+	case msg.Undeliverable:
+		return "undeliverable - server keeps failing"
+	}
+	return "queued"
+}
+
+func (c *Client) marshalContactGroups() []*disk.ContactGroup {
+	var groups []*disk.ContactGroup
+	for _, name := range c.GroupNames() {
+		groups = append(groups, &disk.ContactGroup{
+			Name:     proto.String(name),
+			Contacts: c.ContactGroups[name],
+		})
+	}
+	return groups
+}
+
+func (c *Client) unmarshalContactGroups(groups []*disk.ContactGroup) {
+	c.ContactGroups = make(map[string][]uint64)
+	for _, group := range groups {
+		var members []uint64
+		for _, id := range group.Contacts {
+			if _, ok := c.Contacts[id]; ok {
+				members = append(members, id)
+			}
+		}
+		if len(members) > 0 {
+			c.ContactGroups[group.GetName()] = members
+		}
+	}
+}
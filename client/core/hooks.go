@@ -0,0 +1,222 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/agl/pond/client/disk"
+	"github.com/golang/protobuf/proto"
+)
+
+// The events for which hook commands can be configured.
+const (
+	HookReceived   = "received"
+	HookDelivered  = "delivered"
+	HookAcked      = "acked"
+	hookPANDA      = "key-exchange"
+	hookRevocation = "revocation"
+	HookEraseSoon  = "erase-soon"
+)
+
+// HookEvents lists the names of all the events, and describes them.
+var HookEvents = []struct {
+	Name, Description string
+}{
+	{HookReceived, "a message is received"},
+	{HookDelivered, "a message is delivered to the recipient's server"},
+	{HookAcked, "a message is acknowledged by the recipient"},
+	{hookPANDA, "a shared-secret key exchange completes or fails"},
+	{hookRevocation, "a contact revokes us"},
+	{HookEraseSoon, "an inbox message will be erased soon"},
+}
+
+// hook is a command that's run when an event occurs. A JSON description of
+// the event is written to its standard input.
+type hook struct {
+	Command string
+	// IncludeBody is true if the description of events for which there's
+	// a message should include its body.
+	IncludeBody bool
+}
+
+// HookPayload is the description of an event that's given to a hook command.
+// Times are formatted as RFC 3339.
+type HookPayload struct {
+	Event     string `json:"event"`
+	Contact   string `json:"contact,omitempty"`
+	ContactId uint64 `json:"contact_id,omitempty"`
+	// Id is the id of the message in the inbox or outbox and MessageId
+	// is the id that was transmitted.
+	Id        uint64 `json:"id,omitempty"`
+	MessageId uint64 `json:"message_id,omitempty"`
+	Time      string `json:"time"`
+	Sent      string `json:"sent,omitempty"`
+	Received  string `json:"received,omitempty"`
+	Acked     string `json:"acked,omitempty"`
+	EraseTime string `json:"erase_time,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Body      string `json:"body,omitempty"`
+}
+
+// formatHookTime formats t for a HookPayload. The zero time is formatted as
+// the empty string.
+func formatHookTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// isHookEvent returns true if event is the name of an event.
+func isHookEvent(event string) bool {
+	for _, e := range HookEvents {
+		if e.Name == event {
+			return true
+		}
+	}
+	return false
+}
+
+// SetHook sets the command that's run for event. An empty command removes
+// the hook.
+func (c *Client) SetHook(event, command string, includeBody bool) error {
+	if !isHookEvent(event) {
+		var names []string
+		for _, e := range HookEvents {
+			names = append(names, e.Name)
+		}
+		return errors.New("unknown event. Events are " + strings.Join(names, ", "))
+	}
+	if len(command) == 0 {
+		delete(c.Hooks, event)
+		return nil
+	}
+	if c.Hooks == nil {
+		c.Hooks = make(map[string]*hook)
+	}
+	c.Hooks[event] = &hook{Command: command, IncludeBody: includeBody}
+	return nil
+}
+
+// runHook runs the command, if any, that's configured for an event. The
+// command runs in the background and any body in payload is removed unless
+// the hook has opted in to receiving it. For compatibility, the command in
+// POND_HOOK_RECEIVE is run for received messages if no hook is configured.
+func (c *Client) runHook(event string, payload *HookPayload) {
+	h, ok := c.Hooks[event]
+	if !ok && event == HookReceived && len(c.receiveHookCommand) > 0 {
+		h, ok = &hook{Command: c.receiveHookCommand}, true
+	}
+	if !ok {
+		return
+	}
+
+	payload.Event = event
+	payload.Time = formatHookTime(c.Now())
+	if !h.IncludeBody {
+		payload.Body = ""
+	}
+	input, err := json.Marshal(payload)
+	if err != nil {
+		panic(err)
+	}
+	input = append(input, '\n')
+
+	cmd := exec.Command(h.Command)
+	cmd.Stdin = bytes.NewReader(input)
+	go func() {
+		if err := cmd.Run(); err != nil {
+			c.Log.Errorf("Failed to run %s hook command: %s", event, err.Error())
+		}
+	}()
+}
+
+// inboxHookPayload returns the description of an event for an inbox message.
+func (c *Client) inboxHookPayload(msg *InboxMessage) *HookPayload {
+	payload := &HookPayload{
+		Contact:   c.ContactName(msg.From),
+		ContactId: msg.From,
+		Id:        msg.Id,
+		Received:  formatHookTime(msg.ReceivedTime),
+	}
+	if msg.Message != nil {
+		payload.MessageId = msg.Message.GetId()
+		payload.Sent = formatHookTime(time.Unix(msg.Message.GetTime(), 0))
+		payload.Body = string(msg.Message.Body)
+	}
+	return payload
+}
+
+// outboxHookPayload returns the description of an event for an outbox
+// message.
+func (c *Client) outboxHookPayload(msg *QueuedMessage) *HookPayload {
+	payload := &HookPayload{
+		Contact:   c.ContactName(msg.To),
+		ContactId: msg.To,
+		Id:        msg.Id,
+		MessageId: msg.Id,
+		Sent:      formatHookTime(msg.Sent),
+		Acked:     formatHookTime(msg.Acked),
+	}
+	if msg.Message != nil {
+		payload.Body = string(msg.Message.Body)
+	}
+	return payload
+}
+
+// runEraseSoonHooks runs the hook for inbox messages that have come to be
+// erased soon. It's run at most once for each message in each session.
+func (c *Client) runEraseSoonHooks(now time.Time) {
+	for _, msg := range c.Inbox {
+		if msg.eraseSoonHookRun || msg.Message == nil || !c.InboxEraseSoon(msg, now) {
+			continue
+		}
+		msg.eraseSoonHookRun = true
+		payload := c.inboxHookPayload(msg)
+		if eraseTime, ok := c.InboxEraseTime(msg); ok {
+			payload.EraseTime = formatHookTime(eraseTime)
+		}
+		c.runHook(HookEraseSoon, payload)
+	}
+}
+
+// HookNames returns the names of the events that have hooks, sorted.
+func (c *Client) HookNames() []string {
+	var names []string
+	for name := range c.Hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Client) marshalHooks() []*disk.Hook {
+	var hooks []*disk.Hook
+	for _, name := range c.HookNames() {
+		h := c.Hooks[name]
+		m := &disk.Hook{
+			Event:   proto.String(name),
+			Command: proto.String(h.Command),
+		}
+		if h.IncludeBody {
+			m.IncludeBody = proto.Bool(true)
+		}
+		hooks = append(hooks, m)
+	}
+	return hooks
+}
+
+func (c *Client) unmarshalHooks(hooks []*disk.Hook) {
+	c.Hooks = make(map[string]*hook)
+	for _, m := range hooks {
+		c.Hooks[m.GetEvent()] = &hook{
+			Command:     m.GetCommand(),
+			IncludeBody: m.GetIncludeBody(),
+		}
+	}
+}
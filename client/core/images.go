@@ -1,4 +1,4 @@
-package main
+package core
 
 import (
 	"strconv"
@@ -7,15 +7,15 @@ import (
 type Indicator int
 
 const (
-	indicatorNone Indicator = iota
-	indicatorRed
-	indicatorYellow
-	indicatorGreen
-	indicatorBlue
-	indicatorBlack
-	indicatorRemove
-	indicatorAdd
-	indicatorCount
+	IndicatorNone Indicator = iota
+	IndicatorRed
+	IndicatorYellow
+	IndicatorGreen
+	IndicatorBlue
+	IndicatorBlack
+	IndicatorRemove
+	IndicatorAdd
+	IndicatorCount
 )
 
 func starWithColor(xtermColorNum int) string {
@@ -25,15 +25,15 @@ func starWithColor(xtermColorNum int) string {
 // Star returns a colored star for the given indicator
 func (i Indicator) Star() string {
 	switch i {
-	case indicatorRed:
+	case IndicatorRed:
 		return starWithColor(160)
-	case indicatorYellow:
+	case IndicatorYellow:
 		return starWithColor(227)
-	case indicatorGreen:
+	case IndicatorGreen:
 		return starWithColor(82)
-	case indicatorBlue:
+	case IndicatorBlue:
 		return starWithColor(57)
-	case indicatorBlack:
+	case IndicatorBlack:
 		return starWithColor(201)
 	}
 
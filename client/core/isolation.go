@@ -0,0 +1,87 @@
+package core
+
+import (
+	"encoding/base32"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// connPurpose identifies the reason for a connection. Tor is asked to keep
+// connections with different purposes, or to different servers, on separate
+// circuits so that an exit or hidden service can't link, say, the fetches
+// from our home server with anonymous deliveries to a contact's server.
+type connPurpose int
+
+const (
+	// PurposeFetch is used for authenticated transactions with our home
+	// server: fetches, account creation and revocations.
+	PurposeFetch connPurpose = iota
+	// PurposeDelivery is used for anonymous deliveries to contacts'
+	// servers.
+	PurposeDelivery
+	// purposeDetachment is used for uploading and downloading detachments.
+	purposeDetachment
+	// purposePANDA is used for connections to a PANDA meeting place.
+	purposePANDA
+)
+
+// IsolationRotation is the interval after which new SOCKS credentials are
+// generated for a given server and purpose, other than deliveries. This
+// matches Tor's default MaxCircuitDirtiness, after which Tor would stop using
+// a circuit for new streams anyway.
+const IsolationRotation = 10 * time.Minute
+
+// isolationKey identifies a class of connections that may share a circuit.
+type isolationKey struct {
+	server  string
+	purpose connPurpose
+}
+
+// isolationToken contains the SOCKS credentials used for an isolationKey.
+type isolationToken struct {
+	auth    proxy.Auth
+	Created time.Time
+}
+
+// IsolationAuth returns the SOCKS credentials to use for a connection to
+// server for the given purpose. Tor puts streams with different credentials
+// on different circuits. Each anonymous delivery gets fresh credentials, and
+// so its own circuit, so that deliveries can't be linked to each other.
+func (c *Client) IsolationAuth(server string, purpose connPurpose) *proxy.Auth {
+	if purpose == PurposeDelivery {
+		return &proxy.Auth{
+			User:     c.randomIsolationString(),
+			Password: c.randomIsolationString(),
+		}
+	}
+
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	key := isolationKey{server, purpose}
+	now := time.Now()
+	token, ok := c.IsolationTokens[key]
+	if !ok || now.Sub(token.Created) >= IsolationRotation || now.Before(token.Created) {
+		token = &isolationToken{
+			auth: proxy.Auth{
+				User:     c.randomIsolationString(),
+				Password: c.randomIsolationString(),
+			},
+			Created: now,
+		}
+		if c.IsolationTokens == nil {
+			c.IsolationTokens = make(map[isolationKey]*isolationToken)
+		}
+		c.IsolationTokens[key] = token
+	}
+
+	auth := token.auth
+	return &auth
+}
+
+func (c *Client) randomIsolationString() string {
+	var b [10]byte
+	c.RandBytes(b[:])
+	return base32.StdEncoding.EncodeToString(b[:])
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type logEntry struct {
+	time.Time
+	IsError bool
+	S       string
+}
+
+type Log struct {
+	sync.Mutex
+	Entries    []logEntry
+	Epoch      uint64
+	UpdateChan chan bool
+	ToStderr   bool
+	// Name is set in tests to an opaque identifer for this client. It's
+	// prepended to log messages in order to aid debugging.
+	Name string
+}
+
+func NewLog() *Log {
+	return &Log{
+		UpdateChan: make(chan bool, 1),
+	}
+}
+
+func (l *Log) Printf(format string, args ...interface{}) {
+	l.add(false, format, args...)
+}
+
+func (l *Log) Errorf(format string, args ...interface{}) {
+	l.add(true, format, args...)
+}
+
+const (
+	// LogLimit is the maximum number of entries in the log.
+	LogLimit = 500
+	// LogSlack is the number of entries past the maximum that we'll allow
+	// before the log is recompacted down to LogLimit enties.
+	LogSlack = 250
+)
+
+func (l *Log) add(isError bool, format string, args ...interface{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	entry := logEntry{
+		time.Now(),
+		isError,
+		fmt.Sprintf(format, args...),
+	}
+	if len(l.Entries) > LogLimit+LogSlack {
+		newEntries := make([]logEntry, LogLimit)
+		copy(newEntries, l.Entries[LogSlack:])
+		l.Entries = newEntries
+		l.Epoch++
+	}
+	l.Entries = append(l.Entries, entry)
+	select {
+	case l.UpdateChan <- true:
+	default:
+	}
+
+	if l.ToStderr {
+		var name string
+		if len(l.Name) != 0 {
+			name = fmt.Sprintf("(%s) ", l.Name)
+		}
+		fmt.Fprintf(os.Stderr, "%s%s: %s\n", name, entry.Format(LogTimeFormat), entry.S)
+	}
+}
+
+func (l *Log) Clear() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.Entries = nil
+	l.Epoch = 0
+}
@@ -0,0 +1,1694 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/agl/pond/bbssig"
+	pond "github.com/agl/pond/protos"
+	"github.com/agl/pond/transport"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	// nonceLen is the length of a NaCl nonce.
+	nonceLen = 24
+	// ephemeralBlockLen is the length of the signcrypted, ephemeral key
+	// used when Contact.SupportedVersion >= 1.
+	ephemeralBlockLen = nonceLen + 32 + box.Overhead
+)
+
+func (c *Client) SendAck(msg *InboxMessage) {
+	// The further parts of a message that was split are acknowledged
+	// along with it.
+	ackIds := append([]uint64{msg.Message.GetId()}, msg.PartIds...)
+
+	// First, see if we can merge this ack with a message to the same
+	// contact that is pending transmission.
+	c.QueueMutex.Lock()
+	for _, queuedMsg := range c.Queue {
+		if queuedMsg.sending {
+			continue
+		}
+		if msg.From == queuedMsg.To && !queuedMsg.Revocation {
+			proto := queuedMsg.Message
+			proto.AlsoAck = append(proto.AlsoAck, ackIds...)
+			if !c.tooLarge(queuedMsg) {
+				c.QueueMutex.Unlock()
+				c.Log.Printf("ACK merged with queued message.")
+				// All done.
+				return
+			}
+
+			proto.AlsoAck = proto.AlsoAck[:len(proto.AlsoAck)-len(ackIds)]
+			if len(proto.AlsoAck) == 0 {
+				proto.AlsoAck = nil
+			}
+		}
+	}
+	c.QueueMutex.Unlock()
+
+	to := c.Contacts[msg.From]
+	var myNextDH []byte
+	if to.ratchet == nil {
+		var nextDHPub [32]byte
+		curve25519.ScalarBaseMult(&nextDHPub, &to.CurrentDHPrivate)
+		myNextDH = nextDHPub[:]
+	}
+
+	id := c.RandId()
+	err := c.send(to, &pond.Message{
+		Id:               proto.Uint64(id),
+		Time:             proto.Int64(time.Now().Unix()),
+		Body:             make([]byte, 0),
+		BodyEncoding:     pond.Message_RAW.Enum(),
+		MyNextDh:         myNextDH,
+		InReplyTo:        msg.Message.Id,
+		AlsoAck:          msg.PartIds,
+		SupportedVersion: proto.Int32(ProtoVersion),
+	})
+	if err != nil {
+		c.Log.Errorf("Error sending message: %s", err)
+	}
+}
+
+// send encrypts |message| and enqueues it for transmission.
+func (c *Client) send(to *Contact, message *pond.Message) error {
+	return c.sendCopy(to, message, 0, time.Time{})
+}
+
+// sendCopy is like send, but for one copy of a message that is being sent to
+// several contacts. All the copies share FanoutId. If NotBefore isn't zero
+// then the message is scheduled, rather than enqueued, for transmission.
+func (c *Client) sendCopy(to *Contact, message *pond.Message, fanoutId uint64, notBefore time.Time) error {
+	messageBytes, err := serializeMessage(to, message)
+	if err != nil {
+		return err
+	}
+
+	if len(messageBytes) > pond.MaxSerializedMessage {
+		return errors.New("message too large")
+	}
+
+	out := &QueuedMessage{
+		Id:        *message.Id,
+		To:        to.Id,
+		Server:    to.TheirServer,
+		Message:   message,
+		Created:   time.Unix(*message.Time, 0),
+		FanoutId:  fanoutId,
+		NotBefore: notBefore,
+	}
+	if notBefore.IsZero() {
+		c.enqueue(out)
+	} else {
+		c.schedule(out)
+	}
+	c.Outbox = append(c.Outbox, out)
+
+	return nil
+}
+
+// SendDraft enqueues a copy of draft for each of its recipients and returns
+// the id of the first copy. If the draft's attachments make it too large to
+// send then they're uploaded to the home server in the background, to be
+// replaced with detachments, and ErrDraftUploading is returned. The draft is
+// then sent once the uploads have finished. A draft whose body is still too
+// long is sent in parts.
+func (c *Client) SendDraft(draft *Draft) (uint64, time.Time, error) {
+	recipients := draft.Recipients()
+	if len(recipients) == 0 {
+		return 0, time.Time{}, errors.New("draft has no recipients")
+	}
+	for _, id := range recipients {
+		to, ok := c.Contacts[id]
+		if !ok {
+			return 0, time.Time{}, errors.New("draft has an unknown recipient")
+		}
+		if to.IsPending {
+			return 0, time.Time{}, errors.New("cannot send message to pending contact " + to.Name)
+		}
+	}
+
+	if err := checkSchedule(draft, c.Now()); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	// Zero length bodies are ACKs.
+	if len(draft.Body) == 0 {
+		draft.Body = " "
+	}
+
+	// Attachments that make the draft too large are uploaded instead.
+	if uploading, err := c.detachLargeAttachments(draft); err != nil {
+		return 0, time.Time{}, err
+	} else if uploading {
+		return 0, time.Time{}, ErrDraftUploading
+	}
+
+	var bodies []string
+	if size, _ := c.draftSize(draft); size > pond.MaxSerializedMessage {
+		var err error
+		if bodies, err = c.splitBody(draft); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+
+	created := c.Now()
+	var fanoutId uint64
+	if len(recipients) > 1 {
+		fanoutId = c.RandId()
+	}
+
+	// All the messages are built before any are enqueued so that a
+	// failure doesn't leave the draft sent to only some recipients.
+	messages := make([]*pond.Message, 0, len(recipients))
+	partsOfMessages := make([][]*pond.Message, 0, len(recipients))
+	for _, id := range recipients {
+		to := c.Contacts[id]
+		message := &pond.Message{
+			Id:               proto.Uint64(c.RandId()),
+			Time:             proto.Int64(created.Unix()),
+			Body:             []byte(draft.Body),
+			BodyEncoding:     pond.Message_RAW.Enum(),
+			Files:            draft.Attachments,
+			DetachedFiles:    draft.Detachments,
+			SupportedVersion: proto.Int32(ProtoVersion),
+		}
+
+		if draft.Expiry != 0 {
+			message.Expiry = proto.Int64(int64(draft.Expiry / time.Second))
+		}
+
+		// A reply references the id of a message from the first
+		// recipient, which is meaningless to anyone else.
+		if r := draft.InReplyTo; r != 0 && id == draft.To {
+			message.InReplyTo = proto.Uint64(r)
+			message.AlsoAck = c.replyAcks(draft)
+		}
+
+		if to.ratchet == nil {
+			var nextDHPub [32]byte
+			curve25519.ScalarBaseMult(&nextDHPub, &to.CurrentDHPrivate)
+			message.MyNextDh = nextDHPub[:]
+		}
+
+		var parts []*pond.Message
+		transmitted := []*pond.Message{message}
+		if len(bodies) > 0 {
+			parts = c.splitMessage(message, bodies)
+			transmitted = parts
+		}
+		for _, m := range transmitted {
+			messageBytes, err := serializeMessage(to, m)
+			if err != nil {
+				return 0, created, err
+			}
+			if len(messageBytes) > pond.MaxSerializedMessage {
+				return 0, created, errors.New("message too large")
+			}
+		}
+		messages = append(messages, message)
+		partsOfMessages = append(partsOfMessages, parts)
+	}
+
+	notBefore := c.NotBefore(draft)
+	for i, message := range messages {
+		to := c.Contacts[recipients[i]]
+		var err error
+		if parts := partsOfMessages[i]; len(parts) > 0 {
+			err = c.sendParts(to, message, parts, fanoutId, notBefore)
+		} else {
+			err = c.sendCopy(to, message, fanoutId, notBefore)
+		}
+		if err != nil {
+			return 0, created, err
+		}
+	}
+	c.startBurst()
+	return messages[0].GetId(), created, nil
+}
+
+// tooLarge returns true if the given message is too large to serialise.
+func (c *Client) tooLarge(msg *QueuedMessage) bool {
+	messageBytes, err := serializeMessage(c.Contacts[msg.To], msg.Message)
+	if err != nil {
+		return true
+	}
+
+	return len(messageBytes) > pond.MaxSerializedMessage
+}
+
+// ProcessSigningRequest is run on the main goroutine in response to a request
+// from the network thread to apply a group signature to a message that is just
+// about to be sent to the destination server.
+func (c *Client) ProcessSigningRequest(sigReq SigningRequest) {
+	defer close(sigReq.resultChan)
+	if sigReq.msg.cover {
+		sigReq.msg.Server = c.Server
+		request, err := c.coverRequest()
+		if err != nil {
+			c.Log.Printf("Failed to create cover delivery: %s", err)
+			return
+		}
+		sigReq.resultChan <- request
+		return
+	}
+	to := c.Contacts[sigReq.msg.To]
+
+	messageBytes, err := serializeMessage(to, sigReq.msg.Message)
+	if err != nil {
+		c.Log.Printf("Failed to sign outgoing message: %s", err)
+		return
+	}
+
+	if len(messageBytes) > pond.MaxSerializedMessage {
+		c.Log.Printf("Failed to sign outgoing message because it's too large")
+		return
+	}
+
+	// All messages are padded to the maximum length.
+	plaintext := make([]byte, pond.MaxSerializedMessage+4)
+	binary.LittleEndian.PutUint32(plaintext, uint32(len(messageBytes)))
+	copy(plaintext[4:], messageBytes)
+	c.RandBytes(plaintext[4+len(messageBytes):])
+
+	var sealed []byte
+	if to.ratchet != nil {
+		sealed = to.ratchet.Encrypt(sealed, plaintext)
+	} else {
+		// The message is encrypted to an ephemeral key so that the sending
+		// client can choose not to store it and then cannot decrypt it once
+		// sent.
+
+		//            +---------------------+            +---...
+		// outerNonce | ephemeral DH public | innerNonce | message
+		// (24 bytes) |                     | (24 bytes) |
+		//            +---------------------+            +---....
+
+		sealedLen := ephemeralBlockLen + nonceLen + len(plaintext) + box.Overhead
+		sealed = make([]byte, sealedLen)
+		var outerNonce [24]byte
+		c.RandBytes(outerNonce[:])
+		copy(sealed, outerNonce[:])
+		x := sealed[nonceLen:]
+
+		public, private, err := box.GenerateKey(c.Rand)
+		if err != nil {
+			c.Log.Printf("Failed to generate key for outgoing message: %s", err)
+			return
+		}
+		box.Seal(x[:0], public[:], &outerNonce, &to.TheirCurrentDHPublic, &to.lastDHPrivate)
+		x = x[len(public)+box.Overhead:]
+
+		var innerNonce [24]byte
+		c.RandBytes(innerNonce[:])
+		copy(x, innerNonce[:])
+		x = x[nonceLen:]
+		box.Seal(x[:0], plaintext, &innerNonce, &to.TheirCurrentDHPublic, private)
+	}
+
+	sha := sha256.New()
+	sha.Write(sealed)
+	digest := sha.Sum(nil)
+	sha.Reset()
+	groupSig, err := to.myGroupKey.Sign(c.Rand, digest, sha)
+	if err != nil {
+		c.Log.Printf("Failed to sign outgoing message: %s", err)
+		return
+	}
+
+	request := &pond.Request{
+		Deliver: &pond.Delivery{
+			To:             to.TheirIdentityPublic[:],
+			GroupSignature: groupSig,
+			Generation:     proto.Uint32(to.Generation),
+			Message:        sealed,
+		},
+	}
+
+	sigReq.resultChan <- request
+}
+
+// revocationSignaturePrefix is prepended to a SignedRevocation_Revocation
+// message before signing in order to give context to the signature.
+var revocationSignaturePrefix = []byte("revocation\x00")
+
+func (c *Client) revoke(to *Contact) *QueuedMessage {
+	to.Revoked = true
+	revocation := c.groupPriv.GenerateRevocation(to.groupKey)
+	now := time.Now()
+
+	groupCopy, _ := new(bbssig.Group).Unmarshal(c.groupPriv.Group.Marshal())
+	groupPrivCopy, _ := new(bbssig.PrivateKey).Unmarshal(groupCopy, c.groupPriv.Marshal())
+	c.prevGroupPrivs = append(c.prevGroupPrivs, previousGroupPrivateKey{
+		priv:    groupPrivCopy,
+		expired: now,
+	})
+
+	for _, contact := range c.Contacts {
+		if contact == to {
+			continue
+		}
+		contact.previousTags = append(contact.previousTags, previousTag{
+			tag:     contact.groupKey.Tag(),
+			expired: now,
+		})
+		contact.groupKey.Update(revocation)
+	}
+
+	rev := &pond.SignedRevocation_Revocation{
+		Revocation: revocation.Marshal(),
+		Generation: proto.Uint32(c.Generation),
+	}
+
+	c.groupPriv.Group.Update(revocation)
+	c.Generation++
+
+	revBytes, err := proto.Marshal(rev)
+	if err != nil {
+		panic(err)
+	}
+
+	var signed []byte
+	signed = append(signed, revocationSignaturePrefix...)
+	signed = append(signed, revBytes...)
+
+	sig := ed25519.Sign(&c.priv, signed)
+
+	signedRev := pond.SignedRevocation{
+		Revocation: rev,
+		Signature:  sig[:],
+	}
+
+	request := &pond.Request{
+		Revocation: &signedRev,
+	}
+
+	out := &QueuedMessage{
+		Revocation: true,
+		request:    request,
+		Id:         c.RandId(),
+		Server:     c.Server, // revocations always go to the home server.
+		Created:    time.Now(),
+	}
+	c.enqueue(out)
+	c.Outbox = append(c.Outbox, out)
+	return out
+}
+
+func decryptMessage(sealed []byte, from *Contact) ([]byte, error) {
+	if from.ratchet != nil {
+		plaintext, err := from.ratchet.Decrypt(sealed)
+		if err != nil {
+			return nil, err
+		}
+		return plaintext, nil
+	}
+
+	var nonce [24]byte
+	if len(sealed) < len(nonce) {
+		return nil, errors.New("message shorter than nonce")
+	}
+	copy(nonce[:], sealed)
+	sealed = sealed[24:]
+	headerLen := ephemeralBlockLen - len(nonce)
+	if len(sealed) < headerLen {
+		return nil, errors.New("message shorter than header")
+	}
+
+	publicBytes, ok := decryptMessageInner(sealed[:headerLen], &nonce, from)
+	if !ok || len(publicBytes) != 32 {
+		return nil, errors.New("failed to decrypt inner message")
+	}
+	var innerNonce [nonceLen]byte
+	sealed = sealed[headerLen:]
+	copy(innerNonce[:], sealed)
+	sealed = sealed[nonceLen:]
+	var ephemeralPublicKey [32]byte
+	copy(ephemeralPublicKey[:], publicBytes)
+
+	if plaintext, ok := box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.lastDHPrivate); ok {
+		return plaintext, nil
+	}
+
+	plaintext, ok := box.Open(nil, sealed, &innerNonce, &ephemeralPublicKey, &from.CurrentDHPrivate)
+	if !ok {
+		return nil, errors.New("failed to decrypt with either DH values (old ratchet)")
+	}
+
+	// They have clearly received our current DH value. Time to
+	// rotate.
+	copy(from.lastDHPrivate[:], from.CurrentDHPrivate[:])
+	if _, err := io.ReadFull(rand.Reader, from.CurrentDHPrivate[:]); err != nil {
+		panic(err)
+	}
+	return plaintext, nil
+}
+
+func decryptMessageInner(sealed []byte, nonce *[24]byte, from *Contact) ([]byte, bool) {
+	if plaintext, ok := box.Open(nil, sealed, nonce, &from.TheirLastDHPublic, &from.lastDHPrivate); ok {
+		return plaintext, true
+	}
+
+	if plaintext, ok := box.Open(nil, sealed, nonce, &from.TheirCurrentDHPublic, &from.lastDHPrivate); ok {
+		return plaintext, true
+	}
+
+	plaintext, ok := box.Open(nil, sealed, nonce, &from.TheirLastDHPublic, &from.CurrentDHPrivate)
+	if !ok {
+		plaintext, ok = box.Open(nil, sealed, nonce, &from.TheirCurrentDHPublic, &from.CurrentDHPrivate)
+		if !ok {
+			return nil, false
+		}
+	}
+
+	// They have clearly received our current DH value. Time to
+	// rotate.
+	copy(from.lastDHPrivate[:], from.CurrentDHPrivate[:])
+	if _, err := io.ReadFull(rand.Reader, from.CurrentDHPrivate[:]); err != nil {
+		panic(err)
+	}
+	return plaintext, true
+}
+
+func (c *Client) ProcessNewMessage(m NewMessage) {
+	defer func() { m.ack <- true }()
+
+	if m.fetched != nil {
+		c.ProcessFetch(m)
+	} else {
+		c.ProcessServerAnnounce(m)
+	}
+}
+
+func (c *Client) ProcessFetch(m NewMessage) {
+	f := m.fetched
+
+	sha := sha256.New()
+	sha.Write(f.Message)
+	digest := sha.Sum(nil)
+
+	var tag []byte
+	var ok bool
+	if c.groupPriv.Verify(digest, sha, f.GroupSignature) {
+		tag, ok = c.groupPriv.Open(f.GroupSignature)
+	} else {
+		found := false
+		for _, prev := range c.prevGroupPrivs {
+			if prev.priv.Verify(digest, sha, f.GroupSignature) {
+				found = true
+				tag, ok = c.groupPriv.Open(f.GroupSignature)
+				break
+			}
+		}
+		if !found {
+			c.Log.Errorf("Received message with bad group signature!")
+			return
+		}
+	}
+	if !ok {
+		c.Log.Errorf("Failed to open group signature!")
+		return
+	}
+
+	var from *Contact
+NextCandidate:
+	for _, candidate := range c.Contacts {
+		if bytes.Equal(tag, candidate.groupKey.Tag()) {
+			from = candidate
+			break
+		}
+		for _, prevTag := range candidate.previousTags {
+			if bytes.Equal(tag, prevTag.tag) {
+				from = candidate
+				break NextCandidate
+			}
+		}
+	}
+
+	if from == nil {
+		if c.isCoverMessage(f.Message) {
+			return
+		}
+		c.Log.Errorf("Message from unknown contact. Dropping. Tag: %x", tag)
+		return
+	}
+
+	if from.Revoked {
+		// It's possible that there were pending messages from the
+		// contact when we revoked them.
+		c.Log.Errorf("Message from revoked contact %s. Dropping", from.Name)
+		return
+	}
+
+	if len(f.Message) < box.Overhead+24 {
+		c.logEvent(from, "Message too small to process")
+		return
+	}
+
+	inboxMsg := &InboxMessage{
+		Id:           c.RandId(),
+		ReceivedTime: time.Now(),
+		From:         from.Id,
+		Sealed:       f.Message,
+	}
+
+	if !from.IsPending {
+		if !c.UnsealMessage(inboxMsg, from) || len(inboxMsg.Message.Body) == 0 {
+			return
+		}
+		if IsMessagePart(inboxMsg.Message) {
+			if inboxMsg = c.holdPart(inboxMsg, from); inboxMsg == nil {
+				c.Save()
+				return
+			}
+		}
+	}
+
+	c.Inbox = append(c.Inbox, inboxMsg)
+	c.UI.ProcessFetch(inboxMsg)
+	c.Save()
+
+	c.runHook(HookReceived, c.inboxHookPayload(inboxMsg))
+}
+
+func (c *Client) ProcessServerAnnounce(m NewMessage) {
+	inboxMsg := &InboxMessage{
+		Id:           c.RandId(),
+		ReceivedTime: time.Now(),
+		From:         0,
+		Message:      m.announce.Message,
+	}
+
+	c.Inbox = append(c.Inbox, inboxMsg)
+	c.UI.ProcessServerAnnounce(inboxMsg)
+
+	c.Save()
+}
+
+func (c *Client) UnsealMessage(inboxMsg *InboxMessage, from *Contact) bool {
+	if from.IsPending {
+		panic("was asked to unseal message from pending contact")
+	}
+
+	sealed := inboxMsg.Sealed
+	plaintext, err := decryptMessage(sealed, from)
+
+	if err != nil {
+		c.logEvent(from, "Failed to decrypt message: "+err.Error())
+		return false
+	}
+
+	if len(plaintext) < 4 {
+		c.logEvent(from, "Plaintext too small to process")
+		return false
+	}
+
+	mLen := int(binary.LittleEndian.Uint32(plaintext[:4]))
+	plaintext = plaintext[4:]
+	if mLen < 0 || mLen > len(plaintext) {
+		c.logEvent(from, fmt.Sprintf("Plaintext length incorrect: %d", mLen))
+		return false
+	}
+	plaintext = plaintext[:mLen]
+
+	msg := new(pond.Message)
+	if err := proto.Unmarshal(plaintext, msg); err != nil {
+		c.logEvent(from, "Failed to parse message: "+err.Error())
+		return false
+	}
+	if err := DecompressBody(msg); err != nil {
+		// The message is kept, since it may carry acknowledgements,
+		// but the body is replaced so that it's never shown
+		// compressed.
+		c.logEvent(from, "Failed to decompress message: "+err.Error())
+		msg.Body = []byte("(cannot display message as it couldn't be decompressed)")
+		msg.BodyEncoding = pond.Message_RAW.Enum()
+	}
+
+	// Check for duplicate message.
+	for _, candidate := range c.Inbox {
+		if candidate.From == from.Id &&
+			candidate.Id != inboxMsg.Id &&
+			candidate.Message != nil &&
+			*candidate.Message.Id == *msg.Id {
+			c.Log.Printf("Dropping duplicate message from %s", from.Name)
+			return false
+		}
+	}
+	if IsMessagePart(msg) && c.isDuplicatePart(from.Id, msg.GetId()) {
+		c.Log.Printf("Dropping duplicate part of a message from %s", from.Name)
+		return false
+	}
+
+	if from.ratchet == nil {
+		if l := len(msg.MyNextDh); l != len(from.TheirCurrentDHPublic) {
+			c.logEvent(from, fmt.Sprintf("Bad Diffie-Hellman value length: %d", l))
+			return false
+		}
+
+		if !bytes.Equal(from.TheirCurrentDHPublic[:], msg.MyNextDh) {
+			// We have a new DH value from them.
+			copy(from.TheirLastDHPublic[:], from.TheirCurrentDHPublic[:])
+			copy(from.TheirCurrentDHPublic[:], msg.MyNextDh)
+		}
+	}
+
+	var ackedIds []uint64
+	ackedIds = append(ackedIds, msg.AlsoAck...)
+	if msg.InReplyTo != nil {
+		ackedIds = append(ackedIds, *msg.InReplyTo)
+	}
+
+	var now time.Time
+	if len(ackedIds) > 0 {
+		now = time.Now()
+	}
+
+	for _, ackedId := range ackedIds {
+		if candidate, transmission := c.findTransmission(ackedId); candidate != nil {
+			wasAcked := !candidate.Acked.IsZero()
+			transmission.Acked = now
+			if len(candidate.Parts) > 0 {
+				// A message that was split is only acknowledged
+				// once all its parts are.
+				candidate.Acked = candidate.partsAcked()
+			}
+			if !candidate.Acked.IsZero() {
+				c.UI.ProcessAcknowledgement(candidate)
+				if !wasAcked {
+					c.runHook(HookAcked, c.outboxHookPayload(candidate))
+				}
+			}
+		}
+	}
+
+	if msg.SupportedVersion != nil {
+		from.SupportedVersion = *msg.SupportedVersion
+	}
+
+	from.KxsBytes = nil
+	inboxMsg.Message = msg
+	inboxMsg.Sealed = nil
+	inboxMsg.Read = false
+
+	return true
+}
+
+func (c *Client) ProcessMessageSent(msr MessageSendResult) {
+	msg, transmission := c.findTransmission(msr.Id)
+	if msg == nil {
+		// Message might have been deleted while sending.
+		return
+	}
+
+	if msr.failure != nil {
+		c.processDeliveryFailure(msg, msr.failure)
+		return
+	}
+
+	if msr.revocation != nil {
+		// We tried to deliver a message to a user but the server told
+		// us that there's a pending revocation.
+		to := c.Contacts[msg.To]
+
+		for revNum := 0; !to.RevokedUs; revNum++ {
+			var rev *pond.SignedRevocation
+			if revNum == 0 {
+				rev = msr.revocation
+			} else {
+				if n := revNum - 1; n < len(msr.extraRevocations) {
+					rev = msr.extraRevocations[n]
+				} else {
+					break
+				}
+			}
+
+			if gen := *rev.Revocation.Generation; gen != to.Generation {
+				c.Log.Printf("Message to '%s' resulted in revocation for generation %d, but current generation is %d", to.Name, gen, to.Generation)
+				return
+			}
+
+			// Check the signature on the revocation.
+			revBytes, err := proto.Marshal(rev.Revocation)
+			if err != nil {
+				c.Log.Printf("Failed to marshal revocation message: %s", err)
+				return
+			}
+
+			var sig [ed25519.SignatureSize]byte
+			if revSig := rev.Signature; copy(sig[:], revSig) != len(sig) {
+				c.Log.Printf("Bad signature length on revocation (%d bytes) from %s", len(revSig), to.Name)
+				return
+			}
+
+			var signed []byte
+			signed = append(signed, revocationSignaturePrefix...)
+			signed = append(signed, revBytes...)
+			if !ed25519.Verify(&to.TheirPub, signed, &sig) {
+				c.Log.Printf("Bad signature on revocation from %s", to.Name)
+				return
+			}
+			bbsRev, ok := new(bbssig.Revocation).Unmarshal(rev.Revocation.Revocation)
+			if !ok {
+				c.Log.Printf("Failed to parse revocation from %s", to.Name)
+				return
+			}
+			to.Generation++
+			if !to.myGroupKey.Update(bbsRev) {
+				// We were revoked.
+				to.RevokedUs = true
+				// Further revocations will not be applied
+				// because the loop conditional is false now.
+				c.Log.Printf("Revoked by %s", to.Name)
+				c.UI.ProcessRevocationOfUs(to)
+
+				// Mark all pending messages to this contact as
+				// undeliverable.
+				newQueue := make([]*QueuedMessage, 0, len(c.Queue))
+				c.QueueMutex.Lock()
+				for _, m := range c.Queue {
+					if m.To != msg.To {
+						newQueue = append(newQueue, m)
+					}
+				}
+				c.Queue = newQueue
+				c.QueueMutex.Unlock()
+			} else {
+				to.myGroupKey.Group.Update(bbsRev)
+				// Outgoing messages will be resigned when the network
+				// goroutine next attempts to send them.
+			}
+
+			c.UI.ProcessRevocation(to)
+			c.runHook(hookRevocation, &HookPayload{
+				Contact:   to.Name,
+				ContactId: to.Id,
+			})
+		}
+
+		return
+	}
+
+	transmission.Sent = time.Now()
+	if len(msg.Parts) > 0 {
+		msg.Sent = msg.partsSent()
+	}
+	if msg.Revocation {
+		c.DeleteOutboxMsg(msg.Id)
+		c.UI.RemoveOutboxMessageUI(msg)
+	} else if !msg.Sent.IsZero() {
+		c.UI.ProcessMessageDelivered(msg)
+		c.runHook(HookDelivered, c.outboxHookPayload(msg))
+	}
+	c.Save()
+}
+
+func decodeBase32(s string) ([]byte, error) {
+	for len(s)%8 != 0 {
+		s += "="
+	}
+	return base32.StdEncoding.DecodeString(s)
+}
+
+func replyToError(reply *pond.Reply) error {
+	if reply.Status == nil || *reply.Status == pond.Reply_OK {
+		return nil
+	}
+	if msg, ok := pond.Reply_Status_name[int32(*reply.Status)]; ok {
+		return errors.New("error from server: " + msg)
+	}
+	return errors.New("unknown error from server: " + strconv.Itoa(int(*reply.Status)))
+}
+
+// ParseServer parses a pondserver URL. Unless AllowClearnet is true, the host
+// must be a Tor hidden service and may not include a port.
+func ParseServer(server string, allowClearnet bool) (serverIdentity *[32]byte, host string, err error) {
+	url, err := url.Parse(server)
+	if err != nil {
+		return
+	}
+	if url.Scheme != "pondserver" {
+		err = errors.New("bad URL scheme, should be pondserver")
+		return
+	}
+	if url.User == nil || len(url.User.Username()) == 0 {
+		err = errors.New("no server ID in URL")
+		return
+	}
+	serverIdSlice, err := decodeBase32(url.User.Username())
+	if err != nil {
+		return
+	}
+	if len(serverIdSlice) != 32 {
+		err = errors.New("bad server ID length")
+		return
+	}
+
+	host = url.Host
+	if !allowClearnet {
+		if strings.ContainsRune(host, ':') {
+			err = errors.New("URL contains a port number")
+			return
+		}
+		if !strings.HasSuffix(host, ".onion") {
+			err = errors.New("host is not a .onion address")
+			return
+		}
+		host += ":16333"
+	} else if _, _, splitErr := net.SplitHostPort(host); splitErr != nil {
+		host += ":16333"
+	}
+
+	serverIdentity = new([32]byte)
+	copy(serverIdentity[:], serverIdSlice)
+	return
+}
+
+// MaxTickets is the number of resumption tickets that are kept for each
+// server. Since tickets are issued blindly, deliveries and authenticated
+// connections can share them without being linked, as long as they were
+// issued with a key that the server presents to everyone. See the comment at
+// the top of transport/ticket.go.
+const MaxTickets = 4
+
+// takeTicket removes and returns a resumption ticket for server, if any.
+// Anonymous connections only take tickets that were issued with a key that
+// the server has presented on an anonymous connection. Others are left for
+// authenticated connections.
+func (c *Client) takeTicket(server string, anonymous bool) *transport.Ticket {
+	c.TicketsLock.Lock()
+	defer c.TicketsLock.Unlock()
+
+	now := time.Now()
+	pins := c.ticketKeyPins[server]
+	var taken *transport.Ticket
+	var kept []*transport.Ticket
+	for _, ticket := range c.Tickets[server] {
+		switch {
+		case ticket.Expired(now):
+		case taken == nil && (!anonymous || pins != nil && pins.Allows(ticket)):
+			taken = ticket
+		default:
+			kept = append(kept, ticket)
+		}
+	}
+	if len(kept) > 0 {
+		c.Tickets[server] = kept
+	} else {
+		delete(c.Tickets, server)
+	}
+	return taken
+}
+
+// pinTicketKey records a ticket key that server presented on an anonymous
+// connection.
+func (c *Client) pinTicketKey(server string, key *transport.TicketKey) {
+	c.TicketsLock.Lock()
+	defer c.TicketsLock.Unlock()
+
+	if c.ticketKeyPins == nil {
+		c.ticketKeyPins = make(map[string]*transport.TicketKeyPins)
+	}
+	pins, ok := c.ticketKeyPins[server]
+	if !ok {
+		pins = new(transport.TicketKeyPins)
+		c.ticketKeyPins[server] = pins
+	}
+	pins.Pin(key)
+}
+
+// wantTickets returns true if connections to server should ask for a
+// resumption ticket.
+func (c *Client) wantTickets(server string) bool {
+	c.TicketsLock.Lock()
+	defer c.TicketsLock.Unlock()
+
+	return len(c.Tickets[server]) < MaxTickets
+}
+
+func (c *Client) storeTicket(server string, ticket *transport.Ticket) {
+	c.TicketsLock.Lock()
+	defer c.TicketsLock.Unlock()
+
+	if c.Tickets == nil {
+		c.Tickets = make(map[string][]*transport.Ticket)
+	}
+	tickets := append(c.Tickets[server], ticket)
+	if len(tickets) > MaxTickets {
+		tickets = tickets[len(tickets)-MaxTickets:]
+	}
+	c.Tickets[server] = tickets
+}
+
+// DialServer connects to server for the given purpose. Anonymous deliveries
+// use a random identity and pin the server's ticket key. A resumption ticket is used if one is available;
+// the server falls back to a full handshake if it doesn't accept it.
+func (c *Client) DialServer(server string, purpose connPurpose) (*transport.Conn, error) {
+	useRandomIdentity := purpose == PurposeDelivery
+	identity := &c.identity
+	identityPublic := &c.IdentityPublic
+	if useRandomIdentity {
+		var randomIdentity [32]byte
+		c.RandBytes(randomIdentity[:])
+
+		var randomIdentityPublic [32]byte
+		curve25519.ScalarBaseMult(&randomIdentityPublic, &randomIdentity)
+
+		identity = &randomIdentity
+		identityPublic = &randomIdentityPublic
+	}
+
+	serverIdentity, host, err := c.ParseServer(server)
+	if err != nil {
+		return nil, err
+	}
+	carrier := c.carrierFor(server)
+	dialer := serverDialer{c, server, purpose}
+
+	rawConn, err := dialer.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	// Sometimes Tor holds the connection open but we never receive
+	// anything so we add a 60 second deadline.
+	rawConn.SetDeadline(time.Now().Add(60 * time.Second))
+	var carrierConn io.ReadWriteCloser = rawConn
+	if carrier != nil {
+		if carrierConn, err = transport.DialWebSocketURL(rawConn, carrier, c.CarrierTLSConfig); err != nil {
+			rawConn.Close()
+			return nil, &handshakeError{err}
+		}
+	}
+	conn := transport.NewClient(carrierConn, identity, identityPublic, serverIdentity)
+	// More tickets are wanted if the pool isn't full before this
+	// connection takes one.
+	if c.wantTickets(server) {
+		conn.SetTicketHandler(func(ticket *transport.Ticket) {
+			c.storeTicket(server, ticket)
+		})
+	}
+	if useRandomIdentity {
+		conn.SetTicketKeyHandler(func(key *transport.TicketKey) {
+			c.pinTicketKey(server, key)
+		})
+	}
+	if ticket := c.takeTicket(server, useRandomIdentity); ticket != nil {
+		conn.SetTicket(ticket)
+	}
+	if err := conn.Handshake(); err != nil {
+		carrierConn.Close()
+		return nil, &handshakeError{err}
+	}
+	return conn, nil
+}
+
+// writeRequest sends a request to the server, offering to pad the records
+// that follow the reply and, if more are wanted and there's room, asking for
+// resumption tickets. Deliveries of full messages leave no room, but they can
+// still redeem tickets obtained by other requests.
+func writeRequest(conn *transport.Conn, req *pond.Request) error {
+	// The request is copied because queued requests are shared with the
+	// main goroutine.
+	padded := *req
+	padded.Padding = transport.DefaultPaddingPolicy.Marshal()
+	if conn.WantsTickets() {
+		ticketRequest, err := conn.TicketRequest()
+		if err != nil {
+			return err
+		}
+		padded.TicketRequest = ticketRequest
+		if proto.Size(&padded) > pond.TransportSize {
+			padded.TicketRequest = nil
+		}
+	}
+	return conn.WriteProto(&padded)
+}
+
+// readReply reads the server's reply, starts padding records if the server
+// accepted the offer made by writeRequest and stores any resumption ticket
+// and ticket key.
+func readReply(conn *transport.Conn, reply *pond.Reply) error {
+	if err := conn.ReadProto(reply); err != nil {
+		return err
+	}
+	if reply.Padding != nil {
+		policy, err := transport.AcceptPadding(reply.Padding)
+		if err != nil {
+			return err
+		}
+		conn.SetPaddingPolicy(policy)
+	}
+	if len(reply.Ticket) > 0 {
+		if err := conn.AcceptTicket(reply.Ticket); err != nil {
+			return err
+		}
+	}
+	if len(reply.TicketKey) > 0 {
+		if err := conn.AcceptTicketKey(reply.TicketKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) DoCreateAccount(displayMsg func(string)) error {
+	_, _, err := c.ParseServer(c.Server)
+	if err != nil {
+		return err
+	}
+
+	if err := c.checkProxy(c.Server); err != nil {
+		return err
+	}
+
+	displayMsg("Connecting...")
+
+	conn, err := c.DialServer(c.Server, PurposeFetch)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	displayMsg("Requesting new account...")
+
+	c.Generation = uint32(c.RandId())
+
+	request := new(pond.Request)
+	request.NewAccount = &pond.NewAccount{
+		Generation: proto.Uint32(c.Generation),
+		Group:      c.groupPriv.Group.Marshal(),
+	}
+	if err := writeRequest(conn, request); err != nil {
+		return err
+	}
+
+	reply := new(pond.Reply)
+	if err := readReply(conn, reply); err != nil {
+		return err
+	}
+	if err := replyToError(reply); err != nil {
+		return err
+	}
+
+	displayMsg("Done")
+
+	return nil
+}
+
+func (c *Client) transact() {
+	startup := true
+
+	var ackChan chan bool
+	var head *QueuedMessage
+	lastWasSend := false
+	// syncing is true while the transactions of a sync are being made.
+	syncing := false
+
+	for {
+		if head != nil {
+			// We failed to send a message.
+			c.QueueMutex.Lock()
+			head.sending = false
+			c.QueueMutex.Unlock()
+			head = nil
+		}
+
+		if !startup || !c.AutoFetch || !c.mayTransactNow(time.Now()) {
+			if ackChan != nil {
+				ackChan <- true
+				ackChan = nil
+			}
+
+		Wait:
+			for {
+				if c.takeSyncTransaction() {
+					c.Log.Printf("Starting sync transaction")
+					syncing = true
+					break Wait
+				}
+				if syncing {
+					c.Log.Printf("Sync complete")
+					syncing = false
+				}
+
+				// The time of the next transaction is recalculated
+				// whenever the network schedule changes.
+				var timerChan <-chan time.Time
+				if c.AutoFetch {
+					var seedBytes [8]byte
+					c.RandBytes(seedBytes[:])
+					seed := int64(binary.LittleEndian.Uint64(seedBytes[:]))
+					r := mrand.New(mrand.NewSource(seed))
+					if delay, ok := c.nextTransactionDelay(r, time.Now()); ok {
+						c.Log.Printf("Next network transaction in %s", delay)
+						timerChan = time.After(delay)
+					} else {
+						c.Log.Printf("Timed network transactions are paused")
+					}
+				}
+
+				var ok bool
+				select {
+				case ackChan, ok = <-c.FetchNowChan:
+					if !ok {
+						return
+					}
+					if c.IsOffline() {
+						c.Log.Printf("Ignoring fetchNow signal while offline")
+						if ackChan != nil {
+							ackChan <- true
+							ackChan = nil
+						}
+						continue
+					}
+					c.Log.Printf("Starting fetch because of fetchNow signal")
+					break Wait
+				case <-timerChan:
+					c.Log.Printf("Starting fetch because of timer")
+					break Wait
+				case <-c.networkPolicyChan:
+				}
+			}
+		}
+		startup = false
+		c.transactionStarted()
+
+		var req *pond.Request
+		var server string
+
+		useAnonymousIdentity := true
+		isFetch := false
+		c.QueueMutex.Lock()
+		now := time.Now()
+		c.releaseScheduledMessages(now)
+		// Messages to servers that have been failing are skipped until
+		// their backoff has passed.
+		next := c.nextSendableLocked(now)
+		// With cover traffic, deliveries and fetches always alternate,
+		// even in tests.
+		coverTraffic := c.CoverTrafficEnabled()
+		if !lastWasSend && next == nil && coverTraffic {
+			// Send a cover delivery in place of a real one so that
+			// the rate of deliveries doesn't reveal when the user is
+			// sending messages. It's delivered to our own account
+			// on the home server.
+			head = &QueuedMessage{
+				cover:   true,
+				sending: true,
+			}
+			c.Log.Printf("Starting cover transmission")
+			lastWasSend = true
+		} else if ((!c.Testing || coverTraffic) && lastWasSend) || next == nil {
+			useAnonymousIdentity = false
+			isFetch = true
+			req = &pond.Request{Fetch: &pond.Fetch{}}
+			server = c.Server
+			c.Log.Printf("Starting fetch from home server")
+			lastWasSend = false
+		} else {
+			head = next
+			head.sending = true
+			req = head.request
+			server = head.Server
+			c.Log.Printf("Starting message transmission to %s", server)
+
+			if head.Revocation {
+				useAnonymousIdentity = false
+			}
+			lastWasSend = true
+		}
+		c.QueueMutex.Unlock()
+
+		// Poke the UI thread so that it knows that a message has
+		// started sending.
+		c.MessageSentChan <- MessageSendResult{}
+
+		purpose := PurposeFetch
+		if useAnonymousIdentity {
+			purpose = PurposeDelivery
+		}
+
+		sendRecv := func() (*pond.Reply, error) {
+			if head != nil && head.cover {
+				resultChan := make(chan *pond.Request, 1)
+				c.SigningRequestChan <- SigningRequest{head, resultChan}
+				if req = <-resultChan; req == nil {
+					return nil, errNotSigned
+				}
+				server = head.Server
+				c.Log.Printf("Sending cover delivery to %s", server)
+			}
+
+			conn, err := c.DialServer(server, purpose)
+			if err != nil {
+				c.Log.Printf("Failed to connect to %s: %s", server, err)
+				return nil, err
+			}
+			defer conn.Close()
+
+			if lastWasSend && req == nil {
+				resultChan := make(chan *pond.Request, 1)
+				c.SigningRequestChan <- SigningRequest{head, resultChan}
+				req = <-resultChan
+				if req == nil {
+					return nil, errNotSigned
+				}
+			}
+
+			if err := writeRequest(conn, req); err != nil {
+				c.Log.Printf("Failed to send to %s: %s", server, err)
+				return nil, &handshakeError{err}
+			}
+
+			reply := new(pond.Reply)
+			if err := readReply(conn, reply); err != nil {
+				c.Log.Printf("Failed to read from %s: %s", server, err)
+				return nil, &handshakeError{err}
+			}
+
+			return reply, nil
+		}
+
+		reply, err := sendRecv()
+		if err != nil {
+			if !isFetch && !head.cover {
+				c.QueueMutex.Lock()
+				c.moveContactsMessagesToEndOfQueue(head.To)
+				c.QueueMutex.Unlock()
+				if err != errNotSigned {
+					c.MessageSentChan <- MessageSendResult{Id: head.Id, failure: c.recordServerFailure(server, err, time.Now())}
+				}
+			}
+			continue
+		}
+
+		if !isFetch && head.cover {
+			head = nil
+		} else if !isFetch {
+			c.QueueMutex.Lock()
+			// Find the index of the message that we just sent (if any) in
+			// the queue. It should be at the front, but something
+			// may have happened while we didn't hold the lock.
+			indexOfSentMessage := c.indexOfQueuedMessage(head)
+
+			// If we sent a message that was removed from the queue while
+			// we were processing it then ignore any result.
+			if indexOfSentMessage == -1 {
+				c.QueueMutex.Unlock()
+				continue
+			}
+
+			head.sending = false
+
+			if reply.Status == nil {
+				c.removeQueuedMessage(indexOfSentMessage)
+				c.QueueMutex.Unlock()
+				c.recordServerSuccess(server)
+				c.MessageSentChan <- MessageSendResult{Id: head.Id}
+			} else {
+				c.moveContactsMessagesToEndOfQueue(head.To)
+				c.QueueMutex.Unlock()
+
+				if *reply.Status == pond.Reply_GENERATION_REVOKED && reply.Revocation != nil {
+					c.recordServerSuccess(server)
+					c.MessageSentChan <- MessageSendResult{Id: head.Id, revocation: reply.Revocation, extraRevocations: reply.ExtraRevocations}
+				} else {
+					c.MessageSentChan <- MessageSendResult{Id: head.Id, failure: c.recordServerFailure(server, replyError{*reply.Status}, time.Now())}
+				}
+			}
+
+			head = nil
+		} else if reply.Fetched != nil || reply.Announce != nil {
+			ackChan := make(chan bool)
+			c.NewMessageChan <- NewMessage{reply.Fetched, reply.Announce, ackChan}
+			<-ackChan
+		}
+
+		if err := replyToError(reply); err != nil {
+			c.Log.Errorf("Error from server %s: %s", server, err)
+			continue
+		}
+	}
+}
+
+// detachmentTransfer is the interface to either an upload or download so that
+// the code for moving the bytes can be shared between them.
+type detachmentTransfer interface {
+	// Request returns the request that should be sent to the server.
+	Request() *pond.Request
+	// ProcessReply returns a file to read/write from, the starting offset
+	// for the transfer and the total size of the file. The file will
+	// already have been positioned correctly.
+	ProcessReply(*pond.Reply) (file *os.File, isUpload bool, offset, total int64, isComplete bool, err error)
+	// Complete is called once the bytes have been transfered. It trues true on success.
+	Complete(conn *transport.Conn) bool
+}
+
+type uploadTransfer struct {
+	id    uint64
+	file  *os.File
+	total int64
+}
+
+func (ut uploadTransfer) Request() *pond.Request {
+	return &pond.Request{
+		Upload: &pond.Upload{
+			Id:   proto.Uint64(ut.id),
+			Size: proto.Int64(ut.total),
+		},
+	}
+}
+
+func (ut uploadTransfer) ProcessReply(reply *pond.Reply) (file *os.File, isUpload bool, offset, total int64, isComplete bool, err error) {
+	if reply.Upload != nil && reply.Upload.Resume != nil {
+		offset = *reply.Upload.Resume
+	}
+
+	if offset == ut.total {
+		isComplete = true
+		return
+	}
+	if offset > ut.total {
+		err = fmt.Errorf("offset from server is greater than the length of the file: %d vs %d", offset, ut.total)
+		return
+	}
+	pos, err := ut.file.Seek(offset, 0 /* from start */)
+	if err != nil || pos != offset {
+		err = fmt.Errorf("failed to seek in temp file: %d %d %s", pos, offset, err)
+		return
+	}
+
+	file = ut.file
+	isUpload = true
+	total = ut.total
+	return
+}
+
+func (ut uploadTransfer) Complete(conn *transport.Conn) bool {
+	// The server will send us a zero byte if it got everything.
+	buf := []byte{1}
+	io.ReadFull(conn, buf)
+	return buf[0] == 0
+}
+
+func (c *Client) uploadDetachment(out chan interface{}, in *os.File, id uint64, killChan chan bool) error {
+	transfer := uploadTransfer{file: in, id: id}
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	transfer.total = fi.Size()
+
+	return c.transferDetachment(out, c.Server, transfer, id, killChan)
+}
+
+type downloadTransfer struct {
+	fileID uint64
+	file   *os.File
+	resume int64
+	from   *[32]byte
+}
+
+func (dt *downloadTransfer) Request() *pond.Request {
+	pos, err := dt.file.Seek(0, 2 /* from end */)
+	if err == nil {
+		dt.resume = pos
+	} else {
+		dt.resume = 0
+	}
+
+	var resume *int64
+	if dt.resume > 0 {
+		resume = proto.Int64(dt.resume)
+	}
+
+	return &pond.Request{
+		Download: &pond.Download{
+			From:   dt.from[:],
+			Id:     proto.Uint64(dt.fileID),
+			Resume: resume,
+		},
+	}
+}
+
+func (dt *downloadTransfer) ProcessReply(reply *pond.Reply) (file *os.File, isUpload bool, offset, total int64, isComplete bool, err error) {
+	if reply.Download == nil {
+		err = errors.New("Reply from server didn't include a download section")
+		return
+	}
+
+	total = *reply.Download.Size
+	if total < dt.resume {
+		err = errors.New("Reply from server suggested that the file was truncated")
+		return
+	}
+
+	offset = dt.resume
+	file = dt.file
+	return
+}
+
+func (dt *downloadTransfer) Complete(conn *transport.Conn) bool {
+	return true
+}
+
+func (c *Client) downloadDetachment(out chan interface{}, file *os.File, id uint64, downloadURL string, killChan chan bool) error {
+	c.Log.Printf("Starting download of %s", downloadURL)
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return errors.New("failed to parse download URL: " + err.Error())
+	}
+	if u.Scheme != "pondserver" {
+		return errors.New("download URL is a not a Pond URL")
+	}
+	path := u.Path
+	if len(path) == 0 {
+		return errors.New("download URL is missing a path")
+	}
+	path = path[1:]
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		return errors.New("download URL has incorrect number of path elements")
+	}
+	fromSlice, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return errors.New("failed to parse public identity from download URL: " + err.Error())
+	}
+	if len(fromSlice) != 32 {
+		return errors.New("public identity in download URL is wrong length")
+	}
+	var from [32]byte
+	copy(from[:], fromSlice)
+
+	fileID, err := strconv.ParseUint(parts[1], 16, 64)
+	if err != nil {
+		return errors.New("failed to parse download ID from URL: " + err.Error())
+	}
+
+	u.Path = ""
+	server := u.String()
+
+	transfer := &downloadTransfer{file: file, fileID: fileID, from: &from}
+
+	return c.transferDetachment(out, server, transfer, id, killChan)
+}
+
+// transferDetachmentConn transfers as much of a detachment as possible on a
+// single connection. It calls sendStatus repeatedly with the current state of
+// the transfer and watches KillChan for an abort signal. It returns an error
+// and an indication of whether the error is fatal. If not fatatl then another
+// connection can be attempted in order to resume the transfer.
+func (c *Client) transferDetachmentConn(sendStatus func(s string, done, total int64), conn *transport.Conn, transfer detachmentTransfer, killChan chan bool) (err error, fatal bool) {
+	defer conn.Close()
+
+	// transferred is the number of bytes that *this connection* has transferred.
+	// total is the full length of the file.
+	var startingOffset, transferred, total int64
+
+	sendStatus("Requesting transfer", 0, 0)
+	if err := writeRequest(conn, transfer.Request()); err != nil {
+		return fmt.Errorf("failed to write request: %s", err), false
+	}
+
+	reply := new(pond.Reply)
+	if err := readReply(conn, reply); err != nil {
+		return fmt.Errorf("failed to read reply: %s", err), false
+	}
+
+	if reply.Status != nil && *reply.Status == pond.Reply_RESUME_PAST_END_OF_FILE {
+		return nil, false
+	}
+
+	if err := replyToError(reply); err != nil {
+		if reply.GetStatus() == pond.Reply_OVER_QUOTA {
+			return fmt.Errorf("server reports that the upload would exceed allowed quota"), true
+		}
+		if reply.GetStatus() == pond.Reply_NO_SUCH_FILE {
+			return fmt.Errorf("server reports that the file doesn't exist"), true
+		}
+		return fmt.Errorf("request failed: %s", err), false
+	}
+
+	var file *os.File
+	var isUpload, isComplete bool
+	if file, isUpload, startingOffset, total, isComplete, err = transfer.ProcessReply(reply); err != nil {
+		return fmt.Errorf("request failed: %s", err), false
+	}
+	if isComplete {
+		return nil, false
+	}
+	todo := total - startingOffset
+
+	var in io.Reader
+	var out io.Writer
+	if isUpload {
+		out = conn
+		in = file
+	} else {
+		out = file
+		in = conn
+	}
+
+	buf := make([]byte, 16*1024)
+	var lastUpdate time.Time
+
+	for transferred < todo {
+		select {
+		case <-killChan:
+			return backgroundCanceledError, true
+		default:
+			break
+		}
+
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+		n, err := in.Read(buf)
+		if err != nil {
+			if isUpload {
+				return fmt.Errorf("failed to read from disk: %s", err), true
+			}
+
+			return err, false
+		}
+
+		n, err = out.Write(buf[:n])
+		if err != nil {
+			if !isUpload {
+				return fmt.Errorf("failed to write to disk: %s", err), true
+			}
+
+			return err, false
+		}
+
+		transferred += int64(n)
+
+		if transferred > todo {
+			return errors.New("transferred more than the expected amount"), true
+		}
+		now := time.Now()
+		if lastUpdate.IsZero() || now.Sub(lastUpdate) > 10*time.Millisecond {
+			lastUpdate = now
+			sendStatus("", startingOffset+transferred, total)
+		}
+	}
+	sendStatus("", startingOffset+transferred, total)
+
+	if transferred < todo {
+		return errors.New("incomplete transfer"), false
+	}
+
+	if !transfer.Complete(conn) {
+		return errors.New("didn't receive confirmation from server"), false
+	}
+	return nil, false
+}
+
+func (c *Client) transferDetachment(out chan interface{}, server string, transfer detachmentTransfer, id uint64, killChan chan bool) error {
+	sendStatus := func(s string, done, total int64) {
+		select {
+		case out <- DetachmentProgress{
+			Id:     id,
+			Done:   uint64(done),
+			Total:  uint64(total),
+			Status: s,
+		}:
+			break
+		default:
+		}
+	}
+
+	const initialBackoff = 10 * time.Second
+	const maxBackoff = 5 * time.Minute
+	backoff := initialBackoff
+
+	const maxTransientErrors = 15
+	transientErrors := 0
+
+	for transientErrors < maxTransientErrors {
+		sendStatus("Connecting", 0, 0)
+
+		conn, err := c.DialServer(server, purposeDetachment)
+		if err != nil {
+			c.Log.Printf("Failed to connect to %s: %s", server, err)
+			sendStatus("Waiting to reconnect", 0, 0)
+
+			select {
+			case <-time.After(backoff):
+				break
+			case <-killChan:
+				return backgroundCanceledError
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		backoff = initialBackoff
+		err, isFatal := c.transferDetachmentConn(sendStatus, conn, transfer, killChan)
+		if err == nil {
+			c.Log.Printf("Completed transfer to/from %s", server)
+			return nil
+		}
+
+		if err == backgroundCanceledError {
+			return err
+		}
+
+		if isFatal {
+			err = fmt.Errorf("fatal error: %s", err)
+		} else {
+			transientErrors++
+			err = fmt.Errorf("transient error: %s", err)
+		}
+		c.Log.Printf("While transferring to/from %s: %s", server, err)
+		if isFatal {
+			return err
+		}
+	}
+
+	err := errors.New("too many transient errors")
+	c.Log.Printf("While tranferring to/from %s: %s", server, err)
+	return err
+}
@@ -0,0 +1,205 @@
+package core
+
+import (
+	"errors"
+	"os"
+)
+
+// While the client is offline it doesn't touch the network at all: Tor isn't
+// needed, no transactions are made, PANDA key exchanges and detachment
+// transfers wait until the client is online again, and sent messages stay in
+// the queue. Composing, reading and preparing key exchanges all work as
+// normal. A sync makes a bounded number of transactions, enough to deliver
+// the queue and fetch what's waiting, and then the client is offline again.
+// A sync also uploads the detachments of drafts that are waiting to be sent
+// and, once they've been uploaded, syncs again to deliver the drafts.
+
+// maxSyncTransactions is the largest number of transactions that a sync will
+// make.
+const maxSyncTransactions = 40
+
+var ErrOffline = errors.New("the client is offline")
+
+// IsOffline returns true if the client is in offline mode.
+func (c *Client) IsOffline() bool {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	return c.network.Offline
+}
+
+// loadOfflineFromEnvironment enters offline mode if the POND_OFFLINE
+// environment variable is set, so that a client that was last used online can
+// be started without touching the network. It's called before anything that
+// uses the network has started.
+func (c *Client) loadOfflineFromEnvironment() {
+	if len(os.Getenv("POND_OFFLINE")) == 0 {
+		return
+	}
+	c.Log.Printf("Starting offline because POND_OFFLINE is set")
+
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	c.network.Offline = true
+}
+
+// SetOffline enters or leaves offline mode. When going offline, running PANDA
+// key exchanges are stopped; they're resumed from their saved state when the
+// client comes back online, as are any transfers that were waiting. It runs
+// on the main client goroutine.
+func (c *Client) SetOffline(offline bool) {
+	c.NetworkLock.Lock()
+	c.network.Offline = offline
+	c.syncRemaining = 0
+	if !offline {
+		c.syncUploads = 0
+	}
+	c.NetworkLock.Unlock()
+
+	for _, contact := range c.Contacts {
+		if len(contact.PandaKeyExchange) == 0 {
+			continue
+		}
+		if offline && contact.PandaShutdownChan != nil {
+			close(contact.PandaShutdownChan)
+			contact.PandaShutdownChan = nil
+		} else if !offline && contact.PandaShutdownChan == nil {
+			c.ResumePANDA(contact)
+		}
+	}
+	if !offline {
+		for _, t := range c.Transfers {
+			t.sync = false
+			if t.KillChan == nil {
+				c.Log.Printf("Starting %s of %s", t.Direction(), t.Name())
+				c.runTransfer(t)
+			}
+		}
+	}
+
+	c.pokeNetworkSchedule()
+}
+
+// syncTransactions returns the number of transactions that a sync should
+// make: one to deliver each queued message and one to fetch after each of
+// those, as well as a final pair for anything that arrives in the meantime.
+func (c *Client) syncTransactions() int {
+	c.QueueMutex.Lock()
+	n := 2*len(c.Queue) + 2
+	c.QueueMutex.Unlock()
+
+	if n > maxSyncTransactions {
+		n = maxSyncTransactions
+	}
+	return n
+}
+
+// StartSync causes the network goroutine to make a bounded number of
+// transactions while offline. It returns the number of transactions.
+func (c *Client) StartSync() (int, error) {
+	n := c.syncTransactions()
+
+	c.NetworkLock.Lock()
+	if !c.network.Offline {
+		c.NetworkLock.Unlock()
+		return 0, errors.New("the client isn't offline")
+	}
+	c.syncRemaining = n
+	c.NetworkLock.Unlock()
+
+	c.startSyncUploads()
+	c.pokeNetworkSchedule()
+	return n, nil
+}
+
+// startSyncUploads starts the waiting uploads of drafts that are to be sent
+// once they've been uploaded. It runs on the main client goroutine.
+func (c *Client) startSyncUploads() {
+	var uploads []*Transfer
+	for _, t := range c.Transfers {
+		if !t.Upload || t.KillChan != nil {
+			continue
+		}
+		if draft, ok := c.Drafts[t.Draft]; !ok || !draft.SendWhenUploaded {
+			continue
+		}
+		uploads = append(uploads, t)
+	}
+	if len(uploads) == 0 {
+		return
+	}
+
+	c.NetworkLock.Lock()
+	c.syncUploads += len(uploads)
+	c.NetworkLock.Unlock()
+
+	for _, t := range uploads {
+		c.Log.Printf("Starting upload of %s for sync", t.Name())
+		t.sync = true
+		c.runTransfer(t)
+	}
+}
+
+// syncUploadFinished is called on the main client goroutine when an upload
+// that was started by a sync has finished. If the client is still offline
+// and messages are queued, such as the draft that was waiting for the upload,
+// then another sync is started to deliver them.
+func (c *Client) syncUploadFinished() {
+	c.NetworkLock.Lock()
+	if c.syncUploads > 0 {
+		c.syncUploads--
+	}
+	offline := c.network.Offline
+	c.NetworkLock.Unlock()
+
+	c.QueueMutex.Lock()
+	queued := len(c.Queue) > 0
+	c.QueueMutex.Unlock()
+
+	if offline && queued {
+		c.StartSync()
+	}
+}
+
+// dialAllowed returns false if a connection for the given purpose mustn't be
+// made because the client is offline. The network goroutine only transacts
+// while offline when syncing, and detachments are only transferred while
+// offline for uploads that a sync started.
+func (c *Client) dialAllowed(purpose connPurpose) bool {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	switch {
+	case !c.network.Offline:
+		return true
+	case purpose == PurposeFetch, purpose == PurposeDelivery:
+		return true
+	case purpose == purposeDetachment:
+		return c.syncUploads > 0
+	}
+	return false
+}
+
+// takeSyncTransaction returns true, and counts the transaction, if the
+// network goroutine should make a transaction as part of a sync. It's called
+// from the network goroutine.
+func (c *Client) takeSyncTransaction() bool {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	if !c.network.Offline || c.syncRemaining == 0 {
+		return false
+	}
+	c.syncRemaining--
+	return true
+}
+
+// SyncStatus returns whether the client is offline and, if so, the number of
+// transactions that remain in the current sync.
+func (c *Client) SyncStatus() (offline bool, remaining int) {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	return c.network.Offline, c.syncRemaining
+}
@@ -0,0 +1,380 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+)
+
+// MultipartVersion is the first protocol version in which messages that are
+// split into parts are understood. A draft that's too long to send as a
+// single message can only be sent if all its recipients have advertised at
+// least this version.
+const MultipartVersion = 3
+
+// maxMessageParts is the largest number of parts that a message may be split
+// into. It also limits the number of parts that a contact can make us hold
+// for a single message.
+const maxMessageParts = 64
+
+// IsMessagePart returns true if msg is one of the parts of a message that was
+// split into several.
+func IsMessagePart(msg *pond.Message) bool {
+	return msg != nil && msg.PartGroup != nil
+}
+
+// canSplit returns true if all the recipients of draft understand messages
+// that are split into parts.
+func (c *Client) canSplit(draft *Draft) bool {
+	recipients := draft.Recipients()
+	if len(recipients) == 0 {
+		return false
+	}
+	for _, id := range recipients {
+		if to, ok := c.Contacts[id]; !ok || to.SupportedVersion < MultipartVersion {
+			return false
+		}
+	}
+	return true
+}
+
+// partTemplate returns a message that's at least as large, when serialised,
+// as any part of draft with an empty body. Only the first part carries the
+// attachments and the reference to the message that draft replies to.
+func (c *Client) partTemplate(draft *Draft, first bool) *pond.Message {
+	msg := c.candidateMessage(draft)
+	msg.Body = make([]byte, 0)
+	msg.PartGroup = proto.Uint64(0)
+	msg.PartNumber = proto.Uint32(math.MaxUint32)
+	msg.NumParts = proto.Uint32(math.MaxUint32)
+	if !first {
+		msg.InReplyTo = nil
+		msg.AlsoAck = nil
+		msg.Files = nil
+		msg.DetachedFiles = nil
+	}
+	return msg
+}
+
+// partCapacity returns the number of bytes of body that can be added to
+// template without it becoming too large.
+func partCapacity(template *pond.Message) int {
+	serialized, err := proto.Marshal(template)
+	if err != nil {
+		panic("error while serialising candidate Message: " + err.Error())
+	}
+	// The length of a body that fills a message takes one more byte to
+	// encode than the length of an empty body.
+	return pond.MaxSerializedMessage - len(serialized) - 1
+}
+
+// splitBody returns the bodies of the parts that draft will be sent as. It
+// returns an error if draft can't be split: because a recipient doesn't
+// support it, because its attachments don't leave space for the body in the
+// first part or because it would take more than maxMessageParts parts.
+func (c *Client) splitBody(draft *Draft) ([]string, error) {
+	if !c.canSplit(draft) {
+		return nil, errors.New("message too large and not all recipients support sending it in parts")
+	}
+
+	body := draft.Body
+	capacity := partCapacity(c.partTemplate(draft, true))
+	restCapacity := partCapacity(c.partTemplate(draft, false))
+
+	var bodies []string
+	for len(body) > 0 {
+		// Every part needs a body because empty bodies are ACKs.
+		if capacity < utf8.UTFMax {
+			return nil, errors.New("message too large")
+		}
+		if len(bodies) == maxMessageParts {
+			return nil, errors.New("message too long")
+		}
+		n := capacity
+		if n >= len(body) {
+			n = len(body)
+		} else {
+			for !utf8.RuneStart(body[n]) {
+				n--
+			}
+		}
+		bodies = append(bodies, body[:n])
+		body = body[n:]
+		capacity = restCapacity
+	}
+	if len(bodies) < 2 {
+		return nil, errors.New("message too large")
+	}
+	return bodies, nil
+}
+
+// fits returns true if draft can be sent, either as a single message or split
+// into parts.
+func (c *Client) fits(draft *Draft) bool {
+	if size, _ := c.draftSize(draft); size <= pond.MaxSerializedMessage {
+		return true
+	}
+	_, err := c.splitBody(draft)
+	return err == nil
+}
+
+// splitMessage returns the parts, with the given bodies, that message will be
+// sent as. The first part has the same id as message.
+func (c *Client) splitMessage(message *pond.Message, bodies []string) []*pond.Message {
+	var groupBytes [8]byte
+	c.RandBytes(groupBytes[:])
+	group := binary.LittleEndian.Uint64(groupBytes[:])
+
+	parts := make([]*pond.Message, 0, len(bodies))
+	for i, body := range bodies {
+		part := *message
+		part.Body = []byte(body)
+		part.PartGroup = proto.Uint64(group)
+		part.PartNumber = proto.Uint32(uint32(i))
+		part.NumParts = proto.Uint32(uint32(len(bodies)))
+		if i > 0 {
+			part.Id = proto.Uint64(c.RandId())
+			part.InReplyTo = nil
+			part.AlsoAck = nil
+			part.Files = nil
+			part.DetachedFiles = nil
+		}
+		parts = append(parts, &part)
+	}
+	return parts
+}
+
+// sendParts is like sendCopy for a message that has been split into parts.
+// The parts are enqueued for transmission and message, which has the same id
+// as the first part, is added to the outbox so that the parts are shown, and
+// erased, as a single message.
+func (c *Client) sendParts(to *Contact, message *pond.Message, parts []*pond.Message, fanoutId uint64, notBefore time.Time) error {
+	out := &QueuedMessage{
+		Id:        *message.Id,
+		To:        to.Id,
+		Server:    to.TheirServer,
+		Message:   message,
+		Created:   time.Unix(*message.Time, 0),
+		FanoutId:  fanoutId,
+		NotBefore: notBefore,
+	}
+	for _, part := range parts {
+		messageBytes, err := serializeMessage(to, part)
+		if err != nil {
+			return err
+		}
+		if len(messageBytes) > pond.MaxSerializedMessage {
+			return errors.New("message too large")
+		}
+
+		out.Parts = append(out.Parts, &QueuedMessage{
+			Id:        *part.Id,
+			To:        to.Id,
+			Server:    to.TheirServer,
+			Message:   part,
+			Created:   out.Created,
+			NotBefore: notBefore,
+		})
+	}
+
+	for _, part := range out.Parts {
+		if notBefore.IsZero() {
+			c.enqueue(part)
+		} else {
+			c.schedule(part)
+		}
+	}
+	c.Outbox = append(c.Outbox, out)
+
+	return nil
+}
+
+// transmissions returns the messages that are transmitted for an outbox
+// message: its parts, if it was split, or else the message itself.
+func (msg *QueuedMessage) transmissions() []*QueuedMessage {
+	if len(msg.Parts) > 0 {
+		return msg.Parts
+	}
+	return []*QueuedMessage{msg}
+}
+
+// partsSent returns the time at which the last part of msg was sent, or the
+// zero time if some parts haven't been sent yet.
+func (msg *QueuedMessage) partsSent() (sent time.Time) {
+	for _, part := range msg.Parts {
+		if part.Sent.IsZero() {
+			return time.Time{}
+		}
+		if part.Sent.After(sent) {
+			sent = part.Sent
+		}
+	}
+	return
+}
+
+// partsAcked returns the time at which the last part of msg was acknowledged,
+// or the zero time if some parts haven't been acknowledged yet.
+func (msg *QueuedMessage) partsAcked() (acked time.Time) {
+	for _, part := range msg.Parts {
+		if part.Acked.IsZero() {
+			return time.Time{}
+		}
+		if part.Acked.After(acked) {
+			acked = part.Acked
+		}
+	}
+	return
+}
+
+// findTransmission returns the outbox message that includes the transmitted
+// message with the given id, and the transmitted message itself.
+func (c *Client) findTransmission(id uint64) (msg, transmission *QueuedMessage) {
+	for _, msg := range c.Outbox {
+		for _, transmission := range msg.transmissions() {
+			if transmission.Id == id {
+				return msg, transmission
+			}
+		}
+	}
+	return nil, nil
+}
+
+// replyAcks returns the ids of the further parts of the message that draft
+// replies to, which the reply acknowledges along with the message itself.
+func (c *Client) replyAcks(draft *Draft) []uint64 {
+	for _, msg := range c.Inbox {
+		if msg.From == draft.To && msg.Message != nil && msg.Message.GetId() == draft.InReplyTo {
+			return msg.PartIds
+		}
+	}
+	return nil
+}
+
+// isDuplicatePart returns true if a part with the given id, from the given
+// contact, is already held or has been reassembled into an inbox message.
+func (c *Client) isDuplicatePart(from, id uint64) bool {
+	for _, held := range c.HeldParts {
+		if held.From == from && held.Message.GetId() == id {
+			return true
+		}
+	}
+	for _, msg := range c.Inbox {
+		if msg.From != from {
+			continue
+		}
+		for _, partId := range msg.PartIds {
+			if partId == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holdPart adds a part of a message to those that are held until all the
+// parts have arrived. If msg was the last part to arrive then the parts are
+// removed and the reassembled message is returned.
+func (c *Client) holdPart(msg *InboxMessage, from *Contact) *InboxMessage {
+	numParts := msg.Message.GetNumParts()
+	if numParts < 2 || numParts > maxMessageParts || msg.Message.GetPartNumber() >= numParts {
+		c.logEvent(from, "Received a part of a message with an invalid part number")
+		return nil
+	}
+	c.HeldParts = append(c.HeldParts, msg)
+
+	group := msg.Message.GetPartGroup()
+	parts := make([]*InboxMessage, numParts)
+	var stillHeld []*InboxMessage
+	for _, held := range c.HeldParts {
+		if held.From != msg.From || held.Message.GetPartGroup() != group {
+			stillHeld = append(stillHeld, held)
+			continue
+		}
+		if held.Message.GetNumParts() == numParts {
+			parts[held.Message.GetPartNumber()] = held
+		}
+	}
+	for _, part := range parts {
+		if part == nil {
+			return nil
+		}
+	}
+	c.HeldParts = stillHeld
+
+	return c.reassemble(parts)
+}
+
+// expireHeldParts drops the parts of messages that haven't arrived in full
+// within MessageLifetime. It returns true if any parts were dropped.
+func (c *Client) expireHeldParts(now time.Time) bool {
+	var stillHeld []*InboxMessage
+	for _, held := range c.HeldParts {
+		if now.Sub(held.ReceivedTime) > MessageLifetime {
+			continue
+		}
+		stillHeld = append(stillHeld, held)
+	}
+	expired := len(stillHeld) != len(c.HeldParts)
+	c.HeldParts = stillHeld
+	return expired
+}
+
+// reassemble returns the message that was split into the given parts.
+func (c *Client) reassemble(parts []*InboxMessage) *InboxMessage {
+	first := parts[0]
+	message := *first.Message
+	message.PartGroup = nil
+	message.PartNumber = nil
+	message.NumParts = nil
+
+	var body []byte
+	var partIds []uint64
+	for i, part := range parts {
+		body = append(body, part.Message.Body...)
+		if i == 0 {
+			continue
+		}
+		message.Files = append(message.Files, part.Message.Files...)
+		message.DetachedFiles = append(message.DetachedFiles, part.Message.DetachedFiles...)
+		partIds = append(partIds, part.Message.GetId())
+	}
+	message.Body = body
+
+	return &InboxMessage{
+		Id:           c.RandId(),
+		ReceivedTime: c.Now(),
+		From:         first.From,
+		Message:      &message,
+		PartIds:      partIds,
+	}
+}
+
+// HoldUnsealedParts is run once the messages from a previously pending
+// contact have been unsealed. It moves the parts of any messages from the
+// inbox to those that are held, and reassembled messages are added to the
+// inbox as if they had just been fetched.
+func (c *Client) HoldUnsealedParts(contact *Contact) {
+	var parts []*InboxMessage
+	newInbox := make([]*InboxMessage, 0, len(c.Inbox))
+	for _, msg := range c.Inbox {
+		if msg.From == contact.Id && IsMessagePart(msg.Message) {
+			parts = append(parts, msg)
+			c.unindex(msg)
+			continue
+		}
+		newInbox = append(newInbox, msg)
+	}
+	c.Inbox = newInbox
+
+	for _, part := range parts {
+		if msg := c.holdPart(part, contact); msg != nil {
+			c.Inbox = append(c.Inbox, msg)
+			c.UI.ProcessFetch(msg)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agl/pond/client/disk"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// defaultTransactionInterval is the mean of the exponential
+	// distribution that we'll sample in order to distribute the time
+	// between our network connections.
+	defaultTransactionInterval = 5 * time.Minute
+	// MinTransactionInterval is the smallest mean interval, in normal or
+	// burst mode, that can be configured.
+	MinTransactionInterval = 10 * time.Second
+	// MaxBurstTransactions is the largest number of transactions that a
+	// burst can be configured to last for.
+	MaxBurstTransactions = 20
+)
+
+// NetworkSchedule is the user's policy for when network transactions are
+// made. The zero value makes transactions at the default rate at any time.
+type NetworkSchedule struct {
+	// Interval is the mean time between transactions, or zero to use
+	// defaultTransactionInterval.
+	Interval time.Duration
+	// BurstTransactions is the number of transactions after a message is
+	// sent that use BurstInterval as their mean interval, so that replies
+	// arrive quickly while chatting.
+	BurstTransactions int
+	BurstInterval     time.Duration
+	// QuietHours is true if no transactions should be made between
+	// QuietStart and QuietEnd, which are local times in minutes after
+	// midnight. The period may span midnight.
+	QuietHours           bool
+	QuietStart, QuietEnd int
+	// Paused is true if no transactions should be made on a timer.
+	Paused bool
+}
+
+func (s *NetworkSchedule) marshal(m *disk.NetworkConfig) {
+	if s.Interval != 0 {
+		m.TransactionInterval = proto.Int64(int64(s.Interval / time.Second))
+	}
+	if s.BurstTransactions > 0 {
+		m.BurstTransactions = proto.Int32(int32(s.BurstTransactions))
+		m.BurstInterval = proto.Int64(int64(s.BurstInterval / time.Second))
+	}
+	if s.QuietHours {
+		m.QuietStart = proto.Int32(int32(s.QuietStart))
+		m.QuietEnd = proto.Int32(int32(s.QuietEnd))
+	}
+	if s.Paused {
+		m.Paused = proto.Bool(true)
+	}
+}
+
+// Unmarshal reads a schedule from m. Values that the CLI wouldn't accept,
+// which can only come from a corrupt or edited state file, are replaced by
+// their defaults so that the network goroutine never spins on a zero
+// interval.
+func (s *NetworkSchedule) Unmarshal(m *disk.NetworkConfig) {
+	*s = NetworkSchedule{}
+
+	if interval := time.Duration(m.GetTransactionInterval()) * time.Second; interval >= MinTransactionInterval {
+		s.Interval = interval
+	}
+	burstTransactions := int(m.GetBurstTransactions())
+	burstInterval := time.Duration(m.GetBurstInterval()) * time.Second
+	if burstTransactions > 0 && burstInterval >= MinTransactionInterval {
+		if burstTransactions > MaxBurstTransactions {
+			burstTransactions = MaxBurstTransactions
+		}
+		s.BurstTransactions = burstTransactions
+		s.BurstInterval = burstInterval
+	}
+	if m.QuietStart != nil && m.QuietEnd != nil {
+		start, end := int(m.GetQuietStart()), int(m.GetQuietEnd())
+		if validMinutes(start) && validMinutes(end) && start != end {
+			s.QuietHours = true
+			s.QuietStart = start
+			s.QuietEnd = end
+		}
+	}
+	s.Paused = m.GetPaused()
+}
+
+// validMinutes returns true if minutes is a time of day in minutes after
+// midnight.
+func validMinutes(minutes int) bool {
+	return minutes >= 0 && minutes < 24*60
+}
+
+// MeanInterval returns the mean time between transactions outside of a burst.
+func (s *NetworkSchedule) MeanInterval() time.Duration {
+	if s.Interval == 0 {
+		return defaultTransactionInterval
+	}
+	return s.Interval
+}
+
+// quietUntil returns the end of the quiet period that t falls in, if any.
+func (s *NetworkSchedule) quietUntil(t time.Time) (time.Time, bool) {
+	if !s.QuietHours || s.QuietStart == s.QuietEnd {
+		return time.Time{}, false
+	}
+
+	t = t.Local()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	minute := t.Hour()*60 + t.Minute()
+	end := midnight.Add(time.Duration(s.QuietEnd) * time.Minute)
+
+	if s.QuietStart < s.QuietEnd {
+		if minute >= s.QuietStart && minute < s.QuietEnd {
+			return end, true
+		}
+		return time.Time{}, false
+	}
+
+	// The quiet period spans midnight.
+	switch {
+	case minute >= s.QuietStart:
+		return end.AddDate(0, 0, 1), true
+	case minute < s.QuietEnd:
+		return end, true
+	}
+	return time.Time{}, false
+}
+
+// formatMinutes formats a time in minutes after midnight like "22:30".
+func formatMinutes(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// QuietHoursString returns a description of the quiet hours of s, in the
+// format that ParseQuietHours accepts.
+func (s *NetworkSchedule) QuietHoursString() string {
+	if !s.QuietHours {
+		return "none"
+	}
+	return formatMinutes(s.QuietStart) + "-" + formatMinutes(s.QuietEnd)
+}
+
+// parseMinutes parses a time of day like "07:00" into minutes after midnight.
+func parseMinutes(s string) (int, error) {
+	colon := strings.IndexRune(s, ':')
+	if colon == -1 {
+		return 0, errors.New("times must be given like 07:00")
+	}
+	hours, err := strconv.Atoi(s[:colon])
+	if err != nil || hours < 0 || hours > 23 {
+		return 0, errors.New("invalid hour: " + s)
+	}
+	minutes, err := strconv.Atoi(s[colon+1:])
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, errors.New("invalid minute: " + s)
+	}
+	return hours*60 + minutes, nil
+}
+
+// ParseQuietHours parses quiet hours given like "22:00-07:00", or "none".
+func ParseQuietHours(s string) (quietHours bool, start, end int, err error) {
+	if s == "none" {
+		return
+	}
+	dash := strings.IndexRune(s, '-')
+	if dash == -1 {
+		err = errors.New("quiet hours must be given like 22:00-07:00")
+		return
+	}
+	if start, err = parseMinutes(s[:dash]); err != nil {
+		return
+	}
+	if end, err = parseMinutes(s[dash+1:]); err != nil {
+		return
+	}
+	if start == end {
+		err = errors.New("quiet hours must start and end at different times")
+		return
+	}
+	quietHours = true
+	return
+}
+
+// ParseInterval parses a mean transaction interval given on the command line.
+// It accepts "default", a number of days such as "1d", or anything that
+// time.ParseDuration accepts.
+func ParseInterval(s string) (time.Duration, error) {
+	if s == "default" {
+		return 0, nil
+	}
+	d, err := ParseDays(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < MinTransactionInterval {
+		return 0, errors.New("interval must be at least " + MinTransactionInterval.String())
+	}
+	return d, nil
+}
+
+// NetworkSchedule returns a copy of the current schedule.
+func (c *Client) NetworkSchedule() NetworkSchedule {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	return c.network.Schedule
+}
+
+// SetNetworkSchedule changes the schedule and tells the network goroutine to
+// recalculate the time of the next transaction.
+func (c *Client) SetNetworkSchedule(s NetworkSchedule) {
+	c.NetworkLock.Lock()
+	c.network.Schedule = s
+	if s.BurstTransactions < c.burstRemaining {
+		c.burstRemaining = s.BurstTransactions
+	}
+	c.NetworkLock.Unlock()
+
+	c.pokeNetworkSchedule()
+}
+
+// pokeNetworkSchedule causes the network goroutine to recalculate the time of
+// the next transaction.
+func (c *Client) pokeNetworkSchedule() {
+	select {
+	case c.networkPolicyChan <- true:
+	default:
+	}
+}
+
+// startBurst is called when a message has been sent. If bursts are
+// configured, the following transactions use the burst interval.
+func (c *Client) startBurst() {
+	c.NetworkLock.Lock()
+	burst := c.network.Schedule.BurstTransactions
+	c.burstRemaining = burst
+	c.NetworkLock.Unlock()
+
+	if burst > 0 {
+		c.pokeNetworkSchedule()
+	}
+}
+
+// nextTransactionDelay samples the time until the next timed transaction and
+// records it. It returns false if no timed transaction should be made, because
+// they're paused or the client is offline. It's called from the network
+// goroutine.
+func (c *Client) nextTransactionDelay(r *mrand.Rand, now time.Time) (time.Duration, bool) {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	s := &c.network.Schedule
+	if s.Paused || c.network.Offline {
+		c.nextTransaction = time.Time{}
+		return 0, false
+	}
+
+	mean := s.MeanInterval()
+	if c.burstRemaining > 0 {
+		mean = s.BurstInterval
+	}
+	sample := func() time.Duration {
+		if c.Dev {
+			return 5 * time.Second
+		}
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+
+	next := now.Add(sample())
+	// If the transaction would fall in quiet hours then it's pushed back
+	// to a random time after they end. A sample may land in the following
+	// night's quiet hours if the mean is long, so this repeats.
+	for i := 0; i < 8; i++ {
+		end, ok := s.quietUntil(next)
+		if !ok {
+			break
+		}
+		next = end.Add(sample())
+	}
+
+	c.nextTransaction = next
+	return next.Sub(now), true
+}
+
+// mayTransactNow returns true if a timed transaction may be made at now.
+func (c *Client) mayTransactNow(now time.Time) bool {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	s := &c.network.Schedule
+	if s.Paused || c.network.Offline {
+		return false
+	}
+	_, quiet := s.quietUntil(now)
+	return !quiet
+}
+
+// transactionStarted is called from the network goroutine when a
+// transaction begins.
+func (c *Client) transactionStarted() {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	c.nextTransaction = time.Time{}
+	if c.burstRemaining > 0 {
+		c.burstRemaining--
+	}
+}
+
+// NextTransactionTime returns the time of the next timed transaction, which is
+// zero if there's none pending, and whether timed transactions are paused.
+func (c *Client) NextTransactionTime() (next time.Time, paused bool) {
+	c.NetworkLock.Lock()
+	defer c.NetworkLock.Unlock()
+
+	return c.nextTransaction, c.network.Schedule.Paused
+}
@@ -0,0 +1,305 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agl/pond/client/disk"
+	"github.com/golang/protobuf/proto"
+)
+
+// maxRetentionDays and maxRetentionHours bound the values that can be set in
+// a RetentionPolicy.
+const (
+	maxRetentionDays  = 3650
+	maxRetentionHours = 24 * maxRetentionDays
+)
+
+// RetentionPolicy describes how long messages from, or to, a contact are kept
+// before being erased. The zero value is the default policy, which keeps
+// messages for MessageLifetime.
+type RetentionPolicy struct {
+	Mode disk.Retention_Mode
+	// Days is the number of days, from receipt or creation, for which
+	// messages are kept with mode DAYS.
+	Days int
+	// Hours is the number of hours, from when the message was read or
+	// acknowledged, for which messages are kept with mode AFTER_READ.
+	Hours int
+}
+
+// InboxRetentionChoices and OutboxRetentionChoices are offered in the GUI.
+var (
+	InboxRetentionChoices = []RetentionPolicy{
+		{},
+		{Mode: disk.Retention_DAYS, Days: 1},
+		{Mode: disk.Retention_DAYS, Days: 3},
+		{Mode: disk.Retention_DAYS, Days: 30},
+		{Mode: disk.Retention_AFTER_READ, Hours: 1},
+		{Mode: disk.Retention_AFTER_READ, Hours: 24},
+		{Mode: disk.Retention_FOREVER},
+	}
+	OutboxRetentionChoices = []RetentionPolicy{
+		{},
+		{Mode: disk.Retention_DAYS, Days: 1},
+		{Mode: disk.Retention_DAYS, Days: 30},
+		{Mode: disk.Retention_AFTER_READ, Hours: 1},
+		{Mode: disk.Retention_AFTER_READ, Hours: 24},
+		{Mode: disk.Retention_FOREVER},
+	}
+)
+
+func pluralise(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// Describe returns a description of the policy. The description of AFTER_READ
+// depends on whether the policy applies to sent messages, which are
+// acknowledged rather than read.
+func (p RetentionPolicy) Describe(outbox bool) string {
+	switch p.Mode {
+	case disk.Retention_DAYS:
+		return pluralise(p.Days, "day")
+	case disk.Retention_AFTER_READ:
+		if outbox {
+			return pluralise(p.Hours, "hour") + " after acknowledgement"
+		}
+		return pluralise(p.Hours, "hour") + " after reading"
+	case disk.Retention_FOREVER:
+		return "Forever"
+	}
+	return "Default (" + pluralise(int(MessageLifetime/(24*time.Hour)), "day") + ")"
+}
+
+// ParseRetention parses a policy given on the command line. It accepts
+// "default", "forever", a number of days such as "30d", or a number of hours
+// after reading, or acknowledgement, such as "read+12h".
+func ParseRetention(s string) (RetentionPolicy, error) {
+	switch {
+	case s == "default":
+		return RetentionPolicy{}, nil
+	case s == "forever":
+		return RetentionPolicy{Mode: disk.Retention_FOREVER}, nil
+	case strings.HasPrefix(s, "read+") && strings.HasSuffix(s, "h"):
+		hours, err := strconv.Atoi(s[5 : len(s)-1])
+		if err != nil || hours < 0 || hours > maxRetentionHours {
+			return RetentionPolicy{}, errors.New("invalid number of hours: " + s)
+		}
+		return RetentionPolicy{Mode: disk.Retention_AFTER_READ, Hours: hours}, nil
+	case strings.HasSuffix(s, "d"):
+		days, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || days < 1 || days > maxRetentionDays {
+			return RetentionPolicy{}, errors.New("invalid number of days: " + s)
+		}
+		return RetentionPolicy{Mode: disk.Retention_DAYS, Days: days}, nil
+	}
+	return RetentionPolicy{}, errors.New("unknown retention policy: " + s)
+}
+
+// eraseTime returns the time at which a message is erased under the policy,
+// given the time at which it was received or created and the time at which it
+// was read or acknowledged, which may be zero. It returns false if the message
+// is to be kept indefinitely.
+func (p RetentionPolicy) eraseTime(start, read time.Time) (time.Time, bool) {
+	switch p.Mode {
+	case disk.Retention_DAYS:
+		return start.Add(time.Duration(p.Days) * 24 * time.Hour), true
+	case disk.Retention_AFTER_READ:
+		if read.IsZero() {
+			return time.Time{}, false
+		}
+		return read.Add(time.Duration(p.Hours) * time.Hour), true
+	case disk.Retention_FOREVER:
+		return time.Time{}, false
+	}
+	return start.Add(MessageLifetime), true
+}
+
+func (p RetentionPolicy) marshal() *disk.Retention {
+	if p.Mode == disk.Retention_DEFAULT {
+		return nil
+	}
+	m := &disk.Retention{Mode: p.Mode.Enum()}
+	switch p.Mode {
+	case disk.Retention_DAYS:
+		m.Days = proto.Uint32(uint32(p.Days))
+	case disk.Retention_AFTER_READ:
+		m.Hours = proto.Uint32(uint32(p.Hours))
+	}
+	return m
+}
+
+func unmarshalRetention(m *disk.Retention) RetentionPolicy {
+	p := RetentionPolicy{Mode: m.GetMode()}
+	switch p.Mode {
+	case disk.Retention_DAYS:
+		p.Days = int(m.GetDays())
+		if p.Days < 1 || p.Days > maxRetentionDays {
+			return RetentionPolicy{}
+		}
+	case disk.Retention_AFTER_READ:
+		p.Hours = int(m.GetHours())
+		if p.Hours > maxRetentionHours {
+			return RetentionPolicy{}
+		}
+	case disk.Retention_FOREVER:
+	default:
+		return RetentionPolicy{}
+	}
+	return p
+}
+
+// RetentionLabels returns the descriptions of choices, plus current if it's
+// not one of them, and the description of current.
+func RetentionLabels(choices []RetentionPolicy, current RetentionPolicy, outbox bool) (labels []string, selected string) {
+	selected = current.Describe(outbox)
+	found := false
+	for _, choice := range choices {
+		label := choice.Describe(outbox)
+		labels = append(labels, label)
+		if label == selected {
+			found = true
+		}
+	}
+	if !found {
+		labels = append(labels, selected)
+	}
+	return
+}
+
+// RetentionForLabel returns the policy with the given description from
+// choices, or current if there isn't one.
+func RetentionForLabel(choices []RetentionPolicy, label string, current RetentionPolicy, outbox bool) RetentionPolicy {
+	for _, choice := range choices {
+		if choice.Describe(outbox) == label {
+			return choice
+		}
+	}
+	return current
+}
+
+// MarkRead marks an inbox message as read and records the time at which that
+// first happened.
+func (msg *InboxMessage) MarkRead(now time.Time) {
+	msg.Read = true
+	if msg.ReadTime.IsZero() {
+		msg.ReadTime = now
+	}
+}
+
+// InboxEraseTime returns the time at which an inbox message will be erased,
+// unless it's retained, or false if it'll be kept until deleted. The sender
+// may ask for a message to be erased sooner than the contact's policy would.
+func (c *Client) InboxEraseTime(msg *InboxMessage) (time.Time, bool) {
+	if expiry := c.SenderExpiry(msg); expiry != 0 {
+		return msg.ReceivedTime.Add(expiry), true
+	}
+	return c.inboxPolicyEraseTime(msg)
+}
+
+// inboxPolicyEraseTime returns the time at which an inbox message will be
+// erased under the retention policy for its sender, ignoring any expiry that
+// the sender requested.
+func (c *Client) inboxPolicyEraseTime(msg *InboxMessage) (time.Time, bool) {
+	var policy RetentionPolicy
+	if from, ok := c.Contacts[msg.From]; ok {
+		policy = from.InboxRetention
+	}
+	return policy.eraseTime(msg.ReceivedTime, msg.ReadTime)
+}
+
+// InboxExpired returns true if an inbox message should be erased.
+func (c *Client) InboxExpired(msg *InboxMessage, now time.Time) bool {
+	if msg.Retained {
+		return false
+	}
+	eraseTime, ok := c.InboxEraseTime(msg)
+	return ok && now.After(eraseTime)
+}
+
+// InboxEraseSoon returns true if an inbox message will be erased soon and
+// should be indicated as such. The warning period is the same fraction of
+// the message's lifetime as for the default policy.
+func (c *Client) InboxEraseSoon(msg *InboxMessage, now time.Time) bool {
+	if msg.Retained {
+		return false
+	}
+	eraseTime, ok := c.InboxEraseTime(msg)
+	if !ok {
+		return false
+	}
+	start := msg.ReceivedTime
+	if msg.ReadTime.After(start) && msg.ReadTime.Before(eraseTime) {
+		start = msg.ReadTime
+	}
+	warning := eraseTime.Sub(start) / (MessageLifetime / (MessageLifetime - MessagePreIndicationLifetime))
+	return now.After(eraseTime.Add(-warning))
+}
+
+// inboxEraseTimeString describes when an inbox message will be erased.
+func (c *Client) inboxEraseTimeString(msg *InboxMessage) string {
+	eraseTime, ok := c.InboxEraseTime(msg)
+	switch {
+	case ok:
+		return eraseTime.Format(time.RFC1123)
+	case !msg.Read:
+		return "(after it has been read)"
+	}
+	return "(never)"
+}
+
+// outboxEraseTime returns the time at which an outbox message will be erased,
+// or false if it'll be kept until deleted. The message's lifetime starts when
+// it's transmitted or, until then, when it's scheduled to be.
+func (c *Client) outboxEraseTime(msg *QueuedMessage) (time.Time, bool) {
+	start := msg.Sent
+	if start.IsZero() {
+		start = msg.Created
+		if msg.NotBefore.After(start) {
+			start = msg.NotBefore
+		}
+	}
+	return c.outboxRetention(msg).eraseTime(start, msg.Acked)
+}
+
+// OutboxRetention returns the policy that applies to an outbox message.
+// Revocations always use the default.
+func (c *Client) outboxRetention(msg *QueuedMessage) RetentionPolicy {
+	if to, ok := c.Contacts[msg.To]; ok && !msg.Revocation {
+		return to.OutboxRetention
+	}
+	return RetentionPolicy{}
+}
+
+// outboxExpired returns true if an outbox message should be erased. Messages
+// that are still waiting to be transmitted, whether queued or scheduled, are
+// never erased.
+func (c *Client) outboxExpired(msg *QueuedMessage, now time.Time) bool {
+	c.QueueMutex.Lock()
+	waiting := c.IsQueued(msg)
+	c.QueueMutex.Unlock()
+	if waiting {
+		return false
+	}
+
+	eraseTime, ok := c.outboxEraseTime(msg)
+	return ok && now.After(eraseTime)
+}
+
+// OutboxEraseTimeString describes when an outbox message will be erased.
+func (c *Client) OutboxEraseTimeString(msg *QueuedMessage) string {
+	eraseTime, ok := c.outboxEraseTime(msg)
+	switch {
+	case ok:
+		return FormatTime(eraseTime)
+	case msg.Acked.IsZero() && c.outboxRetention(msg).Mode == disk.Retention_AFTER_READ:
+		return "(after it has been acknowledged)"
+	}
+	return "(never)"
+}
@@ -0,0 +1,244 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSendDelay is the longest random delay that can be set on a draft.
+const maxSendDelay = 7 * 24 * time.Hour
+
+// maxScheduleAhead is the furthest in the future that a draft can be
+// scheduled for, including any random delay.
+const maxScheduleAhead = 30 * 24 * time.Hour
+
+// sendTimeFormat is the format in which absolute send times are entered on
+// the command line, in local time.
+const sendTimeFormat = "2006-01-02 15:04"
+
+// sendDelayChoices are offered in the GUI when composing a message.
+var sendDelayChoices = []struct {
+	label string
+	delay time.Duration
+}{
+	{"No delay", 0},
+	{"Within 1 hour", time.Hour},
+	{"Within 6 hours", 6 * time.Hour},
+	{"Within 1 day", 24 * time.Hour},
+}
+
+// ParseDays parses a duration that is either a number of days, such as "2d",
+// or anything that time.ParseDuration accepts.
+func ParseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil {
+			return 0, errors.New("invalid number of days: " + s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// ParseSendAfter parses the time before which a draft mustn't be transmitted,
+// as given on the command line. It accepts "none", a delay from now such as
+// "+3h" or "+1d", or a local time in sendTimeFormat.
+func ParseSendAfter(s string, now time.Time) (time.Time, error) {
+	if s == "none" {
+		return time.Time{}, nil
+	}
+	if strings.HasPrefix(s, "+") {
+		d, err := ParseDays(s[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if d <= 0 {
+			return time.Time{}, errors.New("delay must be positive")
+		}
+		if d > maxScheduleAhead {
+			return time.Time{}, errors.New("delay must be at most " + FormatDuration(maxScheduleAhead))
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.ParseInLocation(sendTimeFormat, s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("times must be given like " + sendTimeFormat)
+	}
+	if !t.After(now) {
+		return time.Time{}, errors.New("time is in the past")
+	}
+	if t.After(now.Add(maxScheduleAhead)) {
+		return time.Time{}, errors.New("time must be within " + FormatDuration(maxScheduleAhead))
+	}
+	return t, nil
+}
+
+// ParseSendDelay parses the window over which a draft's transmission is
+// randomly delayed. It accepts "none", a number of days such as "1d", or
+// anything that time.ParseDuration accepts.
+func ParseSendDelay(s string) (time.Duration, error) {
+	if s == "none" {
+		return 0, nil
+	}
+	d, err := ParseDays(s)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case d <= 0:
+		return 0, errors.New("delay must be positive")
+	case d > maxSendDelay:
+		return 0, errors.New("delay must be at most " + FormatDuration(maxSendDelay))
+	}
+	return d, nil
+}
+
+// SendDelayLabels returns the labels for the delay choices that are offered
+// for a draft, including the draft's current delay, and the label of the
+// current delay.
+func SendDelayLabels(current time.Duration) (labels []string, selected string) {
+	for _, choice := range sendDelayChoices {
+		labels = append(labels, choice.label)
+		if choice.delay == current {
+			selected = choice.label
+		}
+	}
+	if len(selected) == 0 {
+		selected = "Within " + FormatDuration(current)
+		labels = append(labels, selected)
+	}
+	return
+}
+
+// SendDelayForLabel returns the delay for a label returned by
+// SendDelayLabels.
+func SendDelayForLabel(label string, current time.Duration) time.Duration {
+	for _, choice := range sendDelayChoices {
+		if choice.label == label {
+			return choice.delay
+		}
+	}
+	return current
+}
+
+// ScheduleString describes when a draft will be transmitted once it's sent.
+func (draft *Draft) ScheduleString() string {
+	var when string
+	if !draft.SendAfter.IsZero() {
+		when = "after " + FormatTime(draft.SendAfter)
+	}
+	if draft.SendDelay > 0 {
+		if len(when) > 0 {
+			when += ", "
+		}
+		when += "at a random time within " + FormatDuration(draft.SendDelay)
+	}
+	if len(when) == 0 {
+		return "immediately"
+	}
+	return when
+}
+
+// checkSchedule returns an error if draft would be transmitted further in the
+// future than maxScheduleAhead, counting the whole of any random delay.
+func checkSchedule(draft *Draft, now time.Time) error {
+	latest := now
+	if draft.SendAfter.After(latest) {
+		latest = draft.SendAfter
+	}
+	if latest.Add(draft.SendDelay).After(now.Add(maxScheduleAhead)) {
+		return errors.New("message can't be scheduled for more than " + FormatDuration(maxScheduleAhead) + " ahead, including any random delay")
+	}
+	return nil
+}
+
+// NotBefore picks the time before which the copies of a draft mustn't be
+// transmitted, or returns the zero time if they can be transmitted
+// immediately. Any random delay is added to the draft's send time, or to the
+// current time.
+func (c *Client) NotBefore(draft *Draft) time.Time {
+	now := c.Now()
+	t := draft.SendAfter
+	if t.Before(now) {
+		t = now
+	}
+	if draft.SendDelay > 0 {
+		var randBytes [8]byte
+		c.RandBytes(randBytes[:])
+		t = t.Add(time.Duration(binary.LittleEndian.Uint64(randBytes[:]) % uint64(draft.SendDelay)))
+	}
+	if !t.After(now) {
+		return time.Time{}
+	}
+	return t.Truncate(time.Second)
+}
+
+// schedule adds a message to the list of those that will be moved into the
+// queue at msg.NotBefore.
+func (c *Client) schedule(msg *QueuedMessage) {
+	c.QueueMutex.Lock()
+	defer c.QueueMutex.Unlock()
+
+	c.Scheduled = append(c.Scheduled, msg)
+}
+
+// releaseScheduledMessages moves messages whose time has come from the
+// scheduled list to the queue.
+func (c *Client) releaseScheduledMessages(now time.Time) {
+	// c.QueueMutex must be held before calling this function.
+
+	var stillScheduled []*QueuedMessage
+	for _, msg := range c.Scheduled {
+		if msg.NotBefore.After(now) {
+			stillScheduled = append(stillScheduled, msg)
+			continue
+		}
+		c.Log.Printf("Scheduled message to %s is now queued for transmission", msg.Server)
+		c.Queue = append(c.Queue, msg)
+	}
+	c.Scheduled = stillScheduled
+}
+
+// isScheduled returns true if msg is in the scheduled list.
+func (c *Client) isScheduled(msg *QueuedMessage) bool {
+	// c.QueueMutex must be held before calling this function.
+
+	for _, scheduledMsg := range c.Scheduled {
+		if scheduledMsg == msg {
+			return true
+		}
+	}
+	return false
+}
+
+// unscheduleMessage removes a message from the scheduled list and returns
+// true if it was there.
+func (c *Client) unscheduleMessage(msg *QueuedMessage) bool {
+	// c.QueueMutex must be held before calling this function.
+
+	for i, scheduledMsg := range c.Scheduled {
+		if scheduledMsg == msg {
+			c.Scheduled = append(c.Scheduled[:i:i], c.Scheduled[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// SentTimeString describes when an outbox message was, or will be,
+// transmitted.
+func (c *Client) SentTimeString(msg *QueuedMessage) string {
+	if contact, ok := c.Contacts[msg.To]; ok && contact.RevokedUs {
+		return "(never - contact has revoked us)"
+	}
+	if msg.Sent.IsZero() && msg.NotBefore.After(c.Now()) {
+		return "(scheduled for after " + FormatTime(msg.NotBefore) + ")"
+	}
+	if msg.Sent.IsZero() && msg.Undeliverable {
+		return "(undeliverable - server keeps failing)"
+	}
+	return FormatTime(msg.Sent)
+}
@@ -0,0 +1,304 @@
+package core
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	pond "github.com/agl/pond/protos"
+)
+
+// The fields of a message that are indexed for searching.
+const (
+	searchFieldContact = iota
+	searchFieldFilename
+	searchFieldBody
+	numSearchFields
+)
+
+// searchFieldWeights gives the contribution of a match in each field to the
+// score of a document. A match on a contact name or filename is a better
+// indication of what the user is looking for than a word in the body.
+var searchFieldWeights = [numSearchFields]float64{3, 2, 1}
+
+// searchPrefixWeight is the fraction of the score that a query term gets for
+// being a prefix of a word in a document, rather than the whole word.
+const searchPrefixWeight = 0.5
+
+// SearchTerms splits s into lower-case words.
+func SearchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// A searchDoc is an inbox message, outbox message or draft in the search
+// index. Exactly one of inbox, outbox and draft is non-nil.
+type searchDoc struct {
+	Inbox  *InboxMessage
+	Outbox *QueuedMessage
+	Draft  *Draft
+	// fields contains the text that was indexed so that changes, i.e. to
+	// drafts or contact names, can be noticed.
+	fields [numSearchFields]string
+	// terms maps each word in the document to its weighted frequency.
+	terms map[string]float64
+}
+
+func (d *searchDoc) Body() string {
+	return d.fields[searchFieldBody]
+}
+
+// Time returns the time at which the message was received or created.
+func (d *searchDoc) Time() time.Time {
+	switch {
+	case d.Inbox != nil:
+		return d.Inbox.ReceivedTime
+	case d.Outbox != nil:
+		return d.Outbox.Created
+	}
+	return d.Draft.Created
+}
+
+// Snippet returns the part of the body around the first of the given terms
+// that it contains, on a single line.
+func (d *searchDoc) Snippet(terms []string) string {
+	const context = 32
+
+	body := []rune(d.Body())
+	lower := []rune(strings.ToLower(d.Body()))
+	start := -1
+	for _, term := range terms {
+		i := strings.Index(string(lower), term)
+		if i < 0 {
+			continue
+		}
+		if runeIndex := len([]rune(string(lower)[:i])); start < 0 || runeIndex < start {
+			start = runeIndex
+		}
+	}
+	if start < 0 || len(lower) != len(body) {
+		start = 0
+	}
+
+	from, to := start-context, start+2*context
+	prefix, suffix := "…", "…"
+	if from <= 0 {
+		from, prefix = 0, ""
+	}
+	if to >= len(body) {
+		to, suffix = len(body), ""
+	}
+	return prefix + strings.Join(strings.Fields(string(body[from:to])), " ") + suffix
+}
+
+// SearchIndex is an in-memory, inverted index of the messages in the inbox,
+// outbox and drafts. It's built when the state file is unlocked and is never
+// written anywhere so that it can't leak the plaintext of messages.
+type searchIndex struct {
+	// Docs maps an *InboxMessage, *QueuedMessage or *Draft to its entry
+	// in the index.
+	Docs map[interface{}]*searchDoc
+	// Postings maps each word to the documents that contain it.
+	Postings map[string]map[*searchDoc]bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		Docs:     make(map[interface{}]*searchDoc),
+		Postings: make(map[string]map[*searchDoc]bool),
+	}
+}
+
+func (idx *searchIndex) add(key interface{}, doc *searchDoc) {
+	doc.terms = make(map[string]float64)
+	for field, text := range doc.fields {
+		for _, term := range SearchTerms(text) {
+			doc.terms[term] += searchFieldWeights[field]
+		}
+	}
+	for term := range doc.terms {
+		docs, ok := idx.Postings[term]
+		if !ok {
+			docs = make(map[*searchDoc]bool)
+			idx.Postings[term] = docs
+		}
+		docs[doc] = true
+	}
+	idx.Docs[key] = doc
+}
+
+func (idx *searchIndex) remove(key interface{}) {
+	doc, ok := idx.Docs[key]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		docs := idx.Postings[term]
+		delete(docs, doc)
+		if len(docs) == 0 {
+			delete(idx.Postings, term)
+		}
+	}
+	delete(idx.Docs, key)
+}
+
+// update indexes doc, under key, unless the same text is already indexed. It
+// records key in seen.
+func (idx *searchIndex) update(key interface{}, doc *searchDoc, seen map[interface{}]bool) {
+	seen[key] = true
+	if existing, ok := idx.Docs[key]; ok {
+		if existing.fields == doc.fields {
+			return
+		}
+		idx.remove(key)
+	}
+	idx.add(key, doc)
+}
+
+// attachmentNames returns the filenames of the attachments and detachments of
+// a message.
+func attachmentNames(files []*pond.Message_Attachment, detachments []*pond.Message_Detachment) string {
+	var names []string
+	for _, file := range files {
+		names = append(names, file.GetFilename())
+	}
+	for _, detachment := range detachments {
+		names = append(names, detachment.GetFilename())
+	}
+	return strings.Join(names, " ")
+}
+
+// unindex removes a message or draft from the search index, if it's been
+// indexed. It's called whenever one is deleted or erased so that the index
+// doesn't keep the plaintext of erased messages until the next search.
+func (c *Client) unindex(key interface{}) {
+	if c.SearchIndex != nil {
+		c.SearchIndex.remove(key)
+	}
+}
+
+// refreshSearchIndex brings the search index up to date with the inbox,
+// outbox and drafts. It's cheap when little has changed so it's called
+// before each search rather than whenever a message changes.
+func (c *Client) refreshSearchIndex() {
+	if c.SearchIndex == nil {
+		c.SearchIndex = newSearchIndex()
+	}
+	idx := c.SearchIndex
+	seen := make(map[interface{}]bool)
+
+	for _, msg := range c.Inbox {
+		if msg.Message == nil || len(msg.Message.Body) == 0 {
+			continue
+		}
+		doc := &searchDoc{Inbox: msg}
+		doc.fields[searchFieldContact] = c.ContactName(msg.From)
+		doc.fields[searchFieldFilename] = attachmentNames(msg.Message.Files, msg.Message.DetachedFiles)
+		doc.fields[searchFieldBody] = string(msg.Message.Body)
+		idx.update(msg, doc, seen)
+	}
+	for _, msg := range c.Outbox {
+		if msg.Revocation || msg.Message == nil || len(msg.Message.Body) == 0 {
+			continue
+		}
+		doc := &searchDoc{Outbox: msg}
+		doc.fields[searchFieldContact] = c.ContactName(msg.To)
+		doc.fields[searchFieldFilename] = attachmentNames(msg.Message.Files, msg.Message.DetachedFiles)
+		doc.fields[searchFieldBody] = string(msg.Message.Body)
+		idx.update(msg, doc, seen)
+	}
+	for _, draft := range c.Drafts {
+		doc := &searchDoc{Draft: draft}
+		if draft.To != 0 {
+			doc.fields[searchFieldContact] = c.RecipientNames(draft)
+		}
+		doc.fields[searchFieldFilename] = attachmentNames(draft.Attachments, draft.Detachments)
+		doc.fields[searchFieldBody] = draft.Body
+		idx.update(draft, doc, seen)
+	}
+
+	for key := range idx.Docs {
+		if !seen[key] {
+			idx.remove(key)
+		}
+	}
+}
+
+// A SearchHit is a document that matched a search, with its score.
+type SearchHit struct {
+	*searchDoc
+	score float64
+}
+
+// searchHitList is a slice of searchHits that sorts with the best match
+// first and, for equal scores, the most recent first.
+type searchHitList []SearchHit
+
+func (l searchHitList) Len() int {
+	return len(l)
+}
+
+func (l searchHitList) Less(i, j int) bool {
+	if l[i].score != l[j].score {
+		return l[i].score > l[j].score
+	}
+	return l[i].Time().After(l[j].Time())
+}
+
+func (l searchHitList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// Search returns the messages and drafts that contain every word of query,
+// either whole or as a prefix, ranked by relevance.
+func (c *Client) Search(query string) []SearchHit {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	c.refreshSearchIndex()
+	idx := c.SearchIndex
+	numDocs := float64(len(idx.Docs))
+
+	scores := make(map[*searchDoc]float64)
+	for i, term := range terms {
+		// termScores contains the score of each document for this term.
+		// Words that appear in few documents are worth more.
+		termScores := make(map[*searchDoc]float64)
+		for word, docs := range idx.Postings {
+			weight := 1.0
+			if word != term {
+				if !strings.HasPrefix(word, term) {
+					continue
+				}
+				weight = searchPrefixWeight
+			}
+			idf := math.Log(1 + numDocs/float64(len(docs)))
+			for doc := range docs {
+				termScores[doc] += weight * idf * doc.terms[word]
+			}
+		}
+
+		if i == 0 {
+			scores = termScores
+			continue
+		}
+		for doc, score := range scores {
+			if termScore, ok := termScores[doc]; ok {
+				scores[doc] = score + termScore
+			} else {
+				delete(scores, doc)
+			}
+		}
+	}
+
+	hits := make(searchHitList, 0, len(scores))
+	for doc, score := range scores {
+		hits = append(hits, SearchHit{doc, score})
+	}
+	sort.Sort(hits)
+	return hits
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	pond "github.com/agl/pond/protos"
+)
+
+// A threadEntry is a message, either received from or sent to a contact, in
+// a conversation thread. Exactly one of inbox and outbox is non-nil.
+type threadEntry struct {
+	Inbox  *InboxMessage
+	Outbox *QueuedMessage
+	// Parent is the entry that this message replies to, or nil if it
+	// starts a thread.
+	Parent *threadEntry
+	// Depth is the number of replies between this message and the start
+	// of the thread.
+	Depth int
+}
+
+func (e *threadEntry) Message() *pond.Message {
+	if e.Inbox != nil {
+		return e.Inbox.Message
+	}
+	return e.Outbox.Message
+}
+
+// Time returns the local time at which the message was received or created,
+// to the second since that's the precision with which times are saved. Since
+// both are local times, a reply never has an earlier time than the message
+// that it replies to.
+func (e *threadEntry) Time() time.Time {
+	if e.Inbox != nil {
+		return e.Inbox.ReceivedTime.Truncate(time.Second)
+	}
+	return e.Outbox.Created
+}
+
+// descendsFrom returns true if other is e or one of the messages that e
+// replies to, directly or indirectly.
+func (e *threadEntry) descendsFrom(other *threadEntry) bool {
+	for ; e != nil; e = e.Parent {
+		if e == other {
+			return true
+		}
+	}
+	return false
+}
+
+// Summary returns the first line of the message body, truncated to a
+// reasonable length.
+func (e *threadEntry) Summary() string {
+	const maxLen = 48
+
+	body := string(e.Message().Body)
+	if i := strings.IndexByte(body, '\n'); i >= 0 {
+		body = body[:i]
+	}
+	if runes := []rune(body); len(runes) > maxLen {
+		body = string(runes[:maxLen]) + "…"
+	}
+	return body
+}
+
+// threadEntryList is a slice of threadEntries that sorts chronologically.
+type threadEntryList []*threadEntry
+
+func (l threadEntryList) Len() int {
+	return len(l)
+}
+
+func (l threadEntryList) Less(i, j int) bool {
+	if ti, tj := l[i].Time(), l[j].Time(); !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	// A reply may have the same time as the message that it replies to.
+	return l[i].Depth < l[j].Depth
+}
+
+func (l threadEntryList) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
+
+// A thread is a chronologically ordered list of messages that are linked by
+// replies.
+type Thread []*threadEntry
+
+// Contact returns the id of the contact that the thread is with.
+func (t Thread) Contact() uint64 {
+	if t[0].Inbox != nil {
+		return t[0].Inbox.From
+	}
+	return t[0].Outbox.To
+}
+
+// contains returns true if either inbox or outbox message is in the thread.
+func (t Thread) contains(inbox *InboxMessage, outbox *QueuedMessage) bool {
+	for _, entry := range t {
+		if (inbox != nil && entry.Inbox == inbox) || (outbox != nil && entry.Outbox == outbox) {
+			return true
+		}
+	}
+	return false
+}
+
+// Threads reconstructs the conversation threads with a contact from the inbox
+// and outbox. The threads are ordered by their first message.
+//
+// The InReplyTo field of a message contains the id of the message, from the
+// other party, that it replies to. A message that isn't a reply, but which
+// carries acknowledgements in AlsoAck, was sent after the acknowledged
+// messages had been read and so it's placed in the thread of the most recent
+// of them.
+func (c *Client) Threads(contactId uint64) []Thread {
+	var entries threadEntryList
+	for _, msg := range c.Inbox {
+		if msg.From != contactId || msg.Message == nil || len(msg.Message.Body) == 0 {
+			continue
+		}
+		entries = append(entries, &threadEntry{Inbox: msg})
+	}
+	for _, msg := range c.Outbox {
+		if msg.To != contactId || msg.Revocation || msg.Message == nil || len(msg.Message.Body) == 0 {
+			continue
+		}
+		entries = append(entries, &threadEntry{Outbox: msg})
+	}
+
+	// Received messages reference the ids of sent messages and vice
+	// versa, so the two are indexed separately.
+	received := make(map[uint64]*threadEntry)
+	sent := make(map[uint64]*threadEntry)
+	for _, entry := range entries {
+		if entry.Outbox != nil {
+			sent[entry.Message().GetId()] = entry
+		} else {
+			received[entry.Message().GetId()] = entry
+		}
+	}
+
+	// isPossibleParent returns true if entry may be a reply to parent.
+	// The other party controls the ids in their messages so this ensures
+	// that the result is acyclic and chronologically consistent.
+	isPossibleParent := func(entry, parent *threadEntry) bool {
+		return !parent.Time().After(entry.Time()) && !parent.descendsFrom(entry)
+	}
+
+	for _, entry := range entries {
+		msg := entry.Message()
+		candidates := sent
+		if entry.Outbox != nil {
+			candidates = received
+		}
+
+		if parent, ok := candidates[msg.GetInReplyTo()]; ok && isPossibleParent(entry, parent) {
+			entry.Parent = parent
+			continue
+		}
+		for _, id := range msg.AlsoAck {
+			parent, ok := candidates[id]
+			if !ok || !isPossibleParent(entry, parent) {
+				continue
+			}
+			if entry.Parent == nil || parent.Time().After(entry.Parent.Time()) {
+				entry.Parent = parent
+			}
+		}
+	}
+
+	roots := make(map[*threadEntry]*threadEntry)
+	for _, entry := range entries {
+		root := entry
+		for root.Parent != nil {
+			root = root.Parent
+			entry.Depth++
+		}
+		roots[entry] = root
+	}
+	sort.Stable(entries)
+
+	var threads []Thread
+	threadOf := make(map[*threadEntry]int)
+	for _, entry := range entries {
+		root := roots[entry]
+		if root == entry {
+			threadOf[root] = len(threads)
+			threads = append(threads, Thread{entry})
+			continue
+		}
+		i := threadOf[root]
+		threads[i] = append(threads[i], entry)
+	}
+
+	return threads
+}
+
+// ThreadContaining returns the thread that contains the given inbox or outbox
+// message, or nil if the message isn't part of a conversation.
+func (c *Client) ThreadContaining(inbox *InboxMessage, outbox *QueuedMessage) Thread {
+	var contactId uint64
+	switch {
+	case inbox != nil:
+		contactId = inbox.From
+	case outbox != nil:
+		contactId = outbox.To
+	}
+	if contactId == 0 {
+		return nil
+	}
+
+	for _, t := range c.Threads(contactId) {
+		if t.contains(inbox, outbox) {
+			return t
+		}
+	}
+	return nil
+}
+
+// ThreadTranscript returns the full text of the messages in a thread, with
+// replies indented.
+func (c *Client) ThreadTranscript(t Thread) string {
+	var out []string
+	for _, entry := range t {
+		indent := strings.Repeat("    ", entry.Depth)
+		var header string
+		if entry.Inbox != nil {
+			header = "From " + c.ContactName(entry.Inbox.From)
+		} else {
+			header = "To " + c.ContactName(entry.Outbox.To)
+		}
+		header += ", " + entry.Time().Format(time.RFC1123)
+
+		lines := []string{indent + header}
+		for _, line := range strings.Split(string(entry.Message().Body), "\n") {
+			lines = append(lines, indent+"  "+line)
+		}
+		out = append(out, strings.Join(lines, "\n"))
+	}
+	return strings.Join(out, "\n\n")
+}
@@ -0,0 +1,298 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/agl/pond/client/disk"
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+)
+
+// Transfer is an upload or download of a detachment. Transfers are recorded in
+// the state file, along with the temporary file that holds the encrypted
+// detachment, so that they can be resumed when Pond is restarted.
+type Transfer struct {
+	Id     uint64
+	Upload bool
+	// TmpPath names the temporary file that holds the encrypted
+	// detachment. It's removed once the transfer has finished.
+	TmpPath string
+	// Path names the file that's being uploaded, or that a download will
+	// be decrypted to.
+	Path string
+	// Detachment is the detachment that's being downloaded. For uploads,
+	// it's nil until the file has been encrypted.
+	Detachment *pond.Message_Detachment
+	// Draft contains the id of the draft that an upload will be added to.
+	Draft uint64
+	// Attachment is true if the upload is of one of the draft's
+	// attachments, which is replaced by the detachment once the upload is
+	// complete.
+	Attachment bool
+	// source is the detachment that an upload copies, when forwarding it,
+	// instead of encrypting a file. The encrypted contents are downloaded
+	// from the server that holds them and uploaded to the home server
+	// unchanged, so that they're kept for as long as a new upload.
+	source *pond.Message_Detachment
+	// Size contains the length of the file that's being uploaded.
+	Size int64
+	// done and total record the latest progress of the transfer and
+	// status is the latest status message.
+	Done, Total int64
+	Status      string
+	// KillChan is used to cancel the transfer while it's running. It's
+	// nil if the transfer hasn't been started.
+	KillChan chan bool
+	// sync is true if the upload was started by a sync while the client
+	// is offline.
+	sync bool
+}
+
+// Name returns the filename of the detachment that's being transferred.
+func (t *Transfer) Name() string {
+	return filepath.Base(t.Path)
+}
+
+// Direction returns a description of the type of transfer.
+func (t *Transfer) Direction() string {
+	if t.Upload {
+		return "Upload"
+	}
+	return "Download"
+}
+
+// startTransfer creates the temporary file for t, records it and starts it
+// running. It returns a function that cancels the transfer.
+func (c *Client) startTransfer(t *Transfer, tmpPrefix string) (cancel func()) {
+	tmp, err := ioutil.TempFile("" /* default tmp dir */, tmpPrefix)
+	if err != nil {
+		err = errors.New("failed to create temp file: " + err.Error())
+		go func() {
+			c.BackgroundChan <- DetachmentError{t.Id, err}
+		}()
+		return func() {}
+	}
+	t.TmpPath = tmp.Name()
+	tmp.Close()
+
+	c.addTransfer(t)
+	return func() {
+		c.CancelTransfer(t)
+	}
+}
+
+// addTransfer records t, whose temporary file has been created, and starts it
+// running unless the client is offline.
+func (c *Client) addTransfer(t *Transfer) {
+	c.Transfers = append(c.Transfers, t)
+	c.Save()
+	if c.IsOffline() {
+		c.Log.Printf("%s of %s will start when the client is online", t.Direction(), t.Name())
+	} else {
+		c.runTransfer(t)
+	}
+}
+
+// runTransfer starts a goroutine that performs t. Progress and the result are
+// reported on BackgroundChan.
+func (c *Client) runTransfer(t *Transfer) {
+	killChan := make(chan bool, 1)
+	t.KillChan = killChan
+
+	id, upload, tmpPath, path, detachment, source := t.Id, t.Upload, t.TmpPath, t.Path, t.Detachment, t.source
+	go func() {
+		var err error
+		if upload {
+			detachment, err = c.runUpload(id, tmpPath, path, detachment, source, killChan)
+		} else {
+			err = c.runDownload(id, tmpPath, path, detachment, killChan)
+			detachment = nil
+		}
+		os.Remove(tmpPath)
+
+		if err == nil {
+			c.BackgroundChan <- DetachmentComplete{id, detachment}
+		} else {
+			c.BackgroundChan <- DetachmentError{id, err}
+		}
+	}()
+}
+
+// resumeTransfers restarts the transfers that were loaded from the state file.
+// While offline, they're restarted when the client goes online.
+func (c *Client) resumeTransfers() {
+	if c.IsOffline() {
+		return
+	}
+	for _, t := range c.Transfers {
+		c.Log.Printf("Resuming %s of %s", t.Direction(), t.Name())
+		c.runTransfer(t)
+	}
+}
+
+// CancelTransfer stops t, if it's running, and forgets it.
+func (c *Client) CancelTransfer(t *Transfer) {
+	if t.KillChan == nil {
+		// A running transfer removes its own temp file.
+		os.Remove(t.TmpPath)
+	}
+	select {
+	case t.KillChan <- true:
+	default:
+	}
+	if c.removeTransfer(t.Id) == nil {
+		return
+	}
+	if t.sync {
+		c.syncUploadFinished()
+	}
+	if draft, ok := c.Drafts[t.Draft]; ok && t.Upload && draft.SendWhenUploaded {
+		c.Log.Printf("Upload of %s was cancelled so its draft won't be sent", t.Name())
+		draft.SendWhenUploaded = false
+	}
+	c.Save()
+}
+
+// HasUploads returns true if any uploads to the given draft are in progress.
+func (c *Client) HasUploads(draft uint64) bool {
+	for _, t := range c.Transfers {
+		if t.Upload && t.Draft == draft {
+			return true
+		}
+	}
+	return false
+}
+
+// FindTransfer returns the transfer with the given id, or nil if there's none.
+func (c *Client) FindTransfer(id uint64) *Transfer {
+	for _, t := range c.Transfers {
+		if t.Id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// removeTransfer forgets the transfer with the given id and returns it, or nil
+// if there's none.
+func (c *Client) removeTransfer(id uint64) *Transfer {
+	for i, t := range c.Transfers {
+		if t.Id == id {
+			c.Transfers = append(c.Transfers[:i], c.Transfers[i+1:]...)
+			return t
+		}
+	}
+	return nil
+}
+
+// ProcessTransferEvent updates the record of a transfer given an event from
+// BackgroundChan, and must be called by every UI for each such event. If the
+// event shows that a transfer has finished then the transfer is returned. The
+// detachment from a completed upload is added to its draft and, if that was
+// the draft's last upload and it's waiting to be sent, the draft is sent.
+func (c *Client) ProcessTransferEvent(event interface{}) (finished *Transfer) {
+	switch e := event.(type) {
+	case DetachmentEncrypted:
+		if t := c.FindTransfer(e.id); t != nil {
+			t.Detachment = e.detachment
+			c.Save()
+		}
+		close(e.saved)
+	case DetachmentProgress:
+		if t := c.FindTransfer(e.Id); t != nil {
+			t.Done = int64(e.Done)
+			t.Total = int64(e.Total)
+			t.Status = e.Status
+		}
+	case DetachmentComplete:
+		if finished = c.removeTransfer(e.Id); finished == nil {
+			return
+		}
+		if finished.sync {
+			// This runs after the draft has been queued so that
+			// the sync that follows delivers it.
+			defer c.syncUploadFinished()
+		}
+		if !finished.Upload {
+			c.Save()
+			return
+		}
+		draft, ok := c.Drafts[finished.Draft]
+		if !ok {
+			c.Log.Printf("Finished upload of %s, but its draft has been deleted", finished.Name())
+			c.Save()
+			return
+		}
+		if finished.Attachment {
+			draft.removeAttachment(e.Detachment)
+		}
+		draft.Detachments = append(draft.Detachments, e.Detachment)
+		c.Save()
+		if draft.SendWhenUploaded && !c.HasUploads(draft.Id) {
+			c.sendUploadedDraft(draft)
+		}
+	case DetachmentError:
+		if finished = c.removeTransfer(e.Id); finished == nil {
+			return
+		}
+		if finished.sync {
+			c.syncUploadFinished()
+		}
+		c.Log.Printf("%s of %s failed: %s", finished.Direction(), finished.Name(), e.Err)
+		if draft, ok := c.Drafts[finished.Draft]; ok && finished.Upload && draft.SendWhenUploaded {
+			draft.SendWhenUploaded = false
+			c.UI.ProcessDraftSent(draft, 0, errors.New("failed to upload "+finished.Name()+": "+e.Err.Error()))
+		}
+		c.Save()
+	}
+	return
+}
+
+func (c *Client) marshalTransfers() []*disk.Transfer {
+	var transfers []*disk.Transfer
+	for _, t := range c.Transfers {
+		m := &disk.Transfer{
+			Id:         proto.Uint64(t.Id),
+			Upload:     proto.Bool(t.Upload),
+			TmpPath:    proto.String(t.TmpPath),
+			Path:       proto.String(t.Path),
+			Detachment: t.Detachment,
+		}
+		if t.Upload {
+			m.Draft = proto.Uint64(t.Draft)
+			m.Size = proto.Int64(t.Size)
+		}
+		if t.Attachment {
+			m.Attachment = proto.Bool(true)
+		}
+		m.Source = t.source
+		if t.Total > 0 {
+			m.Done = proto.Int64(t.Done)
+			m.Total = proto.Int64(t.Total)
+		}
+		transfers = append(transfers, m)
+	}
+	return transfers
+}
+
+func (c *Client) unmarshalTransfers(transfers []*disk.Transfer) {
+	c.Transfers = nil
+	for _, m := range transfers {
+		c.Transfers = append(c.Transfers, &Transfer{
+			Id:         m.GetId(),
+			Upload:     m.GetUpload(),
+			TmpPath:    m.GetTmpPath(),
+			Path:       m.GetPath(),
+			Detachment: m.GetDetachment(),
+			Draft:      m.GetDraft(),
+			Attachment: m.GetAttachment(),
+			source:     m.GetSource(),
+			Size:       m.GetSize(),
+			Done:       m.GetDone(),
+			Total:      m.GetTotal(),
+		})
+	}
+}
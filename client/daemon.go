@@ -0,0 +1,1171 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/agl/pond/client/core"
+	"github.com/agl/pond/client/disk"
+	"github.com/agl/pond/panda"
+)
+
+// The daemon is a UI with no user interface. It runs the usual network and
+// PANDA goroutines and is controlled by other programs via JSON-RPC 2.0
+// requests on a Unix socket. Requests and responses are JSON objects, one
+// after the other on the stream. The socket is only accessible to the user
+// running the daemon.
+//
+// Methods other than "version" are prefixed with the version of the API that
+// they belong to, e.g. "v1.listContacts". Incompatible changes will only be
+// made in a new version. Message and contact ids are encoded as strings
+// because they are 64-bit values.
+//
+// A connection that calls "v1.subscribe" receives notifications with method
+// "v1.event" as things happen. A subscriber that doesn't keep up with events
+// is disconnected.
+
+// daemonAPIVersions lists the versions of the control API that are supported.
+var daemonAPIVersions = []int{1}
+
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	// rpcFailed is returned when a valid request couldn't be performed.
+	rpcFailed = -32000
+)
+
+// daemonEventQueueLen is the number of messages that may be waiting to be
+// written to a connection before it's considered to be stuck.
+const daemonEventQueueLen = 64
+
+type rpcRequest struct {
+	Version string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResult struct {
+	Version string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Result  interface{}      `json:"result"`
+}
+
+type rpcErrorResult struct {
+	Version string           `json:"jsonrpc"`
+	Id      *json.RawMessage `json:"id"`
+	Error   *rpcError        `json:"error"`
+}
+
+type rpcNotification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+// daemonConn is a connection to the control socket.
+type daemonConn struct {
+	conn net.Conn
+	// out contains messages that are waiting to be written to conn.
+	out chan interface{}
+	// done is closed when the connection has been closed.
+	done chan struct{}
+	// subscribed is true if the connection should receive events. It's
+	// only accessed from the main goroutine.
+	subscribed bool
+}
+
+// daemonCall is a request from a connection, to be processed on the main
+// goroutine.
+type daemonCall struct {
+	conn *daemonConn
+	req  *rpcRequest
+}
+
+type daemonClient struct {
+	core.Client
+
+	// socketPath is the filename of the control socket.
+	socketPath string
+	// passphrase is used to decrypt the state file, or to encrypt a new
+	// one.
+	passphrase string
+	// accountServer is the server to create an account on if the state
+	// file doesn't exist. If empty, no account will be created.
+	accountServer string
+
+	// calls receives requests from all connections.
+	calls chan daemonCall
+	// conns contains all current connections. It's only accessed from the
+	// main goroutine.
+	conns map[*daemonConn]bool
+	// signals receives SIGINT and SIGTERM.
+	signals chan os.Signal
+	// quit is closed when the main goroutine stops processing calls.
+	quit chan struct{}
+}
+
+func NewDaemonClient(stateFilename, socketPath string, rand io.Reader, testing, autoFetch bool) *daemonClient {
+	c := &daemonClient{
+		Client: core.Client{
+			Testing:            testing,
+			Dev:                testing,
+			AutoFetch:          autoFetch,
+			StateFilename:      stateFilename,
+			Log:                core.NewLog(),
+			Rand:               rand,
+			Contacts:           make(map[uint64]*core.Contact),
+			Drafts:             make(map[uint64]*core.Draft),
+			NewMessageChan:     make(chan core.NewMessage),
+			MessageSentChan:    make(chan core.MessageSendResult, 1),
+			BackgroundChan:     make(chan interface{}, 8),
+			PandaChan:          make(chan core.PandaUpdate, 1),
+			UsedIds:            make(map[uint64]bool),
+			SigningRequestChan: make(chan core.SigningRequest),
+		},
+		socketPath: socketPath,
+		calls:      make(chan daemonCall),
+		conns:      make(map[*daemonConn]bool),
+		signals:    make(chan os.Signal, 1),
+		quit:       make(chan struct{}),
+	}
+	c.UI = c
+
+	if !testing {
+		c.TimerChan = time.Tick(core.TimerInterval)
+	}
+
+	c.NewMeetingPlace = c.HTTPMeetingPlace
+	c.Log.ToStderr = true
+	return c
+}
+
+// runDaemon runs a daemonClient until it's interrupted. If socketPath is
+// empty then the control socket is placed next to the state file.
+func runDaemon(stateFile, socketPath string, passphraseFd int, server string, dev bool) {
+	if len(socketPath) == 0 {
+		socketPath = stateFile + ".sock"
+	}
+
+	client := NewDaemonClient(stateFile, socketPath, rand.Reader, false /* testing */, true /* autoFetch */)
+	if passphraseFd >= 0 {
+		pw, err := readPassphrase(passphraseFd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read passphrase: %s\n", err)
+			os.Exit(1)
+		}
+		client.passphrase = pw
+	}
+	client.accountServer = server
+	client.DisableV2Ratchet = true
+	client.Dev = dev
+	client.Start()
+}
+
+// readPassphrase reads a passphrase from the given file descriptor. A
+// trailing newline is removed.
+func readPassphrase(fd int) (string, error) {
+	f := os.NewFile(uintptr(fd), "passphrase")
+	if f == nil {
+		return "", errors.New("invalid passphrase file descriptor")
+	}
+	defer f.Close()
+
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(contents), "\n"), "\r"), nil
+}
+
+func (c *daemonClient) Start() {
+	signal.Notify(c.signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(c.signals)
+
+	if err := c.LoadUI(); err != nil {
+		c.Log.Errorf("%s", err)
+	}
+
+	if c.WriterChan != nil {
+		c.Save()
+	}
+	if c.WriterChan != nil {
+		close(c.WriterChan)
+		<-c.WriterDone
+	}
+	if c.FetchNowChan != nil {
+		close(c.FetchNowChan)
+	}
+	if c.StateLock != nil {
+		c.StateLock.Close()
+	}
+}
+
+func (c *daemonClient) InitUI() {
+	c.Log.Printf("Pond daemon starting")
+}
+
+func (c *daemonClient) LoadingUI() {
+}
+
+func (c *daemonClient) TorPromptUI() error {
+	c.Log.Errorf("Cannot find Tor. Looking for a SOCKS proxy on port 9050 or 9150...")
+	for {
+		if err := c.SleepUI(1 * time.Second); err != nil {
+			return err
+		}
+		if c.DetectTor() {
+			return nil
+		}
+	}
+}
+
+func (c *daemonClient) SleepUI(d time.Duration) error {
+	select {
+	case <-c.signals:
+		return core.ErrInterrupted
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (c *daemonClient) ErrorUI(msg string, fatal bool) {
+	c.Log.Errorf("%s", msg)
+}
+
+func (c *daemonClient) ShutdownAndSuspend() error {
+	return core.ErrInterrupted
+}
+
+func (c *daemonClient) CreatePassphraseUI() (string, error) {
+	if len(c.accountServer) == 0 {
+		return "", errors.New("daemon: state file doesn't exist and no server was given to create an account")
+	}
+	return c.passphrase, nil
+}
+
+func (c *daemonClient) CreateErasureStorage(pw string, stateFile *disk.StateFile) error {
+	// The daemon can't ask whether to use a TPM so the state file is
+	// only protected by the passphrase.
+	return nil
+}
+
+func (c *daemonClient) CreateAccountUI(stateFile *disk.StateFile, pw string) (bool, error) {
+	c.Server = c.accountServer
+	updateMsg := func(msg string) {
+		c.Log.Printf("%s", msg)
+	}
+	return false, c.DoCreateAccount(updateMsg)
+}
+
+func (c *daemonClient) KeyPromptUI(stateFile *disk.StateFile) error {
+	err := c.LoadState(stateFile, c.passphrase)
+	if err == disk.BadPasswordError {
+		return errors.New("daemon: incorrect passphrase")
+	}
+	return err
+}
+
+// event sends a notification to every subscribed connection.
+func (c *daemonClient) event(eventType string, params map[string]interface{}) {
+	params["type"] = eventType
+	n := &rpcNotification{
+		Version: "2.0",
+		Method:  "v1.event",
+		Params:  params,
+	}
+	for conn := range c.conns {
+		if conn.subscribed {
+			c.write(conn, n)
+		}
+	}
+}
+
+func (c *daemonClient) ProcessFetch(msg *core.InboxMessage) {
+	if msg.Message != nil && len(msg.Message.Body) == 0 {
+		// Skip acks.
+		return
+	}
+	c.event("fetch", map[string]interface{}{"message": inboxJSON(&c.Client, msg)})
+}
+
+func (c *daemonClient) ProcessServerAnnounce(msg *core.InboxMessage) {
+	c.event("serverAnnounce", map[string]interface{}{"message": inboxJSON(&c.Client, msg)})
+}
+
+func (c *daemonClient) ProcessAcknowledgement(msg *core.QueuedMessage) {
+	c.event("acknowledgement", map[string]interface{}{"message": c.outboxJSON(msg)})
+}
+
+func (c *daemonClient) ProcessRevocationOfUs(by *core.Contact) {
+	c.event("revocationOfUs", map[string]interface{}{"contact": contactJSON(by)})
+}
+
+func (c *daemonClient) ProcessRevocation(by *core.Contact) {
+	c.event("revocation", map[string]interface{}{"contact": contactJSON(by)})
+}
+
+// unsealPendingMessages is run once a key exchange with a contact has
+// completed and unseals any previously unreadable messages from that contact.
+func (c *daemonClient) unsealPendingMessages(contact *core.Contact) {
+	var needToFilter bool
+
+	for _, msg := range c.Inbox {
+		if msg.Message == nil && msg.From == contact.Id {
+			if !c.UnsealMessage(msg, contact) {
+				needToFilter = true
+				continue
+			}
+			if len(msg.Message.Body) == 0 {
+				needToFilter = true
+				continue
+			}
+		}
+	}
+
+	if needToFilter {
+		c.DropSealedAndAckMessagesFrom(contact)
+	}
+	c.HoldUnsealedParts(contact)
+}
+
+func (c *daemonClient) ProcessPANDAUpdateUI(update core.PandaUpdate) {
+	contact := c.Contacts[update.Id]
+
+	switch {
+	case update.Err != nil:
+		c.event("keyExchangeFailed", map[string]interface{}{
+			"contact": contactJSON(contact),
+			"error":   update.Err.Error(),
+		})
+	case update.Result != nil:
+		c.unsealPendingMessages(contact)
+		c.event("keyExchangeComplete", map[string]interface{}{"contact": contactJSON(contact)})
+	}
+}
+
+func (c *daemonClient) ProcessMessageDelivered(msg *core.QueuedMessage) {
+	if msg.Revocation || len(msg.Message.Body) == 0 {
+		return
+	}
+	c.event("messageDelivered", map[string]interface{}{"message": c.outboxJSON(msg)})
+}
+
+func (c *daemonClient) ProcessMessageUndeliverable(msg *core.QueuedMessage) {
+	c.event("messageUndeliverable", map[string]interface{}{"message": c.outboxJSON(msg)})
+}
+
+func (c *daemonClient) ProcessDraftSent(draft *core.Draft, id uint64, err error) {
+	if err != nil {
+		c.event("draftSendFailed", map[string]interface{}{
+			"draft": fmt.Sprintf("%d", draft.Id),
+			"error": err.Error(),
+		})
+		return
+	}
+	for _, msg := range c.Outbox {
+		if msg.Id == id {
+			c.event("draftSent", map[string]interface{}{
+				"draft":   fmt.Sprintf("%d", draft.Id),
+				"message": c.outboxJSON(msg),
+			})
+			return
+		}
+	}
+}
+
+func (c *daemonClient) RemoveInboxMessageUI(msg *core.InboxMessage) {
+	c.event("inboxRemoved", map[string]interface{}{"id": fmt.Sprintf("%d", msg.Id)})
+}
+
+func (c *daemonClient) RemoveOutboxMessageUI(msg *core.QueuedMessage) {
+	c.event("outboxRemoved", map[string]interface{}{"id": fmt.Sprintf("%d", msg.Id)})
+}
+
+func (c *daemonClient) AddRevocationMessageUI(msg *core.QueuedMessage) {
+}
+
+func (c *daemonClient) RemoveContactUI(contact *core.Contact) {
+	c.event("contactRemoved", map[string]interface{}{"id": fmt.Sprintf("%d", contact.Id)})
+}
+
+func (c *daemonClient) LogEventUI(contact *core.Contact, event core.Event) {
+	c.event("contactEvent", map[string]interface{}{
+		"contact": contactJSON(contact),
+		"message": event.Msg,
+	})
+}
+
+// listenControlSocket creates a Unix socket at path that only the current
+// user can connect to. A stale socket from a previous run is removed.
+func listenControlSocket(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New("daemon: control socket path exists and is not a socket: " + path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("daemon: control socket is in use: " + path)
+		}
+		os.Remove(path)
+	}
+
+	// The umask ensures that the socket is never accessible to other
+	// users, even briefly.
+	oldMask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (c *daemonClient) acceptConnections(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		dc := &daemonConn{
+			conn: conn,
+			out:  make(chan interface{}, daemonEventQueueLen),
+			done: make(chan struct{}),
+		}
+		go dc.writeLoop()
+		go c.readLoop(dc)
+	}
+}
+
+func (dc *daemonConn) writeLoop() {
+	encoder := json.NewEncoder(dc.conn)
+	for {
+		select {
+		case msg := <-dc.out:
+			if err := encoder.Encode(msg); err != nil {
+				dc.conn.Close()
+				return
+			}
+		case <-dc.done:
+			return
+		}
+	}
+}
+
+func (c *daemonClient) readLoop(dc *daemonConn) {
+	defer close(dc.done)
+	defer dc.conn.Close()
+
+	decoder := json.NewDecoder(dc.conn)
+	for {
+		req := new(rpcRequest)
+		if err := decoder.Decode(req); err != nil {
+			if err != io.EOF {
+				// The stream can't be resynchronised after a
+				// parse error so the connection is closed after
+				// reporting it.
+				select {
+				case dc.out <- &rpcErrorResult{"2.0", nil, &rpcError{rpcParseError, err.Error()}}:
+				default:
+				}
+			}
+			return
+		}
+		select {
+		case c.calls <- daemonCall{dc, req}:
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// write queues msg to be written to conn. If the connection isn't keeping up
+// then it's closed.
+func (c *daemonClient) write(conn *daemonConn, msg interface{}) {
+	select {
+	case <-conn.done:
+		delete(c.conns, conn)
+		return
+	default:
+	}
+
+	select {
+	case conn.out <- msg:
+	default:
+		c.Log.Printf("Closing control connection that isn't reading replies")
+		conn.conn.Close()
+		delete(c.conns, conn)
+	}
+}
+
+func (c *daemonClient) MainUI() {
+	listener, err := listenControlSocket(c.socketPath)
+	if err != nil {
+		c.Log.Errorf("Failed to listen on control socket: %s", err)
+		return
+	}
+	defer os.Remove(c.socketPath)
+	defer listener.Close()
+	defer close(c.quit)
+	c.Log.Printf("Listening on %s", c.socketPath)
+
+	go c.acceptConnections(listener)
+
+	for {
+		select {
+		case sigReq := <-c.SigningRequestChan:
+			c.ProcessSigningRequest(sigReq)
+		case call := <-c.calls:
+			c.conns[call.conn] = true
+			c.processCall(call)
+		case newMessage := <-c.NewMessageChan:
+			c.ProcessNewMessage(newMessage)
+		case msr := <-c.MessageSentChan:
+			if msr.Id != 0 {
+				c.ProcessMessageSent(msr)
+			}
+		case update := <-c.PandaChan:
+			c.ProcessPANDAUpdate(update)
+		case event := <-c.BackgroundChan:
+			c.ProcessTransferEvent(event)
+		case <-c.Log.UpdateChan:
+		case <-c.TimerChan:
+			c.ProcessTimerTick(c.Now(), 0)
+		case <-c.signals:
+			c.Log.Printf("Shutting down")
+			for conn := range c.conns {
+				conn.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// daemonMethods maps method names to functions that handle them. Each
+// function runs on the main goroutine, is given the request's parameters and
+// returns a value that is serialised as the result.
+var daemonMethods = map[string]func(c *daemonClient, conn *daemonConn, params json.RawMessage) (interface{}, *rpcError){
+	"version":         (*daemonClient).rpcVersion,
+	"v1.subscribe":    (*daemonClient).rpcSubscribe,
+	"v1.listContacts": (*daemonClient).rpcListContacts,
+	"v1.listInbox":    (*daemonClient).rpcListInbox,
+	"v1.listOutbox":   (*daemonClient).rpcListOutbox,
+	"v1.listDrafts":   (*daemonClient).rpcListDrafts,
+	"v1.listGroups":   (*daemonClient).rpcListGroups,
+	"v1.compose":      (*daemonClient).rpcCompose,
+	"v1.deleteDraft":  (*daemonClient).rpcDeleteDraft,
+	"v1.setExpiry":    (*daemonClient).rpcSetExpiry,
+	"v1.send":         (*daemonClient).rpcSend,
+	"v1.acknowledge":  (*daemonClient).rpcAcknowledge,
+	"v1.markRead":     (*daemonClient).rpcMarkRead,
+	"v1.retain":       (*daemonClient).rpcRetain,
+	"v1.newContact":   (*daemonClient).rpcNewContact,
+	"v1.transactNow":  (*daemonClient).rpcTransactNow,
+	"v1.setOffline":   (*daemonClient).rpcSetOffline,
+	"v1.sync":         (*daemonClient).rpcSync,
+	"v1.listHooks":    (*daemonClient).rpcListHooks,
+	"v1.setHook":      (*daemonClient).rpcSetHook,
+}
+
+func (c *daemonClient) processCall(call daemonCall) {
+	req := call.req
+	var result interface{}
+	var rpcErr *rpcError
+
+	if req.Version != "2.0" || len(req.Method) == 0 {
+		rpcErr = &rpcError{rpcInvalidRequest, "not a JSON-RPC 2.0 request"}
+	} else if method, ok := daemonMethods[req.Method]; !ok {
+		rpcErr = &rpcError{rpcMethodNotFound, "unknown method: " + req.Method}
+	} else {
+		result, rpcErr = method(c, call.conn, req.Params)
+	}
+
+	if req.Id == nil {
+		// Notifications don't get a reply.
+		return
+	}
+	if rpcErr != nil {
+		c.write(call.conn, &rpcErrorResult{"2.0", req.Id, rpcErr})
+		return
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+	c.write(call.conn, &rpcResult{"2.0", req.Id, result})
+}
+
+// parseParams unmarshals the parameters of a request into v.
+func parseParams(params json.RawMessage, v interface{}) *rpcError {
+	if len(params) == 0 {
+		return &rpcError{rpcInvalidParams, "missing parameters"}
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{rpcInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+type contactInfo struct {
+	Id        uint64 `json:"id,string"`
+	Name      string `json:"name"`
+	Pending   bool   `json:"pending"`
+	RevokedUs bool   `json:"revokedUs"`
+	Server    string `json:"server,omitempty"`
+	// KeyExchangeError contains the reason that a PANDA key exchange
+	// failed, if it did.
+	KeyExchangeError string `json:"keyExchangeError,omitempty"`
+}
+
+func contactJSON(contact *core.Contact) *contactInfo {
+	return &contactInfo{
+		Id:               contact.Id,
+		Name:             contact.Name,
+		Pending:          contact.IsPending,
+		RevokedUs:        contact.RevokedUs,
+		Server:           contact.TheirServer,
+		KeyExchangeError: contact.PandaResult,
+	}
+}
+
+type inboxInfo struct {
+	Id   uint64 `json:"id,string"`
+	From uint64 `json:"from,string"`
+	// FromName is the name of the contact who sent the message, or
+	// "Home Server" for announcements.
+	FromName string `json:"fromName"`
+	Received int64  `json:"received"`
+	// Sent is the time claimed by the sender and is zero for messages
+	// that can't be decrypted yet.
+	Sent      int64  `json:"sent,omitempty"`
+	MessageId uint64 `json:"messageId,string,omitempty"`
+	Body      string `json:"body"`
+	// Sealed is true if the message can't be decrypted until a key
+	// exchange with the sender completes.
+	Sealed   bool `json:"sealed"`
+	Acked    bool `json:"acked"`
+	Read     bool `json:"read"`
+	Retained bool `json:"retained"`
+	// Expiry is the number of seconds after receipt after which the
+	// sender asked for the message to be erased, or zero.
+	Expiry int64 `json:"expiry,omitempty"`
+	// Erase is the time at which the message will be erased unless it's
+	// retained, or zero if it'll be kept until deleted.
+	Erase int64 `json:"erase,omitempty"`
+}
+
+func inboxJSON(c *core.Client, msg *core.InboxMessage) *inboxInfo {
+	info := &inboxInfo{
+		Id:       msg.Id,
+		From:     msg.From,
+		FromName: c.ContactName(msg.From),
+		Received: msg.ReceivedTime.Unix(),
+		Sealed:   msg.Message == nil,
+		Acked:    msg.Acked,
+		Read:     msg.Read,
+		Retained: msg.Retained,
+		Expiry:   int64(c.SenderExpiry(msg) / time.Second),
+	}
+	if eraseTime, ok := c.InboxEraseTime(msg); ok {
+		info.Erase = eraseTime.Unix()
+	}
+	if msg.Message != nil {
+		info.Sent = msg.Message.GetTime()
+		info.MessageId = msg.Message.GetId()
+		_, _, info.Body = c.InboxStrings(msg)
+	}
+	return info
+}
+
+// idList is a list of ids that is serialised as an array of strings.
+type idList []uint64
+
+func (ids idList) MarshalJSON() ([]byte, error) {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatUint(id, 10)
+	}
+	return json.Marshal(strs)
+}
+
+func (ids *idList) UnmarshalJSON(data []byte) error {
+	var strs []string
+	if err := json.Unmarshal(data, &strs); err != nil {
+		return err
+	}
+	*ids = make(idList, len(strs))
+	for i, s := range strs {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		(*ids)[i] = id
+	}
+	return nil
+}
+
+type outboxInfo struct {
+	Id     uint64 `json:"id,string"`
+	To     uint64 `json:"to,string"`
+	ToName string `json:"toName"`
+	// FanoutId is shared by the copies of a message that was sent to
+	// several contacts.
+	FanoutId   uint64 `json:"fanoutId,string,omitempty"`
+	Created    int64  `json:"created"`
+	Sent       int64  `json:"sent,omitempty"`
+	Acked      int64  `json:"acked,omitempty"`
+	Body       string `json:"body"`
+	Revocation bool   `json:"revocation"`
+	// Undeliverable is true if the message's server has been failing
+	// for longer than the configured period.
+	Undeliverable bool `json:"undeliverable,omitempty"`
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func (c *daemonClient) outboxJSON(msg *core.QueuedMessage) *outboxInfo {
+	info := &outboxInfo{
+		Id:            msg.Id,
+		To:            msg.To,
+		Created:       msg.Created.Unix(),
+		Sent:          unixOrZero(msg.Sent),
+		Acked:         unixOrZero(msg.Acked),
+		Revocation:    msg.Revocation,
+		FanoutId:      msg.FanoutId,
+		Undeliverable: msg.Undeliverable,
+	}
+	if !msg.Revocation {
+		info.ToName = c.ContactName(msg.To)
+	}
+	if msg.Message != nil {
+		info.Body = string(msg.Message.Body)
+	}
+	return info
+}
+
+type draftInfo struct {
+	Id        uint64 `json:"id,string"`
+	To        uint64 `json:"to,string"`
+	AlsoTo    idList `json:"alsoTo,omitempty"`
+	Body      string `json:"body"`
+	InReplyTo uint64 `json:"inReplyTo,string,omitempty"`
+	Created   int64  `json:"created"`
+	// Expiry is the number of seconds after which recipients are asked
+	// to erase the message, or zero.
+	Expiry int64 `json:"expiry,omitempty"`
+}
+
+func draftJSON(draft *core.Draft) *draftInfo {
+	return &draftInfo{
+		Id:        draft.Id,
+		To:        draft.To,
+		AlsoTo:    draft.AlsoTo,
+		Body:      draft.Body,
+		InReplyTo: draft.InReplyTo,
+		Created:   draft.Created.Unix(),
+		Expiry:    int64(draft.Expiry / time.Second),
+	}
+}
+
+func (c *daemonClient) rpcVersion(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	return map[string]interface{}{"versions": daemonAPIVersions}, nil
+}
+
+func (c *daemonClient) rpcSubscribe(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	conn.subscribed = true
+	return nil, nil
+}
+
+func (c *daemonClient) rpcListContacts(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	contacts := make([]*contactInfo, 0, len(c.Contacts))
+	for _, contact := range c.Contacts {
+		contacts = append(contacts, contactJSON(contact))
+	}
+	return contacts, nil
+}
+
+func (c *daemonClient) rpcListInbox(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	inbox := make([]*inboxInfo, 0, len(c.Inbox))
+	for _, msg := range c.Inbox {
+		if msg.Message != nil && len(msg.Message.Body) == 0 {
+			// Skip acks.
+			continue
+		}
+		inbox = append(inbox, inboxJSON(&c.Client, msg))
+	}
+	return inbox, nil
+}
+
+func (c *daemonClient) rpcListOutbox(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	outbox := make([]*outboxInfo, 0, len(c.Outbox))
+	for _, msg := range c.Outbox {
+		if msg.Message != nil && len(msg.Message.Body) == 0 {
+			// Skip acks.
+			continue
+		}
+		outbox = append(outbox, c.outboxJSON(msg))
+	}
+	return outbox, nil
+}
+
+func (c *daemonClient) rpcListDrafts(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	drafts := make([]*draftInfo, 0, len(c.Drafts))
+	for _, draft := range c.Drafts {
+		drafts = append(drafts, draftJSON(draft))
+	}
+	return drafts, nil
+}
+
+func (c *daemonClient) rpcListGroups(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	groups := make(map[string]idList)
+	for name, members := range c.ContactGroups {
+		groups[name] = members
+	}
+	return groups, nil
+}
+
+func (c *daemonClient) inboxMessage(id uint64) (*core.InboxMessage, *rpcError) {
+	for _, msg := range c.Inbox {
+		if msg.Id == id {
+			return msg, nil
+		}
+	}
+	return nil, &rpcError{rpcFailed, "no such inbox message"}
+}
+
+func (c *daemonClient) rpcCompose(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		To uint64 `json:"to,string"`
+		// AlsoTo contains the ids of any further recipients.
+		AlsoTo idList `json:"alsoTo"`
+		// Group is the name of a contact group whose members are
+		// added to the recipients.
+		Group string `json:"group"`
+		Body  string `json:"body"`
+		// InReplyTo is the id of an inbox message.
+		InReplyTo uint64 `json:"inReplyTo,string"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	draft := &core.Draft{
+		Id:      c.RandId(),
+		Created: c.Now(),
+		Body:    args.Body,
+	}
+
+	var recipients []uint64
+	if args.To != 0 {
+		recipients = append(recipients, args.To)
+	}
+	recipients = append(recipients, args.AlsoTo...)
+	if len(args.Group) > 0 {
+		if _, ok := c.ContactGroups[args.Group]; !ok {
+			return nil, &rpcError{rpcFailed, "no such group"}
+		}
+		recipients = append(recipients, c.GroupRecipients(args.Group)...)
+	}
+	if len(recipients) == 0 {
+		return nil, &rpcError{rpcInvalidParams, "no recipients"}
+	}
+	for _, id := range recipients {
+		to, ok := c.Contacts[id]
+		if !ok {
+			return nil, &rpcError{rpcFailed, "no such contact"}
+		}
+		if to.IsPending {
+			return nil, &rpcError{rpcFailed, "cannot send message to pending contact"}
+		}
+		draft.AddRecipient(id)
+	}
+	if args.InReplyTo != 0 {
+		msg, err := c.inboxMessage(args.InReplyTo)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Message == nil {
+			return nil, &rpcError{rpcFailed, "cannot reply to a message that hasn't been decrypted"}
+		}
+		draft.InReplyTo = msg.Message.GetId()
+	}
+	c.Drafts[draft.Id] = draft
+	c.Save()
+
+	return draftJSON(draft), nil
+}
+
+func (c *daemonClient) rpcDeleteDraft(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Id uint64 `json:"id,string"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	if _, ok := c.Drafts[args.Id]; !ok {
+		return nil, &rpcError{rpcFailed, "no such draft"}
+	}
+	c.DeleteDraft(args.Id)
+	c.Save()
+	return nil, nil
+}
+
+func (c *daemonClient) rpcSetExpiry(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Draft uint64 `json:"draft,string"`
+		// Expiry is a number of seconds, or zero to remove the
+		// expiry.
+		Expiry int64 `json:"expiry"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	draft, ok := c.Drafts[args.Draft]
+	if !ok {
+		return nil, &rpcError{rpcFailed, "no such draft"}
+	}
+	expiry := time.Duration(args.Expiry) * time.Second
+	if err := core.ValidateExpiry(expiry); err != nil || expiry < 0 {
+		return nil, &rpcError{rpcInvalidParams, "invalid expiry"}
+	}
+	draft.Expiry = expiry
+	c.Save()
+
+	return draftJSON(draft), nil
+}
+
+func (c *daemonClient) rpcSend(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Draft uint64 `json:"draft,string"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	draft, ok := c.Drafts[args.Draft]
+	if !ok {
+		return nil, &rpcError{rpcFailed, "no such draft"}
+	}
+	if to, ok := c.Contacts[draft.To]; !ok || to.IsPending {
+		return nil, &rpcError{rpcFailed, "draft doesn't have a valid destination"}
+	}
+
+	id, _, err := c.SendDraft(draft)
+	if err == core.ErrDraftUploading {
+		return map[string]interface{}{
+			"uploading": true,
+			"draft":     fmt.Sprintf("%d", draft.Id),
+		}, nil
+	}
+	if err != nil {
+		return nil, &rpcError{rpcFailed, err.Error()}
+	}
+	c.DraftSent(draft)
+	c.Save()
+
+	for _, msg := range c.Outbox {
+		if msg.Id == id {
+			return c.outboxJSON(msg), nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *daemonClient) rpcAcknowledge(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Id uint64 `json:"id,string"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	msg, rpcErr := c.inboxMessage(args.Id)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if msg.Acked {
+		return nil, &rpcError{rpcFailed, "message has already been acknowledged"}
+	}
+	if msg.From == 0 {
+		return nil, &rpcError{rpcFailed, "cannot acknowledge server announcement"}
+	}
+	if msg.Message == nil {
+		return nil, &rpcError{rpcFailed, "cannot acknowledge a message that hasn't been decrypted"}
+	}
+	msg.Acked = true
+	c.SendAck(msg)
+	c.Save()
+	return nil, nil
+}
+
+func (c *daemonClient) rpcMarkRead(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Id uint64 `json:"id,string"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	msg, rpcErr := c.inboxMessage(args.Id)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	msg.MarkRead(c.Now())
+	c.Save()
+	return nil, nil
+}
+
+func (c *daemonClient) rpcRetain(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Id     uint64 `json:"id,string"`
+		Retain bool   `json:"retain"`
+		// Override must be set to retain a message that the sender
+		// asked to be erased.
+		Override bool `json:"override"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	msg, rpcErr := c.inboxMessage(args.Id)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	if args.Retain && !msg.Retained && c.SenderExpiry(msg) != 0 && !args.Override {
+		return nil, &rpcError{rpcFailed, "the sender asked for this message to be erased; set override to retain it anyway"}
+	}
+	msg.Retained = args.Retain
+	if !msg.Retained {
+		msg.ExposureTime = c.Now()
+	}
+	c.Save()
+	return nil, nil
+}
+
+func (c *daemonClient) rpcNewContact(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Name string `json:"name"`
+		// SharedSecret is optional. If omitted, a random secret is
+		// generated and returned.
+		SharedSecret string `json:"sharedSecret"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	if len(args.Name) == 0 {
+		return nil, &rpcError{rpcInvalidParams, "contact name is empty"}
+	}
+	for _, contact := range c.Contacts {
+		if contact.Name == args.Name {
+			return nil, &rpcError{rpcFailed, "a contact with that name already exists"}
+		}
+	}
+	if len(args.SharedSecret) == 0 {
+		args.SharedSecret = panda.NewSecretString(c.Rand)
+	} else if !panda.IsAcceptableSecretString(args.SharedSecret) {
+		return nil, &rpcError{rpcFailed, "shared secret checksum is incorrect"}
+	}
+
+	contact := c.StartPANDA(args.Name, args.SharedSecret)
+	return map[string]interface{}{
+		"contact":      contactJSON(contact),
+		"sharedSecret": args.SharedSecret,
+	}, nil
+}
+
+func (c *daemonClient) rpcTransactNow(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	if c.IsOffline() {
+		return nil, &rpcError{rpcFailed, core.ErrOffline.Error()}
+	}
+	select {
+	case c.FetchNowChan <- nil:
+	default:
+	}
+	return nil, nil
+}
+
+func (c *daemonClient) rpcSetOffline(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args struct {
+		Offline bool `json:"offline"`
+	}
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	if args.Offline != c.IsOffline() {
+		c.SetOffline(args.Offline)
+		c.Save()
+	}
+	return nil, nil
+}
+
+func (c *daemonClient) rpcSync(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	n, err := c.StartSync()
+	if err != nil {
+		return nil, &rpcError{rpcFailed, err.Error()}
+	}
+	return map[string]interface{}{"transactions": n}, nil
+}
+
+type hookInfo struct {
+	Event       string `json:"event"`
+	Command     string `json:"command"`
+	IncludeBody bool   `json:"includeBody"`
+}
+
+func (c *daemonClient) rpcListHooks(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	hooks := make([]*hookInfo, 0, len(c.Hooks))
+	for _, name := range c.HookNames() {
+		h := c.Hooks[name]
+		hooks = append(hooks, &hookInfo{
+			Event:       name,
+			Command:     h.Command,
+			IncludeBody: h.IncludeBody,
+		})
+	}
+	return hooks, nil
+}
+
+// rpcSetHook sets the command that's run for an event. An empty command
+// removes the hook.
+func (c *daemonClient) rpcSetHook(conn *daemonConn, params json.RawMessage) (interface{}, *rpcError) {
+	var args hookInfo
+	if err := parseParams(params, &args); err != nil {
+		return nil, err
+	}
+
+	if err := c.SetHook(args.Event, args.Command, args.IncludeBody); err != nil {
+		return nil, &rpcError{rpcInvalidParams, err.Error()}
+	}
+	c.Save()
+	return nil, nil
+}
@@ -14,6 +14,90 @@ var _ = proto.Marshal
 var _ = &json.SyntaxError{}
 var _ = math.Inf
 
+type Proxy_Type int32
+
+const (
+	Proxy_TOR          Proxy_Type = 0
+	Proxy_SOCKS5       Proxy_Type = 1
+	Proxy_HTTP_CONNECT Proxy_Type = 2
+	Proxy_DIRECT       Proxy_Type = 3
+)
+
+var Proxy_Type_name = map[int32]string{
+	0: "TOR",
+	1: "SOCKS5",
+	2: "HTTP_CONNECT",
+	3: "DIRECT",
+}
+var Proxy_Type_value = map[string]int32{
+	"TOR":          0,
+	"SOCKS5":       1,
+	"HTTP_CONNECT": 2,
+	"DIRECT":       3,
+}
+
+func (x Proxy_Type) Enum() *Proxy_Type {
+	p := new(Proxy_Type)
+	*p = x
+	return p
+}
+func (x Proxy_Type) String() string {
+	return proto.EnumName(Proxy_Type_name, int32(x))
+}
+func (x Proxy_Type) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+func (x *Proxy_Type) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(Proxy_Type_value, data, "Proxy_Type")
+	if err != nil {
+		return err
+	}
+	*x = Proxy_Type(value)
+	return nil
+}
+
+type Retention_Mode int32
+
+const (
+	Retention_DEFAULT    Retention_Mode = 0
+	Retention_DAYS       Retention_Mode = 1
+	Retention_AFTER_READ Retention_Mode = 2
+	Retention_FOREVER    Retention_Mode = 3
+)
+
+var Retention_Mode_name = map[int32]string{
+	0: "DEFAULT",
+	1: "DAYS",
+	2: "AFTER_READ",
+	3: "FOREVER",
+}
+var Retention_Mode_value = map[string]int32{
+	"DEFAULT":    0,
+	"DAYS":       1,
+	"AFTER_READ": 2,
+	"FOREVER":    3,
+}
+
+func (x Retention_Mode) Enum() *Retention_Mode {
+	p := new(Retention_Mode)
+	*p = x
+	return p
+}
+func (x Retention_Mode) String() string {
+	return proto.EnumName(Retention_Mode_name, int32(x))
+}
+func (x Retention_Mode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(x.String())
+}
+func (x *Retention_Mode) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(Retention_Mode_value, data, "Retention_Mode")
+	if err != nil {
+		return err
+	}
+	*x = Retention_Mode(value)
+	return nil
+}
+
 type Header struct {
 	NonceSmearCopies *int32         `protobuf:"varint,1,opt,name=nonce_smear_copies,def=1365" json:"nonce_smear_copies,omitempty"`
 	KdfSalt          []byte         `protobuf:"bytes,2,opt,name=kdf_salt" json:"kdf_salt,omitempty"`
@@ -139,6 +223,8 @@ type Contact struct {
 	PreviousTags        []*Contact_PreviousTag `protobuf:"bytes,17,rep,name=previous_tags" json:"previous_tags,omitempty"`
 	Events              []*Contact_Event       `protobuf:"bytes,22,rep,name=events" json:"events,omitempty"`
 	IsPending           *bool                  `protobuf:"varint,15,opt,name=is_pending,def=0" json:"is_pending,omitempty"`
+	InboxRetention      *Retention             `protobuf:"bytes,23,opt,name=inbox_retention" json:"inbox_retention,omitempty"`
+	OutboxRetention     *Retention             `protobuf:"bytes,24,opt,name=outbox_retention" json:"outbox_retention,omitempty"`
 	XXX_unrecognized    []byte                 `json:"-"`
 }
 
@@ -302,6 +388,54 @@ func (this *Contact) GetIsPending() bool {
 	return Default_Contact_IsPending
 }
 
+func (this *Contact) GetInboxRetention() *Retention {
+	if this != nil {
+		return this.InboxRetention
+	}
+	return nil
+}
+
+func (this *Contact) GetOutboxRetention() *Retention {
+	if this != nil {
+		return this.OutboxRetention
+	}
+	return nil
+}
+
+type Retention struct {
+	Mode             *Retention_Mode `protobuf:"varint,1,opt,name=mode,enum=disk.Retention_Mode,def=0" json:"mode,omitempty"`
+	Days             *uint32         `protobuf:"varint,2,opt,name=days" json:"days,omitempty"`
+	Hours            *uint32         `protobuf:"varint,3,opt,name=hours" json:"hours,omitempty"`
+	XXX_unrecognized []byte          `json:"-"`
+}
+
+func (this *Retention) Reset()         { *this = Retention{} }
+func (this *Retention) String() string { return proto.CompactTextString(this) }
+func (*Retention) ProtoMessage()       {}
+
+const Default_Retention_Mode Retention_Mode = Retention_DEFAULT
+
+func (this *Retention) GetMode() Retention_Mode {
+	if this != nil && this.Mode != nil {
+		return *this.Mode
+	}
+	return Default_Retention_Mode
+}
+
+func (this *Retention) GetDays() uint32 {
+	if this != nil && this.Days != nil {
+		return *this.Days
+	}
+	return 0
+}
+
+func (this *Retention) GetHours() uint32 {
+	if this != nil && this.Hours != nil {
+		return *this.Hours
+	}
+	return 0
+}
+
 type Contact_PreviousTag struct {
 	Tag              []byte `protobuf:"bytes,1,req,name=tag" json:"tag,omitempty"`
 	Expired          *int64 `protobuf:"varint,2,req,name=expired" json:"expired,omitempty"`
@@ -551,15 +685,18 @@ func (this *RatchetState_SavedKeys_MessageKey) GetCreationTime() int64 {
 }
 
 type Inbox struct {
-	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
-	From             *uint64 `protobuf:"fixed64,2,req,name=from" json:"from,omitempty"`
-	ReceivedTime     *int64  `protobuf:"varint,3,req,name=received_time" json:"received_time,omitempty"`
-	Acked            *bool   `protobuf:"varint,4,req,name=acked" json:"acked,omitempty"`
-	Message          []byte  `protobuf:"bytes,5,opt,name=message" json:"message,omitempty"`
-	Read             *bool   `protobuf:"varint,6,req,name=read" json:"read,omitempty"`
-	Sealed           []byte  `protobuf:"bytes,7,opt,name=sealed" json:"sealed,omitempty"`
-	Retained         *bool   `protobuf:"varint,8,opt,name=retained,def=0" json:"retained,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	Id               *uint64  `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	From             *uint64  `protobuf:"fixed64,2,req,name=from" json:"from,omitempty"`
+	ReceivedTime     *int64   `protobuf:"varint,3,req,name=received_time" json:"received_time,omitempty"`
+	Acked            *bool    `protobuf:"varint,4,req,name=acked" json:"acked,omitempty"`
+	Message          []byte   `protobuf:"bytes,5,opt,name=message" json:"message,omitempty"`
+	Read             *bool    `protobuf:"varint,6,req,name=read" json:"read,omitempty"`
+	Sealed           []byte   `protobuf:"bytes,7,opt,name=sealed" json:"sealed,omitempty"`
+	Retained         *bool    `protobuf:"varint,8,opt,name=retained,def=0" json:"retained,omitempty"`
+	ReadTime         *int64   `protobuf:"varint,9,opt,name=read_time" json:"read_time,omitempty"`
+	PartIds          []uint64 `protobuf:"fixed64,10,rep,name=part_ids" json:"part_ids,omitempty"`
+	Held             *bool    `protobuf:"varint,11,opt,name=held" json:"held,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
 }
 
 func (this *Inbox) Reset()         { *this = Inbox{} }
@@ -624,6 +761,27 @@ func (this *Inbox) GetRetained() bool {
 	return Default_Inbox_Retained
 }
 
+func (this *Inbox) GetReadTime() int64 {
+	if this != nil && this.ReadTime != nil {
+		return *this.ReadTime
+	}
+	return 0
+}
+
+func (this *Inbox) GetPartIds() []uint64 {
+	if this != nil {
+		return this.PartIds
+	}
+	return nil
+}
+
+func (this *Inbox) GetHeld() bool {
+	if this != nil && this.Held != nil {
+		return *this.Held
+	}
+	return false
+}
+
 type Outbox struct {
 	Id               *uint64 `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
 	To               *uint64 `protobuf:"fixed64,2,req,name=to" json:"to,omitempty"`
@@ -634,6 +792,10 @@ type Outbox struct {
 	Request          []byte  `protobuf:"bytes,7,opt,name=request" json:"request,omitempty"`
 	Acked            *int64  `protobuf:"varint,8,opt,name=acked" json:"acked,omitempty"`
 	Revocation       *bool   `protobuf:"varint,9,opt,name=revocation" json:"revocation,omitempty"`
+	FanoutId         *uint64 `protobuf:"fixed64,10,opt,name=fanout_id" json:"fanout_id,omitempty"`
+	NotBefore        *int64  `protobuf:"varint,11,opt,name=not_before" json:"not_before,omitempty"`
+	PartOf           *uint64 `protobuf:"fixed64,12,opt,name=part_of" json:"part_of,omitempty"`
+	Undeliverable    *bool   `protobuf:"varint,13,opt,name=undeliverable" json:"undeliverable,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -704,6 +866,34 @@ func (this *Outbox) GetRevocation() bool {
 	return false
 }
 
+func (this *Outbox) GetFanoutId() uint64 {
+	if this != nil && this.FanoutId != nil {
+		return *this.FanoutId
+	}
+	return 0
+}
+
+func (this *Outbox) GetNotBefore() int64 {
+	if this != nil && this.NotBefore != nil {
+		return *this.NotBefore
+	}
+	return 0
+}
+
+func (this *Outbox) GetPartOf() uint64 {
+	if this != nil && this.PartOf != nil {
+		return *this.PartOf
+	}
+	return 0
+}
+
+func (this *Outbox) GetUndeliverable() bool {
+	if this != nil && this.Undeliverable != nil {
+		return *this.Undeliverable
+	}
+	return false
+}
+
 type Draft struct {
 	Id               *uint64                      `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
 	Created          *int64                       `protobuf:"varint,2,req,name=created" json:"created,omitempty"`
@@ -712,6 +902,11 @@ type Draft struct {
 	InReplyTo        *uint64                      `protobuf:"fixed64,5,opt,name=in_reply_to" json:"in_reply_to,omitempty"`
 	Attachments      []*protos.Message_Attachment `protobuf:"bytes,6,rep,name=attachments" json:"attachments,omitempty"`
 	Detachments      []*protos.Message_Detachment `protobuf:"bytes,7,rep,name=detachments" json:"detachments,omitempty"`
+	AlsoTo           []uint64                     `protobuf:"fixed64,8,rep,name=also_to" json:"also_to,omitempty"`
+	Expiry           *int64                       `protobuf:"varint,9,opt,name=expiry" json:"expiry,omitempty"`
+	SendAfter        *int64                       `protobuf:"varint,10,opt,name=send_after" json:"send_after,omitempty"`
+	SendDelay        *int64                       `protobuf:"varint,11,opt,name=send_delay" json:"send_delay,omitempty"`
+	SendWhenUploaded *bool                        `protobuf:"varint,12,opt,name=send_when_uploaded" json:"send_when_uploaded,omitempty"`
 	XXX_unrecognized []byte                       `json:"-"`
 }
 
@@ -768,6 +963,451 @@ func (this *Draft) GetDetachments() []*protos.Message_Detachment {
 	return nil
 }
 
+func (this *Draft) GetAlsoTo() []uint64 {
+	if this != nil {
+		return this.AlsoTo
+	}
+	return nil
+}
+
+func (this *Draft) GetExpiry() int64 {
+	if this != nil && this.Expiry != nil {
+		return *this.Expiry
+	}
+	return 0
+}
+
+func (this *Draft) GetSendAfter() int64 {
+	if this != nil && this.SendAfter != nil {
+		return *this.SendAfter
+	}
+	return 0
+}
+
+func (this *Draft) GetSendDelay() int64 {
+	if this != nil && this.SendDelay != nil {
+		return *this.SendDelay
+	}
+	return 0
+}
+
+func (this *Draft) GetSendWhenUploaded() bool {
+	if this != nil && this.SendWhenUploaded != nil {
+		return *this.SendWhenUploaded
+	}
+	return false
+}
+
+type ContactGroup struct {
+	Name             *string  `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	Contacts         []uint64 `protobuf:"fixed64,2,rep,name=contacts" json:"contacts,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (this *ContactGroup) Reset()         { *this = ContactGroup{} }
+func (this *ContactGroup) String() string { return proto.CompactTextString(this) }
+func (*ContactGroup) ProtoMessage()       {}
+
+func (this *ContactGroup) GetName() string {
+	if this != nil && this.Name != nil {
+		return *this.Name
+	}
+	return ""
+}
+
+func (this *ContactGroup) GetContacts() []uint64 {
+	if this != nil {
+		return this.Contacts
+	}
+	return nil
+}
+
+type Proxy struct {
+	Type               *Proxy_Type `protobuf:"varint,1,opt,name=type,enum=disk.Proxy_Type,def=0" json:"type,omitempty"`
+	Address            *string     `protobuf:"bytes,2,opt,name=address" json:"address,omitempty"`
+	Username           *string     `protobuf:"bytes,3,opt,name=username" json:"username,omitempty"`
+	Password           *string     `protobuf:"bytes,4,opt,name=password" json:"password,omitempty"`
+	IsolateStreams     *bool       `protobuf:"varint,5,opt,name=isolate_streams" json:"isolate_streams,omitempty"`
+	DirectAcknowledged *bool       `protobuf:"varint,6,opt,name=direct_acknowledged" json:"direct_acknowledged,omitempty"`
+	XXX_unrecognized   []byte      `json:"-"`
+}
+
+func (this *Proxy) Reset()         { *this = Proxy{} }
+func (this *Proxy) String() string { return proto.CompactTextString(this) }
+func (*Proxy) ProtoMessage()       {}
+
+const Default_Proxy_Type Proxy_Type = Proxy_TOR
+
+func (this *Proxy) GetType() Proxy_Type {
+	if this != nil && this.Type != nil {
+		return *this.Type
+	}
+	return Default_Proxy_Type
+}
+
+func (this *Proxy) GetAddress() string {
+	if this != nil && this.Address != nil {
+		return *this.Address
+	}
+	return ""
+}
+
+func (this *Proxy) GetUsername() string {
+	if this != nil && this.Username != nil {
+		return *this.Username
+	}
+	return ""
+}
+
+func (this *Proxy) GetPassword() string {
+	if this != nil && this.Password != nil {
+		return *this.Password
+	}
+	return ""
+}
+
+func (this *Proxy) GetIsolateStreams() bool {
+	if this != nil && this.IsolateStreams != nil {
+		return *this.IsolateStreams
+	}
+	return false
+}
+
+func (this *Proxy) GetDirectAcknowledged() bool {
+	if this != nil && this.DirectAcknowledged != nil {
+		return *this.DirectAcknowledged
+	}
+	return false
+}
+
+type NetworkConfig struct {
+	DefaultProxy        *Proxy                         `protobuf:"bytes,1,opt,name=default_proxy" json:"default_proxy,omitempty"`
+	ServerProxies       []*NetworkConfig_ServerProxy   `protobuf:"bytes,2,rep,name=server_proxies" json:"server_proxies,omitempty"`
+	CoverTraffic        *bool                          `protobuf:"varint,3,opt,name=cover_traffic" json:"cover_traffic,omitempty"`
+	UndeliverableAfter  *int64                         `protobuf:"varint,4,opt,name=undeliverable_after" json:"undeliverable_after,omitempty"`
+	TransactionInterval *int64                         `protobuf:"varint,5,opt,name=transaction_interval" json:"transaction_interval,omitempty"`
+	BurstTransactions   *int32                         `protobuf:"varint,6,opt,name=burst_transactions" json:"burst_transactions,omitempty"`
+	BurstInterval       *int64                         `protobuf:"varint,7,opt,name=burst_interval" json:"burst_interval,omitempty"`
+	QuietStart          *int32                         `protobuf:"varint,8,opt,name=quiet_start" json:"quiet_start,omitempty"`
+	QuietEnd            *int32                         `protobuf:"varint,9,opt,name=quiet_end" json:"quiet_end,omitempty"`
+	Paused              *bool                          `protobuf:"varint,10,opt,name=paused" json:"paused,omitempty"`
+	Offline             *bool                          `protobuf:"varint,11,opt,name=offline" json:"offline,omitempty"`
+	ServerFailures      []*NetworkConfig_ServerFailure `protobuf:"bytes,12,rep,name=server_failures" json:"server_failures,omitempty"`
+	ServerCarriers      []*NetworkConfig_ServerCarrier `protobuf:"bytes,13,rep,name=server_carriers" json:"server_carriers,omitempty"`
+	XXX_unrecognized    []byte                         `json:"-"`
+}
+
+func (this *NetworkConfig) Reset()         { *this = NetworkConfig{} }
+func (this *NetworkConfig) String() string { return proto.CompactTextString(this) }
+func (*NetworkConfig) ProtoMessage()       {}
+
+func (this *NetworkConfig) GetDefaultProxy() *Proxy {
+	if this != nil {
+		return this.DefaultProxy
+	}
+	return nil
+}
+
+func (this *NetworkConfig) GetServerProxies() []*NetworkConfig_ServerProxy {
+	if this != nil {
+		return this.ServerProxies
+	}
+	return nil
+}
+
+func (this *NetworkConfig) GetCoverTraffic() bool {
+	if this != nil && this.CoverTraffic != nil {
+		return *this.CoverTraffic
+	}
+	return false
+}
+
+func (this *NetworkConfig) GetUndeliverableAfter() int64 {
+	if this != nil && this.UndeliverableAfter != nil {
+		return *this.UndeliverableAfter
+	}
+	return 0
+}
+
+func (this *NetworkConfig) GetTransactionInterval() int64 {
+	if this != nil && this.TransactionInterval != nil {
+		return *this.TransactionInterval
+	}
+	return 0
+}
+
+func (this *NetworkConfig) GetBurstTransactions() int32 {
+	if this != nil && this.BurstTransactions != nil {
+		return *this.BurstTransactions
+	}
+	return 0
+}
+
+func (this *NetworkConfig) GetBurstInterval() int64 {
+	if this != nil && this.BurstInterval != nil {
+		return *this.BurstInterval
+	}
+	return 0
+}
+
+func (this *NetworkConfig) GetQuietStart() int32 {
+	if this != nil && this.QuietStart != nil {
+		return *this.QuietStart
+	}
+	return 0
+}
+
+func (this *NetworkConfig) GetQuietEnd() int32 {
+	if this != nil && this.QuietEnd != nil {
+		return *this.QuietEnd
+	}
+	return 0
+}
+
+func (this *NetworkConfig) GetPaused() bool {
+	if this != nil && this.Paused != nil {
+		return *this.Paused
+	}
+	return false
+}
+
+func (this *NetworkConfig) GetOffline() bool {
+	if this != nil && this.Offline != nil {
+		return *this.Offline
+	}
+	return false
+}
+
+func (this *NetworkConfig) GetServerFailures() []*NetworkConfig_ServerFailure {
+	if this != nil {
+		return this.ServerFailures
+	}
+	return nil
+}
+
+func (this *NetworkConfig) GetServerCarriers() []*NetworkConfig_ServerCarrier {
+	if this != nil {
+		return this.ServerCarriers
+	}
+	return nil
+}
+
+type NetworkConfig_ServerProxy struct {
+	Server           *string `protobuf:"bytes,1,req,name=server" json:"server,omitempty"`
+	Proxy            *Proxy  `protobuf:"bytes,2,req,name=proxy" json:"proxy,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *NetworkConfig_ServerProxy) Reset()         { *this = NetworkConfig_ServerProxy{} }
+func (this *NetworkConfig_ServerProxy) String() string { return proto.CompactTextString(this) }
+func (*NetworkConfig_ServerProxy) ProtoMessage()       {}
+
+func (this *NetworkConfig_ServerProxy) GetServer() string {
+	if this != nil && this.Server != nil {
+		return *this.Server
+	}
+	return ""
+}
+
+func (this *NetworkConfig_ServerProxy) GetProxy() *Proxy {
+	if this != nil {
+		return this.Proxy
+	}
+	return nil
+}
+
+type NetworkConfig_ServerFailure struct {
+	Server           *string `protobuf:"bytes,1,req,name=server" json:"server,omitempty"`
+	First            *int64  `protobuf:"varint,2,req,name=first" json:"first,omitempty"`
+	Count            *int32  `protobuf:"varint,3,req,name=count" json:"count,omitempty"`
+	Retry            *int64  `protobuf:"varint,4,req,name=retry" json:"retry,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *NetworkConfig_ServerFailure) Reset()         { *this = NetworkConfig_ServerFailure{} }
+func (this *NetworkConfig_ServerFailure) String() string { return proto.CompactTextString(this) }
+func (*NetworkConfig_ServerFailure) ProtoMessage()       {}
+
+func (this *NetworkConfig_ServerFailure) GetServer() string {
+	if this != nil && this.Server != nil {
+		return *this.Server
+	}
+	return ""
+}
+
+func (this *NetworkConfig_ServerFailure) GetFirst() int64 {
+	if this != nil && this.First != nil {
+		return *this.First
+	}
+	return 0
+}
+
+func (this *NetworkConfig_ServerFailure) GetCount() int32 {
+	if this != nil && this.Count != nil {
+		return *this.Count
+	}
+	return 0
+}
+
+func (this *NetworkConfig_ServerFailure) GetRetry() int64 {
+	if this != nil && this.Retry != nil {
+		return *this.Retry
+	}
+	return 0
+}
+
+type NetworkConfig_ServerCarrier struct {
+	Server           *string `protobuf:"bytes,1,req,name=server" json:"server,omitempty"`
+	Url              *string `protobuf:"bytes,2,req,name=url" json:"url,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *NetworkConfig_ServerCarrier) Reset()         { *this = NetworkConfig_ServerCarrier{} }
+func (this *NetworkConfig_ServerCarrier) String() string { return proto.CompactTextString(this) }
+func (*NetworkConfig_ServerCarrier) ProtoMessage()       {}
+
+func (this *NetworkConfig_ServerCarrier) GetServer() string {
+	if this != nil && this.Server != nil {
+		return *this.Server
+	}
+	return ""
+}
+
+func (this *NetworkConfig_ServerCarrier) GetUrl() string {
+	if this != nil && this.Url != nil {
+		return *this.Url
+	}
+	return ""
+}
+
+type Transfer struct {
+	Id               *uint64                    `protobuf:"fixed64,1,req,name=id" json:"id,omitempty"`
+	Upload           *bool                      `protobuf:"varint,2,req,name=upload" json:"upload,omitempty"`
+	TmpPath          *string                    `protobuf:"bytes,3,req,name=tmp_path" json:"tmp_path,omitempty"`
+	Path             *string                    `protobuf:"bytes,4,req,name=path" json:"path,omitempty"`
+	Detachment       *protos.Message_Detachment `protobuf:"bytes,5,opt,name=detachment" json:"detachment,omitempty"`
+	Draft            *uint64                    `protobuf:"fixed64,6,opt,name=draft" json:"draft,omitempty"`
+	Size             *int64                     `protobuf:"varint,7,opt,name=size" json:"size,omitempty"`
+	Done             *int64                     `protobuf:"varint,8,opt,name=done" json:"done,omitempty"`
+	Total            *int64                     `protobuf:"varint,9,opt,name=total" json:"total,omitempty"`
+	Attachment       *bool                      `protobuf:"varint,10,opt,name=attachment" json:"attachment,omitempty"`
+	Source           *protos.Message_Detachment `protobuf:"bytes,11,opt,name=source" json:"source,omitempty"`
+	XXX_unrecognized []byte                     `json:"-"`
+}
+
+func (this *Transfer) Reset()         { *this = Transfer{} }
+func (this *Transfer) String() string { return proto.CompactTextString(this) }
+func (*Transfer) ProtoMessage()       {}
+
+func (this *Transfer) GetId() uint64 {
+	if this != nil && this.Id != nil {
+		return *this.Id
+	}
+	return 0
+}
+
+func (this *Transfer) GetUpload() bool {
+	if this != nil && this.Upload != nil {
+		return *this.Upload
+	}
+	return false
+}
+
+func (this *Transfer) GetTmpPath() string {
+	if this != nil && this.TmpPath != nil {
+		return *this.TmpPath
+	}
+	return ""
+}
+
+func (this *Transfer) GetPath() string {
+	if this != nil && this.Path != nil {
+		return *this.Path
+	}
+	return ""
+}
+
+func (this *Transfer) GetDetachment() *protos.Message_Detachment {
+	if this != nil {
+		return this.Detachment
+	}
+	return nil
+}
+
+func (this *Transfer) GetDraft() uint64 {
+	if this != nil && this.Draft != nil {
+		return *this.Draft
+	}
+	return 0
+}
+
+func (this *Transfer) GetSize() int64 {
+	if this != nil && this.Size != nil {
+		return *this.Size
+	}
+	return 0
+}
+
+func (this *Transfer) GetDone() int64 {
+	if this != nil && this.Done != nil {
+		return *this.Done
+	}
+	return 0
+}
+
+func (this *Transfer) GetTotal() int64 {
+	if this != nil && this.Total != nil {
+		return *this.Total
+	}
+	return 0
+}
+
+func (this *Transfer) GetAttachment() bool {
+	if this != nil && this.Attachment != nil {
+		return *this.Attachment
+	}
+	return false
+}
+
+func (this *Transfer) GetSource() *protos.Message_Detachment {
+	if this != nil {
+		return this.Source
+	}
+	return nil
+}
+
+type Hook struct {
+	Event            *string `protobuf:"bytes,1,req,name=event" json:"event,omitempty"`
+	Command          *string `protobuf:"bytes,2,req,name=command" json:"command,omitempty"`
+	IncludeBody      *bool   `protobuf:"varint,3,opt,name=include_body" json:"include_body,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *Hook) Reset()         { *this = Hook{} }
+func (this *Hook) String() string { return proto.CompactTextString(this) }
+func (*Hook) ProtoMessage()       {}
+
+func (this *Hook) GetEvent() string {
+	if this != nil && this.Event != nil {
+		return *this.Event
+	}
+	return ""
+}
+
+func (this *Hook) GetCommand() string {
+	if this != nil && this.Command != nil {
+		return *this.Command
+	}
+	return ""
+}
+
+func (this *Hook) GetIncludeBody() bool {
+	if this != nil && this.IncludeBody != nil {
+		return *this.IncludeBody
+	}
+	return false
+}
+
 type State struct {
 	Identity                 []byte                 `protobuf:"bytes,1,req,name=identity" json:"identity,omitempty"`
 	Public                   []byte                 `protobuf:"bytes,2,req,name=public" json:"public,omitempty"`
@@ -782,6 +1422,10 @@ type State struct {
 	Inbox                    []*Inbox               `protobuf:"bytes,9,rep,name=inbox" json:"inbox,omitempty"`
 	Outbox                   []*Outbox              `protobuf:"bytes,10,rep,name=outbox" json:"outbox,omitempty"`
 	Drafts                   []*Draft               `protobuf:"bytes,11,rep,name=drafts" json:"drafts,omitempty"`
+	Network                  *NetworkConfig         `protobuf:"bytes,14,opt,name=network" json:"network,omitempty"`
+	ContactGroups            []*ContactGroup        `protobuf:"bytes,15,rep,name=contact_groups" json:"contact_groups,omitempty"`
+	Transfers                []*Transfer            `protobuf:"bytes,16,rep,name=transfers" json:"transfers,omitempty"`
+	Hooks                    []*Hook                `protobuf:"bytes,17,rep,name=hooks" json:"hooks,omitempty"`
 	XXX_unrecognized         []byte                 `json:"-"`
 }
 
@@ -880,6 +1524,34 @@ func (this *State) GetDrafts() []*Draft {
 	return nil
 }
 
+func (this *State) GetNetwork() *NetworkConfig {
+	if this != nil {
+		return this.Network
+	}
+	return nil
+}
+
+func (this *State) GetContactGroups() []*ContactGroup {
+	if this != nil {
+		return this.ContactGroups
+	}
+	return nil
+}
+
+func (this *State) GetTransfers() []*Transfer {
+	if this != nil {
+		return this.Transfers
+	}
+	return nil
+}
+
+func (this *State) GetHooks() []*Hook {
+	if this != nil {
+		return this.Hooks
+	}
+	return nil
+}
+
 type State_PreviousGroup struct {
 	Group            []byte `protobuf:"bytes,1,req,name=group" json:"group,omitempty"`
 	GroupPrivate     []byte `protobuf:"bytes,2,req,name=group_private" json:"group_private,omitempty"`
@@ -913,4 +1585,6 @@ func (this *State_PreviousGroup) GetExpired() int64 {
 }
 
 func init() {
+	proto.RegisterEnum("disk.Proxy_Type", Proxy_Type_name, Proxy_Type_value)
+	proto.RegisterEnum("disk.Retention_Mode", Retention_Mode_name, Retention_Mode_value)
 }
@@ -43,6 +43,13 @@ type ErasureStorage interface {
 // that header.
 var erasureRegistry []func(*Header) ErasureStorage
 
+// RegisterErasureStorage adds f to the functions that are tried, in order, to
+// find the ErasureStorage for a state file's header. It's intended to be
+// called from the init function of a package that implements ErasureStorage.
+func RegisterErasureStorage(f func(*Header) ErasureStorage) {
+	erasureRegistry = append(erasureRegistry, f)
+}
+
 // StateFile encapsulates information about a state file on diskl
 type StateFile struct {
 	Path string
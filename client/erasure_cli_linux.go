@@ -9,7 +9,7 @@ import (
 	"github.com/agl/pond/client/tpm"
 )
 
-func (c *cliClient) createErasureStorage(pw string, stateFile *disk.StateFile) error {
+func (c *cliClient) CreateErasureStorage(pw string, stateFile *disk.StateFile) error {
 	c.Printf("%s %s\n", termInfoPrefix, tpmIntroMsg)
 
 	present := tpm.Present()
@@ -37,15 +37,15 @@ ConfigureLoop:
 			}
 		}
 
-		tpm := disk.TPM{
+		erasure := tpm.Erasure{
 			Log: func(format string, args ...interface{}) {
 				msg := fmt.Sprintf(format, args...)
 				c.Printf("%s\n", terminalEscape(msg, false))
 			},
-			Rand: c.rand,
+			Rand: c.Rand,
 		}
 
-		stateFile.Erasure = &tpm
+		stateFile.Erasure = &erasure
 		if err := stateFile.Create(pw); err != nil {
 			c.Printf("%s Setup failed with error: %s\n", termErrPrefix, terminalEscape(err.Error(), false))
 		} else {
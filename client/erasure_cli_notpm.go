@@ -0,0 +1,16 @@
+// +build darwin freebsd notpm
+
+package main
+
+import (
+	"github.com/agl/pond/client/disk"
+)
+
+func (c *cliClient) CreateErasureStorage(pw string, stateFile *disk.StateFile) error {
+	// No NVRAM support on this platform or in this build.
+	return stateFile.Create(pw)
+}
+
+func (c *cliClient) hasErasure() bool {
+	return false
+}
@@ -10,7 +10,7 @@ import (
 	"github.com/agl/pond/client/tpm"
 )
 
-func (c *guiClient) createErasureStorage(pw string, stateFile *disk.StateFile) error {
+func (c *guiClient) CreateErasureStorage(pw string, stateFile *disk.StateFile) error {
 	var tpmInfo string
 	present := tpm.Present()
 	if present {
@@ -63,14 +63,14 @@ func (c *guiClient) createErasureStorage(pw string, stateFile *disk.StateFile) e
 
 	var logText string
 
-	tpm := disk.TPM{
+	erasure := tpm.Erasure{
 		Log: func(format string, args ...interface{}) {
-			c.log.Printf(format, args...)
+			c.Log.Printf(format, args...)
 			logText += fmt.Sprintf(format, args...) + "\n"
 			c.gui.Actions() <- SetTextView{name: "log", text: logText}
 			c.gui.Signal()
 		},
-		Rand: c.rand,
+		Rand: c.Rand,
 	}
 
 NextEvent:
@@ -97,13 +97,13 @@ NextEvent:
 				time.Sleep(300 * time.Millisecond)
 			}
 
-			stateFile.Erasure = &tpm
+			stateFile.Erasure = &erasure
 			c.gui.Actions() <- Sensitive{name: "tpm", sensitive: false}
 			c.gui.Actions() <- Sensitive{name: "continue", sensitive: false}
 			c.gui.Signal()
 			if err := stateFile.Create(pw); err != nil {
-				tpm.Log("Setup failed with error: %s", err)
-				tpm.Log("You can click the button to try again")
+				erasure.Log("Setup failed with error: %s", err)
+				erasure.Log("You can click the button to try again")
 				c.gui.Actions() <- Sensitive{name: "tpm", sensitive: true}
 				c.gui.Actions() <- Sensitive{name: "continue", sensitive: true}
 				c.gui.Signal()
@@ -0,0 +1,17 @@
+// +build !nogui
+// +build darwin freebsd notpm
+
+package main
+
+import (
+	"github.com/agl/pond/client/disk"
+)
+
+func (c *guiClient) CreateErasureStorage(pw string, stateFile *disk.StateFile) error {
+	// No NVRAM support on this platform or in this build.
+	return stateFile.Create(pw)
+}
+
+func (c *guiClient) hasErasure() bool {
+	return false
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/agl/go-gtk/glib"
 	"github.com/agl/go-gtk/gtk"
 	"github.com/agl/go-gtk/gtkspell"
+	"github.com/agl/pond/client/core"
 )
 
 type GTKUI struct {
@@ -329,8 +330,8 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 				button.Add(label)
 			}
 		}
-		if v.image != indicatorNone {
-			image := gtk.ImageFromPixbuf(v.image.Image())
+		if v.image != core.IndicatorNone {
+			image := gtk.ImageFromPixbuf(indicatorImage(v.image))
 			button.Add(image)
 		}
 		button.Clicked(func() {
@@ -417,7 +418,7 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		configureWidget(&combo.GtkWidget, v.widgetBase)
 		return combo
 	case Image:
-		image := gtk.ImageFromPixbuf(v.image.Image())
+		image := gtk.ImageFromPixbuf(indicatorImage(v.image))
 		image.SetAlignment(v.xAlign, v.yAlign)
 		configureWidget(&image.GtkWidget, v.widgetBase)
 		return image
@@ -476,6 +477,10 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		return hbox
 	case Calendar:
 		cal := gtk.Calendar()
+		if v.date.year != 0 {
+			cal.SelectMonth(uint(v.date.month), uint(v.date.year))
+			cal.SelectDay(uint(v.date.day))
+		}
 		configureWidget(&cal.GtkWidget, v.widgetBase)
 		if len(v.name) > 0 {
 			ui.calendars[v.name] = cal
@@ -486,6 +491,7 @@ func (ui *GTKUI) createWidget(v interface{}) gtk.WidgetLike {
 		return cal
 	case SpinButton:
 		spin := gtk.SpinButtonWithRange(v.min, v.max, v.step)
+		spin.SetValue(v.value)
 		configureWidget(&spin.GtkWidget, v.widgetBase)
 		if len(v.name) > 0 {
 			ui.spinButtons[v.name] = spin
@@ -606,7 +612,7 @@ func (ui *GTKUI) handle(action interface{}) {
 		widget.ScrollToMark(mark, 0.0, true, 0, 1)
 	case SetImage:
 		widget := gtk.GtkImage{gtk.GtkWidget{ui.getWidget(action.name).ToNative()}}
-		widget.SetFromPixbuf(action.image.Image())
+		widget.SetFromPixbuf(indicatorImage(action.image))
 	case SetFocus:
 		widget := gtk.GtkWidget{ui.getWidget(action.name).ToNative()}
 		widget.GrabFocus()
@@ -681,9 +687,9 @@ func toColor(color uint32) *gdk.GdkRGBA {
 	return gdk.RGBA(colComponent(color>>16), colComponent(color>>8), colComponent(color), 1)
 }
 
-var indicatorImages [indicatorCount]*gdkpixbuf.GdkPixbuf
+var indicatorImages [core.IndicatorCount]*gdkpixbuf.GdkPixbuf
 
-func (i Indicator) Image() *gdkpixbuf.GdkPixbuf {
+func indicatorImage(i core.Indicator) *gdkpixbuf.GdkPixbuf {
 	if indicatorImages[i] == nil {
 		loader, err := gdkpixbuf.PixbufLoaderWithType("png")
 		if err != nil {
@@ -2,12 +2,16 @@
 
 package main
 
-import "io"
+import (
+	"io"
+
+	"github.com/agl/pond/client/core"
+)
 
 const haveGUI = false
 
 type noGUIClient struct {
-	client
+	core.Client
 }
 
 type GUI int
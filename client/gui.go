@@ -15,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/agl/pond/client/core"
 	"github.com/agl/pond/client/disk"
 	"github.com/agl/pond/panda"
 	pond "github.com/agl/pond/protos"
@@ -79,10 +80,14 @@ const (
 	uiStateEntombComplete
 	uiStateContactNameChanged
 	uiStateDetachmentComplete
+	uiStateThread
+	uiStateSearch
+	uiStateTransfers
+	uiStateServers
 )
 
 type guiClient struct {
-	client
+	core.Client
 
 	gui                                               GUI
 	inboxUI, outboxUI, contactsUI, clientUI, draftsUI *listUI
@@ -99,29 +104,29 @@ type guiClient struct {
 func (c *guiClient) nextEvent(currentMsgId uint64) (event interface{}, wanted bool) {
 	var ok bool
 	select {
-	case sigReq := <-c.signingRequestChan:
-		c.processSigningRequest(sigReq)
+	case sigReq := <-c.SigningRequestChan:
+		c.ProcessSigningRequest(sigReq)
 		return
 	case event, ok = <-c.gui.Events():
 		if !ok {
 			c.ShutdownAndSuspend()
 		}
-	case newMessage := <-c.newMessageChan:
-		c.processNewMessage(newMessage)
+	case newMessage := <-c.NewMessageChan:
+		c.ProcessNewMessage(newMessage)
 		return
-	case msr := <-c.messageSentChan:
-		if msr.id != 0 {
-			c.processMessageSent(msr)
+	case msr := <-c.MessageSentChan:
+		if msr.Id != 0 {
+			c.ProcessMessageSent(msr)
 		}
 		return
-	case update := <-c.pandaChan:
-		c.processPANDAUpdate(update)
+	case update := <-c.PandaChan:
+		c.ProcessPANDAUpdate(update)
 		return
-	case event = <-c.backgroundChan:
-		break
-	case <-c.log.updateChan:
+	case event = <-c.BackgroundChan:
+		c.ProcessTransferEvent(event)
+	case <-c.Log.UpdateChan:
 		return
-	case <-c.timerChan:
+	case <-c.TimerChan:
 		c.processTimer(currentMsgId)
 		return
 	}
@@ -149,53 +154,18 @@ func (c *guiClient) nextEvent(currentMsgId uint64) (event interface{}, wanted bo
 
 func (c *guiClient) processTimer(currentMsgId uint64) {
 	now := c.Now()
-	haveDeleted := false
-
-RestartInboxIteration:
-	for {
-		for _, msg := range c.inbox {
-			if msg.id != currentMsgId && !msg.retained && now.Sub(msg.receivedTime) > messageLifetime && now.Sub(msg.exposureTime) > messageGraceTime {
-				if len(msg.message.Body) > 0 {
-					c.inboxUI.Remove(msg.id)
-				}
-				c.deleteInboxMsg(msg.id)
-				// c.inbox will have been updated by this
-				// deletion so we start from the beginning
-				// again.
-				haveDeleted = true
-				continue RestartInboxIteration
-			}
-			c.updateInboxBackgroundColor(msg)
-		}
-		break
-	}
-
-RestartOutboxIteration:
-	for {
-		for _, msg := range c.outbox {
-			if msg.id != currentMsgId && now.Sub(msg.created) > messageLifetime {
-				if msg.revocation || len(msg.message.Body) > 0 {
-					c.outboxUI.Remove(msg.id)
-				}
-				c.deleteOutboxMsg(msg.id)
-				haveDeleted = true
-				continue RestartOutboxIteration
-			}
-		}
-		break
-	}
-
-	if haveDeleted {
-		c.save()
+	c.ProcessTimerTick(now, currentMsgId)
+	for _, msg := range c.Inbox {
+		c.updateInboxBackgroundColor(msg)
 	}
 
 	c.gui.Actions() <- UIState{uiStateTimerComplete}
 	c.gui.Signal()
 }
 
-// torPromptUI displays a prompt to start Tor and tries once a second until it
+// TorPromptUI displays a prompt to start Tor and tries once a second until it
 // can be found.
-func (c *guiClient) torPromptUI() error {
+func (c *guiClient) TorPromptUI() error {
 	ui := VBox{
 		widgetBase: widgetBase{padding: 40, expand: true, fill: true, name: "vbox"},
 		children: []Widget{
@@ -226,7 +196,7 @@ func (c *guiClient) torPromptUI() error {
 				c.ShutdownAndSuspend()
 			}
 		case <-ticker.C:
-			if c.detectTor() {
+			if c.DetectTor() {
 				return nil
 			}
 		}
@@ -235,7 +205,7 @@ func (c *guiClient) torPromptUI() error {
 	return nil
 }
 
-func (c *guiClient) sleepUI(d time.Duration) error {
+func (c *guiClient) SleepUI(d time.Duration) error {
 	select {
 	case _, ok := <-c.gui.Events():
 		if !ok {
@@ -250,7 +220,7 @@ func (c *guiClient) sleepUI(d time.Duration) error {
 	return nil
 }
 
-func (c *guiClient) initUI() {
+func (c *guiClient) InitUI() {
 	ui := VBox{
 		widgetBase: widgetBase{
 			background: colorWhite,
@@ -284,7 +254,7 @@ func (c *guiClient) initUI() {
 	c.gui.Actions() <- Reset{ui}
 }
 
-func (c *guiClient) loadingUI() {
+func (c *guiClient) LoadingUI() {
 	loading := EventBox{
 		widgetBase: widgetBase{expand: true, fill: true},
 		child: Label{
@@ -327,8 +297,8 @@ var rightPlaceholderUI = EventBox{
 func (c *guiClient) updateWindowTitle() {
 	unreadCount := 0
 
-	for _, msg := range c.inbox {
-		if msg.message != nil && !msg.read && len(msg.message.Body) > 0 {
+	for _, msg := range c.Inbox {
+		if msg.Message != nil && !msg.Read && len(msg.Message.Body) > 0 {
 			unreadCount++
 		}
 	}
@@ -341,54 +311,83 @@ func (c *guiClient) updateWindowTitle() {
 	c.gui.Signal()
 }
 
-func (c *guiClient) processFetch(inboxMsg *InboxMessage) {
-	from := c.contacts[inboxMsg.from]
+func (c *guiClient) ProcessFetch(inboxMsg *core.InboxMessage) {
+	from := c.Contacts[inboxMsg.From]
 
-	if !from.isPending {
-		if len(inboxMsg.message.Body) > 0 {
-			subline := time.Unix(*inboxMsg.message.Time, 0).Format(shortTimeFormat)
-			c.inboxUI.Add(inboxMsg.id, from.name, subline, indicatorBlue)
+	if !from.IsPending {
+		if len(inboxMsg.Message.Body) > 0 {
+			subline := time.Unix(*inboxMsg.Message.Time, 0).Format(core.ShortTimeFormat)
+			c.inboxUI.Add(inboxMsg.Id, from.Name, subline, core.IndicatorBlue)
 		}
 	} else {
-		c.inboxUI.Add(inboxMsg.id, from.name, "pending", indicatorRed)
+		c.inboxUI.Add(inboxMsg.Id, from.Name, "pending", core.IndicatorRed)
 	}
 
 	c.updateWindowTitle()
 }
 
-func (c *guiClient) processServerAnnounce(inboxMsg *InboxMessage) {
-	subline := time.Unix(*inboxMsg.message.Time, 0).Format(shortTimeFormat)
-	c.inboxUI.Add(inboxMsg.id, c.ContactName(inboxMsg.from), subline, indicatorBlue)
+func (c *guiClient) ProcessServerAnnounce(inboxMsg *core.InboxMessage) {
+	subline := time.Unix(*inboxMsg.Message.Time, 0).Format(core.ShortTimeFormat)
+	c.inboxUI.Add(inboxMsg.Id, c.ContactName(inboxMsg.From), subline, core.IndicatorBlue)
 	c.updateWindowTitle()
 }
 
-func (c *guiClient) processAcknowledgement(ackedMsg *queuedMessage) {
-	c.outboxUI.SetIndicator(ackedMsg.id, indicatorGreen)
+func (c *guiClient) ProcessAcknowledgement(ackedMsg *core.QueuedMessage) {
+	c.outboxUI.SetIndicator(ackedMsg.Id, core.IndicatorGreen)
 }
 
-func (c *guiClient) processRevocationOfUs(by *Contact) {
-	c.contactsUI.SetIndicator(by.id, indicatorBlack)
-	c.contactsUI.SetSubline(by.id, "has revoked")
+func (c *guiClient) ProcessRevocationOfUs(by *core.Contact) {
+	c.contactsUI.SetIndicator(by.Id, core.IndicatorBlack)
+	c.contactsUI.SetSubline(by.Id, "has revoked")
 
-	c.queueMutex.Lock()
-	for _, m := range c.queue {
-		if m.to == by.id {
-			c.outboxUI.SetIndicator(m.id, indicatorBlack)
+	c.QueueMutex.Lock()
+	for _, m := range c.Queue {
+		if m.To == by.Id {
+			c.outboxUI.SetIndicator(m.Id, core.IndicatorBlack)
 		}
 	}
-	c.queueMutex.Unlock()
+	c.QueueMutex.Unlock()
 }
 
-func (c *guiClient) processRevocation(by *Contact) {
+func (c *guiClient) ProcessRevocation(by *core.Contact) {
 	c.gui.Actions() <- UIState{uiStateRevocationProcessed}
 	c.gui.Signal()
 }
 
-func (c *guiClient) processMessageDelivered(msg *queuedMessage) {
-	c.outboxUI.SetIndicator(msg.id, indicatorYellow)
+func (c *guiClient) ProcessMessageDelivered(msg *core.QueuedMessage) {
+	c.outboxUI.SetIndicator(msg.Id, core.IndicatorYellow)
+}
+
+func (c *guiClient) ProcessMessageUndeliverable(msg *core.QueuedMessage) {
+	c.outboxUI.SetIndicator(msg.Id, core.IndicatorBlack)
 }
 
-func (c *guiClient) mainUI() {
+func (c *guiClient) ProcessDraftSent(draft *core.Draft, id uint64, err error) {
+	if err != nil {
+		c.Log.Errorf("Error sending message after uploading its attachments: %s", err)
+		return
+	}
+	c.draftsUI.Remove(draft.Id)
+	for _, msg := range c.Outbox {
+		if msg.Id != id {
+			continue
+		}
+		for _, m := range c.FanoutCopies(msg) {
+			c.outboxUI.Add(m.Id, c.ContactName(m.To), m.Created.Format(core.ShortTimeFormat), core.IndicatorRed)
+		}
+		break
+	}
+	if draft.InReplyTo != 0 {
+		for _, msg := range c.Inbox {
+			if msg.Acked && msg.Message != nil && msg.Message.GetId() == draft.InReplyTo {
+				c.inboxUI.SetIndicator(msg.Id, core.IndicatorNone)
+				break
+			}
+		}
+	}
+}
+
+func (c *guiClient) MainUI() {
 	ui := Paned{
 		left: Scrolled{
 			viewport: true,
@@ -533,8 +532,8 @@ func (c *guiClient) mainUI() {
 		vboxName: "contactsVbox",
 	}
 
-	for _, contact := range c.client.contactsSorted() {
-		c.contactsUI.Add(contact.id, contact.name, contact.subline(), contact.indicator())
+	for _, contact := range c.Client.ContactsSorted() {
+		c.contactsUI.Add(contact.Id, contact.Name, contact.Subline(), contact.Indicator())
 	}
 
 	c.inboxUI = &listUI{
@@ -542,27 +541,27 @@ func (c *guiClient) mainUI() {
 		vboxName: "inboxVbox",
 	}
 
-	for _, msg := range c.inbox {
+	for _, msg := range c.Inbox {
 		var subline string
-		i := indicatorNone
+		i := core.IndicatorNone
 
-		if msg.message == nil {
+		if msg.Message == nil {
 			subline = "pending"
 		} else {
-			if len(msg.message.Body) == 0 {
+			if len(msg.Message.Body) == 0 {
 				continue
 			}
-			if !msg.read {
-				i = indicatorBlue
+			if !msg.Read {
+				i = core.IndicatorBlue
 			}
-			subline = time.Unix(*msg.message.Time, 0).Format(shortTimeFormat)
+			subline = time.Unix(*msg.Message.Time, 0).Format(core.ShortTimeFormat)
 		}
-		if msg.from != 0 {
-			if i == indicatorNone && !msg.acked {
-				i = indicatorYellow
+		if msg.From != 0 {
+			if i == core.IndicatorNone && !msg.Acked {
+				i = core.IndicatorYellow
 			}
 		}
-		c.inboxUI.Add(msg.id, c.ContactName(msg.from), subline, i)
+		c.inboxUI.Add(msg.Id, c.ContactName(msg.From), subline, i)
 		c.updateInboxBackgroundColor(msg)
 	}
 	c.updateWindowTitle()
@@ -572,15 +571,15 @@ func (c *guiClient) mainUI() {
 		vboxName: "outboxVbox",
 	}
 
-	for _, msg := range c.outbox {
-		if msg.revocation {
-			c.outboxUI.Add(msg.id, "Revocation", msg.created.Format(shortTimeFormat), msg.indicator(nil))
-			c.outboxUI.SetInsensitive(msg.id)
+	for _, msg := range c.Outbox {
+		if msg.Revocation {
+			c.outboxUI.Add(msg.Id, "Revocation", msg.Created.Format(core.ShortTimeFormat), msg.Indicator(nil))
+			c.outboxUI.SetInsensitive(msg.Id)
 			continue
 		}
-		if len(msg.message.Body) > 0 {
-			subline := msg.created.Format(shortTimeFormat)
-			c.outboxUI.Add(msg.id, c.ContactName(msg.to), subline, msg.indicator(c.contacts[msg.to]))
+		if len(msg.Message.Body) > 0 {
+			subline := msg.Created.Format(core.ShortTimeFormat)
+			c.outboxUI.Add(msg.Id, c.ContactName(msg.To), subline, msg.Indicator(c.Contacts[msg.To]))
 		}
 	}
 
@@ -589,13 +588,9 @@ func (c *guiClient) mainUI() {
 		vboxName: "draftsVbox",
 	}
 
-	for _, draft := range c.drafts {
-		to := "Unknown"
-		if draft.to != 0 {
-			to = c.ContactName(draft.to)
-		}
-		subline := draft.created.Format(shortTimeFormat)
-		c.draftsUI.Add(draft.id, to, subline, indicatorNone)
+	for _, draft := range c.Drafts {
+		subline := draft.Created.Format(core.ShortTimeFormat)
+		c.draftsUI.Add(draft.Id, c.RecipientNames(draft), subline, core.IndicatorNone)
 	}
 
 	c.clientUI = &listUI{
@@ -605,9 +600,15 @@ func (c *guiClient) mainUI() {
 	const (
 		clientUIIdentity = iota + 1
 		clientUIActivity
+		clientUISearch
+		clientUITransfers
+		clientUIServers
 	)
-	c.clientUI.Add(clientUIIdentity, "Identity", "", indicatorNone)
-	c.clientUI.Add(clientUIActivity, "Activity Log", "", indicatorNone)
+	c.clientUI.Add(clientUIIdentity, "Identity", "", core.IndicatorNone)
+	c.clientUI.Add(clientUIActivity, "Activity Log", "", core.IndicatorNone)
+	c.clientUI.Add(clientUISearch, "Search", "", core.IndicatorNone)
+	c.clientUI.Add(clientUITransfers, "Transfers", "", core.IndicatorNone)
+	c.clientUI.Add(clientUIServers, "Unreachable Servers", "", core.IndicatorNone)
 
 	c.gui.Actions() <- UIState{uiStateMain}
 	c.gui.Signal()
@@ -646,6 +647,12 @@ func (c *guiClient) mainUI() {
 				nextEvent = c.identityUI()
 			case clientUIActivity:
 				nextEvent = c.logUI()
+			case clientUISearch:
+				nextEvent = c.searchUI()
+			case clientUITransfers:
+				nextEvent = c.transfersUI()
+			case clientUIServers:
+				nextEvent = c.serversUI()
 			default:
 				panic("bad clientUI event")
 			}
@@ -653,7 +660,7 @@ func (c *guiClient) mainUI() {
 		}
 		if id, ok := c.draftsUI.Event(event); ok {
 			c.draftsUI.Select(id)
-			nextEvent = c.composeUI(c.drafts[id], nil)
+			nextEvent = c.composeUI(c.Drafts[id], nil)
 		}
 
 		click, ok := event.(Click)
@@ -672,26 +679,26 @@ func (c *guiClient) mainUI() {
 // updateInboxBackgroundColor updates the background color of an inbox message
 // in the listUI. For example, if a message is marked as "retain" then the
 // background color may go from a warning indication to a normal color.
-func (c *guiClient) updateInboxBackgroundColor(msg *InboxMessage) {
+func (c *guiClient) updateInboxBackgroundColor(msg *core.InboxMessage) {
 	now := c.Now()
 
-	if !msg.retained {
-		if now.Sub(msg.receivedTime) > messageLifetime {
+	if !msg.Retained {
+		if c.InboxExpired(msg, now) {
 			// The message will be deleted imminently.
-			c.inboxUI.SetBackground(msg.id, colorImminently)
+			c.inboxUI.SetBackground(msg.Id, colorImminently)
 			return
 		}
-		if now.Sub(msg.receivedTime) > messagePreIndicationLifetime {
+		if c.InboxEraseSoon(msg, now) {
 			// The message will be deleted soon.
-			c.inboxUI.SetBackground(msg.id, colorDeleteSoon)
+			c.inboxUI.SetBackground(msg.Id, colorDeleteSoon)
 			return
 		}
 	}
 
-	c.inboxUI.SetBackground(msg.id, colorGray)
+	c.inboxUI.SetBackground(msg.Id, colorGray)
 }
 
-func (c *guiClient) errorUI(errorText string, fatal bool) {
+func (c *guiClient) ErrorUI(errorText string, fatal bool) {
 	bgColor := uint32(colorDefault)
 	if fatal {
 		bgColor = colorError
@@ -709,11 +716,11 @@ func (c *guiClient) errorUI(errorText string, fatal bool) {
 			yAlign: 0.5,
 		},
 	}
-	c.log.Printf("Fatal error: %s", errorText)
+	c.Log.Printf("Fatal error: %s", errorText)
 	c.gui.Actions() <- SetBoxContents{name: "body", child: ui}
 	c.gui.Actions() <- UIState{uiStateError}
 	c.gui.Signal()
-	if !c.testing {
+	if !c.Testing {
 		select {
 		case _, ok := <-c.gui.Events():
 			if !ok {
@@ -725,7 +732,7 @@ func (c *guiClient) errorUI(errorText string, fatal bool) {
 	}
 }
 
-func (c *guiClient) keyPromptUI(stateFile *disk.StateFile) error {
+func (c *guiClient) KeyPromptUI(stateFile *disk.StateFile) error {
 	ui := VBox{
 		widgetBase: widgetBase{padding: 40, expand: true, fill: true, name: "vbox"},
 		children: []Widget{
@@ -738,7 +745,7 @@ func (c *guiClient) keyPromptUI(stateFile *disk.StateFile) error {
 					padding: 20,
 					font:    "DejaVu Sans 14",
 				},
-				text: msgKeyPrompt,
+				text: core.MsgKeyPrompt,
 				wrap: 600,
 			},
 			HBox{
@@ -803,11 +810,11 @@ func (c *guiClient) keyPromptUI(stateFile *disk.StateFile) error {
 		c.gui.Actions() <- Sensitive{name: "pw", sensitive: false}
 		c.gui.Signal()
 
-		if err := c.loadState(stateFile, pw); err != disk.BadPasswordError {
+		if err := c.LoadState(stateFile, pw); err != disk.BadPasswordError {
 			return err
 		}
 
-		c.gui.Actions() <- SetText{name: "status", text: msgIncorrectPassword}
+		c.gui.Actions() <- SetText{name: "status", text: core.MsgIncorrectPassword}
 		c.gui.Actions() <- SetEntry{name: "pw", text: ""}
 		c.gui.Actions() <- Sensitive{name: "pw", sensitive: true}
 		c.gui.Actions() <- SetFocus{name: "pw"}
@@ -818,7 +825,7 @@ func (c *guiClient) keyPromptUI(stateFile *disk.StateFile) error {
 	return nil
 }
 
-func (c *guiClient) createPassphraseUI() (string, error) {
+func (c *guiClient) CreatePassphraseUI() (string, error) {
 	ui := Grid{
 		widgetBase: widgetBase{margin: 20},
 		rowSpacing: 5,
@@ -836,7 +843,7 @@ func (c *guiClient) createPassphraseUI() (string, error) {
 						padding: 20,
 						font:    "DejaVu Sans 14",
 					},
-					text: msgCreatePassphrase,
+					text: core.MsgCreatePassphrase,
 					wrap: 600,
 				}},
 			},
@@ -890,15 +897,15 @@ func (c *guiClient) createPassphraseUI() (string, error) {
 	panic("unreachable")
 }
 
-func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didImport bool, err error) {
-	defaultServer := msgDefaultServer
-	if c.dev {
-		defaultServer = msgDefaultDevServer
+func (c *guiClient) CreateAccountUI(stateFile *disk.StateFile, pw string) (didImport bool, err error) {
+	defaultServer := core.MsgDefaultServer
+	if c.Dev {
+		defaultServer = core.MsgDefaultDevServer
 	}
 
 	serverLabels := []string{"Default"}
-	for _, server := range knownServers {
-		serverLabels = append(serverLabels, server.description)
+	for _, server := range core.KnownServers {
+		serverLabels = append(serverLabels, server.Description)
 	}
 	serverLabels = append(serverLabels, "Custom")
 
@@ -919,7 +926,7 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 						padding: 20,
 						font:    "DejaVu Sans 14",
 					},
-					text: msgCreateAccount + " If you want to use the default server, just click 'Create'.",
+					text: core.MsgCreateAccount + " If you want to use the default server, just click 'Create'.",
 					wrap: 600,
 				}},
 			},
@@ -1032,8 +1039,8 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 			c.gui.Signal()
 			continue
 		case "import":
-			if err := c.importTombFile(stateFile, click.entries["tombkey"], tombPath); err == nil {
-				err = c.loadState(stateFile, pw)
+			if err := c.ImportTombFile(stateFile, click.entries["tombkey"], tombPath); err == nil {
+				err = c.LoadState(stateFile, pw)
 			}
 			if err != nil {
 				c.gui.Actions() <- SetText{name: "tomberror", text: err.Error()}
@@ -1042,7 +1049,7 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 				continue
 			}
 
-			c.lastErasureStorageTime = time.Now()
+			c.LastErasureStorageTime = time.Now()
 			return true, nil
 		case "servercombo":
 			selected := click.combos["servercombo"]
@@ -1054,9 +1061,9 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 			case "Custom":
 				server = ""
 			default:
-				for _, known := range knownServers {
-					if known.description == selected {
-						server = known.uri
+				for _, known := range core.KnownServers {
+					if known.Description == selected {
+						server = known.Uri
 					}
 				}
 			}
@@ -1071,7 +1078,7 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 			continue
 		}
 
-		c.server = click.entries["server"]
+		c.Server = click.entries["server"]
 
 		c.gui.Actions() <- Sensitive{name: "server", sensitive: false}
 		c.gui.Actions() <- Sensitive{name: "create", sensitive: false}
@@ -1107,7 +1114,7 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 			c.gui.Signal()
 		}
 
-		if err := c.doCreateAccount(updateMsg); err != nil {
+		if err := c.DoCreateAccount(updateMsg); err != nil {
 			c.gui.Actions() <- StopSpinner{name: "spinner"}
 			c.gui.Actions() <- UIError{err}
 			c.gui.Actions() <- SetText{name: "status", text: err.Error()}
@@ -1124,8 +1131,8 @@ func (c *guiClient) createAccountUI(stateFile *disk.StateFile, pw string) (didIm
 }
 
 func (c *guiClient) ShutdownAndSuspend() error {
-	if c.writerChan != nil {
-		c.save()
+	if c.WriterChan != nil {
+		c.Save()
 	}
 	c.Shutdown()
 	close(c.gui.Actions())
@@ -1134,73 +1141,73 @@ func (c *guiClient) ShutdownAndSuspend() error {
 }
 
 func (c *guiClient) Shutdown() {
-	for _, contact := range c.contacts {
-		if contact.pandaShutdownChan != nil {
-			close(contact.pandaShutdownChan)
+	for _, contact := range c.Contacts {
+		if contact.PandaShutdownChan != nil {
+			close(contact.PandaShutdownChan)
 		}
 	}
-	if c.testing {
-		c.pandaWaitGroup.Wait()
+	if c.Testing {
+		c.PandaWaitGroup.Wait()
 
 	ProcessPANDAUpdates:
 		for {
 			select {
-			case update := <-c.pandaChan:
-				c.processPANDAUpdate(update)
+			case update := <-c.PandaChan:
+				c.ProcessPANDAUpdate(update)
 			default:
 				break ProcessPANDAUpdates
 			}
 		}
 	}
-	if c.writerChan != nil {
-		close(c.writerChan)
-		<-c.writerDone
+	if c.WriterChan != nil {
+		close(c.WriterChan)
+		<-c.WriterDone
 	}
-	if c.fetchNowChan != nil {
-		close(c.fetchNowChan)
+	if c.FetchNowChan != nil {
+		close(c.FetchNowChan)
 	}
-	if c.stateLock != nil {
-		c.stateLock.Close()
+	if c.StateLock != nil {
+		c.StateLock.Close()
 	}
 }
 
 type InboxDetachmentUI struct {
-	msg *InboxMessage
+	msg *core.InboxMessage
 	gui GUI
 }
 
 func (i InboxDetachmentUI) IsValid(id uint64) bool {
-	_, ok := i.msg.decryptions[id]
+	_, ok := i.msg.Decryptions[id]
 	return ok
 }
 
 func (i InboxDetachmentUI) ProgressName(id uint64) string {
-	return fmt.Sprintf("detachment-progress-%d", i.msg.decryptions[id].index)
+	return fmt.Sprintf("detachment-progress-%d", i.msg.Decryptions[id].Index)
 }
 
 func (i InboxDetachmentUI) VBoxName(id uint64) string {
-	return fmt.Sprintf("detachment-vbox-%d", i.msg.decryptions[id].index)
+	return fmt.Sprintf("detachment-vbox-%d", i.msg.Decryptions[id].Index)
 }
 
 func (i InboxDetachmentUI) OnFinal(id uint64) {
 	i.gui.Actions() <- Sensitive{
-		name:      fmt.Sprintf("detachment-decrypt-%d", i.msg.decryptions[id].index),
+		name:      fmt.Sprintf("detachment-decrypt-%d", i.msg.Decryptions[id].Index),
 		sensitive: true,
 	}
 	i.gui.Actions() <- Sensitive{
-		name:      fmt.Sprintf("detachment-download-%d", i.msg.decryptions[id].index),
+		name:      fmt.Sprintf("detachment-download-%d", i.msg.Decryptions[id].Index),
 		sensitive: true,
 	}
-	delete(i.msg.decryptions, id)
+	delete(i.msg.Decryptions, id)
 }
 
 func (i InboxDetachmentUI) OnSuccess(id uint64, detachment *pond.Message_Detachment) {
 }
 
 func (c *guiClient) showInbox(id uint64) interface{} {
-	var msg *InboxMessage
-	for _, candidate := range c.inbox {
-		if candidate.id == id {
+	var msg *core.InboxMessage
+	for _, candidate := range c.Inbox {
+		if candidate.Id == id {
 			msg = candidate
 			break
 		}
@@ -1208,20 +1215,20 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 	if msg == nil {
 		panic("failed to find message in inbox")
 	}
-	isServerAnnounce := msg.from == 0
-	isPending := msg.message == nil
-	if msg.message != nil && !msg.read {
-		msg.read = true
-		i := indicatorYellow
+	isServerAnnounce := msg.From == 0
+	isPending := msg.Message == nil
+	if msg.Message != nil && !msg.Read {
+		msg.MarkRead(c.Now())
+		i := core.IndicatorYellow
 		if isServerAnnounce {
-			i = indicatorNone
+			i = core.IndicatorNone
 		}
 		c.inboxUI.SetIndicator(id, i)
 		c.updateWindowTitle()
-		c.save()
+		c.Save()
 	}
 
-	sentTimeText, eraseTimeText, msgText := msg.Strings()
+	sentTimeText, eraseTimeText, msgText := c.InboxStrings(msg)
 
 	left := Grid{
 		widgetBase: widgetBase{margin: 6, name: "lhs"},
@@ -1236,7 +1243,7 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 				// We set hExpand true here so that the
 				// attachments/detachments UI doesn't cause the
 				// first column to expand.
-				{1, 1, Label{widgetBase: widgetBase{hExpand: true}, text: c.ContactName(msg.from)}},
+				{1, 1, Label{widgetBase: widgetBase{hExpand: true}, text: c.ContactName(msg.From)}},
 			},
 			{
 				{1, 1, Label{
@@ -1254,8 +1261,42 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 			},
 		},
 	}
+	hasSenderExpiry := c.SenderExpiry(msg) != 0
+	expiryText := c.ExpiryCountdown(msg, c.Now())
+	if hasSenderExpiry {
+		left.rows = append(left.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
+				text:       "EXPIRES",
+			}},
+			{1, 1, Label{
+				widgetBase: widgetBase{name: "expires"},
+				text:       expiryText,
+				wrap:       400,
+			}},
+		})
+	}
 	lhsNextRow := len(left.rows)
 
+	// Retaining a message that the sender asked to be erased needs an
+	// explicit override, so such messages get a button that warns
+	// before retaining it.
+	var retainWidget Widget = CheckButton{
+		widgetBase: widgetBase{
+			name: "retain",
+		},
+		checked: msg.Retained,
+		text:    "Retain",
+	}
+	if hasSenderExpiry && !msg.Retained {
+		retainWidget = Button{
+			widgetBase: widgetBase{
+				name: "retain-override",
+			},
+			text: "Retain",
+		}
+	}
+
 	right := Grid{
 		widgetBase: widgetBase{margin: 6},
 		rowSpacing: 3,
@@ -1270,11 +1311,20 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 					text: "Reply",
 				}},
 			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "forward",
+						insensitive: isPending,
+					},
+					text: "Forward",
+				}},
+			},
 			{
 				{1, 1, Button{
 					widgetBase: widgetBase{
 						name:        "ack",
-						insensitive: isServerAnnounce || isPending || msg.acked,
+						insensitive: isServerAnnounce || isPending || msg.Acked,
 					},
 					text: "Ack",
 				}},
@@ -1282,20 +1332,23 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 			{
 				{1, 1, Button{
 					widgetBase: widgetBase{
-						name: "delete",
+						name:        "thread",
+						insensitive: isServerAnnounce || isPending,
 					},
-					text: "Delete Now",
+					text: "Conversation",
 				}},
 			},
 			{
-				{1, 1, CheckButton{
+				{1, 1, Button{
 					widgetBase: widgetBase{
-						name: "retain",
+						name: "delete",
 					},
-					checked: msg.retained,
-					text:    "Retain",
+					text: "Delete Now",
 				}},
 			},
+			{
+				{1, 1, retainWidget},
+			},
 		},
 	}
 
@@ -1332,11 +1385,11 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 		}
 	}
 
-	if msg.message != nil && len(msg.message.Files) != 0 {
+	if msg.Message != nil && len(msg.Message.Files) != 0 {
 		grid := Grid{widgetBase: widgetBase{marginLeft: 25}, rowSpacing: 3}
 
-		for i, attachment := range msg.message.Files {
-			filename := maybeTruncate(*attachment.Filename)
+		for i, attachment := range msg.Message.Files {
+			filename := core.MaybeTruncate(*attachment.Filename)
 			grid.rows = append(grid.rows, []GridE{
 				{1, 1, Label{
 					widgetBase: widgetBase{vAlign: AlignCenter, hAlign: AlignStart},
@@ -1360,14 +1413,14 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 		lhsNextRow++
 	}
 
-	if msg.message != nil && len(msg.message.DetachedFiles) != 0 {
+	if msg.Message != nil && len(msg.Message.DetachedFiles) != 0 {
 		grid := Grid{widgetBase: widgetBase{name: "detachment-grid", marginLeft: 25}, rowSpacing: 3}
 
-		for i, detachment := range msg.message.DetachedFiles {
-			filename := maybeTruncate(*detachment.Filename)
-			var pending *pendingDecryption
-			for _, candidate := range msg.decryptions {
-				if candidate.index == i {
+		for i, detachment := range msg.Message.DetachedFiles {
+			filename := core.MaybeTruncate(*detachment.Filename)
+			var pending *core.PendingDecryption
+			for _, candidate := range msg.Decryptions {
+				if candidate.Index == i {
 					pending = candidate
 					break
 				}
@@ -1430,17 +1483,29 @@ func (c *guiClient) showInbox(id uint64) interface{} {
 
 	detachmentUI := InboxDetachmentUI{msg, c.gui}
 
-	if msg.decryptions == nil {
-		msg.decryptions = make(map[uint64]*pendingDecryption)
+	if msg.Decryptions == nil {
+		msg.Decryptions = make(map[uint64]*core.PendingDecryption)
 	}
 
+	// overrideWarned is true once the user has been warned about
+	// retaining a message that the sender asked to be erased.
+	overrideWarned := false
+
 NextEvent:
 	for {
-		event, wanted := c.nextEvent(msg.id)
+		event, wanted := c.nextEvent(msg.Id)
 		if wanted {
 			return event
 		}
 
+		if hasSenderExpiry && !overrideWarned {
+			if text := c.ExpiryCountdown(msg, c.Now()); text != expiryText {
+				expiryText = text
+				c.gui.Actions() <- SetText{name: "expires", text: expiryText}
+				c.gui.Signal()
+			}
+		}
+
 		// These types are returned by the UI from a file dialog and
 		// serve to identify the actions that should be taken with the
 		// resulting filename.
@@ -1459,10 +1524,10 @@ NextEvent:
 			switch i := open.arg.(type) {
 			case attachmentSaveIndex:
 				// Save an attachment to disk.
-				ioutil.WriteFile(open.path, msg.message.Files[i].Contents, 0600)
+				ioutil.WriteFile(open.path, msg.Message.Files[i].Contents, 0600)
 			case detachmentSaveIndex:
 				// Save a detachment key to disk.
-				bytes, err := proto.Marshal(msg.message.DetachedFiles[i])
+				bytes, err := proto.Marshal(msg.Message.DetachedFiles[i])
 				if err != nil {
 					panic(err)
 				}
@@ -1483,8 +1548,8 @@ NextEvent:
 				// Decrypt a local file with a detachment key,
 				// after the second save dialog - which prompts
 				// for where to write the new key.
-				for _, decryption := range msg.decryptions {
-					if decryption.index == i.index {
+				for _, decryption := range msg.Decryptions {
+					if decryption.Index == i.index {
 						continue NextEvent
 					}
 				}
@@ -1501,16 +1566,16 @@ NextEvent:
 					pos:  i.index*2 + 1,
 					row:  []GridE{{4, 1, widgetForDetachmentProcess(i.index)}},
 				}
-				id := c.randId()
-				msg.decryptions[id] = &pendingDecryption{
-					index:  i.index,
-					cancel: c.startDecryption(id, open.path, i.inPath, msg.message.DetachedFiles[i.index]),
+				id := c.RandId()
+				msg.Decryptions[id] = &core.PendingDecryption{
+					Index:  i.index,
+					Cancel: c.StartDecryption(id, open.path, i.inPath, msg.Message.DetachedFiles[i.index]),
 				}
 				c.gui.Signal()
 			case detachmentDownloadIndex:
 				// Download a detachment.
-				for _, decryption := range msg.decryptions {
-					if decryption.index == int(i) {
+				for _, decryption := range msg.Decryptions {
+					if decryption.Index == int(i) {
 						continue NextEvent
 					}
 				}
@@ -1527,10 +1592,10 @@ NextEvent:
 					pos:  int(i)*2 + 1,
 					row:  []GridE{{4, 1, widgetForDetachmentProcess(int(i))}},
 				}
-				id := c.randId()
-				msg.decryptions[id] = &pendingDecryption{
-					index:  int(i),
-					cancel: c.startDownload(id, open.path, msg.message.DetachedFiles[i]),
+				id := c.RandId()
+				msg.Decryptions[id] = &core.PendingDecryption{
+					Index:  int(i),
+					Cancel: c.StartDownload(id, open.path, msg.Message.DetachedFiles[i]),
 				}
 				c.gui.Signal()
 			default:
@@ -1553,7 +1618,7 @@ NextEvent:
 			c.gui.Actions() <- FileOpen{
 				save:     true,
 				title:    "Save Attachment",
-				filename: msg.message.Files[i].GetFilename(),
+				filename: msg.Message.Files[i].GetFilename(),
 				arg:      attachmentSaveIndex(i),
 			}
 			c.gui.Signal()
@@ -1563,7 +1628,7 @@ NextEvent:
 			c.gui.Actions() <- FileOpen{
 				save:     true,
 				title:    "Save Key",
-				filename: msg.message.DetachedFiles[i].GetFilename() + ".key",
+				filename: msg.Message.DetachedFiles[i].GetFilename() + ".key",
 				arg:      detachmentSaveIndex(i),
 			}
 			c.gui.Signal()
@@ -1581,7 +1646,7 @@ NextEvent:
 			c.gui.Actions() <- FileOpen{
 				save:     true,
 				title:    "Save to",
-				filename: msg.message.DetachedFiles[i].GetFilename(),
+				filename: msg.Message.DetachedFiles[i].GetFilename(),
 				arg:      detachmentDownloadIndex(i),
 			}
 			c.gui.Signal()
@@ -1589,29 +1654,57 @@ NextEvent:
 		case click.name == "ack":
 			c.gui.Actions() <- Sensitive{name: "ack", sensitive: false}
 			c.gui.Signal()
-			msg.acked = true
-			c.sendAck(msg)
-			c.inboxUI.SetIndicator(msg.id, indicatorNone)
+			msg.Acked = true
+			c.SendAck(msg)
+			c.inboxUI.SetIndicator(msg.Id, core.IndicatorNone)
 			c.gui.Actions() <- UIState{uiStateInbox}
 			c.gui.Signal()
 		case click.name == "reply":
 			c.inboxUI.Deselect()
 			return c.composeUI(nil, msg)
+		case click.name == "forward":
+			c.inboxUI.Deselect()
+			draft := c.ForwardDraft(msg)
+			c.draftsUI.Add(draft.Id, "Unknown", draft.Created.Format(core.ShortTimeFormat), core.IndicatorNone)
+			c.draftsUI.Select(draft.Id)
+			c.Save()
+			return c.composeUI(draft, nil)
+		case click.name == "thread":
+			return c.threadUI(c.ThreadContaining(msg, nil))
 		case click.name == "delete":
-			c.inboxUI.Remove(msg.id)
-			c.deleteInboxMsg(msg.id)
+			c.inboxUI.Remove(msg.Id)
+			c.DeleteInboxMsg(msg.Id)
 			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
 			c.gui.Actions() <- UIState{uiStateMain}
 			c.gui.Signal()
-			c.save()
+			c.Save()
 			return nil
+		case click.name == "retain-override":
+			if !overrideWarned {
+				overrideWarned = true
+				c.gui.Actions() <- SetText{name: "expires", text: msg.ExpiryWarning()}
+				c.gui.Actions() <- SetButtonText{name: "retain-override", text: "Retain Anyway"}
+				c.gui.Actions() <- UIState{uiStateInbox}
+				c.gui.Signal()
+				continue
+			}
+			msg.Retained = true
+			overrideWarned = false
+			expiryText = c.ExpiryCountdown(msg, c.Now())
+			c.updateInboxBackgroundColor(msg)
+			c.Save()
+			c.gui.Actions() <- SetText{name: "expires", text: expiryText}
+			c.gui.Actions() <- SetButtonText{name: "retain-override", text: "Retained"}
+			c.gui.Actions() <- Sensitive{name: "retain-override", sensitive: false}
+			c.gui.Actions() <- UIState{uiStateInbox}
+			c.gui.Signal()
 		case click.name == "retain":
-			msg.retained = click.checks["retain"]
-			if !msg.retained {
-				msg.exposureTime = c.Now()
+			msg.Retained = click.checks["retain"]
+			if !msg.Retained {
+				msg.ExposureTime = c.Now()
 			}
 			c.updateInboxBackgroundColor(msg)
-			c.save()
+			c.Save()
 			c.gui.Actions() <- UIState{uiStateInbox}
 			c.gui.Signal()
 		}
@@ -1621,9 +1714,9 @@ NextEvent:
 }
 
 func (c *guiClient) showOutbox(id uint64) interface{} {
-	var msg *queuedMessage
-	for _, candidate := range c.outbox {
-		if candidate.id == id {
+	var msg *core.QueuedMessage
+	for _, candidate := range c.Outbox {
+		if candidate.Id == id {
 			msg = candidate
 			break
 		}
@@ -1632,22 +1725,17 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 		panic("failed to find message in outbox")
 	}
 
-	contact := c.contacts[msg.to]
-	var sentTime string
-	if contact.revokedUs {
-		sentTime = "(never - contact has revoked us)"
-	} else {
-		sentTime = formatTime(msg.sent)
-	}
-	eraseTime := formatTime(msg.created.Add(messageLifetime))
+	contact := c.Contacts[msg.To]
+	sentTime := c.SentTimeString(msg)
+	eraseTime := c.OutboxEraseTimeString(msg)
 
-	canAbort := !contact.revokedUs && msg.sent.IsZero()
+	canAbort := !contact.RevokedUs && msg.Sent.IsZero()
 	if canAbort {
-		c.queueMutex.Lock()
-		if msg.sending {
+		c.QueueMutex.Lock()
+		if msg.TransmissionStarted() {
 			canAbort = false
 		}
-		c.queueMutex.Unlock()
+		c.QueueMutex.Unlock()
 	}
 
 	left := Grid{
@@ -1660,7 +1748,7 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 					widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignCenter},
 					text:       "TO",
 				}},
-				{1, 1, Label{text: contact.name}},
+				{1, 1, Label{text: contact.Name}},
 			},
 			{
 				{1, 1, Label{
@@ -1668,7 +1756,7 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 					text:       "CREATED",
 				}},
 				{1, 1, Label{
-					text: time.Unix(*msg.message.Time, 0).Format(time.RFC1123),
+					text: time.Unix(*msg.Message.Time, 0).Format(time.RFC1123),
 				}},
 			},
 			{
@@ -1688,7 +1776,7 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 				}},
 				{1, 1, Label{
 					widgetBase: widgetBase{name: "acked"},
-					text:       formatTime(msg.acked),
+					text:       core.FormatTime(msg.Acked),
 				}},
 			},
 			{
@@ -1703,6 +1791,23 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 		},
 	}
 
+	if msg.FanoutId != 0 {
+		var statuses []string
+		for _, m := range c.FanoutCopies(msg) {
+			statuses = append(statuses, c.ContactName(m.To)+": "+c.DeliveryStatus(m))
+		}
+		left.rows = append(left.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, hAlign: AlignEnd, vAlign: AlignStart},
+				text:       "RECIPIENTS",
+			}},
+			{1, 1, Label{
+				widgetBase: widgetBase{name: "recipients"},
+				text:       strings.Join(statuses, "\n"),
+			}},
+		})
+	}
+
 	right := Grid{
 		widgetBase: widgetBase{margin: 6},
 		rowSpacing: 3,
@@ -1726,13 +1831,22 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 					text: "Delete",
 				}},
 			},
+			{
+				{1, 1, Button{
+					widgetBase: widgetBase{
+						name:        "thread",
+						insensitive: msg.Revocation,
+					},
+					text: "Conversation",
+				}},
+			},
 		},
 	}
 
 	main := TextView{
 		widgetBase: widgetBase{vExpand: true, hExpand: true, name: "body"},
 		editable:   false,
-		text:       string(msg.message.Body),
+		text:       string(msg.Message.Body),
 		wrap:       true,
 	}
 
@@ -1740,22 +1854,18 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 	c.gui.Actions() <- UIState{uiStateOutbox}
 	c.gui.Signal()
 
-	haveSentTime := !msg.sent.IsZero()
-	haveAckTime := !msg.acked.IsZero()
+	haveSentTime := !msg.Sent.IsZero()
+	haveAckTime := !msg.Acked.IsZero()
 
 	for {
-		event, wanted := c.nextEvent(msg.id)
+		event, wanted := c.nextEvent(msg.Id)
 		if wanted {
 			return event
 		}
 
 		if click, ok := event.(Click); ok && click.name == "abort" {
-			c.queueMutex.Lock()
-			indexOfMessage := c.indexOfQueuedMessage(msg)
-			if indexOfMessage == -1 || msg.sending {
+			if !c.AbortMessage(msg) {
 				// Sorry - too late. Can't abort now.
-				c.queueMutex.Unlock()
-
 				canAbort = false
 				c.gui.Actions() <- Sensitive{name: "abort", sensitive: canAbort}
 				c.gui.Actions() <- Sensitive{name: "delete", sensitive: !canAbort}
@@ -1763,32 +1873,32 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 				continue
 			}
 
-			c.removeQueuedMessage(indexOfMessage)
-			c.queueMutex.Unlock()
-
-			c.deleteOutboxMsg(msg.id)
-			c.outboxUI.Remove(msg.id)
+			c.DeleteOutboxMsg(msg.Id)
+			c.outboxUI.Remove(msg.Id)
 
-			draft := c.outboxToDraft(msg)
-			c.draftsUI.Add(draft.id, c.ContactName(msg.to), draft.created.Format(shortTimeFormat), indicatorNone)
-			c.draftsUI.Select(draft.id)
-			c.drafts[draft.id] = draft
-			c.save()
+			draft := c.OutboxToDraft(msg)
+			c.draftsUI.Add(draft.Id, c.ContactName(msg.To), draft.Created.Format(core.ShortTimeFormat), core.IndicatorNone)
+			c.draftsUI.Select(draft.Id)
+			c.Save()
 			return c.composeUI(draft, nil)
 		}
 
+		if click, ok := event.(Click); ok && click.name == "thread" {
+			return c.threadUI(c.ThreadContaining(nil, msg))
+		}
+
 		if click, ok := event.(Click); ok && click.name == "delete" {
-			c.deleteOutboxMsg(msg.id)
+			c.DeleteOutboxMsg(msg.Id)
 			// Also find and delete any empty acks for this message.
-			for _, inboxMsg := range c.inbox {
-				if inboxMsg.message != nil && len(inboxMsg.message.Body) == 0 && inboxMsg.message.InReplyTo != nil && *inboxMsg.message.InReplyTo == msg.id {
-					c.deleteInboxMsg(inboxMsg.id)
+			for _, inboxMsg := range c.Inbox {
+				if inboxMsg.Message != nil && len(inboxMsg.Message.Body) == 0 && inboxMsg.Message.InReplyTo != nil && *inboxMsg.Message.InReplyTo == msg.Id {
+					c.DeleteInboxMsg(inboxMsg.Id)
 					break
 				}
 			}
-			c.save()
-			if msg.revocation || len(msg.message.Body) > 0 {
-				c.outboxUI.Remove(msg.id)
+			c.Save()
+			if msg.Revocation || len(msg.Message.Body) > 0 {
+				c.outboxUI.Remove(msg.Id)
 			}
 			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
 			c.gui.Actions() <- UIState{uiStateMain}
@@ -1796,22 +1906,22 @@ func (c *guiClient) showOutbox(id uint64) interface{} {
 			return nil
 		}
 
-		if !haveSentTime && !msg.sent.IsZero() {
-			c.gui.Actions() <- SetText{name: "sent", text: formatTime(msg.sent)}
+		if !haveSentTime && !msg.Sent.IsZero() {
+			c.gui.Actions() <- SetText{name: "sent", text: core.FormatTime(msg.Sent)}
 			c.gui.Signal()
 		}
-		if !haveAckTime && !msg.acked.IsZero() {
-			c.gui.Actions() <- SetText{name: "acked", text: formatTime(msg.acked)}
+		if !haveAckTime && !msg.Acked.IsZero() {
+			c.gui.Actions() <- SetText{name: "acked", text: core.FormatTime(msg.Acked)}
 			c.gui.Signal()
 		}
 
 		canAbortChanged := false
-		c.queueMutex.Lock()
-		if c := !contact.revokedUs && msg.sent.IsZero() && !msg.sending; c != canAbort {
+		c.QueueMutex.Lock()
+		if c := !contact.RevokedUs && msg.Sent.IsZero() && !msg.TransmissionStarted(); c != canAbort {
 			canAbort = c
 			canAbortChanged = true
 		}
-		c.queueMutex.Unlock()
+		c.QueueMutex.Unlock()
 
 		if canAbortChanged {
 			c.gui.Actions() <- Sensitive{name: "abort", sensitive: canAbort}
@@ -1894,13 +2004,304 @@ func nameValuesLHS(entries []nvEntry) Grid {
 	return grid
 }
 
+// threadUI shows the messages of a conversation thread, both sent and
+// received, in the order in which they were sent and received.
+func (c *guiClient) threadUI(t core.Thread) interface{} {
+	left := nameValuesLHS([]nvEntry{
+		{"WITH", c.ContactName(t.Contact())},
+		{"MESSAGES", fmt.Sprintf("%d", len(t))},
+		{"STARTED", core.FormatTime(t[0].Time())},
+	})
+
+	main := TextView{
+		widgetBase: widgetBase{vExpand: true, hExpand: true, name: "thread"},
+		editable:   false,
+		text:       c.ThreadTranscript(t),
+		wrap:       true,
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane("CONVERSATION", left, nil, main)}
+	c.gui.Actions() <- UIState{uiStateThread}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+	}
+}
+
+// searchUI lets the user search the inbox, outbox and drafts. Clicking on a
+// result opens the message.
+func (c *guiClient) searchUI() interface{} {
+	var query string
+	var hits []core.SearchHit
+
+	for {
+		left := Grid{
+			widgetBase: widgetBase{margin: 6},
+			colSpacing: 3,
+			rows: [][]GridE{
+				{
+					{1, 1, Entry{
+						widgetBase: widgetBase{name: "search-query"},
+						width:      40,
+						text:       query,
+					}},
+					{1, 1, Button{
+						widgetBase: widgetBase{name: "search"},
+						text:       "Search",
+					}},
+				},
+			},
+		}
+
+		results := Grid{
+			widgetBase: widgetBase{margin: 6},
+			rowSpacing: 3,
+			colSpacing: 10,
+		}
+		terms := core.SearchTerms(query)
+		for i, hit := range hits {
+			var title string
+			switch {
+			case hit.Inbox != nil:
+				title = "From " + c.ContactName(hit.Inbox.From)
+			case hit.Outbox != nil:
+				title = "To " + c.ContactName(hit.Outbox.To)
+			default:
+				title = "Draft to " + c.RecipientNames(hit.Draft)
+			}
+			results.rows = append(results.rows, []GridE{
+				{1, 1, Button{
+					widgetBase: widgetBase{name: fmt.Sprintf("search-result-%d", i)},
+					text:       title,
+				}},
+				{1, 1, Label{
+					text: core.FormatTime(hit.Time()),
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{name: fmt.Sprintf("search-snippet-%d", i), hExpand: true},
+					text:       hit.Snippet(terms),
+				}},
+			})
+		}
+		if len(terms) > 0 && len(hits) == 0 {
+			results.rows = append(results.rows, []GridE{
+				{1, 1, Label{
+					widgetBase: widgetBase{name: "search-snippet-0"},
+					text:       "No messages found",
+				}},
+			})
+		}
+
+		c.gui.Actions() <- SetChild{name: "right", child: rightPane("SEARCH", left, nil, results)}
+		c.gui.Actions() <- UIState{uiStateSearch}
+		c.gui.Signal()
+
+	Events:
+		for {
+			event, wanted := c.nextEvent(0)
+			if wanted {
+				return event
+			}
+
+			click, ok := event.(Click)
+			if !ok {
+				continue
+			}
+
+			switch {
+			case click.name == "search" || click.name == "search-query":
+				query = click.entries["search-query"]
+				hits = c.Search(query)
+				break Events
+			case strings.HasPrefix(click.name, "search-result-"):
+				i, err := strconv.Atoi(click.name[len("search-result-"):])
+				if err != nil || i < 0 || i >= len(hits) {
+					continue
+				}
+				return c.openSearchHit(hits[i])
+			}
+		}
+	}
+}
+
+// openSearchHit shows the message or draft of a search result, if it still
+// exists.
+func (c *guiClient) openSearchHit(hit core.SearchHit) interface{} {
+	c.DeselectAll()
+	switch {
+	case hit.Inbox != nil:
+		for _, msg := range c.Inbox {
+			if msg == hit.Inbox {
+				c.inboxUI.Select(msg.Id)
+				return c.showInbox(msg.Id)
+			}
+		}
+	case hit.Outbox != nil:
+		for _, msg := range c.Outbox {
+			if msg == hit.Outbox {
+				c.outboxUI.Select(msg.Id)
+				return c.showOutbox(msg.Id)
+			}
+		}
+	default:
+		if draft, ok := c.Drafts[hit.Draft.Id]; ok {
+			c.draftsUI.Select(draft.Id)
+			return c.composeUI(draft, nil)
+		}
+	}
+	return c.searchUI()
+}
+
+// transferFraction returns the fraction of t that has been completed.
+func transferFraction(t *core.Transfer) float64 {
+	if t.Total <= 0 {
+		return 0
+	}
+	f := float64(t.Done) / float64(t.Total)
+	if f > 1 {
+		f = 1
+	}
+	return f
+}
+
+// transfersUI lists the uploads and downloads of detachments that are in
+// progress and allows them to be cancelled.
+func (c *guiClient) transfersUI() interface{} {
+	const cancelPrefix = "transfer-cancel-"
+
+	for {
+		transfers := Grid{
+			widgetBase: widgetBase{margin: 6},
+			rowSpacing: 3,
+			colSpacing: 10,
+		}
+		for _, t := range c.Transfers {
+			transfers.rows = append(transfers.rows, []GridE{
+				{1, 1, Label{
+					text: t.Direction(),
+				}},
+				{1, 1, Label{
+					widgetBase: widgetBase{hExpand: true},
+					text:       t.Name(),
+				}},
+				{1, 1, Progress{
+					widgetBase: widgetBase{name: fmt.Sprintf("transfer-progress-%x", t.Id)},
+				}},
+				{1, 1, Button{
+					widgetBase: widgetBase{name: fmt.Sprintf("%s%x", cancelPrefix, t.Id)},
+					text:       "Cancel",
+				}},
+			})
+		}
+		if len(c.Transfers) == 0 {
+			transfers.rows = append(transfers.rows, []GridE{
+				{1, 1, Label{
+					text: "No uploads or downloads are in progress",
+				}},
+			})
+		}
+
+		c.gui.Actions() <- SetChild{name: "right", child: rightPane("TRANSFERS", nil, nil, transfers)}
+		for _, t := range c.Transfers {
+			c.gui.Actions() <- SetProgress{
+				name:     fmt.Sprintf("transfer-progress-%x", t.Id),
+				s:        t.Status,
+				fraction: transferFraction(t),
+			}
+		}
+		c.gui.Actions() <- UIState{uiStateTransfers}
+		c.gui.Signal()
+
+	Events:
+		for {
+			event, wanted := c.nextEvent(0)
+			if wanted {
+				return event
+			}
+
+			switch e := event.(type) {
+			case core.DetachmentProgress:
+				if t := c.FindTransfer(e.Id); t != nil {
+					c.gui.Actions() <- SetProgress{
+						name:     fmt.Sprintf("transfer-progress-%x", t.Id),
+						s:        t.Status,
+						fraction: transferFraction(t),
+					}
+					c.gui.Signal()
+				}
+			case core.DetachmentComplete, core.DetachmentError:
+				break Events
+			case Click:
+				if !strings.HasPrefix(e.name, cancelPrefix) {
+					continue
+				}
+				id, err := strconv.ParseUint(e.name[len(cancelPrefix):], 16, 64)
+				if err != nil {
+					panic(e.name)
+				}
+				if t := c.FindTransfer(id); t != nil {
+					c.CancelTransfer(t)
+				}
+				break Events
+			}
+		}
+	}
+}
+
+func (c *guiClient) serversUI() interface{} {
+	servers := Grid{
+		widgetBase: widgetBase{margin: 6},
+		rowSpacing: 3,
+		colSpacing: 10,
+	}
+	failures := c.UnreachableServers()
+	for _, f := range failures {
+		servers.rows = append(servers.rows, []GridE{
+			{1, 1, Label{
+				widgetBase: widgetBase{hExpand: true},
+				text:       f.Server,
+			}},
+			{1, 1, Label{
+				text: f.Category.String(),
+			}},
+		}, []GridE{
+			{2, 1, Label{
+				text: fmt.Sprintf("%d failures since %s. Next attempt after %s. %s", f.Count, core.FormatTime(f.First), core.FormatTime(f.Retry), f.Err),
+				wrap: 600,
+			}},
+		})
+	}
+	if len(failures) == 0 {
+		servers.rows = append(servers.rows, []GridE{
+			{1, 1, Label{
+				text: "Deliveries aren't failing to any servers",
+			}},
+		})
+	}
+
+	c.gui.Actions() <- SetChild{name: "right", child: rightPane("UNREACHABLE SERVERS", nil, nil, servers)}
+	c.gui.Actions() <- UIState{uiStateServers}
+	c.gui.Signal()
+
+	for {
+		event, wanted := c.nextEvent(0)
+		if wanted {
+			return event
+		}
+	}
+}
+
 func (c *guiClient) identityUI() interface{} {
 	entries := nameValuesLHS([]nvEntry{
-		{"SERVER", c.server},
-		{"PUBLIC IDENTITY", fmt.Sprintf("%x", c.identityPublic[:])},
-		{"PUBLIC KEY", fmt.Sprintf("%x", c.pub[:])},
-		{"STATE FILE", c.stateFilename},
-		{"GROUP GENERATION", fmt.Sprintf("%d", c.generation)},
+		{"SERVER", c.Server},
+		{"PUBLIC IDENTITY", fmt.Sprintf("%x", c.IdentityPublic[:])},
+		{"PUBLIC KEY", fmt.Sprintf("%x", c.Pub[:])},
+		{"STATE FILE", c.StateFilename},
+		{"GROUP GENERATION", fmt.Sprintf("%d", c.Generation)},
 	})
 
 	left := Grid{
@@ -2024,7 +2425,7 @@ func (c *guiClient) identityUI() interface{} {
 				c.gui.Signal()
 			}
 
-			key, ok := c.entomb(tombPath, f, log)
+			key, ok := c.Entomb(tombPath, f, log)
 			if ok {
 				log("\nThe process has completed successfully. You must write down the ephemeral key now. You can close this window when done.\n")
 				c.gui.Actions() <- UIInfo{fmt.Sprintf("%x", key[:])}
@@ -2058,52 +2459,56 @@ func allBytesZero(bs []byte) bool {
 }
 
 func (c *guiClient) showContact(id uint64) interface{} {
-	contact := c.contacts[id]
-	if contact.isPending && len(contact.pandaKeyExchange) == 0 && len(contact.pandaResult) == 0 {
+	contact := c.Contacts[id]
+	if contact.IsPending && len(contact.PandaKeyExchange) == 0 && len(contact.PandaResult) == 0 {
 		return c.newContactUI(contact)
 	}
-	c.contactsUI.SetIndicator(id, indicatorNone)
+	c.contactsUI.SetIndicator(id, core.IndicatorNone)
 
 	entries := []nvEntry{
 		{"NAME", ""},
-		{"SERVER", contact.theirServer},
-		{"PUBLIC IDENTITY", fmt.Sprintf("%x", contact.theirIdentityPublic[:])},
-		{"PUBLIC KEY", fmt.Sprintf("%x", contact.theirPub[:])},
+		{"SERVER", contact.TheirServer},
+		{"PUBLIC IDENTITY", fmt.Sprintf("%x", contact.TheirIdentityPublic[:])},
+		{"PUBLIC KEY", fmt.Sprintf("%x", contact.TheirPub[:])},
 	}
-	if !allBytesZero(contact.theirLastDHPublic[:]) {
+	if !allBytesZero(contact.TheirLastDHPublic[:]) {
 		entries = append(entries,
-			nvEntry{"LAST DH", fmt.Sprintf("%x", contact.theirLastDHPublic[:])},
-			nvEntry{"CURRENT DH", fmt.Sprintf("%x", contact.theirCurrentDHPublic[:])})
+			nvEntry{"LAST DH", fmt.Sprintf("%x", contact.TheirLastDHPublic[:])},
+			nvEntry{"CURRENT DH", fmt.Sprintf("%x", contact.TheirCurrentDHPublic[:])})
 	}
 	entries = append(entries,
-		nvEntry{"GROUP GENERATION", fmt.Sprintf("%d", contact.generation)},
-		nvEntry{"CLIENT VERSION", fmt.Sprintf("%d", contact.supportedVersion)})
+		nvEntry{"GROUP GENERATION", fmt.Sprintf("%d", contact.Generation)},
+		nvEntry{"CLIENT VERSION", fmt.Sprintf("%d", contact.SupportedVersion)})
+	retentionRow := len(entries)
+	entries = append(entries,
+		nvEntry{"INBOX RETENTION", ""},
+		nvEntry{"OUTBOX RETENTION", ""})
 
 	var pandaMessage string
 
-	if len(contact.pandaResult) > 0 {
-		pandaMessage = contact.pandaResult
-	} else if len(contact.pandaKeyExchange) > 0 {
+	if len(contact.PandaResult) > 0 {
+		pandaMessage = contact.PandaResult
+	} else if len(contact.PandaKeyExchange) > 0 {
 		pandaMessage = "in progress"
 	}
 
 	if len(pandaMessage) > 0 {
 		entries = append(entries, nvEntry{"PANDA KEY EXCHANGE", pandaMessage})
-	} else if len(contact.kxsBytes) > 0 {
+	} else if len(contact.KxsBytes) > 0 {
 		var out bytes.Buffer
-		pem.Encode(&out, &pem.Block{Bytes: contact.kxsBytes, Type: keyExchangePEM})
+		pem.Encode(&out, &pem.Block{Bytes: contact.KxsBytes, Type: core.KeyExchangePEM})
 		entries = append(entries, nvEntry{"KEY EXCHANGE", string(out.Bytes())})
 	}
 
-	if len(contact.events) > 0 {
+	if len(contact.Events) > 0 {
 		eventsText := ""
-		for i, event := range contact.events {
+		for i, event := range contact.Events {
 			if i > 0 {
 				eventsText += "\n"
 			}
-			eventsText += event.t.Format(logTimeFormat)
+			eventsText += event.T.Format(core.LogTimeFormat)
 			eventsText += ": "
-			eventsText += event.msg
+			eventsText += event.Msg
 		}
 		entries = append(entries, nvEntry{"EVENTS", eventsText})
 	}
@@ -2133,7 +2538,7 @@ func (c *guiClient) showContact(id uint64) interface{} {
 				widgetBase: widgetBase{
 					name: "contactname",
 				},
-				text:           contact.name,
+				text:           contact.Name,
 				updateOnChange: true,
 			},
 			Button{
@@ -2146,6 +2551,20 @@ func (c *guiClient) showContact(id uint64) interface{} {
 		},
 	}
 
+	// Switch the retention labels with combos.
+	inboxLabels, inboxSelected := core.RetentionLabels(core.InboxRetentionChoices, contact.InboxRetention, false)
+	left.rows[retentionRow][1].widget = Combo{
+		widgetBase:  widgetBase{name: "inbox-retention", hAlign: AlignStart},
+		labels:      inboxLabels,
+		preSelected: inboxSelected,
+	}
+	outboxLabels, outboxSelected := core.RetentionLabels(core.OutboxRetentionChoices, contact.OutboxRetention, true)
+	left.rows[retentionRow+1][1].widget = Combo{
+		widgetBase:  widgetBase{name: "outbox-retention", hAlign: AlignStart},
+		labels:      outboxLabels,
+		preSelected: outboxSelected,
+	}
+
 	c.gui.Actions() <- SetChild{name: "right", child: rightPane("CONTACT", left, right, nil)}
 	c.gui.Actions() <- UIState{uiStateShowContact}
 	c.gui.Signal()
@@ -2160,7 +2579,7 @@ func (c *guiClient) showContact(id uint64) interface{} {
 
 		if update, ok := event.(Update); ok && update.name == "contactname" {
 			candidate := update.text
-			_, alreadyExists := c.contactByName(candidate)
+			_, alreadyExists := c.ContactByName(candidate)
 			c.gui.Actions() <- Sensitive{name: "changebutton", sensitive: len(candidate) > 0 && !alreadyExists}
 			c.gui.Signal()
 			continue
@@ -2176,11 +2595,11 @@ func (c *guiClient) showContact(id uint64) interface{} {
 			if deleteArmed {
 				c.gui.Actions() <- Sensitive{name: "delete", sensitive: false}
 				c.gui.Signal()
-				c.deleteContact(contact)
+				c.DeleteContact(contact)
 				c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
 				c.gui.Actions() <- UIState{uiStateRevocationComplete}
 				c.gui.Signal()
-				c.save()
+				c.Save()
 				return nil
 			} else {
 				deleteArmed = true
@@ -2188,50 +2607,67 @@ func (c *guiClient) showContact(id uint64) interface{} {
 				c.gui.Signal()
 			}
 
+		case "inbox-retention":
+			contact.InboxRetention = core.RetentionForLabel(core.InboxRetentionChoices, click.combos["inbox-retention"], contact.InboxRetention, false)
+			for _, msg := range c.Inbox {
+				if msg.From == contact.Id {
+					c.updateInboxBackgroundColor(msg)
+				}
+			}
+			c.gui.Actions() <- UIState{uiStateShowContact}
+			c.gui.Signal()
+			c.Save()
+
+		case "outbox-retention":
+			contact.OutboxRetention = core.RetentionForLabel(core.OutboxRetentionChoices, click.combos["outbox-retention"], contact.OutboxRetention, true)
+			c.gui.Actions() <- UIState{uiStateShowContact}
+			c.gui.Signal()
+			c.Save()
+
 		case "changebutton":
 			newName := click.entries["contactname"]
-			_, alreadyExists := c.contactByName(newName)
+			_, alreadyExists := c.ContactByName(newName)
 			if len(newName) == 0 || alreadyExists {
 				continue
 			}
 
-			contact.name = newName
-			for _, msg := range c.inbox {
-				if msg.from == contact.id {
-					c.inboxUI.SetLine(msg.id, newName)
+			contact.Name = newName
+			for _, msg := range c.Inbox {
+				if msg.From == contact.Id {
+					c.inboxUI.SetLine(msg.Id, newName)
 				}
 			}
-			for _, msg := range c.outbox {
-				if msg.to == contact.id {
-					c.outboxUI.SetLine(msg.id, newName)
+			for _, msg := range c.Outbox {
+				if msg.To == contact.Id {
+					c.outboxUI.SetLine(msg.Id, newName)
 				}
 			}
-			for _, msg := range c.drafts {
-				if msg.to == contact.id {
-					c.draftsUI.SetLine(msg.id, newName)
+			for _, msg := range c.Drafts {
+				if msg.To == contact.Id {
+					c.draftsUI.SetLine(msg.Id, newName)
 				}
 			}
-			for _, msg := range c.drafts {
-				if msg.to == contact.id {
-					c.draftsUI.SetLine(msg.id, newName)
+			for _, msg := range c.Drafts {
+				if msg.To == contact.Id {
+					c.draftsUI.SetLine(msg.Id, newName)
 				}
 			}
-			c.contactsUI.SetLine(contact.id, newName)
+			c.contactsUI.SetLine(contact.Id, newName)
 			c.gui.Actions() <- UIState{uiStateContactNameChanged}
 			c.gui.Signal()
 
-			c.save()
+			c.Save()
 		}
 	}
 
 	panic("unreachable")
 }
 
-func (c *guiClient) newContactUI(contact *Contact) interface{} {
+func (c *guiClient) newContactUI(contact *core.Contact) interface{} {
 	var name string
 	existing := contact != nil
 	if existing {
-		name = contact.name
+		name = contact.Name
 	}
 
 	grid := Grid{
@@ -2345,8 +2781,8 @@ Manual keying (not generally recommended) involves exchanging key material with
 		}
 
 		nameIsUnique := true
-		for _, contact := range c.contacts {
-			if contact.name == name {
+		for _, contact := range c.Contacts {
+			if contact.Name == name {
 				const errText = "A contact by that name already exists!"
 				c.gui.Actions() <- SetText{name: "error1", text: errText}
 				c.gui.Actions() <- UIError{errors.New(errText)}
@@ -2361,10 +2797,10 @@ Manual keying (not generally recommended) involves exchanging key material with
 		}
 	}
 
-	contact = &Contact{
-		name:      name,
-		isPending: true,
-		id:        c.randId(),
+	contact = &core.Contact{
+		Name:      name,
+		IsPending: true,
+		Id:        c.RandId(),
 	}
 
 	c.gui.Actions() <- SetText{name: "error1", text: ""}
@@ -2388,15 +2824,15 @@ Manual keying (not generally recommended) involves exchanging key material with
 			continue
 		}
 
-		var nextFunc func(*Contact, bool, int) interface{}
+		var nextFunc func(*core.Contact, bool, int) interface{}
 
 		switch click.name {
 		case "manual":
-			nextFunc = func(contact *Contact, existing bool, nextRow int) interface{} {
+			nextFunc = func(contact *core.Contact, existing bool, nextRow int) interface{} {
 				return c.newContactManual(contact, existing, nextRow)
 			}
 		case "shared":
-			nextFunc = func(contact *Contact, existing bool, nextRow int) interface{} {
+			nextFunc = func(contact *core.Contact, existing bool, nextRow int) interface{} {
 				return c.newContactPanda(contact, existing, nextRow)
 			}
 		default:
@@ -2411,18 +2847,18 @@ Manual keying (not generally recommended) involves exchanging key material with
 	panic("unreachable")
 }
 
-func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow int) interface{} {
+func (c *guiClient) newContactManual(contact *core.Contact, existing bool, nextRow int) interface{} {
 	if !existing {
-		c.newKeyExchange(contact)
-		c.contacts[contact.id] = contact
-		c.save()
+		c.NewKeyExchange(contact)
+		c.Contacts[contact.Id] = contact
+		c.Save()
 
-		c.contactsUI.Add(contact.id, contact.name, "pending", indicatorNone)
-		c.contactsUI.Select(contact.id)
+		c.contactsUI.Add(contact.Id, contact.Name, "pending", core.IndicatorNone)
+		c.contactsUI.Select(contact.Id)
 	}
 
 	var out bytes.Buffer
-	pem.Encode(&out, &pem.Block{Bytes: contact.kxsBytes, Type: keyExchangePEM})
+	pem.Encode(&out, &pem.Block{Bytes: contact.KxsBytes, Type: core.KeyExchangePEM})
 	handshake := string(out.Bytes())
 
 	rows := [][]GridE{
@@ -2516,11 +2952,11 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 		if click.name == "abort" {
 			c.gui.Actions() <- Sensitive{name: "abort", sensitive: false}
 			c.gui.Signal()
-			c.deleteContact(contact)
+			c.DeleteContact(contact)
 			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
 			c.gui.Actions() <- UIState{uiStateRevocationComplete}
 			c.gui.Signal()
-			c.save()
+			c.Save()
 			return nil
 		}
 
@@ -2529,14 +2965,14 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 		}
 
 		block, _ := pem.Decode([]byte(click.textViews["kxin"]))
-		if block == nil || block.Type != keyExchangePEM {
+		if block == nil || block.Type != core.KeyExchangePEM {
 			const errText = "No key exchange message found!"
 			c.gui.Actions() <- SetText{name: "error2", text: errText}
 			c.gui.Actions() <- UIError{errors.New(errText)}
 			c.gui.Signal()
 			continue
 		}
-		if err := contact.processKeyExchange(block.Bytes, c.dev, c.simulateOldClient, c.disableV2Ratchet); err != nil {
+		if err := contact.ProcessKeyExchange(block.Bytes, c.AllowClearnet, c.SimulateOldClient, c.DisableV2Ratchet); err != nil {
 			c.gui.Actions() <- SetText{name: "error2", text: err.Error()}
 			c.gui.Actions() <- UIError{err}
 			c.gui.Signal()
@@ -2547,15 +2983,15 @@ func (c *guiClient) newContactManual(contact *Contact, existing bool, nextRow in
 	}
 
 	// Unseal all pending messages from this new contact.
-	contact.isPending = false
+	contact.IsPending = false
 	c.unsealPendingMessages(contact)
-	c.contactsUI.SetSubline(contact.id, "")
-	c.save()
-	return c.showContact(contact.id)
+	c.contactsUI.SetSubline(contact.Id, "")
+	c.Save()
+	return c.showContact(contact.Id)
 }
 
-func (c *guiClient) newContactPanda(contact *Contact, existing bool, nextRow int) interface{} {
-	c.newKeyExchange(contact)
+func (c *guiClient) newContactPanda(contact *core.Contact, existing bool, nextRow int) interface{} {
+	c.NewKeyExchange(contact)
 
 	controls := Grid{
 		widgetBase: widgetBase{name: "controls", margin: 5},
@@ -2777,32 +3213,30 @@ SharedSecretEvent:
 					secret.Hours = click.spinButtons["hour"]
 					secret.Minutes = click.spinButtons["minute"]
 				}
-				mp := c.newMeetingPlace()
+				mp := c.NewMeetingPlace()
 
-				c.contacts[contact.id] = contact
-				c.contactsUI.Add(contact.id, contact.name, "pending", indicatorNone)
-				c.contactsUI.Select(contact.id)
+				c.Contacts[contact.Id] = contact
+				c.contactsUI.Add(contact.Id, contact.Name, "pending", core.IndicatorNone)
+				c.contactsUI.Select(contact.Id)
 
-				kx, err := panda.NewKeyExchange(c.rand, mp, &secret, contact.kxsBytes)
+				kx, err := panda.NewKeyExchange(c.Rand, mp, &secret, contact.KxsBytes)
 				if err != nil {
 					panic(err)
 				}
-				kx.Testing = c.testing
-				contact.pandaKeyExchange = kx.Marshal()
-				contact.kxsBytes = nil
+				kx.Testing = c.Testing
+				contact.PandaKeyExchange = kx.Marshal()
+				contact.KxsBytes = nil
 				break SharedSecretEvent
 			case click.name == "generate":
-				c.gui.Actions() <- SetEntry{name: "shared", text: panda.NewSecretString(c.rand)}
+				c.gui.Actions() <- SetEntry{name: "shared", text: panda.NewSecretString(c.Rand)}
 				c.gui.Signal()
 			}
 		}
 	}
 
-	c.save()
-	c.pandaWaitGroup.Add(1)
-	contact.pandaShutdownChan = make(chan struct{})
-	go c.runPANDA(contact.pandaKeyExchange, contact.id, contact.name, contact.pandaShutdownChan)
-	return c.showContact(contact.id)
+	c.Save()
+	c.ResumePANDA(contact)
+	return c.showContact(contact.Id)
 }
 
 func widgetForAttachment(id uint64, label string, isError bool, extraWidgets []Widget) Widget {
@@ -2840,7 +3274,7 @@ func widgetForAttachment(id uint64, label string, isError bool, extraWidgets []W
 						},
 						Button{
 							widgetBase: widgetBase{name: fmt.Sprintf("remove-%x", id)},
-							image:      indicatorRemove,
+							image:      core.IndicatorRemove,
 						},
 					},
 				},
@@ -2858,14 +3292,14 @@ type DetachmentUI interface {
 }
 
 type ComposeDetachmentUI struct {
-	draft       *Draft
+	draft       *core.Draft
 	detachments map[uint64]int
 	gui         GUI
 	final       func()
 }
 
 func (i ComposeDetachmentUI) IsValid(id uint64) bool {
-	_, ok := i.draft.pendingDetachments[id]
+	_, ok := i.draft.PendingDetachments[id]
 	return ok
 }
 
@@ -2878,20 +3312,28 @@ func (i ComposeDetachmentUI) VBoxName(id uint64) string {
 }
 
 func (i ComposeDetachmentUI) OnFinal(id uint64) {
-	delete(i.draft.pendingDetachments, id)
+	delete(i.draft.PendingDetachments, id)
 	i.final()
 }
 
 func (i ComposeDetachmentUI) OnSuccess(id uint64, detachment *pond.Message_Detachment) {
-	i.detachments[id] = len(i.draft.detachments)
-	i.draft.detachments = append(i.draft.detachments, detachment)
+	// Uploaded detachments have already been added to the draft when the
+	// transfer completed.
+	for index, d := range i.draft.Detachments {
+		if d == detachment {
+			i.detachments[id] = index
+			return
+		}
+	}
+	i.detachments[id] = len(i.draft.Detachments)
+	i.draft.Detachments = append(i.draft.Detachments, detachment)
 }
 
 // maybeProcessDetachmentMsg is called to process a possible message from a
 // background, detachment task. It returns true if event was handled.
 func (c *guiClient) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI) bool {
-	if derr, ok := event.(DetachmentError); ok {
-		id := derr.id
+	if derr, ok := event.(core.DetachmentError); ok {
+		id := derr.Id
 		if !ui.IsValid(id) {
 			return true
 		}
@@ -2903,7 +3345,7 @@ func (c *guiClient) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI
 					widgetBase: widgetBase{
 						foreground: colorRed,
 					},
-					text: derr.err.Error(),
+					text: derr.Err.Error(),
 				},
 			},
 		}
@@ -2911,28 +3353,28 @@ func (c *guiClient) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI
 		c.gui.Signal()
 		return true
 	}
-	if prog, ok := event.(DetachmentProgress); ok {
-		id := prog.id
+	if prog, ok := event.(core.DetachmentProgress); ok {
+		id := prog.Id
 		if !ui.IsValid(id) {
 			return true
 		}
-		if prog.total == 0 {
+		if prog.Total == 0 {
 			return true
 		}
-		f := float64(prog.done) / float64(prog.total)
+		f := float64(prog.Done) / float64(prog.Total)
 		if f > 1 {
 			f = 1
 		}
 		c.gui.Actions() <- SetProgress{
 			name:     ui.ProgressName(id),
-			s:        prog.status,
+			s:        prog.Status,
 			fraction: f,
 		}
 		c.gui.Signal()
 		return true
 	}
-	if complete, ok := event.(DetachmentComplete); ok {
-		id := complete.id
+	if complete, ok := event.(core.DetachmentComplete); ok {
+		id := complete.Id
 		if !ui.IsValid(id) {
 			return true
 		}
@@ -2940,7 +3382,7 @@ func (c *guiClient) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI
 			name: ui.ProgressName(id),
 		}
 		ui.OnFinal(id)
-		ui.OnSuccess(id, complete.detachment)
+		ui.OnSuccess(id, complete.Detachment)
 		c.gui.Actions() <- UIState{uiStateDetachmentComplete}
 		c.gui.Signal()
 		return true
@@ -2949,8 +3391,8 @@ func (c *guiClient) maybeProcessDetachmentMsg(event interface{}, ui DetachmentUI
 	return false
 }
 
-func (c *guiClient) updateUsage(validContactSelected bool, draft *Draft) bool {
-	usageMessage, over := draft.usageString()
+func (c *guiClient) updateUsage(validContactSelected bool, draft *core.Draft) bool {
+	usageMessage, over := c.UsageString(draft)
 	c.gui.Actions() <- SetText{name: "usage", text: usageMessage}
 	color := uint32(colorBlack)
 	if over {
@@ -2963,43 +3405,56 @@ func (c *guiClient) updateUsage(validContactSelected bool, draft *Draft) bool {
 	return over
 }
 
-func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{} {
+func (c *guiClient) composeUI(draft *core.Draft, inReplyTo *core.InboxMessage) interface{} {
 	if draft != nil && inReplyTo != nil {
 		panic("draft and inReplyTo both set")
 	}
 
 	var contactNames []string
-	for _, contact := range c.contacts {
-		if !contact.isPending && !contact.revokedUs {
-			contactNames = append(contactNames, contact.name)
+	for _, contact := range c.Contacts {
+		if !contact.IsPending && !contact.RevokedUs {
+			contactNames = append(contactNames, contact.Name)
+		}
+	}
+	for _, group := range c.GroupNames() {
+		if len(c.GroupRecipients(group)) > 0 {
+			contactNames = append(contactNames, core.GroupLabelPrefix+group)
 		}
 	}
 
 	var preSelected string
 	if inReplyTo != nil {
-		if from, ok := c.contacts[inReplyTo.from]; ok {
-			preSelected = from.name
+		if from, ok := c.Contacts[inReplyTo.From]; ok {
+			preSelected = from.Name
 		}
 	}
 
 	attachments := make(map[uint64]int)
 	detachments := make(map[uint64]int)
 
+	// multipleLabel is offered as a recipient when editing a draft that
+	// was addressed to several contacts and selecting it leaves the
+	// recipients unchanged.
+	var multipleLabel string
 	if draft != nil {
-		if to, ok := c.contacts[draft.to]; ok {
-			preSelected = to.name
+		if len(draft.AlsoTo) > 0 {
+			multipleLabel = c.RecipientNames(draft)
+			contactNames = append(contactNames, multipleLabel)
+			preSelected = multipleLabel
+		} else if to, ok := c.Contacts[draft.To]; ok {
+			preSelected = to.Name
 		}
-		for i := range draft.attachments {
-			attachments[c.randId()] = i
+		for i := range draft.Attachments {
+			attachments[c.RandId()] = i
 		}
-		for i := range draft.detachments {
-			detachments[c.randId()] = i
+		for i := range draft.Detachments {
+			detachments[c.RandId()] = i
 		}
 	}
 
-	if draft != nil && draft.inReplyTo != 0 {
-		for _, msg := range c.inbox {
-			if msg.id == draft.inReplyTo {
+	if draft != nil && draft.InReplyTo != 0 {
+		for _, msg := range c.Inbox {
+			if msg.Id == draft.InReplyTo {
 				inReplyTo = msg
 				break
 			}
@@ -3012,23 +3467,51 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			from = "Unknown"
 		}
 
-		draft = &Draft{
-			id:      c.randId(),
-			created: c.Now(),
+		draft = &core.Draft{
+			Id:      c.RandId(),
+			Created: c.Now(),
 		}
 		if inReplyTo != nil {
-			draft.inReplyTo = inReplyTo.id
-			draft.to = inReplyTo.from
-			draft.body = indentForReply(inReplyTo.message.GetBody())
+			draft.InReplyTo = inReplyTo.Id
+			draft.To = inReplyTo.From
+			draft.Body = core.IndentForReply(inReplyTo.Message.GetBody())
 		}
 
-		c.draftsUI.Add(draft.id, from, draft.created.Format(shortTimeFormat), indicatorNone)
-		c.draftsUI.Select(draft.id)
-		c.drafts[draft.id] = draft
+		c.draftsUI.Add(draft.Id, from, draft.Created.Format(core.ShortTimeFormat), core.IndicatorNone)
+		c.draftsUI.Select(draft.Id)
+		c.Drafts[draft.Id] = draft
 	}
 
-	initialUsageMessage, overSize := draft.usageString()
+	initialUsageMessage, overSize := c.UsageString(draft)
 	validContactSelected := len(preSelected) > 0
+	expiryLabelList, expirySelected := core.ExpiryLabels(draft.Expiry)
+	sendDelayLabelList, sendDelaySelected := core.SendDelayLabels(draft.SendDelay)
+
+	// The send time defaults to the current time so that the user only
+	// has to move it forwards.
+	scheduled := !draft.SendAfter.IsZero()
+	sendAfter := draft.SendAfter
+	if !scheduled {
+		sendAfter = c.Now()
+	}
+	sendAfter = sendAfter.Local()
+
+	// selectRecipients sets the recipients of the draft from a label in
+	// the "to" combo, which may be a contact or a group.
+	selectRecipients := func(label string) {
+		if len(multipleLabel) > 0 && label == multipleLabel {
+			return
+		}
+		for _, contact := range c.Contacts {
+			if contact.Name == label {
+				draft.SetRecipients([]uint64{contact.Id})
+				return
+			}
+		}
+		if strings.HasPrefix(label, core.GroupLabelPrefix) {
+			draft.SetRecipients(c.GroupRecipients(label[len(core.GroupLabelPrefix):]))
+		}
+	}
 
 	lhs := VBox{
 		children: []Widget{
@@ -3050,6 +3533,58 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					},
 				},
 			},
+			HBox{
+				widgetBase: widgetBase{padding: 2},
+				children: []Widget{
+					Label{
+						widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, padding: 10},
+						text:       "EXPIRES",
+						yAlign:     0.5,
+					},
+					Combo{
+						widgetBase:  widgetBase{name: "expiry"},
+						labels:      expiryLabelList,
+						preSelected: expirySelected,
+					},
+				},
+			},
+			HBox{
+				widgetBase: widgetBase{padding: 2},
+				children: []Widget{
+					Label{
+						widgetBase: widgetBase{font: fontMainLabel, foreground: colorHeaderForeground, padding: 10},
+						text:       "TRANSMIT",
+						yAlign:     0.5,
+					},
+					Combo{
+						widgetBase:  widgetBase{name: "send-delay"},
+						labels:      sendDelayLabelList,
+						preSelected: sendDelaySelected,
+					},
+					CheckButton{
+						widgetBase: widgetBase{name: "schedule", padding: 10},
+						checked:    scheduled,
+						text:       "Not before",
+					},
+				},
+			},
+			HBox{
+				widgetBase: widgetBase{padding: 2},
+				children: []Widget{
+					Calendar{
+						widgetBase: widgetBase{name: "send-date", padding: 10, insensitive: !scheduled},
+						date:       CalendarDate{sendAfter.Year(), int(sendAfter.Month()) - 1, sendAfter.Day()},
+					},
+					VBox{
+						children: []Widget{
+							Label{text: "Hour"},
+							SpinButton{widgetBase: widgetBase{name: "send-hour", insensitive: !scheduled}, min: 0, max: 23, step: 1, value: float64(sendAfter.Hour())},
+							Label{text: "Minute"},
+							SpinButton{widgetBase: widgetBase{name: "send-minute", insensitive: !scheduled}, min: 0, max: 59, step: 1, value: float64(sendAfter.Minute())},
+						},
+					},
+				},
+			},
 			HBox{
 				widgetBase: widgetBase{padding: 2},
 				children: []Widget{
@@ -3074,7 +3609,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					},
 					Button{
 						widgetBase: widgetBase{name: "attach", font: "Liberation Sans 8"},
-						image:      indicatorAdd,
+						image:      core.IndicatorAdd,
 					},
 				},
 			},
@@ -3092,7 +3627,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 		widgetBase: widgetBase{padding: 5},
 		children: []Widget{
 			Button{
-				widgetBase: widgetBase{name: "send", insensitive: !validContactSelected, padding: 2},
+				widgetBase: widgetBase{name: "send", insensitive: !validContactSelected || overSize, padding: 2},
 				text:       "Send",
 			},
 			Button{
@@ -3138,7 +3673,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					wrap:           true,
 					updateOnChange: true,
 					spellCheck:     true,
-					text:           draft.body,
+					text:           draft.Body,
 				},
 			},
 		},
@@ -3146,21 +3681,33 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 
 	c.gui.Actions() <- SetChild{name: "right", child: ui}
 
-	if draft.pendingDetachments == nil {
-		draft.pendingDetachments = make(map[uint64]*pendingDetachment)
+	if draft.PendingDetachments == nil {
+		draft.PendingDetachments = make(map[uint64]*core.PendingDetachment)
+	}
+	// Uploads that were resumed when Pond started are shown as pending.
+	for _, t := range c.Transfers {
+		if _, ok := draft.PendingDetachments[t.Id]; ok || !t.Upload || t.Draft != draft.Id {
+			continue
+		}
+		t := t
+		draft.PendingDetachments[t.Id] = &core.PendingDetachment{
+			Path:   t.Path,
+			Size:   t.Size,
+			Cancel: func() { c.CancelTransfer(t) },
+		}
 	}
 
 	var initialAttachmentChildren []Widget
 	for id, index := range attachments {
-		attachment := draft.attachments[index]
+		attachment := draft.Attachments[index]
 		initialAttachmentChildren = append(initialAttachmentChildren, widgetForAttachment(id, fmt.Sprintf("%s (%d bytes)", *attachment.Filename, len(attachment.Contents)), false, nil))
 	}
 	for id, index := range detachments {
-		detachment := draft.detachments[index]
+		detachment := draft.Detachments[index]
 		initialAttachmentChildren = append(initialAttachmentChildren, widgetForAttachment(id, fmt.Sprintf("%s (%d bytes, external)", *detachment.Filename, *detachment.Size), false, nil))
 	}
-	for id, pending := range draft.pendingDetachments {
-		initialAttachmentChildren = append(initialAttachmentChildren, widgetForAttachment(id, fmt.Sprintf("%s (%d bytes, external)", filepath.Base(pending.path), pending.size), false, []Widget{
+	for id, pending := range draft.PendingDetachments {
+		initialAttachmentChildren = append(initialAttachmentChildren, widgetForAttachment(id, fmt.Sprintf("%s (%d bytes, external)", filepath.Base(pending.Path), pending.Size), false, []Widget{
 			Progress{
 				widgetBase: widgetBase{
 					name: fmt.Sprintf("attachment-progress-%x", id),
@@ -3191,16 +3738,16 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 
 		if update, ok := event.(Update); ok {
 			overSize = c.updateUsage(validContactSelected, draft)
-			draft.body = update.text
+			draft.Body = update.text
 			c.gui.Signal()
 			continue
 		}
 
 		if open, ok := event.(OpenResult); ok && open.ok && open.arg == nil {
 			// Opening a file for an attachment.
-			contents, size, err := openAttachment(open.path)
+			contents, size, err := core.OpenAttachment(open.path)
 			base := filepath.Base(open.path)
-			id := c.randId()
+			id := c.RandId()
 
 			var label string
 			var extraWidgets []Widget
@@ -3240,9 +3787,9 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					},
 				}}
 
-				draft.pendingDetachments[id] = &pendingDetachment{
-					path: open.path,
-					size: size,
+				draft.PendingDetachments[id] = &core.PendingDetachment{
+					Path: open.path,
+					Size: size,
 				}
 			} else {
 				label = fmt.Sprintf("%s (%d bytes)", base, len(contents))
@@ -3250,8 +3797,8 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					Filename: proto.String(base),
 					Contents: contents,
 				}
-				attachments[id] = len(draft.attachments)
-				draft.attachments = append(draft.attachments, a)
+				attachments[id] = len(draft.Attachments)
+				draft.Attachments = append(draft.Attachments, a)
 			}
 
 			c.gui.Actions() <- Append{
@@ -3277,7 +3824,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					},
 				},
 			}
-			draft.pendingDetachments[id].cancel = c.startEncryption(id, open.path, draft.pendingDetachments[id].path)
+			draft.PendingDetachments[id].Cancel = c.StartEncryption(id, open.path, draft.PendingDetachments[id].Path)
 			c.gui.Signal()
 		}
 
@@ -3301,22 +3848,36 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			if len(selected) > 0 {
 				validContactSelected = true
 			}
-			for _, contact := range c.contacts {
-				if contact.name == selected {
-					draft.to = contact.id
-				}
-			}
-			c.draftsUI.SetLine(draft.id, selected)
-			if validContactSelected && !overSize {
-				c.gui.Actions() <- Sensitive{name: "send", sensitive: true}
-				c.gui.Signal()
-			}
+			selectRecipients(selected)
+			c.draftsUI.SetLine(draft.Id, selected)
+			// Whether a long draft can be sent depends on the
+			// recipients.
+			overSize = c.updateUsage(validContactSelected, draft)
+			c.gui.Signal()
+			continue
+		}
+		if click.name == "expiry" {
+			draft.Expiry = core.ExpiryForLabel(click.combos["expiry"], draft.Expiry)
+			overSize = c.updateUsage(validContactSelected, draft)
+			c.gui.Signal()
+			continue
+		}
+		if click.name == "send-delay" {
+			draft.SendDelay = core.SendDelayForLabel(click.combos["send-delay"], draft.SendDelay)
+			continue
+		}
+		if click.name == "schedule" {
+			scheduled := click.checks["schedule"]
+			c.gui.Actions() <- Sensitive{name: "send-date", sensitive: scheduled}
+			c.gui.Actions() <- Sensitive{name: "send-hour", sensitive: scheduled}
+			c.gui.Actions() <- Sensitive{name: "send-minute", sensitive: scheduled}
+			c.gui.Signal()
 			continue
 		}
 		if click.name == "discard" {
-			c.draftsUI.Remove(draft.id)
-			delete(c.drafts, draft.id)
-			c.save()
+			c.draftsUI.Remove(draft.Id)
+			c.DeleteDraft(draft.Id)
+			c.Save()
 			c.gui.Actions() <- SetChild{name: "right", child: rightPlaceholderUI}
 			c.gui.Actions() <- UIState{uiStateMain}
 			c.gui.Signal()
@@ -3330,17 +3891,17 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			}
 			c.gui.Actions() <- Destroy{name: "attachment-frame-" + click.name[7:]}
 			if index, ok := attachments[id]; ok {
-				draft.attachments = append(draft.attachments[:index], draft.attachments[index+1:]...)
+				draft.Attachments = append(draft.Attachments[:index], draft.Attachments[index+1:]...)
 				delete(attachments, id)
 			}
-			if detachment, ok := draft.pendingDetachments[id]; ok {
-				if detachment.cancel != nil {
-					detachment.cancel()
+			if detachment, ok := draft.PendingDetachments[id]; ok {
+				if detachment.Cancel != nil {
+					detachment.Cancel()
 				}
-				delete(draft.pendingDetachments, id)
+				delete(draft.PendingDetachments, id)
 			}
 			if index, ok := detachments[id]; ok {
-				draft.detachments = append(draft.detachments[:index], draft.detachments[index+1:]...)
+				draft.Detachments = append(draft.Detachments[:index], draft.Detachments[index+1:]...)
 				delete(detachments, id)
 			}
 			overSize = c.updateUsage(validContactSelected, draft)
@@ -3358,7 +3919,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 			c.gui.Actions() <- FileOpen{
 				save:     true,
 				title:    "Save encrypted file",
-				filename: filepath.Base(draft.pendingDetachments[id].path) + ".pondencrypted",
+				filename: filepath.Base(draft.PendingDetachments[id].Path) + ".pondencrypted",
 				arg:      id,
 			}
 			c.gui.Signal()
@@ -3381,7 +3942,7 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 					},
 				},
 			}
-			draft.pendingDetachments[id].cancel = c.startUpload(id, draft.pendingDetachments[id].path)
+			draft.PendingDetachments[id].Cancel = c.StartUpload(id, draft.Id, draft.PendingDetachments[id].Path)
 			c.gui.Signal()
 		}
 
@@ -3393,36 +3954,53 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 		if len(toName) == 0 {
 			continue
 		}
-		for _, contact := range c.contacts {
-			if contact.name == toName {
-				draft.to = contact.id
-				break
-			}
+		selectRecipients(toName)
+		draft.Expiry = core.ExpiryForLabel(click.combos["expiry"], draft.Expiry)
+		draft.SendDelay = core.SendDelayForLabel(click.combos["send-delay"], draft.SendDelay)
+		draft.SendAfter = time.Time{}
+		if click.checks["schedule"] {
+			date := click.calendars["send-date"]
+			draft.SendAfter = time.Date(date.year, time.Month(date.month+1), date.day, click.spinButtons["send-hour"], click.spinButtons["send-minute"], 0, 0, time.Local)
 		}
 
 		if inReplyTo != nil {
-			draft.inReplyTo = inReplyTo.message.GetId()
+			draft.InReplyTo = inReplyTo.Message.GetId()
 		}
-		draft.body = click.textViews["body"]
+		draft.Body = click.textViews["body"]
 
-		id, created, err := c.sendDraft(draft)
+		id, created, err := c.SendDraft(draft)
+		if err == core.ErrDraftUploading {
+			// The draft is sent once its attachments have been
+			// uploaded, which can be followed in the list of
+			// transfers.
+			c.Save()
+			c.draftsUI.Deselect()
+			return c.transfersUI()
+		}
 		if err != nil {
 			// TODO: handle this case better.
 			println(err.Error())
-			c.log.Errorf("Error sending message: %s", err)
+			c.Log.Errorf("Error sending message: %s", err)
 			continue
 		}
-		to := c.contacts[draft.to]
-		c.outboxUI.Add(id, to.name, created.Format(shortTimeFormat), indicatorRed)
+		for _, msg := range c.Outbox {
+			if msg.Id != id {
+				continue
+			}
+			for _, m := range c.FanoutCopies(msg) {
+				c.outboxUI.Add(m.Id, c.ContactName(m.To), created.Format(core.ShortTimeFormat), core.IndicatorRed)
+			}
+			break
+		}
 		if inReplyTo != nil {
-			inReplyTo.acked = true
-			c.inboxUI.SetIndicator(inReplyTo.id, indicatorNone)
+			inReplyTo.Acked = true
+			c.inboxUI.SetIndicator(inReplyTo.Id, core.IndicatorNone)
 		}
 
-		c.draftsUI.Remove(draft.id)
-		delete(c.drafts, draft.id)
+		c.draftsUI.Remove(draft.Id)
+		c.DeleteDraft(draft.Id)
 
-		c.save()
+		c.Save()
 
 		c.outboxUI.Select(id)
 		return c.showOutbox(id)
@@ -3433,67 +4011,68 @@ func (c *guiClient) composeUI(draft *Draft, inReplyTo *InboxMessage) interface{}
 
 // unsealPendingMessages is run once a key exchange with a contact has
 // completed and unseals any previously unreadable messages from that contact.
-func (c *guiClient) unsealPendingMessages(contact *Contact) {
+func (c *guiClient) unsealPendingMessages(contact *core.Contact) {
 	var needToFilter = true
 
-	for _, msg := range c.inbox {
-		if msg.message == nil && msg.from == contact.id {
-			if !c.unsealMessage(msg, contact) || len(msg.message.Body) == 0 {
-				c.inboxUI.Remove(msg.id)
+	for _, msg := range c.Inbox {
+		if msg.Message == nil && msg.From == contact.Id {
+			if !c.UnsealMessage(msg, contact) || len(msg.Message.Body) == 0 || core.IsMessagePart(msg.Message) {
+				c.inboxUI.Remove(msg.Id)
 				needToFilter = true
 				continue
 			}
-			subline := time.Unix(*msg.message.Time, 0).Format(shortTimeFormat)
-			c.inboxUI.SetSubline(msg.id, subline)
-			c.inboxUI.SetIndicator(msg.id, indicatorBlue)
+			subline := time.Unix(*msg.Message.Time, 0).Format(core.ShortTimeFormat)
+			c.inboxUI.SetSubline(msg.Id, subline)
+			c.inboxUI.SetIndicator(msg.Id, core.IndicatorBlue)
 		}
 	}
 
 	if needToFilter {
-		c.dropSealedAndAckMessagesFrom(contact)
+		c.DropSealedAndAckMessagesFrom(contact)
 	}
+	c.HoldUnsealedParts(contact)
 
 	c.updateWindowTitle()
 }
 
-func (c *guiClient) processPANDAUpdateUI(update pandaUpdate) {
-	contact := c.contacts[update.id]
+func (c *guiClient) ProcessPANDAUpdateUI(update core.PandaUpdate) {
+	contact := c.Contacts[update.Id]
 
 	switch {
-	case update.err != nil:
-		c.contactsUI.SetSubline(contact.id, "failed")
-	case update.serialised != nil:
-	case update.result != nil:
-		c.contactsUI.SetSubline(contact.id, "")
+	case update.Err != nil:
+		c.contactsUI.SetSubline(contact.Id, "failed")
+	case update.Serialised != nil:
+	case update.Result != nil:
+		c.contactsUI.SetSubline(contact.Id, "")
 		c.unsealPendingMessages(contact)
 		c.gui.Actions() <- UIState{uiStatePANDAComplete}
 		c.gui.Signal()
 	}
 }
 
-func (c *guiClient) removeInboxMessageUI(msg *InboxMessage) {
-	if msg.message == nil || len(msg.message.Body) > 0 {
-		c.inboxUI.Remove(msg.id)
+func (c *guiClient) RemoveInboxMessageUI(msg *core.InboxMessage) {
+	if msg.Message == nil || len(msg.Message.Body) > 0 {
+		c.inboxUI.Remove(msg.Id)
 	}
 }
 
-func (c *guiClient) removeOutboxMessageUI(msg *queuedMessage) {
-	if msg.revocation || len(msg.message.Body) > 0 {
-		c.outboxUI.Remove(msg.id)
+func (c *guiClient) RemoveOutboxMessageUI(msg *core.QueuedMessage) {
+	if msg.Revocation || len(msg.Message.Body) > 0 {
+		c.outboxUI.Remove(msg.Id)
 	}
 }
 
-func (c *guiClient) addRevocationMessageUI(msg *queuedMessage) {
-	c.outboxUI.Add(msg.id, "Revocation", msg.created.Format(shortTimeFormat), indicatorRed)
-	c.outboxUI.SetInsensitive(msg.id)
+func (c *guiClient) AddRevocationMessageUI(msg *core.QueuedMessage) {
+	c.outboxUI.Add(msg.Id, "Revocation", msg.Created.Format(core.ShortTimeFormat), core.IndicatorRed)
+	c.outboxUI.SetInsensitive(msg.Id)
 }
 
-func (c *guiClient) removeContactUI(contact *Contact) {
-	c.contactsUI.Remove(contact.id)
+func (c *guiClient) RemoveContactUI(contact *core.Contact) {
+	c.contactsUI.Remove(contact.Id)
 }
 
-func (c *guiClient) logEventUI(contact *Contact, event Event) {
-	c.contactsUI.SetIndicator(contact.id, indicatorBlue)
+func (c *guiClient) LogEventUI(contact *core.Contact, event core.Event) {
+	c.contactsUI.SetIndicator(contact.Id, core.IndicatorBlue)
 }
 
 func (c *guiClient) logUI() interface{} {
@@ -3564,13 +4143,13 @@ func (c *guiClient) logUI() interface{} {
 	log := ""
 	lastProcessedIndex := -1
 
-	c.log.Lock()
-	logEpoch := c.log.epoch
-	for _, entry := range c.log.entries {
-		log += fmt.Sprintf("%s: %s\n", entry.Format(logTimeFormat), entry.s)
+	c.Log.Lock()
+	logEpoch := c.Log.Epoch
+	for _, entry := range c.Log.Entries {
+		log += fmt.Sprintf("%s: %s\n", entry.Format(core.LogTimeFormat), entry.S)
 		lastProcessedIndex++
 	}
-	c.log.Unlock()
+	c.Log.Unlock()
 
 	c.gui.Actions() <- SetChild{name: "right", child: ui}
 	c.gui.Actions() <- SetTextView{name: "log", text: log}
@@ -3586,15 +4165,15 @@ func (c *guiClient) logUI() interface{} {
 
 		if click, ok := event.(Click); ok && click.name == "transact" {
 			select {
-			case c.fetchNowChan <- nil:
+			case c.FetchNowChan <- nil:
 			default:
 			}
 			continue
 		}
 
 		if click, ok := event.(Click); ok && click.name == "clear-log" {
-			c.log.clear()
-			logEpoch = c.log.epoch
+			c.Log.Clear()
+			logEpoch = c.Log.Epoch
 			lastProcessedIndex = -1
 			log = ""
 			c.gui.Actions() <- SetTextView{name: "log", text: log}
@@ -3602,17 +4181,17 @@ func (c *guiClient) logUI() interface{} {
 			continue
 		}
 
-		c.log.Lock()
-		if logEpoch != c.log.epoch {
-			logEpoch = c.log.epoch
+		c.Log.Lock()
+		if logEpoch != c.Log.Epoch {
+			logEpoch = c.Log.Epoch
 			lastProcessedIndex = -1
 			log = ""
 		}
-		for _, entry := range c.log.entries[lastProcessedIndex+1:] {
-			log += fmt.Sprintf("%s: %s\n", entry.Format(logTimeFormat), entry.s)
+		for _, entry := range c.Log.Entries[lastProcessedIndex+1:] {
+			log += fmt.Sprintf("%s: %s\n", entry.Format(core.LogTimeFormat), entry.S)
 			lastProcessedIndex++
 		}
-		c.log.Unlock()
+		c.Log.Unlock()
 
 		c.gui.Actions() <- SetTextView{name: "log", text: log}
 		c.gui.Actions() <- ScrollTextViewToEnd{name: "log"}
@@ -3624,40 +4203,35 @@ func (c *guiClient) logUI() interface{} {
 
 func NewGUIClient(stateFilename string, gui GUI, rand io.Reader, testing, autoFetch bool) *guiClient {
 	c := &guiClient{
-		client: client{
-			testing:            testing,
-			dev:                testing,
-			autoFetch:          autoFetch,
-			stateFilename:      stateFilename,
-			log:                NewLog(),
-			rand:               rand,
-			contacts:           make(map[uint64]*Contact),
-			drafts:             make(map[uint64]*Draft),
-			newMessageChan:     make(chan NewMessage),
-			messageSentChan:    make(chan messageSendResult, 1),
-			backgroundChan:     make(chan interface{}, 8),
-			pandaChan:          make(chan pandaUpdate, 1),
-			signingRequestChan: make(chan signingRequest),
-			usedIds:            make(map[uint64]bool),
+		Client: core.Client{
+			Testing:            testing,
+			Dev:                testing,
+			AutoFetch:          autoFetch,
+			StateFilename:      stateFilename,
+			Log:                core.NewLog(),
+			Rand:               rand,
+			Contacts:           make(map[uint64]*core.Contact),
+			Drafts:             make(map[uint64]*core.Draft),
+			NewMessageChan:     make(chan core.NewMessage),
+			MessageSentChan:    make(chan core.MessageSendResult, 1),
+			BackgroundChan:     make(chan interface{}, 8),
+			PandaChan:          make(chan core.PandaUpdate, 1),
+			SigningRequestChan: make(chan core.SigningRequest),
+			UsedIds:            make(map[uint64]bool),
 		},
 		gui: gui,
 	}
-	c.ui = c
+	c.UI = c
 
 	if !testing {
-		c.timerChan = time.Tick(60 * time.Second)
+		c.TimerChan = time.Tick(core.TimerInterval)
 	}
 
-	c.newMeetingPlace = func() panda.MeetingPlace {
-		return &panda.HTTPMeetingPlace{
-			TorAddress: c.torAddress,
-			URL:        "https://panda-key-exchange.appspot.com/exchange",
-		}
-	}
-	c.log.toStderr = true
+	c.NewMeetingPlace = c.HTTPMeetingPlace
+	c.Log.ToStderr = true
 	return c
 }
 
 func (c *guiClient) Start() {
-	go c.loadUI()
+	go c.LoadUI()
 }
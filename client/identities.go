@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/agl/pond/client/core"
+)
+
+// cliIdentities runs several identities, each loaded from its own state file,
+// behind a single terminal. Each identity is a complete cliClient with its own
+// state, erasure storage, network goroutine and Tor isolation credentials, so
+// nothing is shared between identities except the terminal. Commands are sent
+// to the selected identity and output from the others is labelled with their
+// names.
+type cliIdentities struct {
+	clients []*cliClient
+
+	// selectedLock protects selected, which is read by each identity's
+	// goroutine as it writes to the terminal.
+	selectedLock sync.Mutex
+	selected     *cliClient
+}
+
+// NewCLIIdentities returns a cliIdentities with an identity for each of the
+// given state files.
+func NewCLIIdentities(stateFilenames []string, rand io.Reader, testing, autoFetch bool) *cliIdentities {
+	ids := new(cliIdentities)
+	for i, name := range identityNames(stateFilenames) {
+		c := NewCLIClient(stateFilenames[i], rand, testing, autoFetch)
+		c.identities = ids
+		c.identityName = name
+		ids.clients = append(ids.clients, c)
+	}
+	return ids
+}
+
+// identityNames returns a short, unique name for the identity in each state
+// file, based on its filename.
+func identityNames(stateFilenames []string) []string {
+	names := make([]string, 0, len(stateFilenames))
+	used := make(map[string]bool)
+	for _, filename := range stateFilenames {
+		base := strings.TrimLeft(filepath.Base(filename), "."+string(filepath.Separator))
+		if len(base) == 0 {
+			base = "identity"
+		}
+		name := base
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+func (ids *cliIdentities) isSelected(c *cliClient) bool {
+	ids.selectedLock.Lock()
+	defer ids.selectedLock.Unlock()
+
+	return ids.selected == c
+}
+
+func (ids *cliIdentities) selectIdentity(c *cliClient) {
+	ids.selectedLock.Lock()
+	defer ids.selectedLock.Unlock()
+
+	ids.selected = c
+}
+
+// find returns the identity with the given name, or number counting from one,
+// or nil if there's none.
+func (ids *cliIdentities) find(s string) *cliClient {
+	for _, c := range ids.clients {
+		if c.identityName == s {
+			return c
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 1 && n <= len(ids.clients) {
+		return ids.clients[n-1]
+	}
+	return nil
+}
+
+// show writes a table of the identities to w.
+func (ids *cliIdentities) show(w io.Writer) {
+	table := cliTable{
+		heading: "Identities",
+	}
+	for i, c := range ids.clients {
+		indicator := core.IndicatorNone
+		if ids.isSelected(c) {
+			indicator = core.IndicatorGreen
+		}
+		table.rows = append(table.rows, cliRow{
+			indicator: indicator,
+			cols: []string{
+				strconv.Itoa(i + 1),
+				terminalEscape(c.identityName, false),
+				terminalEscape(c.Server, false),
+				terminalEscape(c.StateFilename, false),
+			},
+		})
+	}
+	table.WriteTo(w)
+}
+
+// Start unlocks each identity in turn and then passes commands from the
+// terminal to the selected identity until the user quits.
+func (ids *cliIdentities) Start() {
+	first := ids.clients[0]
+	restore := first.startTerminal()
+	defer restore()
+
+	done := make(chan *cliClient, len(ids.clients))
+	var running []*cliClient
+	defer func() {
+		// Closing lines causes MainUI, and then LoadUI, to return.
+		for _, c := range running {
+			close(c.lines)
+		}
+		for _ = range running {
+			<-done
+		}
+	}()
+
+	for _, c := range ids.clients {
+		c.term, c.termWrapper, c.interrupt = first.term, first.termWrapper, first.interrupt
+		c.lines = make(chan cliTerminalLine)
+		c.ready = make(chan struct{})
+
+		ids.selectIdentity(c)
+		c.Printf("%s Loading identity %s from %s\n", termInfoPrefix, terminalEscape(c.identityName, false), terminalEscape(c.StateFilename, false))
+
+		go func(c *cliClient) {
+			c.LoadUI()
+			c.shutdown()
+			done <- c
+		}(c)
+
+		select {
+		case <-c.ready:
+			running = append(running, c)
+		case <-done:
+			// The identity couldn't be loaded so the others are
+			// shut down too.
+			return
+		}
+	}
+
+	selected := running[0]
+	// pending records, for each identity, the ackChan of the last line
+	// that it was given. MainUI closes it once the command is done, unless
+	// the identity exits while processing it.
+	pending := make(map[*cliClient]chan struct{})
+
+	// exited forgets an identity whose MainUI has returned and selects
+	// another if it was the selected one. It returns false if no
+	// identities remain.
+	exited := func(c *cliClient) bool {
+		for i, r := range running {
+			if r == c {
+				running = append(running[:i], running[i+1:]...)
+				break
+			}
+		}
+		if ackChan, ok := pending[c]; ok {
+			// Input waits for each command to be acknowledged.
+			select {
+			case <-ackChan:
+			default:
+				close(ackChan)
+			}
+			delete(pending, c)
+		}
+		fmt.Fprintf(first.term, "%s Identity %s has exited\n", termWarnPrefix, terminalEscape(c.identityName, false))
+		if len(running) == 0 {
+			return false
+		}
+		if selected == c {
+			selected = running[0]
+			ids.selectIdentity(selected)
+			fmt.Fprintf(first.term, "%s Switched to identity %s\n", termInfoPrefix, terminalEscape(selected.identityName, false))
+		}
+		return true
+	}
+
+	isRunning := func(c *cliClient) bool {
+		for _, r := range running {
+			if r == c {
+				return true
+			}
+		}
+		return false
+	}
+
+	// deliver passes line to the selected identity, unless it exits
+	// first. It returns false if no identities remain.
+	deliver := func(line cliTerminalLine) bool {
+		for {
+			target := selected
+			select {
+			case target.lines <- line:
+				pending[target] = line.ackChan
+				return true
+			case c := <-done:
+				if !exited(c) {
+					return false
+				}
+				if c == target {
+					close(line.ackChan)
+					return true
+				}
+			}
+		}
+	}
+
+	ids.selectIdentity(selected)
+	ids.show(first.term)
+	if !deliver(cliTerminalLine{command: switchIdentityCommand{}, ackChan: make(chan struct{})}) {
+		return
+	}
+
+	termChan := make(chan cliTerminalLine)
+	input := &cliInput{
+		term: first.term,
+	}
+	go input.processInput(termChan)
+
+	for {
+		var line cliTerminalLine
+		select {
+		case line = <-termChan:
+		case c := <-done:
+			if !exited(c) {
+				return
+			}
+			continue
+		}
+		if line.err != nil {
+			return
+		}
+
+		switch cmd := line.command.(type) {
+		case quitCommand:
+			fmt.Fprintf(first.term, "Goodbye!\n")
+			return
+		case switchIdentityCommand:
+			c := ids.find(cmd.Identity)
+			if c == nil {
+				fmt.Fprintf(first.term, "%s No such identity. Use the identities command to list them\n", termErrPrefix)
+				close(line.ackChan)
+				continue
+			}
+			if !isRunning(c) {
+				fmt.Fprintf(first.term, "%s Identity %s has exited\n", termErrPrefix, terminalEscape(c.identityName, false))
+				close(line.ackChan)
+				continue
+			}
+			selected = c
+			ids.selectIdentity(selected)
+		}
+		if !deliver(line) {
+			return
+		}
+	}
+}
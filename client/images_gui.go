@@ -2,10 +2,6 @@
 
 package main
 
-func (i Indicator) pngBytes() []byte {
-	return indicatorPNGBytes[i]
-}
-
 var indicatorPNGBytes = [][]byte{
 	{
 		0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d, 0x49, 0x48, 0x44, 0x52,
@@ -4,6 +4,8 @@ package main
 
 import (
 	"strconv"
+
+	"github.com/agl/pond/client/core"
 )
 
 // listUI manages the sections in the left-hand side list. It contains a number
@@ -52,7 +54,7 @@ func sublineLabel(name, text string) Label {
 	}
 }
 
-func (cs *listUI) Add(id uint64, name, subline string, indicator Indicator) {
+func (cs *listUI) Add(id uint64, name, subline string, indicator core.Indicator) {
 	c := listItem{
 		id:              id,
 		name:            name,
@@ -208,7 +210,7 @@ func (cs *listUI) Select(id uint64) {
 	cs.gui.Signal()
 }
 
-func (cs *listUI) SetIndicator(id uint64, indicator Indicator) {
+func (cs *listUI) SetIndicator(id uint64, indicator core.Indicator) {
 	for _, entry := range cs.entries {
 		if entry.id == id {
 			cs.gui.Actions() <- SetImage{name: entry.imageName, image: indicator}
@@ -7,12 +7,18 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 func main() {
 	devFlag := flag.Bool("dev", false, "Is this a development environment?")
 	stateFile := flag.String("state-file", "", "File in which to save persistent state")
+	stateFiles := flag.String("state-files", "", "Comma-separated state files of several identities to load together in the CLI")
 	cliFlag := flag.Bool("cli", false, "If true, the CLI will be used, even if the GUI is available")
+	daemonFlag := flag.Bool("daemon", false, "If true, run without a user interface and accept commands on a Unix socket")
+	controlSocket := flag.String("control-socket", "", "Path of the daemon's control socket. Defaults to the state file with .sock appended")
+	passphraseFd := flag.Int("passphrase-fd", -1, "File descriptor from which the daemon, or a one-shot command, reads the state file passphrase")
+	serverFlag := flag.String("server", "", "Server on which the daemon creates an account if the state file doesn't exist")
 	flag.Parse()
 
 	dev := os.Getenv("POND") == "dev" || *devFlag
@@ -31,10 +37,30 @@ func main() {
 		*stateFile = filepath.Join(home, ".pond")
 	}
 
+	if flag.NArg() > 0 {
+		runBatch(*stateFile, *passphraseFd, flag.Args(), dev)
+		return
+	}
+
+	if *daemonFlag {
+		runDaemon(*stateFile, *controlSocket, *passphraseFd, *serverFlag, dev)
+		return
+	}
+
+	if len(*stateFiles) > 0 {
+		identities := NewCLIIdentities(strings.Split(*stateFiles, ","), rand.Reader, false /* testing */, true /* autoFetch */)
+		for _, client := range identities.clients {
+			client.DisableV2Ratchet = true
+			client.Dev = dev
+		}
+		identities.Start()
+		return
+	}
+
 	if !haveGUI || *cliFlag {
 		client := NewCLIClient(*stateFile, rand.Reader, false /* testing */, true /* autoFetch */)
-		client.disableV2Ratchet = true
-		client.dev = dev
+		client.DisableV2Ratchet = true
+		client.Dev = dev
 		client.Start()
 	} else {
 		fmt.Fprintf(os.Stderr, "GUI not supported on %s\n", runtime.GOOS)
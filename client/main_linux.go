@@ -8,15 +8,21 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	"golang.org/x/crypto/scrypt"
 )
 
 func main() {
 	stateFile := flag.String("state-file", "", "File in which to save persistent state")
+	stateFiles := flag.String("state-files", "", "Comma-separated state files of several identities to load together in the CLI")
 	pandaScrypt := flag.Bool("panda-scrypt", false, "Run in subprocess mode to process passphrase")
 	cliFlag := flag.Bool("cli", false, "If true, the CLI will be used, even if the GUI is available")
 	devFlag := flag.Bool("dev", false, "Is this a development environment?")
+	daemonFlag := flag.Bool("daemon", false, "If true, run without a user interface and accept commands on a Unix socket")
+	controlSocket := flag.String("control-socket", "", "Path of the daemon's control socket. Defaults to the state file with .sock appended")
+	passphraseFd := flag.Int("passphrase-fd", -1, "File descriptor from which the daemon, or a one-shot command, reads the state file passphrase")
+	serverFlag := flag.String("server", "", "Server on which the daemon creates an account if the state file doesn't exist")
 	flag.Parse()
 
 	if *pandaScrypt {
@@ -63,16 +69,36 @@ func main() {
 		}
 	}
 
+	if flag.NArg() > 0 {
+		runBatch(*stateFile, *passphraseFd, flag.Args(), dev)
+		return
+	}
+
+	if *daemonFlag {
+		runDaemon(*stateFile, *controlSocket, *passphraseFd, *serverFlag, dev)
+		return
+	}
+
+	if len(*stateFiles) > 0 {
+		identities := NewCLIIdentities(strings.Split(*stateFiles, ","), rand.Reader, false /* testing */, true /* autoFetch */)
+		for _, client := range identities.clients {
+			client.DisableV2Ratchet = true
+			client.Dev = dev
+		}
+		identities.Start()
+		return
+	}
+
 	if !haveGUI || *cliFlag || len(os.Getenv("PONDCLI")) > 0 {
 		client := NewCLIClient(*stateFile, rand.Reader, false /* testing */, true /* autoFetch */)
-		client.disableV2Ratchet = true
-		client.dev = dev
+		client.DisableV2Ratchet = true
+		client.Dev = dev
 		client.Start()
 	} else {
 		ui := NewGTKUI()
 		client := NewGUIClient(*stateFile, ui, rand.Reader, false /* testing */, true /* autoFetch */)
-		client.disableV2Ratchet = true
-		client.dev = dev
+		client.DisableV2Ratchet = true
+		client.Dev = dev
 		client.Start()
 		ui.Run()
 	}
@@ -1,6 +1,4 @@
-// +build !notpm
-
-package disk
+package tpm
 
 import (
 	"crypto/sha256"
@@ -8,14 +6,19 @@ import (
 	"fmt"
 	"io"
 
-	"github.com/agl/pond/client/tpm"
+	"github.com/agl/pond/client/disk"
 	"github.com/golang/protobuf/proto"
 )
 
+const (
+	kdfKeyLen     = 32
+	erasureKeyLen = 32
+)
+
 func init() {
-	erasureRegistry = append(erasureRegistry, func(header *Header) ErasureStorage {
+	disk.RegisterErasureStorage(func(header *disk.Header) disk.ErasureStorage {
 		if header.TpmNvram != nil {
-			return &TPM{
+			return &Erasure{
 				index: header.TpmNvram.GetIndex(),
 			}
 		}
@@ -23,17 +26,19 @@ func init() {
 	})
 }
 
-type TPM struct {
+// Erasure is a disk.ErasureStorage that keeps the erasure key of a state file
+// in TPM NVRAM.
+type Erasure struct {
 	Log   func(format string, args ...interface{})
 	Rand  io.Reader
 	index uint32
 }
 
-func (t *TPM) getContext() (*tpm.Context, error) {
-	ctx, err := tpm.NewContext()
+func (t *Erasure) getContext() (*Context, error) {
+	ctx, err := NewContext()
 	if err != nil {
-		if tpmErr, ok := err.(tpm.Error); ok {
-			if tpmErr.Code() == tpm.ErrCodeCommunicationFailure {
+		if tpmErr, ok := err.(Error); ok {
+			if tpmErr.Code() == ErrCodeCommunicationFailure {
 				return nil, errors.New("failed to connect to tcsd; is it running?")
 			}
 		}
@@ -43,7 +48,7 @@ func (t *TPM) getContext() (*tpm.Context, error) {
 	return ctx, nil
 }
 
-func (t *TPM) getNVRAM(ctx *tpm.Context, key *[kdfKeyLen]byte) (*tpm.NVRAM, error) {
+func (t *Erasure) getNVRAM(ctx *Context, key *[kdfKeyLen]byte) (*NVRAM, error) {
 	h := sha256.New()
 	h.Write([]byte("TPM NVRAM key\x00"))
 	h.Write(key[:])
@@ -69,7 +74,7 @@ func (t *TPM) getNVRAM(ctx *tpm.Context, key *[kdfKeyLen]byte) (*tpm.NVRAM, erro
 
 }
 
-func (t *TPM) createIndex(key *[kdfKeyLen]byte) (uint32, error) {
+func (t *Erasure) createIndex(key *[kdfKeyLen]byte) (uint32, error) {
 	t.Log("Connecting to local tcsd")
 	ctx, err := t.getContext()
 	if err != nil {
@@ -92,7 +97,7 @@ func (t *TPM) createIndex(key *[kdfKeyLen]byte) (uint32, error) {
 	}
 
 	nvram.Size = 32
-	nvram.Permissions = tpm.PermWriteAllAtOnce | tpm.PermAuthWrite | tpm.PermAuthRead
+	nvram.Permissions = PermWriteAllAtOnce | PermAuthWrite | PermAuthRead
 
 NextAttempt:
 	for attempt := 0; attempt < 3; attempt++ {
@@ -105,14 +110,14 @@ NextAttempt:
 		}
 		t.Log("Attempting to create NVRAM index %d", nvram.Index)
 		if err := nvram.Create(); err != nil {
-			if tpmErr, ok := err.(tpm.Error); ok {
+			if tpmErr, ok := err.(Error); ok {
 				switch tpmErr.Code() {
-				case tpm.ErrCodeNVRAMAlreadyExists:
+				case ErrCodeNVRAMAlreadyExists:
 					t.Log("NVRAM index already exists. Trying another.")
 					continue NextAttempt
-				case tpm.ErrCodeTPMDisabled:
+				case ErrCodeTPMDisabled:
 					return 0, errors.New("TPM is disabled. Please enable in the BIOS and try again.")
-				case tpm.ErrCodeNoStorageRootKey:
+				case ErrCodeNoStorageRootKey:
 					t.Log("TPM has no owner. Attempting to set default keys.")
 					srk, err := ctx.NewRSA()
 					if err != nil {
@@ -141,13 +146,13 @@ NextAttempt:
 	return 0, errors.New("too many attempts to create NVRAM")
 }
 
-func (t *TPM) Create(header *Header, key *[kdfKeyLen]byte) error {
+func (t *Erasure) Create(header *disk.Header, key *[kdfKeyLen]byte) error {
 	index, err := t.createIndex(key)
 	if err != nil {
 		return err
 	}
 
-	header.TpmNvram = &Header_TPM{
+	header.TpmNvram = &disk.Header_TPM{
 		Index: proto.Uint32(index),
 	}
 	t.index = index
@@ -155,7 +160,7 @@ func (t *TPM) Create(header *Header, key *[kdfKeyLen]byte) error {
 	return nil
 }
 
-func (t *TPM) Read(key *[kdfKeyLen]byte) (*[erasureKeyLen]byte, error) {
+func (t *Erasure) Read(key *[kdfKeyLen]byte) (*[erasureKeyLen]byte, error) {
 	ctx, err := t.getContext()
 	if err != nil {
 		return nil, err
@@ -171,8 +176,8 @@ func (t *TPM) Read(key *[kdfKeyLen]byte) (*[erasureKeyLen]byte, error) {
 	var buf [erasureKeyLen]byte
 	n, err := nvram.Read(buf[:])
 	if err != nil {
-		if tpmErr, ok := err.(tpm.Error); ok && tpmErr.Code() == tpm.ErrCodeAuthentication {
-			return nil, BadPasswordError
+		if tpmErr, ok := err.(Error); ok && tpmErr.Code() == ErrCodeAuthentication {
+			return nil, disk.BadPasswordError
 		}
 		return nil, err
 	}
@@ -183,7 +188,7 @@ func (t *TPM) Read(key *[kdfKeyLen]byte) (*[erasureKeyLen]byte, error) {
 	return &buf, nil
 }
 
-func (t *TPM) Write(key *[kdfKeyLen]byte, value *[erasureKeyLen]byte) error {
+func (t *Erasure) Write(key *[kdfKeyLen]byte, value *[erasureKeyLen]byte) error {
 	ctx, err := t.getContext()
 	if err != nil {
 		return err
@@ -199,7 +204,7 @@ func (t *TPM) Write(key *[kdfKeyLen]byte, value *[erasureKeyLen]byte) error {
 	return nvram.Write(value[:])
 }
 
-func (t *TPM) Destroy(key *[kdfKeyLen]byte) error {
+func (t *Erasure) Destroy(key *[kdfKeyLen]byte) error {
 	ctx, err := t.getContext()
 	if err != nil {
 		return err
@@ -18,8 +18,12 @@ import (
 )
 
 type HTTPMeetingPlace struct {
+	// TorAddress is the address of a Tor SOCKS proxy. It's only used if
+	// Dialer is nil.
 	TorAddress string
-	URL        string
+	// Dialer, if not nil, is used to connect to the meeting place.
+	Dialer proxy.Dialer
+	URL    string
 }
 
 const payloadBytes = 1 << 15
@@ -34,9 +38,11 @@ func (hmp *HTTPMeetingPlace) attemptExchange(log func(string, ...interface{}), i
 		return nil, nil, err
 	}
 
-	dialer, err := proxy.SOCKS5("tcp", hmp.TorAddress, nil, proxy.Direct)
-	if err != nil {
-		return nil, nil, err
+	dialer := hmp.Dialer
+	if dialer == nil {
+		if dialer, err = proxy.SOCKS5("tcp", hmp.TorAddress, nil, proxy.Direct); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	host := serverURL.Host
@@ -51,7 +57,7 @@ func (hmp *HTTPMeetingPlace) attemptExchange(log func(string, ...interface{}), i
 	if err != nil {
 		return nil, nil, err
 	}
-	log("Connecting to %s via Tor", host)
+	log("Connecting to %s", host)
 	rawConn, err := dialer.Dial("tcp", host)
 	if err != nil {
 		return nil, nil, err
@@ -160,6 +160,8 @@ type Request struct {
 	Revocation       *SignedRevocation `protobuf:"bytes,6,opt,name=revocation" json:"revocation,omitempty"`
 	HmacSetup        *HMACSetup        `protobuf:"bytes,7,opt,name=hmac_setup" json:"hmac_setup,omitempty"`
 	HmacStrike       *HMACStrike       `protobuf:"bytes,8,opt,name=hmac_strike" json:"hmac_strike,omitempty"`
+	Padding          *TransportPadding `protobuf:"bytes,9,opt,name=padding" json:"padding,omitempty"`
+	TicketRequest    []byte            `protobuf:"bytes,10,opt,name=ticket_request" json:"ticket_request,omitempty"`
 	XXX_unrecognized []byte            `json:"-"`
 }
 
@@ -223,6 +225,20 @@ func (this *Request) GetHmacStrike() *HMACStrike {
 	return nil
 }
 
+func (this *Request) GetPadding() *TransportPadding {
+	if this != nil {
+		return this.Padding
+	}
+	return nil
+}
+
+func (this *Request) GetTicketRequest() []byte {
+	if this != nil {
+		return this.TicketRequest
+	}
+	return nil
+}
+
 type Reply struct {
 	Status           *Reply_Status       `protobuf:"varint,1,opt,name=status,enum=protos.Reply_Status,def=0" json:"status,omitempty"`
 	AccountCreated   *AccountCreated     `protobuf:"bytes,2,opt,name=account_created" json:"account_created,omitempty"`
@@ -232,6 +248,9 @@ type Reply struct {
 	Download         *DownloadReply      `protobuf:"bytes,6,opt,name=download" json:"download,omitempty"`
 	Revocation       *SignedRevocation   `protobuf:"bytes,7,opt,name=revocation" json:"revocation,omitempty"`
 	ExtraRevocations []*SignedRevocation `protobuf:"bytes,8,rep,name=extra_revocations" json:"extra_revocations,omitempty"`
+	Padding          *TransportPadding   `protobuf:"bytes,9,opt,name=padding" json:"padding,omitempty"`
+	Ticket           []byte              `protobuf:"bytes,10,opt,name=ticket" json:"ticket,omitempty"`
+	TicketKey        []byte              `protobuf:"bytes,11,opt,name=ticket_key" json:"ticket_key,omitempty"`
 	XXX_unrecognized []byte              `json:"-"`
 }
 
@@ -297,6 +316,51 @@ func (this *Reply) GetExtraRevocations() []*SignedRevocation {
 	return nil
 }
 
+func (this *Reply) GetPadding() *TransportPadding {
+	if this != nil {
+		return this.Padding
+	}
+	return nil
+}
+
+func (this *Reply) GetTicket() []byte {
+	if this != nil {
+		return this.Ticket
+	}
+	return nil
+}
+
+func (this *Reply) GetTicketKey() []byte {
+	if this != nil {
+		return this.TicketKey
+	}
+	return nil
+}
+
+type TransportPadding struct {
+	RecordSize       *uint32 `protobuf:"varint,1,req,name=record_size" json:"record_size,omitempty"`
+	DummyPercent     *uint32 `protobuf:"varint,2,opt,name=dummy_percent" json:"dummy_percent,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (this *TransportPadding) Reset()         { *this = TransportPadding{} }
+func (this *TransportPadding) String() string { return proto.CompactTextString(this) }
+func (*TransportPadding) ProtoMessage()       {}
+
+func (this *TransportPadding) GetRecordSize() uint32 {
+	if this != nil && this.RecordSize != nil {
+		return *this.RecordSize
+	}
+	return 0
+}
+
+func (this *TransportPadding) GetDummyPercent() uint32 {
+	if this != nil && this.DummyPercent != nil {
+		return *this.DummyPercent
+	}
+	return 0
+}
+
 type NewAccount struct {
 	Generation       *uint32 `protobuf:"fixed32,1,req,name=generation" json:"generation,omitempty"`
 	Group            []byte  `protobuf:"bytes,2,req,name=group" json:"group,omitempty"`
@@ -772,6 +836,10 @@ type Message struct {
 	Files            []*Message_Attachment `protobuf:"bytes,7,rep,name=files" json:"files,omitempty"`
 	DetachedFiles    []*Message_Detachment `protobuf:"bytes,8,rep,name=detached_files" json:"detached_files,omitempty"`
 	SupportedVersion *int32                `protobuf:"varint,9,opt,name=supported_version" json:"supported_version,omitempty"`
+	Expiry           *int64                `protobuf:"varint,11,opt,name=expiry" json:"expiry,omitempty"`
+	PartGroup        *uint64               `protobuf:"fixed64,12,opt,name=part_group" json:"part_group,omitempty"`
+	PartNumber       *uint32               `protobuf:"varint,13,opt,name=part_number" json:"part_number,omitempty"`
+	NumParts         *uint32               `protobuf:"varint,14,opt,name=num_parts" json:"num_parts,omitempty"`
 	XXX_unrecognized []byte                `json:"-"`
 }
 
@@ -849,6 +917,34 @@ func (this *Message) GetSupportedVersion() int32 {
 	return 0
 }
 
+func (this *Message) GetExpiry() int64 {
+	if this != nil && this.Expiry != nil {
+		return *this.Expiry
+	}
+	return 0
+}
+
+func (this *Message) GetPartGroup() uint64 {
+	if this != nil && this.PartGroup != nil {
+		return *this.PartGroup
+	}
+	return 0
+}
+
+func (this *Message) GetPartNumber() uint32 {
+	if this != nil && this.PartNumber != nil {
+		return *this.PartNumber
+	}
+	return 0
+}
+
+func (this *Message) GetNumParts() uint32 {
+	if this != nil && this.NumParts != nil {
+		return *this.NumParts
+	}
+	return 0
+}
+
 type Message_Attachment struct {
 	Filename         *string `protobuf:"bytes,1,req,name=filename" json:"filename,omitempty"`
 	Contents         []byte  `protobuf:"bytes,2,req,name=contents" json:"contents,omitempty"`
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -140,6 +141,37 @@ func main() {
 
 	server := NewServer(*baseDirectory, config.GetAllowRegistration())
 
+	if config.HttpPort != nil {
+		httpAddr := net.TCPAddr{
+			IP:   ip,
+			Port: int(config.GetHttpPort()),
+		}
+		httpListener, err := net.ListenTCP("tcp", &httpAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on HTTP port: %s", err)
+		}
+		useTLS := len(config.GetTlsCertificate()) > 0 && len(config.GetTlsKey()) > 0
+		scheme := "ws"
+		if useTLS {
+			scheme = "wss"
+		}
+		log.Printf("Accepting WebSocket (%s) connections on port %d at %s", scheme, httpListener.Addr().(*net.TCPAddr).Port, config.GetHttpPath())
+
+		mux := http.NewServeMux()
+		mux.Handle(config.GetHttpPath(), &webSocketHandler{server, &identity})
+		go func() {
+			var err error
+			if useTLS {
+				err = http.ServeTLS(httpListener, mux, config.GetTlsCertificate(), config.GetTlsKey())
+			} else {
+				err = http.Serve(httpListener, mux)
+			}
+			if err != nil {
+				log.Fatalf("HTTP server failed: %s", err)
+			}
+		}()
+	}
+
 	if *lifelineFd > -1 {
 		lifeline := os.NewFile(uintptr(*lifelineFd), "lifeline")
 		go func() {
@@ -160,9 +192,17 @@ func main() {
 	}
 }
 
-func handleConnection(server *Server, rawConn net.Conn, identity *[32]byte) {
+// carrierConn is the interface required of a connection that carries the
+// transport. It's satisfied by both net.Conn and transport.WebSocketConn.
+type carrierConn interface {
+	io.ReadWriteCloser
+	SetDeadline(time.Time) error
+}
+
+func handleConnection(server *Server, rawConn carrierConn, identity *[32]byte) {
 	rawConn.SetDeadline(time.Now().Add(30 * time.Second))
 	conn := transport.NewServer(rawConn, identity)
+	server.EnableResumption(conn)
 
 	if err := conn.Handshake(); err != nil {
 		log.Printf("Error from handshake: %s", err)
@@ -17,6 +17,10 @@ type Config struct {
 	Port              *uint32 `protobuf:"varint,1,req,name=port" json:"port,omitempty"`
 	Address           *string `protobuf:"bytes,2,opt,name=address" json:"address,omitempty"`
 	AllowRegistration *bool   `protobuf:"varint,3,opt,name=allow_registration,def=1" json:"allow_registration,omitempty"`
+	HttpPort          *uint32 `protobuf:"varint,4,opt,name=http_port" json:"http_port,omitempty"`
+	HttpPath          *string `protobuf:"bytes,5,opt,name=http_path,def=/" json:"http_path,omitempty"`
+	TlsCertificate    *string `protobuf:"bytes,6,opt,name=tls_certificate" json:"tls_certificate,omitempty"`
+	TlsKey            *string `protobuf:"bytes,7,opt,name=tls_key" json:"tls_key,omitempty"`
 	XXX_unrecognized  []byte  `json:"-"`
 }
 
@@ -25,6 +29,7 @@ func (this *Config) String() string { return proto.CompactTextString(this) }
 func (*Config) ProtoMessage()       {}
 
 const Default_Config_AllowRegistration bool = true
+const Default_Config_HttpPath string = "/"
 
 func (this *Config) GetPort() uint32 {
 	if this != nil && this.Port != nil {
@@ -47,5 +52,33 @@ func (this *Config) GetAllowRegistration() bool {
 	return Default_Config_AllowRegistration
 }
 
+func (this *Config) GetHttpPort() uint32 {
+	if this != nil && this.HttpPort != nil {
+		return *this.HttpPort
+	}
+	return 0
+}
+
+func (this *Config) GetHttpPath() string {
+	if this != nil && this.HttpPath != nil {
+		return *this.HttpPath
+	}
+	return Default_Config_HttpPath
+}
+
+func (this *Config) GetTlsCertificate() string {
+	if this != nil && this.TlsCertificate != nil {
+		return *this.TlsCertificate
+	}
+	return ""
+}
+
+func (this *Config) GetTlsKey() string {
+	if this != nil && this.TlsKey != nil {
+		return *this.TlsKey
+	}
+	return ""
+}
+
 func init() {
 }
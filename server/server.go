@@ -453,16 +453,32 @@ type Server struct {
 	// expired files.
 	lastSweepTime     time.Time
 	allowRegistration bool
+	// ticketKeys are used to issue and redeem session resumption tickets.
+	// They are never written to disk so a restart invalidates all
+	// tickets.
+	ticketKeys *transport.TicketKeys
 }
 
 func NewServer(dir string, allowRegistration bool) *Server {
+	ticketKeys, err := transport.NewTicketKeys()
+	if err != nil {
+		panic(err)
+	}
+
 	return &Server{
 		baseDirectory:     dir,
 		accounts:          make(map[string]*Account),
 		allowRegistration: allowRegistration,
+		ticketKeys:        ticketKeys,
 	}
 }
 
+// EnableResumption allows conn to be resumed using one of the server's
+// tickets. It must be called before the handshake.
+func (s *Server) EnableResumption(conn *transport.Conn) {
+	conn.EnableResumption(s.ticketKeys)
+}
+
 func (s *Server) Process(conn *transport.Conn) {
 	req := new(pond.Request)
 	if err := conn.ReadProto(req); err != nil {
@@ -470,6 +486,8 @@ func (s *Server) Process(conn *transport.Conn) {
 		return
 	}
 
+	extras := newReplyExtras(conn, req)
+
 	from := &conn.Peer
 	var reply *pond.Reply
 	var messageFetched string
@@ -482,13 +500,13 @@ func (s *Server) Process(conn *transport.Conn) {
 	case req.Fetch != nil:
 		reply, messageFetched = s.fetch(from, req.Fetch)
 	case req.Upload != nil:
-		reply = s.upload(from, conn, req.Upload)
+		reply = s.upload(from, conn, req.Upload, extras)
 		if reply == nil {
 			// Connection will be handled by upload.
 			return
 		}
 	case req.Download != nil:
-		reply = s.download(conn, req.Download)
+		reply = s.download(conn, req.Download, extras)
 		if reply == nil {
 			// Connection will be handled by download.
 			return
@@ -507,6 +525,7 @@ func (s *Server) Process(conn *transport.Conn) {
 		reply = &pond.Reply{}
 	}
 
+	extras.apply(reply)
 	if err := conn.WriteProto(reply); err != nil {
 		log.Printf("Error from Write: %s", err)
 		return
@@ -989,6 +1008,55 @@ func (s *Server) fetch(from *[32]byte, fetch *pond.Fetch) (*pond.Reply, string)
 	return &pond.Reply{Fetched: fetched}, name
 }
 
+// replyExtras contains the parts of a reply that don't depend on the type of
+// request: the selected padding policy, a resumption ticket and the current
+// ticket key.
+type replyExtras struct {
+	padding   *pond.TransportPadding
+	ticket    []byte
+	ticketKey []byte
+}
+
+// newReplyExtras processes the padding offer and ticket request in req. Any
+// padding policy is put into effect on conn immediately.
+func newReplyExtras(conn *transport.Conn, req *pond.Request) (extras replyExtras) {
+	if policy, ok := transport.NegotiatePadding(req.Padding); ok {
+		conn.SetPaddingPolicy(policy)
+		extras.padding = policy.Marshal()
+	}
+
+	if len(req.TicketRequest) > 0 {
+		ticket, err := conn.IssueTicket(req.TicketRequest)
+		if err != nil {
+			log.Printf("Failed to create ticket: %s", err)
+		}
+		extras.ticket = ticket
+	}
+
+	ticketKey, err := conn.TicketKey()
+	if err != nil {
+		log.Printf("Failed to get ticket key: %s", err)
+	}
+	extras.ticketKey = ticketKey
+
+	return
+}
+
+func (extras replyExtras) apply(reply *pond.Reply) {
+	reply.Padding = extras.padding
+	reply.Ticket = extras.ticket
+	reply.TicketKey = extras.ticketKey
+	if reply.Ticket != nil && proto.Size(reply) > pond.TransportSize {
+		// Replies containing a fetched message may not have space
+		// for a ticket. The client will simply perform a full
+		// handshake next time.
+		reply.Ticket = nil
+	}
+	if reply.TicketKey != nil && proto.Size(reply) > pond.TransportSize {
+		reply.TicketKey = nil
+	}
+}
+
 func (s *Server) confirmedDelivery(from *[32]byte, messageName string) {
 	account, ok := s.getAccount(from)
 	if !ok {
@@ -1002,7 +1070,7 @@ func (s *Server) confirmedDelivery(from *[32]byte, messageName string) {
 	}
 }
 
-func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Upload) *pond.Reply {
+func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Upload, extras replyExtras) *pond.Reply {
 	account, ok := s.getAccount(from)
 	if !ok {
 		return &pond.Reply{Status: pond.Reply_NO_ACCOUNT.Enum()}
@@ -1049,6 +1117,7 @@ func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Uploa
 			Resume: resume,
 		},
 	}
+	extras.apply(reply)
 	if err := conn.WriteProto(reply); err != nil {
 		return nil
 	}
@@ -1071,7 +1140,7 @@ func (s *Server) upload(from *[32]byte, conn *transport.Conn, upload *pond.Uploa
 	return nil
 }
 
-func (s *Server) download(conn *transport.Conn, download *pond.Download) *pond.Reply {
+func (s *Server) download(conn *transport.Conn, download *pond.Download, extras replyExtras) *pond.Reply {
 	var from [32]byte
 	if len(download.From) != len(from) {
 		return &pond.Reply{Status: pond.Reply_PARSE_ERROR.Enum()}
@@ -1117,6 +1186,7 @@ func (s *Server) download(conn *transport.Conn, download *pond.Download) *pond.R
 			Size: proto.Int64(size),
 		},
 	}
+	extras.apply(reply)
 	if err := conn.WriteProto(reply); err != nil {
 		return nil
 	}
@@ -11,8 +11,10 @@ import (
 	"io/ioutil"
 	math_rand "math/rand"
 	"net"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -54,6 +56,7 @@ func (t *TestServer) Loop() {
 
 func (t *TestServer) handleConnection(rawConn net.Conn) {
 	conn := transport.NewServer(rawConn, &t.identity)
+	t.server.EnableResumption(conn)
 
 	if err := conn.Handshake(); err != nil {
 		panic(err)
@@ -386,6 +389,116 @@ func TestBadNewAccount(t *testing.T) {
 	})
 }
 
+func TestWebSocket(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "servertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var identity, identityPublic [32]byte
+	io.ReadFull(rand.Reader, identity[:])
+	curve25519.ScalarBaseMult(&identityPublic, &identity)
+
+	httpServer := httptest.NewServer(&webSocketHandler{NewServer(dir, true), &identity})
+	defer httpServer.Close()
+
+	host := strings.TrimPrefix(httpServer.URL, "http://")
+	rawConn, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := transport.DialWebSocket(rawConn, host, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clientIdentity, clientIdentityPublic [32]byte
+	io.ReadFull(rand.Reader, clientIdentity[:])
+	curve25519.ScalarBaseMult(&clientIdentityPublic, &clientIdentity)
+
+	conn := transport.NewClient(ws, &clientIdentity, &clientIdentityPublic, &identityPublic)
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteProto(&pond.Request{Fetch: new(pond.Fetch)}); err != nil {
+		t.Fatal(err)
+	}
+	reply := new(pond.Reply)
+	if err := conn.ReadProto(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Status == nil || *reply.Status != pond.Reply_NO_ACCOUNT {
+		t.Errorf("Bad reply when fetching over WebSocket: %s", reply)
+	}
+}
+
+func TestResumption(t *testing.T) {
+	t.Parallel()
+
+	server := NewTestServer(nil)
+	defer server.Close()
+
+	var identity, identityPublic [32]byte
+	io.ReadFull(rand.Reader, identity[:])
+	curve25519.ScalarBaseMult(&identityPublic, &identity)
+
+	var ticket *transport.Ticket
+	var pins transport.TicketKeyPins
+	for i := 0; i < 3; i++ {
+		rawConn, err := net.DialTCP("tcp", nil, server.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := transport.NewClient(rawConn, &identity, &identityPublic, &server.identityPublic)
+		if ticket != nil {
+			conn.SetTicket(ticket)
+		}
+		conn.SetTicketHandler(func(newTicket *transport.Ticket) {
+			ticket = newTicket
+		})
+		if err := conn.Handshake(); err != nil {
+			t.Fatalf("#%d: handshake failed: %s", i, err)
+		}
+		if resumed := conn.Resumed(); resumed != (i > 0) {
+			t.Errorf("#%d: resumed: %t", i, resumed)
+		}
+
+		ticketRequest, err := conn.TicketRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteProto(&pond.Request{Fetch: new(pond.Fetch), TicketRequest: ticketRequest}); err != nil {
+			t.Fatal(err)
+		}
+		reply := new(pond.Reply)
+		if err := conn.ReadProto(reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Status == nil || *reply.Status != pond.Reply_NO_ACCOUNT {
+			t.Errorf("#%d: bad reply: %s", i, reply)
+		}
+		if len(reply.Ticket) == 0 {
+			t.Fatalf("#%d: no ticket in reply", i)
+		}
+		if err := conn.AcceptTicket(reply.Ticket); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetTicketKeyHandler(pins.Pin)
+		if err := conn.AcceptTicketKey(reply.TicketKey); err != nil {
+			t.Fatalf("#%d: bad ticket key in reply: %s", i, err)
+		}
+		if !pins.Allows(ticket) {
+			t.Errorf("#%d: ticket wasn't issued with the presented key", i)
+		}
+		conn.Close()
+	}
+}
+
 func TestNewAccount(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/agl/pond/transport"
+)
+
+// webSocketHandler accepts connections that tunnel the transport inside
+// WebSocket messages, for clients that can only reach the server via HTTP.
+type webSocketHandler struct {
+	server   *Server
+	identity *[32]byte
+}
+
+func (h *webSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := transport.UpgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("Error from WebSocket upgrade: %s", err)
+		return
+	}
+
+	handleConnection(h.server, conn, h.identity)
+}
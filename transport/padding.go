@@ -0,0 +1,270 @@
+package transport
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	pond "github.com/agl/pond/protos"
+	"github.com/golang/protobuf/proto"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// PaddingPolicy controls the padding of records that follow the request and
+// reply: streamed data, the upload acknowledgement and the close record.
+// Without padding, the lengths of these records reveal the type of request
+// to anyone watching the connection. The policy doesn't change the handshake,
+// whose messages have the same lengths whatever the request, nor the request
+// and reply, which WriteProto always pads to pond.TransportSize.
+//
+// When a policy is in effect, every such record is exactly RecordSize bytes
+// long and its plaintext starts with a three byte header giving the record
+// type and the length of the payload.
+type PaddingPolicy struct {
+	// RecordSize is the length of every encrypted record, excluding the
+	// two length bytes.
+	RecordSize int
+	// DummyPercent is the chance, as a percentage, that a dummy record is
+	// written before each real record. Dummy records are discarded by the
+	// reader.
+	DummyPercent int
+}
+
+const (
+	// MinPaddedRecordSize and MaxPaddedRecordSize are the bounds of
+	// PaddingPolicy.RecordSize.
+	MinPaddedRecordSize = 256
+	MaxPaddedRecordSize = blockSize
+	// MaxDummyPercent is the largest value of PaddingPolicy.DummyPercent
+	// that a server will accept.
+	MaxDummyPercent = 50
+)
+
+// DefaultPaddingPolicy is the policy that clients offer by default. Records
+// are the size of a full streaming block so that bulk transfers cost very
+// little extra.
+var DefaultPaddingPolicy = PaddingPolicy{
+	RecordSize:   blockSize,
+	DummyPercent: 5,
+}
+
+// paddedHeaderLen is the length of the header at the beginning of the
+// plaintext of each padded record: a type byte and a little-endian, 16-bit
+// payload length.
+const paddedHeaderLen = 3
+
+const (
+	recordData  = 0
+	recordDummy = 1
+	recordClose = 2
+)
+
+// Marshal returns the protocol buffer form of p.
+func (p PaddingPolicy) Marshal() *pond.TransportPadding {
+	return &pond.TransportPadding{
+		RecordSize:   proto.Uint32(uint32(p.RecordSize)),
+		DummyPercent: proto.Uint32(uint32(p.DummyPercent)),
+	}
+}
+
+// NegotiatePadding is called by a server with a client's padding offer. It
+// returns the policy that the server will use, which should be echoed in the
+// reply, or false if the offer is unacceptable and no padding should be
+// used.
+func NegotiatePadding(offer *pond.TransportPadding) (PaddingPolicy, bool) {
+	if offer == nil {
+		return PaddingPolicy{}, false
+	}
+
+	p := PaddingPolicy{
+		RecordSize:   int(offer.GetRecordSize()),
+		DummyPercent: int(offer.GetDummyPercent()),
+	}
+	if offer.GetRecordSize() < MinPaddedRecordSize {
+		return PaddingPolicy{}, false
+	}
+	if offer.GetRecordSize() > MaxPaddedRecordSize {
+		p.RecordSize = MaxPaddedRecordSize
+	}
+	if offer.GetDummyPercent() > MaxDummyPercent {
+		p.DummyPercent = MaxDummyPercent
+	}
+	return p, true
+}
+
+// AcceptPadding is called by a client with the server's reply to a padding
+// offer. It returns the policy that the server selected, or an error if the
+// server's choice is invalid.
+func AcceptPadding(reply *pond.TransportPadding) (PaddingPolicy, error) {
+	p := PaddingPolicy{
+		RecordSize:   int(reply.GetRecordSize()),
+		DummyPercent: int(reply.GetDummyPercent()),
+	}
+	if reply.GetRecordSize() < MinPaddedRecordSize || reply.GetRecordSize() > MaxPaddedRecordSize || p.DummyPercent > 100 {
+		return PaddingPolicy{}, errors.New("transport: server selected invalid padding policy")
+	}
+	return p, nil
+}
+
+// SetPaddingPolicy causes all subsequent streamed records, as well as the
+// close record, to be padded according to p. Both sides of the connection
+// must switch to the same policy at the same point: the server after reading
+// the request and the client after reading the reply.
+func (c *Conn) SetPaddingPolicy(p PaddingPolicy) {
+	c.padding = p
+	c.paddingValid = true
+}
+
+// PaddingPolicy returns the padding policy in effect, if any.
+func (c *Conn) PaddingPolicy() (PaddingPolicy, bool) {
+	return c.padding, c.paddingValid
+}
+
+func (c *Conn) wantDummy() bool {
+	if c.padding.DummyPercent <= 0 {
+		return false
+	}
+	percent, err := randomPercent(rand.Reader)
+	if err != nil {
+		return false
+	}
+	return percent < c.padding.DummyPercent
+}
+
+// randomPercent returns a uniformly distributed number in [0, 100) using
+// bytes from r. Bytes of 200 and above are rejected because reducing them
+// would make the lower values more likely.
+func randomPercent(r io.Reader) (int, error) {
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, err
+		}
+		if b[0] < 200 {
+			return int(b[0]) % 100, nil
+		}
+	}
+}
+
+// writePaddedRecord writes a single record of the given type, which must
+// contain no more than the capacity of a padded record.
+func (c *Conn) writePaddedRecord(recordType byte, data []byte) error {
+	if c.writeBuffer == nil {
+		c.writeBuffer = make([]byte, blockSize+2)
+	}
+
+	plaintext := make([]byte, c.padding.RecordSize-secretbox.Overhead)
+	plaintext[0] = recordType
+	plaintext[1] = byte(len(data))
+	plaintext[2] = byte(len(data) >> 8)
+	copy(plaintext[paddedHeaderLen:], data)
+
+	l := len(secretbox.Seal(c.writeBuffer[2:2], plaintext, &c.writeSequence, &c.writeKey))
+	c.writeBuffer[0] = byte(l)
+	c.writeBuffer[1] = byte(l >> 8)
+	incSequence(&c.writeSequence)
+	_, err := c.conn.Write(c.writeBuffer[:2+l])
+	return err
+}
+
+func (c *Conn) writePadded(recordType byte, data []byte) error {
+	if c.wantDummy() {
+		if err := c.writePaddedRecord(recordDummy, nil); err != nil {
+			return err
+		}
+	}
+	return c.writePaddedRecord(recordType, data)
+}
+
+func (c *Conn) writePaddedStream(buf []byte) (n int, err error) {
+	capacity := c.padding.RecordSize - secretbox.Overhead - paddedHeaderLen
+
+	for len(buf) > 0 {
+		m := len(buf)
+		if m > capacity {
+			m = capacity
+		}
+		if err = c.writePadded(recordData, buf[:m]); err != nil {
+			return
+		}
+		n += m
+		buf = buf[m:]
+	}
+
+	return
+}
+
+// readPaddedRecord reads a single padded record and returns its type and
+// payload. The payload aliases c.decryptBuffer.
+func (c *Conn) readPaddedRecord() (recordType byte, data []byte, err error) {
+	if c.readBuffer == nil {
+		c.readBuffer = make([]byte, blockSize+2)
+	}
+
+	if _, err = io.ReadFull(c.conn, c.readBuffer[:2]); err != nil {
+		return
+	}
+	n := int(c.readBuffer[0]) | int(c.readBuffer[1])<<8
+	if n != c.padding.RecordSize {
+		return 0, nil, errors.New("transport: padded record has wrong length")
+	}
+	if _, err = io.ReadFull(c.conn, c.readBuffer[:n]); err != nil {
+		return
+	}
+
+	var ok bool
+	c.decryptBuffer, ok = secretbox.Open(c.decryptBuffer[:0], c.readBuffer[:n], &c.readSequence, &c.readKey)
+	incSequence(&c.readSequence)
+	if !ok {
+		return 0, nil, errors.New("transport: bad MAC")
+	}
+
+	recordType = c.decryptBuffer[0]
+	l := int(c.decryptBuffer[1]) | int(c.decryptBuffer[2])<<8
+	if l > len(c.decryptBuffer)-paddedHeaderLen {
+		return 0, nil, errors.New("transport: corrupt padded record")
+	}
+	data = c.decryptBuffer[paddedHeaderLen : paddedHeaderLen+l]
+	return
+}
+
+// readPaddedStream reads records until one containing data is found.
+func (c *Conn) readPaddedStream(out []byte) (n int, err error) {
+	for len(c.readPending) == 0 {
+		recordType, data, err := c.readPaddedRecord()
+		if err != nil {
+			return 0, err
+		}
+
+		switch recordType {
+		case recordData:
+			c.readPending = data
+		case recordDummy:
+		case recordClose:
+			return 0, io.EOF
+		default:
+			return 0, errors.New("transport: unknown padded record type")
+		}
+	}
+
+	n = copy(out, c.readPending)
+	c.readPending = c.readPending[n:]
+	return
+}
+
+func (c *Conn) waitForPaddedClose() error {
+	for {
+		recordType, _, err := c.readPaddedRecord()
+		if err != nil {
+			return err
+		}
+
+		switch recordType {
+		case recordDummy:
+		case recordClose:
+			return nil
+		default:
+			return errors.New("transport: non-close message received when expecting close")
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Session resumption allows a server to skip most of the public-key
+// operations of the handshake when a client presents a ticket. Tickets are
+// issued blindly so that the server can't link the session in which a ticket
+// is redeemed to the one in which it was issued, or to any other session.
+// That makes them suitable for anonymous deliveries as well as for
+// authenticated connections.
+//
+// A ticket is a random value, x, and the secret k·H(x), where H hashes onto
+// curve25519 and k is the server's ticket key. To obtain a ticket, the client
+// sends r·H(x) for a random r and the server replies with k·r·H(x), from
+// which the client removes r. The server never sees x or H(x) until the ticket
+// is redeemed. Each request asks for several tickets at once. The client also
+// blinds the base point, at a random position in the same request, and checks
+// the server's answer for it against the server's public ticket key, so that
+// a server that answered with a different key would be caught two times in
+// three.
+//
+// A server could still link tickets to the client that they were issued to by
+// using a different ticket key, and public key, for each client. Tickets are
+// requested on authenticated connections because anonymous deliveries are
+// padded to the full size and leave no room for a request. So the server also
+// presents its current public ticket key in every reply and clients pin the
+// keys that they see on anonymous connections, which the server can't tailor
+// to a client. A client only redeems a ticket on an anonymous connection if it
+// was issued with a pinned key. See TicketKeyPins.
+//
+// To redeem a ticket, the client appends x and a tag, keyed by the secret, to
+// the ephemeral public key in its first handshake message. Without a ticket,
+// the first message is just the ephemeral public key, as it always was, and
+// the server uses the length of the message to tell the two apart. Since a
+// client only has tickets for a server that issued them, servers that don't
+// support resumption never see the longer form. The server recomputes the
+// secret from x, checks the tag and derives the session keys from the secret.
+// Otherwise, or if the ticket has been redeemed before, it continues with a
+// full handshake. The server always replies with 32 bytes, which are an
+// ephemeral public key or a random nonce, so a network observer can see that
+// a client tried to resume a session, but not whether the server accepted
+// the ticket, other than by the server's timing. The client's identity is
+// authenticated in the same way in both cases.
+//
+// Resumed sessions don't have forward secrecy with respect to the ticket
+// key, which is another reason that ticket keys are rotated.
+
+const (
+	// ticketKeyRotation is the interval at which a server generates a new
+	// ticket key. Tickets for the previous key remain valid.
+	ticketKeyRotation = time.Hour
+	// TicketLifetime is the minimum time for which a ticket is valid.
+	TicketLifetime = ticketKeyRotation
+
+	// resumeMessageLen is the length of a client's first handshake
+	// message when it presents a ticket: an ephemeral public key followed
+	// by the ticket's x value and tag. Otherwise the first message is only
+	// the ephemeral public key.
+	resumeMessageLen = 32 + 32 + 32
+	// ticketsPerRequest is the number of tickets that a client asks for at
+	// once. Asking for more than one allows a client to build up a pool of
+	// tickets.
+	ticketsPerRequest = 2
+	// ticketRequestLen is the length of a request for tickets: a blinded
+	// point for each ticket and a blinded base point, in a random order.
+	ticketRequestLen = (ticketsPerRequest + 1) * 32
+	// ticketKeyLen is the length of a serialised TicketKey: the parity of
+	// the key's epoch and the public key.
+	ticketKeyLen = 1 + 32
+	// ticketReplyLen is the length of the server's reply to a ticket
+	// request: the key, as for ticketKeyLen, and the request's points
+	// multiplied by the private key.
+	ticketReplyLen = ticketKeyLen + ticketRequestLen
+)
+
+var resumeKeysMagic = []byte("resume keys\x00")
+var ticketTagMagic = []byte("ticket tag\x00")
+var ticketPointMagic = []byte("ticket point\x00")
+
+// fieldPrime is 2^255 - 19.
+var fieldPrime, _ = new(big.Int).SetString("57896044618658097711785492504343953926634992332820282019728792003956564819949", 10)
+
+// curveOrder is the order of curve25519's prime-order subgroup.
+var curveOrder, _ = new(big.Int).SetString("7237005577332262213973186563042994240857116359379907606001950938285454250989", 10)
+
+// curveA is the A coefficient of curve25519: v² = u³ + Au² + u.
+var curveA = big.NewInt(486662)
+
+// ticketKey is one of a server's ticket keys.
+type ticketKey struct {
+	private, public [32]byte
+	valid           bool
+	epoch           uint64
+	// spent contains the x values of tickets that have been redeemed with
+	// this key.
+	spent map[[32]byte]bool
+}
+
+// TicketKeys holds a server's current and previous ticket keys. The keys
+// alternate between two slots so that the parity of a key's epoch identifies
+// it.
+type TicketKeys struct {
+	sync.Mutex
+	keys    [2]ticketKey
+	epoch   uint64
+	rotated time.Time
+}
+
+// NewTicketKeys returns a set of ticket keys with a random, current key.
+func NewTicketKeys() (*TicketKeys, error) {
+	k := new(TicketKeys)
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate generates a new current key. The old current key becomes the
+// previous key and the old previous key is forgotten.
+func (k *TicketKeys) Rotate() error {
+	k.Lock()
+	defer k.Unlock()
+	return k.rotate()
+}
+
+func (k *TicketKeys) rotate() error {
+	key := ticketKey{
+		valid: true,
+		spent: make(map[[32]byte]bool),
+	}
+	if _, err := io.ReadFull(rand.Reader, key.private[:]); err != nil {
+		return err
+	}
+	curve25519.ScalarBaseMult(&key.public, &key.private)
+
+	k.epoch++
+	key.epoch = k.epoch
+	k.keys[k.epoch&1] = key
+	k.rotated = time.Now()
+	return nil
+}
+
+// maybeRotate rotates the keys if the current key is too old. If the
+// previous key is also too old then both are replaced.
+func (k *TicketKeys) maybeRotate() error {
+	age := time.Since(k.rotated)
+	if age <= ticketKeyRotation {
+		return nil
+	}
+	if err := k.rotate(); err != nil {
+		return err
+	}
+	if age > 2*ticketKeyRotation {
+		return k.rotate()
+	}
+	return nil
+}
+
+// current returns the current key and the parity of its epoch.
+func (k *TicketKeys) current() (ticketKey, byte, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	if err := k.maybeRotate(); err != nil {
+		return ticketKey{}, 0, err
+	}
+	parity := byte(k.epoch & 1)
+	return k.keys[parity], parity, nil
+}
+
+// issue answers a ticket request with the current key.
+func (k *TicketKeys) issue(request []byte) ([]byte, error) {
+	if len(request) != ticketRequestLen {
+		return nil, errors.New("transport: ticket request has wrong length")
+	}
+
+	key, parity, err := k.current()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 1, ticketReplyLen)
+	reply[0] = parity
+	reply = append(reply, key.public[:]...)
+	for i := 0; i < ticketRequestLen; i += 32 {
+		point, err := curve25519.X25519(key.private[:], request[i:i+32])
+		if err != nil {
+			return nil, err
+		}
+		reply = append(reply, point...)
+	}
+	return reply, nil
+}
+
+// secret returns the secret for a ticket with the given x value that was
+// issued with the key whose epoch has the given parity. It also returns the
+// key's epoch, for spend.
+func (k *TicketKeys) secret(x *[32]byte, parity byte) (*[32]byte, uint64, bool) {
+	k.Lock()
+	if err := k.maybeRotate(); err != nil {
+		k.Unlock()
+		return nil, 0, false
+	}
+	key := k.keys[parity&1]
+	k.Unlock()
+	if !key.valid {
+		return nil, 0, false
+	}
+
+	point, ok := hashToPoint(x)
+	if !ok {
+		return nil, 0, false
+	}
+	out, err := curve25519.X25519(key.private[:], point[:])
+	if err != nil {
+		return nil, 0, false
+	}
+	secret := new([32]byte)
+	copy(secret[:], out)
+	return secret, key.epoch, true
+}
+
+// spend records that the ticket with the given x value has been redeemed
+// with the key from the given epoch. It returns false if the ticket had
+// already been redeemed or if the key has since been replaced.
+func (k *TicketKeys) spend(x *[32]byte, epoch uint64) bool {
+	k.Lock()
+	defer k.Unlock()
+
+	key := &k.keys[epoch&1]
+	if !key.valid || key.epoch != epoch || key.spent[*x] {
+		return false
+	}
+	key.spent[*x] = true
+	return true
+}
+
+// hashToPoint maps x to a point on curve25519 (rather than its twist) by
+// trying successive hashes of x until one is the u coordinate of such a point.
+// Small-order components are removed by the clamped scalars of X25519.
+func hashToPoint(x *[32]byte) (point [32]byte, ok bool) {
+	var counter [1]byte
+	for i := 0; i < 64; i++ {
+		counter[0] = byte(i)
+		h := sha256.New()
+		h.Write(ticketPointMagic)
+		h.Write(x[:])
+		h.Write(counter[:])
+		h.Sum(point[:0])
+		point[31] &= 127
+
+		u := littleEndianToInt(point[:])
+		if u.Cmp(fieldPrime) >= 0 || u.Sign() == 0 {
+			continue
+		}
+		// u is on the curve if u³ + Au² + u is a square.
+		rhs := new(big.Int).Mul(u, u)
+		rhs.Add(rhs, new(big.Int).Mul(curveA, u))
+		rhs.Add(rhs, big.NewInt(1))
+		rhs.Mul(rhs, u)
+		rhs.Mod(rhs, fieldPrime)
+		if big.Jacobi(rhs, fieldPrime) == 1 {
+			return point, true
+		}
+	}
+	return point, false
+}
+
+func littleEndianToInt(b []byte) *big.Int {
+	be := make([]byte, len(b))
+	for i := range b {
+		be[len(b)-1-i] = b[i]
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+func intToLittleEndian(out *[32]byte, n *big.Int) {
+	be := n.Bytes()
+	for i := range out {
+		out[i] = 0
+	}
+	for i := range be {
+		out[i] = be[len(be)-1-i]
+	}
+}
+
+// newBlind returns a random scalar, r, and a scalar that multiplies r·P by
+// r⁻¹ for any point P in the prime-order subgroup. Both are unchanged by the
+// clamping that X25519 performs, which means that the second must be a
+// multiple of eight between 2^254 and 2^255.
+func newBlind() (scalar, unblind [32]byte, err error) {
+	eightInverse := new(big.Int).ModInverse(big.NewInt(8), curveOrder)
+
+	for {
+		if _, err = io.ReadFull(rand.Reader, scalar[:]); err != nil {
+			return
+		}
+		scalar[0] &= 248
+		scalar[31] &= 127
+		scalar[31] |= 64
+
+		inverse := new(big.Int).ModInverse(littleEndianToInt(scalar[:]), curveOrder)
+		if inverse == nil {
+			continue
+		}
+		inverse.Mul(inverse, eightInverse)
+		inverse.Mod(inverse, curveOrder)
+		if inverse.BitLen() != 252 {
+			continue
+		}
+		intToLittleEndian(&unblind, inverse.Lsh(inverse, 3))
+		return
+	}
+}
+
+// TicketKey identifies one of a server's ticket keys to a client.
+type TicketKey struct {
+	parity byte
+	public [32]byte
+}
+
+func parseTicketKey(b []byte) (*TicketKey, error) {
+	if len(b) != ticketKeyLen {
+		return nil, errors.New("transport: ticket key has wrong length")
+	}
+	if b[0] > 1 {
+		return nil, errors.New("transport: ticket key has bad parity")
+	}
+	key := &TicketKey{parity: b[0]}
+	copy(key.public[:], b[1:])
+	return key, nil
+}
+
+// TicketKeyPins records the ticket keys that a server has presented on
+// anonymous connections. The zero value is empty and ready to use.
+type TicketKeyPins struct {
+	keys [2]*TicketKey
+}
+
+// Pin records key as the server's key for the parity of its epoch, replacing
+// the key of an earlier epoch.
+func (p *TicketKeyPins) Pin(key *TicketKey) {
+	p.keys[key.parity] = key
+}
+
+// Allows returns true if t was issued with a pinned key, and so may be
+// redeemed on an anonymous connection.
+func (p *TicketKeyPins) Allows(t *Ticket) bool {
+	key := p.keys[t.key.parity]
+	return key != nil && subtle.ConstantTimeCompare(key.public[:], t.key.public[:]) == 1
+}
+
+// Ticket is a client's record of a resumption ticket.
+type Ticket struct {
+	x, secret [32]byte
+	// key is the key that the ticket was issued with.
+	key      TicketKey
+	Received time.Time
+}
+
+// Expired returns true if the server may no longer accept t.
+func (t *Ticket) Expired(now time.Time) bool {
+	// A minute of slack is allowed for the time taken to issue the
+	// ticket and to use it.
+	return now.Sub(t.Received) > TicketLifetime-time.Minute
+}
+
+// tag returns the tag that authenticates t in a first handshake message with
+// the given ephemeral public key. The low bit of the first byte is replaced by
+// the parity of t's key.
+func (t *Ticket) tag(ephemeralPublic []byte) []byte {
+	return ticketTag(&t.secret, ephemeralPublic, &t.x, t.key.parity)
+}
+
+func ticketTag(secret *[32]byte, ephemeralPublic []byte, x *[32]byte, parity byte) []byte {
+	h := hmac.New(sha256.New, secret[:])
+	h.Write(ticketTagMagic)
+	h.Write(ephemeralPublic)
+	h.Write(x[:])
+	tag := h.Sum(nil)
+	tag[0] = tag[0]&^1 | parity&1
+	return tag
+}
+
+// ticketRequest is a client's state for the tickets that it has requested.
+type ticketRequest struct {
+	x       [ticketsPerRequest][32]byte
+	unblind [ticketsPerRequest][32]byte
+	// check is the scalar by which the base point was blinded.
+	check [32]byte
+	// checkIndex is the position of the blinded base point in the request.
+	checkIndex int
+}
+
+// EnableResumption allows clients to resume sessions with tickets for keys
+// and allows IssueTicket to be called. It must be called before Handshake.
+func (c *Conn) EnableResumption(keys *TicketKeys) {
+	c.ticketKeys = keys
+}
+
+// TicketKey returns the server's current ticket key, to be sent to the
+// client, or nil if resumption isn't enabled. The client should pass it to
+// AcceptTicketKey.
+func (c *Conn) TicketKey() ([]byte, error) {
+	if !c.isServer {
+		panic("client tried to present a ticket key")
+	}
+	if c.ticketKeys == nil {
+		return nil, nil
+	}
+	key, parity, err := c.ticketKeys.current()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{parity}, key.public[:]...), nil
+}
+
+// IssueTicket returns the reply to a client's ticket request, or nil if
+// resumption isn't enabled.
+func (c *Conn) IssueTicket(request []byte) ([]byte, error) {
+	if !c.isServer {
+		panic("client tried to issue a ticket")
+	}
+	if c.ticketKeys == nil {
+		return nil, nil
+	}
+	return c.ticketKeys.issue(request)
+}
+
+// SetTicket causes the client to resume a session using t, which must not be
+// used again. It must be called before Handshake.
+func (c *Conn) SetTicket(t *Ticket) {
+	c.ticket = t
+}
+
+// SetTicketHandler sets a function that is called by AcceptTicket.
+func (c *Conn) SetTicketHandler(f func(*Ticket)) {
+	c.ticketHandler = f
+}
+
+// SetTicketKeyHandler sets a function that is called by AcceptTicketKey.
+func (c *Conn) SetTicketKeyHandler(f func(*TicketKey)) {
+	c.ticketKeyHandler = f
+}
+
+// AcceptTicketKey is called by a client with the server's ticket key, as
+// returned by TicketKey. The key is passed to the function given to
+// SetTicketKeyHandler, if any.
+func (c *Conn) AcceptTicketKey(b []byte) error {
+	key, err := parseTicketKey(b)
+	if err != nil {
+		return err
+	}
+	if c.ticketKeyHandler != nil {
+		c.ticketKeyHandler(key)
+	}
+	return nil
+}
+
+// WantsTickets returns true if a client has a handler for resumption tickets,
+// and so should ask the server for them.
+func (c *Conn) WantsTickets() bool {
+	return c.ticketHandler != nil
+}
+
+// TicketRequest returns a request for tickets, to be sent to the server.
+// The server's reply should be passed to AcceptTicket.
+func (c *Conn) TicketRequest() ([]byte, error) {
+	if c.isServer {
+		panic("server tried to request a ticket")
+	}
+
+	req := new(ticketRequest)
+	var points [ticketsPerRequest][]byte
+	for i := range req.x {
+		if _, err := io.ReadFull(rand.Reader, req.x[i][:]); err != nil {
+			return nil, err
+		}
+		point, ok := hashToPoint(&req.x[i])
+		if !ok {
+			return nil, errors.New("transport: failed to hash ticket to a point")
+		}
+		scalar, unblind, err := newBlind()
+		if err != nil {
+			return nil, err
+		}
+		req.unblind[i] = unblind
+		if points[i], err = curve25519.X25519(scalar[:], point[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.ReadFull(rand.Reader, req.check[:]); err != nil {
+		return nil, err
+	}
+	checkPoint, err := curve25519.X25519(req.check[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rejection sampling avoids biasing the position of the base point.
+	const limit = 256 - 256%(ticketsPerRequest+1)
+	index := [1]byte{limit}
+	for index[0] >= limit {
+		if _, err := io.ReadFull(rand.Reader, index[:]); err != nil {
+			return nil, err
+		}
+	}
+	req.checkIndex = int(index[0]) % (ticketsPerRequest + 1)
+
+	request := make([]byte, 0, ticketRequestLen)
+	for i, point := range points {
+		if i == req.checkIndex {
+			request = append(request, checkPoint...)
+		}
+		request = append(request, point...)
+	}
+	if req.checkIndex == ticketsPerRequest {
+		request = append(request, checkPoint...)
+	}
+	c.pendingTicket = req
+	return request, nil
+}
+
+// AcceptTicket is called by a client with the server's reply to the request
+// from TicketRequest. The resulting tickets are passed to the function given
+// to SetTicketHandler, if any.
+func (c *Conn) AcceptTicket(reply []byte) error {
+	req := c.pendingTicket
+	c.pendingTicket = nil
+	if req == nil {
+		return errors.New("transport: unexpected resumption ticket")
+	}
+	if len(reply) != ticketReplyLen {
+		return errors.New("transport: resumption ticket has wrong length")
+	}
+	key, err := parseTicketKey(reply[:ticketKeyLen])
+	if err != nil {
+		return err
+	}
+	var points [][]byte
+	for i := ticketKeyLen; i < len(reply); i += 32 {
+		points = append(points, reply[i:i+32])
+	}
+	checkPoint := points[req.checkIndex]
+	points = append(points[:req.checkIndex], points[req.checkIndex+1:]...)
+
+	expectedCheck, err := curve25519.X25519(req.check[:], key.public[:])
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(expectedCheck, checkPoint) != 1 {
+		return errors.New("transport: resumption ticket doesn't match server's ticket key")
+	}
+
+	var tickets []*Ticket
+	for i, blinded := range points {
+		secret, err := curve25519.X25519(req.unblind[i][:], blinded)
+		if err != nil {
+			return err
+		}
+		t := &Ticket{
+			x:        req.x[i],
+			key:      *key,
+			Received: time.Now(),
+		}
+		copy(t.secret[:], secret)
+		tickets = append(tickets, t)
+	}
+	if c.ticketHandler != nil {
+		for _, t := range tickets {
+			c.ticketHandler(t)
+		}
+	}
+	return nil
+}
+
+// Resumed returns true if the session was resumed from a ticket.
+func (c *Conn) Resumed() bool {
+	return c.resumed
+}
+
+// redeemTicket is called by a server with the client's first handshake
+// message. If the message contains a valid ticket that hasn't been redeemed
+// before then it returns the ticket's secret.
+func (c *Conn) redeemTicket(firstMessage []byte) (*[32]byte, bool) {
+	if c.ticketKeys == nil || len(firstMessage) != resumeMessageLen {
+		return nil, false
+	}
+
+	var x [32]byte
+	copy(x[:], firstMessage[32:64])
+	tag := firstMessage[64:96]
+	parity := tag[0] & 1
+
+	secret, epoch, ok := c.ticketKeys.secret(&x, parity)
+	if !ok {
+		return nil, false
+	}
+	if subtle.ConstantTimeCompare(ticketTag(secret, firstMessage[:32], &x, parity), tag) != 1 {
+		return nil, false
+	}
+	if !c.ticketKeys.spend(&x, epoch) {
+		return nil, false
+	}
+	return secret, true
+}
+
+// setupResumedKeys derives the session keys from a ticket's secret and the
+// hash of the first two handshake messages.
+func (c *Conn) setupResumedKeys(secret *[32]byte, transcript []byte) {
+	h := hmac.New(sha256.New, secret[:])
+	h.Write(resumeKeysMagic)
+	h.Write(transcript)
+	var shared [32]byte
+	h.Sum(shared[:0])
+	c.setupKeys(&shared)
+}
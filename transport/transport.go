@@ -6,7 +6,6 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"errors"
-	"hash"
 	"io"
 	"strconv"
 	"time"
@@ -47,6 +46,27 @@ type Conn struct {
 	// writeBuffer is used to hold encrypted payloads when this Conn is
 	// used for streaming data.
 	writeBuffer []byte
+
+	// padding contains the padding policy for streamed records, if
+	// paddingValid is true.
+	padding      PaddingPolicy
+	paddingValid bool
+
+	// resumed is true if the session was resumed from a ticket.
+	resumed bool
+	// ticketKeys, if not nil, allows a server to issue and accept
+	// tickets.
+	ticketKeys *TicketKeys
+	// ticket, if not nil, is used by a client to resume a session.
+	ticket *Ticket
+	// ticketHandler is called with tickets that a client receives.
+	ticketHandler func(*Ticket)
+	// ticketKeyHandler is called with ticket keys that a client
+	// receives.
+	ticketKeyHandler func(*TicketKey)
+	// pendingTicket contains the client's state for the ticket request
+	// most recently returned by TicketRequest.
+	pendingTicket *ticketRequest
 }
 
 func NewServer(conn io.ReadWriteCloser, identity *[32]byte) *Conn {
@@ -89,6 +109,10 @@ func (c *Conn) SetDeadline(t time.Time) {
 }
 
 func (c *Conn) Read(out []byte) (n int, err error) {
+	if c.paddingValid {
+		return c.readPaddedStream(out)
+	}
+
 	if len(c.readPending) > 0 {
 		n = copy(out, c.readPending)
 		c.readPending = c.readPending[n:]
@@ -132,6 +156,10 @@ func (c *Conn) Read(out []byte) (n int, err error) {
 }
 
 func (c *Conn) Write(buf []byte) (n int, err error) {
+	if c.paddingValid {
+		return c.writePaddedStream(buf)
+	}
+
 	if c.writeBuffer == nil {
 		c.writeBuffer = make([]byte, blockSize+2)
 	}
@@ -192,7 +220,11 @@ func (c *Conn) WriteProto(msg proto.Message) error {
 
 func (c *Conn) Close() (err error) {
 	if !c.isServer {
-		_, err = c.write(nil)
+		if c.paddingValid {
+			err = c.writePadded(recordClose, nil)
+		} else {
+			_, err = c.write(nil)
+		}
 	}
 
 	if closeErr := c.conn.Close(); err == nil {
@@ -206,6 +238,9 @@ func (c *Conn) WaitForClose() error {
 	if !c.isServer {
 		panic("non-server waited for connection close")
 	}
+	if c.paddingValid {
+		return c.waitForPaddedClose()
+	}
 	n, err := c.read(make([]byte, 128))
 	if err != nil {
 		return err
@@ -246,14 +281,14 @@ func (c *Conn) read(data []byte) (n int, err error) {
 func (c *Conn) write(data []byte) (n int, err error) {
 	encrypted := c.encrypt(data)
 
-	var lengthBytes [2]byte
-	lengthBytes[0] = byte(len(encrypted))
-	lengthBytes[1] = byte(len(encrypted) >> 8)
+	// The length and record are written with a single call so that
+	// message-based carriers, like WebSocketConn, see whole records.
+	record := make([]byte, 2+len(encrypted))
+	record[0] = byte(len(encrypted))
+	record[1] = byte(len(encrypted) >> 8)
+	copy(record[2:], encrypted)
 
-	if _, err := c.conn.Write(lengthBytes[:]); err != nil {
-		return 0, err
-	}
-	if _, err := c.conn.Write(encrypted); err != nil {
+	if _, err := c.conn.Write(record); err != nil {
 		return 0, err
 	}
 
@@ -313,16 +348,44 @@ var clientProofMagic = []byte("client proof\x00")
 var shortMessageError = errors.New("transport: received short handshake message")
 
 func (c *Conn) Handshake() error {
-	var ephemeralPrivate, ephemeralPublic, ephemeralShared [32]byte
+	if c.isServer {
+		return c.handshakeServer()
+	}
+	return c.handshakeClient()
+}
+
+// serverProof returns the server's proof of its identity, or of its
+// knowledge of a ticket's secret, given the hash of the first two handshake
+// messages.
+func serverProof(key *[32]byte, digest []byte) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write(serverProofMagic)
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+func (c *Conn) handshakeClient() error {
+	var ephemeralPrivate, ephemeralPublic [32]byte
 	if _, err := io.ReadFull(rand.Reader, ephemeralPrivate[:]); err != nil {
 		return err
 	}
 	curve25519.ScalarBaseMult(&ephemeralPublic, &ephemeralPrivate)
 
-	if _, err := c.write(ephemeralPublic[:]); err != nil {
+	// A ticket, if any, follows the ephemeral public key. See the comment
+	// at the top of ticket.go.
+	firstMessage := ephemeralPublic[:]
+	if c.ticket != nil {
+		firstMessage = make([]byte, 0, resumeMessageLen)
+		firstMessage = append(firstMessage, ephemeralPublic[:]...)
+		firstMessage = append(firstMessage, c.ticket.x[:]...)
+		firstMessage = append(firstMessage, c.ticket.tag(ephemeralPublic[:])...)
+	}
+	if _, err := c.write(firstMessage); err != nil {
 		return err
 	}
 
+	// The server replies with either its ephemeral public key or, if it
+	// accepted the ticket, a nonce.
 	var theirEphemeralPublic [32]byte
 	if n, err := c.read(theirEphemeralPublic[:]); err != nil || n != len(theirEphemeralPublic) {
 		if err == nil {
@@ -332,54 +395,52 @@ func (c *Conn) Handshake() error {
 	}
 
 	handshakeHash := sha256.New()
-	if c.isServer {
-		handshakeHash.Write(theirEphemeralPublic[:])
-		handshakeHash.Write(ephemeralPublic[:])
-	} else {
-		handshakeHash.Write(ephemeralPublic[:])
-		handshakeHash.Write(theirEphemeralPublic[:])
-	}
-
-	curve25519.ScalarMult(&ephemeralShared, &ephemeralPrivate, &theirEphemeralPublic)
-	c.setupKeys(&ephemeralShared)
-
-	if c.isServer {
-		return c.handshakeServer(handshakeHash, &theirEphemeralPublic)
-	}
-	return c.handshakeClient(handshakeHash, &ephemeralPrivate)
-}
-
-func (c *Conn) handshakeClient(handshakeHash hash.Hash, ephemeralPrivate *[32]byte) error {
-	var ephemeralIdentityShared [32]byte
-	curve25519.ScalarMult(&ephemeralIdentityShared, ephemeralPrivate, &c.Peer)
-
+	handshakeHash.Write(firstMessage)
+	handshakeHash.Write(theirEphemeralPublic[:])
 	digest := handshakeHash.Sum(nil)
-	h := hmac.New(sha256.New, ephemeralIdentityShared[:])
-	h.Write(serverProofMagic)
-	h.Write(digest)
-	digest = h.Sum(digest[:0])
 
-	digestReceived := make([]byte, len(digest)+secretbox.Overhead)
-	n, err := c.read(digestReceived)
+	sealedProof := make([]byte, sha256.Size+secretbox.Overhead)
+	n, err := c.read(sealedProof)
 	if err != nil {
 		return err
 	}
-	if n != len(digest) {
+	if n != len(sealedProof) {
 		return shortMessageError
 	}
-	digestReceived = digestReceived[:n]
 
-	if subtle.ConstantTimeCompare(digest, digestReceived) != 1 {
+	var expectedProof, proof []byte
+	if c.ticket != nil {
+		c.setupResumedKeys(&c.ticket.secret, digest)
+		if proof, c.resumed = secretbox.Open(nil, sealedProof, &c.readSequence, &c.readKey); c.resumed {
+			expectedProof = serverProof(&c.ticket.secret, digest)
+		}
+	}
+	if !c.resumed {
+		// The server didn't accept the ticket, or none was presented,
+		// so this is a full handshake.
+		var ephemeralShared, ephemeralIdentityShared [32]byte
+		curve25519.ScalarMult(&ephemeralShared, &ephemeralPrivate, &theirEphemeralPublic)
+		c.setupKeys(&ephemeralShared)
+		var ok bool
+		if proof, ok = secretbox.Open(nil, sealedProof, &c.readSequence, &c.readKey); !ok {
+			return errors.New("transport: bad MAC")
+		}
+		curve25519.ScalarMult(&ephemeralIdentityShared, &ephemeralPrivate, &c.Peer)
+		expectedProof = serverProof(&ephemeralIdentityShared, digest)
+	}
+	incSequence(&c.readSequence)
+
+	if subtle.ConstantTimeCompare(expectedProof, proof) != 1 {
 		return errors.New("transport: server identity incorrect")
 	}
 
 	var identityShared [32]byte
 	curve25519.ScalarMult(&identityShared, &c.identity, &c.Peer)
 
-	handshakeHash.Write(digest)
+	handshakeHash.Write(proof)
 	digest = handshakeHash.Sum(digest[:0])
 
-	h = hmac.New(sha256.New, identityShared[:])
+	h := hmac.New(sha256.New, identityShared[:])
 	h.Write(clientProofMagic)
 	h.Write(digest)
 
@@ -394,25 +455,69 @@ func (c *Conn) handshakeClient(handshakeHash hash.Hash, ephemeralPrivate *[32]by
 	return nil
 }
 
-func (c *Conn) handshakeServer(handshakeHash hash.Hash, theirEphemeralPublic *[32]byte) error {
-	var ephemeralIdentityShared [32]byte
-	curve25519.ScalarMult(&ephemeralIdentityShared, &c.identity, theirEphemeralPublic)
+func (c *Conn) handshakeServer() error {
+	// The server reads the client's first message before sending
+	// anything so that a resumed session needn't generate an ephemeral
+	// key.
+	firstMessage := make([]byte, resumeMessageLen)
+	n, err := c.read(firstMessage)
+	if err != nil {
+		return err
+	}
+	// The first message is either an ephemeral public key or, if the
+	// client is presenting a ticket, a longer message that starts with
+	// one.
+	if n != 32 && n != resumeMessageLen {
+		return shortMessageError
+	}
+	firstMessage = firstMessage[:n]
+	var theirEphemeralPublic [32]byte
+	copy(theirEphemeralPublic[:], firstMessage)
 
-	digest := handshakeHash.Sum(nil)
-	h := hmac.New(sha256.New, ephemeralIdentityShared[:])
-	h.Write(serverProofMagic)
-	h.Write(digest)
-	digest = h.Sum(digest[:0])
+	handshakeHash := sha256.New()
+	handshakeHash.Write(firstMessage)
 
-	if _, err := c.write(digest); err != nil {
+	var proof []byte
+	if secret, ok := c.redeemTicket(firstMessage); ok {
+		var nonce [32]byte
+		if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+			return err
+		}
+		if _, err := c.write(nonce[:]); err != nil {
+			return err
+		}
+		handshakeHash.Write(nonce[:])
+		digest := handshakeHash.Sum(nil)
+		c.setupResumedKeys(secret, digest)
+		c.resumed = true
+		proof = serverProof(secret, digest)
+	} else {
+		var ephemeralPrivate, ephemeralPublic, ephemeralShared, ephemeralIdentityShared [32]byte
+		if _, err := io.ReadFull(rand.Reader, ephemeralPrivate[:]); err != nil {
+			return err
+		}
+		curve25519.ScalarBaseMult(&ephemeralPublic, &ephemeralPrivate)
+		if _, err := c.write(ephemeralPublic[:]); err != nil {
+			return err
+		}
+		handshakeHash.Write(ephemeralPublic[:])
+		digest := handshakeHash.Sum(nil)
+
+		curve25519.ScalarMult(&ephemeralShared, &ephemeralPrivate, &theirEphemeralPublic)
+		c.setupKeys(&ephemeralShared)
+		curve25519.ScalarMult(&ephemeralIdentityShared, &c.identity, &theirEphemeralPublic)
+		proof = serverProof(&ephemeralIdentityShared, digest)
+	}
+
+	if _, err := c.write(proof); err != nil {
 		return err
 	}
 
-	handshakeHash.Write(digest)
-	digest = handshakeHash.Sum(digest[:0])
+	handshakeHash.Write(proof)
+	digest := handshakeHash.Sum(nil)
 
 	finalMessage := make([]byte, 32+sha256.Size+secretbox.Overhead)
-	n, err := c.read(finalMessage)
+	n, err = c.read(finalMessage)
 	if err != nil {
 		return err
 	}
@@ -425,7 +530,7 @@ func (c *Conn) handshakeServer(handshakeHash hash.Hash, theirEphemeralPublic *[3
 	var identityShared [32]byte
 	curve25519.ScalarMult(&identityShared, &c.identity, &c.Peer)
 
-	h = hmac.New(sha256.New, identityShared[:])
+	h := hmac.New(sha256.New, identityShared[:])
 	h.Write(clientProofMagic)
 	h.Write(digest)
 	digest = h.Sum(digest[:0])
@@ -2,15 +2,23 @@ package transport
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"testing"
 
 	pond "github.com/agl/pond/protos"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/secretbox"
 )
 
 func NewBiDiPipe() (x, y net.Conn) {
@@ -99,6 +107,136 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+// baselineHandshake performs the handshake as it was before session
+// resumption was added, when both sides sent their ephemeral public keys at
+// once.
+func baselineHandshake(c *Conn) error {
+	var ephemeralPrivate, ephemeralPublic, ephemeralShared, ephemeralIdentityShared, identityShared [32]byte
+	randBytes(ephemeralPrivate[:])
+	curve25519.ScalarBaseMult(&ephemeralPublic, &ephemeralPrivate)
+
+	if _, err := c.write(ephemeralPublic[:]); err != nil {
+		return err
+	}
+	var theirEphemeralPublic [32]byte
+	if n, err := c.read(theirEphemeralPublic[:]); err != nil || n != len(theirEphemeralPublic) {
+		if err == nil {
+			err = shortMessageError
+		}
+		return err
+	}
+
+	handshakeHash := sha256.New()
+	if c.isServer {
+		handshakeHash.Write(theirEphemeralPublic[:])
+		handshakeHash.Write(ephemeralPublic[:])
+	} else {
+		handshakeHash.Write(ephemeralPublic[:])
+		handshakeHash.Write(theirEphemeralPublic[:])
+	}
+	curve25519.ScalarMult(&ephemeralShared, &ephemeralPrivate, &theirEphemeralPublic)
+	c.setupKeys(&ephemeralShared)
+
+	if c.isServer {
+		curve25519.ScalarMult(&ephemeralIdentityShared, &c.identity, &theirEphemeralPublic)
+		proof := serverProof(&ephemeralIdentityShared, handshakeHash.Sum(nil))
+		if _, err := c.write(proof); err != nil {
+			return err
+		}
+		handshakeHash.Write(proof)
+
+		finalMessage := make([]byte, 32+sha256.Size+secretbox.Overhead)
+		n, err := c.read(finalMessage)
+		if err != nil {
+			return err
+		}
+		if n != 32+sha256.Size {
+			return shortMessageError
+		}
+		copy(c.Peer[:], finalMessage[:32])
+		curve25519.ScalarMult(&identityShared, &c.identity, &c.Peer)
+		h := hmac.New(sha256.New, identityShared[:])
+		h.Write(clientProofMagic)
+		h.Write(handshakeHash.Sum(nil))
+		if !hmac.Equal(h.Sum(nil), finalMessage[32:n]) {
+			return errors.New("bad proof from client")
+		}
+		return nil
+	}
+
+	curve25519.ScalarMult(&ephemeralIdentityShared, &ephemeralPrivate, &c.Peer)
+	expectedProof := serverProof(&ephemeralIdentityShared, handshakeHash.Sum(nil))
+	proof := make([]byte, sha256.Size+secretbox.Overhead)
+	n, err := c.read(proof)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(expectedProof, proof[:n]) {
+		return errors.New("server identity incorrect")
+	}
+	handshakeHash.Write(expectedProof)
+
+	curve25519.ScalarMult(&identityShared, &c.identity, &c.Peer)
+	h := hmac.New(sha256.New, identityShared[:])
+	h.Write(clientProofMagic)
+	h.Write(handshakeHash.Sum(nil))
+	finalMessage := append(c.identityPublic[:], h.Sum(nil)...)
+	_, err = c.write(finalMessage)
+	return err
+}
+
+func TestBaselineHandshake(t *testing.T) {
+	var serverPrivate, clientPrivate, serverPublic, clientPublic [32]byte
+
+	randBytes(serverPrivate[:])
+	randBytes(clientPrivate[:])
+	curve25519.ScalarBaseMult(&serverPublic, &serverPrivate)
+	curve25519.ScalarBaseMult(&clientPublic, &clientPrivate)
+
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, baselineServer := range []bool{false, true} {
+		x, y := NewBiDiPipe()
+		client := NewClient(x, &clientPrivate, &clientPublic, &serverPublic)
+		server := NewServer(y, &serverPrivate)
+		server.EnableResumption(keys)
+
+		serverError := make(chan error, 1)
+		go func() {
+			defer y.Close()
+			var err error
+			if baselineServer {
+				err = baselineHandshake(server)
+			} else {
+				err = server.Handshake()
+			}
+			if err == nil && !bytes.Equal(server.Peer[:], clientPublic[:]) {
+				err = errors.New("server's view of client's identity is incorrect")
+			}
+			if err == nil {
+				err = server.ReadProto(new(pond.Fetch))
+			}
+			serverError <- err
+		}()
+
+		if baselineServer {
+			err = client.Handshake()
+		} else {
+			err = baselineHandshake(client)
+		}
+		if err == nil {
+			err = client.WriteProto(&pond.Fetch{})
+		}
+		x.Close()
+		if serverErr := <-serverError; err != nil || serverErr != nil {
+			t.Errorf("handshake with baseline server: %t failed: client:'%s' server:'%s'", baselineServer, err, serverErr)
+		}
+	}
+}
+
 func TestStreamData(t *testing.T) {
 	var serverPrivate, clientPrivate, serverPublic, clientPublic [32]byte
 
@@ -154,3 +292,567 @@ func TestStreamData(t *testing.T) {
 	<-clientComplete
 	<-serverComplete
 }
+
+func TestWebSocket(t *testing.T) {
+	testWebSocket(t, false)
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	testWebSocket(t, true)
+}
+
+func testWebSocket(t *testing.T, useTLS bool) {
+	var serverPrivate, clientPrivate, serverPublic, clientPublic [32]byte
+
+	randBytes(serverPrivate[:])
+	randBytes(clientPrivate[:])
+	curve25519.ScalarBaseMult(&serverPublic, &serverPrivate)
+	curve25519.ScalarBaseMult(&clientPublic, &clientPrivate)
+
+	serverError := make(chan error, 1)
+	httpServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/pond" {
+			http.NotFound(w, r)
+			serverError <- errors.New("request for unexpected path " + r.URL.Path)
+			return
+		}
+		ws, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			serverError <- err
+			return
+		}
+		server := NewServer(ws, &serverPrivate)
+		defer server.Close()
+
+		err = server.Handshake()
+		if err == nil && !bytes.Equal(server.Peer[:], clientPublic[:]) {
+			err = errors.New("server's view of client's identity is incorrect")
+		}
+		if err == nil {
+			err = server.ReadProto(new(pond.Fetch))
+		}
+		if err == nil {
+			err = server.WriteProto(&pond.Reply{Status: pond.Reply_OK.Enum()})
+		}
+		if err == nil {
+			err = server.WaitForClose()
+		}
+		serverError <- err
+	}))
+	scheme := "ws://"
+	var tlsConfig *tls.Config
+	if useTLS {
+		httpServer.StartTLS()
+		scheme = "wss://"
+		roots := x509.NewCertPool()
+		roots.AddCert(httpServer.Certificate())
+		tlsConfig = &tls.Config{RootCAs: roots, ServerName: "example.com"}
+	} else {
+		httpServer.Start()
+	}
+	defer httpServer.Close()
+
+	u, err := url.Parse(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := url.Parse(scheme + u.Host + "/pond")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawConn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := DialWebSocketURL(rawConn, endpoint, tlsConfig)
+	if err != nil {
+		t.Fatalf("WebSocket upgrade failed: %s", err)
+	}
+
+	client := NewClient(ws, &clientPrivate, &clientPublic, &serverPublic)
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("handshake failed: %s", err)
+	}
+	if err := client.WriteProto(&pond.Fetch{}); err != nil {
+		t.Fatalf("failed to write request: %s", err)
+	}
+	reply := new(pond.Reply)
+	if err := client.ReadProto(reply); err != nil {
+		t.Fatalf("failed to read reply: %s", err)
+	}
+	if reply.GetStatus() != pond.Reply_OK {
+		t.Errorf("bad reply status: %s", reply.GetStatus())
+	}
+	client.Close()
+
+	if err := <-serverError; err != nil {
+		t.Fatalf("server failed: %s", err)
+	}
+
+	if useTLS {
+		// A certificate that doesn't chain to the given roots must be
+		// rejected.
+		rawConn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DialWebSocketURL(rawConn, endpoint, nil); err == nil {
+			t.Error("WebSocket over TLS accepted an untrusted certificate")
+		}
+		rawConn.Close()
+	}
+}
+
+// recordingConn wraps a connection and records the length of each write.
+type recordingConn struct {
+	net.Conn
+	lengths []int
+}
+
+func (r *recordingConn) Write(b []byte) (int, error) {
+	r.lengths = append(r.lengths, len(b))
+	return r.Conn.Write(b)
+}
+
+func TestPaddedStream(t *testing.T) {
+	var serverPrivate, clientPrivate, serverPublic, clientPublic [32]byte
+
+	randBytes(serverPrivate[:])
+	randBytes(clientPrivate[:])
+	curve25519.ScalarBaseMult(&serverPublic, &serverPrivate)
+	curve25519.ScalarBaseMult(&clientPublic, &clientPrivate)
+
+	x, y := NewBiDiPipe()
+	recorder := &recordingConn{Conn: x}
+	client := NewClient(recorder, &clientPrivate, &clientPublic, &serverPublic)
+	server := NewServer(y, &serverPrivate)
+
+	policy, ok := NegotiatePadding(PaddingPolicy{RecordSize: 1024, DummyPercent: 100}.Marshal())
+	if !ok {
+		t.Fatal("padding offer rejected")
+	}
+	if policy.DummyPercent != MaxDummyPercent {
+		t.Errorf("dummy percentage was not limited: %d", policy.DummyPercent)
+	}
+
+	data := make([]byte, 5000)
+	randBytes(data)
+
+	clientError := make(chan error, 1)
+	go func() {
+		defer x.Close()
+		err := client.Handshake()
+		if err == nil {
+			recorder.lengths = nil
+			client.SetPaddingPolicy(policy)
+			for _, chunk := range [][]byte{data[:1], data[1:100], data[100:]} {
+				if _, err = client.Write(chunk); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = client.Close()
+		}
+		clientError <- err
+	}()
+
+	serverError := make(chan error, 1)
+	go func() {
+		defer y.Close()
+		err := server.Handshake()
+		if err == nil {
+			server.SetPaddingPolicy(policy)
+			received := make([]byte, len(data))
+			if _, err = io.ReadFull(server, received); err == nil && !bytes.Equal(received, data) {
+				err = errors.New("received data doesn't match")
+			}
+		}
+		if err == nil {
+			err = server.WaitForClose()
+		}
+		serverError <- err
+	}()
+
+	if err := <-clientError; err != nil {
+		t.Fatalf("client error: %s", err)
+	}
+	if err := <-serverError; err != nil {
+		t.Fatalf("server error: %s", err)
+	}
+
+	if len(recorder.lengths) < 8 {
+		t.Errorf("too few records written: %d", len(recorder.lengths))
+	}
+	for i, l := range recorder.lengths {
+		if l != 2+policy.RecordSize {
+			t.Errorf("record %d has length %d, want %d", i, l, 2+policy.RecordSize)
+		}
+	}
+}
+
+func TestNegotiatePadding(t *testing.T) {
+	if _, ok := NegotiatePadding(nil); ok {
+		t.Error("no offer resulted in padding")
+	}
+	if _, ok := NegotiatePadding(PaddingPolicy{RecordSize: MinPaddedRecordSize - 1}.Marshal()); ok {
+		t.Error("undersized records were accepted")
+	}
+	policy, ok := NegotiatePadding(PaddingPolicy{RecordSize: 65535}.Marshal())
+	if !ok || policy.RecordSize != MaxPaddedRecordSize {
+		t.Errorf("oversized records were not limited: %#v", policy)
+	}
+	if _, err := AcceptPadding(PaddingPolicy{RecordSize: 65535}.Marshal()); err == nil {
+		t.Error("client accepted oversized records")
+	}
+}
+
+func TestRandomPercent(t *testing.T) {
+	// Bytes of 200 and above are rejected rather than reduced.
+	r := bytes.NewReader([]byte{255, 200, 199, 0, 150})
+	for _, want := range []int{99, 0, 50} {
+		got, err := randomPercent(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("randomPercent returned %d, but wanted %d", got, want)
+		}
+	}
+	if _, err := randomPercent(bytes.NewReader([]byte{255})); err == nil {
+		t.Error("randomPercent didn't fail when it ran out of input")
+	}
+}
+
+// resumableSession contains the results of runResumableSession.
+type resumableSession struct {
+	// ticket is the ticket issued during the session.
+	ticket *Ticket
+	// resumed is true if the session was resumed.
+	resumed bool
+	// clientLengths and serverLengths are the lengths of the records
+	// written during the handshake.
+	clientLengths, serverLengths []int
+	// request is the ticket request seen by the server.
+	request []byte
+}
+
+// runResumableSession runs a session between a client and a server with
+// resumption enabled. If ticket is non-nil, the client tries to resume with
+// it. The client asks for a new ticket after the handshake.
+func runResumableSession(keys *TicketKeys, ticket *Ticket, clientPrivate, clientPublic, serverPrivate, serverPublic *[32]byte) (*resumableSession, error) {
+	x, y := NewBiDiPipe()
+	clientRecorder := &recordingConn{Conn: x}
+	serverRecorder := &recordingConn{Conn: y}
+	client := NewClient(clientRecorder, clientPrivate, clientPublic, serverPublic)
+	server := NewServer(serverRecorder, serverPrivate)
+	server.EnableResumption(keys)
+	if ticket != nil {
+		client.SetTicket(ticket)
+	}
+
+	session := new(resumableSession)
+	client.SetTicketHandler(func(t *Ticket) {
+		session.ticket = t
+	})
+
+	serverError := make(chan error, 1)
+	go func() {
+		defer y.Close()
+		err := server.Handshake()
+		if err == nil && !bytes.Equal(server.Peer[:], clientPublic[:]) {
+			err = errors.New("server's view of client's identity is incorrect")
+		}
+		session.serverLengths = serverRecorder.lengths
+		request := make([]byte, ticketRequestLen+secretbox.Overhead)
+		var n int
+		if err == nil {
+			n, err = server.read(request)
+		}
+		var reply []byte
+		if err == nil {
+			session.request = request[:n]
+			reply, err = server.IssueTicket(session.request)
+		}
+		if err == nil {
+			_, err = server.write(reply)
+		}
+		serverError <- err
+	}()
+
+	err := client.Handshake()
+	session.clientLengths = clientRecorder.lengths
+	var request []byte
+	if err == nil {
+		request, err = client.TicketRequest()
+	}
+	if err == nil {
+		_, err = client.write(request)
+	}
+	if err == nil {
+		reply := make([]byte, ticketReplyLen+secretbox.Overhead)
+		var n int
+		if n, err = client.read(reply); err == nil {
+			err = client.AcceptTicket(reply[:n])
+		}
+	}
+	x.Close()
+	if serverErr := <-serverError; err == nil {
+		err = serverErr
+	}
+	session.resumed = client.Resumed()
+	if session.resumed != server.Resumed() && err == nil {
+		err = errors.New("client and server disagree about resumption")
+	}
+
+	return session, err
+}
+
+func TestResumption(t *testing.T) {
+	var serverPrivate, clientPrivate, serverPublic, clientPublic [32]byte
+
+	randBytes(serverPrivate[:])
+	randBytes(clientPrivate[:])
+	curve25519.ScalarBaseMult(&serverPublic, &serverPrivate)
+	curve25519.ScalarBaseMult(&clientPublic, &clientPrivate)
+
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(ticket *Ticket) *resumableSession {
+		session, err := runResumableSession(keys, ticket, &clientPrivate, &clientPublic, &serverPrivate, &serverPublic)
+		if err != nil {
+			t.Fatalf("session failed: %s", err)
+		}
+		if session.ticket == nil {
+			t.Fatalf("no ticket was issued")
+		}
+		return session
+	}
+
+	full := run(nil)
+	if full.resumed {
+		t.Fatalf("session without a ticket was resumed")
+	}
+
+	resumed := run(full.ticket)
+	if !resumed.resumed {
+		t.Fatalf("session with a ticket wasn't resumed")
+	}
+	if resumed.ticket.x == full.ticket.x || resumed.ticket.secret == full.ticket.secret {
+		t.Error("resumed session issued the same ticket")
+	}
+
+	// Without a ticket, the first message is only an ephemeral public key,
+	// as before resumption was supported.
+	if l := full.clientLengths[0]; l != 2+32 {
+		t.Errorf("first message without a ticket has length %d", l)
+	}
+
+	// The server never sees the ticket that it issued.
+	for _, b := range [][]byte{resumed.ticket.x[:], resumed.ticket.secret[:]} {
+		if bytes.Contains(resumed.request, b) {
+			t.Error("ticket request reveals the ticket")
+		}
+	}
+	point, _ := hashToPoint(&resumed.ticket.x)
+	if bytes.Contains(resumed.request, point[:]) {
+		t.Error("ticket request reveals the ticket's point")
+	}
+
+	// A ticket can only be used once. Later attempts fall back to a full
+	// handshake.
+	again := run(full.ticket)
+	if again.resumed {
+		t.Error("ticket was accepted twice")
+	}
+
+	// An observer can't tell whether the server accepted a ticket by the
+	// lengths of the handshake messages.
+	if !reflect.DeepEqual(again.clientLengths, resumed.clientLengths) || !reflect.DeepEqual(again.serverLengths, resumed.serverLengths) {
+		t.Errorf("handshake lengths differ: rejected %v/%v, resumed %v/%v", again.clientLengths, again.serverLengths, resumed.clientLengths, resumed.serverLengths)
+	}
+
+	// A corrupted ticket results in a full handshake.
+	corrupt := *resumed.ticket
+	corrupt.secret[0] ^= 1
+	if session := run(&corrupt); session.resumed {
+		t.Error("resumption with a corrupt ticket succeeded")
+	}
+
+	// Tickets remain valid after one rotation, but not two.
+	ticket := run(nil).ticket
+	if err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	session := run(ticket)
+	if !session.resumed {
+		t.Fatalf("resumption after rotation failed")
+	}
+	keys.Rotate()
+	keys.Rotate()
+	if session := run(session.ticket); session.resumed {
+		t.Error("resumption with a ticket from a forgotten key succeeded")
+	}
+}
+
+func TestTicketKeyCheck(t *testing.T) {
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A server that answers with a key other than the one that it claims
+	// is detected.
+	x, _ := NewBiDiPipe()
+	defer x.Close()
+	var identity [32]byte
+	client := NewClient(x, &identity, &identity, &identity)
+	request, err := client.TicketRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := otherKeys.issue(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(reply[1:33], keys.keys[keys.epoch&1].public[:])
+	if err := client.AcceptTicket(reply); err == nil {
+		t.Error("ticket from an inconsistent key was accepted")
+	}
+
+	request, err = client.TicketRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply, err = keys.issue(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.AcceptTicket(reply); err != nil {
+		t.Errorf("valid ticket was rejected: %s", err)
+	}
+	if err := client.AcceptTicket(reply); err == nil {
+		t.Error("ticket was accepted without a request")
+	}
+}
+
+func TestTicketKeyPins(t *testing.T) {
+	var serverPrivate, clientPrivate, serverPublic, clientPublic [32]byte
+
+	randBytes(serverPrivate[:])
+	randBytes(clientPrivate[:])
+	curve25519.ScalarBaseMult(&serverPublic, &serverPrivate)
+	curve25519.ScalarBaseMult(&clientPublic, &clientPrivate)
+
+	keys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeys, err := NewTicketKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := runResumableSession(keys, nil, &clientPrivate, &clientPublic, &serverPrivate, &serverPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket := session.ticket
+
+	var pins TicketKeyPins
+	// pin passes the key presented by a server with the given keys
+	// through a client that pins it.
+	pin := func(keys *TicketKeys) {
+		server := NewServer(nil, &serverPrivate)
+		server.EnableResumption(keys)
+		key, err := server.TicketKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewClient(nil, &clientPrivate, &clientPublic, &serverPublic)
+		client.SetTicketKeyHandler(pins.Pin)
+		if err := client.AcceptTicketKey(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pins.Allows(ticket) {
+		t.Error("ticket was allowed without a pinned key")
+	}
+
+	// A server that presents one key on anonymous connections, but
+	// issued a ticket with another, is detected.
+	pin(otherKeys)
+	if pins.Allows(ticket) {
+		t.Error("ticket from a key other than the pinned one was allowed")
+	}
+
+	pin(keys)
+	if !pins.Allows(ticket) {
+		t.Error("ticket from the pinned key wasn't allowed")
+	}
+
+	// Pinning the next key keeps the previous one, which has the other
+	// parity.
+	if err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	pin(keys)
+	if !pins.Allows(ticket) {
+		t.Error("ticket from the previous pinned key wasn't allowed")
+	}
+	keys.Rotate()
+	pin(keys)
+	if pins.Allows(ticket) {
+		t.Error("ticket from a replaced key was allowed")
+	}
+}
+
+func benchmarkHandshake(b *testing.B, resume bool) {
+	var serverPrivate, clientPrivate, serverPublic, clientPublic [32]byte
+
+	randBytes(serverPrivate[:])
+	randBytes(clientPrivate[:])
+	curve25519.ScalarBaseMult(&serverPublic, &serverPrivate)
+	curve25519.ScalarBaseMult(&clientPublic, &clientPrivate)
+
+	keys, err := NewTicketKeys()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var ticket *Ticket
+	if resume {
+		session, err := runResumableSession(keys, nil, &clientPrivate, &clientPublic, &serverPrivate, &serverPublic)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ticket = session.ticket
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		session, err := runResumableSession(keys, ticket, &clientPrivate, &clientPublic, &serverPrivate, &serverPublic)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if session.resumed != resume {
+			b.Fatalf("resumed: %t", session.resumed)
+		}
+		if resume {
+			ticket = session.ticket
+		}
+	}
+}
+
+func BenchmarkFullHandshake(b *testing.B) {
+	benchmarkHandshake(b, false)
+}
+
+func BenchmarkResumedHandshake(b *testing.B) {
+	benchmarkHandshake(b, true)
+}
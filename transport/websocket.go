@@ -0,0 +1,338 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocketConn carries a byte stream inside binary WebSocket messages
+// (RFC 6455). It's intended to be passed to NewClient or NewServer so that
+// the Pond transport can traverse networks that only permit HTTP(S). Every
+// call to Write produces exactly one WebSocket message and, since Conn
+// writes each record with a single Write, each record travels in its own
+// message. The framing provides no security: all the cryptography remains
+// in Conn.
+type WebSocketConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	isClient bool
+
+	// writeLock protects writes to conn because Read may need to answer a
+	// ping while another goroutine is writing.
+	writeLock sync.Mutex
+	// pending contains payload bytes that have been received but not yet
+	// returned from Read.
+	pending []byte
+	// readBuffer holds the payload of the most recently received frame.
+	readBuffer []byte
+	closed     bool
+}
+
+// maxWebSocketFrame is the largest frame payload that we'll accept. Pond
+// records are never larger than about 16KB so this leaves plenty of room.
+const maxWebSocketFrame = 1 << 16
+
+// webSocketGUID is the magic value from RFC 6455, section 1.3.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0
+	opText         = 1
+	opBinary       = 2
+	opClose        = 8
+	opPing         = 9
+	opPong         = 10
+)
+
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// DialWebSocket performs the client side of a WebSocket upgrade over conn,
+// which must already be connected (possibly via a proxy) to the server.
+// The host and path are used to form the HTTP request.
+func DialWebSocket(conn net.Conn, host, path string) (*WebSocketConn, error) {
+	if len(path) == 0 {
+		path = "/"
+	}
+
+	var nonce [16]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req, err := http.NewRequest("GET", "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("transport: WebSocket upgrade failed: " + resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, errors.New("transport: server did not upgrade to WebSocket")
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("transport: bad Sec-WebSocket-Accept from server")
+	}
+
+	return &WebSocketConn{
+		conn:     conn,
+		r:        r,
+		isClient: true,
+	}, nil
+}
+
+// DialWebSocketURL performs the client side of a WebSocket upgrade to the
+// endpoint named by a ws:// or wss:// URL. The conn argument must already be
+// connected (possibly via a proxy) to the endpoint's host. For wss:// URLs, a
+// TLS handshake is performed first and the server's certificate is verified
+// using config, which may be nil.
+func DialWebSocketURL(conn net.Conn, endpoint *url.URL, config *tls.Config) (*WebSocketConn, error) {
+	switch endpoint.Scheme {
+	case "ws":
+	case "wss":
+		if config == nil {
+			config = new(tls.Config)
+		} else {
+			config = config.Clone()
+		}
+		if len(config.ServerName) == 0 {
+			config.ServerName = endpoint.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	default:
+		return nil, errors.New("transport: WebSocket URL has unknown scheme: " + endpoint.Scheme)
+	}
+
+	return DialWebSocket(conn, endpoint.Host, endpoint.RequestURI())
+}
+
+// UpgradeWebSocket performs the server side of a WebSocket upgrade. On
+// error, an HTTP error has already been written to w.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	if r.Method != "GET" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("transport: request is not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, errors.New("transport: unsupported WebSocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if len(key) == 0 {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("transport: missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade connection", http.StatusInternalServerError)
+		return nil, errors.New("transport: ResponseWriter cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &WebSocketConn{
+		conn: conn,
+		r:    rw.Reader,
+	}, nil
+}
+
+func (ws *WebSocketConn) SetDeadline(t time.Time) error {
+	return ws.conn.SetDeadline(t)
+}
+
+func (ws *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if ws.isClient {
+		maskBit = 0x80
+	}
+	switch l := len(payload); {
+	case l < 126:
+		frame = append(frame, maskBit|byte(l))
+	case l < 1<<16:
+		frame = append(frame, maskBit|126, byte(l>>8), byte(l))
+	default:
+		var lenBytes [8]byte
+		binary.BigEndian.PutUint64(lenBytes[:], uint64(l))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, lenBytes[:]...)
+	}
+
+	if ws.isClient {
+		// Clients are required to mask frames, although the mask
+		// serves no purpose for us beyond compliance.
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// readFrame reads a single frame and returns its opcode and unmasked
+// payload. The payload aliases ws.readBuffer.
+func (ws *WebSocketConn) readFrame() (opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(ws.r, header[:]); err != nil {
+		return
+	}
+	if header[0]&0x70 != 0 {
+		return 0, nil, errors.New("transport: unexpected WebSocket extension bits")
+	}
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	if masked == ws.isClient {
+		return 0, nil, errors.New("transport: WebSocket frame has incorrect masking")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var lenBytes [2]byte
+		if _, err = io.ReadFull(ws.r, lenBytes[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(lenBytes[:]))
+	case 127:
+		var lenBytes [8]byte
+		if _, err = io.ReadFull(ws.r, lenBytes[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(lenBytes[:])
+	}
+	if length > maxWebSocketFrame {
+		return 0, nil, errors.New("transport: WebSocket frame too large")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(ws.r, mask[:]); err != nil {
+			return
+		}
+	}
+
+	if cap(ws.readBuffer) < int(length) {
+		ws.readBuffer = make([]byte, length)
+	}
+	payload = ws.readBuffer[:length]
+	if _, err = io.ReadFull(ws.r, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+
+	return
+}
+
+func (ws *WebSocketConn) Read(out []byte) (n int, err error) {
+	for len(ws.pending) == 0 {
+		if ws.closed {
+			return 0, io.EOF
+		}
+
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case opBinary, opContinuation:
+			ws.pending = payload
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return 0, err
+			}
+		case opPong:
+		case opClose:
+			ws.closed = true
+			return 0, io.EOF
+		default:
+			return 0, errors.New("transport: unexpected WebSocket opcode")
+		}
+	}
+
+	n = copy(out, ws.pending)
+	ws.pending = ws.pending[n:]
+	return
+}
+
+func (ws *WebSocketConn) Write(buf []byte) (n int, err error) {
+	if err := ws.writeFrame(opBinary, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+func (ws *WebSocketConn) Close() error {
+	// A close frame is sent on a best-effort basis: the peer may have
+	// already gone away.
+	ws.writeFrame(opClose, nil)
+	return ws.conn.Close()
+}